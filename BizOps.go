@@ -1,607 +1,17061 @@
-// BizPulse - One-file Revenue & Risk Intelligence Server
-// Features: CSV ingest, KPIs, anomalies, overdue detection, forecast, suggestions,
-// Slack alerts, optional OpenAI exec summary, HTML dashboard + JSON API, CLI report.
-//
-// Run:
-//   go run main.go -file=data.csv        # CLI mode -> report.md
-//   go run main.go -serve -port=8080     # Web mode -> upload & dashboard
-//
-// CSV expected headers (case-insensitive): date, customer, product, amount, status
-// - date: YYYY-MM-DD (flexible parsing attempted)
-// - amount: float (positive for revenue)
-// - status: "paid" / "unpaid" / "overdue" (free text ok; we'll detect unpaid/overdue heuristically)
-
-package main
-
-import (
-	"bytes"
-	"context"
-	"encoding/csv"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"html/template"
-	"io"
-	"log"
-	"math"
-	"net/http"
-	"os"
-	"sort"
-	"strconv"
-	"strings"
-	"time"
-)
-
-// -------- Data model --------
-
-type Sale struct {
-	Date    time.Time
-	Customer string
-	Product  string
-	Amount   float64
-	Status   string
-}
-
-type KPIs struct {
-	From, To               time.Time
-	TotalRevenue           float64
-	AvgOrderValue          float64
-	Orders                 int
-	UniqueCustomers        int
-	TopCustomers           []KVf
-	TopProducts            []KVf
-	DailyRevenue           []KVt
-	RetentionRate          float64
-	ForecastNext7DaysTotal float64
-	Anomalies              []Anomaly
-	OverdueCount           int
-	OverdueTotal           float64
-	Suggestions            []string
-	ExecSummary            string // optional (OpenAI)
-}
-
-type KVf struct {
-	Key   string
-	Value float64
-}
-
-type KVt struct {
-	Day   time.Time
-	Value float64
-}
-
-type Anomaly struct {
-	Day   time.Time
-	Value float64
-	Z     float64
-}
-
-// -------- CSV ingest --------
-
-func parseCSV(r io.Reader) ([]Sale, error) {
-	cr := csv.NewReader(r)
-	cr.TrimLeadingSpace = true
-	records, err := cr.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("csv read: %w", err)
-	}
-	if len(records) < 2 {
-		return nil, fmt.Errorf("csv has no data rows")
-	}
-	// Header map
-	h := map[string]int{}
-	for i, col := range records[0] {
-		h[strings.ToLower(strings.TrimSpace(col))] = i
-	}
-	get := func(row []string, key string) string {
-		for k, idx := range h {
-			if strings.Contains(k, key) { // flexible match
-				if idx >= 0 && idx < len(row) {
-					return strings.TrimSpace(row[idx])
-				}
-			}
-		}
-		return ""
-	}
-	var out []Sale
-	for _, row := range records[1:] {
-		ds := get(row, "date")
-		if ds == "" { continue }
-		dt := parseDateFlexible(ds)
-		if dt.IsZero() { continue }
-		amtStr := get(row, "amount")
-		amt, _ := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(amtStr), ",", ""), 64)
-		s := Sale{
-			Date:     dt,
-			Customer: nz(get(row, "customer"), "Unknown"),
-			Product:  nz(get(row, "product"), "Unknown"),
-			Amount:   amt,
-			Status:   strings.ToLower(get(row, "status")),
-		}
-		out = append(out, s)
-	}
-	return out, nil
-}
-
-func parseDateFlexible(s string) time.Time {
-	candidates := []string{
-		"2006-01-02", "02/01/2006", "01/02/2006", "2006/01/02", "2006.01.02", time.RFC3339,
-	}
-	s = strings.TrimSpace(s)
-	for _, f := range candidates {
-		if t, err := time.Parse(f, s); err == nil {
-			return t
-		}
-	}
-	// Try partial
-	if t, err := time.Parse("2006-01", s); err == nil { return t }
-	return time.Time{}
-}
-
-func nz(a, b string) string {
-	if strings.TrimSpace(a) == "" { return b }
-	return a
-}
-
-// -------- Analytics --------
-
-func computeKPIs(sales []Sale) KPIs {
-	if len(sales) == 0 { return KPIs{} }
-	sort.Slice(sales, func(i,j int) bool { return sales[i].Date.Before(sales[j].Date) })
-	from, to := sales[0].Date, sales[len(sales)-1].Date
-
-	var total float64
-	orders := 0
-	byCustomer := map[string]float64{}
-	byProduct  := map[string]float64{}
-	customers  := map[string]bool{}
-	// daily
-	dr := map[string]float64{}
-	// overdue
-	overdueCount := 0
-	var overdueTotal float64
-
-	for _, s := range sales {
-		total += s.Amount
-		orders++
-		byCustomer[s.Customer] += s.Amount
-		byProduct[s.Product] += s.Amount
-		customers[s.Customer] = true
-		key := s.Date.Format("2006-01-02")
-		dr[key] += s.Amount
-		// detect overdue/unpaid heuristics
-		if strings.Contains(s.Status, "overdue") || strings.Contains(s.Status, "unpaid") || strings.Contains(s.Status, "due") {
-			overdueCount++
-			overdueTotal += s.Amount
-		}
-	}
-
-	// to slice
-	var daily []KVt
-	for k,v := range dr {
-		d, _ := time.Parse("2006-01-02", k)
-		daily = append(daily, KVt{Day: d, Value: v})
-	}
-	sort.Slice(daily, func(i,j int) bool { return daily[i].Day.Before(daily[j].Day) })
-
-	// top N
-	topCust := topN(byCustomer, 5)
-	topProd := topN(byProduct, 5)
-
-	avgOrder := 0.0
-	if orders > 0 {
-		avgOrder = total / float64(orders)
-	}
-
-	// retention (very rough): % of customers appearing in >=2 distinct weeks
-	retention := retentionRate(sales)
-
-	// anomalies on daily revenue
-	anoms := detectAnomalies(daily)
-
-	// forecast 7-day naive (moving average over last 7 or up to 14 days)
-	forecast := forecast7(daily)
-
-	// suggestions
-	sug := suggestions(total, avgOrder, overdueCount, overdueTotal, topCust, topProd, anoms)
-
-	return KPIs{
-		From: from, To: to,
-		TotalRevenue: total,
-		AvgOrderValue: avgOrder,
-		Orders: orders,
-		UniqueCustomers: len(customers),
-		TopCustomers: topCust,
-		TopProducts: topProd,
-		DailyRevenue: daily,
-		RetentionRate: retention,
-		ForecastNext7DaysTotal: forecast,
-		Anomalies: anoms,
-		OverdueCount: overdueCount,
-		OverdueTotal: overdueTotal,
-		Suggestions: sug,
-	}
-}
-
-func topN(m map[string]float64, n int) []KVf {
-	var arr []KVf
-	for k,v := range m { arr = append(arr, KVf{k,v}) }
-	sort.Slice(arr, func(i,j int) bool { return arr[i].Value > arr[j].Value })
-	if len(arr) > n { arr = arr[:n] }
-	return arr
-}
-
-func retentionRate(sales []Sale) float64 {
-	// crude: map customer -> set of ISO weeks
-	type wk struct{ year, week int }
-	m := map[string]map[wk]bool{}
-	for _, s := range sales {
-		year, week := s.Date.ISOWeek()
-		w := wk{year,week}
-		if _, ok := m[s.Customer]; !ok { m[s.Customer] = map[wk]bool{} }
-		m[s.Customer][w] = true
-	}
-	retained := 0
-	for _, set := range m {
-		if len(set) >= 2 { retained++ }
-	}
-	if len(m) == 0 { return 0 }
-	return float64(retained) / float64(len(m))
-}
-
-func detectAnomalies(d []KVt) []Anomaly {
-	if len(d) < 7 { return nil }
-	// compute mean & std
-	var sum float64
-	for _, x := range d { sum += x.Value }
-	mean := sum / float64(len(d))
-	var ss float64
-	for _, x := range d { ss += (x.Value - mean) * (x.Value - mean) }
-	std := math.Sqrt(ss / float64(len(d)))
-	if std == 0 { return nil }
-	var out []Anomaly
-	for _, x := range d {
-		z := (x.Value - mean) / std
-		if math.Abs(z) >= 2.0 { // flag 2+ std
-			out = append(out, Anomaly{Day: x.Day, Value: x.Value, Z: z})
-		}
-	}
-	return out
-}
-
-func forecast7(d []KVt) float64 {
-	if len(d) == 0 { return 0 }
-	window := 7
-	if len(d) < window { window = len(d) }
-	var sum float64
-	for i:=len(d)-window; i<len(d); i++ {
-		sum += d[i].Value
-	}
-	avg := sum / float64(window)
-	return avg * 7.0
-}
-
-func suggestions(total, aov float64, overdueCount int, overdueTotal float64, topC, topP []KVf, anoms []Anomaly) []string {
-	var s []string
-	if overdueCount > 0 {
-		s = append(s, fmt.Sprintf("Initiate dunning workflow: %d overdue/unpaid invoices totaling $%.2f.", overdueCount, overdueTotal))
-	}
-	if aov < 50 {
-		s = append(s, "Test bundles/tiers to increase Average Order Value (cross-sell top products).")
-	}
-	if len(topC) > 0 {
-		s = append(s, fmt.Sprintf("Send loyalty offers to top customers: %s.", joinKV(topC)))
-	}
-	if len(topP) > 0 {
-		s = append(s, fmt.Sprintf("Double down on high-velocity products: %s.", joinKV(topP)))
-	}
-	for _, an := range anoms {
-		if an.Z < -2 {
-			s = append(s, fmt.Sprintf("Investigate revenue dip on %s (z=%.2f). Check campaigns, outages, pricing.", an.Day.Format("2006-01-02"), an.Z))
-		} else if an.Z > 2 {
-			s = append(s, fmt.Sprintf("Spike on %s (z=%.2f). Attribute uplift and try to replicate.", an.Day.Format("2006-01-02"), an.Z))
-		}
-	}
-	if total > 0 && aov > 0 && overdueCount == 0 && len(anoms) == 0 {
-		s = append(s, "Steady performance. Consider experimentation (price tests, reorder nudges) to uncover upside.")
-	}
-	return s
-}
-
-func joinKV(a []KVf) string {
-	var parts []string
-	for _, x := range a {
-		parts = append(parts, fmt.Sprintf("%s ($%.2f)", x.Key, x.Value))
-	}
-	return strings.Join(parts, ", ")
-}
-
-// -------- Slack + OpenAI (optional) --------
-
-func postSlack(webhook string, msg string) {
-	if webhook == "" { return }
-	body := map[string]string{"text": msg}
-	b, _ := json.Marshal(body)
-	http.Post(webhook, "application/json", bytes.NewReader(b))
-}
-
-func openAISummary(ctx context.Context, k KPIs) string {
-	key := os.Getenv("OPENAI_API_KEY")
-	if key == "" { return "" }
-	// minimal raw HTTP call to OpenAI Chat Completions (gpt-4o-mini)
-	payload := fmt.Sprintf(`{"model":"gpt-4o-mini","messages":[{"role":"system","content":"You write concise executive summaries for business performance."},{"role":"user","content":"Summarize these KPIs in 4 sentences, include 1-2 risks and 1-2 actionable next steps.\nFrom:%s To:%s\nRevenue: %.2f\nOrders: %d\nAOV: %.2f\nRetention: %.2f\nTopCustomers: %s\nTopProducts: %s\nOverdue: %d ($%.2f)\nForecast7: %.2f"}],"temperature":0.2}`,
-		k.From.Format("2006-01-02"), k.To.Format("2006-01-02"),
-		k.TotalRevenue, k.Orders, k.AvgOrderValue, k.RetentionRate,
-		joinKV(k.TopCustomers), joinKV(k.TopProducts), k.OverdueCount, k.OverdueTotal, k.ForecastNext7DaysTotal,
-	)
-	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", strings.NewReader(payload))
-	req.Header.Set("Authorization", "Bearer "+key)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil { return "" }
-	defer resp.Body.Close()
-	var raw struct{
-		Choices []struct{ Message struct{ Content string `json:"content"` } `json:"message"` } `json:"choices"`
-	}
-	_ = json.NewDecoder(resp.Body).Decode(&raw)
-	if len(raw.Choices) > 0 {
-		return strings.TrimSpace(raw.Choices[0].Message.Content)
-	}
-	return ""
-}
-
-// -------- HTML + API + CLI --------
-
-var tpl = template.Must(template.New("page").Parse(`
-<!doctype html><html><head>
-<meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
-<title>BizPulse</title>
-<style>
-body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
-.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
-h1{margin:0 0 10px 0} .muted{color:#9aa7cf} table{width:100%;border-collapse:collapse}
-th,td{border-bottom:1px solid #22305f;padding:8px;vertical-align:top}
-.badge{display:inline-block;background:#1b2a59;padding:4px 8px;border-radius:8px;margin-right:6px}
-svg{max-width:100%}
-button{background:#7aa2ff;color:#04102a;border:none;padding:8px 12px;border-radius:10px;cursor:pointer}
-input[type=file]{margin-top:8px}
-</style>
-</head><body>
-<h1>BizPulse</h1>
-<div class="card">
-  <h3>Upload CSV</h3>
-  <form method="POST" action="/upload" enctype="multipart/form-data">
-    <input type="file" name="file" required>
-    <button type="submit">Analyze</button>
-  </form>
-  <p class="muted">Columns: date, customer, product, amount, status (flexible order)</p>
-</div>
-
-{{if .KPIs}}
-<div class="card">
-  <h3>KPIs ({{.KPIs.From.Format "2006-01-02"}} → {{.KPIs.To.Format "2006-01-02"}})</h3>
-  <div class="badge">Revenue: ${{printf "%.2f" .KPIs.TotalRevenue}}</div>
-  <div class="badge">Orders: {{.KPIs.Orders}}</div>
-  <div class="badge">AOV: ${{printf "%.2f" .KPIs.AvgOrderValue}}</div>
-  <div class="badge">Unique Customers: {{.KPIs.UniqueCustomers}}</div>
-  <div class="badge">Retention: {{printf "%.1f" (mul100 .KPIs.RetentionRate)}}%</div>
-  <div class="badge">Forecast 7d: ${{printf "%.2f" .KPIs.ForecastNext7DaysTotal}}</div>
-</div>
-
-<div class="card">
-  <h3>Daily Revenue</h3>
-  {{ svgSpark .KPIs.DailyRevenue }}
-  {{ if .KPIs.Anomalies }}
-  <p class="muted">Anomalies: {{len .KPIs.Anomalies}}</p>
-  {{end}}
-</div>
-
-<div class="card">
-  <h3>Top Customers</h3>
-  <table><thead><tr><th>Customer</th><th>Revenue</th></tr></thead><tbody>
-  {{range .KPIs.TopCustomers}}<tr><td>{{.Key}}</td><td>${{printf "%.2f" .Value}}</td></tr>{{end}}
-  </tbody></table>
-</div>
-
-<div class="card">
-  <h3>Top Products</h3>
-  <table><thead><tr><th>Product</th><th>Revenue</th></tr></thead><tbody>
-  {{range .KPIs.TopProducts}}<tr><td>{{.Key}}</td><td>${{printf "%.2f" .Value}}</td></tr>{{end}}
-  </tbody></table>
-</div>
-
-<div class="card">
-  <h3>Risks & Actions</h3>
-  <ul>{{range .KPIs.Suggestions}}<li>{{.}}</li>{{end}}</ul>
-  {{if .KPIs.ExecSummary}}
-  <h4>Executive Summary (AI)</h4>
-  <p class="muted">{{.KPIs.ExecSummary}}</p>
-  {{end}}
-</div>
-{{end}}
-
-</body></html>
-`))
-
-// template funcs
-func mul100(f float64) float64 { return f*100 }
-
-func svgSpark(d []KVt) template.HTML {
-	if len(d) == 0 { return template.HTML("<p class='muted'>No data.</p>") }
-	// normalize
-	minV, maxV := d[0].Value, d[0].Value
-	for _, x := range d {
-		if x.Value < minV { minV = x.Value }
-		if x.Value > maxV { maxV = x.Value }
-	}
-	w, h := 600.0, 120.0
-	var pts []string
-	for i, x := range d {
-		px := float64(i) * (w / float64(max(1, len(d)-1)))
-		py := h - scale(x.Value, minV, maxV, 8, h-8)
-		pts = append(pts, fmt.Sprintf("%.1f,%.1f", px, py))
-	}
-	path := "M " + strings.Join(pts, " L ")
-	svg := fmt.Sprintf(`<svg viewBox="0 0 %.0f %.0f"><path d="%s" fill="none" stroke="#7aa2ff" stroke-width="2"/><line x1="0" y1="%.0f" x2="%.0f" y2="%.0f" stroke="#22305f"/></svg>`, w, h, path, h-0.5, w, h-0.5)
-	return template.HTML(svg)
-}
-
-func scale(v, min, max, a, b float64) float64 {
-	if max == min { return (a+b)/2 }
-	return a + (v-min)*(b-a)/(max-min)
-}
-func max(a,b int) int { if a>b {return a}; return b }
-
-// server state
-var latestKPIs *KPIs
-
-func main() {
-	var (
-		file  = flag.String("file", "", "CSV file to analyze (CLI mode)")
-		serve = flag.Bool("serve", false, "Start HTTP server")
-		port  = flag.Int("port", 8080, "HTTP port")
-	)
-	flag.Parse()
-
-	// register funcs
-	tpl = tpl.Funcs(template.FuncMap{
-		"svgSpark": svgSpark,
-		"mul100": mul100,
-	})
-
-	if *serve {
-		http.HandleFunc("/", handleIndex)
-		http.HandleFunc("/upload", handleUpload)
-		http.HandleFunc("/api/kpis", handleKPIs)
-		addr := fmt.Sprintf(":%d", *port)
-		log.Printf("BizPulse server on %s", addr)
-		log.Fatal(http.ListenAndServe(addr, nil))
-		return
-	}
-
-	if *file != "" {
-		if err := runCLI(*file); err != nil {
-			log.Fatal(err)
-		}
-		return
-	}
-
-	fmt.Println("Usage:")
-	fmt.Println("  go run main.go -file=data.csv           # CLI: outputs report.md")
-	fmt.Println("  go run main.go -serve -port=8080        # Web: upload & dashboard")
-}
-
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	var data struct{ KPIs *KPIs }
-	data.KPIs = latestKPIs
-	_ = tpl.Execute(w, data)
-}
-
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(50<<20); err != nil {
-		http.Error(w, err.Error(), 400); return
-	}
-	f, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "file is required", 400); return
-	}
-	defer f.Close()
-	sales, err := parseCSV(f)
-	if err != nil {
-		http.Error(w, "parse: "+err.Error(), 400); return
-	}
-	k := computeKPIs(sales)
-	// AI exec summary (optional)
-	if os.Getenv("OPENAI_API_KEY") != "" {
-		ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
-		defer cancel()
-		k.ExecSummary = openAISummary(ctx, k)
-	}
-	latestKPIs = &k
-	// push alerts if anomalies or overdue
-	if len(k.Anomalies) > 0 || k.OverdueCount > 0 {
-		msg := fmt.Sprintf("BizPulse Alert: %d anomalies; %d overdue ($%.2f). Period %s→%s. Rev $%.2f.",
-			len(k.Anomalies), k.OverdueCount, k.OverdueTotal,
-			k.From.Format("2006-01-02"), k.To.Format("2006-01-02"), k.TotalRevenue)
-		postSlack(os.Getenv("SLACK_WEBHOOK"), msg)
-	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-func handleKPIs(w http.ResponseWriter, _ *http.Request) {
-	if latestKPIs == nil {
-		http.Error(w, "no KPIs yet", 404); return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(latestKPIs)
-}
-
-func runCLI(path string) error {
-	f, err := os.Open(path)
-	if err != nil { return err }
-	defer f.Close()
-	sales, err := parseCSV(f)
-	if err != nil { return err }
-	k := computeKPIs(sales)
-	// AI exec summary
-	if os.Getenv("OPENAI_API_KEY") != "" {
-		ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
-		defer cancel()
-		k.ExecSummary = openAISummary(ctx, k)
-	}
-	md := renderMarkdown(k)
-	if err := os.WriteFile("report.md", []byte(md), 0644); err != nil {
-		return err
-	}
-	fmt.Println("Wrote report.md")
-	// Slack alert if needed
-	if len(k.Anomalies) > 0 || k.OverdueCount > 0 {
-		msg := fmt.Sprintf("BizPulse Alert: %d anomalies; %d overdue ($%.2f). Period %s→%s. Rev $%.2f.",
-			len(k.Anomalies), k.OverdueCount, k.OverdueTotal,
-			k.From.Format("2006-01-02"), k.To.Format("2006-01-02"), k.TotalRevenue)
-		postSlack(os.Getenv("SLACK_WEBHOOK"), msg)
-	}
-	return nil
-}
-
-func renderMarkdown(k KPIs) string {
-	var b strings.Builder
-	fmt.Fprintf(&b, "# BizPulse Report (%s → %s)\n\n", k.From.Format("2006-01-02"), k.To.Format("2006-01-02"))
-	fmt.Fprintf(&b, "- **Revenue:** $%.2f\n- **Orders:** %d\n- **AOV:** $%.2f\n- **Unique Customers:** %d\n- **Retention:** %.1f%%\n- **Forecast (7d):** $%.2f\n\n",
-		k.TotalRevenue, k.Orders, k.AvgOrderValue, k.UniqueCustomers, k.RetentionRate*100, k.ForecastNext7DaysTotal)
-	if len(k.TopCustomers) > 0 {
-		fmt.Fprintf(&b, "## Top Customers\n")
-		for _, kv := range k.TopCustomers {
-			fmt.Fprintf(&b, "- %s: $%.2f\n", kv.Key, kv.Value)
-		}
-		fmt.Fprintln(&b)
-	}
-	if len(k.TopProducts) > 0 {
-		fmt.Fprintf(&b, "## Top Products\n")
-		for _, kv := range k.TopProducts {
-			fmt.Fprintf(&b, "- %s: $%.2f\n", kv.Key, kv.Value)
-		}
-		fmt.Fprintln(&b)
-	}
-	if len(k.Anomalies) > 0 {
-		fmt.Fprintf(&b, "## Anomalies\n")
-		for _, a := range k.Anomalies {
-			fmt.Fprintf(&b, "- %s: $%.2f (z=%.2f)\n", a.Day.Format("2006-01-02"), a.Value, a.Z)
-		}
-		fmt.Fprintln(&b)
-	}
-	if k.OverdueCount > 0 {
-		fmt.Fprintf(&b, "## Overdue / Unpaid\n- Count: %d\n- Total: $%.2f\n\n", k.OverdueCount, k.OverdueTotal)
-	}
-	if len(k.Suggestions) > 0 {
-		fmt.Fprintf(&b, "## Recommendations\n")
-		for _, s := range k.Suggestions {
-			fmt.Fprintf(&b, "- %s\n", s)
-		}
-		fmt.Fprintln(&b)
-	}
-	if k.ExecSummary != "" {
-		fmt.Fprintf(&b, "## Executive Summary (AI)\n%s\n", k.ExecSummary)
-	}
-	return b.String()
-}
+// BizPulse - One-file Revenue & Risk Intelligence Server
+// Features: CSV ingest, KPIs, anomalies, overdue detection, forecast, suggestions,
+// Slack alerts, optional OpenAI exec summary, HTML dashboard + JSON API, CLI report.
+//
+// Run:
+//   go run main.go -file=data.csv        # CLI mode -> report.md
+//   go run main.go -serve -port=8080     # Web mode -> upload & dashboard
+//
+// CSV expected headers (case-insensitive): date, customer, product, amount, status
+// - date: YYYY-MM-DD (flexible parsing attempted)
+// - amount: float (positive for revenue)
+// - status: "paid" / "unpaid" / "overdue" (free text ok; we'll detect unpaid/overdue heuristically)
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// -------- Data model --------
+
+type Sale struct {
+	Date    time.Time
+	Customer string
+	RawCustomer string // customer name as ingested, before merges/renames
+	Product  string
+	Amount   float64
+	Status   string
+	Rep      string // optional sales rep column
+	Region   string // optional region/territory column
+	Campaign string // optional campaign/source column
+	Invoice  string // optional invoice id, used to dedupe merged uploads
+	Currency   string  // optional ISO code; empty means the base currency
+	OrigAmount float64 // Amount in Currency before conversion to the base currency
+	Due        time.Time // optional due date; receivables age from it when set
+	Tax        float64   // optional tax included in Amount, in Currency like OrigAmount
+	Discount   float64   // optional discount already taken off Amount, in Currency
+	Quantity   float64   // optional units; 0 when the data has no quantity
+	Category   string    // optional product category
+	Channel    string    // optional sales channel (e.g. online, retail, partner)
+	Email      string    // optional customer email; its domain can name the company and country
+	Country    string    // optional ISO 3166 alpha-2 country, normalized from a country column
+}
+
+// inBase converts v, in the sale's own currency like OrigAmount, to the base currency.
+func (s Sale) inBase(v float64) float64 {
+	if s.OrigAmount == 0 || s.OrigAmount == s.Amount { return v }
+	return v * s.Amount / s.OrigAmount
+}
+
+type KPIs struct {
+	From, To               time.Time
+	TotalRevenue           float64
+	AvgOrderValue          float64
+	Orders                 int
+	UniqueCustomers        int
+	Days                   int               // distinct days with sales
+	Insufficient           map[string]string // sections left out for lack of history, with the reason
+	Health                 *HealthScore // composite 0-100 score with component breakdown
+	TopCustomers           []KVf
+	TopProducts            []KVf
+	TopByLTV               []CustomerLTV // highest projected lifetime value
+	AtRisk                 []AtRiskCustomer // customers whose purchase cadence has broken
+	KeyAccounts            []KeyAccountForecast // per-account forecasts for the configured key accounts
+	Pricing                *Pricing // tax, discounts and units; nil without those columns
+	DailyRevenue           []KVt
+	WeeklyRevenue          []KVt // keyed by the Monday of each ISO week
+	MonthlyRevenue         []KVt // keyed by the first of each month
+	AccountRollups         []AccountRollup // top parent accounts with child drill-down
+	Categories             []CategoryRollup // product categories with product drill-down; nil without categories
+	Countries              []CountryRollup  // revenue by country with company drill-down; nil when no row has a country
+	Concentration          float64         // share of revenue from the top 5 accounts
+	OverdueByAccount       []KVf
+	Receivables            *Receivables // aging of open invoices and DSO; nil when none are open
+	Refunds                *Refunds     // negative-amount rows; nil when there are none
+	RetentionRate          float64
+	ForecastNext7DaysTotal float64
+	Forecast               *Forecast // daily projection with confidence band
+	Momentum               *Momentum // run-rate ratio, acceleration and growth streaks
+	Comparisons            []PeriodComparison // week, month and year over year, to date
+	Anomalies              []Anomaly
+	AnomalyMethod          AnomalyMethod // detector and parameters behind Anomalies
+	AnomalyExclusions      []Exclusion   // date windows left out of anomaly detection
+	SegmentAnomalies       []SegmentAnomaly // per top account and product, ongoing first
+	OverdueCount           int
+	OverdueTotal           float64
+	Territories            []TerritoryStat // quota leaderboard, best attainment first
+	Targets                []TargetStat    // revenue targets for the current week or month
+	Tiers                  *TierReport     // revenue-percentile tiers for the latest month
+	Bridge                 *RevenueBridge  // last 30 days vs the 30 before, by customer
+	Restatements           []Restatement   // revisions to previously reported days, oldest first
+	RankChanges            []RankChange    // top customer/product list movements since the previous analysis
+	ForecastTracking       *ForecastTracking // forecast vs actual, once earlier forecasts cover loaded days
+	Funnel                 *Funnel         // only when a leads file was supplied
+	Campaigns              []CampaignStat  // only when a campaign/source column exists
+	Events                 []Event         // events log entries within From..To
+	BaseCurrency           string          // currency of all totals, when conversion is configured
+	Currencies             []CurrencyTotal // per-currency revenue, only when a currency column exists
+	Currency               string          // currency the totals are in (dataset metadata); "" when not known
+	Unit                   string          // what quantities count (dataset metadata), e.g. "kg"
+	Conversion             *FXConversion   // set when the API converted the totals at query time
+	Suggestions            []Suggestion // largest estimated impact first
+	Preset                 string       // business-type preset the suggestions follow
+	ExecSummary            string // optional (OpenAI)
+	Quality                []*DataQuality // per file read, for the CLI report; the server keeps it on the Analysis
+}
+
+// Suggestion is a recommended action with its estimated dollar impact. Impact is 0 when
+// there is no sensible estimate; those rank last. Key identifies the suggestion across
+// reports (e.g. "dunning", "dip:2025-07-04") so its status can be tracked.
+type Suggestion struct {
+	Key    string
+	Text   string
+	Impact float64
+	Basis  string // how Impact was estimated
+}
+
+type KVf struct {
+	Key   string
+	Value float64
+}
+
+type KVt struct {
+	Day   time.Time
+	Value float64
+}
+
+type Anomaly struct {
+	Day       time.Time
+	Value     float64
+	Z         float64
+	Campaigns []string // campaigns that started shortly before a spike
+	Events    []string // logged events on or just before the day (see annotateEvents)
+	Reviewed  bool     // already alerted with identical data for that day; not re-alerted
+	Restated  bool     // already alerted, but the day's rows have since changed
+}
+
+// Lead is a signup from the optional leads file, matched to sales by customer name.
+type Lead struct {
+	Customer string
+	Date     time.Time
+	Source   string
+}
+
+// Funnel summarizes lead-to-customer conversion.
+type Funnel struct {
+	Leads                     int
+	Converted                 int
+	ConversionRate            float64
+	MedianDaysToFirstPurchase float64
+	Cohorts                   []LeadCohort
+}
+
+// LeadCohort is the conversion curve for leads signed up in one month:
+// ConvertedWithin[i] is the share converted within funnelWindows[i] days.
+type LeadCohort struct {
+	Month           time.Time
+	Leads           int
+	ConvertedWithin []float64
+}
+
+var funnelWindows = []int{7, 14, 30, 60, 90}
+
+// CampaignStat is revenue attribution for one campaign/source value.
+type CampaignStat struct {
+	Name             string
+	Start            time.Time // from the spend file, else the campaign's first sale
+	Revenue          float64
+	Orders           int
+	AOV              float64
+	NewCustomerShare float64 // share of the campaign's customers whose first order came through it
+	Spend            float64
+	ROI              float64 // (revenue - spend) / spend; 0 without spend
+}
+
+// CampaignSpend is one row of the optional spend file (campaign, spend, start).
+type CampaignSpend struct {
+	Campaign string
+	Spend    float64
+	Start    time.Time
+}
+
+// campaignLeadDays is how soon after a campaign start a spike is attributed to it.
+const campaignLeadDays = 3
+
+// AccountRollup is a parent account with the child customers that rolled up into it.
+type AccountRollup struct {
+	Account  string
+	Revenue  float64
+	Overdue  float64
+	Children []KVf
+}
+
+// TerritoryStat is quota attainment for one territory in the period containing the latest sale.
+type TerritoryStat struct {
+	Name        string
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Quota       float64
+	Revenue     float64
+	Attainment  float64 // revenue / quota
+	Pace        float64 // attainment / elapsed fraction of the period (1.0 = on track)
+	Projected   float64 // revenue extrapolated to the full period
+	Behind      bool    // mid-period and pace below cfg.PaceAlert
+}
+
+// TargetStat is attainment of one revenue target in the period containing the latest sale.
+type TargetStat struct {
+	Name                string
+	Period              string // week or month
+	PeriodStart         time.Time
+	PeriodEnd           time.Time
+	Target              float64
+	Revenue             float64
+	Attainment          float64 // revenue / target (percent-to-target)
+	Elapsed             float64 // fraction of the period's days through the latest sale
+	Pace                float64 // attainment / elapsed (1.0 = on track)
+	Remaining           float64 // revenue expected over the rest of the period
+	Basis               string  // where Remaining comes from: forecast or run rate
+	Projected           float64 // revenue + remaining
+	ProjectedAttainment float64 // projected / target
+	Gap                 float64 // target - projected, when projected falls short
+	Behind              bool    // mid-period and projected attainment below cfg.TargetAlert
+	Saved               bool    // added from the dashboard rather than the config
+}
+
+// -------- Config --------
+
+// Config holds optional analysis settings, loaded from a JSON file via -config.
+type Config struct {
+	// ParentAccounts maps a child customer name to its parent account.
+	ParentAccounts map[string]string `json:"parentAccounts"`
+	// ProductCategories maps a product to its category, for rows without a category column.
+	ProductCategories map[string]string `json:"productCategories"`
+	// CompanyDomains names the company behind an email domain where the domain's own name
+	// won't do, e.g. {"acme-corp.com": "Acme Corporation"}.
+	CompanyDomains map[string]string `json:"companyDomains"`
+	// KeyAccounts are customers or parent accounts forecast individually, with an alert
+	// when one's expected next order is overdue.
+	KeyAccounts []string `json:"keyAccounts"`
+	// Territories define quotas per rep or region.
+	Territories []Territory `json:"territories"`
+	// PaceAlert flags territories whose pace falls below this ratio mid-period (default 0.9).
+	PaceAlert float64 `json:"paceAlert"`
+	// Targets are revenue targets per week or month, tracked against actuals and the
+	// forecast; more can be added from the dashboard.
+	Targets []Target `json:"targets"`
+	// TargetAlert alerts when a target's projected attainment falls below this ratio
+	// mid-period (default 0.9; negative disables).
+	TargetAlert float64 `json:"targetAlert"`
+	// RefundAlert alerts when refunds reach this share of gross revenue over the last
+	// 7 days (default 0.1; negative disables).
+	RefundAlert float64 `json:"refundAlert"`
+	// AgingDrift alerts when the average age of open receivables grows by more than Days
+	// over the last Snapshots analyses (defaults 5 days over 4; negative days disables).
+	AgingDrift AgingDriftConfig `json:"agingDrift"`
+	// ExpectedCadence is how often each dataset should receive data ("26h", "7d");
+	// the freshness monitor alerts when it goes longer without an ingest.
+	ExpectedCadence map[string]string `json:"expectedCadence"`
+	// Health tunes the composite business health score.
+	Health HealthConfig `json:"health"`
+	// Digest emails new anomalies on a schedule (server mode).
+	Digest DigestConfig `json:"digest"`
+	// Insights sends the week's most notable changes against the weeks before it, by
+	// email and to alert sinks (server mode).
+	Insights InsightsConfig `json:"insights"`
+	// ForecastBand is the relative forecast miss that triggers an alert (default 0.25).
+	ForecastBand float64 `json:"forecastBand"`
+	// Comparison aligns the week, month and year comparisons by weekday, leaves holidays
+	// out, or compares per trading day.
+	Comparison ComparisonConfig `json:"comparison"`
+	// Currency converts amounts from a "currency" column to a base currency.
+	Currency CurrencyConfig `json:"currency"`
+	// Forecast sets the forecast horizon and optional fixed smoothing factors.
+	Forecast ForecastConfig `json:"forecast"`
+	// Anomalies selects the anomaly detector per dataset; "default" covers the rest.
+	Anomalies map[string]AnomalyConfig `json:"anomalies"`
+	// AnomalyExclusions are date windows (a migration week, a known outage) left out of
+	// anomaly detection and its baselines; more can be added from the dashboard.
+	AnomalyExclusions []Exclusion `json:"anomalyExclusions"`
+	// Presets names the business-type preset per dataset (ecommerce, saas, services or
+	// retail); "default" covers the rest. One picked when a workspace is created wins.
+	Presets map[string]string `json:"presets"`
+	// Datasets describes each dataset's values, e.g. {"uk": {"currency": "GBP", "unit": "kg"}};
+	// "default" covers the rest. Metadata set on a workspace through the API wins.
+	Datasets map[string]DatasetMeta `json:"datasets"`
+	// Strict fails an ingest on any row it can't fully read (no or unreadable date, a
+	// number that isn't one), listing the rows, instead of leaving them out or reading 0.
+	Strict bool `json:"strict"`
+	// DateFormat settles numeric dates that read either way round, like 03/04/2025: "dmy",
+	// "mdy", or a Go layout such as "02.01.2006". "auto" (default) infers it per file.
+	DateFormat string `json:"dateFormat"`
+	// Columns pins sale fields to exact header names, e.g. {"amount": "Net Amount"},
+	// for files where the flexible match would bind the wrong column.
+	Columns map[string]string `json:"columns"`
+	// Fetch sets headers and limits for ingest by URL.
+	Fetch FetchConfig `json:"fetch"`
+	// Pull lists FTP/SFTP drops polled for new sales files (server mode).
+	Pull []PullConfig `json:"pull"`
+	// Money sets how amounts are displayed: "cents" (default, $1234.56), "whole"
+	// ($1235) or "short" ($1.2k, $3.4M).
+	Money string `json:"money"`
+	// Templates is a directory of *.tmpl files whose {{define}} blocks override the
+	// dashboard partials ("head", "header", "footer") for branding.
+	Templates string `json:"templates"`
+	// Slack lays out alert messages (Block Kit sections, dashboard link).
+	Slack SlackConfig `json:"slack"`
+	// AlertRules replace the built-in alert conditions with named metric conditions.
+	AlertRules []AlertRule `json:"alertRules"`
+	// AlertCooldown is how long the same alert conditions stay quiet per sink ("24h"
+	// default, "0s" to always send).
+	AlertCooldown string `json:"alertCooldown"`
+	// AlertSinks sends alerts to Teams, Discord or more Slack webhooks too.
+	AlertSinks []AlertSink `json:"alertSinks"`
+	// CRM pushes customer insights to HubSpot or Salesforce (server mode).
+	CRM CRMConfig `json:"crm"`
+	// Stripe pulls charges or invoices from the Stripe API (stripe: sources, server sync).
+	Stripe StripeConfig `json:"stripe"`
+	// Shopify syncs orders from a Shopify store incrementally (server mode).
+	Shopify ShopifyConfig `json:"shopify"`
+	// SwaggerUI is where /api/docs loads swagger-ui-dist from (default: unpkg), for
+	// networks that can't reach the CDN.
+	SwaggerUI string `json:"swaggerUI"`
+}
+
+// HealthConfig weights the health score components (growth, retention, overdue,
+// concentration, forecast). The forecast component needs a revenue target (see weeklyTarget).
+type HealthConfig struct {
+	Weights map[string]float64 `json:"weights"`
+}
+
+var defaultHealthWeights = map[string]float64{"growth": 0.25, "retention": 0.2, "overdue": 0.2, "concentration": 0.15, "forecast": 0.2}
+
+// Territory matches sales by rep or region (falling back to Name) and carries a quota per period.
+type Territory struct {
+	Name    string   `json:"name"`
+	Reps    []string `json:"reps"`
+	Regions []string `json:"regions"`
+	Quota   float64  `json:"quota"`
+	Period  string   `json:"period"` // week, month (default) or quarter
+}
+
+// Target is a revenue target for every week or month; Overrides set it for particular
+// periods, keyed by their first day ("2026-03-01", or the Monday for weeks).
+type Target struct {
+	Name      string             `json:"name"`
+	Period    string             `json:"period"` // week or month (default)
+	Amount    float64            `json:"amount"`
+	Overrides map[string]float64 `json:"overrides,omitempty"`
+}
+
+func (t Territory) matches(s Sale) bool {
+	if len(t.Reps) == 0 && len(t.Regions) == 0 {
+		return strings.EqualFold(s.Rep, t.Name) || strings.EqualFold(s.Region, t.Name)
+	}
+	for _, r := range t.Reps {
+		if strings.EqualFold(s.Rep, r) { return true }
+	}
+	for _, r := range t.Regions {
+		if strings.EqualFold(s.Region, r) { return true }
+	}
+	return false
+}
+
+var cfg Config
+
+func loadConfig(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil { return fmt.Errorf("config: %w", err) }
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	pa := map[string]string{}
+	for child, parent := range cfg.ParentAccounts {
+		pa[strings.ToLower(strings.TrimSpace(child))] = strings.TrimSpace(parent)
+	}
+	cfg.ParentAccounts = pa
+	pc := map[string]string{}
+	for product, cat := range cfg.ProductCategories {
+		pc[strings.ToLower(strings.TrimSpace(product))] = strings.TrimSpace(cat)
+	}
+	cfg.ProductCategories = pc
+	cd := map[string]string{}
+	for domain, company := range cfg.CompanyDomains {
+		cd[strings.Trim(strings.ToLower(strings.TrimSpace(domain)), "@")] = strings.TrimSpace(company)
+	}
+	cfg.CompanyDomains = cd
+	cfg.Currency.Base = strings.ToUpper(strings.TrimSpace(cfg.Currency.Base))
+	rates := map[string]float64{}
+	for cur, r := range cfg.Currency.Rates { rates[strings.ToUpper(strings.TrimSpace(cur))] = r }
+	cfg.Currency.Rates = rates
+	hdrs := map[string]map[string]string{}
+	for host, h := range cfg.Fetch.Headers { hdrs[strings.ToLower(strings.TrimSpace(host))] = h }
+	cfg.Fetch.Headers = hdrs
+	for field := range cfg.Columns {
+		if !isSaleField(field) { return fmt.Errorf("config %s: unknown column field %q", path, field) }
+	}
+	if err := checkMoneyFormat(cfg.Money); err != nil { return fmt.Errorf("config %s: %w", path, err) }
+	if err := checkDateFormat(cfg.DateFormat); err != nil { return fmt.Errorf("config %s: %w", path, err) }
+	for ds, ac := range cfg.Anomalies {
+		if _, err := newDetector(ac); err != nil { return fmt.Errorf("config %s: anomalies.%s: %w", path, ds, err) }
+	}
+	for i := range cfg.AnomalyExclusions {
+		if err := cfg.AnomalyExclusions[i].check(); err != nil { return fmt.Errorf("config %s: anomalyExclusions[%d]: %w", path, i, err) }
+	}
+	for ds, name := range cfg.Presets {
+		if err := checkPreset(name); err != nil { return fmt.Errorf("config %s: presets.%s: %w", path, ds, err) }
+	}
+	for ds, m := range cfg.Datasets {
+		m.Currency = strings.ToUpper(strings.TrimSpace(m.Currency))
+		if err := m.check(); err != nil { return fmt.Errorf("config %s: datasets.%s: %w", path, ds, err) }
+		cfg.Datasets[ds] = m
+	}
+	if err := compileAlertRules(cfg.AlertRules); err != nil { return fmt.Errorf("config %s: %w", path, err) }
+	// health.weeklyTarget predates "targets"; it carries over as a weekly target
+	var legacy struct {
+		Health struct{ WeeklyTarget float64 `json:"weeklyTarget"` } `json:"health"`
+	}
+	json.Unmarshal(b, &legacy)
+	if t := legacy.Health.WeeklyTarget; t > 0 {
+		hasWeekly := false
+		for _, x := range cfg.Targets { hasWeekly = hasWeekly || strings.EqualFold(x.Period, "week") }
+		if hasWeekly {
+			log.Printf("config %s: ignoring health.weeklyTarget; a weekly target is already configured", path)
+		} else {
+			log.Printf(`config %s: health.weeklyTarget is deprecated; using it as "targets": [{"name": "Weekly", "period": "week", "amount": %g}]`, path, t)
+			cfg.Targets = append(cfg.Targets, Target{Name: "Weekly", Period: "week", Amount: t})
+		}
+	}
+	for i := range cfg.Targets {
+		if err := cfg.Targets[i].check(); err != nil { return fmt.Errorf("config %s: targets[%d]: %w", path, i, err) }
+	}
+	if cfg.AlertCooldown != "" {
+		if d, err := parseCadence(cfg.AlertCooldown); err != nil || d < 0 { return fmt.Errorf("config %s: alertCooldown: invalid %q", path, cfg.AlertCooldown) }
+	}
+	if d, err := parseCadence(cfg.Slack.RateLimit); cfg.Slack.RateLimit != "" && (err != nil || d <= 0) {
+		return fmt.Errorf("config %s: slack.rateLimit: invalid %q", path, cfg.Slack.RateLimit)
+	}
+	if err := cfg.Comparison.check(); err != nil { return fmt.Errorf("config %s: comparison: %w", path, err) }
+	if p := cfg.Forecast.Winsorize; p != 0 && (p <= 0.5 || p >= 1) {
+		return fmt.Errorf("config %s: forecast.winsorize must be a percentile between 0.5 and 1, got %v", path, p)
+	}
+	if m := cfg.Stripe.Mode; m != "" && m != "replace" && m != "merge" {
+		return fmt.Errorf("config %s: stripe.mode must be replace or merge, got %q", path, m)
+	}
+	if _, _, _, err := parseStripeSource("stripe:"); err != nil { return fmt.Errorf("config %s: %w", path, err) }
+	for _, r := range cfg.AlertRules {
+		if err := r.checkChannels(); err != nil { return fmt.Errorf("config %s: alertRules: %w", path, err) }
+	}
+	for i := range cfg.AlertSinks {
+		sink := &cfg.AlertSinks[i]
+		if m := strings.ToLower(sink.MinSeverity); m != "" && severityRank[m] == 0 {
+			return fmt.Errorf("config %s: alertSinks[%d]: minSeverity must be info, warning or critical", path, i)
+		}
+		if d, err := parseCadence(sink.RateLimit); sink.RateLimit != "" && (err != nil || d <= 0) {
+			return fmt.Errorf("config %s: alertSinks[%d]: rateLimit: invalid %q", path, i, sink.RateLimit)
+		}
+		if sink.Token != "" && (sink.Channel == "" || !strings.EqualFold(sink.Type, "slack")) {
+			return fmt.Errorf("config %s: alertSinks[%d]: token needs type slack and a channel", path, i)
+		}
+		switch strings.ToLower(sink.Type) {
+		case "slack", "teams", "discord":
+		case "webhook":
+			if err := sink.parseTemplate(); err != nil { return fmt.Errorf("config %s: alertSinks[%d]: %w", path, i, err) }
+		default:
+			return fmt.Errorf("config %s: alertSinks[%d]: unknown type %q (want slack, teams, discord or webhook)", path, i, sink.Type)
+		}
+	}
+	return nil
+}
+
+func checkMoneyFormat(f string) error {
+	switch f {
+	case "", "cents", "whole", "short":
+		return nil
+	}
+	return fmt.Errorf("unknown money format %q (want cents, whole or short)", f)
+}
+
+// parseColumnFlag adds "field=Header,field=Header" pins from -columns to cfg.Columns.
+func parseColumnFlag(spec string) error {
+	if cfg.Columns == nil { cfg.Columns = map[string]string{} }
+	for _, pair := range strings.Split(spec, ",") {
+		field, header, ok := strings.Cut(pair, "=")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || strings.TrimSpace(header) == "" || !isSaleField(field) {
+			return fmt.Errorf("-columns: want field=Header with field one of %s, got %q", strings.Join(saleFields, ", "), pair)
+		}
+		cfg.Columns[field] = strings.TrimSpace(header)
+	}
+	return nil
+}
+
+// loadParentAccounts reads a "child,parent" CSV (header optional) into cfg.ParentAccounts.
+func loadParentAccounts(path string) error {
+	f, err := os.Open(path)
+	if err != nil { return fmt.Errorf("parent accounts: %w", err) }
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil { return fmt.Errorf("parent accounts csv: %w", err) }
+	if cfg.ParentAccounts == nil { cfg.ParentAccounts = map[string]string{} }
+	for i, row := range records {
+		if len(row) < 2 { continue }
+		child, parent := strings.TrimSpace(row[0]), strings.TrimSpace(row[1])
+		if i == 0 && strings.EqualFold(child, "child") { continue }
+		if child == "" || parent == "" { continue }
+		cfg.ParentAccounts[strings.ToLower(child)] = parent
+	}
+	return nil
+}
+
+// accountOf returns the parent account a customer rolls up to (the customer itself if unmapped).
+func accountOf(customer string) string {
+	if p, ok := cfg.ParentAccounts[strings.ToLower(customer)]; ok && p != "" {
+		return p
+	}
+	return customer
+}
+
+// -------- Customer aliases (merge / rename) --------
+
+// Aliases map a customer name as ingested onto a canonical name ("Acme Ltd" -> "Acme").
+// They are persisted to aliasPath, applied to every ingest and retroactively to the
+// current dataset. Each change pushes the previous mapping onto a bounded undo stack.
+// A mapping is never modified once current: changes build a new one under aliasMu, so
+// ingests read whichever mapping they picked up without holding the lock.
+var (
+	aliasMu      sync.RWMutex
+	aliasPath    = "aliases.json"
+	aliasMap     = map[string]string{} // lower(from) -> to
+	aliasHistory []map[string]string   // previous mappings, most recent last
+)
+
+var (
+	errNoAlias       = errors.New("alias not found")
+	errNothingToUndo = errors.New("nothing to undo")
+)
+
+const aliasHistoryLimit = 50
+
+type aliasFile struct {
+	Aliases map[string]string   `json:"aliases"`
+	History []map[string]string `json:"history"`
+}
+
+func loadAliases(path string) error {
+	aliasPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("aliases: %w", err) }
+	var af aliasFile
+	if err := json.Unmarshal(b, &af); err != nil { return fmt.Errorf("aliases %s: %w", path, err) }
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	if af.Aliases != nil { aliasMap = af.Aliases }
+	aliasHistory = af.History
+	return nil
+}
+
+// saveAliases writes the aliases and undo stack; the caller holds aliasMu.
+func saveAliases() error {
+	if aliasPath == "" { return nil }
+	b, _ := json.MarshalIndent(aliasFile{Aliases: aliasMap, History: aliasHistory}, "", "  ")
+	return os.WriteFile(aliasPath, b, 0644)
+}
+
+// aliases is the current mapping; callers must not modify it.
+func aliases() map[string]string {
+	aliasMu.RLock()
+	defer aliasMu.RUnlock()
+	return aliasMap
+}
+
+// canonicalCustomer follows alias chains (bounded, to survive cycles).
+func canonicalCustomer(name string) string {
+	m := aliases()
+	for i := 0; i < 10; i++ {
+		to, ok := m[strings.ToLower(strings.TrimSpace(name))]
+		if !ok || strings.EqualFold(to, name) { break }
+		name = to
+	}
+	return name
+}
+
+// changeAliases makes current a copy of the aliases with change applied, pushing the
+// previous mapping onto the undo stack, and saves them. Nothing changes if change fails.
+func changeAliases(change func(next map[string]string) error) error {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	next := make(map[string]string, len(aliasMap)+1)
+	for k, v := range aliasMap { next[k] = v }
+	if err := change(next); err != nil { return err }
+	aliasHistory = append(aliasHistory, aliasMap)
+	if len(aliasHistory) > aliasHistoryLimit { aliasHistory = aliasHistory[len(aliasHistory)-aliasHistoryLimit:] }
+	aliasMap = next
+	return saveAliases()
+}
+
+// undoAliases restores the mapping in effect before the last change.
+func undoAliases() error {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	if len(aliasHistory) == 0 { return errNothingToUndo }
+	aliasMap = aliasHistory[len(aliasHistory)-1]
+	aliasHistory = aliasHistory[:len(aliasHistory)-1]
+	return saveAliases()
+}
+
+// applyAliases re-resolves customer names from the raw ingested values.
+func applyAliases(sales []Sale) {
+	for i := range sales {
+		sales[i].Customer = canonicalCustomer(nz(sales[i].RawCustomer, sales[i].Customer))
+	}
+}
+
+// -------- Errors --------
+
+// Failures a caller may want to handle differently carry one of these kinds, so code can
+// branch with errors.Is instead of matching messages. Tagging doesn't change the message.
+// Over HTTP the kind is sent in the X-Error-Kind header, and upload jobs report it as Kind.
+var (
+	ErrBadSchema = errors.New("bad schema")       // the columns can't be bound: a pinned header is missing, or no date column
+	ErrNoData    = errors.New("no data")          // nothing to analyze: no data rows, none with a usable date, none in range
+	ErrParseRow  = errors.New("unreadable row")   // a row couldn't be read; errors.As gives its *RowError
+	ErrUpstream  = errors.New("upstream failure") // a remote source (URL fetch, Stripe, Shopify, FX rates) failed
+	ErrTooLarge  = errors.New("too many rows")    // an ingest has more rows than -max-rows allows
+)
+
+// errNoDatedRows is the usual ErrNoData: rows were read, but none had a usable date.
+var errNoDatedRows = withKind(ErrNoData, errors.New("no rows with a usable date"))
+
+// errorKinds names the kinds for X-Error-Kind and Job.Kind.
+var errorKinds = []struct {
+	err  error
+	name string
+}{{ErrBadSchema, "bad_schema"}, {ErrNoData, "no_data"}, {ErrParseRow, "parse_row"}, {ErrUpstream, "upstream"}, {ErrTooLarge, "too_large"}}
+
+// kindError tags err with kind.
+type kindError struct{ kind, err error }
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// withKind tags err with kind; nil stays nil.
+func withKind(kind, err error) error {
+	if err == nil { return nil }
+	return &kindError{kind, err}
+}
+
+// RowError is a row that couldn't be read. Row is its 1-based line in a CSV (the header
+// is line 1) or its position in a JSON ingest; Column is set when the fault is in one.
+type RowError struct {
+	Row    int
+	Column int // 1-based; 0 when not known
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	if e.Column > 0 { return fmt.Sprintf("row %d, column %d: %v", e.Row, e.Column, e.Err) }
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error        { return e.Err }
+func (e *RowError) Is(target error) bool { return target == ErrParseRow }
+
+// csvRowError turns the csv package's parse errors into RowErrors; others pass through.
+func csvRowError(err error) error {
+	var pe *csv.ParseError
+	if !errors.As(err, &pe) { return err }
+	return &RowError{Row: pe.Line, Column: pe.Column, Err: pe.Err}
+}
+
+// errorKind is the name of err's kind, or "".
+func errorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) { return k.name }
+	}
+	return ""
+}
+
+// errorStatus is the HTTP status for a failed ingest or analysis: 504 when it ran out of
+// time, 503 when the client went away, 502 for an upstream failure, 413 for too many rows,
+// 400 for a bad schema or row, otherwise fallback.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrUpstream):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadSchema), errors.Is(err, ErrParseRow):
+		return http.StatusBadRequest
+	}
+	return fallback
+}
+
+// httpError answers err with errorStatus and its kind in X-Error-Kind; prefix (if any)
+// goes before the message.
+func httpError(w http.ResponseWriter, prefix string, err error, fallback int) {
+	if kind := errorKind(err); kind != "" { w.Header().Set("X-Error-Kind", kind) }
+	http.Error(w, prefix+err.Error(), errorStatus(err, fallback))
+}
+
+// -------- CSV ingest --------
+
+// CSV files are parsed as a stream: rows are read one at a time (csv.Reader reusing its
+// record) and turned into sales as they arrive, so the file and its raw cells are never
+// held. The sales are, though. Aggregating as rows arrive isn't an option: medians,
+// cohorts, ranges picked after the upload, the outreach lists and the Raw Data export all
+// go back to individual rows, and a store of spilled rows would just be read back in for
+// each of them. So instead of a memory bound we can't keep, an ingest is capped at
+// maxRows kept rows (-max-rows; each takes a few hundred bytes plus its distinct strings,
+// which are interned) and fails with ErrTooLarge past it, before the server runs out of
+// memory. Spreadsheets are read whole.
+
+const progressEvery = 50000 // rows between progress callbacks
+
+var maxRows = 5000000 // rows one ingest may keep; 0 for no limit
+
+// errTooManyRows is the ErrTooLarge an ingest fails with past maxRows.
+func errTooManyRows() error {
+	return withKind(ErrTooLarge, fmt.Errorf("more than %d rows; split the file or raise -max-rows", maxRows))
+}
+
+// ParseProgress is a running count from a streaming parse; Total is 0 when the size is unknown.
+type ParseProgress struct {
+	File    string
+	Bytes   int64
+	Total   int64
+	Rows    int // sales kept so far
+	Skipped int // rows without a usable date
+	Revenue float64
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// interner returns one shared copy of each distinct string it's given.
+type interner map[string]string
+
+func (in interner) of(v string) string {
+	if s, ok := in[v]; ok { return s }
+	in[v] = v
+	return v
+}
+
+// parseCSV streams a sales CSV of size bytes (0 if unknown), calling progress (if set)
+// every progressEvery rows and once at the end. It returns the sales and their quality
+// report (which holds how the columns were bound), or ctx's error if ctx ends mid-file.
+func parseCSV(ctx context.Context, r io.Reader, size int64, progress func(ParseProgress)) ([]Sale, *DataQuality, error) {
+	counter := &countingReader{r: r}
+	cr := csv.NewReader(bufio.NewReaderSize(counter, 1<<20))
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF { return nil, nil, withKind(ErrNoData, fmt.Errorf("file has no data rows")) }
+	if err != nil { return nil, nil, fmt.Errorf("csv read: %w", csvRowError(err)) }
+	header = append([]string(nil), header...)
+	if err := checkColumns(header, nil); err != nil { return nil, nil, err }
+	get := saleGetter(header, nil)
+	qc := newQualityCheck(header, nil, get)
+	strs := interner{}
+	p := ParseProgress{Total: size}
+	var out []Sale
+	for {
+		row, err := cr.Read()
+		if err == io.EOF { break }
+		if err != nil { return nil, nil, fmt.Errorf("csv read: %w", csvRowError(err)) }
+		if (p.Rows+p.Skipped)%1024 == 0 && ctx.Err() != nil { return nil, nil, ctx.Err() }
+		s, ok := saleFromRow(get, row)
+		line, _ := cr.FieldPos(0)
+		qc.row(line, row, ok)
+		if !ok {
+			p.Skipped++
+			continue
+		}
+		if maxRows > 0 && p.Rows >= maxRows { return nil, nil, errTooManyRows() }
+		for _, f := range []*string{&s.Customer, &s.RawCustomer, &s.Product, &s.Status, &s.Rep, &s.Region, &s.Campaign, &s.Currency, &s.Category, &s.Channel, &s.Email, &s.Country} {
+			*f = strs.of(*f)
+		}
+		out = append(out, s)
+		p.Rows++
+		p.Revenue += s.Amount
+		if progress != nil && p.Rows%progressEvery == 0 {
+			p.Bytes = counter.n
+			progress(p)
+		}
+	}
+	if p.Rows == 0 && p.Skipped == 0 { return nil, nil, withKind(ErrNoData, fmt.Errorf("file has no data rows")) }
+	if err := qc.err(); err != nil { return nil, nil, err }
+	qc.settleDates(out)
+	if progress != nil {
+		p.Bytes = counter.n
+		progress(p)
+	}
+	if err := convertCurrencies(out); err != nil { return nil, nil, err }
+	return out, qc.done(out), nil
+}
+
+// parseRecords maps a header row plus data rows (from CSV or a spreadsheet) to sales
+// and their quality report. mapping pins fields to headers for this file, on top of the
+// configured columns.
+func parseRecords(records [][]string, mapping map[string]string) ([]Sale, *DataQuality, error) {
+	return parseRows(records, mapping, 2)
+}
+
+// parseRows is parseRecords numbering the data rows from first in its reports: 2 for
+// files, whose header is row 1, and 1 for JSON records.
+func parseRows(records [][]string, mapping map[string]string, first int) ([]Sale, *DataQuality, error) {
+	if len(records) < 2 {
+		return nil, nil, withKind(ErrNoData, fmt.Errorf("file has no data rows"))
+	}
+	if err := checkColumns(records[0], mapping); err != nil { return nil, nil, err }
+	get := saleGetter(records[0], mapping)
+	qc := newQualityCheck(records[0], mapping, get)
+	var out []Sale
+	for i, row := range records[1:] {
+		s, ok := saleFromRow(get, row)
+		qc.row(first+i, row, ok)
+		if !ok { continue }
+		if maxRows > 0 && len(out) >= maxRows { return nil, nil, errTooManyRows() }
+		out = append(out, s)
+	}
+	if err := qc.err(); err != nil { return nil, nil, err }
+	qc.settleDates(out)
+	if err := convertCurrencies(out); err != nil { return nil, nil, err }
+	return out, qc.done(out), nil
+}
+
+// checkColumns fails with ErrBadSchema when a pinned column is missing from header or
+// nothing binds the date.
+func checkColumns(header []string, mapping map[string]string) error {
+	for _, f := range saleFields {
+		if pin := pinnedColumn(f, mapping); pin != "" && exactHeader(header, pin) < 0 {
+			return withKind(ErrBadSchema, fmt.Errorf("column %q mapped to %s not found", pin, f))
+		}
+	}
+	if columnFor(header, "date", mapping) < 0 { return withKind(ErrBadSchema, fmt.Errorf("no date column found")) }
+	return nil
+}
+
+// saleFromRow maps one data row to a sale; false when it has no usable date.
+func saleFromRow(get func(row []string, field string) string, row []string) (Sale, bool) {
+	ds := get(row, "date")
+	if ds == "" { return Sale{}, false }
+	dt := parseDateFlexible(ds)
+	if dt.IsZero() { return Sale{}, false }
+	amt := parseNumber(get(row, "amount"))
+	tax := parseNumber(get(row, "tax"))
+	// a discount is an amount, or with a % suffix a share of the price before it
+	disc := get(row, "discount")
+	discount := parseNumber(strings.TrimSuffix(disc, "%"))
+	if strings.HasSuffix(disc, "%") {
+		discount = 0
+		if r := parseNumber(strings.TrimSuffix(disc, "%")) / 100; r > 0 && r < 1 { discount = (amt - tax) * r / (1 - r) }
+	}
+	email := get(row, "email")
+	cust := nz(get(row, "customer"), nz(domainCompany(emailDomain(email)), "Unknown"))
+	return Sale{
+		Date:     dt,
+		Customer: canonicalCustomer(cust),
+		RawCustomer: cust,
+		Product:  nz(get(row, "product"), "Unknown"),
+		Amount:   amt,
+		Status:   strings.ToLower(get(row, "status")),
+		Rep:      get(row, "rep"),
+		Region:   get(row, "region"),
+		Campaign: nz(get(row, "campaign"), get(row, "source")),
+		Invoice:  get(row, "invoice"),
+		Currency:   strings.ToUpper(get(row, "currency")),
+		OrigAmount: amt,
+		Due:        parseDateFlexible(get(row, "due")),
+		Tax:        tax,
+		Discount:   discount,
+		Quantity:   parseNumber(nz(get(row, "quantity"), get(row, "qty"))),
+		Category:   get(row, "category"),
+		Channel:    get(row, "channel"),
+		Email:      email,
+		Country:    normalizeCountry(get(row, "country")),
+	}, true
+}
+
+// parseNumber reads a number with optional thousands separators; 0 when it isn't one.
+func parseNumber(v string) float64 {
+	f, _ := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(v), ",", ""), 64)
+	return f
+}
+
+// headerGetter returns a lookup that finds a row value by flexible (substring) header match.
+func headerGetter(header []string) func(row []string, key string) string {
+	return func(row []string, key string) string {
+		if idx := headerIndex(header, key); idx >= 0 && idx < len(row) {
+			return strings.TrimSpace(row[idx])
+		}
+		return ""
+	}
+}
+
+var saleFields = []string{"date", "customer", "product", "amount", "status", "rep", "region", "campaign", "invoice", "currency", "due", "tax", "discount", "quantity", "category", "channel", "email", "country"}
+
+func isSaleField(f string) bool {
+	for _, x := range saleFields {
+		if x == f { return true }
+	}
+	return false
+}
+
+func pinnedColumn(field string, mapping map[string]string) string {
+	return nz(mapping[field], cfg.Columns[field])
+}
+
+// columnFor resolves a sale field to a column index. A pinned header (per-file mapping,
+// then cfg.Columns) must match exactly, ignoring case; otherwise a header equal to the
+// field beats the first one containing it, so "amount" wins over "amount_tax". A loose
+// match never takes the amount column, so "tax" skips "Amount incl. tax".
+func columnFor(header []string, field string, mapping map[string]string) int {
+	if pin := pinnedColumn(field, mapping); pin != "" { return exactHeader(header, pin) }
+	if i := exactHeader(header, field); i >= 0 { return i }
+	amount := -1
+	if field != "amount" { amount = columnFor(header, "amount", mapping) }
+	for i, col := range header {
+		if i != amount && strings.Contains(strings.ToLower(strings.TrimSpace(col)), field) { return i }
+	}
+	return -1
+}
+
+func exactHeader(header []string, name string) int {
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), strings.TrimSpace(name)) { return i }
+	}
+	return -1
+}
+
+// saleGetter is headerGetter for sales files: it honours pinned columns and exact names.
+func saleGetter(header []string, mapping map[string]string) func(row []string, field string) string {
+	idx := map[string]int{}
+	return func(row []string, field string) string {
+		i, ok := idx[field]
+		if !ok {
+			i = columnFor(header, field, mapping)
+			idx[field] = i
+		}
+		if i >= 0 && i < len(row) { return strings.TrimSpace(row[i]) }
+		return ""
+	}
+}
+
+// headerBinding reports which header each sale field binds to ("" when missing).
+func headerBinding(header []string, mapping map[string]string) map[string]string {
+	out := map[string]string{}
+	for _, f := range saleFields {
+		out[f] = ""
+		if i := columnFor(header, f, mapping); i >= 0 { out[f] = header[i] }
+	}
+	if out["campaign"] == "" && pinnedColumn("campaign", mapping) == "" {
+		if i := columnFor(header, "source", nil); i >= 0 { out["campaign"] = header[i] }
+	}
+	if out["quantity"] == "" && pinnedColumn("quantity", mapping) == "" {
+		if i := columnFor(header, "qty", nil); i >= 0 { out["quantity"] = header[i] }
+	}
+	return out
+}
+
+// bindingSummary renders a binding as "date←Order Date, amount←Net" in field order.
+func bindingSummary(b map[string]string) string {
+	var parts []string
+	for _, f := range saleFields {
+		if b[f] != "" { parts = append(parts, f+"←"+b[f]) }
+	}
+	return strings.Join(parts, ", ")
+}
+
+// headerIndex returns the first column (left to right) whose header contains key, or -1.
+func headerIndex(header []string, key string) int {
+	for i, col := range header {
+		if strings.Contains(strings.ToLower(strings.TrimSpace(col)), key) { // flexible match
+			return i
+		}
+	}
+	return -1
+}
+
+// parseLeads reads a leads/signups CSV: a date column plus a customer (or lead/email/name) column.
+func parseLeads(r io.Reader) ([]Lead, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("leads csv read: %w", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("leads csv has no data rows")
+	}
+	get := headerGetter(records[0])
+	var out []Lead
+	for _, row := range records[1:] {
+		dt := parseDateFlexible(nz(get(row, "date"), nz(get(row, "signup"), get(row, "created"))))
+		if dt.IsZero() { continue }
+		name := get(row, "customer")
+		for _, alt := range []string{"lead", "email", "name"} {
+			name = nz(name, get(row, alt))
+		}
+		if name == "" { continue }
+		out = append(out, Lead{Customer: name, Date: dt, Source: get(row, "source")})
+	}
+	return out, nil
+}
+
+// parseSpend reads a campaign spend CSV with campaign, spend and optional start columns.
+func parseSpend(r io.Reader) ([]CampaignSpend, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("spend csv read: %w", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("spend csv has no data rows")
+	}
+	get := headerGetter(records[0])
+	var out []CampaignSpend
+	for _, row := range records[1:] {
+		name := nz(get(row, "campaign"), get(row, "source"))
+		if name == "" { continue }
+		amt, _ := strconv.ParseFloat(strings.ReplaceAll(nz(get(row, "spend"), get(row, "cost")), ",", ""), 64)
+		out = append(out, CampaignSpend{Campaign: name, Spend: amt, Start: parseDateFlexible(nz(get(row, "start"), get(row, "date")))})
+	}
+	return out, nil
+}
+
+// Dates read as ISO 8601 (2025-03-04, optionally with a time and zone), with a month name
+// (4 Mar 2025, Mar 4, 2025, 04-Mar-2025), or as three numbers separated by /, . or -:
+// year first, or day and month then the year (a 2-digit year is 19xx from 69 on). Numbers
+// that read either way round, like 03/04/2025, are ambiguous. cfg.DateFormat settles them
+// ("dmy", "mdy", or a Go layout such as "02.01.2006" tried first); under "auto" each reads
+// as it fits, day first when both do, and an ingest then looks at the whole column (see
+// qualityCheck.settleDates).
+
+// dateLayouts are tried, in order, on dates that aren't plain numbers.
+var dateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01",
+	"2 Jan 2006", "2 January 2006", "Jan 2, 2006", "January 2, 2006", "Jan 2 2006", "2-Jan-2006", "2-Jan-06", "Mon, 2 Jan 2006"}
+
+// dateFit is how a numeric day-and-month date reads.
+type dateFit int
+
+const (
+	fitNone       dateFit = iota // not one, or the same either way round (05/05/2025)
+	fitDayFirst                  // only day first
+	fitMonthFirst                // only month first
+	fitEither                    // both, to different days
+)
+
+// checkDateFormat accepts the dateFormat hints: "auto" (or empty), "dmy", "mdy", or a Go
+// layout with a year, month and day.
+func checkDateFormat(f string) error {
+	switch f {
+	case "", "auto", "dmy", "mdy":
+		return nil
+	}
+	ref := time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC)
+	if t, err := time.Parse(f, ref.Format(f)); err == nil && t.Year() == 2025 && t.Month() == 3 && t.Day() == 14 { return nil }
+	return fmt.Errorf("dateFormat must be auto, dmy, mdy or a Go layout like 02.01.2006, not %q", f)
+}
+
+func isDateLayout(f string) bool { return f != "" && f != "auto" && f != "dmy" && f != "mdy" }
+
+// numericDate splits a date written as three numbers separated by one of /, . or -,
+// dropping a time of day after a space. A 4-digit first number is the year (y, m, d
+// come back as a, b, y with yearFirst); otherwise the year is last. ok is false for
+// anything else.
+func numericDate(s string) (a, b, y int, yearFirst, ok bool) {
+	if i := strings.IndexByte(s, ' '); i > 0 { s = s[:i] }
+	var n, digits [3]int
+	var sep byte
+	k := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			if digits[k]++; digits[k] > 4 { return 0, 0, 0, false, false }
+			n[k] = n[k]*10 + int(c-'0')
+		case (c == '/' || c == '.' || c == '-') && k < 2 && digits[k] > 0 && (sep == 0 || c == sep):
+			sep = c
+			k++
+		default:
+			return 0, 0, 0, false, false
+		}
+	}
+	if k != 2 || digits[2] == 0 { return 0, 0, 0, false, false }
+	if digits[0] == 4 { return n[1], n[2], n[0], true, digits[1] <= 2 && digits[2] <= 2 }
+	if digits[0] > 2 || digits[1] > 2 || (digits[2] != 2 && digits[2] != 4) { return 0, 0, 0, false, false }
+	y = n[2]
+	if digits[2] == 2 {
+		y += 2000
+		if y >= 2069 { y -= 100 }
+	}
+	return n[0], n[1], y, false, true
+}
+
+// dateOf is the day y-m-d, or the zero time when there's no such day.
+func dateOf(y, m, d int) time.Time {
+	t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	if m < 1 || m > 12 || t.Day() != d { return time.Time{} }
+	return t
+}
+
+// numericFit is how s reads as a day-and-month date.
+func numericFit(s string) dateFit {
+	a, b, y, yearFirst, ok := numericDate(strings.TrimSpace(s))
+	if !ok || yearFirst || a == b { return fitNone }
+	switch day, month := !dateOf(y, b, a).IsZero(), !dateOf(y, a, b).IsZero(); {
+	case day && month:
+		return fitEither
+	case day:
+		return fitDayFirst
+	case month:
+		return fitMonthFirst
+	}
+	return fitNone
+}
+
+// parseDateAs reads s under a dateFormat hint; the zero time when it isn't a date.
+func parseDateAs(s, format string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" { return time.Time{} }
+	if isDateLayout(format) {
+		if t, err := time.Parse(format, s); err == nil { return t }
+	}
+	if a, b, y, yearFirst, ok := numericDate(s); ok {
+		switch {
+		case yearFirst, format == "mdy":
+			return dateOf(y, a, b)
+		case format == "dmy":
+			return dateOf(y, b, a)
+		}
+		if t := dateOf(y, b, a); !t.IsZero() { return t }
+		return dateOf(y, a, b)
+	}
+	for _, f := range dateLayouts {
+		if t, err := time.Parse(f, s); err == nil { return t }
+	}
+	return time.Time{}
+}
+
+// parseDateFlexible reads s under the configured dateFormat.
+func parseDateFlexible(s string) time.Time { return parseDateAs(s, cfg.DateFormat) }
+
+// isOverdue applies the overdue/unpaid status heuristic.
+func isOverdue(status string) bool {
+	return strings.Contains(status, "overdue") || strings.Contains(status, "unpaid") || strings.Contains(status, "due")
+}
+
+func nz(a, b string) string {
+	if strings.TrimSpace(a) == "" { return b }
+	return a
+}
+
+// -------- Excel (.xlsx) ingest --------
+
+// readXLSX returns the cell values of one worksheet as rows. sheet selects by name, or by
+// 1-based index when numeric and no sheet has that name; "" means the first sheet.
+// Numeric cells formatted as dates are returned as YYYY-MM-DD.
+func readXLSX(b []byte, sheet string) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil { return nil, fmt.Errorf("xlsx: %w", err) }
+	files := map[string]*zip.File{}
+	for _, f := range zr.File { files[f.Name] = f }
+	decode := func(name string, v interface{}) error {
+		f, ok := files[name]
+		if !ok { return os.ErrNotExist }
+		rc, err := f.Open()
+		if err != nil { return err }
+		defer rc.Close()
+		return xml.NewDecoder(rc).Decode(v)
+	}
+
+	var wb struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decode("xl/workbook.xml", &wb); err != nil { return nil, fmt.Errorf("xlsx workbook: %w", err) }
+	if len(wb.Sheets) == 0 { return nil, fmt.Errorf("xlsx has no sheets") }
+	pick := -1
+	for i, s := range wb.Sheets {
+		if sheet == "" && i == 0 || strings.EqualFold(s.Name, sheet) { pick = i; break }
+	}
+	if pick < 0 {
+		if n, err := strconv.Atoi(sheet); err == nil && n >= 1 && n <= len(wb.Sheets) { pick = n - 1 }
+	}
+	if pick < 0 {
+		var names []string
+		for _, s := range wb.Sheets { names = append(names, s.Name) }
+		return nil, fmt.Errorf("xlsx sheet %q not found (have %s)", sheet, strings.Join(names, ", "))
+	}
+
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	target := fmt.Sprintf("xl/worksheets/sheet%d.xml", pick+1)
+	if decode("xl/_rels/workbook.xml.rels", &rels) == nil {
+		for _, r := range rels.Rels {
+			if r.ID == wb.Sheets[pick].RID {
+				target = strings.TrimPrefix(r.Target, "/")
+				if !strings.HasPrefix(target, "xl/") { target = "xl/" + target }
+			}
+		}
+	}
+
+	var sst struct {
+		SI []struct {
+			T string `xml:"t"`
+			R []struct {
+				T string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	_ = decode("xl/sharedStrings.xml", &sst)
+	shared := make([]string, len(sst.SI))
+	for i, si := range sst.SI {
+		shared[i] = si.T
+		for _, r := range si.R { shared[i] += r.T }
+	}
+	dateStyles := xlsxDateStyles(decode)
+
+	var ws struct {
+		Rows []struct {
+			Cells []struct {
+				Ref   string `xml:"r,attr"`
+				Type  string `xml:"t,attr"`
+				Style int    `xml:"s,attr"`
+				V     string `xml:"v"`
+				IS    struct {
+					T string `xml:"t"`
+				} `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := decode(target, &ws); err != nil { return nil, fmt.Errorf("xlsx sheet %s: %w", target, err) }
+	var out [][]string
+	for _, row := range ws.Rows {
+		var rec []string
+		empty := true
+		for i, c := range row.Cells {
+			col := xlsxColumn(c.Ref)
+			if col < 0 { col = i }
+			for len(rec) < col { rec = append(rec, "") }
+			v := c.V
+			switch c.Type {
+			case "s":
+				if n, err := strconv.Atoi(c.V); err == nil && n >= 0 && n < len(shared) { v = shared[n] }
+			case "inlineStr":
+				v = c.IS.T
+			case "", "n":
+				if dateStyles[c.Style] {
+					if f, err := strconv.ParseFloat(c.V, 64); err == nil {
+						v = excelSerialDate(f).Format("2006-01-02")
+					}
+				}
+			}
+			if v != "" { empty = false }
+			rec = append(rec, v)
+		}
+		if !empty { out = append(out, rec) }
+	}
+	return out, nil
+}
+
+// xlsxDateStyles reports which cell style indexes use a date number format.
+func xlsxDateStyles(decode func(string, interface{}) error) map[int]bool {
+	var st struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		XFs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	out := map[int]bool{}
+	if decode("xl/styles.xml", &st) != nil { return out }
+	custom := map[int]bool{}
+	for _, nf := range st.NumFmts {
+		code := strings.ToLower(nf.Code)
+		custom[nf.ID] = strings.ContainsAny(code, "dy") || strings.Contains(code, "mmm")
+	}
+	for i, xf := range st.XFs {
+		id := xf.NumFmtID
+		out[i] = (id >= 14 && id <= 17) || id == 22 || custom[id]
+	}
+	return out
+}
+
+// xlsxColumn converts a cell reference like "C7" to a 0-based column index.
+func xlsxColumn(ref string) int {
+	col := 0
+	n := 0
+	for _, ch := range ref {
+		if ch < 'A' || ch > 'Z' { break }
+		col = col*26 + int(ch-'A'+1)
+		n++
+	}
+	if n == 0 { return -1 }
+	return col - 1
+}
+
+// excelSerialDate converts an Excel 1900-system serial day number to a date.
+func excelSerialDate(f float64) time.Time {
+	return time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).Add(time.Duration(f * 24 * float64(time.Hour))).Truncate(24 * time.Hour)
+}
+
+// parseSalesFile parses a CSV or xlsx sales file and reports its quality, including how
+// its columns were bound. It stops early if ctx ends.
+func parseSalesFile(ctx context.Context, r io.Reader, name, sheet string) ([]Sale, *DataQuality, error) {
+	return parseSalesStream(ctx, r, name, sheet, 0, nil)
+}
+
+// parseSalesStream is parseSalesFile reporting progress:
+// CSVs are streamed (see parseCSV), xlsx workbooks (by extension or zip signature) are
+// read whole.
+func parseSalesStream(ctx context.Context, r io.Reader, name, sheet string, size int64, progress func(ParseProgress)) ([]Sale, *DataQuality, error) {
+	br := bufio.NewReader(r)
+	var sales []Sale
+	var q *DataQuality
+	var err error
+	if sig, _ := br.Peek(4); !strings.HasSuffix(strings.ToLower(name), ".xlsx") && !bytes.Equal(sig, []byte("PK\x03\x04")) {
+		sales, q, err = parseCSV(ctx, br, size, progress)
+	} else {
+		records, rerr := readRecords(br, name, sheet)
+		if rerr != nil { return nil, nil, rerr }
+		if ctx.Err() != nil { return nil, nil, ctx.Err() }
+		sales, q, err = parseRecords(records, nil)
+	}
+	if err != nil { return nil, nil, err }
+	q.File = name
+	return sales, q, nil
+}
+
+// readRecords reads the raw header and data rows of a CSV or xlsx upload.
+func readRecords(r io.Reader, name, sheet string) ([][]string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+	if strings.HasSuffix(strings.ToLower(name), ".xlsx") || bytes.HasPrefix(b, []byte("PK\x03\x04")) {
+		return readXLSX(b, sheet)
+	}
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil { return nil, fmt.Errorf("csv read: %w", csvRowError(err)) }
+	return records, nil
+}
+
+// -------- Data quality --------
+
+// Every ingest reports what it made of its file: the rows read and kept, why the others
+// were left out (with the first few as examples), amounts that weren't numbers (kept as
+// 0), rows that repeat one already in the file, stretches of the date range with no rows,
+// which fields found no column, and which way round its numeric dates were read. Nothing
+// is dropped or fixed on its account, bar ambiguous dates settled by the rest of the
+// column; it's there so a file that half-parsed doesn't pass for a slow month.
+
+const (
+	qualityExamples = 5  // skipped rows kept as examples
+	qualityGapDays  = 7  // shortest run of days without rows reported as a gap
+	qualityMaxGaps  = 10 // longest gaps listed
+)
+
+// DataQuality is one file's ingest report.
+type DataQuality struct {
+	File       string
+	Rows       int            // data rows read
+	Kept       int            // rows that became sales
+	Skipped    map[string]int // rows left out, by reason: "no date" or "unreadable date"
+	Examples   []SkippedRow   // the first qualityExamples skipped rows
+	BadAmounts int            // kept rows whose amount wasn't a number, counted as 0
+	Duplicates int            // kept rows repeating an earlier one (date, customer, product, amount, invoice)
+	From, To   time.Time      // dates of the kept rows
+	Gaps       []DateGap      // the longest runs of qualityGapDays or more days without rows, oldest first
+	GapDays    int            // days in all such runs, listed or not
+	Columns    map[string]string // field -> header bound
+	Unbound    []string          // fields no header was bound to
+	Unused     []string          // headers no field took
+	DateOrder  string            // numeric dates read "day first", "month first" or "mixed" (each as it fit), or by the dateFormat layout
+	Ambiguous  int               // dates that read either way round with nothing in the file to settle them, read day first
+}
+
+// SkippedRow is a row an ingest left out. Row counts the header as row 1 (for a CSV, the
+// line the row starts on).
+type SkippedRow struct {
+	Row    int
+	Reason string
+	Value  string // the date cell as written
+}
+
+// DateGap is a run of Days days, From..To inclusive, with no rows.
+type DateGap struct {
+	From, To time.Time
+	Days     int
+}
+
+// SkippedTotal is the number of rows left out for any reason.
+func (q *DataQuality) SkippedTotal() int {
+	n := 0
+	for _, c := range q.Skipped { n += c }
+	return n
+}
+
+// Summary is q in one line, e.g. "1204 rows read, 1198 kept; skipped 6 (no date 4,
+// unreadable date 2); 3 duplicate(s)".
+func (q *DataQuality) Summary() string {
+	parts := []string{fmt.Sprintf("%d rows read, %d kept", q.Rows, q.Kept)}
+	if n := q.SkippedTotal(); n > 0 {
+		var reasons []string
+		for r, c := range q.Skipped { reasons = append(reasons, fmt.Sprintf("%s %d", r, c)) }
+		sort.Strings(reasons)
+		parts = append(parts, fmt.Sprintf("skipped %d (%s)", n, strings.Join(reasons, ", ")))
+	}
+	if q.BadAmounts > 0 { parts = append(parts, fmt.Sprintf("%d unreadable amount(s) counted as 0", q.BadAmounts)) }
+	if q.Duplicates > 0 { parts = append(parts, fmt.Sprintf("%d duplicate(s)", q.Duplicates)) }
+	if len(q.Gaps) > 0 { parts = append(parts, fmt.Sprintf("%d day(s) without rows in gaps of %d+ days", q.GapDays, qualityGapDays)) }
+	if q.DateOrder == "mixed" { parts = append(parts, "dates mix day-first and month-first") }
+	if q.Ambiguous > 0 { parts = append(parts, fmt.Sprintf("%d ambiguous date(s) read day first (set dateFormat to confirm)", q.Ambiguous)) }
+	return strings.Join(parts, "; ")
+}
+
+// qualityCheck builds a DataQuality as a file is parsed and, in strict mode, collects
+// the rows that make the ingest fail.
+type qualityCheck struct {
+	q         DataQuality
+	get       func(row []string, field string) string
+	header    []string
+	mapping   map[string]string
+	strict    bool
+	faults    []error // the first strictErrorsLimit unreadable rows
+	bad       int     // unreadable rows in all
+	kept      int
+	fits      map[dateFit]int       // numeric date and due cells of kept rows, by how they read
+	first     map[dateFit]datePlace // the first of each
+	either    []int                 // indexes in the sales of dates that read either way round
+	dueEither []int                 // likewise for due dates
+}
+
+// datePlace is where a date cell is, for naming it in an error.
+type datePlace struct {
+	row          int
+	field, value string
+}
+
+func newQualityCheck(header []string, mapping map[string]string, get func(row []string, field string) string) *qualityCheck {
+	c := &qualityCheck{get: get, header: header, mapping: mapping, strict: cfg.Strict, fits: map[dateFit]int{}, first: map[dateFit]datePlace{},
+		q: DataQuality{Skipped: map[string]int{}, Columns: headerBinding(header, mapping)}}
+	bound := map[string]bool{}
+	for _, f := range saleFields {
+		if h := c.q.Columns[f]; h != "" { bound[h] = true } else { c.q.Unbound = append(c.q.Unbound, f) }
+	}
+	for _, h := range header {
+		if !bound[h] && strings.TrimSpace(h) != "" { c.q.Unused = append(c.q.Unused, h) }
+	}
+	return c
+}
+
+// row records data row n, which saleFromRow kept when ok.
+func (c *qualityCheck) row(n int, row []string, ok bool) {
+	c.q.Rows++
+	if c.strict {
+		if err := c.fault(n, row, ok); err != nil {
+			c.bad++
+			if len(c.faults) < strictErrorsLimit { c.faults = append(c.faults, err) }
+		}
+	}
+	if !ok {
+		ds := c.get(row, "date")
+		reason := "unreadable date"
+		if ds == "" { reason = "no date" }
+		c.q.Skipped[reason]++
+		if len(c.q.Examples) < qualityExamples { c.q.Examples = append(c.q.Examples, SkippedRow{Row: n, Reason: reason, Value: ds}) }
+		return
+	}
+	if v := c.get(row, "amount"); v != "" && !isNumber(v) { c.q.BadAmounts++ }
+	for _, f := range []string{"date", "due"} {
+		v := c.get(row, f)
+		fit := numericFit(v)
+		if fit == fitNone { continue }
+		c.fits[fit]++
+		if _, ok := c.first[fit]; !ok { c.first[fit] = datePlace{n, f, v} }
+		if fit == fitEither && f == "date" { c.either = append(c.either, c.kept) }
+		if fit == fitEither && f == "due" { c.dueEither = append(c.dueEither, c.kept) }
+	}
+	c.kept++
+}
+
+// settleDates rereads month first the dates that read either way round, when the file's
+// other numeric dates only read month first. A dateFormat hint leaves nothing to settle.
+func (c *qualityCheck) settleDates(sales []Sale) {
+	if cfg.DateFormat != "" && cfg.DateFormat != "auto" { return }
+	if c.fits[fitMonthFirst] == 0 || c.fits[fitDayFirst] > 0 { return }
+	swap := func(t time.Time) time.Time { return time.Date(t.Year(), time.Month(t.Day()), int(t.Month()), 0, 0, 0, 0, t.Location()) }
+	for _, i := range c.either { sales[i].Date = swap(sales[i].Date) }
+	for _, i := range c.dueEither { sales[i].Due = swap(sales[i].Due) }
+}
+
+// In strict mode (-strict, or "strict": true in the config) a row that would be left out
+// or read as 0 fails the whole ingest instead, so nothing loads silently short.
+
+const strictErrorsLimit = 20 // unreadable rows listed when strict mode fails an ingest
+
+// strictNumbers are the number fields strict mode requires to be numbers when present.
+var strictNumbers = []string{"amount", "tax", "discount", "quantity"}
+
+// fault is what strict mode can't accept in data row n: no date or an unreadable one,
+// a number field that isn't a number, or a due date that isn't a date. nil when it reads.
+func (c *qualityCheck) fault(n int, row []string, ok bool) error {
+	column := func(field string) int { return columnFor(c.header, field, c.mapping) + 1 }
+	if !ok {
+		if ds := c.get(row, "date"); ds != "" {
+			return &RowError{Row: n, Column: column("date"), Err: fmt.Errorf("unreadable date %q", ds)}
+		}
+		return &RowError{Row: n, Column: column("date"), Err: errors.New("no date")}
+	}
+	for _, f := range strictNumbers {
+		v := c.get(row, f)
+		if f == "discount" { v = strings.TrimSuffix(v, "%") }
+		if v != "" && !isNumber(v) { return &RowError{Row: n, Column: column(f), Err: fmt.Errorf("%s %q is not a number", f, v)} }
+	}
+	if v := c.get(row, "due"); v != "" && parseDateFlexible(v).IsZero() {
+		return &RowError{Row: n, Column: column("due"), Err: fmt.Errorf("unreadable due date %q", v)}
+	}
+	return nil
+}
+
+// err is strict mode's failure once the file is read: every unreadable row counted, the
+// first strictErrorsLimit listed. nil outside strict mode or when every row read.
+func (c *qualityCheck) err() error {
+	var mixed error
+	if d, m := c.first[fitDayFirst], c.first[fitMonthFirst]; c.strict && c.fits[fitDayFirst] > 0 && c.fits[fitMonthFirst] > 0 {
+		mixed = &RowError{Row: m.row, Column: columnFor(c.header, m.field, c.mapping) + 1,
+			Err: fmt.Errorf("%s %q only reads month first, but row %d's %q only day first; set dateFormat", m.field, m.value, d.row, d.value)}
+	}
+	if c.bad == 0 {
+		if mixed != nil { return fmt.Errorf("strict: dates mix day-first and month-first:\n%w", mixed) }
+		return nil
+	}
+	errs := c.faults
+	if c.bad > len(errs) { errs = append(errs[:len(errs):len(errs)], fmt.Errorf("and %d more", c.bad-len(errs))) }
+	if mixed != nil { errs = append(errs[:len(errs):len(errs)], mixed) }
+	return fmt.Errorf("strict: %d of %d rows unreadable:\n%w", c.bad, c.q.Rows, errors.Join(errs...))
+}
+
+// saleIdentity is saleKey without building a string, for counting repeats in big files.
+type saleIdentity struct {
+	day                        int64
+	customer, product, invoice string
+	cents                      float64
+}
+
+// done finishes the report from the sales kept.
+func (c *qualityCheck) done(sales []Sale) *DataQuality {
+	q := c.q
+	q.Kept = len(sales)
+	switch day, month, either := c.fits[fitDayFirst], c.fits[fitMonthFirst], c.fits[fitEither]; {
+	case isDateLayout(cfg.DateFormat):
+		q.DateOrder = cfg.DateFormat
+	case day+month+either == 0:
+	case cfg.DateFormat == "dmy":
+		q.DateOrder = "day first"
+	case cfg.DateFormat == "mdy":
+		q.DateOrder = "month first"
+	case day > 0 && month > 0:
+		q.DateOrder, q.Ambiguous = "mixed", either
+	case month > 0:
+		q.DateOrder = "month first"
+	default:
+		q.DateOrder = "day first"
+		if day == 0 { q.Ambiguous = either }
+	}
+	if len(sales) == 0 { return &q }
+	seen := make(map[saleIdentity]bool, len(sales))
+	q.From, q.To = sales[0].Date, sales[0].Date
+	for _, s := range sales {
+		id := saleIdentity{s.Date.Unix() / 86400, s.Customer, s.Product, s.Invoice, math.Round(s.Amount * 100)}
+		if seen[id] { q.Duplicates++ } else { seen[id] = true }
+		if s.Date.Before(q.From) { q.From = s.Date }
+		if s.Date.After(q.To) { q.To = s.Date }
+	}
+	from := q.From.Truncate(24 * time.Hour)
+	has := make([]bool, int(q.To.Sub(from).Hours()/24)+1)
+	for _, s := range sales { has[int(s.Date.Sub(from).Hours()/24)] = true }
+	for i := 0; i < len(has); {
+		j := i
+		for j < len(has) && !has[j] { j++ }
+		if n := j - i; n >= qualityGapDays {
+			q.Gaps = append(q.Gaps, DateGap{From: from.AddDate(0, 0, i), To: from.AddDate(0, 0, j-1), Days: n})
+			q.GapDays += n
+		}
+		i = j + 1
+	}
+	if len(q.Gaps) > qualityMaxGaps {
+		sort.SliceStable(q.Gaps, func(i, j int) bool { return q.Gaps[i].Days > q.Gaps[j].Days })
+		q.Gaps = q.Gaps[:qualityMaxGaps]
+		sort.Slice(q.Gaps, func(i, j int) bool { return q.Gaps[i].From.Before(q.Gaps[j].From) })
+	}
+	return &q
+}
+
+// isNumber reports whether parseNumber reads v as a number rather than defaulting to 0.
+func isNumber(v string) bool {
+	_, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(v), ",", ""), 64)
+	return err == nil
+}
+
+// -------- Excel (.xlsx) export --------
+
+// xlsxSheet is one worksheet: a header row and data rows. Cells may be string, int,
+// float64 or time.Time (written as a date number, so Excel sorts and filters it).
+type xlsxSheet struct {
+	Name string
+	Rows [][]interface{}
+}
+
+const (
+	xlsxMainNS = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelNS  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxPkgNS  = "http://schemas.openxmlformats.org/package/2006/relationships"
+)
+
+// Cell styles: 0 default, 1 bold (header row), 2 date (built-in format 14).
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="` + xlsxMainNS + `"><fonts count="2"><font/><font><b/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border/></borders><cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+	`<cellXfs count="3"><xf/><xf fontId="1" applyFont="1"/><xf numFmtId="14" applyNumberFormat="1"/></cellXfs></styleSheet>`
+
+// writeXLSX writes a minimal workbook with inline strings (no shared string table).
+func writeXLSX(w io.Writer, sheets []xlsxSheet) error {
+	zw := zip.NewWriter(w)
+	add := func(name, body string) error {
+		f, err := zw.Create(name)
+		if err != nil { return err }
+		_, err = io.WriteString(f, body)
+		return err
+	}
+	var types, books, rels strings.Builder
+	for i, s := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&books, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(s.Name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="%s/worksheet" Target="worksheets/sheet%d.xml"/>`, n, xlsxRelNS, n)
+	}
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="%s/styles" Target="styles.xml"/>`, len(sheets)+1, xlsxRelNS)
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` + types.String() + `</Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="` + xlsxPkgNS + `"><Relationship Id="rId1" Type="` + xlsxRelNS + `/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="` + xlsxMainNS + `" xmlns:r="` + xlsxRelNS + `"><sheets>` + books.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="` + xlsxPkgNS + `">` + rels.String() + `</Relationships>`},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		if err := add(p.name, p.body); err != nil { return err }
+	}
+	for i, s := range sheets {
+		if err := add(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), xlsxSheetXML(s)); err != nil { return err }
+	}
+	return zw.Close()
+}
+
+func xlsxSheetXML(s xlsxSheet) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="` + xlsxMainNS + `"><sheetData>`)
+	for r, row := range s.Rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, v := range row {
+			ref := xlsxColumnName(c) + strconv.Itoa(r+1)
+			style := ""
+			if r == 0 { style = ` s="1"` }
+			switch x := v.(type) {
+			case float64:
+				fmt.Fprintf(&b, `<c r="%s"%s><v>%s</v></c>`, ref, style, strconv.FormatFloat(x, 'f', -1, 64))
+			case int:
+				fmt.Fprintf(&b, `<c r="%s"%s><v>%d</v></c>`, ref, style, x)
+			case time.Time:
+				if x.IsZero() { continue }
+				serial := x.Sub(time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)).Hours() / 24
+				fmt.Fprintf(&b, `<c r="%s" s="2"><v>%s</v></c>`, ref, strconv.FormatFloat(math.Floor(serial), 'f', -1, 64))
+			default:
+				str := fmt.Sprint(x)
+				if str == "" { continue }
+				fmt.Fprintf(&b, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, xmlEscape(str))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// xlsxColumnName converts a 0-based column index to its letters (0 → A, 26 → AA).
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// exportWorkbook lays out an analysis as sheets: KPI summary, daily revenue, top
+// customers and products, anomalies, and the cleaned rows the KPIs were computed from.
+func exportWorkbook(k KPIs, sales []Sale) []xlsxSheet {
+	summary := [][]interface{}{
+		{"Metric", "Value"},
+		{"From", k.From}, {"To", k.To},
+		{"Total revenue", k.TotalRevenue},
+		{"Orders", k.Orders},
+		{"Unique customers", k.UniqueCustomers},
+		{"Average order value", k.AvgOrderValue},
+		{"Retention rate", k.RetentionRate},
+		{"Forecast next 7 days", k.ForecastNext7DaysTotal},
+		{"Overdue invoices", k.OverdueCount},
+		{"Overdue total", k.OverdueTotal},
+		{"Top-account concentration", k.Concentration},
+		{"Anomaly detector", k.AnomalyMethod.Algorithm + " (" + paramList(k.AnomalyMethod.Params) + ")"},
+	}
+	if k.BaseCurrency != "" { summary = append(summary, []interface{}{"Currency", k.BaseCurrency}) }
+	daily := [][]interface{}{{"Date", "Revenue"}}
+	for _, d := range k.DailyRevenue { daily = append(daily, []interface{}{d.Day, d.Value}) }
+	top := func(head string, kvs []KVf) [][]interface{} {
+		rows := [][]interface{}{{head, "Revenue"}}
+		for _, kv := range kvs { rows = append(rows, []interface{}{kv.Key, kv.Value}) }
+		return rows
+	}
+	anoms := [][]interface{}{{"Date", "Revenue", "Score", "Campaigns"}}
+	for _, a := range k.Anomalies { anoms = append(anoms, []interface{}{a.Day, a.Value, a.Z, strings.Join(a.Campaigns, ", ")}) }
+	// the raw rows have the clean export's columns, so the sheet uploads like its CSV
+	head := make([]interface{}, len(cleanColumns))
+	for i, c := range cleanColumns { head[i] = c.Name }
+	raw := [][]interface{}{head}
+	for _, s := range sales {
+		row := make([]interface{}, len(cleanColumns))
+		for i, c := range cleanColumns { row[i] = c.value(s) }
+		raw = append(raw, row)
+	}
+	return []xlsxSheet{
+		{"Summary", summary},
+		{"Daily Revenue", daily},
+		{"Top Customers", top("Account", k.TopCustomers)},
+		{"Top Products", top("Product", k.TopProducts)},
+		{"Anomalies", anoms},
+		{"Raw Data", raw},
+	}
+}
+
+// handleExportXLSX downloads the current analysis as a workbook (GET /export/xlsx).
+func handleExportXLSX(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, exportWorkbook(*a.KPIs, a.Sales)); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=bizpulse-%s.xlsx", a.KPIs.To.Format("2006-01-02")))
+	w.Write(buf.Bytes())
+}
+
+// -------- Clean data export --------
+
+// cleanColumn is one column of the clean export: Kind is "date" (zero dates are empty,
+// or null in Parquet), "number" or "text".
+type cleanColumn struct {
+	Name  string
+	Kind  string
+	value func(s Sale) interface{}
+}
+
+// cleanColumns are the normalized sale fields in saleFields order, after merges, renames,
+// dedupe and currency conversion, then the derived company. amount is in the base currency;
+// original_amount, tax and discount are in the row's own currency; country is enriched (see
+// Geography). The names bind back to the same fields on upload.
+var cleanColumns = []cleanColumn{
+	{"date", "date", func(s Sale) interface{} { return s.Date }},
+	{"customer", "text", func(s Sale) interface{} { return s.Customer }},
+	{"customer_raw", "text", func(s Sale) interface{} { return s.RawCustomer }},
+	{"product", "text", func(s Sale) interface{} { return s.Product }},
+	{"amount", "number", func(s Sale) interface{} { return s.Amount }},
+	{"status", "text", func(s Sale) interface{} { return s.Status }},
+	{"rep", "text", func(s Sale) interface{} { return s.Rep }},
+	{"region", "text", func(s Sale) interface{} { return s.Region }},
+	{"campaign", "text", func(s Sale) interface{} { return s.Campaign }},
+	{"invoice", "text", func(s Sale) interface{} { return s.Invoice }},
+	{"currency", "text", func(s Sale) interface{} { return s.Currency }},
+	{"original_amount", "number", func(s Sale) interface{} { return s.OrigAmount }},
+	{"due", "date", func(s Sale) interface{} { return s.Due }},
+	{"tax", "number", func(s Sale) interface{} { return s.Tax }},
+	{"discount", "number", func(s Sale) interface{} { return s.Discount }},
+	{"quantity", "number", func(s Sale) interface{} { return s.Quantity }},
+	{"category", "text", func(s Sale) interface{} { return s.Category }},
+	{"channel", "text", func(s Sale) interface{} { return s.Channel }},
+	{"email", "text", func(s Sale) interface{} { return s.Email }},
+	{"country", "text", func(s Sale) interface{} { return countryOf(s) }},
+	{"company", "text", func(s Sale) interface{} { return companyOf(s) }},
+}
+
+// writeCleanCSV writes sales with a header row; dates as 2006-01-02.
+func writeCleanCSV(w io.Writer, sales []Sale) error {
+	cw := csv.NewWriter(w)
+	row := make([]string, len(cleanColumns))
+	for i, c := range cleanColumns { row[i] = c.Name }
+	cw.Write(row)
+	for _, s := range sales {
+		for i, c := range cleanColumns {
+			switch v := c.value(s).(type) {
+			case time.Time:
+				row[i] = ""
+				if !v.IsZero() { row[i] = v.Format("2006-01-02") }
+			case float64:
+				row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Parquet constants (parquet.thrift) for the subset writeParquet uses.
+const (
+	parquetInt32     = 1
+	parquetDouble    = 5
+	parquetByteArray = 6
+	parquetRequired  = 0
+	parquetOptional  = 1
+	parquetUTF8      = 0
+	parquetDate      = 6
+	parquetPlain     = 0
+	parquetRLE       = 3
+	parquetPageRows  = 20000
+)
+
+// thriftCompact encodes the Thrift compact protocol, enough for Parquet's page headers
+// and footer: i32, i64, binary, lists and nested structs.
+type thriftCompact struct {
+	bytes.Buffer
+	last []int16 // previous field id of each open struct
+}
+
+func (t *thriftCompact) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftCompact) zigzag(v int64) { t.uvarint(uint64(v<<1) ^ uint64(v>>63)) }
+
+func (t *thriftCompact) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftCompact) i32(id int16, v int32) { t.field(id, 5); t.zigzag(int64(v)) }
+func (t *thriftCompact) i64(id int16, v int64) { t.field(id, 6); t.zigzag(v) }
+func (t *thriftCompact) str(id int16, s string) { t.field(id, 8); t.uvarint(uint64(len(s))); t.WriteString(s) }
+
+// list starts a list field of n elements of type elem (5 i32, 8 binary, 12 struct).
+func (t *thriftCompact) list(id int16, elem byte, n int) {
+	t.field(id, 9)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.WriteByte(0xf0 | elem)
+		t.uvarint(uint64(n))
+	}
+}
+
+// begin opens a struct: a field when id > 0, a list element otherwise; end closes it.
+func (t *thriftCompact) begin(id int16) {
+	if id > 0 { t.field(id, 12) }
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftCompact) end() { t.WriteByte(0); t.last = t.last[:len(t.last)-1] }
+
+// parquetChunk is where one column's pages landed in the file.
+type parquetChunk struct {
+	offset, size int64
+}
+
+// writeParquet writes sales as one uncompressed row group with PLAIN-encoded pages of up
+// to parquetPageRows rows: dates as DATE (nullable), numbers as DOUBLE, text as UTF8.
+func writeParquet(w io.Writer, sales []Sale) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	chunks := make([]parquetChunk, len(cleanColumns))
+	for ci, c := range cleanColumns {
+		chunks[ci].offset = int64(file.Len())
+		for start := 0; start == 0 || start < len(sales); start += parquetPageRows {
+			end := start + parquetPageRows
+			if end > len(sales) { end = len(sales) }
+			var page, levels bytes.Buffer
+			var b [8]byte
+			run, runDef := 0, byte(0)
+			flush := func() { // definition levels as RLE runs, bit width 1
+				if run == 0 { return }
+				var v [binary.MaxVarintLen64]byte
+				levels.Write(v[:binary.PutUvarint(v[:], uint64(run)<<1)])
+				levels.WriteByte(runDef)
+			}
+			for _, s := range sales[start:end] {
+				switch v := c.value(s).(type) {
+				case time.Time:
+					def := byte(0)
+					if !v.IsZero() {
+						def = 1
+						day := time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)
+						binary.LittleEndian.PutUint32(b[:4], uint32(int32(day.Sub(epoch).Hours()/24)))
+						page.Write(b[:4])
+					}
+					if run > 0 && def != runDef { flush(); run = 0 }
+					run, runDef = run+1, def
+				case float64:
+					binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+					page.Write(b[:])
+				case string:
+					binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+					page.Write(b[:4])
+					page.WriteString(v)
+				}
+			}
+			if c.Kind == "date" {
+				flush()
+				binary.LittleEndian.PutUint32(b[:4], uint32(levels.Len()))
+				body := append(append(b[:4:4], levels.Bytes()...), page.Bytes()...)
+				page.Reset()
+				page.Write(body)
+			}
+			h := thriftCompact{last: []int16{0}}
+			h.i32(1, 0) // DATA_PAGE
+			h.i32(2, int32(page.Len()))
+			h.i32(3, int32(page.Len()))
+			h.begin(5)
+			h.i32(1, int32(end-start))
+			h.i32(2, parquetPlain)
+			h.i32(3, parquetRLE)
+			h.i32(4, parquetRLE)
+			h.end()
+			h.WriteByte(0)
+			file.Write(h.Bytes())
+			file.Write(page.Bytes())
+		}
+		chunks[ci].size = int64(file.Len()) - chunks[ci].offset
+	}
+	m := thriftCompact{last: []int16{0}}
+	m.i32(1, 1)
+	m.list(2, 12, len(cleanColumns)+1)
+	m.begin(0)
+	m.str(4, "schema")
+	m.i32(5, int32(len(cleanColumns)))
+	m.end()
+	var total int64
+	for _, c := range cleanColumns {
+		m.begin(0)
+		m.i32(1, parquetColumnType(c.Kind))
+		rep := int32(parquetRequired)
+		if c.Kind == "date" { rep = parquetOptional }
+		m.i32(3, rep)
+		m.str(4, c.Name)
+		switch c.Kind {
+		case "date":
+			m.i32(6, parquetDate)
+		case "text":
+			m.i32(6, parquetUTF8)
+		}
+		m.end()
+	}
+	m.i64(3, int64(len(sales)))
+	m.list(4, 12, 1)
+	m.begin(0)
+	m.list(1, 12, len(cleanColumns))
+	for ci, c := range cleanColumns {
+		ch := chunks[ci]
+		total += ch.size
+		m.begin(0)
+		m.i64(2, ch.offset)
+		m.begin(3)
+		m.i32(1, parquetColumnType(c.Kind))
+		m.list(2, 5, 2)
+		m.zigzag(parquetPlain)
+		m.zigzag(parquetRLE)
+		m.list(3, 8, 1)
+		m.uvarint(uint64(len(c.Name)))
+		m.WriteString(c.Name)
+		m.i32(4, 0) // UNCOMPRESSED
+		m.i64(5, int64(len(sales)))
+		m.i64(6, ch.size)
+		m.i64(7, ch.size)
+		m.i64(9, ch.offset)
+		m.end()
+		m.end()
+	}
+	m.i64(2, total)
+	m.i64(3, int64(len(sales)))
+	m.end()
+	m.str(6, "BizPulse")
+	m.WriteByte(0)
+	file.Write(m.Bytes())
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(m.Len()))
+	file.Write(n[:])
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+func parquetColumnType(kind string) int32 {
+	switch kind {
+	case "date":
+		return parquetInt32
+	case "number":
+		return parquetDouble
+	}
+	return parquetByteArray
+}
+
+// handleExportClean downloads the rows the analysis ran on, parsed, normalized and
+// deduplicated, for BI tools (GET /export/clean?format=csv|parquet, default csv).
+// ?from=&to= keep only those days.
+func handleExportClean(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	q := r.URL.Query()
+	from, to, err := dateRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	sales := salesBetween(a.Sales, from, to)
+	name := "bizpulse-clean-" + a.KPIs.To.Format("2006-01-02")
+	if a.Dataset != "" && a.Dataset != defaultDataset { name = "bizpulse-" + a.Dataset + "-clean-" + a.KPIs.To.Format("2006-01-02") }
+	var buf bytes.Buffer
+	format, ctype := nz(q.Get("format"), "csv"), "text/csv; charset=utf-8"
+	switch format {
+	case "csv":
+		err = writeCleanCSV(&buf, sales)
+	case "parquet":
+		err, ctype = writeParquet(&buf, sales), "application/vnd.apache.parquet"
+	default:
+		http.Error(w, "format must be csv or parquet", 400); return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+"."+format)
+	w.Write(buf.Bytes())
+}
+
+// -------- Currency --------
+
+// CurrencyConfig converts multi-currency amounts to Base at ingest. Rates are units of
+// each currency per one unit of Base (base USD: "EUR": 0.92), the way FX APIs quote them.
+// RatesURL fetches a {"rates": {...}} table that takes precedence over Rates. HistoryURL
+// is the same kind of feed for a past day, with {date} replaced by 2006-01-02; the API
+// uses it to convert results at historical rates (?rateDate=).
+type CurrencyConfig struct {
+	Base       string             `json:"base"`
+	Rates      map[string]float64 `json:"rates"`
+	RatesURL   string             `json:"ratesUrl"`
+	HistoryURL string             `json:"historyUrl"`
+}
+
+// CurrencyTotal is the revenue booked in one original currency.
+type CurrencyTotal struct {
+	Currency  string
+	Orders    int
+	Amount    float64 // in Currency
+	Converted float64 // in the base currency; equals Amount when nothing was converted
+}
+
+const fxCacheTTL = time.Hour
+
+// fxHistorySize caps the historical rate tables kept in memory; past rates don't change.
+const fxHistorySize = 64
+
+var (
+	fxMu      sync.Mutex
+	fxRates   map[string]float64
+	fxFetched time.Time
+	fxAsOf    string                        // the feed's "date", else the day it was fetched
+	fxHistory = map[string]map[string]float64{} // day -> rates from HistoryURL
+)
+
+// currencyRates returns the rate table, refreshing it from RatesURL at most hourly.
+func currencyRates() (map[string]float64, error) {
+	c := cfg.Currency
+	if c.RatesURL == "" { return c.Rates, nil }
+	fxMu.Lock()
+	defer fxMu.Unlock()
+	if fxRates != nil && time.Since(fxFetched) < fxCacheTTL { return fxRates, nil }
+	feed, asOf, err := fetchRates(context.Background(), c.RatesURL)
+	if err != nil { return nil, err }
+	rates := map[string]float64{}
+	for cur, r := range c.Rates { rates[cur] = r } // configured rates fill gaps in the feed
+	for cur, r := range feed { rates[cur] = r }
+	fxRates, fxFetched, fxAsOf = rates, time.Now(), nz(asOf, time.Now().Format("2006-01-02"))
+	return rates, nil
+}
+
+// historicalRates returns the rate table for day from HistoryURL.
+func historicalRates(ctx context.Context, day time.Time) (map[string]float64, error) {
+	c := cfg.Currency
+	if c.HistoryURL == "" { return nil, fmt.Errorf("historical rates need currency.historyUrl in the config") }
+	key := day.Format("2006-01-02")
+	fxMu.Lock()
+	rates := fxHistory[key]
+	fxMu.Unlock()
+	if rates != nil { return rates, nil }
+	rates, _, err := fetchRates(ctx, strings.ReplaceAll(c.HistoryURL, "{date}", key))
+	if err != nil { return nil, err }
+	fxMu.Lock()
+	if len(fxHistory) >= fxHistorySize { fxHistory = map[string]map[string]float64{} }
+	fxHistory[key] = rates
+	fxMu.Unlock()
+	return rates, nil
+}
+
+// fetchRates reads a {"base": "USD", "date": "2025-06-30", "rates": {...}} feed; base and
+// date are optional, and a named base goes in the table at 1.
+func fetchRates(ctx context.Context, u string) (map[string]float64, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil { return nil, "", fmt.Errorf("fx rates: %w", err) }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return nil, "", withKind(ErrUpstream, fmt.Errorf("fx rates: %w", err)) }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK { return nil, "", withKind(ErrUpstream, fmt.Errorf("fx rates: status %s", resp.Status)) }
+	var body struct {
+		Base  string             `json:"base"`
+		Date  string             `json:"date"`
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, "", withKind(ErrUpstream, fmt.Errorf("fx rates: %w", err))
+	}
+	rates := map[string]float64{}
+	for cur, r := range body.Rates { rates[strings.ToUpper(cur)] = r }
+	if body.Base != "" { rates[strings.ToUpper(body.Base)] = 1 }
+	return rates, body.Date, nil
+}
+
+// FXConversion is how an API response was converted at query time: Rate units of To per
+// unit of From, from Source ("config" or the rate feed's host) as of Date.
+type FXConversion struct {
+	From, To string
+	Rate     float64
+	Source   string
+	Date     string
+}
+
+// fxConversion finds the rate from one currency to another, at the current rates or, when
+// day is set, that day's from HistoryURL. Rates are crossed through the table, so neither
+// currency has to be its base.
+func fxConversion(ctx context.Context, from, to string, day time.Time) (*FXConversion, error) {
+	c := &FXConversion{From: from, To: to, Rate: 1, Source: "config", Date: time.Now().Format("2006-01-02")}
+	var rates map[string]float64
+	var err error
+	if day.IsZero() {
+		if rates, err = currencyRates(); err != nil { return nil, err }
+		if cfg.Currency.RatesURL != "" {
+			fxMu.Lock()
+			c.Date = fxAsOf
+			fxMu.Unlock()
+			c.Source = cfg.Currency.RatesURL
+		}
+	} else {
+		if rates, err = historicalRates(ctx, day); err != nil { return nil, err }
+		c.Source, c.Date = cfg.Currency.HistoryURL, day.Format("2006-01-02")
+	}
+	if u, err := url.Parse(c.Source); err == nil && u.Host != "" { c.Source = u.Host } // no keys in query strings
+	if from == to { return c, nil }
+	rate := func(cur string) float64 {
+		if r := rates[cur]; r > 0 { return r }
+		if cur == cfg.Currency.Base { return 1 }
+		return 0
+	}
+	rf, rt := rate(from), rate(to)
+	missing := from
+	if rf > 0 { missing = to }
+	if rf == 0 || rt == 0 { return nil, fmt.Errorf("no %s rate", missing) }
+	c.Rate = rt / rf
+	return c, nil
+}
+
+// apply returns copies of sales and spend with money in c.To.
+func (c *FXConversion) apply(sales []Sale, spend []CampaignSpend) ([]Sale, []CampaignSpend) {
+	sales = append([]Sale(nil), sales...)
+	for i := range sales { sales[i].Amount *= c.Rate } // tax and discount follow via inBase
+	spend = append([]CampaignSpend(nil), spend...)
+	for i := range spend { spend[i].Spend *= c.Rate }
+	return sales, spend
+}
+
+// queryConversion reads ?currency= and ?rateDate= for an API answer about k: nil when it
+// stays in the dataset currency. Errors are the caller's 400s, or ErrUpstream.
+func queryConversion(r *http.Request, k *KPIs) (*FXConversion, error) {
+	q := r.URL.Query()
+	to := strings.ToUpper(strings.TrimSpace(q.Get("currency")))
+	if to == "" {
+		if q.Get("rateDate") != "" { return nil, fmt.Errorf("rateDate needs currency") }
+		return nil, nil
+	}
+	if !isCurrencyCode(to) { return nil, fmt.Errorf("currency must be an ISO code like EUR") }
+	if k.Currency == "" { return nil, fmt.Errorf("the dataset's currency isn't known: set currency.base in the config or one on the workspace") }
+	var day time.Time
+	if v := q.Get("rateDate"); v != "" {
+		if day = parseDateFlexible(v); day.IsZero() { return nil, fmt.Errorf("rateDate: expected a date like 2025-07-01") }
+		if day.After(time.Now()) { return nil, fmt.Errorf("rateDate is in the future") }
+	}
+	return fxConversion(r.Context(), k.Currency, to, day)
+}
+
+// fxHeaders repeats c in response headers, for answers (like a series) without a place
+// for it in the body.
+func fxHeaders(w http.ResponseWriter, c *FXConversion) {
+	w.Header().Set("X-Currency", c.To)
+	w.Header().Set("X-FX-Rate", strconv.FormatFloat(c.Rate, 'g', -1, 64))
+	w.Header().Set("X-FX-Source", c.Source)
+	w.Header().Set("X-FX-Date", c.Date)
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 { return false }
+	for _, ch := range s {
+		if ch < 'A' || ch > 'Z' { return false }
+	}
+	return true
+}
+
+// convertCurrencies rewrites Amount in the base currency, keeping OrigAmount. Rows without
+// a currency are taken to be in the base currency already; a missing rate is an error
+// rather than a silently blended total.
+func convertCurrencies(sales []Sale) error {
+	base := cfg.Currency.Base
+	if base == "" { return nil }
+	var rates map[string]float64
+	for i := range sales {
+		s := &sales[i]
+		if s.Currency == "" || s.Currency == base { continue }
+		if rates == nil {
+			var err error
+			if rates, err = currencyRates(); err != nil { return err }
+		}
+		rate := rates[s.Currency]
+		if rate <= 0 { return fmt.Errorf("no %s rate for %s (row dated %s)", base, s.Currency, s.Date.Format("2006-01-02")) }
+		s.Amount = s.OrigAmount / rate
+	}
+	return nil
+}
+
+// currencyTotals groups revenue by original currency; nil when no row names a currency.
+func currencyTotals(sales []Sale) []CurrencyTotal {
+	idx := map[string]int{}
+	var out []CurrencyTotal
+	named := false
+	for _, s := range sales {
+		cur, orig := s.Currency, s.OrigAmount
+		if cur == "" {
+			cur, orig = nz(cfg.Currency.Base, "(none)"), s.Amount
+		} else {
+			named = true
+		}
+		i, ok := idx[cur]
+		if !ok {
+			i = len(out)
+			idx[cur] = i
+			out = append(out, CurrencyTotal{Currency: cur})
+		}
+		if !isRefund(s) { out[i].Orders++ }
+		out[i].Amount += orig
+		out[i].Converted += s.Amount
+	}
+	if !named { return nil }
+	sort.Slice(out, func(i, j int) bool { return out[i].Converted > out[j].Converted })
+	return out
+}
+
+// -------- Analytics --------
+
+// Analysis parameters; also reported by the explain endpoint and the glossary.
+const (
+	topListSize       = 5   // entries in top customer/product lists
+	anomalyMinDays    = 7   // days of history before anomaly detection runs
+	anomalyZThreshold = 2.0 // |z| at or above which a day is flagged
+	forecastWindow    = 7   // trailing days averaged by the forecast
+	forecastHorizon   = 7   // days projected forward
+	retentionMinWeeks = 2   // distinct ISO weeks a customer needs to count as retained
+)
+
+// dataLimits names the sections a short history can't support, with the reason shown in
+// their place. Totals, top lists and overdue figures are always computed; a one-day file
+// otherwise yields a forecast that is that day times seven and a retention rate of zero.
+func dataLimits(daily []KVt, sales []Sale) map[string]string {
+	span := len(calendarSeries(daily))
+	weeks := map[[2]int]bool{}
+	for _, s := range sales {
+		y, w := s.Date.ISOWeek()
+		weeks[[2]int{y, w}] = true
+	}
+	m := map[string]string{}
+	need := func(section string, want, have int, unit string) {
+		if have < want { m[section] = fmt.Sprintf("needs %d %s; the data has %d", want, unit, have) }
+	}
+	need("forecast", forecastWindow, span, "days of history")
+	need("momentum", momentumShort+1, span, "days of history")
+	need("anomalies", anomalyMinDays, len(daily), "days with sales")
+	need("retention", retentionMinWeeks, len(weeks), "ISO weeks")
+	need("bridge", 2*bridgeDays, span, "days of history")
+	if len(m) == 0 { return nil }
+	return m
+}
+
+// forecastFigure is the 7-day forecast for messages, or n/a when the history is too short.
+func forecastFigure(k KPIs) string {
+	if k.Insufficient["forecast"] != "" { return "n/a (too little history)" }
+	return money(k.ForecastNext7DaysTotal)
+}
+
+// computeKPIs checks ctx as it goes, so a cancelled request or timed-out job stops a large
+// analysis partway instead of finishing it for nobody. dataset picks the anomaly detector.
+func computeKPIs(ctx context.Context, dataset string, sales []Sale, p *Preset) (KPIs, error) {
+	if len(sales) == 0 { return KPIs{Insufficient: map[string]string{"data": "no rows with a usable date"}}, nil }
+	sort.Slice(sales, func(i,j int) bool { return sales[i].Date.Before(sales[j].Date) })
+	from, to := sales[0].Date, sales[len(sales)-1].Date
+
+	var total float64
+	orders := 0
+	byCustomer := map[string]float64{}
+	byAccount  := map[string]float64{}
+	byProduct  := map[string]float64{}
+	overdueByAccount := map[string]float64{}
+	customers  := map[string]bool{}
+	// daily
+	dr := map[string]float64{}
+	// overdue
+	overdueCount := 0
+	var overdueTotal float64
+
+	for i, s := range sales {
+		if i%1024 == 0 && ctx.Err() != nil { return KPIs{}, ctx.Err() }
+		total += s.Amount
+		if !isRefund(s) { orders++ } // refunds lower revenue without being orders
+		byCustomer[s.Customer] += s.Amount
+		byAccount[accountOf(s.Customer)] += s.Amount
+		byProduct[s.Product] += s.Amount
+		customers[s.Customer] = true
+		key := s.Date.Format("2006-01-02")
+		dr[key] += s.Amount
+		// detect overdue/unpaid heuristics
+		if isOverdue(s.Status) {
+			overdueCount++
+			overdueTotal += s.Amount
+			overdueByAccount[accountOf(s.Customer)] += s.Amount
+		}
+	}
+
+	// to slice
+	var daily []KVt
+	for k,v := range dr {
+		d, _ := time.Parse("2006-01-02", k)
+		daily = append(daily, KVt{Day: d, Value: v})
+	}
+	sort.Slice(daily, func(i,j int) bool { return daily[i].Day.Before(daily[j].Day) })
+	limits := dataLimits(daily, sales)
+
+	// top N (customers are rolled up to parent accounts)
+	topCust := topN(byAccount, topListSize)
+	topProd := topN(byProduct, topListSize)
+	rollups := accountRollups(topCust, byCustomer, overdueByAccount)
+	concentration := 0.0
+	if total > 0 {
+		for _, kv := range topCust { concentration += kv.Value }
+		concentration /= total
+	}
+
+	avgOrder := 0.0
+	if orders > 0 {
+		avgOrder = total / float64(orders)
+	}
+
+	// retention (very rough): % of customers appearing in >=2 distinct weeks
+	retention := retentionRate(sales)
+
+	// anomalies on daily revenue
+	if ctx.Err() != nil { return KPIs{}, ctx.Err() }
+	detector := detectorFor(dataset)
+	anoms := detector.Detect(daily)
+	segAnoms := segmentAnomalies(sales, topCust, topProd, from, to, detector)
+
+	// daily forecast (Holt-Winters, or a trailing average on short histories)
+	if ctx.Err() != nil { return KPIs{}, ctx.Err() }
+	var fcast *Forecast
+	var forecast float64
+	if limits["forecast"] == "" { fcast, forecast = forecastDaily(daily) }
+	if ctx.Err() != nil { return KPIs{}, ctx.Err() }
+
+	// suggestions
+	sug := suggestions(p, total, avgOrder, overdueCount, overdueTotal, topCust, topProd, anoms, typicalDay(daily))
+	tiers := tierReport(sales)
+	sug = append(sug, tierSuggestions(tiers)...)
+	sug = append(sug, segmentSuggestions(segAnoms)...)
+	cats := categoryRollups(sales, to)
+	sug = append(sug, categorySuggestions(cats)...)
+	atRisk := atRiskCustomers(sales, to)
+	if s := atRiskSuggestion(atRisk); s.Text != "" { sug = append(sug, s) }
+	terr := territoryStats(sales, to)
+	for _, t := range terr {
+		if t.Behind {
+			sug = append(sug, Suggestion{Key: "territory:" + t.Name, Text: fmt.Sprintf("Territory %s is pacing at %.0f%% of quota (%s of %s). Review pipeline and coverage.", t.Name, t.Pace*100, money(t.Revenue), money(t.Quota)),
+				Impact: math.Max(t.Quota-t.Projected, 0), Basis: "projected shortfall to quota"})
+		}
+	}
+	targets := targetStats(daily, fcast, to)
+	for _, t := range targets {
+		if t.Behind {
+			sug = append(sug, Suggestion{Key: "target:" + t.Name, Text: fmt.Sprintf("%s target is projected at %.0f%% (%s of %s by %s). Plan how to close the gap.", t.Name, t.ProjectedAttainment*100, money(t.Projected), money(t.Target), t.PeriodEnd.AddDate(0, 0, -1).Format("Jan 2")),
+				Impact: t.Gap, Basis: "projected shortfall to target"})
+		}
+	}
+	currencies := currencyTotals(sales)
+	if len(currencies) > 1 && cfg.Currency.Base == "" {
+		var codes []string
+		for _, c := range currencies { codes = append(codes, c.Currency) }
+		sug = append(sug, Suggestion{Key: "currencies", Text: fmt.Sprintf("Revenue mixes %d currencies (%s) into one total. Set currency.base and rates in the config to convert.", len(codes), strings.Join(codes, ", "))})
+	}
+	if len(byAccount) > 5 && concentration >= 0.8 {
+		sug = append(sug, Suggestion{Key: "concentration", Text: fmt.Sprintf("Concentration risk: top 5 accounts drive %.0f%% of revenue. Diversify the customer base.", concentration*100)})
+	}
+	if ctx.Err() != nil { return KPIs{}, ctx.Err() }
+
+	k := KPIs{
+		From: from, To: to,
+		TotalRevenue: total,
+		AvgOrderValue: avgOrder,
+		Orders: orders,
+		UniqueCustomers: len(customers),
+		Days: len(daily),
+		Insufficient: limits,
+		TopCustomers: topCust,
+		TopProducts: topProd,
+		TopByLTV: topByLTV(sales),
+		AccountRollups: rollups,
+		Categories: cats,
+		Countries: countryRollups(sales, to),
+		Concentration: concentration,
+		OverdueByAccount: topN(overdueByAccount, topListSize),
+		Receivables: receivables(sales, to),
+		Refunds: refunds(sales, to),
+		DailyRevenue: daily,
+		WeeklyRevenue: rollupSeries(daily, "week"),
+		MonthlyRevenue: rollupSeries(daily, "month"),
+		RetentionRate: retention,
+		ForecastNext7DaysTotal: forecast,
+		Forecast: fcast,
+		Momentum: momentum(daily),
+		Comparisons: periodComparisons(sales, from, to),
+		Anomalies: anoms,
+		AnomalyMethod: AnomalyMethod{Algorithm: detector.Name(), Params: detector.Params()},
+		AnomalyExclusions: allExclusions(),
+		SegmentAnomalies: segAnoms,
+		OverdueCount: overdueCount,
+		OverdueTotal: overdueTotal,
+		Territories: terr,
+		Targets: targets,
+		Tiers: tiers,
+		Bridge: trailingBridge(sales, from, to),
+		AtRisk: atRisk,
+		KeyAccounts: keyAccountForecasts(sales, to),
+		Pricing: pricing(sales),
+		BaseCurrency: cfg.Currency.Base,
+		Currencies: currencies,
+		Suggestions: sug,
+	}
+	k.Health = healthScore(k)
+	return k, nil
+}
+
+func topN(m map[string]float64, n int) []KVf {
+	var arr []KVf
+	for k,v := range m { arr = append(arr, KVf{k,v}) }
+	sort.Slice(arr, func(i,j int) bool {
+		if arr[i].Value != arr[j].Value { return arr[i].Value > arr[j].Value }
+		return arr[i].Key < arr[j].Key // ties in a stable order, so ranks don't shuffle between runs
+	})
+	if len(arr) > n { arr = arr[:n] }
+	return arr
+}
+
+// accountRollups attaches the child customers of each top account for drill-down.
+func accountRollups(top []KVf, byCustomer, overdue map[string]float64) []AccountRollup {
+	var out []AccountRollup
+	for _, acct := range top {
+		r := AccountRollup{Account: acct.Key, Revenue: acct.Value, Overdue: overdue[acct.Key]}
+		children := map[string]float64{}
+		for c, v := range byCustomer {
+			if accountOf(c) == acct.Key { children[c] = v }
+		}
+		r.Children = topN(children, len(children))
+		out = append(out, r)
+	}
+	return out
+}
+
+// periodBounds returns the [start, end) of the week/month/quarter containing t.
+func periodBounds(t time.Time, period string) (time.Time, time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch strings.ToLower(period) {
+	case "week":
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // Monday
+		return start, start.AddDate(0, 0, 7)
+	case "quarter":
+		q := (int(t.Month()) - 1) / 3
+		start := time.Date(t.Year(), time.Month(q*3+1), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 3, 0)
+	default:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+}
+
+func territoryStats(sales []Sale, asOf time.Time) []TerritoryStat {
+	threshold := cfg.PaceAlert
+	if threshold <= 0 { threshold = 0.9 }
+	var out []TerritoryStat
+	for _, t := range cfg.Territories {
+		start, end := periodBounds(asOf, t.Period)
+		st := TerritoryStat{Name: t.Name, PeriodStart: start, PeriodEnd: end, Quota: t.Quota}
+		for _, s := range sales {
+			if !s.Date.Before(start) && s.Date.Before(end) && t.matches(s) {
+				st.Revenue += s.Amount
+			}
+		}
+		elapsed := (asOf.Sub(start).Hours()/24 + 1) / (end.Sub(start).Hours() / 24)
+		if elapsed > 1 { elapsed = 1 }
+		st.Projected = st.Revenue / elapsed
+		if t.Quota > 0 {
+			st.Attainment = st.Revenue / t.Quota
+			st.Pace = st.Attainment / elapsed
+		}
+		st.Behind = t.Quota > 0 && elapsed < 1 && st.Pace < threshold
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Attainment > out[j].Attainment })
+	return out
+}
+
+// computeFunnel matches leads to each customer's first purchase on or after signup.
+func computeFunnel(leads []Lead, sales []Sale) *Funnel {
+	if len(leads) == 0 { return nil }
+	purchases := map[string][]time.Time{}
+	for _, s := range sales {
+		if s.Amount <= 0 { continue }
+		c := strings.ToLower(s.Customer)
+		purchases[c] = append(purchases[c], s.Date)
+	}
+	for _, ds := range purchases {
+		sort.Slice(ds, func(i, j int) bool { return ds[i].Before(ds[j]) })
+	}
+	f := &Funnel{Leads: len(leads)}
+	var gaps []float64
+	cohorts := map[time.Time]*LeadCohort{}
+	for _, l := range leads {
+		m := time.Date(l.Date.Year(), l.Date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		c, ok := cohorts[m]
+		if !ok {
+			c = &LeadCohort{Month: m, ConvertedWithin: make([]float64, len(funnelWindows))}
+			cohorts[m] = c
+		}
+		c.Leads++
+		for _, d := range purchases[strings.ToLower(l.Customer)] {
+			if d.Before(l.Date) { continue }
+			days := d.Sub(l.Date).Hours() / 24
+			f.Converted++
+			gaps = append(gaps, days)
+			for i, w := range funnelWindows {
+				if days <= float64(w) { c.ConvertedWithin[i]++ }
+			}
+			break
+		}
+	}
+	f.ConversionRate = float64(f.Converted) / float64(f.Leads)
+	f.MedianDaysToFirstPurchase = median(gaps)
+	for _, c := range cohorts {
+		for i := range c.ConvertedWithin { c.ConvertedWithin[i] /= float64(c.Leads) }
+		f.Cohorts = append(f.Cohorts, *c)
+	}
+	sort.Slice(f.Cohorts, func(i, j int) bool { return f.Cohorts[i].Month.Before(f.Cohorts[j].Month) })
+	return f
+}
+
+// analyze computes KPIs and attaches the optional leads funnel and campaign spend. It
+// returns ctx's error if ctx ends first.
+func analyze(ctx context.Context, dataset string, sales []Sale, leads []Lead, spend []CampaignSpend) (KPIs, error) {
+	p := presetFor(dataset)
+	k, err := computeKPIs(ctx, dataset, sales, p)
+	if err != nil { return KPIs{}, err }
+	k.Preset = p.Name
+	meta := datasetMeta(dataset)
+	k.Currency, k.Unit = meta.Currency, meta.Unit
+	if k.Pricing != nil { k.Pricing.Unit = meta.Unit }
+	if len(leads) > 0 {
+		k.Funnel = computeFunnel(leads, sales)
+		k.Suggestions = append(k.Suggestions, funnelSuggestions(p, k.Funnel)...)
+	}
+	k.Campaigns = campaignStats(sales, spend)
+	k.Suggestions = append(k.Suggestions, attributeAnomalies(k.Anomalies, k.Campaigns, typicalDay(k.DailyRevenue))...)
+	k.Events = eventsBetween(k.From, k.To)
+	annotateEvents(k.Anomalies, k.Events)
+	rankSuggestions(k.Suggestions)
+	k.Suggestions = openSuggestions(nz(dataset, defaultDataset), k.Suggestions)
+	return k, nil
+}
+
+func campaignStats(sales []Sale, spend []CampaignSpend) []CampaignStat {
+	firstCampaign := map[string]string{} // customer -> campaign of first order (sales are date-sorted)
+	stats := map[string]*CampaignStat{}
+	customers := map[string]map[string]bool{}
+	for _, s := range sales {
+		if _, seen := firstCampaign[s.Customer]; !seen {
+			firstCampaign[s.Customer] = s.Campaign
+		}
+		if s.Campaign == "" { continue }
+		st, ok := stats[s.Campaign]
+		if !ok {
+			st = &CampaignStat{Name: s.Campaign, Start: s.Date}
+			stats[s.Campaign] = st
+			customers[s.Campaign] = map[string]bool{}
+		}
+		st.Revenue += s.Amount
+		if !isRefund(s) { st.Orders++ }
+		customers[s.Campaign][s.Customer] = true
+	}
+	for _, sp := range spend {
+		st, ok := stats[sp.Campaign]
+		if !ok {
+			st = &CampaignStat{Name: sp.Campaign}
+			stats[sp.Campaign] = st
+		}
+		st.Spend += sp.Spend
+		if !sp.Start.IsZero() { st.Start = sp.Start }
+	}
+	var out []CampaignStat
+	for name, st := range stats {
+		if st.Orders > 0 { st.AOV = st.Revenue / float64(st.Orders) }
+		if n := len(customers[name]); n > 0 {
+			fresh := 0
+			for c := range customers[name] {
+				if firstCampaign[c] == name { fresh++ }
+			}
+			st.NewCustomerShare = float64(fresh) / float64(n)
+		}
+		if st.Spend > 0 { st.ROI = (st.Revenue - st.Spend) / st.Spend }
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Revenue > out[j].Revenue })
+	return out
+}
+
+// attributeAnomalies tags spikes with campaigns that started up to campaignLeadDays before them.
+func attributeAnomalies(anoms []Anomaly, camps []CampaignStat, typical float64) []Suggestion {
+	var sug []Suggestion
+	for i := range anoms {
+		if anoms[i].Z <= 0 { continue }
+		for _, c := range camps {
+			if c.Start.IsZero() { continue }
+			lag := anoms[i].Day.Sub(c.Start).Hours() / 24
+			if lag >= 0 && lag <= campaignLeadDays {
+				anoms[i].Campaigns = append(anoms[i].Campaigns, c.Name)
+			}
+		}
+		if len(anoms[i].Campaigns) > 0 {
+			sug = append(sug, Suggestion{Key: "campaign:" + anoms[i].Day.Format("2006-01-02"), Text: fmt.Sprintf("Spike on %s aligns with campaign start: %s. Consider extending or re-running it.",
+				anoms[i].Day.Format("2006-01-02"), strings.Join(anoms[i].Campaigns, ", ")),
+				Impact: math.Max(anoms[i].Value-typical, 0), Basis: "spike above a typical day"})
+		}
+	}
+	return sug
+}
+
+func funnelSuggestions(p *Preset, f *Funnel) []Suggestion {
+	if f == nil { return nil }
+	var s []Suggestion
+	if f.ConversionRate < p.Conversion {
+		s = append(s, Suggestion{Key: "funnel:conversion", Text: fmt.Sprintf("Only %.0f%% of %d leads converted. Tighten lead qualification and nurture sequences.", f.ConversionRate*100, f.Leads)})
+	}
+	if f.Converted > 0 && f.MedianDaysToFirstPurchase > p.ActivationDays {
+		s = append(s, Suggestion{Key: "funnel:activation", Text: fmt.Sprintf("Median time-to-first-purchase is %.0f days. Add first-week activation nudges or a starter offer.", f.MedianDaysToFirstPurchase)})
+	}
+	return s
+}
+
+func median(xs []float64) float64 {
+	if len(xs) == 0 { return 0 }
+	c := append([]float64(nil), xs...)
+	sort.Float64s(c)
+	if len(c)%2 == 1 { return c[len(c)/2] }
+	return (c[len(c)/2-1] + c[len(c)/2]) / 2
+}
+
+func retentionRate(sales []Sale) float64 {
+	// crude: map customer -> set of ISO weeks
+	type wk struct{ year, week int }
+	m := map[string]map[wk]bool{}
+	for _, s := range sales {
+		year, week := s.Date.ISOWeek()
+		w := wk{year,week}
+		if _, ok := m[s.Customer]; !ok { m[s.Customer] = map[wk]bool{} }
+		m[s.Customer][w] = true
+	}
+	retained := 0
+	for _, set := range m {
+		if len(set) >= retentionMinWeeks { retained++ }
+	}
+	if len(m) == 0 { return 0 }
+	return float64(retained) / float64(len(m))
+}
+
+// rollupSeries sums a daily series into weeks (starting Monday) or calendar months.
+func rollupSeries(daily []KVt, granularity string) []KVt {
+	var out []KVt
+	for _, d := range daily {
+		start := periodStart(d.Day, granularity)
+		if n := len(out); n > 0 && out[n-1].Day.Equal(start) {
+			out[n-1].Value += d.Value
+		} else {
+			out = append(out, KVt{Day: start, Value: d.Value})
+		}
+	}
+	return out
+}
+
+func periodStart(day time.Time, granularity string) time.Time {
+	switch granularity {
+	case "week":
+		return day.AddDate(0, 0, -int((day.Weekday()+6)%7))
+	case "month":
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	}
+	return day
+}
+
+// PeriodComparison compares the period to date with the same days of an earlier period:
+// this week with last week, this month with last month, and this month with the same
+// dates a year before. Periods whose earlier days start before the data are left out.
+type PeriodComparison struct {
+	Period           string // week, month or year
+	Label            string
+	From, To         time.Time
+	PrevFrom, PrevTo time.Time
+	Revenue          float64
+	PrevRevenue      float64
+	Orders           int
+	PrevOrders       int
+	Days, PrevDays   int     // days counted: trading days when adjusted, less excluded holidays
+	Excluded         int     // holiday days left out of the two periods
+	Change           float64 // revenue (per day when adjusted); 0 without prior revenue
+	OrdersChange     float64
+	Method           string // how the periods were aligned and adjusted, e.g. "same weekdays, per trading day"
+}
+
+// ComparisonConfig is the "comparison" config section; see PeriodComparison.
+type ComparisonConfig struct {
+	// Align is calendar (default: the same dates) or weekday: the earlier days are the
+	// current ones moved back whole weeks (4 for last month, 52 for last year), so a
+	// month with five Saturdays isn't set against one with four.
+	Align string `json:"align"`
+	// ExcludeHolidays leaves the days of holidays and promotions in the events log out
+	// of both periods and compares them per remaining day.
+	ExcludeHolidays bool `json:"excludeHolidays"`
+	// TradingDays are the weekdays the business trades ("mon" … "sun"). When set, revenue
+	// and orders are compared per trading day, so periods with different numbers of
+	// them compare fairly.
+	TradingDays []string `json:"tradingDays"`
+}
+
+func (c ComparisonConfig) check() error {
+	if c.Align != "" && c.Align != "calendar" && c.Align != "weekday" {
+		return fmt.Errorf("align must be calendar or weekday, got %q", c.Align)
+	}
+	for _, d := range c.TradingDays {
+		if _, ok := cronWeekdays[strings.ToUpper(d)]; !ok { return fmt.Errorf("tradingDays: unknown weekday %q (want mon … sun)", d) }
+	}
+	return nil
+}
+
+// method describes the alignment and adjustments for PeriodComparison.Method.
+func (c ComparisonConfig) method() string {
+	parts := []string{"same dates"}
+	if c.Align == "weekday" { parts[0] = "same weekdays" }
+	if c.ExcludeHolidays { parts = append(parts, "holidays excluded") }
+	switch {
+	case len(c.TradingDays) > 0:
+		parts = append(parts, "per trading day ("+strings.ToLower(strings.Join(c.TradingDays, " "))+")")
+	case c.ExcludeHolidays:
+		parts = append(parts, "per day")
+	}
+	return strings.Join(parts, ", ")
+}
+
+func periodComparisons(sales []Sale, from, to time.Time) []PeriodComparison {
+	cc := cfg.Comparison
+	week := periodStart(to, "week")
+	month := periodStart(to, "month")
+	// prior shifts the current days back by a number of months, capped at the earlier
+	// month's end so March 31 compares with February 28; aligned by weekday, it moves
+	// them back the nearest whole number of weeks instead (364 days for a year), capped
+	// the day before start
+	prior := func(start time.Time, months int) (time.Time, time.Time) {
+		pf := start.AddDate(0, months, 0)
+		if cc.Align == "weekday" {
+			weeks := int(math.Round(start.Sub(pf).Hours() / 24 / 7))
+			pf, pt := start.AddDate(0, 0, -7*weeks), to.AddDate(0, 0, -7*weeks)
+			if end := start.AddDate(0, 0, -1); pt.After(end) { pt = end }
+			return pf, pt
+		}
+		pt := pf.AddDate(0, 0, int(to.Sub(start).Hours()/24))
+		if end := pf.AddDate(0, 1, -1); pt.After(end) { pt = end }
+		return pf, pt
+	}
+	holiday := map[time.Time]bool{}
+	if cc.ExcludeHolidays {
+		for _, e := range holidayCalendar() {
+			f, t := e.days()
+			for d := f; !d.After(t); d = d.AddDate(0, 0, 1) { holiday[d] = true }
+		}
+	}
+	trading := map[time.Weekday]bool{}
+	for _, d := range cc.TradingDays { trading[time.Weekday(cronWeekdays[strings.ToUpper(d)])] = true }
+	// days counts a period's days that aren't holidays (and are trading days, if set)
+	days := func(f, t time.Time) (n, skipped int) {
+		for d := f; !d.After(t); d = d.AddDate(0, 0, 1) {
+			if holiday[d] { skipped++; continue }
+			if len(trading) == 0 || trading[d.Weekday()] { n++ }
+		}
+		return n, skipped
+	}
+	var out []PeriodComparison
+	add := func(period, label string, start, pf, pt time.Time) {
+		if pf.Before(from) { return }
+		c := PeriodComparison{Period: period, Label: label, From: start, To: to, PrevFrom: pf, PrevTo: pt, Method: cc.method()}
+		for _, s := range sales {
+			if holiday[s.Date] { continue }
+			switch {
+			case !s.Date.Before(start) && !s.Date.After(to):
+				c.Revenue += s.Amount
+				if !isRefund(s) { c.Orders++ }
+			case !s.Date.Before(pf) && !s.Date.After(pt):
+				c.PrevRevenue += s.Amount
+				if !isRefund(s) { c.PrevOrders++ }
+			}
+		}
+		var skipped, prevSkipped int
+		c.Days, skipped = days(start, to)
+		c.PrevDays, prevSkipped = days(pf, pt)
+		c.Excluded = skipped + prevSkipped
+		// per (trading) day, each total is scaled by the other period's day count
+		scale := 1.0
+		if (len(trading) > 0 || cc.ExcludeHolidays) && c.Days > 0 && c.PrevDays > 0 { scale = float64(c.PrevDays) / float64(c.Days) }
+		if c.PrevRevenue > 0 { c.Change = c.Revenue*scale/c.PrevRevenue - 1 }
+		if c.PrevOrders > 0 { c.OrdersChange = float64(c.Orders)*scale/float64(c.PrevOrders) - 1 }
+		out = append(out, c)
+	}
+	add("week", "This week vs last week", week, week.AddDate(0, 0, -7), to.AddDate(0, 0, -7))
+	pf, pt := prior(month, -1)
+	add("month", "This month vs last month", month, pf, pt)
+	pf, pt = prior(month, -12)
+	add("year", "This month vs last year", month, pf, pt)
+	return out
+}
+
+// SeriesOverlay is an earlier stretch of a chart's series drawn over it for comparison,
+// aligned to the chart's points; Have marks the points the earlier data covers.
+type SeriesOverlay struct {
+	Label  string
+	Color  string
+	Values []float64
+	Have   []bool
+}
+
+// comparisonOverlays shifts the series back a week (daily charts only) and a year
+// (364 days on daily charts, keeping weekdays; 52 weeks; 12 months). Days without sales
+// inside the data count as zero.
+func comparisonOverlays(series []KVt, granularity string) []SeriesOverlay {
+	if len(series) == 0 { return nil }
+	at := map[time.Time]float64{}
+	for _, p := range series { at[p.Day] = p.Value }
+	first := series[0].Day
+	shift := func(label, color string, back func(time.Time) time.Time) *SeriesOverlay {
+		o := SeriesOverlay{Label: label, Color: color, Values: make([]float64, len(series)), Have: make([]bool, len(series))}
+		found := false
+		for i, p := range series {
+			d := back(p.Day)
+			if d.Before(first) { continue }
+			o.Values[i], o.Have[i], found = at[d], true, true
+		}
+		if !found { return nil }
+		return &o
+	}
+	var out []SeriesOverlay
+	switch granularity {
+	case "week":
+		if o := shift("last year", "#9aa7cf", func(d time.Time) time.Time { return d.AddDate(0, 0, -364) }); o != nil { out = append(out, *o) }
+	case "month":
+		if o := shift("last year", "#9aa7cf", func(d time.Time) time.Time { return d.AddDate(-1, 0, 0) }); o != nil { out = append(out, *o) }
+	default:
+		if o := shift("last week", "#c792ea", func(d time.Time) time.Time { return d.AddDate(0, 0, -7) }); o != nil { out = append(out, *o) }
+		if o := shift("last year", "#9aa7cf", func(d time.Time) time.Time { return d.AddDate(0, 0, -364) }); o != nil { out = append(out, *o) }
+	}
+	return out
+}
+
+// seriesFor picks the revenue series for a granularity: day (default), week or month.
+func seriesFor(k *KPIs, granularity string) ([]KVt, error) {
+	switch granularity {
+	case "", "day":
+		return k.DailyRevenue, nil
+	case "week":
+		return k.WeeklyRevenue, nil
+	case "month":
+		return k.MonthlyRevenue, nil
+	}
+	return nil, fmt.Errorf("granularity must be day, week or month")
+}
+
+func forecast7(d []KVt) float64 {
+	if len(d) == 0 { return 0 }
+	window := forecastWindow
+	if len(d) < window { window = len(d) }
+	var sum float64
+	for i:=len(d)-window; i<len(d); i++ {
+		sum += d[i].Value
+	}
+	avg := sum / float64(window)
+	return avg * forecastHorizon
+}
+
+// aovUplift is the Average Order Value lift assumed when estimating bundle/tier impact
+// (the ecommerce preset's; see Presets).
+const aovUplift = 0.10
+
+func suggestions(p *Preset, total, aov float64, overdueCount int, overdueTotal float64, topC, topP []KVf, anoms []Anomaly, typical float64) []Suggestion {
+	var s []Suggestion
+	if overdueCount > 0 {
+		s = append(s, Suggestion{Key: "dunning", Text: p.say("dunning", "Initiate dunning workflow: %d overdue/unpaid invoices totaling %s.", overdueCount, money(overdueTotal)),
+			Impact: overdueTotal, Basis: "overdue balance recovered"})
+	}
+	if aov < p.AOVFloor {
+		s = append(s, Suggestion{Key: "aov", Text: p.say("aov", "Test bundles/tiers to increase Average Order Value (cross-sell top products)."),
+			Impact: total * p.Uplift, Basis: fmt.Sprintf("%.0f%% higher AOV on the period's orders", p.Uplift*100)})
+	}
+	if len(topC) > 0 {
+		s = append(s, Suggestion{Key: "loyalty", Text: p.say("loyalty", "Send loyalty offers to top customers: %s.", joinKV(topC))})
+	}
+	if len(topP) > 0 {
+		s = append(s, Suggestion{Key: "products", Text: p.say("products", "Double down on high-velocity products: %s.", joinKV(topP))})
+	}
+	for _, an := range anoms {
+		if an.Z < 0 {
+			s = append(s, Suggestion{Key: "dip:" + an.Day.Format("2006-01-02"), Text: fmt.Sprintf("Investigate revenue dip on %s (z=%.2f). Check campaigns, outages, pricing.", an.Day.Format("2006-01-02"), an.Z),
+				Impact: math.Max(typical-an.Value, 0), Basis: "shortfall against a typical day"})
+		} else if an.Z > 0 {
+			s = append(s, Suggestion{Key: "spike:" + an.Day.Format("2006-01-02"), Text: fmt.Sprintf("Spike on %s (z=%.2f). Attribute uplift and try to replicate.", an.Day.Format("2006-01-02"), an.Z),
+				Impact: math.Max(an.Value-typical, 0), Basis: "spike above a typical day"})
+		}
+	}
+	if total > 0 && aov > 0 && overdueCount == 0 && len(anoms) == 0 {
+		s = append(s, Suggestion{Key: "steady", Text: p.say("steady", "Steady performance. Consider experimentation (price tests, reorder nudges) to uncover upside.")})
+	}
+	return s
+}
+
+// typicalDay is the median daily revenue, the baseline for anomaly impact estimates.
+func typicalDay(daily []KVt) float64 {
+	var v []float64
+	for _, d := range daily { v = append(v, d.Value) }
+	return median(v)
+}
+
+// rankSuggestions orders suggestions by estimated impact, largest first; unestimated ones
+// keep their relative order at the end.
+func rankSuggestions(s []Suggestion) {
+	sort.SliceStable(s, func(i, j int) bool { return s[i].Impact > s[j].Impact })
+}
+
+func joinKV(a []KVf) string {
+	var parts []string
+	for _, x := range a {
+		parts = append(parts, fmt.Sprintf("%s (%s)", x.Key, money(x.Value)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// -------- Presets --------
+
+// A business-type preset tunes suggestions to the kind of business behind a dataset: the
+// AOV below which an upsell is suggested, the lead conversion and activation limits,
+// which KPIs the dashboard and report.md lead with, and the wording ("test bundles/tiers"
+// means nothing to a consulting firm). A workspace's preset is picked when it's created
+// (POST /api/v1/workspaces, or the upload form's business type) and kept in presets.json;
+// the config's "presets" map names it per dataset, its "default" entry covers the rest,
+// and ecommerce is used otherwise.
+
+// Preset is one business type. Wording replaces suggestion texts by key and takes the
+// same arguments: dunning an invoice count and total, loyalty and products the list.
+type Preset struct {
+	Name           string
+	Label          string
+	AOVFloor       float64  // suggest raising AOV below this
+	Uplift         float64  // AOV lift assumed for that suggestion's impact
+	Conversion     float64  // suggest tighter qualification below this lead conversion rate
+	ActivationDays float64  // suggest activation nudges above this median time to first purchase
+	KPIs           []string // KPIs shown besides revenue and orders: aov, customers, retention, forecast
+	Wording        map[string]string
+}
+
+var presetNames = []string{"ecommerce", "saas", "services", "retail"}
+
+var presets = map[string]*Preset{
+	"ecommerce": {Name: "ecommerce", Label: "E-commerce", AOVFloor: 50, Uplift: aovUplift, Conversion: 0.2, ActivationDays: 14,
+		KPIs: []string{"aov", "customers", "retention", "forecast"}},
+	"saas": {Name: "saas", Label: "SaaS", AOVFloor: 100, Uplift: aovUplift, Conversion: 0.1, ActivationDays: 7,
+		KPIs: []string{"customers", "forecast"},
+		Wording: map[string]string{
+			"dunning":  "Retry failed and overdue subscription payments: %d invoices totaling %s.",
+			"aov":      "Raise revenue per account: test annual prepay, seat or usage tiers, and add-ons on the top plans.",
+			"loyalty":  "Plan expansion and renewal reviews with the largest accounts: %s.",
+			"products": "Put more behind the plans that sell best: %s.",
+			"steady":   "Steady performance. Consider pricing-page tests and churn interviews to uncover upside.",
+		}},
+	"services": {Name: "services", Label: "Services", AOVFloor: 1000, Uplift: aovUplift, Conversion: 0.25, ActivationDays: 30,
+		KPIs: []string{"aov", "customers", "forecast"},
+		Wording: map[string]string{
+			"dunning":  "Follow up with client contacts on %d overdue/unpaid invoices totaling %s.",
+			"aov":      "Package work into retainers or fixed-fee engagements to raise the average invoice.",
+			"loyalty":  "Propose follow-on engagements to the top clients: %s.",
+			"products": "Lead with the services that bill the most: %s.",
+			"steady":   "Steady performance. Review rates and utilization to uncover upside.",
+		}},
+	"retail": {Name: "retail", Label: "Retail", AOVFloor: 30, Uplift: 0.05, Conversion: 0.2, ActivationDays: 14,
+		KPIs: []string{"aov", "customers", "retention", "forecast"},
+		Wording: map[string]string{
+			"aov":      "Add checkout add-ons and multi-buy offers to grow the average basket.",
+			"loyalty":  "Invite the top customers to the loyalty program: %s.",
+			"products": "Keep the fastest sellers in stock and prominently placed: %s.",
+			"steady":   "Steady performance. Consider promotions, layout or opening-hours tests to uncover upside.",
+		}},
+}
+
+var (
+	presetsMu      sync.Mutex
+	presetsPath    string
+	datasetPresets = map[string]string{} // dataset -> preset picked at creation
+)
+
+// say formats the suggestion text for key: the preset's wording, else def.
+func (p *Preset) say(key, def string, args ...interface{}) string {
+	f := def
+	if w, ok := p.Wording[key]; ok { f = w }
+	return fmt.Sprintf(f, args...)
+}
+
+// Shows reports whether the dashboard and report.md show the KPI.
+func (p *Preset) Shows(kpi string) bool {
+	for _, k := range p.KPIs {
+		if k == kpi { return true }
+	}
+	return false
+}
+
+func checkPreset(name string) error {
+	if presets[name] == nil { return fmt.Errorf("unknown preset %q (want %s)", name, strings.Join(presetNames, ", ")) }
+	return nil
+}
+
+// presetFor is the preset of dataset; session analyses use the default dataset's.
+func presetFor(dataset string) *Preset {
+	dataset = nz(dataset, defaultDataset)
+	presetsMu.Lock()
+	name := datasetPresets[dataset]
+	presetsMu.Unlock()
+	if name == "" { name = cfg.Presets[dataset] }
+	if name == "" { name = cfg.Presets[defaultDataset] }
+	return presetNamed(name)
+}
+
+// presetNamed is the named preset, or ecommerce for an empty or unknown name.
+func presetNamed(name string) *Preset {
+	if p := presets[name]; p != nil { return p }
+	return presets["ecommerce"]
+}
+
+func loadPresets(path string) error {
+	presetsPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("presets: %w", err) }
+	if err := json.Unmarshal(b, &datasetPresets); err != nil { return fmt.Errorf("presets %s: %w", path, err) }
+	for ds, name := range datasetPresets {
+		if err := checkPreset(name); err != nil { return fmt.Errorf("presets %s: %s: %w", path, ds, err) }
+	}
+	return nil
+}
+
+// setPreset records dataset's preset; the caller recomputes.
+func setPreset(dataset, name string) error {
+	if err := checkPreset(name); err != nil { return err }
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	datasetPresets[dataset] = name
+	if presetsPath == "" { return nil }
+	b, _ := json.MarshalIndent(datasetPresets, "", "  ")
+	return os.WriteFile(presetsPath, b, 0644)
+}
+
+// handlePresets lists the presets (GET /api/v1/presets).
+func handlePresets(w http.ResponseWriter, r *http.Request) {
+	var out []*Preset
+	for _, name := range presetNames { out = append(out, presets[name]) }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// -------- Dataset metadata --------
+
+// DatasetMeta describes a dataset's values: Currency is what its amounts are in (the
+// configured currency.base when unset) and Unit what its quantities count, e.g. "kg" or
+// "seats". KPIs carry both, and the API converts results to another currency on request.
+type DatasetMeta struct {
+	Currency string `json:"currency,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+}
+
+var (
+	metaMu       sync.Mutex
+	metaPath     string                  // -dataset-meta; empty keeps changes in memory
+	datasetMetas = map[string]DatasetMeta{} // dataset -> metadata set through the API
+)
+
+// check rejects a malformed currency, or one other than currency.base: amounts are
+// converted to the base at ingest, so a dataset can't be in anything else.
+func (m DatasetMeta) check() error {
+	if m.Currency != "" && !isCurrencyCode(m.Currency) { return fmt.Errorf("currency must be an ISO code like EUR, not %q", m.Currency) }
+	if base := cfg.Currency.Base; m.Currency != "" && base != "" && m.Currency != base {
+		return fmt.Errorf("currency %s: amounts are converted to %s at ingest", m.Currency, base)
+	}
+	if len(m.Unit) > 20 { return fmt.Errorf("unit is longer than 20 characters") }
+	return nil
+}
+
+// datasetMeta is dataset's metadata, field by field: set through the API, else the
+// config's, else the default dataset's; the currency falls back to currency.base.
+func datasetMeta(dataset string) DatasetMeta {
+	dataset = nz(dataset, defaultDataset)
+	metaMu.Lock()
+	m := datasetMetas[dataset]
+	metaMu.Unlock()
+	for _, c := range []DatasetMeta{cfg.Datasets[dataset], cfg.Datasets[defaultDataset]} {
+		m.Currency, m.Unit = nz(m.Currency, c.Currency), nz(m.Unit, c.Unit)
+	}
+	m.Currency = nz(m.Currency, cfg.Currency.Base)
+	return m
+}
+
+func loadDatasetMeta(path string) error {
+	metaPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("dataset metadata: %w", err) }
+	if err := json.Unmarshal(b, &datasetMetas); err != nil { return fmt.Errorf("dataset metadata %s: %w", path, err) }
+	for ds, m := range datasetMetas {
+		if err := m.check(); err != nil { return fmt.Errorf("dataset metadata %s: %s: %w", path, ds, err) }
+	}
+	return nil
+}
+
+// setDatasetMeta records the non-empty fields of m for dataset; the caller recomputes.
+func setDatasetMeta(dataset string, m DatasetMeta) error {
+	m.Currency, m.Unit = strings.ToUpper(strings.TrimSpace(m.Currency)), strings.TrimSpace(m.Unit)
+	if err := m.check(); err != nil { return err }
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	cur := datasetMetas[dataset]
+	cur.Currency, cur.Unit = nz(m.Currency, cur.Currency), nz(m.Unit, cur.Unit)
+	datasetMetas[dataset] = cur
+	if metaPath == "" { return nil }
+	b, _ := json.MarshalIndent(datasetMetas, "", "  ")
+	return os.WriteFile(metaPath, b, 0644)
+}
+
+// -------- Suggestion status --------
+
+// Suggestions can be marked done or dismissed per dataset. Dismissed ones are left out of
+// later reports until reopened; done ones come back only if their text changes (e.g. new
+// overdue invoices), since the action taken covered the situation as it was described.
+
+// SuggestionEvent is one status change in a dataset's suggestion history.
+type SuggestionEvent struct {
+	Key    string    `json:"key"`
+	Text   string    `json:"text"`
+	Status string    `json:"status"` // done, dismissed or open (reopened)
+	At     time.Time `json:"at"`
+}
+
+type datasetSuggestions struct {
+	Status  map[string]SuggestionEvent `json:"status"` // latest done/dismissed event per key
+	History []SuggestionEvent          `json:"history"`
+}
+
+var (
+	suggestionMu    sync.Mutex
+	suggestionPath  string
+	suggestionState = map[string]*datasetSuggestions{} // per dataset
+)
+
+func loadSuggestionState(path string) error {
+	suggestionPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("suggestions: %w", err) }
+	if err := json.Unmarshal(b, &suggestionState); err != nil { return fmt.Errorf("suggestions %s: %w", path, err) }
+	return nil
+}
+
+func saveSuggestionState() error {
+	if suggestionPath == "" { return nil }
+	b, _ := json.MarshalIndent(suggestionState, "", "  ")
+	return os.WriteFile(suggestionPath, b, 0644)
+}
+
+// openSuggestions drops suggestions the dataset has dismissed, or marked done with the same text.
+func openSuggestions(dataset string, sug []Suggestion) []Suggestion {
+	suggestionMu.Lock()
+	defer suggestionMu.Unlock()
+	st := suggestionState[dataset]
+	if st == nil { return sug }
+	out := sug[:0]
+	for _, s := range sug {
+		e, ok := st.Status[s.Key]
+		if ok && (e.Status == "dismissed" || e.Text == s.Text) { continue }
+		out = append(out, s)
+	}
+	return out
+}
+
+// setSuggestionStatus records a status change; "open" clears a previous done/dismissed.
+func setSuggestionStatus(dataset string, e SuggestionEvent) error {
+	suggestionMu.Lock()
+	defer suggestionMu.Unlock()
+	st := suggestionState[dataset]
+	if st == nil {
+		st = &datasetSuggestions{}
+		suggestionState[dataset] = st
+	}
+	if st.Status == nil { st.Status = map[string]SuggestionEvent{} }
+	if e.Status == "open" {
+		delete(st.Status, e.Key)
+	} else {
+		st.Status[e.Key] = e
+	}
+	st.History = append(st.History, e)
+	return saveSuggestionState()
+}
+
+// handleSuggestions lists open suggestions with the dataset's status history (GET) or
+// changes one suggestion's status (POST key and status done, dismissed or open).
+func handleSuggestions(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	dataset := nz(a.Dataset, defaultDataset) // a per-browser upload shares the default's state
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		key, status := r.FormValue("key"), r.FormValue("status")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body struct{ Key, Status string }
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil {
+				http.Error(w, "invalid JSON body", 400); return
+			}
+			key, status = body.Key, body.Status
+		}
+		if status != "done" && status != "dismissed" && status != "open" {
+			http.Error(w, "status must be done, dismissed or open", 400); return
+		}
+		e := SuggestionEvent{Key: key, Status: status, At: time.Now().UTC()}
+		found := false
+		if a.KPIs != nil {
+			for _, s := range a.KPIs.Suggestions {
+				if s.Key == key { e.Text, found = s.Text, true }
+			}
+		}
+		if status == "open" {
+			found = false
+			suggestionMu.Lock()
+			if st := suggestionState[dataset]; st != nil {
+				var prev SuggestionEvent
+				prev, found = st.Status[key]
+				e.Text = prev.Text
+			}
+			suggestionMu.Unlock()
+		}
+		if !found {
+			http.Error(w, "suggestion not found", 404); return
+		}
+		if err := setSuggestionStatus(dataset, e); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		recomputeLatest()
+		a = analysisFor(r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if r.Method == http.MethodPost && r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther); return
+	}
+	out := struct {
+		Open    []Suggestion               `json:"open"`
+		Status  map[string]SuggestionEvent `json:"status"`
+		History []SuggestionEvent          `json:"history"`
+	}{Open: []Suggestion{}, Status: map[string]SuggestionEvent{}, History: []SuggestionEvent{}}
+	if a.KPIs != nil && a.KPIs.Suggestions != nil { out.Open = a.KPIs.Suggestions }
+	suggestionMu.Lock()
+	if st := suggestionState[dataset]; st != nil {
+		for k, e := range st.Status { out.Status[k] = e }
+		out.History = append(out.History, st.History...)
+	}
+	suggestionMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// -------- Holt-Winters forecast --------
+
+// ForecastConfig tunes the daily forecast. Smoothing factors left at zero are fitted per
+// dataset by minimizing one-step-ahead squared error over a small grid.
+type ForecastConfig struct {
+	Horizon int     `json:"horizon"` // days projected (default 7)
+	Alpha   float64 `json:"alpha"`   // level
+	Beta    float64 `json:"beta"`    // trend
+	Gamma   float64 `json:"gamma"`   // weekly seasonality
+	// Winsorize caps daily revenue at this percentile (e.g. 0.95), and floors it at the
+	// complement, before fitting, so a one-off deal doesn't inflate the projection. 0 is off.
+	Winsorize float64 `json:"winsorize"`
+}
+
+const (
+	hwSeason = 7    // seasonal period in days (weekly)
+	hwBandZ  = 1.96 // band half-width in standard errors (~95%)
+)
+
+// ForecastDay is one projected day with its confidence band.
+type ForecastDay struct {
+	Day       time.Time
+	Value     float64
+	Low, High float64
+}
+
+// Forecast is the daily projection behind ForecastNext7DaysTotal; Chart is a pre-rendered SVG.
+type Forecast struct {
+	Method             string // holt-winters, or average with under two weeks of history
+	Alpha, Beta, Gamma float64
+	Sigma              float64 // standard deviation of one-step-ahead errors
+	Days               []ForecastDay
+	Capped             *ForecastCap // winsorizing applied to the inputs; nil when off
+	Holidays           []HolidayEffect // calendar effects learned from history and applied
+	Chart              template.HTML `json:"-"`
+}
+
+// holtWinters runs additive triple exponential smoothing over v (at least two seasons)
+// and returns h projected values with the one-step-ahead squared error sum and count.
+func holtWinters(v []float64, alpha, beta, gamma float64, h int) ([]float64, float64, int) {
+	m := hwSeason
+	var s1, s2 float64
+	for i := 0; i < m; i++ { s1 += v[i]; s2 += v[m+i] }
+	level := s1 / float64(m)
+	trend := (s2 - s1) / float64(m*m)
+	season := make([]float64, m)
+	for i := range season { season[i] = v[i] - level }
+	var sse float64
+	n := 0
+	for t := m; t < len(v); t++ {
+		e := v[t] - (level + trend + season[t%m])
+		sse += e * e
+		n++
+		prev := level
+		level = alpha*(v[t]-season[t%m]) + (1-alpha)*(level+trend)
+		trend = beta*(level-prev) + (1-beta)*trend
+		season[t%m] = gamma*(v[t]-level) + (1-gamma)*season[t%m]
+	}
+	out := make([]float64, h)
+	for i := range out { out[i] = level + float64(i+1)*trend + season[(len(v)+i)%m] }
+	return out, sse, n
+}
+
+// ForecastCap records how the forecast's inputs were winsorized.
+type ForecastCap struct {
+	Percentile float64
+	Low, High  float64 // daily revenue floor and cap
+	Days       []KVt   // days outside them, with their actual revenue
+	Adjustment float64 // capped minus actual revenue, summed over those days
+}
+
+// quantile interpolates the p-quantile of sorted.
+func quantile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 { return 0 }
+	pos := p * float64(len(sorted)-1)
+	i := int(pos)
+	if i >= len(sorted)-1 { return sorted[len(sorted)-1] }
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// winsorize clamps the days of daily to its p and 1-p quantiles (days without sales are
+// left out of both), returning the clamped copy and what changed.
+func winsorize(daily []KVt, p float64) ([]KVt, *ForecastCap) {
+	vals := make([]float64, len(daily))
+	for i, d := range daily { vals[i] = d.Value }
+	sort.Float64s(vals)
+	c := &ForecastCap{Percentile: p, Low: quantile(vals, 1-p), High: quantile(vals, p)}
+	out := make([]KVt, len(daily))
+	for i, d := range daily {
+		out[i] = d
+		out[i].Value = math.Min(math.Max(d.Value, c.Low), c.High)
+		if out[i].Value != d.Value {
+			c.Days = append(c.Days, d)
+			c.Adjustment += out[i].Value - d.Value
+		}
+	}
+	return out, c
+}
+
+func forecastHorizonDays() int {
+	if cfg.Forecast.Horizon > 0 { return cfg.Forecast.Horizon }
+	return forecastHorizon
+}
+
+// forecastDaily projects the configured horizon past the last day of daily, returning the
+// forecast and the total of its first forecastHorizon days.
+func forecastDaily(daily []KVt) (*Forecast, float64) {
+	if len(daily) == 0 { return nil, 0 }
+	f := &Forecast{}
+	inputs := daily
+	var hm *holidayModel
+	if cal := holidayCalendar(); len(cal) > 0 {
+		hm = learnHolidays(daily, cal)
+		inputs = hm.adjust(daily)
+	}
+	if p := cfg.Forecast.Winsorize; p > 0 { inputs, f.Capped = winsorize(inputs, p) }
+	v := calendarSeries(inputs)
+	h := forecastHorizonDays()
+	steps := max(h, forecastHorizon)
+	var fc []float64
+	if len(v) < 2*hwSeason {
+		f.Method = "average"
+		per := forecast7(inputs) / forecastHorizon
+		tail := v[max(0, len(v)-forecastWindow):]
+		var ss float64
+		for _, x := range tail { ss += (x - per) * (x - per) }
+		f.Sigma = math.Sqrt(ss / float64(len(tail)))
+		for i := 0; i < steps; i++ { fc = append(fc, per) }
+	} else {
+		f.Method = "holt-winters"
+		grid := func(fixed float64, fit ...float64) []float64 {
+			if fixed > 0 { return []float64{fixed} }
+			return fit
+		}
+		best := math.Inf(1)
+		for _, a := range grid(cfg.Forecast.Alpha, 0.1, 0.2, 0.4, 0.6, 0.8) {
+			for _, b := range grid(cfg.Forecast.Beta, 0, 0.05, 0.1, 0.2) {
+				for _, g := range grid(cfg.Forecast.Gamma, 0.05, 0.1, 0.3, 0.5) {
+					out, sse, n := holtWinters(v, a, b, g, steps)
+					if sse < best {
+						best, fc = sse, out
+						f.Alpha, f.Beta, f.Gamma, f.Sigma = a, b, g, math.Sqrt(sse/float64(n))
+					}
+				}
+			}
+		}
+	}
+	last := daily[len(daily)-1].Day
+	var total float64
+	for i, x := range fc {
+		day := last.AddDate(0, 0, i+1)
+		mult := 1.0
+		if hm != nil {
+			var used []*HolidayEffect
+			if mult, used = hm.factor(day); i < h {
+				for _, eff := range used { eff.Days = append(eff.Days, day) }
+			}
+		}
+		x = math.Max(x, 0) * mult
+		if i < forecastHorizon { total += x }
+		if i >= h { continue }
+		// the error of an i-step projection grows with the level's smoothing factor
+		band := hwBandZ * f.Sigma * math.Sqrt(1+float64(i)*f.Alpha*f.Alpha) * mult
+		f.Days = append(f.Days, ForecastDay{Day: day, Value: x, Low: math.Max(x-band, 0), High: x + band})
+	}
+	if hm != nil { f.Holidays = hm.effects() }
+	f.Chart = projectionChart(daily, f.Days)
+	return f, total
+}
+
+// projectionChart draws the last four weeks of actuals followed by the forecast and its band.
+func projectionChart(daily []KVt, days []ForecastDay) template.HTML {
+	if len(days) == 0 { return "" }
+	v := calendarSeries(daily)
+	v = v[max(0, len(v)-4*hwSeason):]
+	maxV := 0.0
+	for _, x := range v { maxV = math.Max(maxV, x) }
+	for _, d := range days { maxV = math.Max(maxV, d.High) }
+	w, h := 600.0, 120.0
+	n := len(v) + len(days)
+	pt := func(i int, val float64) string {
+		return fmt.Sprintf("%.1f,%.1f", float64(i)*(w/float64(max(1, n-1))), h-scale(val, 0, maxV, 8, h-8))
+	}
+	var actual, fcast, upper, lower []string
+	for i, x := range v { actual = append(actual, pt(i, x)) }
+	if len(v) > 0 { fcast = append(fcast, pt(len(v)-1, v[len(v)-1])) }
+	for i, d := range days {
+		fcast = append(fcast, pt(len(v)+i, d.Value))
+		upper = append(upper, pt(len(v)+i, d.High))
+		lower = append([]string{pt(len(v)+i, d.Low)}, lower...)
+	}
+	band := "M " + strings.Join(append(upper, lower...), " L ") + " Z"
+	line := func(pts []string) string {
+		if len(pts) == 0 { return "" }
+		return "M " + strings.Join(pts, " L ")
+	}
+	return template.HTML(fmt.Sprintf(`<svg viewBox="0 0 %.0f %.0f"><path d="%s" fill="#22305f" stroke="none"/><path d="%s" fill="none" stroke="#7aa2ff" stroke-width="2"/><path d="%s" fill="none" stroke="#9aa7cf" stroke-width="2" stroke-dasharray="6 4"/></svg>`,
+		w, h, band, line(actual), line(fcast)))
+}
+
+// -------- Holiday uplift --------
+
+// Holidays and promotions in the events log (kinds holiday and promotion) are the
+// forecast's calendar. Each past occurrence's days are compared with the same weekday in
+// the holidayBaselineWeeks before it, skipping other calendar days, and an event's factor
+// is the average ratio over its occurrences, matched by title. Before fitting, those days
+// are divided by their factor so a Black Friday doesn't read as trend; forecast days an
+// upcoming occurrence covers are multiplied by it. Titles without history take the
+// average factor of their kind, and none at all leaves the forecast as it was.
+const holidayBaselineWeeks = 4
+
+var holidayKinds = map[string]bool{"holiday": true, "promotion": true}
+
+// HolidayEffect is what the forecast learned for one calendar title.
+type HolidayEffect struct {
+	Title       string
+	Kind        string
+	Occurrences int         // past occurrences the factor was learned from; 0 uses the kind's
+	Factor      float64     // revenue over the baseline on its days; 1 is no effect
+	Days        []time.Time // forecast days it was applied to
+}
+
+type holidayModel struct {
+	cal     []Event
+	byTitle map[string]*HolidayEffect
+}
+
+// holidayCalendar returns the holidays and promotions in the events log.
+func holidayCalendar() []Event {
+	var out []Event
+	for _, e := range eventsBetween(time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		if holidayKinds[e.Kind] { out = append(out, e) }
+	}
+	return out
+}
+
+// learnHolidays fits a factor per calendar title from the occurrences within daily.
+func learnHolidays(daily []KVt, cal []Event) *holidayModel {
+	m := &holidayModel{cal: cal, byTitle: map[string]*HolidayEffect{}}
+	v := calendarSeries(daily)
+	first := daily[0].Day
+	index := func(d time.Time) int { return int(math.Floor(d.Sub(first).Hours() / 24)) }
+	covered := map[int]bool{}
+	for _, e := range cal {
+		from, to := e.days()
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) { covered[index(d)] = true }
+	}
+	sums := map[string]float64{}
+	kindSum, kindN := map[string]float64{}, map[string]int{}
+	for _, e := range cal {
+		key := strings.ToLower(e.Title)
+		if m.byTitle[key] == nil { m.byTitle[key] = &HolidayEffect{Title: e.Title, Kind: e.Kind, Factor: 1} }
+		from, to := e.days()
+		start := index(from)
+		var ratios []float64
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			i := index(d)
+			if i < 0 || i >= len(v) { continue }
+			var base []float64
+			for w := 0; w < 2*holidayBaselineWeeks && len(base) < holidayBaselineWeeks; w++ {
+				j := i - 7*(1+(i-start)/7+w)
+				if j < 0 { break }
+				if !covered[j] { base = append(base, v[j]) }
+			}
+			var sum float64
+			for _, x := range base { sum += x }
+			if len(base) < 2 || sum <= 0 { continue }
+			ratios = append(ratios, v[i]/(sum/float64(len(base))))
+		}
+		if len(ratios) == 0 { continue }
+		var r float64
+		for _, x := range ratios { r += x }
+		r /= float64(len(ratios))
+		m.byTitle[key].Occurrences++
+		sums[key] += r
+		kindSum[e.Kind] += r
+		kindN[e.Kind]++
+	}
+	for key, eff := range m.byTitle {
+		if eff.Occurrences > 0 {
+			eff.Factor = sums[key] / float64(eff.Occurrences)
+		} else if n := kindN[eff.Kind]; n > 0 {
+			eff.Factor = kindSum[eff.Kind] / float64(n)
+		}
+	}
+	return m
+}
+
+// factor is the combined effect of the calendar events covering day, with the effects
+// that contributed; 1 when none has one.
+func (m *holidayModel) factor(day time.Time) (float64, []*HolidayEffect) {
+	f := 1.0
+	var used []*HolidayEffect
+	for _, e := range m.cal {
+		if from, to := e.days(); day.Before(from) || day.After(to) { continue }
+		eff := m.byTitle[strings.ToLower(e.Title)]
+		if eff.Factor == 1 { continue }
+		f *= eff.Factor
+		used = append(used, eff)
+	}
+	return f, used
+}
+
+// adjust divides each calendar day of daily by its factor, for fitting.
+func (m *holidayModel) adjust(daily []KVt) []KVt {
+	out := make([]KVt, len(daily))
+	for i, d := range daily {
+		out[i] = d
+		if f, _ := m.factor(d.Day); f > 0 { out[i].Value = d.Value / f }
+	}
+	return out
+}
+
+// effects lists the titles with history or applied to the forecast, by date of first use.
+func (m *holidayModel) effects() []HolidayEffect {
+	var out []HolidayEffect
+	for _, eff := range m.byTitle {
+		if eff.Occurrences > 0 || len(eff.Days) > 0 { out = append(out, *eff) }
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if (len(out[i].Days) > 0) != (len(out[j].Days) > 0) { return len(out[i].Days) > 0 }
+		if len(out[i].Days) > 0 && !out[i].Days[0].Equal(out[j].Days[0]) { return out[i].Days[0].Before(out[j].Days[0]) }
+		return out[i].Title < out[j].Title
+	})
+	return out
+}
+
+// -------- Anomaly detection --------
+
+// AnomalyConfig selects the detector for a dataset. Zero values take each algorithm's
+// defaults; Threshold is in the algorithm's own score units (see the detectors).
+type AnomalyConfig struct {
+	Algorithm string  `json:"algorithm"` // zscore (default), mad, iqr or ewma
+	Threshold float64 `json:"threshold"`
+	Window    int     `json:"window"` // mad: trailing days used as the baseline
+	Lambda    float64 `json:"lambda"` // ewma: smoothing factor
+	Seasonal  bool    `json:"seasonal"` // remove the day-of-week pattern before scoring
+}
+
+// AnomalyDetector flags unusual days in a daily revenue series. Each flagged day's Z is a
+// signed score in the detector's units, at or beyond its threshold.
+type AnomalyDetector interface {
+	Name() string
+	Params() map[string]string
+	Detect(d []KVt) []Anomaly
+}
+
+// AnomalyMethod records the detector behind KPIs.Anomalies.
+type AnomalyMethod struct {
+	Algorithm string
+	Params    map[string]string
+}
+
+func newDetector(c AnomalyConfig) (AnomalyDetector, error) {
+	if c.Seasonal {
+		c.Seasonal = false
+		inner, err := newDetector(c)
+		if err != nil { return nil, err }
+		return seasonalDetector{inner}, nil
+	}
+	or := func(v, def float64) float64 {
+		if v > 0 { return v }
+		return def
+	}
+	switch c.Algorithm {
+	case "", "zscore":
+		return zScoreDetector{threshold: or(c.Threshold, anomalyZThreshold)}, nil
+	case "mad":
+		w := c.Window
+		if w <= 0 { w = 14 }
+		return madDetector{threshold: or(c.Threshold, 3.5), window: w}, nil
+	case "iqr":
+		return iqrDetector{k: or(c.Threshold, 1.5)}, nil
+	case "ewma":
+		return ewmaDetector{limit: or(c.Threshold, 3), lambda: math.Min(or(c.Lambda, 0.3), 1)}, nil
+	}
+	return nil, fmt.Errorf("unknown anomaly algorithm %q (want zscore, mad, iqr or ewma)", c.Algorithm)
+}
+
+// detectorFor returns the configured detector for dataset, falling back to the
+// "default" entry and then to z-score, skipping the anomaly exclusion windows.
+func detectorFor(dataset string) AnomalyDetector {
+	c, ok := cfg.Anomalies[dataset]
+	if !ok { c = cfg.Anomalies[defaultDataset] }
+	d, err := newDetector(c)
+	if err != nil { d, _ = newDetector(AnomalyConfig{}) } // rejected by loadConfig already
+	if xs := allExclusions(); len(xs) > 0 { d = excludingDetector{d, xs} }
+	return d
+}
+
+func formatParam(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+
+// seasonalMinDays is the history needed to estimate a day-of-week pattern (two of each weekday).
+const seasonalMinDays = 14
+
+// seasonalDetector runs its inner detector on revenue with the day-of-week pattern taken
+// out: each weekday's median minus the overall median is subtracted before scoring, so a
+// regular weekend dip isn't flagged. Flagged days keep their actual revenue.
+type seasonalDetector struct{ inner AnomalyDetector }
+
+func (s seasonalDetector) Name() string { return s.inner.Name() }
+func (s seasonalDetector) Params() map[string]string {
+	p := s.inner.Params()
+	p["seasonal"] = "dayOfWeek"
+	return p
+}
+func (s seasonalDetector) Detect(d []KVt) []Anomaly {
+	if len(d) < seasonalMinDays { return s.inner.Detect(d) }
+	all := make([]float64, len(d))
+	byDay := map[time.Weekday][]float64{}
+	for i, x := range d {
+		all[i] = x.Value
+		byDay[x.Day.Weekday()] = append(byDay[x.Day.Weekday()], x.Value)
+	}
+	overall := median(all)
+	effect := map[time.Weekday]float64{}
+	for wd, vs := range byDay { effect[wd] = median(vs) - overall }
+	adj := make([]KVt, len(d))
+	actual := map[time.Time]float64{}
+	for i, x := range d {
+		adj[i] = KVt{Day: x.Day, Value: x.Value - effect[x.Day.Weekday()]}
+		actual[x.Day] = x.Value
+	}
+	out := s.inner.Detect(adj)
+	for i := range out { out[i].Value = actual[out[i].Day] }
+	return out
+}
+
+// zScoreDetector flags days whose z-score against the mean and standard deviation of all
+// days reaches the threshold.
+type zScoreDetector struct{ threshold float64 }
+
+func (zScoreDetector) Name() string { return "zscore" }
+func (z zScoreDetector) Params() map[string]string {
+	return map[string]string{"threshold": formatParam(z.threshold), "minDays": strconv.Itoa(anomalyMinDays)}
+}
+func (z zScoreDetector) Detect(d []KVt) []Anomaly {
+	if len(d) < anomalyMinDays { return nil }
+	// compute mean & std
+	var sum float64
+	for _, x := range d { sum += x.Value }
+	mean := sum / float64(len(d))
+	var ss float64
+	for _, x := range d { ss += (x.Value - mean) * (x.Value - mean) }
+	std := math.Sqrt(ss / float64(len(d)))
+	if std == 0 { return nil }
+	var out []Anomaly
+	for _, x := range d {
+		score := (x.Value - mean) / std
+		if math.Abs(score) >= z.threshold {
+			out = append(out, Anomaly{Day: x.Day, Value: x.Value, Z: score})
+		}
+	}
+	return out
+}
+
+// madDetector compares each day with the median of the trailing window using the
+// modified z-score 0.6745·(x − median) / MAD, robust to earlier outliers and drift.
+type madDetector struct {
+	threshold float64
+	window    int
+}
+
+func (madDetector) Name() string { return "mad" }
+func (m madDetector) Params() map[string]string {
+	return map[string]string{"threshold": formatParam(m.threshold), "window": strconv.Itoa(m.window)}
+}
+func (m madDetector) Detect(d []KVt) []Anomaly {
+	var out []Anomaly
+	for i := m.window; i < len(d); i++ {
+		var base []float64
+		for _, x := range d[i-m.window : i] { base = append(base, x.Value) }
+		med := median(base)
+		dev := make([]float64, len(base))
+		for j, v := range base { dev[j] = math.Abs(v - med) }
+		mad := median(dev)
+		if mad == 0 { continue }
+		score := 0.6745 * (d[i].Value - med) / mad
+		if math.Abs(score) >= m.threshold {
+			out = append(out, Anomaly{Day: d[i].Day, Value: d[i].Value, Z: score})
+		}
+	}
+	return out
+}
+
+// iqrDetector flags days outside Tukey's fences, Q1 − k·IQR and Q3 + k·IQR; the score is
+// the distance beyond the quartile in IQRs.
+type iqrDetector struct{ k float64 }
+
+func (iqrDetector) Name() string { return "iqr" }
+func (q iqrDetector) Params() map[string]string {
+	return map[string]string{"k": formatParam(q.k), "minDays": strconv.Itoa(anomalyMinDays)}
+}
+func (q iqrDetector) Detect(d []KVt) []Anomaly {
+	if len(d) < anomalyMinDays { return nil }
+	vals := make([]float64, len(d))
+	for i, x := range d { vals[i] = x.Value }
+	sort.Float64s(vals)
+	q1, q3 := median(vals[:len(vals)/2]), median(vals[(len(vals)+1)/2:])
+	iqr := q3 - q1
+	if iqr == 0 { return nil }
+	var out []Anomaly
+	for _, x := range d {
+		var score float64
+		switch {
+		case x.Value > q3: score = (x.Value - q3) / iqr
+		case x.Value < q1: score = (x.Value - q1) / iqr
+		}
+		if math.Abs(score) >= q.k {
+			out = append(out, Anomaly{Day: x.Day, Value: x.Value, Z: score})
+		}
+	}
+	return out
+}
+
+// ewmaDetector is an EWMA control chart: the smoothed series is compared with the overall
+// mean, and a day is flagged when it leaves the ±limit·σ control band (σ scaled for the
+// smoothing). It catches sustained shifts that single-day scores miss.
+type ewmaDetector struct{ limit, lambda float64 }
+
+func (ewmaDetector) Name() string { return "ewma" }
+func (e ewmaDetector) Params() map[string]string {
+	return map[string]string{"limit": formatParam(e.limit), "lambda": formatParam(e.lambda), "minDays": strconv.Itoa(anomalyMinDays)}
+}
+func (e ewmaDetector) Detect(d []KVt) []Anomaly {
+	if len(d) < anomalyMinDays { return nil }
+	var sum float64
+	for _, x := range d { sum += x.Value }
+	mean := sum / float64(len(d))
+	var ss float64
+	for _, x := range d { ss += (x.Value - mean) * (x.Value - mean) }
+	std := math.Sqrt(ss / float64(len(d)))
+	if std == 0 { return nil }
+	var out []Anomaly
+	z := mean
+	for i, x := range d {
+		z = e.lambda*x.Value + (1-e.lambda)*z
+		sigma := std * math.Sqrt(e.lambda/(2-e.lambda)*(1-math.Pow(1-e.lambda, 2*float64(i+1))))
+		score := (z - mean) / sigma
+		if math.Abs(score) >= e.limit {
+			out = append(out, Anomaly{Day: x.Day, Value: x.Value, Z: score})
+		}
+	}
+	return out
+}
+
+// -------- Anomaly exclusions --------
+
+// Exclusion windows are days anomaly detection ignores: a migration week or a known outage
+// would otherwise skew the mean and spread every later day is scored against, and be
+// flagged again on each analysis. They come from the config's "anomalyExclusions" and from
+// the dashboard form (POST /api/v1/anomaly-exclusions), kept in exclusionsPath. The
+// configured detector is wrapped so its callers all skip them.
+var (
+	exclusionsMu    sync.Mutex
+	exclusionsPath  string // empty until loadExclusions, so a demo keeps them in memory
+	savedExclusions []Exclusion
+)
+
+// Exclusion is a window of days left out of anomaly detection; To is its last day.
+type Exclusion struct {
+	ID     int    `json:"id,omitempty"` // set on windows added from the dashboard or API
+	From   string `json:"from"` // YYYY-MM-DD
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// check rewrites x's dates as YYYY-MM-DD; any format parseDateFlexible reads is accepted.
+func (x *Exclusion) check() error {
+	x.Reason = strings.TrimSpace(x.Reason)
+	from := parseDateFlexible(x.From)
+	if from.IsZero() { return fmt.Errorf("invalid from date %q", x.From) }
+	x.From = from.Format("2006-01-02")
+	if strings.TrimSpace(x.To) == "" { x.To = x.From }
+	to := parseDateFlexible(x.To)
+	if to.IsZero() || to.Before(from) { return fmt.Errorf("to %q must be a date on or after %s", x.To, x.From) }
+	x.To = to.Format("2006-01-02")
+	return nil
+}
+
+// Span is the window as "from..to", or the one day.
+func (x Exclusion) Span() string {
+	if x.To == "" || x.To == x.From { return x.From }
+	return x.From + ".." + x.To
+}
+
+func (x Exclusion) covers(day time.Time) bool {
+	d := day.Format("2006-01-02")
+	return d >= x.From && d <= nz(x.To, x.From)
+}
+
+func loadExclusions(path string) error {
+	exclusionsPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("anomaly exclusions: %w", err) }
+	var xs []Exclusion
+	if err := json.Unmarshal(b, &xs); err != nil { return fmt.Errorf("anomaly exclusions %s: %w", path, err) }
+	for i := range xs {
+		if err := xs[i].check(); err != nil { return fmt.Errorf("anomaly exclusions %s: %d: %w", path, xs[i].ID, err) }
+	}
+	savedExclusions = xs
+	return nil
+}
+
+func saveExclusions() error {
+	if exclusionsPath == "" { return nil }
+	b, _ := json.MarshalIndent(savedExclusions, "", "  ")
+	return os.WriteFile(exclusionsPath, b, 0644)
+}
+
+// allExclusions returns the config's windows followed by the saved ones.
+func allExclusions() []Exclusion {
+	exclusionsMu.Lock()
+	defer exclusionsMu.Unlock()
+	return append(append([]Exclusion{}, cfg.AnomalyExclusions...), savedExclusions...)
+}
+
+func excluded(day time.Time, xs []Exclusion) bool {
+	for _, x := range xs {
+		if x.covers(day) { return true }
+	}
+	return false
+}
+
+// excludingDetector runs its inner detector on the days outside every window, so they
+// neither feed its baseline nor get flagged.
+type excludingDetector struct {
+	inner   AnomalyDetector
+	windows []Exclusion
+}
+
+func (e excludingDetector) Name() string { return e.inner.Name() }
+func (e excludingDetector) Params() map[string]string {
+	p := e.inner.Params()
+	spans := make([]string, len(e.windows))
+	for i, x := range e.windows { spans[i] = x.Span() }
+	p["exclude"] = strings.Join(spans, "; ")
+	return p
+}
+func (e excludingDetector) Detect(d []KVt) []Anomaly {
+	kept := make([]KVt, 0, len(d))
+	for _, x := range d {
+		if !excluded(x.Day, e.windows) { kept = append(kept, x) }
+	}
+	return e.inner.Detect(kept)
+}
+
+func handleAnomalyExclusions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if r.Method == http.MethodDelete || r.FormValue("action") == "delete" {
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			exclusionsMu.Lock()
+			kept, found := []Exclusion{}, false
+			for _, x := range savedExclusions {
+				if x.ID == id { found = true; continue }
+				kept = append(kept, x)
+			}
+			if !found {
+				exclusionsMu.Unlock()
+				http.Error(w, "no exclusion with that id", 404); return
+			}
+			savedExclusions = kept
+			err := saveExclusions()
+			exclusionsMu.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+		} else {
+			var x Exclusion
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&x); err != nil {
+					http.Error(w, "invalid JSON body", 400); return
+				}
+			} else {
+				x = Exclusion{From: r.FormValue("from"), To: r.FormValue("to"), Reason: r.FormValue("reason")}
+			}
+			if err := x.check(); err != nil {
+				http.Error(w, "anomaly exclusion: "+err.Error(), 400); return
+			}
+			exclusionsMu.Lock()
+			x.ID = 1
+			for _, s := range savedExclusions {
+				if s.ID >= x.ID { x.ID = s.ID + 1 }
+			}
+			savedExclusions = append(savedExclusions, x)
+			sort.SliceStable(savedExclusions, func(i, j int) bool { return savedExclusions[i].From < savedExclusions[j].From })
+			err := saveExclusions()
+			exclusionsMu.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+		}
+		recomputeLatest()
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/#exclusions", http.StatusSeeOther); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(allExclusions())
+}
+
+// -------- Segment anomalies --------
+
+const (
+	segmentWindow    = 7    // days summed into each point of a segment's series
+	segmentMinChange = 0.25 // flagged days within this share of the usual level are dropped
+)
+
+// SegmentAnomaly is an unusual stretch for one top account or product, found by running
+// the configured detector over its trailing 7-day revenue (days without sales count as
+// zero, so an account going quiet shows up). Days that move less than segmentMinChange
+// from the median are ignored; consecutive flagged days are reported once, at the most
+// extreme day.
+type SegmentAnomaly struct {
+	Segment  string // account or product
+	Key      string
+	Day      time.Time
+	Value    float64 // trailing 7-day revenue on Day
+	Baseline float64 // median trailing 7-day revenue over the range
+	Z        float64
+	Ongoing  bool // the stretch runs through the last day of data
+}
+
+func segmentAnomalies(sales []Sale, accounts, products []KVf, from, to time.Time, det AnomalyDetector) []SegmentAnomaly {
+	days := int(to.Sub(from).Hours()/24) + 1
+	if days < segmentWindow+anomalyMinDays { return nil }
+	type seg struct{ segment, key string }
+	series := map[seg][]float64{}
+	for _, kv := range accounts { series[seg{"account", kv.Key}] = make([]float64, days) }
+	for _, kv := range products { series[seg{"product", kv.Key}] = make([]float64, days) }
+	for _, s := range sales {
+		i := int(s.Date.Sub(from).Hours() / 24)
+		if v := series[seg{"account", accountOf(s.Customer)}]; v != nil { v[i] += s.Amount }
+		if v := series[seg{"product", s.Product}]; v != nil { v[i] += s.Amount }
+	}
+	// a trailing week overlapping an exclusion window is left out whole
+	xs := allExclusions()
+	skip := make([]bool, days)
+	for i := range skip {
+		for j := i - segmentWindow + 1; j <= i && !skip[i]; j++ { skip[i] = j >= 0 && excluded(from.AddDate(0, 0, j), xs) }
+	}
+	var out []SegmentAnomaly
+	for sg, v := range series {
+		var rolling []KVt
+		var sums []float64
+		var sum float64
+		for i, x := range v {
+			sum += x
+			if i >= segmentWindow { sum -= v[i-segmentWindow] }
+			if i < segmentWindow-1 || skip[i] { continue }
+			rolling = append(rolling, KVt{Day: from.AddDate(0, 0, i), Value: sum})
+			sums = append(sums, sum)
+		}
+		base := median(sums)
+		var run *SegmentAnomaly
+		var prev time.Time
+		for _, a := range det.Detect(rolling) {
+			if math.Abs(a.Value-base) < segmentMinChange*base { continue }
+			if run == nil || !a.Day.Equal(prev.AddDate(0, 0, 1)) {
+				out = append(out, SegmentAnomaly{Segment: sg.segment, Key: sg.key, Baseline: base})
+				run = &out[len(out)-1]
+			}
+			if math.Abs(a.Z) > math.Abs(run.Z) { run.Day, run.Value, run.Z = a.Day, a.Value, a.Z }
+			run.Ongoing = a.Day.Equal(to)
+			prev = a.Day
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Ongoing != out[j].Ongoing { return out[i].Ongoing }
+		if !out[i].Day.Equal(out[j].Day) { return out[i].Day.After(out[j].Day) }
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+func segmentSuggestions(sa []SegmentAnomaly) []Suggestion {
+	label := map[string]string{"account": "Account", "product": "Product"}
+	var s []Suggestion
+	for _, a := range sa {
+		if !a.Ongoing { continue }
+		if a.Z < 0 {
+			s = append(s, Suggestion{Key: "segment:" + a.Segment + ":" + a.Key, Text: fmt.Sprintf("%s %s has gone quiet: %s in the last 7 days vs a usual %s. Check in before it lapses.", label[a.Segment], a.Key, money(a.Value), money(a.Baseline)),
+				Impact: a.Baseline - a.Value, Basis: "weekly revenue below usual"})
+		} else {
+			s = append(s, Suggestion{Key: "segment:" + a.Segment + ":" + a.Key, Text: fmt.Sprintf("%s %s is surging: %s in the last 7 days vs a usual %s. Find out what's driving it.", label[a.Segment], a.Key, money(a.Value), money(a.Baseline)),
+				Impact: a.Value - a.Baseline, Basis: "weekly revenue above usual"})
+		}
+	}
+	return s
+}
+
+// -------- Forecast tracking --------
+
+const defaultForecastBand = 0.25 // alert when actuals miss the forecast by more than ±25%
+
+// ForecastRecord is one persisted forecast: the daily projection made from data through AsOf.
+type ForecastRecord struct {
+	MadeAt time.Time
+	AsOf   time.Time
+	Days   []KVt
+}
+
+// ForecastPoint compares a forecasted period (a day or an ISO week) with its actuals.
+type ForecastPoint struct {
+	Day      time.Time // the day, or the Monday of the week
+	Forecast float64
+	Actual   float64
+	Error    float64 // (actual - forecast) / forecast
+	Breach   bool    // outside the band
+	New      bool    // breach not alerted before
+}
+
+// ForecastTracking is forecast error over time; Chart is a pre-rendered SVG.
+type ForecastTracking struct {
+	Band   float64
+	Days   []ForecastPoint
+	Weeks  []ForecastPoint
+	MAPE   float64 // mean absolute percentage error over Days
+	Chart  template.HTML `json:"-"`
+}
+
+var (
+	forecastMu      sync.Mutex
+	forecastLog     []ForecastRecord
+	forecastPath    string
+	forecastAlerted = map[string]bool{} // breach days already alerted
+)
+
+func loadForecasts(path string) error {
+	forecastPath = path
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return err }
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var rec ForecastRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("forecasts %s: %w", path, err)
+		}
+		forecastLog = append(forecastLog, rec)
+	}
+}
+
+// recordForecast stores the daily forecast implied by k, replacing an earlier one with
+// the same AsOf so re-uploading a day's data doesn't stack duplicates.
+func recordForecast(k KPIs) error {
+	if len(k.DailyRevenue) == 0 { return nil }
+	rec := ForecastRecord{MadeAt: time.Now(), AsOf: k.To}
+	if k.Forecast != nil {
+		for _, d := range k.Forecast.Days { rec.Days = append(rec.Days, KVt{Day: d.Day, Value: d.Value}) }
+	}
+	forecastMu.Lock()
+	defer forecastMu.Unlock()
+	kept := forecastLog[:0]
+	for _, r := range forecastLog {
+		if !r.AsOf.Equal(rec.AsOf) { kept = append(kept, r) }
+	}
+	forecastLog = append(kept, rec)
+	if forecastPath == "" { return nil }
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, r := range forecastLog { enc.Encode(r) }
+	return os.WriteFile(forecastPath, b.Bytes(), 0644)
+}
+
+// trackForecasts scores stored forecasts against daily actuals. Each day uses the latest
+// forecast made before it; days in the data range without sales count as zero.
+// With alert set, breaches not seen before are flagged New and remembered.
+func trackForecasts(daily []KVt, to time.Time, alert bool) *ForecastTracking {
+	band := cfg.ForecastBand
+	if band <= 0 { band = defaultForecastBand }
+	actual := map[string]float64{}
+	for _, d := range daily { actual[d.Day.Format("2006-01-02")] = d.Value }
+	forecastMu.Lock()
+	defer forecastMu.Unlock()
+	best := map[string]ForecastRecord{}
+	fc := map[string]float64{}
+	for _, r := range forecastLog {
+		for _, d := range r.Days {
+			key := d.Day.Format("2006-01-02")
+			if d.Day.After(to) || (len(daily) > 0 && d.Day.Before(daily[0].Day)) { continue }
+			if prev, ok := best[key]; !ok || r.AsOf.After(prev.AsOf) {
+				best[key], fc[key] = r, d.Value
+			}
+		}
+	}
+	if len(fc) == 0 { return nil }
+	t := &ForecastTracking{Band: band}
+	weeks := map[time.Time]*ForecastPoint{}
+	for key, f := range fc {
+		day, _ := time.Parse("2006-01-02", key)
+		t.Days = append(t.Days, ForecastPoint{Day: day, Forecast: f, Actual: actual[key]})
+		monday := day.AddDate(0, 0, -int((day.Weekday()+6)%7))
+		if weeks[monday] == nil { weeks[monday] = &ForecastPoint{Day: monday} }
+		weeks[monday].Forecast += f
+		weeks[monday].Actual += actual[key]
+	}
+	for _, w := range weeks { t.Weeks = append(t.Weeks, *w) }
+	score := func(ps []ForecastPoint) {
+		sort.Slice(ps, func(i, j int) bool { return ps[i].Day.Before(ps[j].Day) })
+		for i := range ps {
+			if ps[i].Forecast > 0 { ps[i].Error = (ps[i].Actual - ps[i].Forecast) / ps[i].Forecast }
+			ps[i].Breach = math.Abs(ps[i].Error) > band
+		}
+	}
+	score(t.Days)
+	score(t.Weeks)
+	for i := range t.Days {
+		t.MAPE += math.Abs(t.Days[i].Error) / float64(len(t.Days))
+		key := t.Days[i].Day.Format("2006-01-02")
+		if alert && t.Days[i].Breach && !forecastAlerted[key] {
+			t.Days[i].New = true
+			forecastAlerted[key] = true
+		}
+	}
+	t.Chart = forecastChart(t.Days)
+	return t
+}
+
+// forecastChart draws actuals (solid) against forecasts (dashed).
+func forecastChart(ps []ForecastPoint) template.HTML {
+	if len(ps) == 0 { return "" }
+	maxV := 0.0
+	for _, p := range ps { maxV = math.Max(maxV, math.Max(p.Actual, p.Forecast)) }
+	w, h := 600.0, 120.0
+	path := func(val func(ForecastPoint) float64) string {
+		var pts []string
+		for i, p := range ps {
+			x := float64(i) * (w / float64(max(1, len(ps)-1)))
+			pts = append(pts, fmt.Sprintf("%.1f,%.1f", x, h-scale(val(p), 0, maxV, 8, h-8)))
+		}
+		return "M " + strings.Join(pts, " L ")
+	}
+	return template.HTML(fmt.Sprintf(`<svg viewBox="0 0 %.0f %.0f"><path d="%s" fill="none" stroke="#9aa7cf" stroke-width="2" stroke-dasharray="6 4"/><path d="%s" fill="none" stroke="#7aa2ff" stroke-width="2"/></svg>`,
+		w, h, path(func(p ForecastPoint) float64 { return p.Forecast }), path(func(p ForecastPoint) float64 { return p.Actual })))
+}
+
+// handleForecasts serves GET /api/v1/forecasts: stored forecasts and, when data is loaded, their tracking.
+func handleForecasts(w http.ResponseWriter, r *http.Request) {
+	forecastMu.Lock()
+	out := struct {
+		Forecasts []ForecastRecord
+		Tracking  *ForecastTracking
+	}{Forecasts: append([]ForecastRecord{}, forecastLog...)}
+	forecastMu.Unlock()
+	if k := shared.view().KPIs; k != nil { out.Tracking = k.ForecastTracking }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// -------- Momentum --------
+
+const (
+	momentumShort = 7  // days in the short run-rate window
+	momentumLong  = 28 // days in the long run-rate window
+)
+
+// Momentum describes how fast revenue is moving. Run rates are average revenue per
+// calendar day (days without sales count as zero). Velocity is how much the 7-day run
+// rate moved over the last week; Acceleration is the change in velocity from the week
+// before, a discrete second derivative of the smoothed series. Zero means not enough history.
+type Momentum struct {
+	RunRate7            float64
+	RunRate28           float64
+	RunRateRatio        float64 // RunRate7 / RunRate28; above 1 means the recent pace is faster
+	Velocity            float64
+	Acceleration        float64
+	GrowthStreak        int // consecutive days, ending on the last day, each above the day before
+	LongestGrowthStreak int
+	Label               string // accelerating, steady or slowing
+}
+
+// calendarSeries fills missing days of a sorted daily series with zeros.
+func calendarSeries(daily []KVt) []float64 {
+	if len(daily) == 0 { return nil }
+	first := daily[0].Day
+	n := int(daily[len(daily)-1].Day.Sub(first).Hours()/24) + 1
+	out := make([]float64, n)
+	for _, d := range daily { out[int(d.Day.Sub(first).Hours()/24)] += d.Value }
+	return out
+}
+
+func momentum(daily []KVt) *Momentum {
+	v := calendarSeries(daily)
+	if len(v) < momentumShort+1 { return nil }
+	avg := func(end, n int) float64 { // mean of the n days ending at index end (inclusive)
+		if end-n+1 < 0 { n = end + 1 }
+		var s float64
+		for i := end - n + 1; i <= end; i++ { s += v[i] }
+		return s / float64(n)
+	}
+	last := len(v) - 1
+	m := &Momentum{RunRate7: avg(last, momentumShort), RunRate28: avg(last, momentumLong)}
+	if m.RunRate28 > 0 { m.RunRateRatio = m.RunRate7 / m.RunRate28 }
+	if last >= 2*momentumShort-1 {
+		m.Velocity = avg(last, momentumShort) - avg(last-momentumShort, momentumShort)
+	}
+	if last >= 3*momentumShort-1 {
+		prev := avg(last-momentumShort, momentumShort) - avg(last-2*momentumShort, momentumShort)
+		m.Acceleration = m.Velocity - prev
+	}
+	run := 0
+	for i := 1; i <= last; i++ {
+		if v[i] > v[i-1] { run++ } else { run = 0 }
+		if run > m.LongestGrowthStreak { m.LongestGrowthStreak = run }
+	}
+	m.GrowthStreak = run
+	switch {
+	case m.RunRateRatio >= 1.1 || m.Acceleration > 0 && m.Velocity > 0:
+		m.Label = "accelerating"
+	case m.RunRateRatio > 0 && m.RunRateRatio <= 0.9 || m.Acceleration < 0 && m.Velocity < 0:
+		m.Label = "slowing"
+	default:
+		m.Label = "steady"
+	}
+	return m
+}
+
+// momentumSentence is the narrative line used in the report and the AI prompt.
+func momentumSentence(m *Momentum) string {
+	if m == nil { return "" }
+	s := fmt.Sprintf("Momentum is %s: the 7-day run rate is %s/day, %.2f× the 28-day rate", m.Label, money(m.RunRate7), m.RunRateRatio)
+	if m.Velocity != 0 { s += fmt.Sprintf("; it moved %+.2f over the last week", m.Velocity) }
+	if m.Acceleration != 0 { s += fmt.Sprintf(" (%+.2f vs the week before)", m.Acceleration) }
+	s += "."
+	if m.GrowthStreak > 1 { s += fmt.Sprintf(" Revenue has grown %d days in a row.", m.GrowthStreak) }
+	return s
+}
+
+// -------- Health score --------
+
+// HealthScore is a weighted blend of 0-100 component scores. Components without enough
+// data are left out and the remaining weights renormalized.
+type HealthScore struct {
+	Score      float64
+	Grade      string
+	Components []HealthComponent
+}
+
+type HealthComponent struct {
+	Name   string
+	Score  float64
+	Weight float64 // normalized
+	Detail string
+}
+
+func clamp100(v float64) float64 { return math.Max(0, math.Min(100, v)) }
+
+// trailingGrowth compares the last 7 days ending at the final day with the 7 before.
+func trailingGrowth(daily []KVt) (float64, bool) {
+	if len(daily) == 0 { return 0, false }
+	end := daily[len(daily)-1].Day
+	if end.Sub(daily[0].Day) < 13*24*time.Hour { return 0, false }
+	var cur, prev float64
+	for _, d := range daily {
+		age := int(end.Sub(d.Day).Hours() / 24)
+		if age < 7 { cur += d.Value } else if age < 14 { prev += d.Value }
+	}
+	if prev <= 0 { return 0, false }
+	return (cur - prev) / prev, true
+}
+
+func healthScore(k KPIs) *HealthScore {
+	if k.Orders == 0 { return nil }
+	var comps []HealthComponent
+	if g, ok := trailingGrowth(k.DailyRevenue); ok {
+		comps = append(comps, HealthComponent{Name: "growth", Score: clamp100(50 + g*100), Detail: fmt.Sprintf("%+.1f%% vs prior 7 days", g*100)})
+	}
+	if k.Insufficient["retention"] == "" {
+		comps = append(comps, HealthComponent{Name: "retention", Score: clamp100(k.RetentionRate * 100), Detail: fmt.Sprintf("%.1f%% retained", k.RetentionRate*100)})
+	}
+	if k.TotalRevenue > 0 {
+		ratio := k.OverdueTotal / k.TotalRevenue
+		comps = append(comps, HealthComponent{Name: "overdue", Score: clamp100(100 - ratio*200), Detail: fmt.Sprintf("%.1f%% of revenue overdue", ratio*100)})
+		comps = append(comps, HealthComponent{Name: "concentration", Score: clamp100((1 - k.Concentration) * 200), Detail: fmt.Sprintf("top %d accounts %.0f%% of revenue", topListSize, k.Concentration*100)})
+	}
+	if t := weeklyTarget(k.Targets); t > 0 && k.Insufficient["forecast"] == "" {
+		comps = append(comps, HealthComponent{Name: "forecast", Score: clamp100(k.ForecastNext7DaysTotal / t * 100), Detail: fmt.Sprintf("forecast %s vs target %s", money(k.ForecastNext7DaysTotal), money(t))})
+	}
+	weights := defaultHealthWeights
+	if len(cfg.Health.Weights) > 0 { weights = cfg.Health.Weights }
+	var wsum float64
+	for _, c := range comps { wsum += weights[c.Name] }
+	if wsum <= 0 { return nil }
+	h := &HealthScore{}
+	for _, c := range comps {
+		c.Weight = weights[c.Name] / wsum
+		h.Score += c.Score * c.Weight
+		h.Components = append(h.Components, c)
+	}
+	switch {
+	case h.Score >= 80:
+		h.Grade = "healthy"
+	case h.Score >= 60:
+		h.Grade = "watch"
+	default:
+		h.Grade = "at risk"
+	}
+	return h
+}
+
+// -------- Pricing --------
+
+// Pricing summarizes the optional tax, discount and quantity columns. Amounts include tax
+// and are after discounts, so revenue excluding tax is amount less tax, and the discount
+// rate is discounts over what revenue excluding tax would have been without them. Each
+// Has flag is false when no row fills that column, and its figures stay zero.
+type Pricing struct {
+	HasTax, HasDiscount, HasQuantity bool
+	Tax          float64
+	NetExTax     float64 // revenue excluding tax
+	Discount     float64
+	DiscountRate float64
+	Units        float64
+	UnitPrice    float64 // revenue excluding tax per unit, over the rows with a quantity
+	Unit         string  // what Units count, from the dataset metadata ("" for plain units)
+}
+
+// pricing totals the tax, discounts and units in sales; nil when none of them are present.
+func pricing(sales []Sale) *Pricing {
+	p := &Pricing{}
+	var unitRevenue float64
+	for _, s := range sales {
+		tax, disc := s.inBase(s.Tax), s.inBase(s.Discount)
+		p.Tax += tax
+		p.NetExTax += s.Amount - tax
+		p.Discount += disc
+		p.HasTax = p.HasTax || tax != 0
+		p.HasDiscount = p.HasDiscount || disc != 0
+		if s.Quantity != 0 {
+			p.HasQuantity = true
+			p.Units += s.Quantity
+			unitRevenue += s.Amount - tax
+		}
+	}
+	if !p.HasTax && !p.HasDiscount && !p.HasQuantity { return nil }
+	if list := p.NetExTax + p.Discount; list > 0 { p.DiscountRate = p.Discount / list }
+	if p.Units > 0 { p.UnitPrice = unitRevenue / p.Units }
+	return p
+}
+
+// -------- Categories --------
+
+// Products roll up into categories from an optional category column, or the
+// productCategories config for rows without one. Each category compares its last
+// bridgeDays with the bridgeDays before; a drop of categoryDecline or more is suggested
+// for review, as is the top category once there are several.
+const categoryDecline = 0.2
+
+// CategoryRollup is a category's revenue with its products as drill-down rows.
+type CategoryRollup struct {
+	Category string
+	Revenue  float64
+	Share    float64 // of total revenue
+	Current  float64 // last bridgeDays
+	Prior    float64 // the bridgeDays before
+	Change   float64 // Current / Prior - 1; 0 without prior revenue
+	Products []KVf
+}
+
+// categoryOf is a sale's category: its own column, else the configured mapping of its
+// product, else "".
+func categoryOf(s Sale) string {
+	if s.Category != "" { return s.Category }
+	return cfg.ProductCategories[strings.ToLower(s.Product)]
+}
+
+// categoryRollups groups revenue by category as of to; nil when no row has one.
+func categoryRollups(sales []Sale, to time.Time) []CategoryRollup {
+	start := to.AddDate(0, 0, -bridgeDays+1)
+	prevFrom := start.AddDate(0, 0, -bridgeDays)
+	idx := map[string]int{}
+	var out []CategoryRollup
+	products := map[string]map[string]float64{}
+	named := false
+	var total float64
+	for _, s := range sales {
+		cat := categoryOf(s)
+		if cat != "" { named = true }
+		cat = nz(cat, "Uncategorized")
+		i, ok := idx[cat]
+		if !ok {
+			i = len(out)
+			idx[cat] = i
+			out = append(out, CategoryRollup{Category: cat})
+			products[cat] = map[string]float64{}
+		}
+		c := &out[i]
+		c.Revenue += s.Amount
+		total += s.Amount
+		products[cat][s.Product] += s.Amount
+		switch {
+		case !s.Date.Before(start) && !s.Date.After(to):
+			c.Current += s.Amount
+		case !s.Date.Before(prevFrom) && s.Date.Before(start):
+			c.Prior += s.Amount
+		}
+	}
+	if !named { return nil }
+	for i := range out {
+		c := &out[i]
+		if total != 0 { c.Share = c.Revenue / total }
+		if c.Prior > 0 { c.Change = c.Current/c.Prior - 1 }
+		c.Products = topN(products[c.Category], len(products[c.Category]))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Revenue != out[j].Revenue { return out[i].Revenue > out[j].Revenue }
+		return out[i].Category < out[j].Category
+	})
+	return out
+}
+
+func categorySuggestions(cats []CategoryRollup) []Suggestion {
+	var s []Suggestion
+	if len(cats) > 1 && cats[0].Category != "Uncategorized" && len(cats[0].Products) > 0 {
+		top := cats[0]
+		s = append(s, Suggestion{Key: "category:top", Text: fmt.Sprintf("%s is the top category at %.0f%% of revenue, led by %s. Prioritize its stock and promotion.", top.Category, top.Share*100, top.Products[0].Key)})
+	}
+	for _, c := range cats {
+		if c.Prior <= 0 || c.Change > -categoryDecline { continue }
+		s = append(s, Suggestion{Key: "category:" + c.Category, Text: fmt.Sprintf("Category %s is down %.0f%% over the last %d days (%s vs %s). Check pricing, stock and competition.", c.Category, -c.Change*100, bridgeDays, money(c.Current), money(c.Prior)),
+			Impact: c.Prior - c.Current, Basis: "revenue lost against the prior period"})
+	}
+	return s
+}
+
+// handleCategories returns the category rollups, or one category's products with ?category=.
+func handleCategories(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	w.Header().Set("Content-Type", "application/json")
+	if name := r.URL.Query().Get("category"); name != "" {
+		for _, c := range a.KPIs.Categories {
+			if strings.EqualFold(c.Category, name) {
+				json.NewEncoder(w).Encode(c)
+				return
+			}
+		}
+		http.Error(w, "category not found", 404); return
+	}
+	cats := a.KPIs.Categories
+	if cats == nil { cats = []CategoryRollup{} }
+	json.NewEncoder(w).Encode(cats)
+}
+
+// -------- Geography --------
+
+// Rows get a country from the country column, else a region that names a country, else
+// the country-code domain of the customer's email (the row's, else the contact's): .de is
+// DE and .uk is GB, while domains used as generic ones (.io, .co, .ai, ...) say nothing.
+// Names, alpha-2 and alpha-3 codes are accepted and normalized to ISO 3166 alpha-2. Email
+// domains also name the company behind a customer: acme.co.uk is "Acme" unless the
+// companyDomains config says otherwise; free-mail domains (gmail.com, ...) name none.
+
+// CountryRollup is a country's revenue with the companies (else accounts) buying there.
+type CountryRollup struct {
+	Country   string // ISO alpha-2, or "Unknown"
+	Name      string
+	Revenue   float64
+	Share     float64 // of total revenue
+	Orders    int
+	Customers int
+	Current   float64 // last bridgeDays
+	Prior     float64 // the bridgeDays before
+	Change    float64 // Current / Prior - 1; 0 without prior revenue
+	Companies []KVf
+}
+
+// isoCountries is ISO 3166-1 as "alpha-2 alpha-3 names|...", common name first.
+const isoCountries = "AD AND Andorra;Principality of Andorra|AE ARE United Arab Emirates|" +
+	"AF AFG Afghanistan;Islamic Republic of Afghanistan|AG ATG Antigua and Barbuda|AI AIA Anguilla|" +
+	"AL ALB Albania;Republic of Albania|AM ARM Armenia;Republic of Armenia|AO AGO Angola;Republic of Angola|" +
+	"AQ ATA Antarctica|AR ARG Argentina;Argentine Republic|AS ASM American Samoa|" +
+	"AT AUT Austria;Republic of Austria|AU AUS Australia|AW ABW Aruba|AX ALA Åland Islands|" +
+	"AZ AZE Azerbaijan;Republic of Azerbaijan|BA BIH Bosnia and Herzegovina;Republic of Bosnia and Herzegovina|" +
+	"BB BRB Barbados|BD BGD Bangladesh;People's Republic of Bangladesh|BE BEL Belgium;Kingdom of Belgium|" +
+	"BF BFA Burkina Faso|BG BGR Bulgaria;Republic of Bulgaria|BH BHR Bahrain;Kingdom of Bahrain|" +
+	"BI BDI Burundi;Republic of Burundi|BJ BEN Benin;Republic of Benin|BL BLM Saint Barthélemy|BM BMU Bermuda|" +
+	"BN BRN Brunei Darussalam|BO BOL Bolivia;Bolivia, Plurinational State of;Plurinational State of Bolivia|" +
+	"BQ BES Bonaire, Sint Eustatius and Saba|BR BRA Brazil;Federative Republic of Brazil|" +
+	"BS BHS Bahamas;Commonwealth of the Bahamas|BT BTN Bhutan;Kingdom of Bhutan|BV BVT Bouvet Island|" +
+	"BW BWA Botswana;Republic of Botswana|BY BLR Belarus;Republic of Belarus|BZ BLZ Belize|CA CAN Canada|" +
+	"CC CCK Cocos (Keeling) Islands|CD COD Congo, The Democratic Republic of the|CF CAF Central African Republic|" +
+	"CG COG Congo;Republic of the Congo|CH CHE Switzerland;Swiss Confederation|" +
+	"CI CIV Côte d'Ivoire;Republic of Côte d'Ivoire|CK COK Cook Islands|CL CHL Chile;Republic of Chile|" +
+	"CM CMR Cameroon;Republic of Cameroon|CN CHN China;People's Republic of China|" +
+	"CO COL Colombia;Republic of Colombia|CR CRI Costa Rica;Republic of Costa Rica|CU CUB Cuba;Republic of Cuba|" +
+	"CV CPV Cabo Verde;Republic of Cabo Verde|CW CUW Curaçao|CX CXR Christmas Island|" +
+	"CY CYP Cyprus;Republic of Cyprus|CZ CZE Czechia;Czech Republic|DE DEU Germany;Federal Republic of Germany|" +
+	"DJ DJI Djibouti;Republic of Djibouti|DK DNK Denmark;Kingdom of Denmark|" +
+	"DM DMA Dominica;Commonwealth of Dominica|DO DOM Dominican Republic|" +
+	"DZ DZA Algeria;People's Democratic Republic of Algeria|EC ECU Ecuador;Republic of Ecuador|" +
+	"EE EST Estonia;Republic of Estonia|EG EGY Egypt;Arab Republic of Egypt|EH ESH Western Sahara|" +
+	"ER ERI Eritrea;the State of Eritrea|ES ESP Spain;Kingdom of Spain|" +
+	"ET ETH Ethiopia;Federal Democratic Republic of Ethiopia|FI FIN Finland;Republic of Finland|" +
+	"FJ FJI Fiji;Republic of Fiji|FK FLK Falkland Islands (Malvinas)|" +
+	"FM FSM Micronesia, Federated States of;Federated States of Micronesia|FO FRO Faroe Islands|" +
+	"FR FRA France;French Republic|GA GAB Gabon;Gabonese Republic|" +
+	"GB GBR United Kingdom;United Kingdom of Great Britain and Northern Ireland|GD GRD Grenada|GE GEO Georgia|" +
+	"GF GUF French Guiana|GG GGY Guernsey|GH GHA Ghana;Republic of Ghana|GI GIB Gibraltar|GL GRL Greenland|" +
+	"GM GMB Gambia;Republic of the Gambia|GN GIN Guinea;Republic of Guinea|GP GLP Guadeloupe|" +
+	"GQ GNQ Equatorial Guinea;Republic of Equatorial Guinea|GR GRC Greece;Hellenic Republic|" +
+	"GS SGS South Georgia and the South Sandwich Islands|GT GTM Guatemala;Republic of Guatemala|GU GUM Guam|" +
+	"GW GNB Guinea-Bissau;Republic of Guinea-Bissau|GY GUY Guyana;Republic of Guyana|" +
+	"HK HKG Hong Kong;Hong Kong Special Administrative Region of China|HM HMD Heard Island and McDonald Islands|" +
+	"HN HND Honduras;Republic of Honduras|HR HRV Croatia;Republic of Croatia|HT HTI Haiti;Republic of Haiti|" +
+	"HU HUN Hungary|ID IDN Indonesia;Republic of Indonesia|IE IRL Ireland|IL ISR Israel;State of Israel|" +
+	"IM IMN Isle of Man|IN IND India;Republic of India|IO IOT British Indian Ocean Territory|" +
+	"IQ IRQ Iraq;Republic of Iraq|IR IRN Iran;Iran, Islamic Republic of;Islamic Republic of Iran|" +
+	"IS ISL Iceland;Republic of Iceland|IT ITA Italy;Italian Republic|JE JEY Jersey|JM JAM Jamaica|" +
+	"JO JOR Jordan;Hashemite Kingdom of Jordan|JP JPN Japan|KE KEN Kenya;Republic of Kenya|" +
+	"KG KGZ Kyrgyzstan;Kyrgyz Republic|KH KHM Cambodia;Kingdom of Cambodia|KI KIR Kiribati;Republic of Kiribati|" +
+	"KM COM Comoros;Union of the Comoros|KN KNA Saint Kitts and Nevis|" +
+	"KP PRK North Korea;Korea, Democratic People's Republic of;Democratic People's Republic of Korea|" +
+	"KR KOR South Korea;Korea, Republic of|KW KWT Kuwait;State of Kuwait|KY CYM Cayman Islands|" +
+	"KZ KAZ Kazakhstan;Republic of Kazakhstan|LA LAO Laos;Lao People's Democratic Republic|" +
+	"LB LBN Lebanon;Lebanese Republic|LC LCA Saint Lucia|LI LIE Liechtenstein;Principality of Liechtenstein|" +
+	"LK LKA Sri Lanka;Democratic Socialist Republic of Sri Lanka|LR LBR Liberia;Republic of Liberia|" +
+	"LS LSO Lesotho;Kingdom of Lesotho|LT LTU Lithuania;Republic of Lithuania|" +
+	"LU LUX Luxembourg;Grand Duchy of Luxembourg|LV LVA Latvia;Republic of Latvia|LY LBY Libya|" +
+	"MA MAR Morocco;Kingdom of Morocco|MC MCO Monaco;Principality of Monaco|" +
+	"MD MDA Moldova;Moldova, Republic of;Republic of Moldova|ME MNE Montenegro|MF MAF Saint Martin (French part)|" +
+	"MG MDG Madagascar;Republic of Madagascar|MH MHL Marshall Islands;Republic of the Marshall Islands|" +
+	"MK MKD North Macedonia;Republic of North Macedonia|ML MLI Mali;Republic of Mali|" +
+	"MM MMR Myanmar;Republic of Myanmar|MN MNG Mongolia|MO MAC Macao;Macao Special Administrative Region of China|" +
+	"MP MNP Northern Mariana Islands;Commonwealth of the Northern Mariana Islands|MQ MTQ Martinique|" +
+	"MR MRT Mauritania;Islamic Republic of Mauritania|MS MSR Montserrat|MT MLT Malta;Republic of Malta|" +
+	"MU MUS Mauritius;Republic of Mauritius|MV MDV Maldives;Republic of Maldives|MW MWI Malawi;Republic of Malawi|" +
+	"MX MEX Mexico;United Mexican States|MY MYS Malaysia|MZ MOZ Mozambique;Republic of Mozambique|" +
+	"NA NAM Namibia;Republic of Namibia|NC NCL New Caledonia|NE NER Niger;Republic of the Niger|" +
+	"NF NFK Norfolk Island|NG NGA Nigeria;Federal Republic of Nigeria|NI NIC Nicaragua;Republic of Nicaragua|" +
+	"NL NLD Netherlands;Kingdom of the Netherlands|NO NOR Norway;Kingdom of Norway|" +
+	"NP NPL Nepal;Federal Democratic Republic of Nepal|NR NRU Nauru;Republic of Nauru|NU NIU Niue|" +
+	"NZ NZL New Zealand|OM OMN Oman;Sultanate of Oman|PA PAN Panama;Republic of Panama|" +
+	"PE PER Peru;Republic of Peru|PF PYF French Polynesia|" +
+	"PG PNG Papua New Guinea;Independent State of Papua New Guinea|PH PHL Philippines;Republic of the Philippines|" +
+	"PK PAK Pakistan;Islamic Republic of Pakistan|PL POL Poland;Republic of Poland|" +
+	"PM SPM Saint Pierre and Miquelon|PN PCN Pitcairn|PR PRI Puerto Rico|" +
+	"PS PSE Palestine, State of;the State of Palestine|PT PRT Portugal;Portuguese Republic|" +
+	"PW PLW Palau;Republic of Palau|PY PRY Paraguay;Republic of Paraguay|QA QAT Qatar;State of Qatar|" +
+	"RE REU Réunion|RO ROU Romania|RS SRB Serbia;Republic of Serbia|RU RUS Russian Federation|" +
+	"RW RWA Rwanda;Rwandese Republic|SA SAU Saudi Arabia;Kingdom of Saudi Arabia|SB SLB Solomon Islands|" +
+	"SC SYC Seychelles;Republic of Seychelles|SD SDN Sudan;Republic of the Sudan|SE SWE Sweden;Kingdom of Sweden|" +
+	"SG SGP Singapore;Republic of Singapore|SH SHN Saint Helena, Ascension and Tristan da Cunha|" +
+	"SI SVN Slovenia;Republic of Slovenia|SJ SJM Svalbard and Jan Mayen|SK SVK Slovakia;Slovak Republic|" +
+	"SL SLE Sierra Leone;Republic of Sierra Leone|SM SMR San Marino;Republic of San Marino|" +
+	"SN SEN Senegal;Republic of Senegal|SO SOM Somalia;Federal Republic of Somalia|" +
+	"SR SUR Suriname;Republic of Suriname|SS SSD South Sudan;Republic of South Sudan|" +
+	"ST STP Sao Tome and Principe;Democratic Republic of Sao Tome and Principe|" +
+	"SV SLV El Salvador;Republic of El Salvador|SX SXM Sint Maarten (Dutch part)|SY SYR Syria;Syrian Arab Republic|" +
+	"SZ SWZ Eswatini;Kingdom of Eswatini|TC TCA Turks and Caicos Islands|TD TCD Chad;Republic of Chad|" +
+	"TF ATF French Southern Territories|TG TGO Togo;Togolese Republic|TH THA Thailand;Kingdom of Thailand|" +
+	"TJ TJK Tajikistan;Republic of Tajikistan|TK TKL Tokelau|TL TLS Timor-Leste;Democratic Republic of Timor-Leste|" +
+	"TM TKM Turkmenistan|TN TUN Tunisia;Republic of Tunisia|TO TON Tonga;Kingdom of Tonga|" +
+	"TR TUR Türkiye;Republic of Türkiye|TT TTO Trinidad and Tobago;Republic of Trinidad and Tobago|TV TUV Tuvalu|" +
+	"TW TWN Taiwan;Taiwan, Province of China|" +
+	"TZ TZA Tanzania;Tanzania, United Republic of;United Republic of Tanzania|UA UKR Ukraine|" +
+	"UG UGA Uganda;Republic of Uganda|UM UMI United States Minor Outlying Islands|" +
+	"US USA United States;United States of America|UY URY Uruguay;Eastern Republic of Uruguay|" +
+	"UZ UZB Uzbekistan;Republic of Uzbekistan|VA VAT Holy See (Vatican City State)|" +
+	"VC VCT Saint Vincent and the Grenadines|" +
+	"VE VEN Venezuela;Venezuela, Bolivarian Republic of;Bolivarian Republic of Venezuela|" +
+	"VG VGB Virgin Islands, British;British Virgin Islands|" +
+	"VI VIR Virgin Islands, U.S.;Virgin Islands of the United States|" +
+	"VN VNM Vietnam;Viet Nam;Socialist Republic of Viet Nam|VU VUT Vanuatu;Republic of Vanuatu|" +
+	"WF WLF Wallis and Futuna|WS WSM Samoa;Independent State of Samoa|YE YEM Yemen;Republic of Yemen|" +
+	"YT MYT Mayotte|ZA ZAF South Africa;Republic of South Africa|ZM ZMB Zambia;Republic of Zambia|" +
+	"ZW ZWE Zimbabwe;Republic of Zimbabwe"
+
+// countryAliases are common names the ISO table doesn't spell out.
+var countryAliases = map[string]string{
+	"usa": "US", "u.s.": "US", "u.s.a.": "US", "america": "US", "united states of america": "US",
+	"uk": "GB", "u.k.": "GB", "great britain": "GB", "britain": "GB", "england": "GB", "scotland": "GB", "wales": "GB", "northern ireland": "GB",
+	"holland": "NL", "the netherlands": "NL", "korea": "KR", "russia": "RU", "czech republic": "CZ", "ivory coast": "CI", "uae": "AE",
+	"vietnam": "VN", "turkey": "TR", "deutschland": "DE", "españa": "ES", "schweiz": "CH", "österreich": "AT", "méxico": "MX", "brasil": "BR",
+}
+
+// genericTLDs are country-code domains mostly used without regard to the country.
+var genericTLDs = map[string]bool{"io": true, "co": true, "ai": true, "me": true, "tv": true, "fm": true, "ly": true, "gg": true,
+	"cc": true, "ws": true, "to": true, "sh": true, "ac": true, "la": true, "nu": true, "tk": true, "so": true, "am": true, "vc": true}
+
+// freeMail are mail providers (by the domain's name, so yahoo.co.uk counts) whose
+// domains say nothing about the company.
+var freeMail = map[string]bool{"gmail": true, "googlemail": true, "yahoo": true, "ymail": true, "hotmail": true, "outlook": true,
+	"live": true, "msn": true, "icloud": true, "me": true, "mac": true, "aol": true, "protonmail": true, "proton": true, "pm": true,
+	"gmx": true, "web": true, "mail": true, "yandex": true, "qq": true, "163": true, "126": true, "zoho": true, "fastmail": true,
+	"hey": true, "tutanota": true, "orange": true, "comcast": true, "btinternet": true, "free": true, "laposte": true, "libero": true, "t-online": true}
+
+// secondLevel are the labels registries put under a country code: acme.co.uk, acme.com.au.
+var secondLevel = map[string]bool{"co": true, "com": true, "org": true, "net": true, "ac": true, "gov": true, "edu": true, "ltd": true, "plc": true, "ne": true, "or": true}
+
+// countryIndex maps lower-cased names and codes to alpha-2 codes; countryNames maps
+// alpha-2 codes to display names.
+var countryIndex, countryNames = buildCountryIndex()
+
+func buildCountryIndex() (map[string]string, map[string]string) {
+	index, names := map[string]string{}, map[string]string{}
+	for _, e := range strings.Split(isoCountries, "|") {
+		parts := strings.SplitN(e, " ", 3)
+		code := parts[0]
+		index[strings.ToLower(code)], index[strings.ToLower(parts[1])] = code, code
+		for i, n := range strings.Split(parts[2], ";") {
+			if i == 0 { names[code] = n }
+			index[strings.ToLower(n)] = code
+		}
+	}
+	for alias, code := range countryAliases { index[alias] = code }
+	return index, names
+}
+
+// normalizeCountry is the alpha-2 code of a country name or code, or "" when v isn't one.
+func normalizeCountry(v string) string {
+	return countryIndex[strings.ToLower(strings.TrimSpace(v))]
+}
+
+// countryName is the display name of an alpha-2 code, or the code itself.
+func countryName(code string) string { return nz(countryNames[code], code) }
+
+// emailDomain is the lower-cased domain of an email address, or "".
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 { return "" }
+	d := strings.Trim(strings.ToLower(strings.TrimSpace(email[i+1:])), ".>")
+	if !strings.Contains(d, ".") { return "" }
+	return d
+}
+
+// domainCountry is the country of a country-code domain, or "".
+func domainCountry(domain string) string {
+	tld := domain[strings.LastIndex(domain, ".")+1:]
+	if len(tld) != 2 || genericTLDs[tld] { return "" }
+	if tld == "uk" { return "GB" }
+	if code := strings.ToUpper(tld); countryNames[code] != "" { return code }
+	return ""
+}
+
+// domainCompany names the company behind an email domain; "" for free-mail ones.
+func domainCompany(domain string) string {
+	if domain == "" { return "" }
+	labels := strings.Split(domain, ".")
+	i := len(labels) - 2
+	if i > 0 && len(labels[len(labels)-1]) == 2 && secondLevel[labels[i]] { i-- }
+	registered := strings.Join(labels[i:], ".")
+	for _, d := range []string{domain, registered} {
+		if c := cfg.CompanyDomains[d]; c != "" { return c }
+	}
+	if freeMail[labels[i]] { return "" }
+	words := strings.Fields(strings.NewReplacer("-", " ", "_", " ").Replace(labels[i]))
+	for j, w := range words { words[j] = strings.ToUpper(w[:1]) + w[1:] }
+	return strings.Join(words, " ")
+}
+
+// saleEmail is the row's email: its email column, a customer that is an address, else
+// the customer's contact.
+func saleEmail(s Sale) string {
+	if s.Email != "" { return s.Email }
+	if strings.Contains(s.RawCustomer, "@") { return s.RawCustomer }
+	return contactFor(s.Customer).Email
+}
+
+// countryOf is a sale's ISO country, or "" when nothing names one.
+func countryOf(s Sale) string {
+	if s.Country != "" { return s.Country }
+	if c := normalizeCountry(s.Region); c != "" { return c }
+	if d := emailDomain(saleEmail(s)); d != "" { return domainCountry(d) }
+	return ""
+}
+
+// companyOf is the company named by a sale's email domain, or "".
+func companyOf(s Sale) string { return domainCompany(emailDomain(saleEmail(s))) }
+
+// countryRollups groups revenue by country as of to; nil when no row has one.
+func countryRollups(sales []Sale, to time.Time) []CountryRollup {
+	start := to.AddDate(0, 0, -bridgeDays+1)
+	prevFrom := start.AddDate(0, 0, -bridgeDays)
+	idx := map[string]int{}
+	var out []CountryRollup
+	companies := map[string]map[string]float64{}
+	customers := map[string]map[string]bool{}
+	named := false
+	var total float64
+	for _, s := range sales {
+		code := countryOf(s)
+		if code != "" { named = true }
+		code = nz(code, "Unknown")
+		i, ok := idx[code]
+		if !ok {
+			i = len(out)
+			idx[code] = i
+			out = append(out, CountryRollup{Country: code, Name: countryName(code)})
+			companies[code], customers[code] = map[string]float64{}, map[string]bool{}
+		}
+		c := &out[i]
+		c.Revenue += s.Amount
+		if !isRefund(s) { c.Orders++ }
+		total += s.Amount
+		companies[code][nz(companyOf(s), accountOf(s.Customer))] += s.Amount
+		customers[code][s.Customer] = true
+		switch {
+		case !s.Date.Before(start) && !s.Date.After(to):
+			c.Current += s.Amount
+		case !s.Date.Before(prevFrom) && s.Date.Before(start):
+			c.Prior += s.Amount
+		}
+	}
+	if !named { return nil }
+	for i := range out {
+		c := &out[i]
+		if total != 0 { c.Share = c.Revenue / total }
+		if c.Prior > 0 { c.Change = c.Current/c.Prior - 1 }
+		c.Customers = len(customers[c.Country])
+		c.Companies = topN(companies[c.Country], topListSize)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Revenue != out[j].Revenue { return out[i].Revenue > out[j].Revenue }
+		return out[i].Country < out[j].Country
+	})
+	return out
+}
+
+// handleCountries returns revenue by country, or one country's with ?country= (a code or name).
+func handleCountries(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	w.Header().Set("Content-Type", "application/json")
+	if name := r.URL.Query().Get("country"); name != "" {
+		code := nz(normalizeCountry(name), name)
+		for _, c := range a.KPIs.Countries {
+			if strings.EqualFold(c.Country, code) {
+				json.NewEncoder(w).Encode(c)
+				return
+			}
+		}
+		http.Error(w, "country not found", 404); return
+	}
+	countries := a.KPIs.Countries
+	if countries == nil { countries = []CountryRollup{} }
+	json.NewEncoder(w).Encode(countries)
+}
+
+// -------- Segments --------
+
+// /api/kpis?groupby=region splits the KPIs by a segmentation column: each segment's
+// totals, its revenue trend, its last bridgeDays against the bridgeDays before, and the
+// anomaly detector run on its own daily revenue. Rows without a value are "(none)";
+// only the largest maxSegments segments are returned.
+var groupByFields = []string{"region", "country", "channel", "rep", "campaign", "category", "product", "account", "company", "customer", "currency", "status"}
+
+const maxSegments = 25
+
+// SegmentKPIs is one value of the grouping column.
+type SegmentKPIs struct {
+	Segment       string
+	Revenue       float64
+	Share         float64 // of total revenue
+	Orders        int
+	AvgOrderValue float64
+	Customers     int
+	Current       float64 // revenue over the last bridgeDays
+	Prior         float64 // the bridgeDays before that
+	Change        float64 // Current vs Prior; 0 without prior revenue
+	Trend         []KVt   // revenue by Granularity
+	Anomalies     []Anomaly
+}
+
+// SegmentedKPIs is the KPIs grouped by GroupBy, largest segment first.
+type SegmentedKPIs struct {
+	GroupBy     string
+	Granularity string
+	From, To    time.Time
+	Segments    []SegmentKPIs
+	Omitted     int // smaller segments beyond maxSegments
+}
+
+// segmentFields lists the groupByFields with a value on at least one row, for the
+// dashboard's segment picker.
+func segmentFields(sales []Sale) []string {
+	var out []string
+	for _, f := range groupByFields {
+		for _, s := range sales {
+			if fmt.Sprint(saleColumn(s, f)) != "" { out = append(out, f); break }
+		}
+	}
+	return out
+}
+
+// segmentKPIs groups dataset's sales by field; granularity is day, week or month.
+func segmentKPIs(ctx context.Context, dataset string, sales []Sale, field, granularity string) (SegmentedKPIs, error) {
+	out := SegmentedKPIs{GroupBy: field, Granularity: granularity, Segments: []SegmentKPIs{}}
+	if len(sales) == 0 { return out, nil }
+	out.From, out.To = sales[0].Date, sales[0].Date
+	var total float64
+	for _, s := range sales {
+		total += s.Amount
+		if s.Date.Before(out.From) { out.From = s.Date }
+		if s.Date.After(out.To) { out.To = s.Date }
+	}
+	cut := out.To.AddDate(0, 0, -bridgeDays)
+	detector := detectorFor(dataset)
+	values, groups := splitSales(sales, field)
+	if len(values) > maxSegments { out.Omitted, values = len(values)-maxSegments, values[:maxSegments] }
+	for _, v := range values {
+		if ctx.Err() != nil { return out, ctx.Err() }
+		sg := SegmentKPIs{Segment: v}
+		byDay := map[time.Time]float64{}
+		customers := map[string]bool{}
+		for _, s := range groups[v] {
+			sg.Revenue += s.Amount
+			if !isRefund(s) { sg.Orders++ }
+			customers[s.Customer] = true
+			byDay[s.Date] += s.Amount
+			switch {
+			case s.Date.After(cut):
+				sg.Current += s.Amount
+			case s.Date.After(cut.AddDate(0, 0, -bridgeDays)):
+				sg.Prior += s.Amount
+			}
+		}
+		sg.Customers = len(customers)
+		if sg.Orders > 0 { sg.AvgOrderValue = sg.Revenue / float64(sg.Orders) }
+		if total != 0 { sg.Share = sg.Revenue / total }
+		if sg.Prior > 0 { sg.Change = (sg.Current - sg.Prior) / sg.Prior }
+		daily := make([]KVt, 0, len(byDay))
+		for d, x := range byDay { daily = append(daily, KVt{Day: d, Value: x}) }
+		sort.Slice(daily, func(i, j int) bool { return daily[i].Day.Before(daily[j].Day) })
+		sg.Trend = daily
+		if granularity != "day" { sg.Trend = rollupSeries(daily, granularity) }
+		sg.Anomalies = detector.Detect(daily)
+		out.Segments = append(out.Segments, sg)
+	}
+	return out, nil
+}
+
+// -------- Targets --------
+
+// Revenue targets come from the config's "targets" and from the dashboard form (POST
+// /api/v1/targets), kept in targetsPath. Each is tracked for the week or month containing
+// the latest sale: percent-to-target, pace against the share of the period gone, and a
+// projection adding the forecast for the days left. A target projected below
+// cfg.TargetAlert mid-period alerts.
+var (
+	targetsMu    sync.Mutex
+	targetsPath  = "targets.json"
+	savedTargets []Target
+)
+
+// check validates t and fills in its default period and name.
+func (t *Target) check() error {
+	t.Name = strings.TrimSpace(t.Name)
+	t.Period = nz(strings.ToLower(strings.TrimSpace(t.Period)), "month")
+	if t.Period != "week" && t.Period != "month" { return fmt.Errorf("period must be week or month, not %q", t.Period) }
+	if t.Amount < 0 || (t.Amount == 0 && len(t.Overrides) == 0) { return fmt.Errorf("amount must be positive") }
+	for day, v := range t.Overrides {
+		d, err := time.Parse("2006-01-02", day)
+		if err != nil { return fmt.Errorf("overrides: %q isn't a date (YYYY-MM-DD)", day) }
+		if start, _ := periodBounds(d, t.Period); !start.Equal(d) { return fmt.Errorf("overrides: %s doesn't start a %s", day, t.Period) }
+		if v < 0 { return fmt.Errorf("overrides: %s is negative", day) }
+	}
+	if t.Name == "" { t.Name = map[string]string{"week": "Weekly", "month": "Monthly"}[t.Period] }
+	return nil
+}
+
+// amountFor is t's target for the period starting at start; 0 for none.
+func (t Target) amountFor(start time.Time) float64 {
+	if v, ok := t.Overrides[start.Format("2006-01-02")]; ok { return v }
+	return t.Amount
+}
+
+func loadTargets(path string) error {
+	targetsPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("targets: %w", err) }
+	var ts []Target
+	if err := json.Unmarshal(b, &ts); err != nil { return fmt.Errorf("targets %s: %w", path, err) }
+	for i := range ts {
+		if err := ts[i].check(); err != nil { return fmt.Errorf("targets %s: %s: %w", path, ts[i].Name, err) }
+	}
+	savedTargets = ts
+	return nil
+}
+
+func saveTargets() error {
+	if targetsPath == "" { return nil }
+	b, _ := json.MarshalIndent(savedTargets, "", "  ")
+	return os.WriteFile(targetsPath, b, 0644)
+}
+
+// allTargets returns the config's targets followed by the saved ones.
+func allTargets() []Target {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	return append(append([]Target{}, cfg.Targets...), savedTargets...)
+}
+
+// targetAlertRatio is the projected attainment below which a target alerts; 0 when off.
+func targetAlertRatio() float64 {
+	switch r := cfg.TargetAlert; {
+	case r < 0:
+		return 0
+	case r == 0:
+		return 0.9
+	default:
+		return r
+	}
+}
+
+// targetStats tracks every target through the period containing asOf.
+func targetStats(daily []KVt, f *Forecast, asOf time.Time) []TargetStat {
+	threshold := targetAlertRatio()
+	var out []TargetStat
+	for i, t := range allTargets() {
+		start, end := periodBounds(asOf, t.Period)
+		st := TargetStat{Name: t.Name, Period: t.Period, PeriodStart: start, PeriodEnd: end, Target: t.amountFor(start), Saved: i >= len(cfg.Targets)}
+		if st.Target <= 0 { continue }
+		for _, d := range daily {
+			if !d.Day.Before(start) && d.Day.Before(end) { st.Revenue += d.Value }
+		}
+		days := end.Sub(start).Hours() / 24
+		gone := math.Min(asOf.Sub(start).Hours()/24+1, days)
+		st.Elapsed = gone / days
+		st.Attainment = st.Revenue / st.Target
+		st.Pace = st.Attainment / st.Elapsed
+		st.Remaining, st.Basis = remainingRevenue(f, asOf, end, st.Revenue/gone)
+		st.Projected = st.Revenue + st.Remaining
+		st.ProjectedAttainment = st.Projected / st.Target
+		st.Gap = math.Max(st.Target-st.Projected, 0)
+		st.Behind = threshold > 0 && st.Elapsed < 1 && st.ProjectedAttainment < threshold
+		out = append(out, st)
+	}
+	return out
+}
+
+// remainingRevenue is the revenue expected after asOf and before end: the forecast's days,
+// with their average standing in past its horizon, or else runRate a day.
+func remainingRevenue(f *Forecast, asOf, end time.Time, runRate float64) (float64, string) {
+	days := int(math.Round(end.Sub(asOf).Hours()/24)) - 1
+	if days <= 0 { return 0, "" }
+	if f == nil || len(f.Days) == 0 { return runRate * float64(days), "run rate" }
+	var sum, all float64
+	n := 0
+	for _, d := range f.Days {
+		all += d.Value
+		if d.Day.After(asOf) && d.Day.Before(end) { sum, n = sum+d.Value, n+1 }
+	}
+	if n < days { sum += all / float64(len(f.Days)) * float64(days-n) }
+	return sum, "forecast"
+}
+
+// weeklyTarget is the week's revenue target that the 7-day forecast is held to: the first
+// weekly target, else the first monthly one prorated to 7 days; 0 without targets.
+func weeklyTarget(ts []TargetStat) float64 {
+	for _, t := range ts {
+		if t.Period == "week" { return t.Target }
+	}
+	for _, t := range ts {
+		if t.Period == "month" { return t.Target * 7 / (t.PeriodEnd.Sub(t.PeriodStart).Hours() / 24) }
+	}
+	return 0
+}
+
+// targetsBehind lists k's targets projected short of the alert ratio.
+func targetsBehind(k KPIs) []TargetStat {
+	var out []TargetStat
+	for _, t := range k.Targets {
+		if t.Behind { out = append(out, t) }
+	}
+	return out
+}
+
+// TargetsView is the /api/v1/targets response: every target and its attainment now.
+type TargetsView struct {
+	Targets    []Target
+	Attainment []TargetStat
+}
+
+// handleTargets lists the revenue targets and their attainment (GET /api/v1/targets).
+// POST adds or replaces a saved target by name (form fields or JSON name, period,
+// amount, overrides); DELETE ?name= (or POST action=delete) removes one.
+func handleTargets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var t Target
+		del := r.Method == http.MethodDelete || r.FormValue("action") == "delete"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&t); err != nil {
+				http.Error(w, "invalid JSON body", 400); return
+			}
+		} else {
+			t = Target{Name: r.FormValue("name"), Period: r.FormValue("period"), Amount: parseNumber(r.FormValue("amount"))}
+		}
+		if del {
+			t.Name = strings.TrimSpace(t.Name)
+			if t.Name == "" {
+				http.Error(w, "name is required", 400); return
+			}
+		} else {
+			if err := t.check(); err != nil {
+				http.Error(w, err.Error(), 400); return
+			}
+			for _, c := range cfg.Targets {
+				if strings.EqualFold(c.Name, t.Name) {
+					http.Error(w, "a config target already uses that name", 409); return
+				}
+			}
+		}
+		targetsMu.Lock()
+		next, found := []Target{}, false
+		for _, s := range savedTargets {
+			if strings.EqualFold(s.Name, t.Name) { found = true; continue }
+			next = append(next, s)
+		}
+		if !del { next = append(next, t) }
+		if del && !found {
+			targetsMu.Unlock()
+			http.Error(w, "target not found", 404); return
+		}
+		savedTargets = next
+		err := saveTargets()
+		targetsMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		recomputeLatest()
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/#targets", http.StatusSeeOther); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	v := TargetsView{Targets: allTargets(), Attainment: []TargetStat{}}
+	if a := analysisFor(r); a.KPIs != nil && a.KPIs.Targets != nil { v.Attainment = a.KPIs.Targets }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// -------- Receivables aging --------
+
+// Receivables ages the open (overdue/unpaid) invoices as of the last day in the data.
+// Rows with a due date age by days past due, and ones not yet due are Current; rows
+// without one age from the invoice date. DSO is the open balance over the revenue of the
+// trailing dsoWindow days (or all of them, when the data is shorter), times those days.
+type Receivables struct {
+	AsOf    time.Time
+	Basis   string        // due date, invoice date, or due date where present
+	Current AgingBucket   // open invoices not yet due
+	Buckets []AgingBucket // past due, by agingBuckets
+	Open    float64
+	DSO     float64
+	AvgAge  float64     // amount-weighted days past due of the open balance; not yet due counts as 0
+	Drift   *AgingDrift // change in AvgAge over recent analyses; nil without enough history
+}
+
+const dsoWindow = 90 // days of revenue DSO is measured against
+
+// agingBucket returns the agingBuckets index for an invoice age in days.
+func agingBucket(age float64) int {
+	for i, b := range agingBuckets {
+		if age <= b.MaxDays { return i }
+	}
+	return len(agingBuckets) - 1
+}
+
+// receivableAge is how many days an open invoice is past due as of asOf, or since its
+// invoice date when it has no due date; negative until it falls due.
+func receivableAge(s Sale, asOf time.Time) float64 {
+	if !s.Due.IsZero() { return asOf.Sub(s.Due).Hours() / 24 }
+	return asOf.Sub(s.Date).Hours() / 24
+}
+
+// receivables ages sales as of asOf; nil when nothing is open.
+func receivables(sales []Sale, asOf time.Time) *Receivables {
+	r := &Receivables{AsOf: asOf, Buckets: make([]AgingBucket, len(agingBuckets)), Current: AgingBucket{Label: "Not yet due"}}
+	for i, b := range agingBuckets { r.Buckets[i].Label = b.Label }
+	windowStart := asOf.AddDate(0, 0, 1-dsoWindow)
+	first := asOf
+	var revenue float64
+	withDue, without := 0, 0
+	var ageSum float64
+	for _, s := range sales {
+		if s.Date.After(asOf) { continue }
+		if s.Date.Before(first) { first = s.Date }
+		if !s.Date.Before(windowStart) { revenue += s.Amount }
+		if !isOverdue(s.Status) { continue }
+		r.Open += s.Amount
+		if s.Due.IsZero() { without++ } else { withDue++ }
+		if age := receivableAge(s, asOf); age < 0 {
+			r.Current.Count++; r.Current.Amount += s.Amount
+		} else {
+			b := &r.Buckets[agingBucket(age)]
+			b.Count++; b.Amount += s.Amount
+			ageSum += age * s.Amount
+		}
+	}
+	if withDue+without == 0 { return nil }
+	switch {
+	case without == 0:
+		r.Basis = "due date"
+	case withDue == 0:
+		r.Basis = "invoice date"
+	default:
+		r.Basis = "due date where present"
+	}
+	days := math.Min(dsoWindow, asOf.Sub(first).Hours()/24+1)
+	if revenue > 0 { r.DSO = r.Open / revenue * days }
+	if r.Open > 0 { r.AvgAge = ageSum / r.Open }
+	return r
+}
+
+// Aging drift: each analysis records the weighted-average age of its open receivables,
+// and an alert fires when it has grown by more than agingDrift.days over the last
+// agingDrift.snapshots analyses, a sign collections are slipping before any one invoice
+// ages into a late bucket. The history is kept in agingPath (one JSON record per line).
+const (
+	defaultAgingDriftDays      = 5
+	defaultAgingDriftSnapshots = 4
+	agingHistoryLimit          = 500 // records kept, oldest dropped first
+)
+
+// AgingDriftConfig tunes the aging drift alert.
+type AgingDriftConfig struct {
+	Days      float64 `json:"days"`      // growth in average age that alerts (default 5; negative disables)
+	Snapshots int     `json:"snapshots"` // analyses back to compare with (default 4)
+}
+
+// AgingRecord is one analysis's receivables age.
+type AgingRecord struct {
+	MadeAt time.Time
+	AsOf   time.Time
+	AvgAge float64
+	Open   float64
+}
+
+// AgingDrift compares the average age with the analysis Snapshots back, as of Since.
+type AgingDrift struct {
+	Snapshots int
+	Since     time.Time
+	From, To  float64 // average age then and now, in days
+	Change    float64
+	Alert     bool
+}
+
+var (
+	agingMu   sync.Mutex
+	agingLog  []AgingRecord // by AsOf
+	agingPath string
+)
+
+func loadAgingHistory(path string) error {
+	agingPath = path
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return err }
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var rec AgingRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("aging history %s: %w", path, err)
+		}
+		agingLog = append(agingLog, rec)
+	}
+}
+
+func agingDriftLimits() (float64, int) {
+	days, n := cfg.AgingDrift.Days, cfg.AgingDrift.Snapshots
+	if days == 0 { days = defaultAgingDriftDays }
+	if n <= 0 { n = defaultAgingDriftSnapshots }
+	return days, n
+}
+
+// agingDrift compares r with the recorded analysis the configured number of snapshots
+// before it; nil until there are that many.
+func agingDrift(r *Receivables) *AgingDrift {
+	if r == nil { return nil }
+	days, n := agingDriftLimits()
+	agingMu.Lock()
+	defer agingMu.Unlock()
+	var prev []AgingRecord
+	for _, rec := range agingLog {
+		if rec.AsOf.Before(r.AsOf) { prev = append(prev, rec) }
+	}
+	if len(prev) < n { return nil }
+	base := prev[len(prev)-n]
+	d := &AgingDrift{Snapshots: n, Since: base.AsOf, From: base.AvgAge, To: r.AvgAge, Change: r.AvgAge - base.AvgAge}
+	d.Alert = days > 0 && d.Change > days
+	return d
+}
+
+// recordAging stores k's receivables age, replacing an earlier record with the same AsOf.
+func recordAging(k KPIs) error {
+	r := k.Receivables
+	if r == nil { return nil }
+	rec := AgingRecord{MadeAt: time.Now(), AsOf: r.AsOf, AvgAge: r.AvgAge, Open: r.Open}
+	agingMu.Lock()
+	defer agingMu.Unlock()
+	kept := agingLog[:0]
+	for _, x := range agingLog {
+		if !x.AsOf.Equal(rec.AsOf) { kept = append(kept, x) }
+	}
+	agingLog = append(kept, rec)
+	sort.SliceStable(agingLog, func(i, j int) bool { return agingLog[i].AsOf.Before(agingLog[j].AsOf) })
+	if len(agingLog) > agingHistoryLimit { agingLog = agingLog[len(agingLog)-agingHistoryLimit:] }
+	if agingPath == "" { return nil }
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, x := range agingLog { enc.Encode(x) }
+	return os.WriteFile(agingPath, b.Bytes(), 0644)
+}
+
+// agingDrifting reports whether k's receivables age has drifted past the alert threshold.
+func agingDrifting(k KPIs) bool {
+	return k.Receivables != nil && k.Receivables.Drift != nil && k.Receivables.Drift.Alert
+}
+
+// -------- Refunds --------
+
+// Refunds tracks rows with negative amounts (refunds, chargebacks, credit notes), which
+// otherwise only show up as lower net revenue. Rate is refunds over gross revenue; the
+// Last7 figures cover the trailing week the refund alert watches.
+type Refunds struct {
+	Count        int
+	Total        float64 // refunded, as a positive amount
+	Gross        float64 // revenue before refunds
+	Net          float64
+	Rate         float64
+	Last7        float64 // refunded in the last 7 days
+	Rate7        float64 // Last7 over gross revenue of the last 7 days
+	TopProducts  []KVf
+	TopCustomers []KVf
+}
+
+const defaultRefundAlert = 0.1 // trailing-week refund rate that alerts unless configured
+
+// isRefund reports whether s is a refund row. Refunds count against revenue but aren't
+// orders, so they stay out of order counts and the averages built on them.
+func isRefund(s Sale) bool { return s.Amount < 0 }
+
+// refunds summarizes the negative rows in sales as of asOf; nil when there are none.
+func refunds(sales []Sale, asOf time.Time) *Refunds {
+	r := &Refunds{}
+	byProduct, byCustomer := map[string]float64{}, map[string]float64{}
+	weekStart := asOf.AddDate(0, 0, -6)
+	var gross7 float64
+	for _, s := range sales {
+		recent := !s.Date.Before(weekStart) && !s.Date.After(asOf)
+		r.Net += s.Amount
+		if s.Amount >= 0 {
+			r.Gross += s.Amount
+			if recent { gross7 += s.Amount }
+			continue
+		}
+		r.Count++
+		r.Total -= s.Amount
+		byProduct[s.Product] -= s.Amount
+		byCustomer[accountOf(s.Customer)] -= s.Amount
+		if recent { r.Last7 -= s.Amount }
+	}
+	if r.Count == 0 { return nil }
+	if r.Gross > 0 { r.Rate = r.Total / r.Gross }
+	if gross7 > 0 { r.Rate7 = r.Last7 / gross7 }
+	r.TopProducts, r.TopCustomers = topN(byProduct, topListSize), topN(byCustomer, topListSize)
+	return r
+}
+
+// refundAlertRate is the trailing-week refund rate that alerts; 0 when disabled.
+func refundAlertRate() float64 {
+	switch t := cfg.RefundAlert; {
+	case t < 0:
+		return 0
+	case t == 0:
+		return defaultRefundAlert
+	default:
+		return t
+	}
+}
+
+// refundAlerting reports whether k's trailing-week refund rate is at or over the alert rate.
+func refundAlerting(k KPIs) bool {
+	t := refundAlertRate()
+	return t > 0 && k.Refunds != nil && k.Refunds.Last7 > 0 && k.Refunds.Rate7 >= t
+}
+
+// -------- Customer tiers --------
+
+// Customers are tiered per calendar month by revenue percentile rank: the top 10% are
+// Platinum, the next 20% Gold, the next 30% Silver and the rest Bronze (cutoffs round
+// up, so the top customer is always Platinum).
+var tierCutoffs = []struct {
+	Name string
+	Top  float64 // cumulative share of ranked customers
+}{{"Platinum", 0.10}, {"Gold", 0.30}, {"Silver", 0.60}, {"Bronze", 1.0}}
+
+func tierRank(name string) int {
+	for i, t := range tierCutoffs {
+		if t.Name == name { return i }
+	}
+	return len(tierCutoffs)
+}
+
+type CustomerTier struct {
+	Customer string
+	Tier     string
+	Revenue  float64
+}
+
+// TierMigration is a customer's tier change between the previous and latest month.
+// To is empty when the customer bought nothing in the latest month.
+type TierMigration struct {
+	Customer  string
+	From, To  string
+	Direction string // upgrade, downgrade, lapsed
+}
+
+type TierReport struct {
+	Period     string // YYYY-MM
+	PrevPeriod string
+	Counts     map[string]int
+	Customers  []CustomerTier
+	Migrations []TierMigration
+}
+
+func assignTiers(rev map[string]float64) map[string]CustomerTier {
+	ranked := topN(rev, len(rev))
+	out := map[string]CustomerTier{}
+	for i, kv := range ranked {
+		for _, t := range tierCutoffs {
+			if i < int(math.Ceil(t.Top*float64(len(ranked))-1e-9)) {
+				out[kv.Key] = CustomerTier{Customer: kv.Key, Tier: t.Name, Revenue: kv.Value}
+				break
+			}
+		}
+	}
+	return out
+}
+
+func tierReport(sales []Sale) *TierReport {
+	byMonth := map[string]map[string]float64{}
+	for _, s := range sales {
+		m := s.Date.Format("2006-01")
+		if byMonth[m] == nil { byMonth[m] = map[string]float64{} }
+		byMonth[m][s.Customer] += s.Amount
+	}
+	if len(byMonth) == 0 { return nil }
+	var months []string
+	for m := range byMonth { months = append(months, m) }
+	sort.Strings(months)
+	latest := months[len(months)-1]
+	cur := assignTiers(byMonth[latest])
+	tr := &TierReport{Period: latest, Counts: map[string]int{}}
+	for _, ct := range cur {
+		tr.Customers = append(tr.Customers, ct)
+		tr.Counts[ct.Tier]++
+	}
+	sort.Slice(tr.Customers, func(i, j int) bool { return tr.Customers[i].Revenue > tr.Customers[j].Revenue })
+	if len(months) < 2 { return tr }
+	tr.PrevPeriod = months[len(months)-2]
+	prev := assignTiers(byMonth[tr.PrevPeriod])
+	for c, p := range prev {
+		n, ok := cur[c]
+		switch {
+		case !ok:
+			tr.Migrations = append(tr.Migrations, TierMigration{Customer: c, From: p.Tier, Direction: "lapsed"})
+		case tierRank(n.Tier) < tierRank(p.Tier):
+			tr.Migrations = append(tr.Migrations, TierMigration{Customer: c, From: p.Tier, To: n.Tier, Direction: "upgrade"})
+		case tierRank(n.Tier) > tierRank(p.Tier):
+			tr.Migrations = append(tr.Migrations, TierMigration{Customer: c, From: p.Tier, To: n.Tier, Direction: "downgrade"})
+		}
+	}
+	sort.Slice(tr.Migrations, func(i, j int) bool {
+		a, b := tr.Migrations[i], tr.Migrations[j]
+		if tierRank(a.From) != tierRank(b.From) { return tierRank(a.From) < tierRank(b.From) }
+		return a.Customer < b.Customer
+	})
+	return tr
+}
+
+// keyTierLosses are downgrades or lapses of Platinum/Gold customers.
+func keyTierLosses(tr *TierReport) []TierMigration {
+	if tr == nil { return nil }
+	var out []TierMigration
+	for _, m := range tr.Migrations {
+		if m.Direction != "upgrade" && tierRank(m.From) <= tierRank("Gold") { out = append(out, m) }
+	}
+	return out
+}
+
+func tierSuggestions(tr *TierReport) []Suggestion {
+	if tr == nil { return nil }
+	var s []Suggestion
+	for _, m := range keyTierLosses(tr) {
+		if m.Direction == "lapsed" {
+			s = append(s, Suggestion{Key: "tier:" + m.Customer, Text: fmt.Sprintf("%s customer %s made no purchase in %s. Reach out before they churn.", m.From, m.Customer, tr.Period)})
+		} else {
+			s = append(s, Suggestion{Key: "tier:" + m.Customer, Text: fmt.Sprintf("%s slipped from %s to %s in %s. Schedule an account review.", m.Customer, m.From, m.To, tr.Period)})
+		}
+	}
+	var ups []string
+	for _, m := range tr.Migrations {
+		if m.Direction == "upgrade" && tierRank(m.To) <= tierRank("Gold") { ups = append(ups, m.Customer+" → "+m.To) }
+	}
+	if len(ups) > 0 {
+		s = append(s, Suggestion{Key: "tier:upgrades", Text: fmt.Sprintf("Recognize customers who moved up a tier: %s.", strings.Join(ups, ", "))})
+	}
+	return s
+}
+
+// -------- Customer lifetime value --------
+
+const (
+	ltvHorizonDays = 365 // days of future orders counted in projected LTV
+	ltvTableRows   = 200 // customers listed in the dashboard LTV table
+)
+
+// CustomerLTV is one customer's purchase history and projected lifetime value.
+// Frequency and gap need two or more orders; one-time buyers project no future orders,
+// so their ProjectedLTV equals Revenue.
+type CustomerLTV struct {
+	Customer       string
+	Revenue        float64
+	Orders         int
+	AvgOrderValue  float64
+	OrdersPerMonth float64 // average order frequency over the customer's active span
+	AvgGapDays     float64 // average days between consecutive orders
+	FirstOrder     time.Time
+	LastOrder      time.Time
+	ProjectedLTV   float64 // Revenue plus AOV × orders expected over the next ltvHorizonDays
+}
+
+// customerLTV computes LTV for every customer, highest projected LTV first.
+func customerLTV(sales []Sale) []CustomerLTV {
+	by := map[string]*CustomerLTV{}
+	for _, s := range sales {
+		c := by[s.Customer]
+		if c == nil {
+			c = &CustomerLTV{Customer: s.Customer, FirstOrder: s.Date, LastOrder: s.Date}
+			by[s.Customer] = c
+		}
+		c.Revenue += s.Amount
+		if isRefund(s) { continue }
+		c.Orders++
+		if s.Date.Before(c.FirstOrder) { c.FirstOrder = s.Date }
+		if s.Date.After(c.LastOrder) { c.LastOrder = s.Date }
+	}
+	out := make([]CustomerLTV, 0, len(by))
+	for _, c := range by {
+		if c.Orders > 0 { c.AvgOrderValue = c.Revenue / float64(c.Orders) }
+		c.ProjectedLTV = c.Revenue
+		if span := c.LastOrder.Sub(c.FirstOrder).Hours() / 24; c.Orders > 1 && span > 0 {
+			c.AvgGapDays = span / float64(c.Orders-1)
+			c.OrdersPerMonth = 30.44 / c.AvgGapDays
+			c.ProjectedLTV += c.AvgOrderValue * ltvHorizonDays / c.AvgGapDays
+		}
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ProjectedLTV != out[j].ProjectedLTV { return out[i].ProjectedLTV > out[j].ProjectedLTV }
+		return out[i].Customer < out[j].Customer
+	})
+	return out
+}
+
+func topByLTV(sales []Sale) []CustomerLTV {
+	all := customerLTV(sales)
+	if len(all) > topListSize { all = all[:topListSize] }
+	return all
+}
+
+// -------- Churn risk --------
+
+const (
+	churnGapMultiple = 2.0 // days since last order, in median gaps, before a customer is at risk
+	churnMinOrders   = 3   // orders needed for a cadence to be established
+)
+
+// AtRiskCustomer is a customer whose purchase cadence has broken: no order within
+// churnGapMultiple times their median gap between orders, as of the last day in the data.
+type AtRiskCustomer struct {
+	Customer      string
+	Revenue       float64
+	Orders        int
+	LastOrder     time.Time
+	MedianGapDays float64
+	DaysSince     float64 // days from LastOrder to the end of the data
+	Overdue       float64 // DaysSince / MedianGapDays
+}
+
+// atRiskCustomers flags broken cadences, highest revenue first.
+func atRiskCustomers(sales []Sale, asOf time.Time) []AtRiskCustomer {
+	var out []AtRiskCustomer
+	for _, c := range customerCadences(sales, asOf) {
+		if c.Overdue > churnGapMultiple { out = append(out, c) }
+	}
+	return out
+}
+
+// customerCadences measures every customer with an established cadence (churnMinOrders
+// orders), highest revenue first.
+func customerCadences(sales []Sale, asOf time.Time) []AtRiskCustomer {
+	days := map[string][]time.Time{}
+	rev := map[string]float64{}
+	for _, s := range sales {
+		days[s.Customer] = append(days[s.Customer], s.Date)
+		rev[s.Customer] += s.Amount
+	}
+	var out []AtRiskCustomer
+	for c, ds := range days {
+		if len(ds) < churnMinOrders { continue }
+		sort.Slice(ds, func(i, j int) bool { return ds[i].Before(ds[j]) })
+		var gaps []float64
+		for i := 1; i < len(ds); i++ {
+			if g := ds[i].Sub(ds[i-1]).Hours() / 24; g > 0 { gaps = append(gaps, g) }
+		}
+		if len(gaps) == 0 { continue }
+		gap := median(gaps)
+		last := ds[len(ds)-1]
+		since := asOf.Sub(last).Hours() / 24
+		out = append(out, AtRiskCustomer{Customer: c, Revenue: rev[c], Orders: len(ds), LastOrder: last, MedianGapDays: gap, DaysSince: since, Overdue: since / gap})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Revenue != out[j].Revenue { return out[i].Revenue > out[j].Revenue }
+		return out[i].Customer < out[j].Customer
+	})
+	return out
+}
+
+func atRiskSuggestion(at []AtRiskCustomer) Suggestion {
+	if len(at) == 0 { return Suggestion{} }
+	var total, yearly float64
+	var names []string
+	for i, c := range at {
+		total += c.Revenue
+		if c.MedianGapDays > 0 { yearly += c.Revenue / float64(c.Orders) * ltvHorizonDays / c.MedianGapDays }
+		if i < 3 { names = append(names, c.Customer) }
+	}
+	return Suggestion{Key: "atRisk", Text: fmt.Sprintf("At-risk customers: %d (%s lifetime revenue) have gone more than %.0f× their usual gap without ordering, led by %s. Start win-back outreach.", len(at), money(total), churnGapMultiple, strings.Join(names, ", ")),
+		Impact: yearly, Basis: "a year of orders at their usual cadence"}
+}
+
+// -------- Key accounts --------
+
+// Key accounts (keyAccounts in the config: customer or parent account names) get their own
+// forecast. The next order is expected one median gap after the last, and revenue over the
+// forecast horizon is the orders expected at that cadence times the average recent order.
+// An account more than keyAccountGrace of its gap past the expected date is overdue.
+const (
+	keyAccountGrace  = 0.25 // share of the usual gap an order may run late before it's overdue
+	keyAccountRecent = 6    // latest orders averaged for the expected order value
+)
+
+type KeyAccountForecast struct {
+	Account       string
+	Orders        int // days with orders
+	Revenue       float64
+	LastOrder     time.Time
+	MedianGapDays float64   // 0 until churnMinOrders orders establish a cadence
+	OrderValue    float64   // average of the latest keyAccountRecent orders
+	NextOrder     time.Time // expected next order; zero without a cadence
+	DaysLate      float64   // days past NextOrder at the end of the data
+	Overdue       bool
+	Forecast      float64 // expected revenue over the forecast horizon
+}
+
+// keyAccountForecasts forecasts each configured key account as of asOf, in config order.
+// Accounts with no sales are listed with zero orders so a misspelt name shows up.
+func keyAccountForecasts(sales []Sale, asOf time.Time) []KeyAccountForecast {
+	if len(cfg.KeyAccounts) == 0 { return nil }
+	horizon := asOf.AddDate(0, 0, forecastHorizonDays())
+	var out []KeyAccountForecast
+	for _, name := range cfg.KeyAccounts {
+		byDay := map[time.Time]float64{}
+		for _, s := range sales {
+			if strings.EqualFold(s.Customer, name) || strings.EqualFold(accountOf(s.Customer), name) { byDay[s.Date] += s.Amount }
+		}
+		ka := KeyAccountForecast{Account: name, Orders: len(byDay)}
+		var days []time.Time
+		for d, v := range byDay {
+			days = append(days, d)
+			ka.Revenue += v
+		}
+		if len(days) == 0 { out = append(out, ka); continue }
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+		ka.LastOrder = days[len(days)-1]
+		recent := days[max(0, len(days)-keyAccountRecent):]
+		for _, d := range recent { ka.OrderValue += byDay[d] }
+		ka.OrderValue /= float64(len(recent))
+		if len(days) >= churnMinOrders {
+			var gaps []float64
+			for i := 1; i < len(days); i++ { gaps = append(gaps, days[i].Sub(days[i-1]).Hours()/24) }
+			ka.MedianGapDays = median(gaps)
+		}
+		if ka.MedianGapDays > 0 {
+			step := max(1, int(math.Round(ka.MedianGapDays)))
+			ka.NextOrder = ka.LastOrder.AddDate(0, 0, step)
+			if late := asOf.Sub(ka.NextOrder).Hours() / 24; late > 0 {
+				ka.DaysLate = late
+				ka.Overdue = late >= 1 && late > keyAccountGrace*ka.MedianGapDays
+			}
+			// a late order is expected any day now; later ones follow at the usual gap
+			d := ka.NextOrder
+			if !d.After(asOf) { d = asOf.AddDate(0, 0, 1) }
+			for ; !d.After(horizon); d = d.AddDate(0, 0, step) { ka.Forecast += ka.OrderValue }
+		}
+		out = append(out, ka)
+	}
+	return out
+}
+
+// overdueKeyAccounts returns the key accounts whose expected order hasn't come.
+func overdueKeyAccounts(k KPIs) []KeyAccountForecast {
+	var out []KeyAccountForecast
+	for _, ka := range k.KeyAccounts {
+		if ka.Overdue { out = append(out, ka) }
+	}
+	return out
+}
+
+// -------- Revenue bridge --------
+
+// RevenueBridge decomposes the change from a prior period to the current one by customer:
+// new (no revenue in the prior period, including returning customers), churned (none in
+// the current one), and expansion / contraction of the rest. The retained change is also
+// split into volume (orders at the prior AOV) and price (AOV change at current orders).
+type RevenueBridge struct {
+	PrevFrom, PrevTo time.Time
+	From, To         time.Time
+	Prior, Current   float64
+	New              float64
+	Expansion        float64
+	Contraction      float64 // negative
+	Churned          float64 // negative
+	Volume, Price    float64 // Expansion + Contraction = Volume + Price
+	NewCustomers     int
+	ChurnedCustomers int
+	Movers           []BridgeMove // largest customer contributions, any component
+}
+
+type BridgeMove struct {
+	Customer  string
+	Component string // new, expansion, contraction or churned
+	Prior     float64
+	Current   float64
+}
+
+const (
+	bridgeDays   = 30 // KPIs bridge: the last bridgeDays against the bridgeDays before
+	bridgeMovers = 8
+)
+
+func revenueBridge(sales []Sale, prevFrom, prevTo, from, to time.Time) *RevenueBridge {
+	type side struct{ rev, orders float64 }
+	cur, prev := map[string]*side{}, map[string]*side{}
+	add := func(m map[string]*side, s Sale) {
+		x := m[s.Customer]
+		if x == nil {
+			x = &side{}
+			m[s.Customer] = x
+		}
+		x.rev += s.Amount
+		if !isRefund(s) { x.orders++ }
+	}
+	for _, s := range sales {
+		switch {
+		case !s.Date.Before(from) && !s.Date.After(to):
+			add(cur, s)
+		case !s.Date.Before(prevFrom) && !s.Date.After(prevTo):
+			add(prev, s)
+		}
+	}
+	b := &RevenueBridge{PrevFrom: prevFrom, PrevTo: prevTo, From: from, To: to}
+	for c, p := range prev {
+		b.Prior += p.rev
+		if cur[c] == nil {
+			b.Churned -= p.rev
+			b.ChurnedCustomers++
+			b.Movers = append(b.Movers, BridgeMove{Customer: c, Component: "churned", Prior: p.rev})
+		}
+	}
+	for c, x := range cur {
+		b.Current += x.rev
+		p := prev[c]
+		if p == nil {
+			b.New += x.rev
+			b.NewCustomers++
+			b.Movers = append(b.Movers, BridgeMove{Customer: c, Component: "new", Current: x.rev})
+			continue
+		}
+		d := x.rev - p.rev
+		if d == 0 { continue }
+		comp := "expansion"
+		if d > 0 { b.Expansion += d } else { b.Contraction += d; comp = "contraction" }
+		aov := p.rev / p.orders
+		b.Volume += (x.orders - p.orders) * aov
+		b.Price += x.rev - x.orders*aov
+		b.Movers = append(b.Movers, BridgeMove{Customer: c, Component: comp, Prior: p.rev, Current: x.rev})
+	}
+	sort.Slice(b.Movers, func(i, j int) bool {
+		a, c := math.Abs(b.Movers[i].Current-b.Movers[i].Prior), math.Abs(b.Movers[j].Current-b.Movers[j].Prior)
+		if a != c { return a > c }
+		return b.Movers[i].Customer < b.Movers[j].Customer
+	})
+	if len(b.Movers) > bridgeMovers { b.Movers = b.Movers[:bridgeMovers] }
+	return b
+}
+
+// trailingBridge compares the last bridgeDays up to to with the bridgeDays before; nil
+// when the data doesn't reach back to the start of the prior window.
+func trailingBridge(sales []Sale, from, to time.Time) *RevenueBridge {
+	start := to.AddDate(0, 0, -bridgeDays+1)
+	prevFrom := start.AddDate(0, 0, -bridgeDays)
+	if from.After(prevFrom) { return nil }
+	return revenueBridge(sales, prevFrom, start.AddDate(0, 0, -1), start, to)
+}
+
+// bridgeSteps are the waterfall bars: totals for the two periods, deltas between.
+func bridgeSteps(b *RevenueBridge) []KVf {
+	return []KVf{{"Prior", b.Prior}, {"New", b.New}, {"Expansion", b.Expansion}, {"Contraction", b.Contraction}, {"Churned", b.Churned}, {"Current", b.Current}}
+}
+
+// svgWaterfall draws the bridge as a waterfall: blue totals, green increases, red decreases.
+func svgWaterfall(b *RevenueBridge) template.HTML {
+	if b == nil { return template.HTML("<p class='muted'>No data.</p>") }
+	steps := bridgeSteps(b)
+	w, h, top, bottom := 600.0, 210.0, 20.0, 36.0
+	// The axis starts below the lowest running level so small steps stay visible next to
+	// large totals; it is labelled when it doesn't start at zero.
+	hi, lo, run := math.Max(b.Prior, b.Current), math.Min(b.Prior, b.Current), b.Prior
+	for _, st := range steps[1 : len(steps)-1] {
+		run += st.Value
+		hi, lo = math.Max(hi, run), math.Min(lo, run)
+	}
+	floor := math.Max(0, lo-(hi-lo))
+	if hi <= floor { hi = floor + 1 }
+	y := func(v float64) float64 { return h - bottom - math.Max(v-floor, 0)/(hi-floor)*(h-top-bottom) }
+	slot := w / float64(len(steps))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg viewBox="0 0 %.0f %.0f">`, w, h)
+	if floor > 0 {
+		fmt.Fprintf(&sb, `<text x="%.0f" y="%.0f" fill="#9fb0ff" font-size="10" text-anchor="end">axis from %s</text>`, w-2, h-3, template.HTMLEscapeString(money(floor)))
+	}
+	run = 0
+	for i, st := range steps {
+		lo, up, color, label := 0.0, st.Value, "#7aa2ff", money(st.Value)
+		if i > 0 && i < len(steps)-1 {
+			lo, up = run, run+st.Value
+			color, label = "#4caf50", "+"+money(st.Value)
+			if st.Value < 0 { lo, up, color, label = up, lo, "#ff6b6b", "-"+money(-st.Value) }
+		}
+		if i == 0 { run = st.Value } else if i < len(steps)-1 { run += st.Value }
+		x := float64(i)*slot + slot*0.15
+		fmt.Fprintf(&sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`, x, y(up), slot*0.7, math.Max(y(lo)-y(up), 1), color)
+		fmt.Fprintf(&sb, `<text x="%.1f" y="%.1f" fill="#e8ecff" font-size="11" text-anchor="middle">%s</text>`, x+slot*0.35, y(up)-4, template.HTMLEscapeString(label))
+		fmt.Fprintf(&sb, `<text x="%.1f" y="%.1f" fill="#9fb0ff" font-size="12" text-anchor="middle">%s</text>`, x+slot*0.35, h-bottom+16, st.Key)
+	}
+	fmt.Fprintf(&sb, `<line x1="0" y1="%.1f" x2="%.0f" y2="%.1f" stroke="#22305f"/></svg>`, h-bottom+0.5, w, h-bottom+0.5)
+	return template.HTML(sb.String())
+}
+
+func bridgeMarkdown(b *RevenueBridge) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s → %s vs %s → %s\n\n", b.From.Format("2006-01-02"), b.To.Format("2006-01-02"), b.PrevFrom.Format("2006-01-02"), b.PrevTo.Format("2006-01-02"))
+	fmt.Fprintf(&sb, "| Step | Amount |\n|---|---|\n")
+	for _, st := range bridgeSteps(b) { fmt.Fprintf(&sb, "| %s | %s |\n", st.Key, money(st.Value)) }
+	fmt.Fprintf(&sb, "\n- New customers: %d; churned: %d\n- Retained change: volume %s, price %s\n", b.NewCustomers, b.ChurnedCustomers, money(b.Volume), money(b.Price))
+	for _, m := range b.Movers {
+		fmt.Fprintf(&sb, "- %s (%s): %s → %s\n", m.Customer, m.Component, money(m.Prior), money(m.Current))
+	}
+	return sb.String()
+}
+
+// handleBridge returns the revenue bridge (GET /api/v1/bridge): the KPIs' trailing windows
+// by default, or ?period=2025-06 / 2025-Q2 against the period of the same length before it.
+func handleBridge(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	b := a.KPIs.Bridge
+	if spec := r.URL.Query().Get("period"); spec != "" {
+		_, from, to, err := closePeriod(spec, a.KPIs.To)
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		prevFrom := from.AddDate(0, -monthsBetween(from, to), 0)
+		b = revenueBridge(a.Sales, prevFrom, from.AddDate(0, 0, -1), from, to)
+	}
+	if b == nil {
+		http.Error(w, fmt.Sprintf("need %d days of history for the default bridge; pass ?period=", 2*bridgeDays), 404); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// -------- Contacts & outreach --------
+
+// Contact holds outreach details for a customer or account, from a contacts CSV (-contacts,
+// the dashboard upload or POST /api/v1/contacts) with headers customer, email, owner and
+// optional name and phone. It's joined into the churn-risk, overdue and loyalty lists
+// when they're exported for the CRM.
+type Contact struct {
+	Customer string
+	Name     string
+	Email    string
+	Phone    string
+	Owner    string // account owner
+}
+
+var (
+	contactsMu   sync.Mutex
+	contactsPath string
+	contacts     = map[string]Contact{} // by lowercase customer
+)
+
+func parseContacts(r io.Reader) (map[string]Contact, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil { return nil, fmt.Errorf("contacts csv read: %w", err) }
+	if len(records) < 2 { return nil, fmt.Errorf("contacts csv has no data rows") }
+	get := headerGetter(records[0])
+	out := map[string]Contact{}
+	for _, row := range records[1:] {
+		c := Contact{
+			Customer: nz(get(row, "customer"), nz(get(row, "company"), get(row, "account"))),
+			Name:     nz(get(row, "contact"), get(row, "name")),
+			Email:    get(row, "email"),
+			Phone:    get(row, "phone"),
+			Owner:    nz(get(row, "owner"), get(row, "rep")),
+		}
+		if c.Customer == "" { continue }
+		out[strings.ToLower(canonicalCustomer(c.Customer))] = c
+	}
+	return out, nil
+}
+
+func loadContacts(path string) error {
+	contactsPath = path
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("contacts: %w", err) }
+	defer f.Close()
+	c, err := parseContacts(f)
+	if err != nil { return fmt.Errorf("contacts %s: %w", path, err) }
+	contacts = c
+	return nil
+}
+
+// setContacts replaces the contact list and, when a -contacts path is set, the file.
+func setContacts(b []byte) (int, error) {
+	c, err := parseContacts(bytes.NewReader(b))
+	if err != nil { return 0, err }
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+	if contactsPath != "" {
+		if err := os.WriteFile(contactsPath, b, 0644); err != nil { return 0, err }
+	}
+	contacts = c
+	return len(c), nil
+}
+
+// contactFor looks a customer up by name, then by parent account.
+func contactFor(customer string) Contact {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+	if c, ok := contacts[strings.ToLower(customer)]; ok { return c }
+	return contacts[strings.ToLower(accountOf(customer))]
+}
+
+// OutreachRow is one line of an outreach export.
+type OutreachRow struct {
+	List     string // churn, overdue or loyalty
+	Customer string
+	Reason   string
+	Amount   float64
+	Contact
+}
+
+// outreachRows builds the requested lists (all when list is "") with contacts joined in.
+func outreachRows(k KPIs, sales []Sale, list string) []OutreachRow {
+	var out []OutreachRow
+	add := func(l, customer, reason string, amount float64) {
+		c := contactFor(customer)
+		out = append(out, OutreachRow{List: l, Customer: customer, Reason: reason, Amount: amount, Contact: c})
+	}
+	if list == "" || list == "churn" {
+		for _, c := range k.AtRisk {
+			add("churn", c.Customer, fmt.Sprintf("No order in %.0f days (usually every %.0f); last order %s", c.DaysSince, c.MedianGapDays, c.LastOrder.Format("2006-01-02")), c.Revenue)
+		}
+	}
+	if list == "" || list == "overdue" {
+		type due struct {
+			n      int
+			amount float64
+			oldest time.Time
+		}
+		byCustomer := map[string]*due{}
+		var names []string
+		for _, s := range sales {
+			if !isOverdue(s.Status) { continue }
+			d := byCustomer[s.Customer]
+			if d == nil {
+				d = &due{oldest: s.Date}
+				byCustomer[s.Customer] = d
+				names = append(names, s.Customer)
+			}
+			d.n++
+			d.amount += s.Amount
+			if s.Date.Before(d.oldest) { d.oldest = s.Date }
+		}
+		sort.Slice(names, func(i, j int) bool { return byCustomer[names[i]].amount > byCustomer[names[j]].amount })
+		for _, name := range names {
+			d := byCustomer[name]
+			add("overdue", name, fmt.Sprintf("%d overdue/unpaid invoice(s), oldest %s", d.n, d.oldest.Format("2006-01-02")), d.amount)
+		}
+	}
+	if list == "" || list == "loyalty" {
+		for _, kv := range k.TopCustomers {
+			add("loyalty", kv.Key, "Top account by revenue", kv.Value)
+		}
+	}
+	return out
+}
+
+func writeOutreachCSV(w io.Writer, rows []OutreachRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"list", "customer", "reason", "amount", "contact", "email", "phone", "owner"})
+	for _, r := range rows {
+		cw.Write([]string{r.List, r.Customer, r.Reason, strconv.FormatFloat(r.Amount, 'f', 2, 64), r.Name, r.Email, r.Phone, r.Owner})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handleOutreachExport downloads outreach.csv (GET /export/outreach.csv?list=churn|overdue|loyalty).
+func handleOutreachExport(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	list := r.URL.Query().Get("list")
+	switch list {
+	case "", "churn", "overdue", "loyalty":
+	default:
+		http.Error(w, "list must be churn, overdue or loyalty", 400); return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=outreach-"+nz(list, "all")+".csv")
+	writeOutreachCSV(w, outreachRows(*a.KPIs, a.Sales, list))
+}
+
+// handleContacts lists contacts (GET) or replaces them with a CSV (POST, multipart
+// "file" or a text/csv body).
+func handleContacts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var b []byte
+		var err error
+		if f, _, ferr := r.FormFile("file"); ferr == nil {
+			defer f.Close()
+			b, err = io.ReadAll(io.LimitReader(f, 10<<20))
+		} else {
+			b, err = io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		if _, err := setContacts(b); err != nil {
+			http.Error(w, "contacts: "+err.Error(), 400); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	contactsMu.Lock()
+	out := make([]Contact, 0, len(contacts))
+	for _, c := range contacts { out = append(out, c) }
+	contactsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Customer < out[j].Customer })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// -------- CRM sync --------
+
+// CRMConfig pushes customer insights to HubSpot or Salesforce on a schedule (server mode).
+// HubSpot authenticates with HUBSPOT_TOKEN (a private app token), Salesforce with
+// SALESFORCE_TOKEN against URL, the org's instance URL. Records are matched on IDProperty,
+// a unique custom property holding the BizPulse customer name.
+type CRMConfig struct {
+	Provider   string            `json:"provider"` // hubspot or salesforce
+	Every      string            `json:"every"`    // default 24h
+	URL        string            `json:"url"`      // API base; default https://api.hubapi.com for HubSpot
+	Object     string            `json:"object"`   // companies (HubSpot) / Account (Salesforce) by default
+	IDProperty string            `json:"idProperty"`
+	Properties map[string]string `json:"properties"` // churnRisk, clv, overdue, tier -> CRM property name
+}
+
+// CustomerInsight is what BizPulse knows about one customer, as pushed to the CRM.
+// ChurnRisk is 0-100 (50 at the at-risk threshold) and -1 without an established cadence;
+// Tier is empty when the customer bought nothing in the latest month.
+type CustomerInsight struct {
+	Customer  string
+	ChurnRisk float64
+	CLV       float64
+	Overdue   float64
+	Tier      string
+}
+
+const crmBatchHubSpot, crmBatchSalesforce = 100, 200 // API limits per upsert request
+
+var (
+	crmMu     sync.Mutex
+	crmPushed = map[string]string{} // customer -> properties last pushed, to skip unchanged ones
+)
+
+func customerInsights(k KPIs, sales []Sale) []CustomerInsight {
+	by := map[string]*CustomerInsight{}
+	var names []string
+	for _, c := range customerLTV(sales) {
+		by[c.Customer] = &CustomerInsight{Customer: c.Customer, ChurnRisk: -1, CLV: c.ProjectedLTV}
+		names = append(names, c.Customer)
+	}
+	for _, c := range customerCadences(sales, k.To) {
+		by[c.Customer].ChurnRisk = math.Min(100, math.Round(c.Overdue/(2*churnGapMultiple)*100))
+	}
+	for _, s := range sales {
+		if isOverdue(s.Status) { by[s.Customer].Overdue += s.Amount }
+	}
+	if k.Tiers != nil {
+		for _, t := range k.Tiers.Customers {
+			if c := by[t.Customer]; c != nil { c.Tier = t.Tier }
+		}
+	}
+	out := make([]CustomerInsight, 0, len(names))
+	for _, n := range names {
+		if n != "Unknown" { out = append(out, *by[n]) } // rows without a customer
+	}
+	return out
+}
+
+// crmProperties maps an insight to CRM property values; churn risk is left out when unknown.
+func crmProperties(c CustomerInsight, salesforce bool) map[string]interface{} {
+	defaults := map[string]string{"churnRisk": "bizpulse_churn_risk", "clv": "bizpulse_clv", "overdue": "bizpulse_overdue", "tier": "bizpulse_tier"}
+	if salesforce {
+		defaults = map[string]string{"churnRisk": "BizPulse_Churn_Risk__c", "clv": "BizPulse_CLV__c", "overdue": "BizPulse_Overdue__c", "tier": "BizPulse_Tier__c"}
+	}
+	name := func(key string) string { return nz(cfg.CRM.Properties[key], defaults[key]) }
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+	props := map[string]interface{}{name("clv"): round(c.CLV), name("overdue"): round(c.Overdue), name("tier"): c.Tier}
+	if c.ChurnRisk >= 0 { props[name("churnRisk")] = c.ChurnRisk }
+	return props
+}
+
+// crmRequests builds the upsert requests for insights: HubSpot batch upserts or Salesforce
+// sObject collection upserts, keyed by the ID property.
+func crmRequests(insights []CustomerInsight) ([]outboundReq, error) {
+	cc := cfg.CRM
+	var reqs []outboundReq
+	switch strings.ToLower(cc.Provider) {
+	case "hubspot":
+		token := os.Getenv("HUBSPOT_TOKEN")
+		if token == "" { return nil, fmt.Errorf("crm: HUBSPOT_TOKEN is not set") }
+		u := strings.TrimRight(nz(cc.URL, "https://api.hubapi.com"), "/") + "/crm/v3/objects/" + nz(cc.Object, "companies") + "/batch/upsert"
+		idProp := nz(cc.IDProperty, "bizpulse_customer")
+		for i := 0; i < len(insights); i += crmBatchHubSpot {
+			var inputs []interface{}
+			for _, c := range insights[i:min(i+crmBatchHubSpot, len(insights))] {
+				props := map[string]string{}
+				for k, v := range crmProperties(c, false) { props[k] = fmt.Sprint(v) }
+				props[idProp] = c.Customer
+				inputs = append(inputs, map[string]interface{}{"idProperty": idProp, "id": c.Customer, "properties": props})
+			}
+			b, _ := json.Marshal(map[string]interface{}{"inputs": inputs})
+			reqs = append(reqs, outboundReq{dest: "hubspot", url: u, body: b,
+				header: http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer " + token}}})
+		}
+	case "salesforce":
+		token := os.Getenv("SALESFORCE_TOKEN")
+		if token == "" || cc.URL == "" { return nil, fmt.Errorf("crm: salesforce needs crm.url (instance URL) and SALESFORCE_TOKEN") }
+		object, idProp := nz(cc.Object, "Account"), nz(cc.IDProperty, "BizPulse_Customer__c")
+		u := strings.TrimRight(cc.URL, "/") + "/services/data/v60.0/composite/sobjects/" + object + "/" + idProp
+		for i := 0; i < len(insights); i += crmBatchSalesforce {
+			var records []interface{}
+			for _, c := range insights[i:min(i+crmBatchSalesforce, len(insights))] {
+				rec := crmProperties(c, true)
+				rec["attributes"] = map[string]string{"type": object}
+				rec[idProp] = c.Customer
+				records = append(records, rec)
+			}
+			b, _ := json.Marshal(map[string]interface{}{"allOrNone": false, "records": records})
+			reqs = append(reqs, outboundReq{dest: "salesforce", url: u, method: http.MethodPatch, body: b,
+				header: http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer " + token}}})
+		}
+	default:
+		return nil, fmt.Errorf("crm: provider must be hubspot or salesforce, got %q", cc.Provider)
+	}
+	return reqs, nil
+}
+
+// pushCRM sends the shared dataset's insights that changed since the last push (all of
+// them with force) and returns how many customers went out.
+func pushCRM(ctx context.Context, force bool) (int, error) {
+	cur := shared.view()
+	if cur.KPIs == nil { return 0, nil }
+	crmMu.Lock()
+	defer crmMu.Unlock()
+	var changed []CustomerInsight
+	seen := map[string]string{}
+	for _, c := range customerInsights(*cur.KPIs, cur.Sales) {
+		b, _ := json.Marshal(c)
+		seen[c.Customer] = string(b)
+		if force || crmPushed[c.Customer] != string(b) { changed = append(changed, c) }
+	}
+	if len(changed) == 0 { return 0, nil }
+	reqs, err := crmRequests(changed)
+	if err != nil { return 0, err }
+	for _, req := range reqs {
+		sendOutbound(ctx, req)
+	}
+	crmPushed = seen
+	return len(changed), nil
+}
+
+func monitorCRM(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, err := pushCRM(ctx, false); err != nil {
+				log.Printf("crm: %v", err)
+			} else if n > 0 {
+				log.Printf("crm: pushed %d customers to %s", n, cfg.CRM.Provider)
+			}
+		}
+	}
+}
+
+// handleCRM lists the insights that would be pushed (GET /api/v1/crm) or pushes them now
+// (POST; force=1 resends unchanged customers too).
+func handleCRM(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a := analysisFor(r)
+		if a.KPIs == nil {
+			http.Error(w, "no KPIs yet", 404); return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customerInsights(*a.KPIs, a.Sales))
+	case http.MethodPost:
+		n, err := pushCRM(r.Context(), r.FormValue("force") != "")
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"provider": cfg.CRM.Provider, "pushed": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// -------- Metric definitions --------
+
+// MetricDef documents how a metric is computed, including the parameter values in effect.
+// The same definitions back /api/v1/explain, the report glossary and the dashboard glossary card.
+type MetricDef struct {
+	Key        string
+	Name       string
+	Definition string
+	Params     map[string]string
+}
+
+// anomalyDefinitions describes each anomaly detector for the glossary.
+var anomalyDefinitions = map[string]string{
+	"zscore": "Days whose revenue z-score against the mean and standard deviation of all days meets the threshold.",
+	"mad":    "Days whose modified z-score, 0.6745 × (revenue − median) / MAD over the trailing window, meets the threshold.",
+	"iqr":    "Days outside Tukey's fences (below Q1 − k × IQR or above Q3 + k × IQR); the score is the distance beyond the quartile in IQRs.",
+	"ewma":   "Days where the exponentially weighted moving average of revenue leaves the control band of ± limit standard errors around the mean.",
+}
+
+func anomalyDefinition(d AnomalyDetector) string {
+	def := anomalyDefinitions[d.Name()]
+	ex, excluding := d.(excludingDetector)
+	if excluding { d = ex.inner }
+	if _, ok := d.(seasonalDetector); ok {
+		def += " Revenue is first adjusted by each weekday's median offset from the overall median, so regular weekly patterns aren't flagged."
+	}
+	if excluding { def += " Days in the exclusion windows are left out of the baseline and never flagged." }
+	return def
+}
+
+// metricDefs are the metric definitions with the parameters in effect for dataset.
+func metricDefs(dataset string) []MetricDef {
+	detector := detectorFor(dataset)
+	pace := cfg.PaceAlert
+	if pace <= 0 { pace = 0.9 }
+	driftDays, driftN := agingDriftLimits()
+	return []MetricDef{
+		{Key: "revenue", Name: "Total Revenue", Definition: "Sum of the amount column over all parsed rows, including unpaid and overdue invoices."},
+		{Key: "aov", Name: "Average Order Value", Definition: "Net revenue (refunds included) divided by the number of orders: rows with a non-negative amount. Refund rows are not orders."},
+		{Key: "retention", Name: "Retention Rate", Definition: "Share of customers who purchased in at least the minimum number of distinct ISO weeks.",
+			Params: map[string]string{"minWeeks": strconv.Itoa(retentionMinWeeks)}},
+		{Key: "forecast", Name: "Forecast (7d)", Definition: "Sum of the first 7 days of the daily forecast: additive Holt-Winters (level, trend and weekly seasonality) over calendar days, with smoothing factors fitted by one-step-ahead squared error unless configured. With under two weeks of history, the average daily revenue over the trailing window (days without sales not counted). Bands are ±1.96 standard errors of the one-step errors, widening with the horizon. With winsorizing configured, days with sales are first clamped to that percentile of daily revenue and its complement. Holidays and promotions in the events log get a factor each, their revenue over the same weekday in the weeks before; their past days are divided by it before fitting and upcoming ones multiplied by it.",
+			Params: map[string]string{"windowDays": strconv.Itoa(forecastWindow), "horizonDays": strconv.Itoa(forecastHorizonDays()), "seasonDays": strconv.Itoa(hwSeason), "winsorize": strconv.FormatFloat(cfg.Forecast.Winsorize, 'f', -1, 64), "holidayBaselineWeeks": strconv.Itoa(holidayBaselineWeeks)}},
+		{Key: "anomalies", Name: "Anomalies", Definition: anomalyDefinition(detector),
+			Params: detector.Params()},
+		{Key: "overdue", Name: "Overdue / Unpaid", Definition: "Rows whose status contains \"overdue\", \"unpaid\" or \"due\"; counted and summed."},
+		{Key: "refunds", Name: "Refunds", Definition: "Rows with a negative amount (refunds, chargebacks, credit notes). Gross revenue sums the positive rows, net revenue all of them; the refund rate is refunds over gross revenue, overall and for the last 7 days, which alerts at or over the threshold.",
+			Params: map[string]string{"alertRate": strconv.FormatFloat(refundAlertRate(), 'f', -1, 64)}},
+		{Key: "categories", Name: "Categories", Definition: "Revenue by product category, from the category column or else the productCategories mapping; rows with neither are Uncategorized. The change compares the last window with the one before; categories down by the decline share or more are suggested for review.",
+			Params: map[string]string{"windowDays": strconv.Itoa(bridgeDays), "decline": strconv.FormatFloat(categoryDecline, 'f', -1, 64)}},
+		{Key: "countries", Name: "Revenue by country", Definition: "Revenue by ISO country: from the country column, else a region that names a country, else the country-code domain of the customer's email (the row's, else the contact's). Rows with none are Unknown. Companies come from email domains, else the account.",
+			Params: map[string]string{"windowDays": strconv.Itoa(bridgeDays)}},
+		{Key: "segments", Name: "Segments", Definition: "KPIs per value of a column such as region, channel or rep (/api/kpis?groupby=). The change compares each segment's last window with the one before; anomalies are the detector run on the segment's daily revenue.",
+			Params: map[string]string{"windowDays": strconv.Itoa(bridgeDays), "maxSegments": strconv.Itoa(maxSegments)}},
+		{Key: "pricing", Name: "Tax, Discounts & Units", Definition: "From the optional tax, discount and quantity columns. Amounts are taken to include tax and be after discounts: revenue excluding tax is amount less tax, the discount rate is discounts over revenue excluding tax plus discounts, and the unit price is revenue excluding tax over units, on rows with a quantity."},
+		{Key: "aging", Name: "AR Aging / DSO", Definition: "Open (overdue/unpaid) invoices bucketed by days past their due date as of the last day in the data; ones not yet due are current, and rows without a due date age from the invoice date. DSO is open receivables divided by revenue over the trailing window (shorter when the data is), times the window's days. Average age weights each open invoice's days past due by its amount (not yet due counts as 0); drift is its change since the analysis a number of snapshots back, which alerts past the drift days.",
+			Params: map[string]string{"dsoWindowDays": strconv.Itoa(dsoWindow), "driftDays": strconv.FormatFloat(driftDays, 'f', -1, 64), "driftSnapshots": strconv.Itoa(driftN)}},
+		{Key: "concentration", Name: "Concentration", Definition: "Share of revenue from the top parent accounts.",
+			Params: map[string]string{"topAccounts": strconv.Itoa(topListSize)}},
+		{Key: "quota", Name: "Quota Pace", Definition: "Attainment (period revenue / quota) divided by the elapsed share of the period; 100% is on track.",
+			Params: map[string]string{"paceAlert": strconv.FormatFloat(pace, 'f', -1, 64)}},
+		{Key: "targets", Name: "Revenue Targets", Definition: "Per weekly or monthly target, for the period containing the last day in the data: percent-to-target is period revenue over the target, and pace divides it by the elapsed share of the period. The projection adds the forecast for the days left (the forecast's average daily revenue past its horizon, or the period's run rate without a forecast); a projection below the alert ratio mid-period alerts.",
+			Params: map[string]string{"targetAlert": strconv.FormatFloat(targetAlertRatio(), 'f', -1, 64)}},
+		{Key: "health", Name: "Health Score", Definition: "Weighted blend of 0-100 component scores: growth (last 7 vs prior 7 days), retention, overdue share, concentration and the 7-day forecast vs the weekly revenue target (the first weekly target, else the first monthly one prorated to 7 days). Components without data are skipped and weights renormalized.",
+			Params: healthParams()},
+		{Key: "tiers", Name: "Customer Tiers", Definition: "Customers ranked by revenue within each calendar month: top 10% Platinum, next 20% Gold, next 30% Silver, rest Bronze. Migrations compare the latest month with the one before."},
+		{Key: "ltv", Name: "Customer Lifetime Value", Definition: "Per customer: revenue to date, order frequency and the average gap between orders over their first-to-last order span. Projected LTV adds average order value times the orders expected over the horizon at that gap; one-time buyers project none.",
+			Params: map[string]string{"horizonDays": strconv.Itoa(ltvHorizonDays)}},
+		{Key: "segmentAnomalies", Name: "Segment Anomalies", Definition: "The anomaly detector run per top account and top product over trailing 7-day revenue, with days without sales counted as zero so an account going quiet is flagged. Days within the minimum change of the segment's median are ignored. Consecutive flagged days are reported once, at the most extreme day; ongoing means the run reaches the last day in the data.",
+			Params: map[string]string{"windowDays": strconv.Itoa(segmentWindow), "topN": strconv.Itoa(topListSize), "minChange": strconv.FormatFloat(segmentMinChange, 'f', -1, 64)}},
+		{Key: "atRisk", Name: "At-Risk Customers", Definition: "Customers with enough orders to have a cadence whose time since their last order, as of the last day in the data, exceeds a multiple of their median gap between orders. Listed by lifetime revenue.",
+			Params: map[string]string{"gapMultiple": strconv.FormatFloat(churnGapMultiple, 'f', -1, 64), "minOrders": strconv.Itoa(churnMinOrders)}},
+		{Key: "keyAccounts", Name: "Key Account Forecast", Definition: "Per configured key account (customer or parent account), days with orders form its cadence. The next order is expected one median gap after the last; the forecast is the orders expected over the horizon at that gap times the average of the latest orders. An account is overdue once the expected date has passed by more than the grace share of its gap.",
+			Params: map[string]string{"grace": strconv.FormatFloat(keyAccountGrace, 'f', -1, 64), "recentOrders": strconv.Itoa(keyAccountRecent), "minOrders": strconv.Itoa(churnMinOrders), "horizonDays": strconv.Itoa(forecastHorizonDays())}},
+		{Key: "bridge", Name: "Revenue Bridge", Definition: "Change between the prior and current window by customer: new (no prior-window revenue), churned (no current-window revenue), expansion and contraction of the rest. The retained change splits into volume (change in orders at the prior average order value) and price (change in average order value at current orders).",
+			Params: map[string]string{"windowDays": strconv.Itoa(bridgeDays)}},
+		{Key: "conversion", Name: "Lead Conversion", Definition: "Share of leads whose customer made a first purchase on or after the signup date; time-to-first-purchase is the median gap in days."},
+		{Key: "comparisons", Name: "Period Comparison", Definition: "Revenue and orders of the week, month and month to date against the same days of last week, last month and the same month last year (capped at that month's end). A comparison is left out when its earlier days start before the data. The comparison config can align the earlier days by weekday (moved back 4 or 52 whole weeks), leave holidays and promotions from the events log out of both periods, and compare per (trading) day; each comparison's Method names what was applied. The chart's dashed lines are the series shifted back a week and a year (364 days, keeping weekdays)."},
+		{Key: "momentum", Name: "Momentum", Definition: "Run rates are average revenue per calendar day over the short and long windows (days without sales count as zero); the ratio compares them. Velocity is the change in the 7-day run rate over the last week, acceleration the change in velocity from the week before, and the growth streak counts consecutive days each above the day before.",
+			Params: map[string]string{"shortDays": strconv.Itoa(momentumShort), "longDays": strconv.Itoa(momentumLong)}},
+		{Key: "campaignAttribution", Name: "Campaign Attribution", Definition: "Spikes are attributed to campaigns that started within the lead window before the spike day.",
+			Params: map[string]string{"leadDays": strconv.Itoa(campaignLeadDays)}},
+	}
+}
+
+// handleExplain returns all metric definitions, or one with ?metric=.
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	defs := metricDefs(datasetFor(r))
+	w.Header().Set("Content-Type", "application/json")
+	if key := r.URL.Query().Get("metric"); key != "" {
+		for _, d := range defs {
+			if strings.EqualFold(d.Key, key) {
+				json.NewEncoder(w).Encode(d)
+				return
+			}
+		}
+		http.Error(w, "unknown metric", 404); return
+	}
+	json.NewEncoder(w).Encode(defs)
+}
+
+func healthParams() map[string]string {
+	weights := defaultHealthWeights
+	if len(cfg.Health.Weights) > 0 { weights = cfg.Health.Weights }
+	p := map[string]string{}
+	for k, v := range weights { p["w."+k] = strconv.FormatFloat(v, 'f', -1, 64) }
+	return p
+}
+
+func paramList(p map[string]string) string {
+	var parts []string
+	for k, v := range p { parts = append(parts, k+"="+v) }
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// -------- Anomaly review state --------
+
+// alertedDays remembers, per dataset, the data fingerprint of each anomaly day at the time
+// it was alerted, so an appended upload that backfills older dates doesn't re-alert days
+// whose rows are unchanged; days whose rows did change are alerted again as restated.
+// Datasets publish concurrently, so it's only touched under alertedMu.
+var (
+	alertedMu   sync.Mutex
+	alertedDays = map[string]map[string]string{} // dataset -> YYYY-MM-DD -> fingerprint
+)
+
+// dayFingerprints hashes each day's rows (order-independent).
+func dayFingerprints(sales []Sale) map[string]string {
+	rows := map[string][]string{}
+	for _, s := range sales {
+		day := s.Date.Format("2006-01-02")
+		rows[day] = append(rows[day], fmt.Sprintf("%s|%s|%.4f|%s", s.Customer, s.Product, s.Amount, s.Status))
+	}
+	out := make(map[string]string, len(rows))
+	for day, rs := range rows {
+		sort.Strings(rs)
+		sum := sha256.Sum256([]byte(strings.Join(rs, "\n")))
+		out[day] = hex.EncodeToString(sum[:8])
+	}
+	return out
+}
+
+// markReviewedAnomalies flags dataset's anomalies already alerted with identical data
+// (Reviewed) or with changed data (Restated), then, if record is set, records the current
+// fingerprints as alerted.
+func markReviewedAnomalies(dataset string, k *KPIs, sales []Sale, record bool) {
+	fps := dayFingerprints(sales)
+	alertedMu.Lock()
+	defer alertedMu.Unlock()
+	seen := alertedDays[dataset]
+	if seen == nil && record {
+		seen = map[string]string{}
+		alertedDays[dataset] = seen
+	}
+	for i := range k.Anomalies {
+		day := k.Anomalies[i].Day.Format("2006-01-02")
+		if prev, ok := seen[day]; ok {
+			k.Anomalies[i].Reviewed = prev == fps[day]
+			k.Anomalies[i].Restated = prev != fps[day]
+		}
+		if record { seen[day] = fps[day] }
+	}
+}
+
+// -------- Restatements --------
+
+// Restatement records a change to a day that was already reported by an earlier upload.
+type Restatement struct {
+	Day       time.Time
+	Old       float64
+	New       float64
+	Delta     float64
+	ChangedAt time.Time
+}
+
+const restatementHistory = 1000 // restatements kept, oldest dropped first
+
+var (
+	restatementMu  sync.Mutex
+	restatementLog []Restatement // the shared dataset's, oldest first
+)
+
+// restatements returns a copy of restatementLog, safe to publish with an analysis.
+func restatements() []Restatement {
+	restatementMu.Lock()
+	defer restatementMu.Unlock()
+	return append([]Restatement{}, restatementLog...)
+}
+
+// recordRestatements compares the daily totals of prev and next. Days inside prev's
+// range whose totals moved are appended to restatementLog; days outside it are new
+// history, not restatements.
+func recordRestatements(prev *KPIs, next KPIs, now time.Time) {
+	restatementMu.Lock()
+	defer restatementMu.Unlock()
+	defer func() {
+		if n := len(restatementLog); n > restatementHistory {
+			restatementLog = append([]Restatement(nil), restatementLog[n-restatementHistory:]...)
+		}
+	}()
+	if prev == nil || len(prev.DailyRevenue) == 0 { return }
+	old := map[string]float64{}
+	for _, d := range prev.DailyRevenue { old[d.Day.Format("2006-01-02")] = d.Value }
+	seen := map[string]bool{}
+	check := func(day time.Time, v float64) {
+		key := day.Format("2006-01-02")
+		seen[key] = true
+		if day.Before(prev.From) || day.After(prev.To) { return }
+		if o := old[key]; math.Abs(o-v) > 0.005 {
+			restatementLog = append(restatementLog, Restatement{Day: day, Old: o, New: v, Delta: v - o, ChangedAt: now})
+		}
+	}
+	for _, d := range next.DailyRevenue { check(d.Day, d.Value) }
+	for _, d := range prev.DailyRevenue {
+		if !seen[d.Day.Format("2006-01-02")] { check(d.Day, 0) }
+	}
+}
+
+func handleRestatements(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restatements())
+}
+
+// -------- Top-list movements --------
+
+// RankChange is a customer or product moving into, out of or within a top list between
+// the previous published analysis of a dataset and the current one.
+type RankChange struct {
+	List    string // customers or products
+	Name    string
+	From    int     // 1-based position before; 0 when it wasn't listed
+	To      int     // position now; 0 when it dropped out
+	Revenue float64 // revenue now, or before for one that dropped out
+	At      time.Time
+}
+
+// crossing reports whether c entered or left the list, rather than moving within it.
+func (c RankChange) crossing() bool { return c.From == 0 || c.To == 0 }
+
+// Text describes c the way alerts and reports put it.
+func (c RankChange) Text() string {
+	list := fmt.Sprintf("top %d %s", topListSize, c.List)
+	switch {
+	case c.From == 0:
+		return fmt.Sprintf("%s entered the %s at #%d", c.Name, list, c.To)
+	case c.To == 0:
+		return fmt.Sprintf("%s dropped out of the %s (was #%d)", c.Name, list, c.From)
+	case c.To < c.From:
+		return fmt.Sprintf("%s rose from #%d to #%d in the %s", c.Name, c.From, c.To, list)
+	}
+	return fmt.Sprintf("%s fell from #%d to #%d in the %s", c.Name, c.From, c.To, list)
+}
+
+const rankLogLimit = 200 // changes kept for the digest
+
+var (
+	rankMu  sync.Mutex
+	rankLog []RankChange // shared dataset, oldest first
+)
+
+// rankChanges compares the top customer and product lists of prev and next: entries and
+// exits first, in list order, then moves. Nothing is reported without a previous analysis.
+func rankChanges(prev *KPIs, next KPIs, now time.Time) []RankChange {
+	if prev == nil || prev.Orders == 0 { return nil }
+	var out, moves []RankChange
+	compare := func(list string, before, after []KVf) {
+		pos := map[string]int{}
+		for i, kv := range before { pos[kv.Key] = i + 1 }
+		for i, kv := range after {
+			c := RankChange{List: list, Name: kv.Key, From: pos[kv.Key], To: i + 1, Revenue: kv.Value, At: now}
+			delete(pos, kv.Key)
+			switch {
+			case c.From == 0:
+				out = append(out, c)
+			case c.From != c.To:
+				moves = append(moves, c)
+			}
+		}
+		for _, kv := range before {
+			if from, ok := pos[kv.Key]; ok { out = append(out, RankChange{List: list, Name: kv.Key, From: from, Revenue: kv.Value, At: now}) }
+		}
+	}
+	compare("customers", prev.TopCustomers, next.TopCustomers)
+	compare("products", prev.TopProducts, next.TopProducts)
+	return append(out, moves...)
+}
+
+// logRankChanges appends the shared dataset's changes to the digest log.
+func logRankChanges(cs []RankChange) {
+	rankMu.Lock()
+	defer rankMu.Unlock()
+	rankLog = append(rankLog, cs...)
+	if len(rankLog) > rankLogLimit { rankLog = rankLog[len(rankLog)-rankLogLimit:] }
+}
+
+// rankChangesSince returns the logged changes made after t.
+func rankChangesSince(t time.Time) []RankChange {
+	rankMu.Lock()
+	defer rankMu.Unlock()
+	var out []RankChange
+	for _, c := range rankLog {
+		if c.At.After(t) { out = append(out, c) }
+	}
+	return out
+}
+
+// -------- Events --------
+
+// The events log records what moves revenue besides customers: deploys, campaigns, price
+// changes, outages. Entries come from POST /api/v1/events (JSON, a form, or a CSV with
+// date, kind, title and optional end columns) or the dashboard upload form, are drawn on
+// the revenue chart, and are named beside anomalies falling on them or up to
+// eventLeadDays after, in the dashboard, report and alerts. They're kept in eventsPath.
+
+const eventLeadDays = 1 // days after an event that an anomaly is still attributed to it
+
+var eventKinds = []string{"deploy", "campaign", "price", "outage", "holiday", "promotion", "other"}
+
+// Event is one entry in the events log; End is the last day of multi-day events.
+type Event struct {
+	ID    int    `json:"id"`
+	Date  string `json:"date"` // YYYY-MM-DD
+	End   string `json:"end,omitempty"`
+	Kind  string `json:"kind"`
+	Title string `json:"title"`
+}
+
+func (e Event) Label() string { return e.Kind + ": " + e.Title }
+
+func (e Event) days() (from, to time.Time) {
+	from, _ = time.Parse("2006-01-02", e.Date)
+	to = from
+	if end, err := time.Parse("2006-01-02", e.End); err == nil { to = end }
+	return from, to
+}
+
+var (
+	eventsMu   sync.Mutex
+	eventsPath string // empty until loadEvents, so a demo keeps events in memory
+	eventLog   []Event
+)
+
+func loadEvents(path string) error {
+	eventsPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("events: %w", err) }
+	if err := json.Unmarshal(b, &eventLog); err != nil { return fmt.Errorf("events %s: %w", path, err) }
+	return nil
+}
+
+func saveEvents() error {
+	if eventsPath == "" { return nil }
+	b, _ := json.MarshalIndent(eventLog, "", "  ")
+	return os.WriteFile(eventsPath, b, 0644)
+}
+
+// normalizeEvent checks e and rewrites its dates as YYYY-MM-DD; any format
+// parseDateFlexible reads is accepted. Kind defaults to "other".
+func normalizeEvent(e *Event) error {
+	e.Title = strings.TrimSpace(e.Title)
+	if e.Title == "" { return fmt.Errorf("event on %q needs a title", e.Date) }
+	d := parseDateFlexible(e.Date)
+	if d.IsZero() { return fmt.Errorf("event %q: invalid date %q", e.Title, e.Date) }
+	e.Date = d.Format("2006-01-02")
+	if e.End != "" {
+		end := parseDateFlexible(e.End)
+		if end.IsZero() || end.Before(d) { return fmt.Errorf("event %q: end %q must be a date on or after %s", e.Title, e.End, e.Date) }
+		e.End = end.Format("2006-01-02")
+	}
+	e.Kind = nz(strings.ToLower(strings.TrimSpace(e.Kind)), "other")
+	for _, k := range eventKinds {
+		if e.Kind == k { return nil }
+	}
+	return fmt.Errorf("event %q: kind must be one of %s", e.Title, strings.Join(eventKinds, ", "))
+}
+
+func parseEvents(r io.Reader) ([]Event, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil { return nil, fmt.Errorf("events csv read: %w", err) }
+	if len(records) < 2 { return nil, fmt.Errorf("events csv has no data rows") }
+	get := headerGetter(records[0])
+	var out []Event
+	for _, row := range records[1:] {
+		e := Event{Date: get(row, "date"), Kind: nz(get(row, "kind"), get(row, "type")), Title: nz(get(row, "title"), nz(get(row, "event"), get(row, "description"))), End: get(row, "end")}
+		if e.End == e.Date { e.End = "" } // "end date" also matches "date" when there is no start column
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// addEvents validates and appends evs to the log, assigning IDs, then saves it.
+func addEvents(evs []Event) error {
+	for i := range evs {
+		if err := normalizeEvent(&evs[i]); err != nil { return err }
+	}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	next := 1
+	for _, e := range eventLog {
+		if e.ID >= next { next = e.ID + 1 }
+	}
+	for i := range evs {
+		evs[i].ID = next
+		next++
+	}
+	eventLog = append(eventLog, evs...)
+	sort.SliceStable(eventLog, func(i, j int) bool { return eventLog[i].Date < eventLog[j].Date })
+	return saveEvents()
+}
+
+// eventsBetween returns the events overlapping from..to, oldest first.
+func eventsBetween(from, to time.Time) []Event {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	var out []Event
+	for _, e := range eventLog {
+		start, end := e.days()
+		if !end.Before(from) && !start.After(to) { out = append(out, e) }
+	}
+	return out
+}
+
+// annotateEvents names, on each anomaly, the events covering its day or ending up to
+// eventLeadDays before it.
+func annotateEvents(anoms []Anomaly, evs []Event) {
+	for i := range anoms {
+		for _, e := range evs {
+			from, to := e.days()
+			if !anoms[i].Day.Before(from) && !anoms[i].Day.After(to.AddDate(0, 0, eventLeadDays)) {
+				anoms[i].Events = append(anoms[i].Events, e.Label())
+			}
+		}
+	}
+}
+
+// handleEvents lists the events log (GET, ?from=&to=), adds entries (POST a JSON event or
+// array, form fields, or a CSV body or "file" upload) or removes one (DELETE ?id=).
+// Changes re-annotate the loaded analyses.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var evs []Event
+		var err error
+		ct := r.Header.Get("Content-Type")
+		switch {
+		case strings.HasPrefix(ct, "application/json"):
+			b, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err = json.Unmarshal(b, &evs); err != nil {
+				var e Event
+				if err = json.Unmarshal(b, &e); err == nil { evs = []Event{e} }
+			}
+		case strings.HasPrefix(ct, "text/csv"):
+			evs, err = parseEvents(io.LimitReader(r.Body, 10<<20))
+		default:
+			if f, _, ferr := r.FormFile("file"); ferr == nil {
+				defer f.Close()
+				evs, err = parseEvents(f)
+			} else {
+				evs = []Event{{Date: r.FormValue("date"), End: r.FormValue("end"), Kind: r.FormValue("kind"), Title: r.FormValue("title")}}
+			}
+		}
+		if err == nil { err = addEvents(evs) }
+		if err != nil {
+			http.Error(w, "events: "+err.Error(), 400); return
+		}
+		recomputeLatest()
+	case http.MethodDelete:
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		eventsMu.Lock()
+		kept, found := eventLog[:0], false
+		for _, e := range eventLog {
+			if e.ID == id { found = true; continue }
+			kept = append(kept, e)
+		}
+		eventLog = kept
+		err := saveEvents()
+		eventsMu.Unlock()
+		if !found {
+			http.Error(w, "no event with that id", 404); return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		recomputeLatest()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther); return
+	}
+	from, to := parseDateFlexible(r.URL.Query().Get("from")), parseDateFlexible(r.URL.Query().Get("to"))
+	if to.IsZero() { to = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC) }
+	out := eventsBetween(from, to)
+	if out == nil { out = []Event{} }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// -------- Freshness monitor --------
+
+// defaultDataset names the single dataset the server currently holds.
+const defaultDataset = "default"
+
+var (
+	freshnessMu  sync.Mutex
+	lastIngest   = map[string]time.Time{}
+	staleAlerted = map[string]bool{} // alerted since the last ingest
+	serverStart  = time.Now()
+)
+
+// Freshness reports how recently a dataset received data against its expected cadence.
+type Freshness struct {
+	Dataset       string
+	LastIngest    time.Time
+	ExpectedEvery string
+	Stale         bool
+}
+
+// parseCadence accepts Go durations plus a "d" (days) suffix.
+func parseCadence(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil { return 0, fmt.Errorf("invalid cadence %q", s) }
+		return time.Duration(n * 24 * float64(time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func markIngested(dataset string, at time.Time) {
+	freshnessMu.Lock()
+	lastIngest[dataset] = at
+	staleAlerted[dataset] = false
+	freshnessMu.Unlock()
+}
+
+// freshnessStatus evaluates every dataset with a configured cadence. Datasets that have
+// never received data are measured from server start.
+func freshnessStatus(now time.Time) []Freshness {
+	freshnessMu.Lock()
+	defer freshnessMu.Unlock()
+	var out []Freshness
+	for ds, cad := range cfg.ExpectedCadence {
+		every, err := parseCadence(cad)
+		if err != nil || every <= 0 { continue }
+		last, ok := lastIngest[ds]
+		since := serverStart
+		if ok { since = last }
+		out = append(out, Freshness{Dataset: ds, LastIngest: last, ExpectedEvery: cad, Stale: now.Sub(since) > every})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Dataset < out[j].Dataset })
+	return out
+}
+
+// monitorFreshness alerts once per stale period for each dataset.
+func monitorFreshness(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, f := range freshnessStatus(now) {
+				freshnessMu.Lock()
+				fire := f.Stale && !staleAlerted[f.Dataset]
+				if fire { staleAlerted[f.Dataset] = true }
+				freshnessMu.Unlock()
+				if !fire { continue }
+				last := "never"
+				if !f.LastIngest.IsZero() { last = f.LastIngest.Format("2006-01-02 15:04") }
+				sendAlert(nil, nil, fmt.Sprintf("BizPulse Alert: dataset %q is stale. Last ingest: %s; expected every %s. Check the export pipeline.", f.Dataset, last, f.ExpectedEvery))
+			}
+		}
+	}
+}
+
+func handleFreshness(w http.ResponseWriter, _ *http.Request) {
+	out := freshnessStatus(time.Now())
+	if out == nil { out = []Freshness{} }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// -------- Alerts: Slack, Teams, Discord + OpenAI (optional) --------
+
+// AlertSink is an extra alert destination besides SLACK_WEBHOOK. $VARS in URL are
+// expanded from the environment.
+type AlertSink struct {
+	Type        string            `json:"type"` // slack, teams, discord or webhook
+	Name        string            `json:"name"` // what alert rules route to; defaults to the type
+	URL         string            `json:"url"`
+	MinSeverity string            `json:"minSeverity"` // skip rule alerts below info, warning or critical
+	Headers map[string]string `json:"headers"` // e.g. {"Authorization": "GenieKey $OPSGENIE_KEY"}
+	// Token (a Slack bot token, e.g. "$SLACK_BOT_TOKEN") and Channel post through
+	// chat.postMessage instead of a webhook, with findings beyond the top ones in a thread.
+	Token   string `json:"token"`
+	Channel string `json:"channel"`
+	// RateLimit is the least time between messages to this sink, e.g. "15m". Alerts in
+	// between are held and only the latest is sent when the time is up.
+	RateLimit string `json:"rateLimit"`
+	// Template (inline) or TemplateFile renders a webhook sink's JSON body from AlertData.
+	Template     string `json:"template"`
+	TemplateFile string `json:"templateFile"`
+	tmpl         *texttemplate.Template
+}
+
+// AlertData is what webhook templates render: the KPIs (zero for alerts without an
+// analysis, such as stale datasets) plus the alert text.
+type AlertData struct {
+	KPIs
+	Message      string
+	Severity     string       // highest severity among Rules; warning for built-in alerts
+	Rules        []RuleResult // fired alert rules routed to this sink, when rules are configured
+	Time         time.Time
+	DashboardURL string
+}
+
+// parseTemplate compiles a webhook sink's body template with the dashboard funcs plus
+// json, which quotes any value as JSON ({{json .Message}}).
+func (s *AlertSink) parseTemplate() error {
+	src := s.Template
+	if s.TemplateFile != "" {
+		b, err := os.ReadFile(s.TemplateFile)
+		if err != nil { return err }
+		src = string(b)
+	}
+	if strings.TrimSpace(src) == "" { return fmt.Errorf("webhook sink needs template or templateFile") }
+	funcs := texttemplate.FuncMap{"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}}
+	for name, fn := range templateFuncs { funcs[name] = fn }
+	t, err := texttemplate.New("webhook").Funcs(funcs).Parse(src)
+	if err != nil { return err }
+	s.tmpl = t
+	return nil
+}
+
+func webhookPayload(sink AlertSink, k *KPIs, msg, severity string, rules []RuleResult) ([]byte, error) {
+	d := AlertData{Message: msg, Severity: severity, Rules: rules, Time: time.Now(), DashboardURL: strings.TrimRight(cfg.Slack.DashboardURL, "/")}
+	if k != nil { d.KPIs = *k }
+	var b bytes.Buffer
+	if err := sink.tmpl.Execute(&b, d); err != nil { return nil, err }
+	if !json.Valid(b.Bytes()) { return nil, fmt.Errorf("template output is not valid JSON: %.200s", b.String()) }
+	return b.Bytes(), nil
+}
+
+// alertSinks lists where alerts go: SLACK_WEBHOOK when set, then cfg.AlertSinks.
+func alertSinks() []AlertSink {
+	var out []AlertSink
+	if u := os.Getenv("SLACK_WEBHOOK"); u != "" { out = append(out, AlertSink{Type: "slack", Name: "slack", URL: u, RateLimit: cfg.Slack.RateLimit}) }
+	for _, s := range cfg.AlertSinks {
+		s.Type, s.URL = strings.ToLower(s.Type), os.ExpandEnv(s.URL)
+		s.Name = nz(s.Name, s.Type)
+		if s.Type == "slack" && s.Token != "" && s.URL == "" { s.URL = slackPostMessageURL }
+		if s.URL != "" { out = append(out, s) }
+	}
+	return out
+}
+
+// sendAlert posts msg to every alert sink, formatted for each. k (optional) adds the
+// KPI sections, trend, overdue table and dashboard links.
+func sendAlert(k *KPIs, sales []Sale, msg string) {
+	for _, sink := range alertSinks() { sendAlertTo(sink, k, sales, msg, "warning", nil) }
+}
+
+func sendAlertTo(sink AlertSink, k *KPIs, sales []Sale, msg, severity string, rules []RuleResult) {
+	if gap, _ := parseCadence(sink.RateLimit); gap > 0 {
+		if !admitAlert(sink.Name+" "+sink.URL+" "+sink.Channel, gap, func() { deliverAlert(sink, k, sales, msg, severity, rules) }) { return }
+	}
+	deliverAlert(sink, k, sales, msg, severity, rules)
+}
+
+func deliverAlert(sink AlertSink, k *KPIs, sales []Sale, msg, severity string, rules []RuleResult) {
+	var b []byte
+	var then func(*http.Response)
+	switch sink.Type {
+	case "slack":
+		if k != nil {
+			b = slackPayload(*k, sales, msg)
+		} else {
+			b, _ = json.Marshal(map[string]string{"text": msg})
+		}
+		if sink.Token != "" {
+			b, then = slackBotPost(sink, k, b)
+		}
+	case "teams":
+		b = teamsPayload(k, msg)
+	case "discord":
+		b = discordPayload(k, msg)
+	case "webhook":
+		var err error
+		if b, err = webhookPayload(sink, k, msg, severity, rules); err != nil {
+			log.Printf("alerts: webhook %s: %v", redactURL(sink.URL), err)
+			return
+		}
+	default:
+		log.Printf("alerts: unknown sink type %q", sink.Type)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h := http.Header{"Content-Type": {"application/json"}}
+	for name, v := range sink.Headers { h.Set(name, os.ExpandEnv(v)) }
+	if sink.Token != "" { h.Set("Authorization", "Bearer "+os.ExpandEnv(sink.Token)) }
+	sendOutbound(ctx, outboundReq{dest: sink.Type, url: sink.URL, header: h, body: b, sign: true, then: then})
+}
+
+const slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+// slackBotPost addresses a webhook body to sink.Channel for chat.postMessage. The returned
+// callback replies in the new message's thread with the findings past the top ones.
+func slackBotPost(sink AlertSink, k *KPIs, b []byte) ([]byte, func(*http.Response)) {
+	var body map[string]interface{}
+	json.Unmarshal(b, &body)
+	body["channel"] = sink.Channel
+	b, _ = json.Marshal(body)
+	if k == nil { return b, nil }
+	fs := alertFindings(*k)
+	if len(fs) <= topFindings() { return b, nil }
+	rest := fs[topFindings():]
+	return b, func(resp *http.Response) {
+		var posted struct {
+			OK    bool   `json:"ok"`
+			TS    string `json:"ts"`
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&posted)
+		if !posted.OK {
+			log.Printf("alerts: slack %s: %s", sink.Channel, nz(posted.Error, resp.Status)); return
+		}
+		lines := findingLines(rest, strings.TrimRight(cfg.Slack.DashboardURL, "/"))
+		blocks := append([]interface{}{slackSection(fmt.Sprintf("*The other %d findings*", len(rest)))}, slackChunks(lines)...)
+		if len(blocks) > 50 { blocks = blocks[:50] }
+		reply, _ := json.Marshal(map[string]interface{}{"channel": sink.Channel, "thread_ts": posted.TS,
+			"text": fmt.Sprintf("The other %d findings", len(rest)), "blocks": blocks})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		sendOutbound(ctx, outboundReq{dest: sink.Type, url: sink.URL, body: reply, sign: true,
+			header: http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer " + os.ExpandEnv(sink.Token)}}})
+	}
+}
+
+// sinkThrottle is one sink's rate limit: when it last sent, and the latest held alert.
+type sinkThrottle struct {
+	last    time.Time
+	pending func()
+	held    int
+}
+
+var (
+	throttleMu sync.Mutex
+	throttles  = map[string]*sinkThrottle{}
+)
+
+// admitAlert reports whether the sink keyed by key may send now. Otherwise send is held,
+// replacing any alert held before it (each alert describes the whole current analysis),
+// and runs once gap has passed since the last message.
+func admitAlert(key string, gap time.Duration, send func()) bool {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+	t := throttles[key]
+	if t == nil {
+		t = &sinkThrottle{}
+		throttles[key] = t
+	}
+	now := time.Now()
+	if t.pending == nil && now.Sub(t.last) >= gap {
+		t.last = now
+		return true
+	}
+	if t.pending == nil {
+		time.AfterFunc(t.last.Add(gap).Sub(now), func() {
+			throttleMu.Lock()
+			send, held := t.pending, t.held
+			t.pending, t.held, t.last = nil, 0, time.Now()
+			throttleMu.Unlock()
+			log.Printf("alerts: rate limit over; sending the latest of %d held alert(s)", held)
+			send()
+		})
+	}
+	t.pending = send
+	t.held++
+	return false
+}
+
+// splitAlert splits "BizPulse Alert [critical]: text" into its title and text.
+func splitAlert(msg string) (title, text string) {
+	title, text, ok := strings.Cut(msg, ": ")
+	if !ok || !strings.HasPrefix(title, "BizPulse Alert") && !strings.HasPrefix(title, "BizPulse Insights") { return "BizPulse Alert", msg }
+	return strings.TrimSuffix(strings.Replace(title, " [", " · ", 1), "]"), strings.TrimSpace(text)
+}
+
+// alertFacts are the headline numbers shown as Teams facts and Discord fields.
+func alertFacts(k KPIs) [][2]string {
+	return [][2]string{
+		{"Revenue", money(k.TotalRevenue)},
+		{"Orders", fmt.Sprintf("%d (AOV %s)", k.Orders, money(k.AvgOrderValue))},
+		{"Next 7 days", forecastFigure(k)},
+		{"Overdue", fmt.Sprintf("%d (%s)", k.OverdueCount, money(k.OverdueTotal))},
+		{"Period", k.From.Format("2006-01-02") + " → " + k.To.Format("2006-01-02")},
+	}
+}
+
+// teamsPayload is an Adaptive Card message for a Teams incoming webhook or workflow.
+func teamsPayload(k *KPIs, msg string) []byte {
+	title, text := splitAlert(msg)
+	body := []interface{}{
+		map[string]interface{}{"type": "TextBlock", "text": title, "weight": "Bolder", "size": "Medium"},
+		map[string]interface{}{"type": "TextBlock", "text": text, "wrap": true},
+	}
+	card := map[string]interface{}{"$schema": "http://adaptivecards.io/schemas/adaptive-card.json", "type": "AdaptiveCard", "version": "1.4", "body": body}
+	if k != nil {
+		var facts []interface{}
+		for _, f := range alertFacts(*k) { facts = append(facts, map[string]string{"title": f[0], "value": f[1]}) }
+		card["body"] = append(body, map[string]interface{}{"type": "FactSet", "facts": facts})
+		if base := strings.TrimRight(cfg.Slack.DashboardURL, "/"); base != "" {
+			card["actions"] = []interface{}{map[string]string{"type": "Action.OpenUrl", "title": "Open dashboard", "url": base + "/"}}
+		}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"type": "message", "attachments": []interface{}{
+		map[string]interface{}{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+	}})
+	return b
+}
+
+// discordPayload is a Discord webhook message with one embed (descriptions cap at 4096).
+func discordPayload(k *KPIs, msg string) []byte {
+	title, desc := splitAlert(msg)
+	if r := []rune(desc); len(r) > 4096 { desc = string(r[:4093]) + "..." }
+	embed := map[string]interface{}{"title": title, "description": desc, "color": 0xE5534B}
+	if k != nil {
+		var fields []interface{}
+		for _, f := range alertFacts(*k) { fields = append(fields, map[string]interface{}{"name": f[0], "value": f[1], "inline": true}) }
+		embed["fields"] = fields
+		if base := strings.TrimRight(cfg.Slack.DashboardURL, "/"); base != "" { embed["url"] = base + "/" }
+	}
+	b, _ := json.Marshal(map[string]interface{}{"username": "BizPulse", "embeds": []interface{}{embed}})
+	return b
+}
+
+// alertMessage returns the Slack alert text for k, or "" when nothing needs attention.
+func alertMessage(k KPIs) string {
+	var behind []string
+	for _, t := range k.Territories {
+		if t.Behind { behind = append(behind, fmt.Sprintf("%s %.0f%%", t.Name, t.Pace*100)) }
+	}
+	anoms, restated := 0, 0
+	for _, a := range k.Anomalies {
+		if a.Reviewed { continue }
+		anoms++
+		if a.Restated { restated++ }
+	}
+	msg := fmt.Sprintf("BizPulse Alert: %d anomalies; %d overdue (%s). Period %s→%s. Rev %s.",
+		anoms, k.OverdueCount, money(k.OverdueTotal),
+		k.From.Format("2006-01-02"), k.To.Format("2006-01-02"), money(k.TotalRevenue))
+	losses := keyTierLosses(k.Tiers)
+	var misses []string
+	if t := k.ForecastTracking; t != nil {
+		for _, p := range t.Days {
+			if p.New { misses = append(misses, fmt.Sprintf("%s %+.0f%%", p.Day.Format("2006-01-02"), p.Error*100)) }
+		}
+	}
+	var segments []string
+	for _, a := range k.SegmentAnomalies {
+		if a.Ongoing { segments = append(segments, fmt.Sprintf("%s %s %s vs %s usual", a.Key, map[bool]string{true: "↓", false: "↑"}[a.Z < 0], money(a.Value), money(a.Baseline))) }
+	}
+	var late []string
+	for _, ka := range overdueKeyAccounts(k) {
+		late = append(late, fmt.Sprintf("%s (expected %s, %.0fd late)", ka.Account, ka.NextOrder.Format("2006-01-02"), ka.DaysLate))
+	}
+	var ranks []string
+	for _, c := range k.RankChanges {
+		if c.crossing() { ranks = append(ranks, c.Text()) }
+	}
+	if anoms == 0 && k.OverdueCount == 0 && len(behind) == 0 && len(losses) == 0 && len(misses) == 0 && len(segments) == 0 && len(late) == 0 && len(ranks) == 0 && !refundAlerting(k) && !agingDrifting(k) && len(targetsBehind(k)) == 0 { return "" }
+	if restated > 0 {
+		msg += fmt.Sprintf(" %d previously alerted day(s) restated.", restated)
+	}
+	msg += eventNote(k)
+	if len(losses) > 0 {
+		var names []string
+		for _, m := range losses { names = append(names, fmt.Sprintf("%s (%s→%s)", m.Customer, m.From, nz(m.To, "none"))) }
+		msg += " Key customer tier losses: " + strings.Join(names, ", ") + "."
+	}
+	if len(behind) > 0 {
+		msg += " Behind quota pace: " + strings.Join(behind, ", ") + "."
+	}
+	var short []string
+	for _, t := range targetsBehind(k) {
+		short = append(short, fmt.Sprintf("%s %.0f%% (%s of %s)", t.Name, t.ProjectedAttainment*100, money(t.Projected), money(t.Target)))
+	}
+	if len(short) > 0 {
+		msg += " Projected short of target: " + strings.Join(short, ", ") + "."
+	}
+	if len(misses) > 0 {
+		msg += fmt.Sprintf(" Actuals outside the ±%.0f%% forecast band: %s.", k.ForecastTracking.Band*100, firstFew(misses))
+	}
+	if len(segments) > 0 {
+		msg += " Unusual last 7 days: " + firstFew(segments) + "."
+	}
+	if len(late) > 0 {
+		msg += " Key account orders overdue: " + firstFew(late) + "."
+	}
+	if len(ranks) > 0 {
+		msg += " Top list changes: " + firstFew(ranks) + "."
+	}
+	if refundAlerting(k) {
+		msg += fmt.Sprintf(" Refunds at %.1f%% of gross revenue in the last 7 days (%s).", k.Refunds.Rate7*100, money(k.Refunds.Last7))
+	}
+	if agingDrifting(k) {
+		d := k.Receivables.Drift
+		msg += fmt.Sprintf(" Receivables are aging: average %.0f days past due, up %.0f days over the last %d analyses (open %s).", d.To, d.Change, d.Snapshots, money(k.Receivables.Open))
+	}
+	return msg
+}
+
+const alertListMax = 5 // items named per list in the alert text; the findings block ranks the rest
+
+// firstFew joins up to alertListMax items, noting how many more there are.
+func firstFew(items []string) string {
+	if len(items) <= alertListMax { return strings.Join(items, ", ") }
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:alertListMax], ", "), len(items)-alertListMax)
+}
+
+// SlackConfig lays out alert messages. Layout lists Block Kit sections in order from
+// "summary", "findings", "revenue", "trend", "overdue" and "actions"; ["text"] sends the
+// plain one-line alert. Buttons and "view all" links go to DashboardURL and are left out
+// without it.
+type SlackConfig struct {
+	Layout       []string `json:"layout"`
+	DashboardURL string   `json:"dashboardURL"`
+	OverdueRows  int      `json:"overdueRows"` // rows in the overdue table (default 5)
+	TrendDays    int      `json:"trendDays"`   // days in the mini trend (default 14)
+	TopFindings  int      `json:"topFindings"` // findings listed by impact (default 5)
+	RateLimit    string   `json:"rateLimit"`   // least time between SLACK_WEBHOOK messages, e.g. "15m"
+}
+
+var defaultSlackLayout = []string{"summary", "findings", "revenue", "trend", "overdue", "actions"}
+
+// Finding is one item of a batched alert, ranked by Impact: the revenue gap behind it.
+type Finding struct {
+	Text   string
+	Impact float64
+	URL    string // dashboard path of its drill-down
+}
+
+// alertFindings lists what an alert is about, largest impact first: unreviewed anomaly
+// days (gap to a typical day), ongoing segment anomalies (gap to the segment's usual
+// 7-day revenue) and new forecast misses.
+func alertFindings(k KPIs) []Finding {
+	var out []Finding
+	typical := typicalDay(k.DailyRevenue)
+	for _, a := range k.Anomalies {
+		if a.Reviewed { continue }
+		ds := a.Day.Format("2006-01-02")
+		text := fmt.Sprintf("%s revenue %s (z=%.1f)", ds, money(a.Value), a.Z)
+		if len(a.Events) > 0 { text += " — " + strings.Join(a.Events, "; ") }
+		out = append(out, Finding{Text: text, Impact: math.Abs(a.Value - typical), URL: "/view?date=" + ds})
+	}
+	for _, a := range k.SegmentAnomalies {
+		if !a.Ongoing { continue }
+		param := "customer"
+		if a.Segment == "product" { param = "product" }
+		out = append(out, Finding{Text: fmt.Sprintf("%s %s: 7-day revenue %s vs %s usual", a.Segment, a.Key, money(a.Value), money(a.Baseline)),
+			Impact: math.Abs(a.Value - a.Baseline), URL: "/view?" + param + "=" + url.QueryEscape(a.Key)})
+	}
+	if t := k.ForecastTracking; t != nil {
+		for _, p := range t.Days {
+			if !p.New { continue }
+			ds := p.Day.Format("2006-01-02")
+			out = append(out, Finding{Text: fmt.Sprintf("%s actual %s vs %s forecast (%+.0f%%)", ds, money(p.Actual), money(p.Forecast), p.Error*100),
+				Impact: math.Abs(p.Actual - p.Forecast), URL: "/view?date=" + ds})
+		}
+	}
+	for _, ka := range overdueKeyAccounts(k) {
+		out = append(out, Finding{Text: fmt.Sprintf("key account %s: order expected %s, %.0f days late", ka.Account, ka.NextOrder.Format("2006-01-02"), ka.DaysLate),
+			Impact: ka.OrderValue, URL: "/view?customer=" + url.QueryEscape(ka.Account)})
+	}
+	for _, c := range k.RankChanges {
+		if !c.crossing() { continue }
+		param := "customer"
+		if c.List == "products" { param = "product" }
+		out = append(out, Finding{Text: c.Text(), Impact: c.Revenue, URL: "/view?" + param + "=" + url.QueryEscape(c.Name)})
+	}
+	if refundAlerting(k) {
+		out = append(out, Finding{Text: fmt.Sprintf("refunds %.1f%% of gross revenue over the last 7 days", k.Refunds.Rate7*100), Impact: k.Refunds.Last7, URL: "/view?refunds=1"})
+	}
+	if agingDrifting(k) {
+		d := k.Receivables.Drift
+		out = append(out, Finding{Text: fmt.Sprintf("average receivable age up %.0f days (%.0f → %.0f) since %s", d.Change, d.From, d.To, d.Since.Format("2006-01-02")),
+			Impact: k.Receivables.Open, URL: "/#aging"})
+	}
+	for _, t := range targetsBehind(k) {
+		out = append(out, Finding{Text: fmt.Sprintf("%s target projected at %.0f%%: %s of %s, %s short", t.Name, t.ProjectedAttainment*100, money(t.Projected), money(t.Target), money(t.Gap)),
+			Impact: t.Gap, URL: "/#targets"})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Impact > out[j].Impact })
+	return out
+}
+
+func topFindings() int {
+	if n := cfg.Slack.TopFindings; n > 0 { return n }
+	return 5
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// findingLines renders findings as Slack bullets, linked to their drill-down when base is set.
+func findingLines(fs []Finding, base string) []string {
+	var out []string
+	for _, f := range fs {
+		text := slackEscaper.Replace(f.Text)
+		if base != "" { text = "<" + base + f.URL + "|" + text + ">" }
+		out = append(out, fmt.Sprintf("• %s · %s", text, money(f.Impact)))
+	}
+	return out
+}
+
+// slackChunks packs lines into sections under Slack's 3000-character limit.
+func slackChunks(lines []string) []interface{} {
+	var blocks []interface{}
+	var cur string
+	for _, l := range lines {
+		if cur != "" && len(cur)+len(l)+1 > 2900 {
+			blocks = append(blocks, slackSection(cur))
+			cur = ""
+		}
+		if cur != "" { cur += "\n" }
+		cur += l
+	}
+	if cur != "" { blocks = append(blocks, slackSection(cur)) }
+	return blocks
+}
+
+func slackText(kind, text string) map[string]interface{} {
+	return map[string]interface{}{"type": kind, "text": text}
+}
+
+func slackSection(text string) map[string]interface{} {
+	return map[string]interface{}{"type": "section", "text": slackText("mrkdwn", text)}
+}
+
+// textSpark draws vals as a row of block characters, for places without images.
+func textSpark(vals []float64) string {
+	if len(vals) == 0 { return "" }
+	lo, hi := vals[0], vals[0]
+	for _, v := range vals {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	bars := []rune("▁▂▃▄▅▆▇█")
+	var b strings.Builder
+	for _, v := range vals {
+		i := len(bars) / 2
+		if hi > lo { i = int((v - lo) / (hi - lo) * float64(len(bars)-1) + 0.5) }
+		b.WriteRune(bars[i])
+	}
+	return b.String()
+}
+
+// slackBlocks renders the alert sections named in cfg.Slack.Layout; unknown names are skipped.
+func slackBlocks(k KPIs, sales []Sale, msg string) []interface{} {
+	sc := cfg.Slack
+	layout := sc.Layout
+	if len(layout) == 0 { layout = defaultSlackLayout }
+	title, text := splitAlert(msg)
+	blocks := []interface{}{map[string]interface{}{"type": "header", "text": slackText("plain_text", title)}}
+	for _, name := range layout {
+		switch strings.ToLower(name) {
+		case "summary":
+			blocks = append(blocks, slackSection(text))
+		case "findings":
+			fs := alertFindings(k)
+			if len(fs) == 0 { continue }
+			base := strings.TrimRight(sc.DashboardURL, "/")
+			n := min(topFindings(), len(fs))
+			text := fmt.Sprintf("*Top %d of %d findings by impact*\n%s", n, len(fs), strings.Join(findingLines(fs[:n], base), "\n"))
+			if len(fs) > n && base != "" { text += fmt.Sprintf("\n<%s/|View all %d on the dashboard>", base, len(fs)) }
+			blocks = append(blocks, slackSection(text))
+		case "revenue":
+			fields := []interface{}{
+				slackText("mrkdwn", "*Revenue*\n"+money(k.TotalRevenue)),
+				slackText("mrkdwn", fmt.Sprintf("*Orders*\n%d (AOV %s)", k.Orders, money(k.AvgOrderValue))),
+				slackText("mrkdwn", "*Next 7 days*\n"+forecastFigure(k)),
+				slackText("mrkdwn", fmt.Sprintf("*Overdue*\n%d (%s)", k.OverdueCount, money(k.OverdueTotal))),
+			}
+			blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields},
+				map[string]interface{}{"type": "context", "elements": []interface{}{slackText("mrkdwn", fmt.Sprintf("Period %s → %s", k.From.Format("2006-01-02"), k.To.Format("2006-01-02")))}})
+		case "trend":
+			n := sc.TrendDays
+			if n <= 0 { n = 14 }
+			days := k.DailyRevenue
+			if len(days) > n { days = days[len(days)-n:] }
+			if len(days) < 2 { continue }
+			var vals []float64
+			sum := 0.0
+			for _, d := range days {
+				vals = append(vals, d.Value)
+				sum += d.Value
+			}
+			text := fmt.Sprintf("*Last %d days* `%s` %s", len(days), textSpark(vals), money(sum))
+			if all := k.DailyRevenue; len(all) >= 2*len(days) {
+				prev := 0.0
+				for _, d := range all[len(all)-2*len(days) : len(all)-len(days)] { prev += d.Value }
+				if prev > 0 { text += fmt.Sprintf(" (%+.0f%% vs prior %d)", (sum/prev-1)*100, len(days)) }
+			}
+			blocks = append(blocks, slackSection(text))
+		case "overdue":
+			rows := outreachRows(k, sales, "overdue")
+			if len(rows) == 0 { continue }
+			n := sc.OverdueRows
+			if n <= 0 { n = 5 }
+			if n > len(rows) { n = len(rows) }
+			var b strings.Builder
+			fmt.Fprintf(&b, "*Overdue* (%d of %d customers)\n```", n, len(rows))
+			for _, r := range rows[:n] {
+				fmt.Fprintf(&b, "\n%-20.20s %12s  %s", r.Customer, money(r.Amount), nz(r.Owner, "-"))
+			}
+			b.WriteString("\n```")
+			blocks = append(blocks, slackSection(b.String()))
+		case "actions":
+			base := strings.TrimRight(sc.DashboardURL, "/")
+			if base == "" { continue }
+			button := func(label, url string) map[string]interface{} {
+				return map[string]interface{}{"type": "button", "text": slackText("plain_text", label), "url": url}
+			}
+			elems := []interface{}{button("Open dashboard", base+"/")}
+			if k.OverdueCount > 0 { elems = append(elems, button("Overdue outreach", base+"/export/outreach.csv?list=overdue")) }
+			if len(k.AtRisk) > 0 { elems = append(elems, button("At-risk outreach", base+"/export/outreach.csv?list=churn")) }
+			blocks = append(blocks, map[string]interface{}{"type": "divider"}, map[string]interface{}{"type": "actions", "elements": elems})
+		}
+	}
+	return blocks
+}
+
+// slackPayload is the webhook body for an alert: plain text when cfg.Slack.Layout is
+// ["text"], otherwise Block Kit with msg as the notification fallback.
+func slackPayload(k KPIs, sales []Sale, msg string) []byte {
+	body := map[string]interface{}{"text": msg}
+	if l := cfg.Slack.Layout; !(len(l) == 1 && strings.EqualFold(l[0], "text")) {
+		body["blocks"] = slackBlocks(k, sales, msg)
+	}
+	b, _ := json.Marshal(body)
+	return b
+}
+
+// handleSlackPreview shows the alert payload the current analysis would send
+// (GET /api/v1/slack/preview), for pasting into Slack's Block Kit Builder.
+func handleSlackPreview(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	msg := alertFor(*a.KPIs, a.Sales)
+	if msg == "" {
+		http.Error(w, "nothing to alert on", 404); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(slackPayload(*a.KPIs, a.Sales, msg))
+}
+
+func openAISummary(ctx context.Context, k KPIs) string {
+	key := os.Getenv("OPENAI_API_KEY")
+	if key == "" { return "" }
+	// minimal raw HTTP call to OpenAI Chat Completions (gpt-4o-mini)
+	payload := fmt.Sprintf(`{"model":"gpt-4o-mini","messages":[{"role":"system","content":"You write concise executive summaries for business performance."},{"role":"user","content":"Summarize these KPIs in 4 sentences, include 1-2 risks and 1-2 actionable next steps.\nFrom:%s To:%s\nRevenue: %.2f\nOrders: %d\nAOV: %.2f\nRetention: %.2f\nTopCustomers: %s\nTopProducts: %s\nOverdue: %d ($%.2f)\nForecast7: %.2f\n%s"}],"temperature":0.2}`,
+		k.From.Format("2006-01-02"), k.To.Format("2006-01-02"),
+		k.TotalRevenue, k.Orders, k.AvgOrderValue, k.RetentionRate,
+		joinKV(k.TopCustomers), joinKV(k.TopProducts), k.OverdueCount, k.OverdueTotal, k.ForecastNext7DaysTotal,
+		momentumSentence(k.Momentum),
+	)
+	var summary string
+	sent := sendOutbound(ctx, outboundReq{
+		dest: "openai",
+		url:  "https://api.openai.com/v1/chat/completions",
+		header: http.Header{"Authorization": {"Bearer " + key}, "Content-Type": {"application/json"}},
+		body: []byte(payload),
+		then: func(resp *http.Response) {
+			var raw struct{
+				Choices []struct{ Message struct{ Content string `json:"content"` } `json:"message"` } `json:"choices"`
+			}
+			_ = json.NewDecoder(resp.Body).Decode(&raw)
+			if len(raw.Choices) > 0 {
+				summary = strings.TrimSpace(raw.Choices[0].Message.Content)
+			}
+			applyLateSummary(k, summary)
+		},
+	})
+	if !sent { return "" }
+	return summary
+}
+
+// applyLateSummary attaches a summary approved after the fact, if the dataset it
+// describes is still the current one.
+func applyLateSummary(k KPIs, summary string) {
+	if summary == "" { return }
+	for _, a := range allAnalyses() {
+		a.update(func(a *Analysis) {
+			cur := a.KPIs
+			if cur == nil || cur.ExecSummary != "" { return }
+			if cur.From.Equal(k.From) && cur.To.Equal(k.To) && cur.TotalRevenue == k.TotalRevenue && cur.Orders == k.Orders {
+				next := *cur // views may still hold the old KPIs
+				next.ExecSummary = summary
+				a.KPIs, a.Snapshot = &next, snapshotID(next)
+			}
+		})
+	}
+}
+
+// -------- Alert rules --------
+
+// Alert rules replace the built-in "anomalies or overdue" alert with conditions over named
+// metrics, combined with and/or/not and parentheses:
+//
+//   revenue_wow < -15% and new_customers_wow < -20%
+//   overdue_total / revenue > 10% or (at_risk >= 3 and not anomalies = 0)
+//
+// Operands are metrics, numbers (a % suffix divides by 100) and + - * / between them, so
+// cross-metric ratios work. A metric without a value (e.g. a change against an empty week)
+// and division by zero are NaN, and any comparison with NaN is false.
+
+// AlertRule is one named condition. Rules that match are sent to their Channels (alert
+// sink names; all sinks when empty) whose minSeverity they meet, one message per sink.
+type AlertRule struct {
+	Name     string   `json:"name"`
+	When     string   `json:"when"`
+	Severity string   `json:"severity"` // info, warning (default) or critical
+	Channels []string `json:"channels"`
+	cond     ruleCond
+	refs     []string // metrics the condition reads, in order, for the alert text
+}
+
+// Rules added from the alert rules page (or POST /api/v1/alert-rules) are kept in
+// alertRulesPath and run after the config's rules, which can't be edited there.
+var (
+	alertRulesMu   sync.Mutex
+	alertRulesPath = "alert-rules.json"
+	savedRules     []AlertRule
+)
+
+var severityRank = map[string]int{"info": 1, "warning": 2, "critical": 3}
+
+func loadAlertRules(path string) error {
+	alertRulesPath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("alert rules: %w", err) }
+	var rules []AlertRule
+	if err := json.Unmarshal(b, &rules); err != nil { return fmt.Errorf("alert rules %s: %w", path, err) }
+	if err := compileAlertRules(rules); err != nil { return fmt.Errorf("alert rules %s: %w", path, err) }
+	savedRules = rules
+	return nil
+}
+
+func saveAlertRules() error {
+	if alertRulesPath == "" { return nil }
+	b, _ := json.MarshalIndent(savedRules, "", "  ")
+	return os.WriteFile(alertRulesPath, b, 0644)
+}
+
+// alertRules returns the config's rules followed by the saved ones.
+func alertRules() []AlertRule {
+	alertRulesMu.Lock()
+	defer alertRulesMu.Unlock()
+	return append(append([]AlertRule{}, cfg.AlertRules...), savedRules...)
+}
+
+// checkChannels rejects channels that name no alert sink ("slack" is SLACK_WEBHOOK).
+func (r AlertRule) checkChannels() error {
+	for _, c := range r.Channels {
+		ok := strings.EqualFold(c, "slack")
+		for _, s := range cfg.AlertSinks { ok = ok || strings.EqualFold(c, nz(s.Name, s.Type)) }
+		if !ok { return fmt.Errorf("rule %q: unknown channel %q", r.Name, c) }
+	}
+	return nil
+}
+
+func (r AlertRule) routesTo(sink AlertSink) bool {
+	if len(r.Channels) > 0 {
+		found := false
+		for _, c := range r.Channels { found = found || strings.EqualFold(c, sink.Name) }
+		if !found { return false }
+	}
+	return severityRank[r.Severity] >= severityRank[strings.ToLower(sink.MinSeverity)]
+}
+
+type ruleMetric struct {
+	Name string
+	Kind string // money, count, change or share (fractions, shown as percentages) or number
+	Doc  string
+}
+
+var ruleMetricDefs = []ruleMetric{
+	{"revenue", "money", "total revenue of the loaded period"},
+	{"revenue_7d", "money", "revenue in the last 7 days"},
+	{"revenue_prev_7d", "money", "revenue in the 7 days before that"},
+	{"revenue_wow", "change", "week-over-week revenue change (revenue_7d / revenue_prev_7d - 1)"},
+	{"revenue_30d", "money", "revenue in the last 30 days"},
+	{"revenue_mom", "change", "last 30 days against the 30 before"},
+	{"orders", "count", "orders in the loaded period"},
+	{"orders_7d", "count", "orders in the last 7 days"},
+	{"orders_wow", "change", "week-over-week change in orders"},
+	{"aov", "money", "average order value"},
+	{"customers", "count", "unique customers"},
+	{"new_customers_7d", "count", "customers whose first order is in the last 7 days"},
+	{"new_customers_wow", "change", "week-over-week change in new customers"},
+	{"overdue_total", "money", "overdue/unpaid amount"},
+	{"overdue_count", "count", "overdue/unpaid invoices"},
+	{"overdue_90", "money", "open receivables more than 90 days old (past due, or since the invoice date without a due date)"},
+	{"refunds", "money", "refunded (negative-amount) revenue in the loaded period"},
+	{"refund_rate", "share", "refunds / gross revenue over the loaded period"},
+	{"refunds_7d", "money", "refunds in the last 7 days"},
+	{"refund_rate_7d", "share", "refunds / gross revenue over the last 7 days"},
+	{"revenue_ex_tax", "money", "revenue less the tax column (equals revenue without one)"},
+	{"discount_rate", "share", "discounts / revenue excluding tax before discounts"},
+	{"units", "count", "units sold (quantity column)"},
+	{"aging_avg_age", "number", "amount-weighted average days past due of open receivables"},
+	{"aging_drift", "number", "growth in aging_avg_age over the last agingDrift.snapshots analyses"},
+	{"dso", "number", "days sales outstanding: open receivables / revenue of the last 90 days × 90"},
+	{"anomalies", "count", "unreviewed anomaly days"},
+	{"at_risk", "count", "at-risk customers"},
+	{"at_risk_revenue", "money", "lifetime revenue of at-risk customers"},
+	{"key_accounts_overdue", "count", "key accounts past their expected order date"},
+	{"retention", "share", "retention rate"},
+	{"concentration", "share", "revenue share of the top accounts"},
+	{"health", "number", "health score (0-100)"},
+	{"forecast_7d", "money", "forecast revenue for the next 7 days"},
+	{"weekly_target", "money", "the first weekly revenue target this week, else the first monthly one prorated to 7 days"},
+	{"forecast_vs_target", "change", "forecast_7d against weekly_target (forecast_7d / weekly_target - 1)"},
+	{"target_attainment", "share", "lowest percent-to-target among the revenue targets this period"},
+	{"target_projected", "share", "lowest projected attainment (revenue plus forecast over target) among the revenue targets"},
+	{"run_rate_ratio", "number", "7-day run rate / 28-day run rate"},
+}
+
+func isRuleMetric(name string) bool {
+	for _, m := range ruleMetricDefs {
+		if m.Name == name { return true }
+	}
+	return false
+}
+
+// ruleMetrics computes every rule metric for k; windows end on the last day in the data.
+func ruleMetrics(k KPIs, sales []Sale) map[string]float64 {
+	nan := math.NaN()
+	change := func(cur, prev float64) float64 {
+		if prev == 0 { return nan }
+		return cur/prev - 1
+	}
+	end := k.To.AddDate(0, 0, 1)
+	in := func(d time.Time, fromDays, toDays int) bool { // toDays..fromDays days before end
+		return !d.Before(end.AddDate(0, 0, -fromDays)) && d.Before(end.AddDate(0, 0, -toDays))
+	}
+	var rev7, revPrev7, rev30, revPrev30 float64
+	for _, d := range k.DailyRevenue {
+		switch {
+		case in(d.Day, 7, 0):
+			rev7 += d.Value
+		case in(d.Day, 14, 7):
+			revPrev7 += d.Value
+		}
+		if in(d.Day, 30, 0) { rev30 += d.Value } else if in(d.Day, 60, 30) { revPrev30 += d.Value }
+	}
+	var orders7, ordersPrev7 float64
+	first := map[string]time.Time{}
+	for _, s := range sales {
+		switch {
+		case isRefund(s):
+		case in(s.Date, 7, 0):
+			orders7++
+		case in(s.Date, 14, 7):
+			ordersPrev7++
+		}
+		if f, ok := first[s.Customer]; !ok || s.Date.Before(f) { first[s.Customer] = s.Date }
+	}
+	var new7, newPrev7 float64
+	for _, f := range first {
+		if in(f, 7, 0) { new7++ } else if in(f, 14, 7) { newPrev7++ }
+	}
+	anoms := 0
+	for _, a := range k.Anomalies {
+		if !a.Reviewed { anoms++ }
+	}
+	atRiskRev := 0.0
+	for _, c := range k.AtRisk { atRiskRev += c.Revenue }
+	m := map[string]float64{
+		"revenue": k.TotalRevenue, "revenue_7d": rev7, "revenue_prev_7d": revPrev7, "revenue_wow": change(rev7, revPrev7),
+		"revenue_30d": rev30, "revenue_mom": change(rev30, revPrev30),
+		"orders": float64(k.Orders), "orders_7d": orders7, "orders_wow": change(orders7, ordersPrev7),
+		"aov": k.AvgOrderValue, "customers": float64(k.UniqueCustomers),
+		"new_customers_7d": new7, "new_customers_wow": change(new7, newPrev7),
+		"overdue_total": k.OverdueTotal, "overdue_count": float64(k.OverdueCount), "anomalies": float64(anoms),
+		"at_risk": float64(len(k.AtRisk)), "at_risk_revenue": atRiskRev, "key_accounts_overdue": float64(len(overdueKeyAccounts(k))),
+		"retention": k.RetentionRate, "concentration": k.Concentration,
+		"forecast_7d": k.ForecastNext7DaysTotal, "health": nan, "run_rate_ratio": nan,
+	}
+	m["overdue_90"], m["dso"] = 0, nan
+	m["refunds"], m["refund_rate"], m["refunds_7d"], m["refund_rate_7d"] = 0, 0, 0, 0
+	if r := k.Refunds; r != nil { m["refunds"], m["refund_rate"], m["refunds_7d"], m["refund_rate_7d"] = r.Total, r.Rate, r.Last7, r.Rate7 }
+	if r := k.Receivables; r != nil { m["overdue_90"], m["dso"] = r.Buckets[len(r.Buckets)-1].Amount, r.DSO }
+	m["aging_avg_age"], m["aging_drift"] = nan, nan
+	if r := k.Receivables; r != nil {
+		m["aging_avg_age"] = r.AvgAge
+		if r.Drift != nil { m["aging_drift"] = r.Drift.Change }
+	}
+	m["revenue_ex_tax"], m["discount_rate"], m["units"] = k.TotalRevenue, nan, nan
+	if p := k.Pricing; p != nil {
+		m["revenue_ex_tax"] = p.NetExTax
+		if p.HasDiscount { m["discount_rate"] = p.DiscountRate }
+		if p.HasQuantity { m["units"] = p.Units }
+	}
+	m["weekly_target"], m["forecast_vs_target"] = nan, nan
+	if t := weeklyTarget(k.Targets); t > 0 { m["weekly_target"], m["forecast_vs_target"] = t, change(k.ForecastNext7DaysTotal, t) }
+	m["target_attainment"], m["target_projected"] = nan, nan
+	for _, t := range k.Targets {
+		if math.IsNaN(m["target_attainment"]) || t.Attainment < m["target_attainment"] { m["target_attainment"] = t.Attainment }
+		if math.IsNaN(m["target_projected"]) || t.ProjectedAttainment < m["target_projected"] { m["target_projected"] = t.ProjectedAttainment }
+	}
+	// sections left out for lack of history don't evaluate, rather than reading as zero
+	if k.Insufficient["retention"] != "" { m["retention"] = nan }
+	if k.Insufficient["forecast"] != "" { m["forecast_7d"], m["forecast_vs_target"] = nan, nan }
+	if k.Health != nil { m["health"] = k.Health.Score }
+	if k.Momentum != nil { m["run_rate_ratio"] = k.Momentum.RunRateRatio }
+	return m
+}
+
+func formatRuleMetric(name string, v float64) string {
+	if math.IsNaN(v) { return "n/a" }
+	for _, m := range ruleMetricDefs {
+		if m.Name != name { continue }
+		switch m.Kind {
+		case "money":
+			return money(v)
+		case "change":
+			return fmt.Sprintf("%+.1f%%", v*100)
+		case "share":
+			return fmt.Sprintf("%.1f%%", v*100)
+		case "count":
+			return strconv.FormatFloat(v, 'f', 0, 64)
+		}
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+type ruleCond interface{ eval(m map[string]float64) bool }
+type ruleOperand interface{ value(m map[string]float64) float64 }
+
+type ruleAnd struct{ l, r ruleCond }
+type ruleOr struct{ l, r ruleCond }
+type ruleNot struct{ c ruleCond }
+type ruleCmp struct {
+	l, r ruleOperand
+	op   string
+}
+type ruleNum float64
+type ruleRef string
+type ruleArith struct {
+	l, r ruleOperand
+	op   byte
+}
+
+func (c ruleAnd) eval(m map[string]float64) bool { return c.l.eval(m) && c.r.eval(m) }
+func (c ruleOr) eval(m map[string]float64) bool  { return c.l.eval(m) || c.r.eval(m) }
+func (c ruleNot) eval(m map[string]float64) bool { return !c.c.eval(m) }
+
+func (c ruleCmp) eval(m map[string]float64) bool {
+	a, b := c.l.value(m), c.r.value(m)
+	if math.IsNaN(a) || math.IsNaN(b) { return false }
+	switch c.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "=", "==":
+		return a == b
+	case "!=", "<>":
+		return a != b
+	}
+	return false
+}
+
+func (n ruleNum) value(map[string]float64) float64   { return float64(n) }
+func (r ruleRef) value(m map[string]float64) float64 { return m[string(r)] }
+
+func (a ruleArith) value(m map[string]float64) float64 {
+	x, y := a.l.value(m), a.r.value(m)
+	switch a.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	}
+	if y == 0 { return math.NaN() }
+	return x / y
+}
+
+// ruleTokens splits a condition into names, numbers (with an optional %), operators and parentheses.
+func ruleTokens(src string) []string {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.ContainsRune("()+-*/", rune(c)):
+			toks = append(toks, string(c))
+			i++
+		case strings.ContainsRune("=<>!", rune(c)):
+			j := i + 1
+			if j < len(src) && strings.ContainsRune("=>", rune(src[j])) { j++ }
+			toks = append(toks, src[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\n()+-*/=<>!", rune(src[j])) { j++ }
+			toks = append(toks, src[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+type ruleParser struct {
+	sqlParser
+	refs []string
+}
+
+// parseRule compiles a rule condition and lists the metrics it reads.
+func parseRule(src string) (ruleCond, []string, error) {
+	p := &ruleParser{sqlParser: sqlParser{toks: ruleTokens(src)}}
+	if len(p.toks) == 0 { return nil, nil, fmt.Errorf("empty condition") }
+	c, err := p.or()
+	if err != nil { return nil, nil, err }
+	if p.pos < len(p.toks) { return nil, nil, fmt.Errorf("unexpected %q", p.toks[p.pos]) }
+	return c, p.refs, nil
+}
+
+func (p *ruleParser) or() (ruleCond, error) {
+	l, err := p.and()
+	if err != nil { return nil, err }
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		r, err := p.and()
+		if err != nil { return nil, err }
+		l = ruleOr{l, r}
+	}
+	return l, nil
+}
+
+func (p *ruleParser) and() (ruleCond, error) {
+	l, err := p.unary()
+	if err != nil { return nil, err }
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		r, err := p.unary()
+		if err != nil { return nil, err }
+		l = ruleAnd{l, r}
+	}
+	return l, nil
+}
+
+func (p *ruleParser) unary() (ruleCond, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		c, err := p.unary()
+		if err != nil { return nil, err }
+		return ruleNot{c}, nil
+	case "(":
+		// a parenthesized condition, or an arithmetic operand like (a + b) / c
+		save, nrefs := p.pos, len(p.refs)
+		p.next()
+		if c, err := p.or(); err == nil && p.peek() == ")" {
+			p.next()
+			if !strings.ContainsAny(p.peek(), "+-*/<>=!") { return c, nil }
+		}
+		p.pos, p.refs = save, p.refs[:nrefs]
+	}
+	l, err := p.sum()
+	if err != nil { return nil, err }
+	op := p.next()
+	switch op {
+	case "<", "<=", ">", ">=", "=", "==", "!=", "<>":
+	default:
+		return nil, fmt.Errorf("expected a comparison, got %q", op)
+	}
+	r, err := p.sum()
+	if err != nil { return nil, err }
+	return ruleCmp{l, r, op}, nil
+}
+
+func (p *ruleParser) sum() (ruleOperand, error) {
+	l, err := p.product()
+	if err != nil { return nil, err }
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()[0]
+		r, err := p.product()
+		if err != nil { return nil, err }
+		l = ruleArith{l, r, op}
+	}
+	return l, nil
+}
+
+func (p *ruleParser) product() (ruleOperand, error) {
+	l, err := p.operand()
+	if err != nil { return nil, err }
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.next()[0]
+		r, err := p.operand()
+		if err != nil { return nil, err }
+		l = ruleArith{l, r, op}
+	}
+	return l, nil
+}
+
+func (p *ruleParser) operand() (ruleOperand, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("condition ends early")
+	case t == "-":
+		o, err := p.operand()
+		if err != nil { return nil, err }
+		return ruleArith{ruleNum(0), o, '-'}, nil
+	case t == "(":
+		o, err := p.sum()
+		if err != nil { return nil, err }
+		return o, p.expect(")")
+	}
+	num := strings.TrimSuffix(strings.TrimPrefix(t, "$"), "%")
+	if f, err := strconv.ParseFloat(strings.ReplaceAll(num, ",", ""), 64); err == nil {
+		if strings.HasSuffix(t, "%") { f /= 100 }
+		return ruleNum(f), nil
+	}
+	name := strings.ToLower(t)
+	if !isRuleMetric(name) { return nil, fmt.Errorf("unknown metric %q (see /api/v1/alert-rules)", t) }
+	p.refs = append(p.refs, name)
+	return ruleRef(name), nil
+}
+
+func compileAlertRules(rules []AlertRule) error {
+	for i := range rules {
+		r := &rules[i]
+		c, refs, err := parseRule(r.When)
+		if err != nil { return fmt.Errorf("alertRules[%d] %q: %w", i, nz(r.Name, r.When), err) }
+		r.Severity = strings.ToLower(nz(r.Severity, "warning"))
+		if severityRank[r.Severity] == 0 { return fmt.Errorf("alertRules[%d] %q: severity must be info, warning or critical", i, nz(r.Name, r.When)) }
+		r.cond = c
+		seen := map[string]bool{}
+		for _, ref := range refs {
+			if !seen[ref] { r.refs, seen[ref] = append(r.refs, ref), true }
+		}
+		if r.Name == "" { r.Name = r.When }
+	}
+	return nil
+}
+
+// RuleResult is a rule evaluated against an analysis, with the metric values it read.
+type RuleResult struct {
+	Name     string
+	When     string
+	Severity string
+	Channels []string
+	Saved    bool // added from the alert rules page rather than the config
+	Fired    bool
+	Values   map[string]string
+}
+
+// evalAlertRules evaluates rules in order.
+func evalAlertRules(rules []AlertRule, k KPIs, sales []Sale) []RuleResult {
+	m := ruleMetrics(k, sales)
+	var out []RuleResult
+	for i, r := range rules {
+		res := RuleResult{Name: r.Name, When: r.When, Severity: r.Severity, Channels: r.Channels, Saved: i >= len(cfg.AlertRules),
+			Fired: r.cond.eval(m), Values: map[string]string{}}
+		for _, ref := range r.refs { res.Values[ref] = formatRuleMetric(ref, m[ref]) }
+		out = append(out, res)
+	}
+	return out
+}
+
+// ruleAlertText names the fired rules and the values that triggered them, tagged with
+// the highest severity among them.
+func ruleAlertText(k KPIs, rules []AlertRule, fired []RuleResult) (msg, severity string) {
+	var parts []string
+	note := ""
+	for i, r := range fired {
+		if severityRank[r.Severity] > severityRank[severity] { severity = r.Severity }
+		var vals []string
+		for _, ref := range rules[i].refs {
+			vals = append(vals, ref+" "+r.Values[ref])
+			if ref == "anomalies" { note = eventNote(k) }
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", r.Name, strings.Join(vals, ", ")))
+	}
+	return fmt.Sprintf("BizPulse Alert [%s]: %s. Period %s→%s. Rev %s.%s", severity, strings.Join(parts, "; "),
+		k.From.Format("2006-01-02"), k.To.Format("2006-01-02"), money(k.TotalRevenue), note), severity
+}
+
+// eventNote names the logged events unreviewed anomalies coincide with, as a sentence
+// for alert text; "" when there are none.
+func eventNote(k KPIs) string {
+	var coinciding []string
+	for _, a := range k.Anomalies {
+		if !a.Reviewed && len(a.Events) > 0 { coinciding = append(coinciding, a.Day.Format("2006-01-02")+" "+strings.Join(a.Events, "; ")) }
+	}
+	if len(coinciding) == 0 { return "" }
+	return " Anomalies coincide with logged events: " + firstFew(coinciding) + "."
+}
+
+// firedRules evaluates every rule and keeps the ones that matched, rules and results aligned.
+func firedRules(k KPIs, sales []Sale) ([]AlertRule, []RuleResult) {
+	all := alertRules()
+	var rules []AlertRule
+	var fired []RuleResult
+	for i, r := range evalAlertRules(all, k, sales) {
+		if r.Fired { rules, fired = append(rules, all[i]), append(fired, r) }
+	}
+	return rules, fired
+}
+
+// alertFor returns the alert text for k: the built-in alertMessage, or with alert rules
+// configured, every rule that fired. "" means nothing to send.
+func alertFor(k KPIs, sales []Sale) string {
+	if len(alertRules()) == 0 { return alertMessage(k) }
+	rules, fired := firedRules(k, sales)
+	if len(fired) == 0 { return "" }
+	msg, _ := ruleAlertText(k, rules, fired)
+	return msg
+}
+
+// dispatchAlerts sends k's alert: the built-in alert to every sink, or with alert rules,
+// each sink the rules routed to it. Sinks already notified of the same conditions within
+// the cooldown are skipped.
+func dispatchAlerts(k KPIs, sales []Sale) {
+	now := time.Now()
+	if len(alertRules()) == 0 {
+		msg := alertMessage(k)
+		if msg == "" { return }
+		fps := alertFingerprints(k)
+		for _, sink := range alertSinks() {
+			if claimAlert(sink, fps, now) { sendAlertTo(sink, &k, sales, msg, "warning", nil) }
+		}
+		return
+	}
+	rules, fired := firedRules(k, sales)
+	for _, sink := range alertSinks() {
+		var mine []AlertRule
+		var res []RuleResult
+		for i, r := range rules {
+			if r.routesTo(sink) { mine, res = append(mine, r), append(res, fired[i]) }
+		}
+		if len(mine) == 0 { continue }
+		var fps []string
+		for _, r := range mine { fps = append(fps, "rule:"+r.Name) }
+		if !claimAlert(sink, fps, now) { continue }
+		msg, severity := ruleAlertText(k, mine, res)
+		sendAlertTo(sink, &k, sales, msg, severity, res)
+	}
+}
+
+// handleAlertRules lists the rule metrics with their current values and evaluates every
+// rule (GET /api/v1/alert-rules). POST adds or replaces a saved rule by name (form fields
+// or JSON name, when, severity, channels); DELETE ?name= (or POST action=delete) removes one.
+func handleAlertRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var rule AlertRule
+		del := r.Method == http.MethodDelete || r.FormValue("action") == "delete"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&rule); err != nil {
+				http.Error(w, "invalid JSON body", 400); return
+			}
+		} else {
+			rule = AlertRule{Name: r.FormValue("name"), When: r.FormValue("when"), Severity: r.FormValue("severity")}
+			for _, c := range strings.Split(r.FormValue("channels"), ",") {
+				if c = strings.TrimSpace(c); c != "" { rule.Channels = append(rule.Channels, c) }
+			}
+		}
+		rule.Name = strings.TrimSpace(rule.Name)
+		if rule.Name == "" {
+			http.Error(w, "name is required", 400); return
+		}
+		if !del {
+			rules := []AlertRule{rule}
+			if err := compileAlertRules(rules); err != nil {
+				http.Error(w, err.Error(), 400); return
+			}
+			rule = rules[0]
+			if err := rule.checkChannels(); err != nil {
+				http.Error(w, err.Error(), 400); return
+			}
+			for _, c := range cfg.AlertRules {
+				if strings.EqualFold(c.Name, rule.Name) {
+					http.Error(w, "a config rule already uses that name", 409); return
+				}
+			}
+		}
+		alertRulesMu.Lock()
+		next, found := []AlertRule{}, false
+		for _, s := range savedRules {
+			if strings.EqualFold(s.Name, rule.Name) { found = true; continue }
+			next = append(next, s)
+		}
+		if !del { next = append(next, rule) }
+		if del && !found {
+			alertRulesMu.Unlock()
+			http.Error(w, "rule not found", 404); return
+		}
+		savedRules = next
+		err := saveAlertRules()
+		alertRulesMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		if r.FormValue("redirect") != "" {
+			http.Redirect(w, r, "/alert-rules", http.StatusSeeOther); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alertRulesView(analysisFor(r)))
+}
+
+// AlertRulesView is the rules page and API response.
+type AlertRulesView struct {
+	Metrics  []ruleMetric
+	Values   map[string]string // current value per metric, when there is an analysis
+	Rules    []RuleResult
+	Sinks    []string // alert sink names rules can route to
+	ReadOnly bool `json:"-"` // the caller may not manage rules
+}
+
+func alertRulesView(a *Analysis) AlertRulesView {
+	v := AlertRulesView{Metrics: ruleMetricDefs}
+	rules := alertRules()
+	if a.KPIs != nil {
+		v.Values = map[string]string{}
+		for name, x := range ruleMetrics(*a.KPIs, a.Sales) { v.Values[name] = formatRuleMetric(name, x) }
+		v.Rules = evalAlertRules(rules, *a.KPIs, a.Sales)
+	} else {
+		for i, r := range rules { v.Rules = append(v.Rules, RuleResult{Name: r.Name, When: r.When, Severity: r.Severity, Channels: r.Channels, Saved: i >= len(cfg.AlertRules)}) }
+	}
+	for _, s := range alertSinks() { v.Sinks = append(v.Sinks, s.Name) }
+	return v
+}
+
+func handleAlertRulesPage(w http.ResponseWriter, r *http.Request) {
+	v := alertRulesView(analysisFor(r))
+	v.ReadOnly = roleRank[roleFor(r)] < roleRank["admin"]
+	_ = alertRulesTpl.Execute(w, v)
+}
+
+var alertRulesTpl = template.Must(template.New("alertRules").Parse(`
+<!doctype html><html><head><meta charset="utf-8"><title>BizPulse · Alert rules</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
+.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
+table{width:100%;border-collapse:collapse} th,td{border-bottom:1px solid #22305f;padding:8px;text-align:left;vertical-align:top}
+a{color:#7aa2ff} button{background:#7aa2ff;color:#04102a;border:none;padding:6px 10px;border-radius:8px;cursor:pointer}
+input,select{background:#0b1020;color:#e8ecff;border:1px solid #22305f;border-radius:6px;padding:5px} .muted{color:#9fb0ff;font-size:13px}
+.fired{color:#ff8a8a;font-weight:600}</style>
+</head><body>
+<h1>Alert rules</h1><p><a href="/">← Dashboard</a></p>
+{{if .ReadOnly}}<div class="card muted">Only admins can add or delete rules.</div>{{else}}
+<div class="card">
+  <form method="POST" action="/api/v1/alert-rules">
+    <input type="hidden" name="redirect" value="1">
+    <input name="name" placeholder="Name" required>
+    <input name="when" placeholder="revenue_wow &lt; -20% and overdue_total &gt; 10000" size="50" required>
+    <select name="severity"><option>info</option><option selected>warning</option><option>critical</option></select>
+    <input name="channels" placeholder="channels (all)" title="Comma-separated alert sinks{{if .Sinks}}: {{range $i, $s := .Sinks}}{{if $i}}, {{end}}{{$s}}{{end}}{{end}}">
+    <button type="submit">Save</button>
+  </form>
+  <p class="muted">Saving a name that exists replaces that rule. With no rules, the built-in alert (anomalies, overdue, quota, tiers, forecast misses) is sent instead.</p>
+</div>{{end}}
+<div class="card"><table><thead><tr><th>Rule</th><th>Condition</th><th>Severity</th><th>Channels</th><th>Now</th><th></th></tr></thead><tbody>
+{{range .Rules}}<tr><td>{{.Name}}</td><td><code>{{.When}}</code></td><td>{{.Severity}}</td><td>{{range $i, $c := .Channels}}{{if $i}}, {{end}}{{$c}}{{else}}all{{end}}</td>
+<td>{{if .Fired}}<span class="fired">fires</span>{{else}}quiet{{end}}<div class="muted">{{range $m, $v := .Values}}{{$m}} {{$v}}<br>{{end}}</div></td>
+<td>{{if and .Saved (not $.ReadOnly)}}<form method="POST" action="/api/v1/alert-rules"><input type="hidden" name="redirect" value="1"><input type="hidden" name="action" value="delete"><input type="hidden" name="name" value="{{.Name}}"><button type="submit">Delete</button></form>{{else}}<span class="muted">config</span>{{end}}</td></tr>
+{{else}}<tr><td colspan="6">No rules yet.</td></tr>{{end}}
+</tbody></table></div>
+<div class="card"><h3>Metrics</h3><table><thead><tr><th>Metric</th><th>Now</th><th>Meaning</th></tr></thead><tbody>
+{{$vals := .Values}}{{range .Metrics}}<tr><td><code>{{.Name}}</code></td><td>{{index $vals .Name}}</td><td class="muted">{{.Doc}}</td></tr>{{end}}
+</tbody></table></div>
+</body></html>`))
+
+// -------- Alert dedup --------
+
+// Each alert carries fingerprints of the conditions behind it (an anomaly day, the overdue
+// count and total, a fired rule, ...). A sink is skipped when every fingerprint was already
+// sent to it within cfg.AlertCooldown, so re-uploading a file doesn't repeat an alert while
+// any new or changed condition still goes out. Sent fingerprints persist in alertStatePath.
+var (
+	alertStateMu   sync.Mutex
+	alertStatePath string // set by loadAlertState; empty (demo) keeps state in memory
+	alertSent      = map[string]time.Time{} // sink name + "|" + fingerprint -> last sent
+)
+
+const defaultAlertCooldown = 24 * time.Hour
+
+func loadAlertState(path string) error {
+	alertStatePath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return fmt.Errorf("alert state: %w", err) }
+	if err := json.Unmarshal(b, &alertSent); err != nil { return fmt.Errorf("alert state %s: %w", path, err) }
+	return nil
+}
+
+// saveAlertState drops entries past the cooldown and writes the rest; callers hold alertStateMu.
+func saveAlertState(now time.Time) error {
+	cooldown := alertCooldown()
+	for key, at := range alertSent {
+		if now.Sub(at) >= cooldown { delete(alertSent, key) }
+	}
+	if alertStatePath == "" { return nil }
+	b, _ := json.MarshalIndent(alertSent, "", "  ")
+	return os.WriteFile(alertStatePath, b, 0644)
+}
+
+func alertCooldown() time.Duration {
+	if cfg.AlertCooldown == "" { return defaultAlertCooldown }
+	d, _ := parseCadence(cfg.AlertCooldown) // checked by loadConfig
+	return d
+}
+
+// alertFingerprints lists the conditions behind k's built-in alert.
+func alertFingerprints(k KPIs) []string {
+	var fps []string
+	for _, a := range k.Anomalies {
+		if !a.Reviewed { fps = append(fps, "anomaly:"+a.Day.Format("2006-01-02")) }
+	}
+	if k.OverdueCount > 0 { fps = append(fps, fmt.Sprintf("overdue:%d:%.2f", k.OverdueCount, k.OverdueTotal)) }
+	for _, t := range k.Territories {
+		if t.Behind { fps = append(fps, "behind:"+t.Name) }
+	}
+	for _, m := range keyTierLosses(k.Tiers) { fps = append(fps, "tier:"+m.Customer+":"+m.From+">"+m.To) }
+	if t := k.ForecastTracking; t != nil {
+		for _, p := range t.Days {
+			if p.New { fps = append(fps, "forecast:"+p.Day.Format("2006-01-02")) }
+		}
+	}
+	for _, a := range k.SegmentAnomalies {
+		if a.Ongoing { fps = append(fps, "segment:"+a.Key+":"+a.Day.Format("2006-01-02")) }
+	}
+	for _, ka := range overdueKeyAccounts(k) { fps = append(fps, "keyaccount:"+ka.Account+":"+ka.NextOrder.Format("2006-01-02")) }
+	for _, c := range k.RankChanges {
+		if c.crossing() { fps = append(fps, fmt.Sprintf("rank:%s:%s:%d>%d", c.List, c.Name, c.From, c.To)) }
+	}
+	if refundAlerting(k) { fps = append(fps, "refunds:"+k.To.Format("2006-01-02")) }
+	if agingDrifting(k) { fps = append(fps, "agingdrift:"+k.To.Format("2006-01-02")) }
+	for _, t := range targetsBehind(k) { fps = append(fps, "target:"+t.Name+":"+t.PeriodStart.Format("2006-01-02")) }
+	return fps
+}
+
+// claimAlert reports whether sink should get an alert with these fingerprints, and if so
+// records them as sent.
+func claimAlert(sink AlertSink, fps []string, now time.Time) bool {
+	cooldown := alertCooldown()
+	alertStateMu.Lock()
+	defer alertStateMu.Unlock()
+	fresh := cooldown <= 0 || len(fps) == 0
+	for _, fp := range fps {
+		if at, ok := alertSent[sink.Name+"|"+fp]; !ok || now.Sub(at) >= cooldown { fresh = true }
+	}
+	if !fresh {
+		log.Printf("alerts: %s already notified of these conditions within %s; skipped", sink.Name, cooldown)
+		return false
+	}
+	for _, fp := range fps { alertSent[sink.Name+"|"+fp] = now }
+	if err := saveAlertState(now); err != nil { log.Printf("alert state: %v", err) }
+	return true
+}
+
+// handleAlertState lists the fingerprints still in cooldown (GET /api/v1/alert-state);
+// DELETE clears them so the next analysis alerts again.
+func handleAlertState(w http.ResponseWriter, r *http.Request) {
+	alertStateMu.Lock()
+	defer alertStateMu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		alertSent = map[string]time.Time{}
+		if err := saveAlertState(time.Now()); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cooldown": alertCooldown().String(), "sent": alertSent})
+}
+
+// -------- Outbound audit --------
+
+// Every payload sent to an external service (Slack, OpenAI, webhooks) goes through
+// sendOutbound, which records it in an in-memory audit log (and optionally a JSONL file).
+// With -approve-outbound, payloads are held as "pending" until approved or rejected
+// from /outbound or the API.
+
+// OutboundRecord is one audited outbound payload. URL is reduced to scheme and host
+// since webhook paths carry secrets.
+type OutboundRecord struct {
+	ID          int
+	Time        time.Time
+	Destination string
+	URL         string
+	Payload     string
+	Status      string // pending, sent, failed, rejected
+	Error       string
+}
+
+type outboundReq struct {
+	dest   string
+	url    string
+	header http.Header
+	body   []byte
+	method string // default POST
+	then   func(resp *http.Response) // optional; called with the response when sent
+	send   func(ctx context.Context) error // optional; delivers instead of an HTTP POST (e.g. email)
+	sign   bool   // webhook: signed per attempt and retried on 5xx/429 (see signRequest)
+	id     string // delivery ID, set by sendOutbound for signed requests
+}
+
+var (
+	outboundMu       sync.Mutex
+	outboundLog      []OutboundRecord
+	outboundPending  = map[int]outboundReq{}
+	outboundNextID   = 1
+	outboundLogPath  string
+	outboundApproval bool
+)
+
+const outboundLogLimit = 500
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil { return "(invalid url)" }
+	return u.Scheme + "://" + u.Host
+}
+
+// sendOutbound audits req and sends it, or queues it when approval is required.
+// It reports whether the request was sent synchronously.
+func sendOutbound(ctx context.Context, req outboundReq) bool {
+	if req.sign { req.id = newDeliveryID() }
+	outboundMu.Lock()
+	rec := OutboundRecord{ID: outboundNextID, Time: time.Now(), Destination: req.dest, URL: redactURL(req.url), Payload: string(req.body), Status: "pending"}
+	outboundNextID++
+	if demoMode {
+		rec.Status = "blocked (demo)"
+		recordOutbound(rec)
+		outboundMu.Unlock()
+		return false
+	}
+	if outboundApproval {
+		outboundPending[rec.ID] = req
+		recordOutbound(rec)
+		outboundMu.Unlock()
+		return false
+	}
+	outboundMu.Unlock()
+	deliverOutbound(ctx, rec, req)
+	return true
+}
+
+func deliverOutbound(ctx context.Context, rec OutboundRecord, req outboundReq) {
+	var err error
+	if req.send != nil {
+		err = req.send(ctx)
+	} else {
+		err = postOutbound(ctx, req)
+	}
+	rec.Status = "sent"
+	if err != nil {
+		rec.Status, rec.Error = "failed", err.Error()
+	}
+	outboundMu.Lock()
+	recordOutbound(rec)
+	outboundMu.Unlock()
+}
+
+func postOutbound(ctx context.Context, req outboundReq) error {
+	attempts := 1
+	if req.sign { attempts = 3 }
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(time.Duration(i) * time.Second):
+			}
+		}
+		var retry bool
+		if retry, err = postOnce(ctx, req); !retry { return err }
+	}
+	return err
+}
+
+// postOnce makes one delivery attempt and reports whether a failure is worth retrying.
+func postOnce(ctx context.Context, req outboundReq) (bool, error) {
+	hreq, err := http.NewRequestWithContext(ctx, nz(req.method, http.MethodPost), req.url, bytes.NewReader(req.body))
+	if err != nil { return false, err }
+	for k, vs := range req.header {
+		for _, v := range vs { hreq.Header.Add(k, v) }
+	}
+	if req.sign {
+		hreq.Header.Set("X-BizPulse-Delivery", req.id)
+		signRequest(hreq, req.body, time.Now())
+	}
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil { return true, err }
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 { err = fmt.Errorf("status %s", resp.Status) }
+	if req.then != nil { req.then(resp) }
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// recordOutbound upserts rec by ID; callers hold outboundMu.
+func recordOutbound(rec OutboundRecord) {
+	replaced := false
+	for i := range outboundLog {
+		if outboundLog[i].ID == rec.ID {
+			outboundLog[i], replaced = rec, true
+		}
+	}
+	if !replaced { outboundLog = append(outboundLog, rec) }
+	if len(outboundLog) > outboundLogLimit { outboundLog = outboundLog[len(outboundLog)-outboundLogLimit:] }
+	if outboundLogPath != "" && rec.Status != "pending" {
+		if f, err := os.OpenFile(outboundLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+			json.NewEncoder(f).Encode(rec)
+			f.Close()
+		}
+	}
+}
+
+// handleOutbound lists audited payloads, newest first.
+func handleOutbound(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outboundSnapshot())
+}
+
+func outboundSnapshot() []OutboundRecord {
+	outboundMu.Lock()
+	defer outboundMu.Unlock()
+	out := make([]OutboundRecord, len(outboundLog))
+	for i, rec := range outboundLog { out[len(out)-1-i] = rec }
+	return out
+}
+
+// handleOutboundDecision approves (sends) or rejects a pending payload: POST ?id=&action=approve|reject.
+func handleOutboundDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	outboundMu.Lock()
+	req, ok := outboundPending[id]
+	delete(outboundPending, id)
+	var rec OutboundRecord
+	for _, x := range outboundLog {
+		if x.ID == id { rec = x }
+	}
+	outboundMu.Unlock()
+	if !ok {
+		http.Error(w, "no pending payload with that id", 404); return
+	}
+	switch r.FormValue("action") {
+	case "approve":
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		deliverOutbound(ctx, rec, req)
+	default:
+		rec.Status = "rejected"
+		outboundMu.Lock()
+		recordOutbound(rec)
+		outboundMu.Unlock()
+	}
+	if r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/outbound", http.StatusSeeOther); return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var outboundTpl = template.Must(template.New("outbound").Parse(`
+<!doctype html><html><head><meta charset="utf-8"><title>BizPulse · Outbound audit</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
+.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
+table{width:100%;border-collapse:collapse} th,td{border-bottom:1px solid #22305f;padding:8px;vertical-align:top}
+pre{white-space:pre-wrap;word-break:break-all;max-height:160px;overflow:auto;margin:0;color:#9aa7cf}
+a{color:#7aa2ff} button{background:#7aa2ff;color:#04102a;border:none;padding:6px 10px;border-radius:8px;cursor:pointer}</style>
+</head><body>
+<h1>Outbound audit</h1><p><a href="/">← Dashboard</a> · approval {{if .Approval}}required{{else}}off{{end}}</p>
+<div class="card"><table><thead><tr><th>#</th><th>Time</th><th>Destination</th><th>Status</th><th>Payload</th></tr></thead><tbody>
+{{range .Records}}<tr><td>{{.ID}}</td><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Destination}}<br><span style="color:#9aa7cf">{{.URL}}</span></td>
+<td>{{.Status}}{{if .Error}}<br>{{.Error}}{{end}}{{if eq .Status "pending"}}
+<form method="POST" action="/api/v1/outbound/decision"><input type="hidden" name="redirect" value="1"><input type="hidden" name="id" value="{{.ID}}">
+<button name="action" value="approve">Approve</button> <button name="action" value="reject">Reject</button></form>{{end}}</td>
+<td><pre>{{.Payload}}</pre></td></tr>{{else}}<tr><td colspan="5">Nothing has been sent.</td></tr>{{end}}
+</tbody></table></div>
+</body></html>`))
+
+func handleOutboundPage(w http.ResponseWriter, _ *http.Request) {
+	_ = outboundTpl.Execute(w, struct {
+		Approval bool
+		Records  []OutboundRecord
+	}{outboundApproval, outboundSnapshot()})
+}
+
+// -------- Request signing --------
+
+// Webhook payloads (sign set on the outboundReq) carry an HMAC-SHA256 signature when
+// BIZPULSE_SIGNING_SECRET is set. It covers the method, path and expiry as well as the
+// body, so a captured signature can't be replayed against another route or after it
+// lapses:
+//
+//	X-BizPulse-Expires:   unix seconds; at most signatureMaxAge after signing
+//	X-BizPulse-Signature: v1=hex(HMAC(secret, "v1:" + method + ":" + path + ":" + expires + ":" + body))
+//	X-BizPulse-Delivery:  ID shared by every attempt of one payload
+//
+// Each attempt is signed afresh, so retries and deliveries held for approval don't
+// expire, while receivers dedupe on the delivery ID. Inbound integration endpoints
+// accept the same scheme, or Slack's v0 signatures (timestamp and body only) with
+// SLACK_SIGNING_SECRET.
+
+const signatureMaxAge = 5 * time.Minute // longest a signature lives; older v0 timestamps are replays
+
+func hmacHex(secret, msg string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(msg))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// v1Message is what a v1 signature covers.
+func v1Message(method, path, expires string, body []byte) string {
+	return "v1:" + method + ":" + path + ":" + expires + ":" + string(body)
+}
+
+// signRequest adds the signature headers to an outbound webhook request.
+func signRequest(r *http.Request, body []byte, now time.Time) {
+	secret := os.Getenv("BIZPULSE_SIGNING_SECRET")
+	if secret == "" { return }
+	exp := strconv.FormatInt(now.Add(signatureMaxAge).Unix(), 10)
+	r.Header.Set("X-BizPulse-Expires", exp)
+	r.Header.Set("X-BizPulse-Signature", "v1="+hmacHex(secret, v1Message(r.Method, r.URL.Path, exp, body)))
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 16)
+	cryptorand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// verifySignature checks a BizPulse (v1) or Slack (v0) signature on an inbound request
+// with the given body. It returns nil when no inbound secret is configured.
+func verifySignature(r *http.Request, body []byte, now time.Time) error {
+	if secret := os.Getenv("BIZPULSE_SIGNING_SECRET"); secret != "" {
+		if sig := r.Header.Get("X-BizPulse-Signature"); sig != "" {
+			exp, err := strconv.ParseInt(r.Header.Get("X-BizPulse-Expires"), 10, 64)
+			if err != nil { return fmt.Errorf("invalid X-BizPulse-Expires") }
+			if left := time.Unix(exp, 0).Sub(now); left < 0 {
+				return fmt.Errorf("signature expired")
+			} else if left > signatureMaxAge {
+				return fmt.Errorf("signature expiry more than %s ahead", signatureMaxAge)
+			}
+			want := "v1=" + hmacHex(secret, v1Message(r.Method, r.URL.Path, strconv.FormatInt(exp, 10), body))
+			if !hmac.Equal([]byte(sig), []byte(want)) { return fmt.Errorf("signature mismatch") }
+			return nil
+		}
+	}
+	if secret := os.Getenv("SLACK_SIGNING_SECRET"); secret != "" {
+		if sig := r.Header.Get("X-Slack-Signature"); sig != "" {
+			ts, err := strconv.ParseInt(r.Header.Get("X-Slack-Request-Timestamp"), 10, 64)
+			if err != nil { return fmt.Errorf("invalid X-Slack-Request-Timestamp") }
+			if age := now.Sub(time.Unix(ts, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+				return fmt.Errorf("signature timestamp outside ±%s", signatureMaxAge)
+			}
+			want := "v0=" + hmacHex(secret, "v0:"+strconv.FormatInt(ts, 10)+":"+string(body))
+			if !hmac.Equal([]byte(sig), []byte(want)) { return fmt.Errorf("signature mismatch") }
+			return nil
+		}
+	}
+	if os.Getenv("BIZPULSE_SIGNING_SECRET") != "" || os.Getenv("SLACK_SIGNING_SECRET") != "" { return fmt.Errorf("missing signature") }
+	return nil
+}
+
+// requireSignature wraps an inbound integration endpoint so that, once a signing secret
+// is configured, only signed requests reach it. The body is buffered for the check and
+// handed on unchanged.
+func requireSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 50<<20))
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		if err := verifySignature(r, body, time.Now()); err != nil {
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized); return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// -------- Anomaly digest --------
+
+// DigestConfig schedules the anomaly email digest. Mail goes through SMTP_HOST (host:port),
+// authenticating with SMTP_USER / SMTP_PASS when set.
+type DigestConfig struct {
+	To    []string `json:"to"`
+	From  string   `json:"from"`
+	Every string   `json:"every"` // "24h", "7d"; default daily
+}
+
+const digestTopN = 3 // contributors listed per dimension
+
+// Contribution is one customer's or product's share of an anomaly day's revenue.
+type Contribution struct {
+	Dim    string // customer or product
+	Name   string
+	Amount float64
+	Share  float64
+}
+
+// DigestItem is one anomaly in a digest, with its chart and top contributors.
+type DigestItem struct {
+	Anomaly
+	Chart         template.URL // cid: reference in mail, data: URI in the preview
+	Contributions []Contribution
+	png           []byte
+}
+
+// Digest is what one digest mail reports: new anomalies and top-list changes.
+type Digest struct {
+	Items   []DigestItem
+	Changes []RankChange
+}
+
+var (
+	digestMu      sync.Mutex
+	digestSent    = map[string]bool{} // anomaly days already included in a digest
+	digestChanges time.Time           // top-list changes up to this time were included
+)
+
+// contributions ranks the top customers and products on day by revenue share.
+func contributions(sales []Sale, day string) []Contribution {
+	var total float64
+	by := map[string]map[string]float64{"customer": {}, "product": {}}
+	for _, s := range sales {
+		if s.Date.Format("2006-01-02") != day { continue }
+		total += s.Amount
+		by["customer"][s.Customer] += s.Amount
+		by["product"][s.Product] += s.Amount
+	}
+	var out []Contribution
+	for _, dim := range []string{"customer", "product"} {
+		var cs []Contribution
+		for name, amt := range by[dim] {
+			cs = append(cs, Contribution{Dim: dim, Name: name, Amount: amt, Share: amt / math.Max(total, 1e-9)})
+		}
+		sort.Slice(cs, func(i, j int) bool {
+			if cs[i].Amount != cs[j].Amount { return cs[i].Amount > cs[j].Amount }
+			return cs[i].Name < cs[j].Name
+		})
+		if len(cs) > digestTopN { cs = cs[:digestTopN] }
+		out = append(out, cs...)
+	}
+	return out
+}
+
+// anomalyChart draws a small PNG of daily revenue around day, with day marked in red.
+// Mail clients drop inline SVG, so the digest uses raster images.
+func anomalyChart(daily []KVt, day time.Time) []byte {
+	var pts []KVt
+	for _, d := range daily {
+		if !d.Day.Before(day.AddDate(0, 0, -14)) && !d.Day.After(day.AddDate(0, 0, 3)) { pts = append(pts, d) }
+	}
+	const w, h, pad = 240, 60, 4
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix { img.Pix[i] = 255 }
+	if len(pts) == 0 { return encodePNG(img) }
+	minV, maxV := pts[0].Value, pts[0].Value
+	for _, p := range pts {
+		minV, maxV = math.Min(minV, p.Value), math.Max(maxV, p.Value)
+	}
+	xy := func(i int) (int, int) {
+		x := pad + i*(w-2*pad)/max(1, len(pts)-1)
+		return x, int(float64(h-pad) - scale(pts[i].Value, minV, maxV, 0, h-2*pad))
+	}
+	line := color.RGBA{0x4a, 0x72, 0xd8, 0xff}
+	for i := 1; i < len(pts); i++ {
+		x0, y0 := xy(i - 1)
+		x1, y1 := xy(i)
+		steps := max(max(abs(x1-x0), abs(y1-y0)), 1)
+		for s := 0; s <= steps; s++ {
+			img.Set(x0+(x1-x0)*s/steps, y0+(y1-y0)*s/steps, line)
+		}
+	}
+	for i, p := range pts {
+		if !p.Day.Equal(day) { continue }
+		x, y := xy(i)
+		for dx := -2; dx <= 2; dx++ {
+			for dy := -2; dy <= 2; dy++ { img.Set(x+dx, y+dy, color.RGBA{0xd8, 0x3a, 0x3a, 0xff}) }
+		}
+	}
+	return encodePNG(img)
+}
+
+func encodePNG(img image.Image) []byte {
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	return b.Bytes()
+}
+
+func abs(n int) int {
+	if n < 0 { return -n }
+	return n
+}
+
+// digestItems returns the anomalies in a that no earlier digest included.
+func digestItems(a *Analysis) []DigestItem {
+	if a.KPIs == nil { return nil }
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	var out []DigestItem
+	for _, an := range a.KPIs.Anomalies {
+		day := an.Day.Format("2006-01-02")
+		if digestSent[day] { continue }
+		out = append(out, DigestItem{Anomaly: an, png: anomalyChart(a.KPIs.DailyRevenue, an.Day),
+			Contributions: contributions(a.Sales, day)})
+	}
+	return out
+}
+
+// nextDigest collects what the next digest of a would include; top-list changes are
+// tracked for the shared dataset only.
+func nextDigest(a *Analysis) Digest {
+	d := Digest{Items: digestItems(a)}
+	if a.Dataset == defaultDataset {
+		digestMu.Lock()
+		since := digestChanges
+		digestMu.Unlock()
+		d.Changes = rankChangesSince(since)
+	}
+	return d
+}
+
+var digestTpl = template.Must(template.New("digest").Funcs(template.FuncMap{"mul100": mul100, "money": money}).Parse(`<!doctype html><html><body style="font-family:Arial,sans-serif;color:#1a2040">
+<h2>BizPulse anomaly digest</h2>
+<p>{{len .Items}} new anomal{{if eq (len .Items) 1}}y{{else}}ies{{end}} since the last digest.</p>
+{{if .Changes}}<h3>Top list changes</h3>
+<ul>{{range .Changes}}<li>{{.Text}} <span style="color:#6a7398">· {{.At.Format "Jan 2"}}</span></li>{{end}}</ul>{{end}}
+{{range .Items}}
+<div style="border:1px solid #d6dcef;border-radius:8px;padding:12px;margin:12px 0">
+  <b>{{.Day.Format "Mon 2006-01-02"}}</b> — {{money .Value}} (z={{printf "%.2f" .Z}}){{if .Restated}} · restated{{end}}<br>
+  <img src="{{.Chart}}" width="240" height="60" alt="revenue around {{.Day.Format "2006-01-02"}}">
+  <table style="border-collapse:collapse;font-size:13px">
+  {{range .Contributions}}<tr><td style="padding:2px 8px;color:#6a7398">{{.Dim}}</td><td style="padding:2px 8px">{{.Name}}</td>
+  <td style="padding:2px 8px">{{money .Amount}}</td><td style="padding:2px 8px">{{printf "%.0f%%" (mul100 .Share)}}</td></tr>{{end}}
+  </table>
+  {{if .Campaigns}}<p style="color:#6a7398">Campaigns started shortly before: {{range $i, $c := .Campaigns}}{{if $i}}, {{end}}{{$c}}{{end}}</p>{{end}}
+</div>
+{{end}}
+</body></html>`))
+
+// digestMessage builds a multipart/related mail with the charts attached inline.
+func digestMessage(from string, to []string, d Digest) ([]byte, string, error) {
+	items := d.Items
+	for i := range items { items[i].Chart = template.URL(fmt.Sprintf("cid:chart%d@bizpulse", i)) }
+	var html bytes.Buffer
+	if err := digestTpl.Execute(&html, d); err != nil { return nil, "", err }
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	subject := fmt.Sprintf("BizPulse anomaly digest: %d new", len(items))
+	if len(d.Changes) > 0 { subject += fmt.Sprintf(", %d top list change(s)", len(d.Changes)) }
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/related; boundary=%q\r\n\r\n",
+		from, strings.Join(to, ", "), subject, mw.Boundary())
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=UTF-8"}})
+	part.Write(html.Bytes())
+	for i, it := range items {
+		part, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/png"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {fmt.Sprintf("<chart%d@bizpulse>", i)},
+			"Content-Disposition":       {fmt.Sprintf("inline; filename=\"chart%d.png\"", i)},
+		})
+		enc := base64.StdEncoding.EncodeToString(it.png)
+		for len(enc) > 76 {
+			fmt.Fprintf(part, "%s\r\n", enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", enc)
+	}
+	mw.Close()
+	return msg.Bytes(), html.String(), nil
+}
+
+// sendDigest mails anomalies and top-list changes not yet digested and marks them sent.
+// It reports how many of each were included.
+func sendDigest(ctx context.Context) (int, int, error) {
+	d := cfg.Digest
+	host := os.Getenv("SMTP_HOST")
+	if len(d.To) == 0 || host == "" { return 0, 0, fmt.Errorf("digest needs digest.to in the config and SMTP_HOST") }
+	next := nextDigest(shared.view())
+	if len(next.Items) == 0 && len(next.Changes) == 0 { return 0, 0, nil }
+	from := nz(d.From, "bizpulse@localhost")
+	msg, html, err := digestMessage(from, d.To, next)
+	if err != nil { return 0, 0, err }
+	var auth smtp.Auth
+	if u := os.Getenv("SMTP_USER"); u != "" {
+		auth = smtp.PlainAuth("", u, os.Getenv("SMTP_PASS"), strings.Split(host, ":")[0])
+	}
+	sendOutbound(ctx, outboundReq{dest: "email", url: "smtp://" + host, body: []byte(html),
+		send: func(context.Context) error { return smtp.SendMail(host, auth, from, d.To, msg) }})
+	digestMu.Lock()
+	for _, it := range next.Items { digestSent[it.Day.Format("2006-01-02")] = true }
+	if n := len(next.Changes); n > 0 { digestChanges = next.Changes[n-1].At }
+	digestMu.Unlock()
+	return len(next.Items), len(next.Changes), nil
+}
+
+func monitorDigest(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, changes, err := sendDigest(ctx); err != nil {
+				log.Printf("digest: %v", err)
+			} else if n > 0 || changes > 0 {
+				log.Printf("digest: %d anomalies, %d top list changes", n, changes)
+			}
+		}
+	}
+}
+
+// handleDigestPreview renders the digest that would go out next, charts inline as data URIs.
+func handleDigestPreview(w http.ResponseWriter, r *http.Request) {
+	d := nextDigest(analysisFor(r))
+	for i := range d.Items {
+		d.Items[i].Chart = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(d.Items[i].png))
+	}
+	_ = digestTpl.Execute(w, d)
+}
+
+// handleDigestSend sends the digest now (POST /api/v1/digest/send).
+func handleDigestSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	n, changes, err := sendDigest(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Anomalies": n, "Changes": changes})
+}
+
+// -------- Weekly insights --------
+
+// Once a week the insights message picks the few changes worth reading: the last full
+// week (Monday to Sunday) is set against the insightBaselineWeeks before it, for the
+// business totals (revenue, orders, average order value, customers) and for the revenue
+// of every sizeable customer, product, category, region, channel and country. Each
+// candidate is scored by effect size, its change over the baseline weeks' spread, and the
+// strongest few are written out as sentences and sent by email and to the alert sinks
+// the config names.
+
+const (
+	insightBaselineWeeks = 4
+	insightMax           = 5    // insights per message
+	insightMin           = 3    // filled up to from weaker changes, if any are notable at all
+	insightStrong        = 2.0  // effect size that always qualifies
+	insightNotable       = 1.0  // effect size below which a change is never reported
+	insightMinShare      = 0.02 // of the five weeks' revenue, for a segment to be considered
+	insightMinSpread     = 0.1  // the spread is at least this share of the baseline mean
+)
+
+var insightDimensions = []string{"customer", "product", "category", "region", "channel", "country"}
+
+// InsightsConfig schedules the weekly insights message (server mode). It is emailed to
+// To through SMTP_HOST like the digest, and posted to the alert sinks named in Sinks
+// ("*" for all of them).
+type InsightsConfig struct {
+	To       []string `json:"to"`
+	From     string   `json:"from"`
+	Sinks    []string `json:"sinks"`
+	Schedule string   `json:"schedule"` // cron, local time; default "0 8 * * MON"
+	Dataset  string   `json:"dataset"`  // default: the default dataset
+}
+
+func (c InsightsConfig) enabled() bool { return len(c.To) > 0 || len(c.Sinks) > 0 }
+
+// Insight is one notable change of the week.
+type Insight struct {
+	Metric   string  // revenue, orders, aov or customers; for a segment, its dimension
+	Segment  string  // the customer, product, ... ; "" for the business totals
+	Current  float64 // the week's value
+	Baseline float64 // average of the baseline weeks
+	Change   float64 // Current vs Baseline; 0 without a baseline
+	Effect   float64 // (Current - Baseline) / spread of the baseline weeks
+	Text     string
+}
+
+// WeeklyInsights is one week's insights message.
+type WeeklyInsights struct {
+	Dataset    string
+	Week       time.Time // Monday
+	WeekEnd    time.Time // Sunday
+	Baseline   time.Time // first day of the baseline weeks
+	Considered int       // changes scored
+	Insights   []Insight // strongest first
+}
+
+var (
+	insightsMu   sync.Mutex
+	insightsSent = map[string]bool{} // dataset|week already sent by the schedule
+)
+
+// insightWeek is the last full week to report: the one ending on the latest Sunday
+// before today, or before the day after the data ends when that's earlier, so a
+// stale export isn't reported as a week of zeros.
+func insightWeek(to, today time.Time) time.Time {
+	asOf := today.AddDate(0, 0, -1)
+	if end := to.AddDate(0, 0, 1); end.Before(asOf) { asOf = end }
+	return periodStart(asOf.AddDate(0, 0, -int(asOf.Weekday())), "week")
+}
+
+// weeklyInsights scores the week starting on Monday week against the weeks before it.
+func weeklyInsights(sales []Sale, week time.Time) (WeeklyInsights, error) {
+	wi := WeeklyInsights{Week: week, WeekEnd: week.AddDate(0, 0, 6), Baseline: week.AddDate(0, 0, -7*insightBaselineWeeks)}
+	if len(sales) == 0 { return wi, withKind(ErrNoData, fmt.Errorf("no sales loaded")) }
+	from := sales[0].Date
+	for _, s := range sales {
+		if s.Date.Before(from) { from = s.Date }
+	}
+	if from.After(wi.Baseline.AddDate(0, 0, 6)) {
+		return wi, withKind(ErrNoData, fmt.Errorf("weekly insights need %d weeks of history before the week of %s; data starts %s",
+			insightBaselineWeeks, week.Format("2006-01-02"), from.Format("2006-01-02")))
+	}
+	const n = insightBaselineWeeks + 1 // the baseline weeks, then the week
+	var revenue, orders [n]float64
+	var customers [n]map[string]bool
+	for i := range customers { customers[i] = map[string]bool{} }
+	segments := map[string]map[string]*[n]float64{}
+	for _, d := range insightDimensions { segments[d] = map[string]*[n]float64{} }
+	var total float64
+	for _, s := range sales {
+		if s.Date.Before(wi.Baseline) || s.Date.After(wi.WeekEnd) { continue }
+		i := int(s.Date.Sub(wi.Baseline).Hours()/24) / 7
+		revenue[i] += s.Amount
+		orders[i]++
+		customers[i][s.Customer] = true
+		total += s.Amount
+		for _, d := range insightDimensions {
+			v := fmt.Sprint(saleColumn(s, d))
+			if v == "" { continue }
+			w := segments[d][v]
+			if w == nil { w = new([n]float64); segments[d][v] = w }
+			w[i] += s.Amount
+		}
+	}
+	var cands []Insight
+	score := func(metric, segment string, w [n]float64, floor float64) {
+		var mean, sd float64
+		for _, x := range w[:n-1] { mean += x }
+		mean /= n - 1
+		for _, x := range w[:n-1] { sd += (x - mean) * (x - mean) }
+		sd = math.Sqrt(sd / (n - 2))
+		spread := math.Max(sd, math.Max(insightMinSpread*math.Abs(mean), floor))
+		in := Insight{Metric: metric, Segment: segment, Current: w[n-1], Baseline: mean, Effect: (w[n-1] - mean) / spread}
+		if mean != 0 { in.Change = (w[n-1] - mean) / math.Abs(mean) }
+		cands = append(cands, in)
+	}
+	var aov, buyers [n]float64
+	for i := range aov {
+		if orders[i] > 0 { aov[i] = revenue[i] / orders[i] }
+		buyers[i] = float64(len(customers[i]))
+	}
+	weekly := total / n
+	score("revenue", "", revenue, 0)
+	score("orders", "", orders, 1)
+	score("aov", "", aov, 0)
+	score("customers", "", buyers, 1)
+	for _, d := range insightDimensions {
+		for v, w := range segments[d] {
+			var sum float64
+			for _, x := range w { sum += math.Abs(x) }
+			if total == 0 || sum < insightMinShare*math.Abs(total) { continue }
+			score(d, v, *w, 0.01*math.Abs(weekly))
+		}
+	}
+	wi.Considered = len(cands)
+	sort.Slice(cands, func(i, j int) bool {
+		if a, b := math.Abs(cands[i].Effect), math.Abs(cands[j].Effect); a != b { return a > b }
+		if cands[i].Metric != cands[j].Metric { return cands[i].Metric < cands[j].Metric }
+		return cands[i].Segment < cands[j].Segment
+	})
+	for _, c := range cands {
+		e := math.Abs(c.Effect)
+		if len(wi.Insights) == insightMax || e < insightNotable || e < insightStrong && len(wi.Insights) >= insightMin { break }
+		c.Text = insightText(c)
+		wi.Insights = append(wi.Insights, c)
+	}
+	return wi, nil
+}
+
+// insightText words an insight, e.g. "Product Widget A brought in $4,100, 85% above its
+// 4-week average of $2,200."
+func insightText(in Insight) string {
+	figure := money
+	switch in.Metric {
+	case "orders", "customers":
+		figure = func(v float64) string { return fmt.Sprintf("%.0f", v) }
+	}
+	var subject string
+	switch in.Metric {
+	case "revenue":
+		subject = "Revenue was " + figure(in.Current)
+	case "orders":
+		subject = figure(in.Current) + " orders were placed"
+	case "aov":
+		subject = "The average order was " + figure(in.Current)
+	case "customers":
+		subject = figure(in.Current) + " customers bought"
+	default:
+		subject = fmt.Sprintf("%s%s %s", strings.ToUpper(in.Metric[:1]), in.Metric[1:], in.Segment)
+		switch {
+		case in.Baseline == 0:
+			return fmt.Sprintf("%s brought in %s, after nothing in the previous %d weeks.", subject, money(in.Current), insightBaselineWeeks)
+		case in.Current == 0:
+			return fmt.Sprintf("%s brought in nothing, against %s a week over the previous %d weeks.", subject, money(in.Baseline), insightBaselineWeeks)
+		}
+		subject += " brought in " + figure(in.Current)
+	}
+	dir := "above"
+	if in.Current < in.Baseline { dir = "below" }
+	return fmt.Sprintf("%s, %.0f%% %s the %d-week average of %s.", subject, math.Abs(in.Change)*100, dir, insightBaselineWeeks, figure(in.Baseline))
+}
+
+// insightsFor computes a's insights for the week starting Monday week, or for the last
+// full week when week is zero.
+func insightsFor(a *Analysis, week time.Time) (WeeklyInsights, error) {
+	if a.KPIs == nil { return WeeklyInsights{Dataset: a.Dataset}, withKind(ErrNoData, fmt.Errorf("no KPIs yet")) }
+	if week.IsZero() { week = insightWeek(a.KPIs.To, time.Now().UTC().Truncate(24*time.Hour)) }
+	wi, err := weeklyInsights(a.Sales, periodStart(week, "week"))
+	wi.Dataset = a.Dataset
+	return wi, err
+}
+
+// insightsMessage is wi as an alert message: a title line, then one insight per line.
+func insightsMessage(wi WeeklyInsights) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BizPulse Insights [week of %s]: ", wi.Week.Format("Jan 2"))
+	if len(wi.Insights) == 0 { b.WriteString("Nothing moved much against the last 4 weeks.") }
+	for _, in := range wi.Insights { b.WriteString("\n• " + in.Text) }
+	return b.String()
+}
+
+var insightsTpl = template.Must(template.New("insights").Funcs(template.FuncMap{"money": money}).Parse(`<!doctype html><html><body style="font-family:Arial,sans-serif;color:#1a2040">
+<h2>BizPulse weekly insights</h2>
+<p style="color:#6a7398">{{if .Dataset}}{{.Dataset}} · {{end}}Week of {{.Week.Format "Mon Jan 2"}} – {{.WeekEnd.Format "Sun Jan 2, 2006"}}, against the 4 weeks from {{.Baseline.Format "Jan 2"}}</p>
+{{if .Insights}}<ol>{{range .Insights}}<li style="margin:6px 0">{{.Text}}</li>{{end}}</ol>
+{{else}}<p>Nothing moved much against the last 4 weeks.</p>{{end}}
+<p style="color:#6a7398;font-size:12px">{{len .Insights}} of {{.Considered}} changes scored, ranked by how far each moved beyond its usual week-to-week swing.</p>
+</body></html>`))
+
+// sendInsights sends wi by email and to the configured alert sinks.
+func sendInsights(ctx context.Context, wi WeeklyInsights) error {
+	c := cfg.Insights
+	if !c.enabled() { return fmt.Errorf("insights needs insights.to or insights.sinks in the config") }
+	if len(c.To) > 0 {
+		host := os.Getenv("SMTP_HOST")
+		if host == "" { return fmt.Errorf("insights.to needs SMTP_HOST") }
+		var html bytes.Buffer
+		if err := insightsTpl.Execute(&html, wi); err != nil { return err }
+		from := nz(c.From, "bizpulse@localhost")
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: BizPulse weekly insights: week of %s\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n%s",
+			from, strings.Join(c.To, ", "), wi.Week.Format("Jan 2"), html.String())
+		var auth smtp.Auth
+		if u := os.Getenv("SMTP_USER"); u != "" {
+			auth = smtp.PlainAuth("", u, os.Getenv("SMTP_PASS"), strings.Split(host, ":")[0])
+		}
+		sendOutbound(ctx, outboundReq{dest: "email", url: "smtp://" + host, body: html.Bytes(),
+			send: func(context.Context) error { return smtp.SendMail(host, auth, from, c.To, []byte(msg)) }})
+	}
+	msg := insightsMessage(wi)
+	for _, sink := range alertSinks() {
+		for _, name := range c.Sinks {
+			if name == "*" || strings.EqualFold(name, sink.Name) { deliverAlert(sink, nil, nil, msg, "info", nil); break }
+		}
+	}
+	return nil
+}
+
+// runInsights sends the configured dataset's insights for the last full week, once.
+func runInsights(ctx context.Context) error {
+	a, err := workspace(nz(cfg.Insights.Dataset, defaultDataset), false)
+	if err != nil { return err }
+	wi, err := insightsFor(a.view(), time.Time{})
+	if err != nil { return err }
+	key := wi.Dataset + "|" + wi.Week.Format("2006-01-02")
+	insightsMu.Lock()
+	sent := insightsSent[key]
+	insightsMu.Unlock()
+	if sent { return nil }
+	if err := sendInsights(ctx, wi); err != nil { return err }
+	insightsMu.Lock()
+	insightsSent[key] = true
+	insightsMu.Unlock()
+	log.Printf("insights: sent %d for the week of %s", len(wi.Insights), wi.Week.Format("2006-01-02"))
+	return nil
+}
+
+// insightsRequest reads ?week= (any day of it) for r's analysis.
+func insightsRequest(w http.ResponseWriter, r *http.Request) (WeeklyInsights, bool) {
+	var week time.Time
+	if v := r.URL.Query().Get("week"); v != "" {
+		if week = parseDateFlexible(v); week.IsZero() {
+			http.Error(w, "week: expected a date like 2025-07-07", 400); return WeeklyInsights{}, false
+		}
+	}
+	wi, err := insightsFor(analysisFor(r), week)
+	if err != nil {
+		httpError(w, "", err, 400); return wi, false
+	}
+	return wi, true
+}
+
+// handleInsights returns the week's insights (GET /api/v1/insights[?week=]).
+func handleInsights(w http.ResponseWriter, r *http.Request) {
+	wi, ok := insightsRequest(w, r)
+	if !ok { return }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wi)
+}
+
+// handleInsightsPreview renders the insights email (GET /insights/preview[?week=]).
+func handleInsightsPreview(w http.ResponseWriter, r *http.Request) {
+	if wi, ok := insightsRequest(w, r); ok { _ = insightsTpl.Execute(w, wi) }
+}
+
+// handleInsightsSend sends the insights now (POST /api/v1/insights/send[?week=]), whether
+// or not the schedule already sent that week.
+func handleInsightsSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	wi, ok := insightsRequest(w, r)
+	if !ok { return }
+	if err := sendInsights(r.Context(), wi); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wi)
+}
+
+// -------- Schema --------
+
+// The data dictionary behind /api/v1/schema: the normalized sale fields (with the header
+// each binds to in the active dataset), the dimensions rows can be grouped by, and every
+// metric BizPulse computes, so downstream tools can introspect inputs and outputs.
+
+type SchemaField struct {
+	Name        string
+	Type        string // date, string or number
+	Required    bool
+	Description string
+	Matches     string // how the source header is found
+	Pinned      string // header pinned by the columns config, if any
+	Bound       string // header bound in the active dataset's last upload ("" when missing)
+}
+
+type SchemaDimension struct {
+	Name        string
+	Source      string // sale field it comes from, or "derived"
+	Description string
+	Values      int // distinct non-empty values in the active dataset
+}
+
+type SchemaMetric struct {
+	Name        string
+	Unit        string // money, count, change, share or number
+	Description string
+}
+
+type Schema struct {
+	Dataset     string
+	Rows        int
+	Base        string // currency the amounts are in: the dataset's, else the configured base ("" when neither is set)
+	Unit        string // what quantity counts ("" when not set)
+	Fields      []SchemaField
+	Dimensions  []SchemaDimension
+	Metrics     []SchemaMetric // usable in alert rules
+	Definitions []MetricDef    // how the headline metrics are computed
+}
+
+var fieldDocs = map[string]struct{ Type, Doc string }{
+	"date":     {"date", "transaction date; ISO YYYY-MM-DD preferred, common day/month formats are detected"},
+	"customer": {"string", "customer name, canonicalized through the alias table (\"Unknown\" when blank)"},
+	"product":  {"string", "product or SKU (\"Unknown\" when blank)"},
+	"amount":   {"number", "order value, converted to the base currency when a currency column is present"},
+	"status":   {"string", "payment status, lower-cased; values containing overdue, unpaid or due count as unpaid"},
+	"rep":      {"string", "sales rep"},
+	"region":   {"string", "region or territory"},
+	"campaign": {"string", "campaign or acquisition source"},
+	"invoice":  {"string", "invoice id, used to dedupe merged uploads"},
+	"currency": {"string", "ISO 4217 code of amount; empty means the base currency"},
+	"due":      {"date", "invoice due date; receivables age by days past due when present"},
+	"tax":      {"number", "tax included in amount, converted like amount; revenue excluding tax is amount less tax"},
+	"discount": {"number", "discount already taken off amount, converted like amount; a value like 15% is a share of the price before it"},
+	"quantity": {"number", "units sold (also matched from a qty column)"},
+	"category": {"string", "product category; rows without one use the productCategories config"},
+	"channel":  {"string", "sales channel, e.g. online, retail or partner"},
+	"email":    {"string", "customer email; a blank customer takes the company its domain names"},
+	"country":  {"string", "country name, ISO alpha-2 or alpha-3 code, normalized to alpha-2; unrecognized values are dropped"},
+}
+
+var schemaDimensions = []struct{ Name, Source, Doc string }{
+	{"customer", "customer", "canonical customer"},
+	{"account", "derived", "parent account from the parent-accounts mapping, else the customer"},
+	{"product", "product", "product or SKU"},
+	{"category", "derived", "product category from the category column, else the productCategories mapping"},
+	{"status", "status", "payment status"},
+	{"rep", "rep", "sales rep"},
+	{"region", "region", "region or territory"},
+	{"campaign", "campaign", "campaign or acquisition source"},
+	{"channel", "channel", "sales channel"},
+	{"country", "derived", "ISO country from the country column, else a region naming one, else the email's country domain"},
+	{"company", "derived", "company named by the email domain (the row's or the contact's); none for free-mail domains"},
+	{"currency", "currency", "original currency"},
+}
+
+// datasetSchema describes a's normalized schema.
+func datasetSchema(a *Analysis) Schema {
+	meta := datasetMeta(a.Dataset)
+	sc := Schema{Dataset: nz(a.Dataset, "session"), Rows: len(a.Sales), Base: meta.Currency, Unit: meta.Unit}
+	for _, f := range saleFields {
+		matches := "header equal to \"" + f + "\", else the first header containing it"
+		if f == "campaign" { matches += " (falls back to \"source\")" }
+		sc.Fields = append(sc.Fields, SchemaField{
+			Name: f, Type: fieldDocs[f].Type, Required: f == "date", Description: fieldDocs[f].Doc,
+			Matches: matches, Pinned: cfg.Columns[f], Bound: a.Columns[f],
+		})
+	}
+	for _, d := range schemaDimensions {
+		seen := map[string]bool{}
+		for _, s := range a.Sales {
+			if v := fmt.Sprint(saleColumn(s, d.Name)); v != "" { seen[v] = true }
+		}
+		sc.Dimensions = append(sc.Dimensions, SchemaDimension{Name: d.Name, Source: d.Source, Description: d.Doc, Values: len(seen)})
+	}
+	for _, m := range ruleMetricDefs {
+		sc.Metrics = append(sc.Metrics, SchemaMetric{Name: m.Name, Unit: m.Kind, Description: m.Doc})
+	}
+	sc.Definitions = metricDefs(a.Dataset)
+	return sc
+}
+
+// handleSchema returns the data dictionary for the active dataset (GET /api/v1/schema).
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(datasetSchema(analysisFor(r)))
+}
+
+// -------- Sales query language --------
+
+// /api/v1/query and `bizpulse query` take a restricted query language over the normalized
+// sales table, so power users can answer ad-hoc questions without exporting. It borrows
+// SQL's SELECT syntax but is not SQL: there's no database behind it (no DuckDB or SQLite
+// driver is built in), just this parser over the loaded rows. All of it:
+//
+//   SELECT * | col | COUNT(*) | SUM/AVG/MIN/MAX/COUNT(col) [AS alias], ...
+//   FROM sales [WHERE cond {AND|OR cond}] [GROUP BY col, ...]
+//   [ORDER BY col|alias [ASC|DESC], ...] [LIMIT n]
+//
+// Conditions compare a column to a literal with = != <> < <= > >= or LIKE, may be negated
+// with NOT and grouped with parentheses. Dates compare as YYYY-MM-DD strings. Anything
+// else SQL has (joins, subqueries, HAVING, DISTINCT, other functions, other tables, more
+// than one statement) is rejected by name rather than half-parsed; see sqlUnsupported.
+
+const (
+	queryMaxRows = 1000
+	queryTimeout = 5 * time.Second
+)
+
+var sqlColumns = []string{"date", "customer", "account", "product", "amount", "status", "rep", "region", "campaign", "invoice", "currency", "due", "tax", "discount", "quantity", "category", "channel", "email", "country", "company"}
+
+func saleColumn(s Sale, col string) interface{} {
+	switch col {
+	case "date":
+		return s.Date.Format("2006-01-02")
+	case "customer":
+		return s.Customer
+	case "account":
+		return accountOf(s.Customer)
+	case "product":
+		return s.Product
+	case "amount":
+		return s.Amount
+	case "status":
+		return s.Status
+	case "rep":
+		return s.Rep
+	case "region":
+		return s.Region
+	case "campaign":
+		return s.Campaign
+	case "invoice":
+		return s.Invoice
+	case "currency":
+		return s.Currency
+	case "due":
+		if s.Due.IsZero() { return "" }
+		return s.Due.Format("2006-01-02")
+	case "tax":
+		return s.inBase(s.Tax)
+	case "discount":
+		return s.inBase(s.Discount)
+	case "quantity":
+		return s.Quantity
+	case "category":
+		return categoryOf(s)
+	case "channel":
+		return s.Channel
+	case "email":
+		return s.Email
+	case "country":
+		return countryOf(s)
+	case "company":
+		return companyOf(s)
+	}
+	return nil
+}
+
+// QueryResult is a tabular query response.
+type QueryResult struct {
+	Columns   []string
+	Rows      [][]interface{}
+	Truncated bool // more rows matched than the row limit allowed
+}
+
+type sqlItem struct {
+	Agg   string // "", count, sum, avg, min, max
+	Col   string // column name or "*"
+	Alias string
+}
+
+func (it sqlItem) label() string {
+	if it.Alias != "" { return it.Alias }
+	if it.Agg != "" { return it.Agg + "(" + it.Col + ")" }
+	return it.Col
+}
+
+type sqlOrder struct {
+	Key  string
+	Desc bool
+}
+
+type sqlQuery struct {
+	Items   []sqlItem
+	Where   sqlExpr
+	GroupBy []string
+	OrderBy []sqlOrder
+	Limit   int // -1 when absent
+}
+
+type sqlExpr interface{ eval(s Sale) bool }
+
+type sqlAnd struct{ l, r sqlExpr }
+type sqlOr struct{ l, r sqlExpr }
+type sqlNot struct{ e sqlExpr }
+type sqlCmp struct {
+	Col, Op string
+	Val     string
+	like    *regexp.Regexp
+}
+
+func (e sqlAnd) eval(s Sale) bool { return e.l.eval(s) && e.r.eval(s) }
+func (e sqlOr) eval(s Sale) bool  { return e.l.eval(s) || e.r.eval(s) }
+func (e sqlNot) eval(s Sale) bool { return !e.e.eval(s) }
+
+func (e sqlCmp) eval(s Sale) bool {
+	v := saleColumn(s, e.Col)
+	if e.Op == "like" { return e.like.MatchString(fmt.Sprint(v)) }
+	var c int
+	if f, ok := v.(float64); ok {
+		lit, err := strconv.ParseFloat(e.Val, 64)
+		if err != nil { return false }
+		c = compareFloat(f, lit)
+	} else {
+		c = strings.Compare(fmt.Sprint(v), e.Val)
+	}
+	switch e.Op {
+	case "=":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func compareFloat(a, b float64) int {
+	if a < b { return -1 }
+	if a > b { return 1 }
+	return 0
+}
+
+// sqlTokens splits a query into identifiers, numbers, 'strings' and operators.
+func sqlTokens(q string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(q); j++ {
+				if q[j] == '\'' {
+					if j+1 < len(q) && q[j+1] == '\'' { sb.WriteByte('\''); j++; continue }
+					break
+				}
+				sb.WriteByte(q[j])
+			}
+			if j >= len(q) { return nil, fmt.Errorf("unterminated string") }
+			toks = append(toks, "'"+sb.String())
+			i = j + 1
+		case strings.ContainsRune("(),*;", rune(c)):
+			toks = append(toks, string(c))
+			i++
+		case strings.ContainsRune("=<>!", rune(c)):
+			j := i + 1
+			if j < len(q) && strings.ContainsRune("=>", rune(q[j])) { j++ }
+			toks = append(toks, q[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(q) && !strings.ContainsRune(" \t\n\r'(),*;=<>!", rune(q[j])) { j++ }
+			toks = append(toks, q[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// sqlUnsupported maps SQL keywords the language doesn't have to what to say about them.
+var sqlUnsupported = map[string]string{
+	"join": "JOIN", "inner": "JOIN", "outer": "JOIN", "cross": "JOIN", "natural": "JOIN", "using": "JOIN",
+	"union": "UNION", "intersect": "INTERSECT", "except": "EXCEPT",
+	"having": "HAVING", "distinct": "DISTINCT", "with": "WITH", "exists": "EXISTS",
+	"in": "IN", "between": "BETWEEN", "is": "IS [NOT] NULL", "case": "CASE", "offset": "OFFSET",
+	"over": "window functions", "partition": "window functions",
+}
+
+// checkSupported fails on the first SQL in toks that the language leaves out, naming it.
+// A word right after a comparison is an unquoted value, not a keyword.
+func checkSupported(toks []string) error {
+	for i, tok := range toks {
+		t := strings.ToLower(tok)
+		if t == "(" && i+1 < len(toks) && strings.EqualFold(toks[i+1], "select") { return fmt.Errorf("subqueries are not supported") }
+		if i > 0 {
+			switch strings.ToLower(toks[i-1]) {
+			case "=", "!=", "<>", "<", "<=", ">", ">=", "like":
+				continue
+			}
+		}
+		if strings.HasPrefix(t, "'") { continue }
+		if what, ok := sqlUnsupported[t]; ok { return fmt.Errorf("%s is not supported (see the query language in the README)", what) }
+		if t == ";" && i < len(toks)-1 { return fmt.Errorf("only one statement is allowed") }
+		if i+1 < len(toks) && toks[i+1] == "(" && t[0] >= 'a' && t[0] <= 'z' {
+			switch t {
+			case "count", "sum", "avg", "min", "max", "where", "and", "or", "not":
+			default:
+				return fmt.Errorf("function %s() is not supported: only COUNT, SUM, AVG, MIN and MAX", strings.ToUpper(tok))
+			}
+		}
+	}
+	return nil
+}
+
+type sqlParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *sqlParser) peek() string {
+	if p.pos < len(p.toks) { return strings.ToLower(p.toks[p.pos]) }
+	return ""
+}
+
+func (p *sqlParser) next() string {
+	t := ""
+	if p.pos < len(p.toks) { t = p.toks[p.pos] }
+	p.pos++
+	return t
+}
+
+func (p *sqlParser) expect(kw string) error {
+	if p.peek() != kw { return fmt.Errorf("expected %q near %q", strings.ToUpper(kw), p.peek()) }
+	p.pos++
+	return nil
+}
+
+func (p *sqlParser) column() (string, error) {
+	c := strings.ToLower(p.next())
+	for _, known := range sqlColumns {
+		if c == known { return c, nil }
+	}
+	return "", fmt.Errorf("unknown column %q (have %s)", c, strings.Join(sqlColumns, ", "))
+}
+
+func parseSQL(q string) (*sqlQuery, error) {
+	toks, err := sqlTokens(q)
+	if err != nil { return nil, err }
+	for len(toks) > 0 && toks[len(toks)-1] == ";" { toks = toks[:len(toks)-1] }
+	p := &sqlParser{toks: toks}
+	if err := p.expect("select"); err != nil {
+		return nil, fmt.Errorf("only read-only SELECT queries are allowed")
+	}
+	if err := checkSupported(toks); err != nil { return nil, err }
+	out := &sqlQuery{Limit: -1}
+	for {
+		var it sqlItem
+		switch t := p.peek(); t {
+		case "*":
+			p.next()
+			for _, c := range sqlColumns { out.Items = append(out.Items, sqlItem{Col: c}) }
+		case "count", "sum", "avg", "min", "max":
+			p.next()
+			it.Agg = t
+			if err := p.expect("("); err != nil { return nil, err }
+			if p.peek() == "*" && t == "count" {
+				p.next()
+				it.Col = "*"
+			} else if it.Col, err = p.column(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil { return nil, err }
+		default:
+			if it.Col, err = p.column(); err != nil { return nil, err }
+		}
+		if it.Col != "" {
+			if p.peek() == "as" {
+				p.next()
+				it.Alias = p.next()
+			}
+			out.Items = append(out.Items, it)
+		}
+		if p.peek() != "," { break }
+		p.next()
+	}
+	if err := p.expect("from"); err != nil { return nil, err }
+	if t := p.peek(); t != "sales" { return nil, fmt.Errorf("unknown table %q (only \"sales\")", t) }
+	p.next()
+	if p.peek() == "," { return nil, fmt.Errorf("only the sales table can be queried") }
+	if p.peek() == "where" {
+		p.next()
+		if out.Where, err = p.orExpr(); err != nil { return nil, err }
+	}
+	if p.peek() == "group" {
+		p.next()
+		if err := p.expect("by"); err != nil { return nil, err }
+		for {
+			c, err := p.column()
+			if err != nil { return nil, err }
+			out.GroupBy = append(out.GroupBy, c)
+			if p.peek() != "," { break }
+			p.next()
+		}
+	}
+	if p.peek() == "order" {
+		p.next()
+		if err := p.expect("by"); err != nil { return nil, err }
+		for {
+			key := strings.ToLower(p.next())
+			if key == "count" || key == "sum" || key == "avg" || key == "min" || key == "max" {
+				key += p.next() + strings.ToLower(p.next()) + p.next() // agg ( col )
+			}
+			o := sqlOrder{Key: key}
+			if t := p.peek(); t == "asc" || t == "desc" {
+				o.Desc = t == "desc"
+				p.next()
+			}
+			out.OrderBy = append(out.OrderBy, o)
+			if p.peek() != "," { break }
+			p.next()
+		}
+	}
+	if p.peek() == "limit" {
+		p.next()
+		n, err := strconv.Atoi(p.next())
+		if err != nil || n < 0 { return nil, fmt.Errorf("invalid LIMIT") }
+		out.Limit = n
+	}
+	if p.pos < len(p.toks) { return nil, fmt.Errorf("unexpected %q", p.toks[p.pos]) }
+	return out, nil
+}
+
+func (p *sqlParser) orExpr() (sqlExpr, error) {
+	l, err := p.andExpr()
+	if err != nil { return nil, err }
+	for p.peek() == "or" {
+		p.next()
+		r, err := p.andExpr()
+		if err != nil { return nil, err }
+		l = sqlOr{l, r}
+	}
+	return l, nil
+}
+
+func (p *sqlParser) andExpr() (sqlExpr, error) {
+	l, err := p.unary()
+	if err != nil { return nil, err }
+	for p.peek() == "and" {
+		p.next()
+		r, err := p.unary()
+		if err != nil { return nil, err }
+		l = sqlAnd{l, r}
+	}
+	return l, nil
+}
+
+func (p *sqlParser) unary() (sqlExpr, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		e, err := p.unary()
+		if err != nil { return nil, err }
+		return sqlNot{e}, nil
+	case "(":
+		p.next()
+		e, err := p.orExpr()
+		if err != nil { return nil, err }
+		return e, p.expect(")")
+	}
+	col, err := p.column()
+	if err != nil { return nil, err }
+	op := p.peek()
+	switch op {
+	case "=", "!=", "<>", "<", "<=", ">", ">=", "like":
+		p.next()
+	default:
+		return nil, fmt.Errorf("expected comparison after %q", col)
+	}
+	lit := p.next()
+	if lit == "" { return nil, fmt.Errorf("missing value after %s", op) }
+	c := sqlCmp{Col: col, Op: op, Val: strings.TrimPrefix(lit, "'")}
+	if op == "like" {
+		pat := regexp.QuoteMeta(c.Val)
+		pat = strings.NewReplacer("%", ".*", "_", ".").Replace(pat)
+		c.like = regexp.MustCompile("(?is)^" + pat + "$")
+	}
+	return c, nil
+}
+
+// parseFilter compiles a row filter. One that starts with a column, NOT or "(" is a WHERE
+// condition (amount > 500 AND status = 'overdue'); anything else is text that some
+// column of the row must contain, ignoring case.
+func parseFilter(q string) (sqlExpr, error) {
+	toks, err := sqlTokens(q)
+	if err != nil || len(toks) == 0 { return nil, err }
+	first := strings.ToLower(toks[0])
+	cond := first == "not" || first == "("
+	for _, c := range sqlColumns {
+		if first == c { cond = true }
+	}
+	if !cond { return sqlText{strings.ToLower(strings.TrimSpace(q))}, nil }
+	if err := checkSupported(toks); err != nil { return nil, err }
+	p := &sqlParser{toks: toks}
+	e, err := p.orExpr()
+	if err != nil { return nil, err }
+	if p.pos < len(toks) { return nil, fmt.Errorf("unexpected %q", toks[p.pos]) }
+	return e, nil
+}
+
+// sqlText matches rows with the text in any column.
+type sqlText struct{ text string }
+
+func (e sqlText) eval(s Sale) bool {
+	for _, col := range sqlColumns {
+		if strings.Contains(strings.ToLower(fmt.Sprint(saleColumn(s, col))), e.text) { return true }
+	}
+	return false
+}
+
+// runQuery executes a parsed query, honouring ctx cancellation and queryMaxRows.
+func runQuery(ctx context.Context, sales []Sale, q string, maxRows int) (*QueryResult, error) {
+	sq, err := parseSQL(q)
+	if err != nil { return nil, err }
+	if maxRows <= 0 || maxRows > queryMaxRows { maxRows = queryMaxRows }
+	res := &QueryResult{}
+	for _, it := range sq.Items { res.Columns = append(res.Columns, it.label()) }
+
+	grouped := len(sq.GroupBy) > 0
+	for _, it := range sq.Items {
+		if it.Agg != "" { grouped = true }
+	}
+	var rows [][]interface{}
+	if grouped {
+		inGroup := map[string]bool{}
+		for _, g := range sq.GroupBy { inGroup[g] = true }
+		for _, it := range sq.Items {
+			if it.Agg == "" && !inGroup[it.Col] {
+				return nil, fmt.Errorf("column %q must appear in GROUP BY or an aggregate", it.Col)
+			}
+		}
+		type acc struct{ sum, min, max float64; n int }
+		type group struct {
+			first Sale
+			accs  []acc
+		}
+		groups := map[string]*group{}
+		var order []string
+		for i, s := range sales {
+			if i%1024 == 0 && ctx.Err() != nil { return nil, ctx.Err() }
+			if sq.Where != nil && !sq.Where.eval(s) { continue }
+			var kb strings.Builder
+			for _, g := range sq.GroupBy { kb.WriteString(fmt.Sprint(saleColumn(s, g))); kb.WriteByte(0) }
+			key := kb.String()
+			gr, ok := groups[key]
+			if !ok {
+				gr = &group{first: s, accs: make([]acc, len(sq.Items))}
+				groups[key] = gr
+				order = append(order, key)
+			}
+			for j, it := range sq.Items {
+				if it.Agg == "" { continue }
+				a := &gr.accs[j]
+				v := 1.0
+				if it.Col != "*" {
+					f, isNum := saleColumn(s, it.Col).(float64)
+					if !isNum && it.Agg != "count" { return nil, fmt.Errorf("%s(%s): column is not numeric", it.Agg, it.Col) }
+					v = f
+				}
+				if a.n == 0 || v < a.min { a.min = v }
+				if a.n == 0 || v > a.max { a.max = v }
+				a.sum += v
+				a.n++
+			}
+		}
+		for _, key := range order {
+			gr := groups[key]
+			row := make([]interface{}, len(sq.Items))
+			for j, it := range sq.Items {
+				a := gr.accs[j]
+				switch it.Agg {
+				case "":
+					row[j] = saleColumn(gr.first, it.Col)
+				case "count":
+					row[j] = a.n
+				case "sum":
+					row[j] = a.sum
+				case "avg":
+					row[j] = a.sum / float64(max(1, a.n))
+				case "min":
+					row[j] = a.min
+				case "max":
+					row[j] = a.max
+				}
+			}
+			rows = append(rows, row)
+		}
+	} else {
+		for i, s := range sales {
+			if i%1024 == 0 && ctx.Err() != nil { return nil, ctx.Err() }
+			if sq.Where != nil && !sq.Where.eval(s) { continue }
+			row := make([]interface{}, len(sq.Items))
+			for j, it := range sq.Items { row[j] = saleColumn(s, it.Col) }
+			rows = append(rows, row)
+		}
+	}
+
+	for o := len(sq.OrderBy) - 1; o >= 0; o-- {
+		ob := sq.OrderBy[o]
+		idx := -1
+		for j, it := range sq.Items {
+			if strings.EqualFold(it.label(), ob.Key) || (it.Alias == "" && it.Agg == "" && it.Col == ob.Key) { idx = j }
+		}
+		if idx < 0 { return nil, fmt.Errorf("ORDER BY %q must name a selected column", ob.Key) }
+		sort.SliceStable(rows, func(a, b int) bool {
+			x, y := rows[a][idx], rows[b][idx]
+			if ob.Desc { x, y = y, x }
+			return lessValue(toFloatIfNum(x), toFloatIfNum(y))
+		})
+	}
+	if sq.Limit >= 0 && sq.Limit < len(rows) { rows = rows[:sq.Limit] }
+	if len(rows) > maxRows {
+		rows = rows[:maxRows]
+		res.Truncated = true
+	}
+	res.Rows = rows
+	if res.Rows == nil { res.Rows = [][]interface{}{} }
+	return res, nil
+}
+
+func toFloatIfNum(v interface{}) interface{} {
+	if n, ok := v.(int); ok { return float64(n) }
+	return v
+}
+
+// handleQuery runs ?q= (GET) or {"sql": "..."} (POST) against the latest dataset.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no data yet", 404); return
+	}
+	q := r.URL.Query().Get("q")
+	if r.Method == http.MethodPost {
+		var body struct {
+			SQL   string `json:"sql"`
+			Limit int    `json:"limit"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", 400); return
+		}
+		q = body.SQL
+	}
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "missing query", 400); return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	res, err := runQuery(ctx, a.Sales, q, limit)
+	if err != nil {
+		status := 400
+		if errors.Is(err, context.DeadlineExceeded) { status = http.StatusGatewayTimeout }
+		http.Error(w, "query: "+err.Error(), status); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// runQueryCLI implements `bizpulse query -file=data.csv "SELECT ..."`, printing tab-separated rows.
+func runQueryCLI(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	file := fs.String("file", "", "CSV or .xlsx file to query")
+	sheet := fs.String("sheet", "", "Worksheet name or 1-based index for .xlsx input")
+	limit := fs.Int("limit", queryMaxRows, "Maximum rows to print")
+	fs.Parse(args)
+	if *file == "" || fs.NArg() == 0 {
+		return fmt.Errorf(`usage: query -file=data.csv "SELECT ... FROM sales"`)
+	}
+	f, err := os.Open(*file)
+	if err != nil { return err }
+	defer f.Close()
+	sales, _, err := parseSalesFile(ctx, f, *file, *sheet)
+	if err != nil { return err }
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	res, err := runQuery(ctx, sales, strings.Join(fs.Args(), " "), *limit)
+	if err != nil { return err }
+	fmt.Println(strings.Join(res.Columns, "\t"))
+	for _, row := range res.Rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			if f, ok := v.(float64); ok {
+				cells[i] = strconv.FormatFloat(f, 'f', -1, 64)
+			} else {
+				cells[i] = fmt.Sprint(v)
+			}
+		}
+		fmt.Println(strings.Join(cells, "\t"))
+	}
+	if res.Truncated { fmt.Fprintf(os.Stderr, "(truncated to %d rows)\n", len(res.Rows)) }
+	return nil
+}
+
+// -------- Cubes --------
+
+// Slicing the KPIs by date range, product or customer tier (GET /api/v1/slice) would mean
+// rescanning every row per request. Instead each publish builds a cube: revenue, refunds,
+// orders and overdue totals per day × product × tier, where a customer's tier is the one
+// they held in the month of the sale. Slices on those dimensions are summed from the
+// cube's cells; a customer or row filter falls back to scanning the rows.
+type cubeCell struct {
+	Day           time.Time
+	Product, Tier string
+	Revenue       float64 // net of refunds
+	Refunds       float64 // as a positive amount
+	Orders        int
+	Overdue       int
+	OverdueTotal  float64
+}
+
+// Cube holds the cells sorted by day, so a date range is a contiguous run.
+type Cube struct {
+	cells []cubeCell
+	tiers map[string]map[string]string // month -> customer -> tier
+}
+
+// monthlyTiers is each customer's tier per calendar month, as tierReport assigns them.
+func monthlyTiers(sales []Sale) map[string]map[string]string {
+	byMonth := map[string]map[string]float64{}
+	for _, s := range sales {
+		m := s.Date.Format("2006-01")
+		if byMonth[m] == nil { byMonth[m] = map[string]float64{} }
+		byMonth[m][s.Customer] += s.Amount
+	}
+	out := map[string]map[string]string{}
+	for m, rev := range byMonth {
+		out[m] = map[string]string{}
+		for c, ct := range assignTiers(rev) { out[m][c] = ct.Tier }
+	}
+	return out
+}
+
+func (c *Cube) tierOf(s Sale) string { return c.tiers[s.Date.Format("2006-01")][s.Customer] }
+
+// cellOf is the contribution of one row.
+func (c *Cube) cellOf(s Sale) cubeCell {
+	cell := cubeCell{Day: s.Date, Product: s.Product, Tier: c.tierOf(s), Revenue: s.Amount, Orders: 1}
+	if isRefund(s) { cell.Orders, cell.Refunds = 0, -s.Amount }
+	if isOverdue(s.Status) {
+		cell.Overdue = 1
+		cell.OverdueTotal = s.Amount
+	}
+	return cell
+}
+
+func buildCube(sales []Sale) *Cube {
+	c := &Cube{tiers: monthlyTiers(sales)}
+	type key struct {
+		day           string
+		product, tier string
+	}
+	idx := map[key]int{}
+	for _, s := range sales {
+		cell := c.cellOf(s)
+		k := key{s.Date.Format("2006-01-02"), cell.Product, cell.Tier}
+		i, ok := idx[k]
+		if !ok {
+			idx[k] = len(c.cells)
+			c.cells = append(c.cells, cell)
+			continue
+		}
+		p := &c.cells[i]
+		p.Revenue += cell.Revenue
+		p.Refunds += cell.Refunds
+		p.Orders += cell.Orders
+		p.Overdue += cell.Overdue
+		p.OverdueTotal += cell.OverdueTotal
+	}
+	sort.Slice(c.cells, func(i, j int) bool {
+		a, b := c.cells[i], c.cells[j]
+		if !a.Day.Equal(b.Day) { return a.Day.Before(b.Day) }
+		if a.Product != b.Product { return a.Product < b.Product }
+		return a.Tier < b.Tier
+	})
+	return c
+}
+
+// SliceFilter selects part of the dataset; zero values match everything.
+type SliceFilter struct {
+	From, To time.Time
+	Product  string
+	Tier     string
+	Customer string
+	Rows     sqlExpr // a /api/v1/rows-style filter
+}
+
+// cubed reports whether the cube can answer f.
+func (f SliceFilter) cubed() bool { return f.Customer == "" && f.Rows == nil }
+
+func (f SliceFilter) match(cell cubeCell) bool {
+	if !f.From.IsZero() && cell.Day.Before(f.From) { return false }
+	if !f.To.IsZero() && cell.Day.After(f.To) { return false }
+	if f.Product != "" && !strings.EqualFold(cell.Product, f.Product) { return false }
+	if f.Tier != "" && !strings.EqualFold(cell.Tier, f.Tier) { return false }
+	return true
+}
+
+// Slice is the KPIs of a filtered part of the dataset. Source is cube or rows.
+type Slice struct {
+	Source        string
+	From, To      time.Time
+	Revenue       float64
+	Refunds       float64
+	Orders        int
+	AvgOrderValue float64
+	OverdueCount  int
+	OverdueTotal  float64
+	ByTier        []KVf
+	TopProducts   []KVf
+	Series        []KVt
+}
+
+type sliceAcc struct {
+	s         Slice
+	daily     map[time.Time]float64
+	byTier    map[string]float64
+	byProduct map[string]float64
+}
+
+func (a *sliceAcc) add(c cubeCell) {
+	if a.s.Orders == 0 || c.Day.Before(a.s.From) { a.s.From = c.Day }
+	if c.Day.After(a.s.To) { a.s.To = c.Day }
+	a.s.Revenue += c.Revenue
+	a.s.Refunds += c.Refunds
+	a.s.Orders += c.Orders
+	a.s.OverdueCount += c.Overdue
+	a.s.OverdueTotal += c.OverdueTotal
+	a.daily[c.Day] += c.Revenue
+	a.byTier[c.Tier] += c.Revenue
+	a.byProduct[c.Product] += c.Revenue
+}
+
+// slice answers f from the cube when it can and from the rows otherwise, returning the
+// series at granularity (day, week or month).
+func (c *Cube) slice(ctx context.Context, sales []Sale, f SliceFilter, granularity string) (*Slice, error) {
+	acc := &sliceAcc{daily: map[time.Time]float64{}, byTier: map[string]float64{}, byProduct: map[string]float64{}}
+	if f.cubed() {
+		acc.s.Source = "cube"
+		i := 0
+		if !f.From.IsZero() { i = sort.Search(len(c.cells), func(i int) bool { return !c.cells[i].Day.Before(f.From) }) }
+		for ; i < len(c.cells); i++ {
+			cell := c.cells[i]
+			if !f.To.IsZero() && cell.Day.After(f.To) { break }
+			if f.match(cell) { acc.add(cell) }
+		}
+	} else {
+		acc.s.Source = "rows"
+		for i, s := range sales {
+			if i%1024 == 0 && ctx.Err() != nil { return nil, ctx.Err() }
+			if f.Customer != "" && !strings.EqualFold(s.Customer, f.Customer) && !strings.EqualFold(accountOf(s.Customer), f.Customer) { continue }
+			if f.Rows != nil && !f.Rows.eval(s) { continue }
+			if cell := c.cellOf(s); f.match(cell) { acc.add(cell) }
+		}
+	}
+	res := acc.s
+	if res.Orders > 0 { res.AvgOrderValue = res.Revenue / float64(res.Orders) }
+	for t, v := range acc.byTier { res.ByTier = append(res.ByTier, KVf{t, v}) }
+	sort.Slice(res.ByTier, func(i, j int) bool { return tierRank(res.ByTier[i].Key) < tierRank(res.ByTier[j].Key) })
+	res.TopProducts = topN(acc.byProduct, topListSize)
+	var daily []KVt
+	for d, v := range acc.daily { daily = append(daily, KVt{d, v}) }
+	sort.Slice(daily, func(i, j int) bool { return daily[i].Day.Before(daily[j].Day) })
+	if granularity == "" || granularity == "day" {
+		res.Series = daily
+	} else {
+		res.Series = rollupSeries(daily, granularity)
+	}
+	return &res, nil
+}
+
+// handleSlice returns KPIs for ?from=&to=&product=&tier=, plus optional customer= and
+// filter= that are answered from the rows.
+func handleSlice(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	q := r.URL.Query()
+	f := SliceFilter{Product: q.Get("product"), Tier: q.Get("tier"), Customer: q.Get("customer")}
+	var err error
+	if f.From, f.To, err = dateRange(q); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	if f.Tier != "" {
+		known := false
+		for _, t := range tierCutoffs { known = known || strings.EqualFold(t.Name, f.Tier) }
+		if !known {
+			http.Error(w, "tier must be Platinum, Gold, Silver or Bronze", 400); return
+		}
+	}
+	g := q.Get("granularity")
+	if g != "" && g != "day" && g != "week" && g != "month" {
+		http.Error(w, "granularity must be day, week or month", 400); return
+	}
+	if f.Rows, err = parseFilter(q.Get("filter")); err != nil {
+		http.Error(w, "filter: "+err.Error(), 400); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	c := a.cube
+	if c == nil { c = buildCube(a.Sales) }
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	res, err := c.slice(ctx, a.Sales, f, g)
+	if err != nil {
+		http.Error(w, "slice: "+err.Error(), http.StatusGatewayTimeout); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// -------- Storage --------
+
+// Store persists ingested sales so restarts keep data and uploads can append to history.
+// Backends are chosen with -store:
+//
+//   file:bizpulse.jsonl  append-only JSON lines (default)
+//   sqlite:bizpulse.db   SQLite via database/sql; needs a driver registered as "sqlite" or
+//                        "sqlite3" compiled into the binary, which this build doesn't import
+//   memory               nothing persisted
+//
+// Asking for SQLite without a driver is an error rather than a quiet switch to another
+// backend, so data never ends up somewhere the operator didn't choose.
+type Store interface {
+	Load() ([]Sale, error)
+	Append(sales []Sale) error
+	Replace(sales []Sale) error
+	Close() error
+}
+
+var store Store = &memStore{}
+
+func openStore(spec string) (Store, error) {
+	kind, path, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "memory", "":
+		return &memStore{}, nil
+	case "file":
+		return &fileStore{path: nz(path, "bizpulse.jsonl")}, nil
+	case "sqlite":
+		path = nz(path, "bizpulse.db")
+		for _, d := range sql.Drivers() {
+			if d == "sqlite" || d == "sqlite3" { return openSQLStore(d, path) }
+		}
+		return nil, fmt.Errorf("store %q: no SQLite driver compiled in; use -store file:bizpulse.jsonl or build with one (e.g. import _ \"modernc.org/sqlite\")", spec)
+	}
+	return nil, fmt.Errorf("unknown store %q (want sqlite:path, file:path or memory)", spec)
+}
+
+type memStore struct{ sales []Sale }
+
+func (m *memStore) Load() ([]Sale, error) { return append([]Sale(nil), m.sales...), nil }
+func (m *memStore) Append(s []Sale) error { m.sales = append(m.sales, s...); return nil }
+func (m *memStore) Replace(s []Sale) error { m.sales = append([]Sale(nil), s...); return nil }
+func (m *memStore) Close() error { return nil }
+
+type fileStore struct{ path string }
+
+func (f *fileStore) Load() ([]Sale, error) {
+	fh, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) { return nil, nil }
+	if err != nil { return nil, err }
+	defer fh.Close()
+	var out []Sale
+	dec := json.NewDecoder(fh)
+	for {
+		var s Sale
+		if err := dec.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("store %s: %w", f.path, err)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (f *fileStore) Append(sales []Sale) error {
+	fh, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil { return err }
+	enc := json.NewEncoder(fh)
+	for _, s := range sales {
+		if err := enc.Encode(s); err != nil { fh.Close(); return err }
+	}
+	return fh.Close()
+}
+
+func (f *fileStore) Replace(sales []Sale) error {
+	tmp := f.path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) { return err }
+	if err := (&fileStore{path: tmp}).Append(sales); err != nil { return err }
+	return os.Rename(tmp, f.path)
+}
+
+func (f *fileStore) Close() error { return nil }
+
+type sqlStore struct{ db *sql.DB }
+
+func openSQLStore(driver, dsn string) (Store, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil { return nil, err }
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sales (
+		date TEXT NOT NULL, customer TEXT, raw_customer TEXT, product TEXT, amount REAL,
+		status TEXT, rep TEXT, region TEXT, campaign TEXT, invoice TEXT, currency TEXT, orig_amount REAL, due TEXT,
+		tax REAL, discount REAL, quantity REAL, category TEXT, channel TEXT, email TEXT, country TEXT)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store schema: %w", err)
+	}
+	// columns added after the first schema; each fails harmlessly when it already exists
+	for _, col := range []string{"invoice TEXT", "currency TEXT", "orig_amount REAL", "due TEXT", "tax REAL", "discount REAL", "quantity REAL", "category TEXT", "channel TEXT", "email TEXT", "country TEXT"} {
+		db.Exec(`ALTER TABLE sales ADD COLUMN ` + col)
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) Load() ([]Sale, error) {
+	rows, err := s.db.Query(`SELECT date, customer, raw_customer, product, amount, status, rep, region, campaign, COALESCE(invoice, ''), COALESCE(currency, ''), COALESCE(orig_amount, amount), COALESCE(due, ''),
+		COALESCE(tax, 0), COALESCE(discount, 0), COALESCE(quantity, 0), COALESCE(category, ''), COALESCE(channel, ''), COALESCE(email, ''), COALESCE(country, '') FROM sales ORDER BY rowid`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []Sale
+	for rows.Next() {
+		var x Sale
+		var d, due string
+		if err := rows.Scan(&d, &x.Customer, &x.RawCustomer, &x.Product, &x.Amount, &x.Status, &x.Rep, &x.Region, &x.Campaign, &x.Invoice, &x.Currency, &x.OrigAmount, &due, &x.Tax, &x.Discount, &x.Quantity, &x.Category, &x.Channel, &x.Email, &x.Country); err != nil {
+			return nil, err
+		}
+		x.Date, _ = time.Parse("2006-01-02", d)
+		x.Due, _ = time.Parse("2006-01-02", due)
+		out = append(out, x)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) Append(sales []Sale) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	if err := insertSales(tx, sales); err != nil { tx.Rollback(); return err }
+	return tx.Commit()
+}
+
+func (s *sqlStore) Replace(sales []Sale) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM sales`); err != nil { tx.Rollback(); return err }
+	if err := insertSales(tx, sales); err != nil { tx.Rollback(); return err }
+	return tx.Commit()
+}
+
+func insertSales(tx *sql.Tx, sales []Sale) error {
+	st, err := tx.Prepare(`INSERT INTO sales (date, customer, raw_customer, product, amount, status, rep, region, campaign, invoice, currency, orig_amount, due, tax, discount, quantity, category, channel, email, country) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil { return err }
+	defer st.Close()
+	for _, x := range sales {
+		if _, err := st.Exec(x.Date.Format("2006-01-02"), x.Customer, x.RawCustomer, x.Product, x.Amount, x.Status, x.Rep, x.Region, x.Campaign, x.Invoice, x.Currency, x.OrigAmount, saleColumn(x, "due"), x.Tax, x.Discount, x.Quantity, x.Category, x.Channel, x.Email, x.Country); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error { return s.db.Close() }
+
+// restoreFromStore recomputes a's KPIs from stored history at startup (no alerts are sent).
+func restoreFromStore(a *Analysis) error {
+	sales, err := a.storage().Load()
+	if err != nil || len(sales) == 0 { return err }
+	applyAliases(sales)
+	k, err := analyze(context.Background(), a.Dataset, sales, nil, nil)
+	if err != nil { return err }
+	if a == shared {
+		k.ForecastTracking = trackForecasts(k.DailyRevenue, k.To, false)
+		if k.Receivables != nil { k.Receivables.Drift = agingDrift(k.Receivables) }
+	}
+	a.set(k, sales, nil, nil)
+	log.Printf("store: restored %d rows (%s)", len(sales), a.Dataset)
+	return nil
+}
+
+// -------- Merge --------
+
+// MergeResult summarizes a merge-mode ingest: rows added vs skipped as duplicates.
+type MergeResult struct {
+	Files   int
+	Added   int
+	Skipped int
+	When    time.Time
+}
+
+// saleKey identifies a row for dedup: date, customer, product, amount and invoice id.
+func saleKey(s Sale) string {
+	return strings.Join([]string{s.Date.Format("2006-01-02"), s.Customer, s.Product,
+		strconv.FormatFloat(s.Amount, 'f', 2, 64), s.Invoice}, "\x1f")
+}
+
+// mergeSales appends the incoming rows that aren't already in existing. Keys are counted,
+// so a row a file legitimately repeats is kept as often as it appears beyond what is stored.
+func mergeSales(existing, incoming []Sale) (merged, added []Sale, skipped int) {
+	have := map[string]int{}
+	for _, s := range existing { have[saleKey(s)]++ }
+	seen := map[string]int{}
+	for _, s := range incoming {
+		k := saleKey(s)
+		seen[k]++
+		if seen[k] <= have[k] { skipped++; continue }
+		added = append(added, s)
+	}
+	merged = append(append([]Sale(nil), existing...), added...)
+	return merged, added, skipped
+}
+
+// -------- JSON ingest --------
+
+// IngestResult is the response of POST /api/ingest.
+type IngestResult struct {
+	Mode     string
+	Received int // records in the request
+	Dropped  int // records without a usable date
+	Added    int
+	Skipped  int // duplicates (merge mode)
+	Replaced int // rows superseded by a newer version of their order (Shopify sync)
+	Snapshot string
+	Quality  *DataQuality `json:",omitempty"` // what the parse made of the records; nil for API syncs
+}
+
+// jsonRecords turns a JSON array or newline-delimited stream of objects into CSV-style
+// records, header row first, so they map through the same flexible headers as files.
+// Keys keep their document order, since header matching is left to right.
+func jsonRecords(r io.Reader) ([][]string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+	b = bytes.TrimSpace(b)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	isArray := len(b) > 0 && b[0] == '['
+	if isArray {
+		if _, err := dec.Token(); err != nil { return nil, err }
+	}
+	var header []string
+	col := map[string]int{}
+	var rows []map[string]string
+	for dec.More() {
+		keys, vals, err := readObject(dec)
+		if err != nil { return nil, &RowError{Row: len(rows) + 1, Err: err} }
+		for _, k := range keys {
+			if _, ok := col[k]; !ok {
+				col[k] = len(header)
+				header = append(header, k)
+			}
+		}
+		rows = append(rows, vals)
+	}
+	if isArray {
+		if _, err := dec.Token(); err != nil { return nil, err }
+	}
+	records := [][]string{header}
+	for _, vals := range rows {
+		rec := make([]string, len(header))
+		for k, v := range vals { rec[col[k]] = v }
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// readObject decodes one JSON object, returning its keys in order and scalar values as text.
+func readObject(dec *json.Decoder) ([]string, map[string]string, error) {
+	t, err := dec.Token()
+	if err != nil { return nil, nil, err }
+	if d, ok := t.(json.Delim); !ok || d != '{' {
+		return nil, nil, fmt.Errorf("expected an object")
+	}
+	var keys []string
+	vals := map[string]string{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil { return nil, nil, err }
+		key, _ := t.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil { return nil, nil, err }
+		var s string
+		switch {
+		case string(raw) == "null":
+		case json.Unmarshal(raw, &s) == nil:
+		default:
+			s = string(raw) // numbers and booleans as written
+		}
+		keys = append(keys, key)
+		vals[key] = s
+	}
+	_, err = dec.Token() // closing brace
+	return keys, vals, err
+}
+
+// handleIngest accepts sale records pushed as JSON (POST /api/ingest?mode=replace|append|merge).
+// It writes to the shared analysis, or to the workspace named by ?dataset= (created on
+// first use); ?ai=1 requests an AI summary.
+func handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	a, err := workspace(r.URL.Query().Get("dataset"), true)
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	records, err := jsonRecords(io.LimitReader(r.Body, 50<<20))
+	if err != nil {
+		httpError(w, "invalid JSON: ", err, 400); return
+	}
+	sales, quality, err := parseRows(records, nil, 1)
+	if err != nil {
+		httpError(w, "parse: ", err, 400); return
+	}
+	quality.File = "request body"
+	res := IngestResult{Mode: nz(r.URL.Query().Get("mode"), "replace"), Received: len(records) - 1, Quality: quality}
+	res.Dropped = res.Received - len(sales)
+	if !validIngestMode(res.Mode) {
+		http.Error(w, "mode must be replace, append or merge", 400); return
+	}
+	if len(sales) == 0 {
+		httpError(w, "", errNoDatedRows, 400); return
+	}
+	if err := ingestInto(r.Context(), a, sales, &res, r.URL.Query().Get("ai") != ""); err != nil {
+		httpError(w, "", err, 500); return
+	}
+	a.update(func(a *Analysis) { a.Columns, a.Quality = quality.Columns, []*DataQuality{quality} })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func validIngestMode(mode string) bool { return mode == "replace" || mode == "append" || mode == "merge" }
+
+// ingestInto writes sales to a's store per res.Mode, republishes a and fills in
+// res.Added, res.Skipped and res.Snapshot. Nothing is stored if ctx ends first.
+func ingestInto(ctx context.Context, a *Analysis, sales []Sale, res *IngestResult, ai bool) error {
+	a.ingest.Lock()
+	defer a.ingest.Unlock()
+	cur := a.view()
+	var leads []Lead
+	var spend []CampaignSpend
+	var save func() error
+	switch res.Mode {
+	case "replace":
+		res.Added = len(sales)
+		rows := sales
+		save = func() error { return a.storage().Replace(rows) }
+	case "append":
+		res.Added = len(sales)
+		rows := sales
+		save = func() error { return a.storage().Append(rows) }
+		sales = append(append([]Sale(nil), cur.Sales...), sales...)
+		leads, spend = cur.Leads, cur.Spend
+	case "merge":
+		var added []Sale
+		sales, added, res.Skipped = mergeSales(cur.Sales, sales)
+		res.Added = len(added)
+		save = func() error { return a.storage().Append(added) }
+		leads, spend = cur.Leads, cur.Spend
+	}
+	if _, err := publishAnalysis(ctx, a, sales, leads, spend, ai, storeErr(save)); err != nil { return err }
+	res.Snapshot = a.view().Snapshot
+	return nil
+}
+
+// storeErr marks save's errors as the store's, so callers can tell them from a
+// cancelled analysis.
+func storeErr(save func() error) func() error {
+	return func() error {
+		if err := save(); err != nil { return fmt.Errorf("store: %w", err) }
+		return nil
+	}
+}
+
+// -------- URL ingest --------
+
+// FetchConfig controls ingest by URL (-url, POST /api/v1/ingest). Headers are sent only
+// to the host they're keyed by, with $VAR references expanded from the environment so
+// tokens stay out of the config: {"portal.example.com": {"Authorization": "Bearer ${PORTAL_TOKEN}"}}.
+type FetchConfig struct {
+	Headers   map[string]map[string]string `json:"headers"`
+	MaxMB     int64                        `json:"maxMB"`     // largest accepted file (default 50)
+	AllowHTTP bool                         `json:"allowHTTP"` // permit plain http:// URLs
+}
+
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://")
+}
+
+// fetchSalesFile downloads a CSV or xlsx file, returning its bytes and a file name for
+// format detection. Configured headers are dropped on redirects to another host.
+func fetchSalesFile(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil { return nil, "", fmt.Errorf("fetch: %w", err) }
+	allowed := func(u *url.URL) bool { return u.Scheme == "https" || u.Scheme == "http" && cfg.Fetch.AllowHTTP }
+	if !allowed(u) || u.Host == "" {
+		return nil, "", fmt.Errorf("fetch: %s is not an https URL", rawURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil { return nil, "", fmt.Errorf("fetch: %w", err) }
+	for k, v := range cfg.Fetch.Headers[strings.ToLower(u.Hostname())] { req.Header.Set(k, os.ExpandEnv(v)) }
+	client := &http.Client{Timeout: time.Minute, CheckRedirect: func(next *http.Request, via []*http.Request) error {
+		if len(via) >= 5 { return fmt.Errorf("too many redirects") }
+		if !allowed(next.URL) { return fmt.Errorf("redirect to %s is not https", next.URL.Redacted()) }
+		if !strings.EqualFold(next.URL.Hostname(), u.Hostname()) {
+			for k := range cfg.Fetch.Headers[strings.ToLower(u.Hostname())] { next.Header.Del(k) }
+		}
+		return nil
+	}}
+	resp, err := client.Do(req)
+	if err != nil { return nil, "", withKind(ErrUpstream, fmt.Errorf("fetch: %w", err)) }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", withKind(ErrUpstream, fmt.Errorf("fetch %s: %s", u.Redacted(), resp.Status))
+	}
+	limit := cfg.Fetch.MaxMB << 20
+	if limit <= 0 { limit = 50 << 20 }
+	if resp.ContentLength > limit {
+		return nil, "", fmt.Errorf("fetch %s: file is %d bytes, over the %d byte limit", u.Redacted(), resp.ContentLength, limit)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil { return nil, "", withKind(ErrUpstream, fmt.Errorf("fetch %s: %w", u.Redacted(), err)) }
+	if int64(len(b)) > limit {
+		return nil, "", fmt.Errorf("fetch %s: file is over the %d byte limit", u.Redacted(), limit)
+	}
+	name := path.Base(resp.Request.URL.Path)
+	if strings.Contains(resp.Header.Get("Content-Type"), "spreadsheetml") && !strings.HasSuffix(strings.ToLower(name), ".xlsx") {
+		name += ".xlsx"
+	}
+	return b, name, nil
+}
+
+// readSalesSource parses a local file, fetches it first when src is a URL, or pulls it
+// from the Stripe API for stripe: sources (which have no quality report).
+func readSalesSource(ctx context.Context, src, sheet string) ([]Sale, *DataQuality, error) {
+	if isStripeSource(src) {
+		sales, err := readStripeSource(ctx, src)
+		return sales, nil, err
+	}
+	if isURL(src) {
+		b, name, err := fetchSalesFile(ctx, src)
+		if err != nil { return nil, nil, err }
+		return parseSalesFile(ctx, bytes.NewReader(b), name, sheet)
+	}
+	f, err := os.Open(src)
+	if err != nil { return nil, nil, err }
+	defer f.Close()
+	return parseSalesFile(ctx, f, src, sheet)
+}
+
+// URLIngest is the body of POST /api/v1/ingest.
+type URLIngest struct {
+	URL   string `json:"url"`
+	Mode  string `json:"mode"`  // replace (default), append or merge
+	Sheet string `json:"sheet"` // xlsx worksheet name or 1-based index
+	AI    bool   `json:"ai"`
+	Dataset string `json:"dataset"` // workspace to ingest into (default: the shared analysis)
+}
+
+// handleURLIngest fetches a file by URL and ingests it into the shared analysis or a
+// workspace like POST /api/ingest does for JSON records.
+func handleURLIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	var req URLIngest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || req.URL == "" {
+		http.Error(w, `body must be {"url": "https://..."}`, 400); return
+	}
+	res := IngestResult{Mode: nz(req.Mode, "replace")}
+	if !validIngestMode(res.Mode) {
+		http.Error(w, "mode must be replace, append or merge", 400); return
+	}
+	a, err := workspace(req.Dataset, true)
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	b, name, err := fetchSalesFile(r.Context(), req.URL)
+	if err != nil {
+		httpError(w, "", err, http.StatusBadGateway); return
+	}
+	records, err := readRecords(bytes.NewReader(b), name, req.Sheet)
+	if err != nil {
+		httpError(w, "parse: ", err, 400); return
+	}
+	sales, quality, err := parseRecords(records, nil)
+	if err != nil {
+		httpError(w, "parse: ", err, 400); return
+	}
+	quality.File = name
+	res.Received = len(records) - 1
+	res.Dropped = res.Received - len(sales)
+	res.Quality = quality
+	if len(sales) == 0 {
+		httpError(w, "", errNoDatedRows, 400); return
+	}
+	if err := ingestInto(r.Context(), a, sales, &res, req.AI); err != nil {
+		httpError(w, "", err, 500); return
+	}
+	a.update(func(a *Analysis) { a.Columns, a.Quality = quality.Columns, []*DataQuality{quality} })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// -------- FTP/SFTP pull --------
+
+// PullConfig polls an FTP or SFTP drop for new sales files (server mode). Each file is
+// merged into the shared analysis, so rows already loaded are skipped, and is then moved
+// to Archive on the server, or remembered in the -pull-state file when Archive is empty.
+// SFTP runs the system OpenSSH sftp client in batch mode with Key; FTP uses Password
+// ($VARS are expanded from the environment).
+type PullConfig struct {
+	URL          string `json:"url"`          // sftp://user@host[:port]/dir or ftp://user@host[:port]/dir
+	Key          string `json:"key"`          // SSH private key file (sftp)
+	Password     string `json:"password"`     // ftp password
+	Glob         string `json:"glob"`         // remote file name pattern (default *.csv)
+	Every        string `json:"every"`        // poll cadence (default 1h)
+	Archive      string `json:"archive"`      // remote directory processed files are moved into
+	ArchiveLocal string `json:"archiveLocal"` // local directory that keeps a copy of each processed file
+}
+
+// dropClient is a remote directory of incoming files. The context it was dialed with
+// bounds every operation on it.
+type dropClient interface {
+	List() ([]string, error)
+	Get(name string) ([]byte, error)
+	Move(name, dir string) error
+	Close() error
+}
+
+var (
+	pullMu        sync.Mutex
+	pullStatePath string
+	pulled        = map[string]bool{} // source URL + "|" + file name, for drops without an archive
+)
+
+func loadPullState(path string) error {
+	pullStatePath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return err }
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil { return fmt.Errorf("pull state %s: %w", path, err) }
+	for _, n := range names { pulled[n] = true }
+	return nil
+}
+
+func savePullState() error {
+	if pullStatePath == "" { return nil }
+	var names []string
+	for n := range pulled { names = append(names, n) }
+	sort.Strings(names)
+	b, _ := json.MarshalIndent(names, "", "  ")
+	return os.WriteFile(pullStatePath, b, 0644)
+}
+
+func dialDrop(ctx context.Context, pc PullConfig) (dropClient, error) {
+	u, err := url.Parse(pc.URL)
+	if err != nil { return nil, err }
+	switch u.Scheme {
+	case "sftp":
+		return &sftpDrop{ctx: ctx, u: u, key: pc.Key}, nil
+	case "ftp":
+		return dialFTP(ctx, u, os.ExpandEnv(pc.Password))
+	}
+	return nil, fmt.Errorf("must be an sftp:// or ftp:// URL")
+}
+
+// pullOnce ingests the new files in one drop and returns how many it processed. A file
+// that fails to parse is left in place and logged, so the rest of the drop still loads.
+func pullOnce(ctx context.Context, pc PullConfig) (int, error) {
+	pullMu.Lock()
+	defer pullMu.Unlock()
+	c, err := dialDrop(ctx, pc)
+	if err != nil { return 0, fmt.Errorf("pull %s: %w", pc.URL, err) }
+	defer c.Close()
+	names, err := c.List()
+	if err != nil { return 0, fmt.Errorf("pull %s: list: %w", pc.URL, err) }
+	glob := nz(pc.Glob, "*.csv")
+	n := 0
+	for _, name := range names {
+		if ok, _ := path.Match(glob, name); !ok || pulled[pc.URL+"|"+name] { continue }
+		b, err := c.Get(name)
+		if err != nil { return n, fmt.Errorf("pull %s: get %s: %w", pc.URL, name, err) }
+		sales, q, err := parseSalesFile(ctx, bytes.NewReader(b), name, "")
+		if err == nil && len(sales) == 0 { err = fmt.Errorf("%w (%s)", errNoDatedRows, q.Summary()) }
+		if err != nil {
+			log.Printf("pull %s: skipping %s: %v", pc.URL, name, err)
+			continue
+		}
+		res := IngestResult{Mode: "merge", Quality: q}
+		if err := ingestInto(ctx, shared, sales, &res, false); err != nil { return n, fmt.Errorf("pull %s: %w", pc.URL, err) }
+		shared.update(func(a *Analysis) { a.Columns, a.Quality = q.Columns, []*DataQuality{q} })
+		log.Printf("pull %s: %s — %d rows added, %d duplicates skipped; %s", pc.URL, name, res.Added, res.Skipped, q.Summary())
+		n++
+		if pc.ArchiveLocal != "" {
+			if err := os.MkdirAll(pc.ArchiveLocal, 0755); err != nil { return n, err }
+			if err := os.WriteFile(filepath.Join(pc.ArchiveLocal, name), b, 0644); err != nil { return n, err }
+		}
+		if pc.Archive != "" {
+			if err := c.Move(name, pc.Archive); err != nil { return n, fmt.Errorf("pull %s: archive %s: %w", pc.URL, name, err) }
+			continue
+		}
+		pulled[pc.URL+"|"+name] = true
+		if err := savePullState(); err != nil { return n, err }
+	}
+	return n, nil
+}
+
+func monitorPull(ctx context.Context, pc PullConfig, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		if _, err := pullOnce(ctx, pc); err != nil { log.Printf("%v", err) }
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handlePull runs every configured pull now (POST /api/v1/pull).
+func handlePull(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	type result struct {
+		URL   string
+		Files int
+		Error string `json:",omitempty"`
+	}
+	var out []result
+	for _, pc := range cfg.Pull {
+		n, err := pullOnce(r.Context(), pc)
+		res := result{URL: redactURL(pc.URL), Files: n}
+		if err != nil { res.Error = err.Error() }
+		out = append(out, res)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// sftpDrop drives `sftp -b -` (OpenSSH) with one batch per operation.
+type sftpDrop struct {
+	ctx context.Context // kills a running sftp when it ends
+	u   *url.URL
+	key string
+}
+
+func (d *sftpDrop) run(cmds ...string) (string, error) {
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if d.key != "" { args = append(args, "-i", d.key) }
+	if p := d.u.Port(); p != "" { args = append(args, "-P", p) }
+	host := d.u.Hostname()
+	if d.u.User != nil { host = d.u.User.Username() + "@" + host }
+	cmd := exec.CommandContext(d.ctx, "sftp", append(args, host)...)
+	cmd.Stdin = strings.NewReader(strings.Join(cmds, "\n") + "\n")
+	var out, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("sftp: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.String(), nil
+}
+
+// sftpQuote quotes a path for an sftp batch command. Inside double quotes sftp reads a
+// backslash as an escape, so backslashes are doubled before quotes are escaped.
+func sftpQuote(p string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(p, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+func (d *sftpDrop) dir() string { return nz(d.u.Path, ".") }
+
+func (d *sftpDrop) List() ([]string, error) {
+	out, err := d.run("ls -1 " + sftpQuote(d.dir()))
+	if err != nil { return nil, err }
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "sftp>") { continue }
+		names = append(names, path.Base(line))
+	}
+	return names, nil
+}
+
+func (d *sftpDrop) Get(name string) ([]byte, error) {
+	tmp, err := os.CreateTemp("", "bizpulse-pull-*")
+	if err != nil { return nil, err }
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := d.run("get " + sftpQuote(path.Join(d.dir(), name)) + " " + sftpQuote(tmp.Name())); err != nil { return nil, err }
+	return os.ReadFile(tmp.Name())
+}
+
+func (d *sftpDrop) Move(name, dir string) error {
+	if !path.IsAbs(dir) { dir = path.Join(d.dir(), dir) }
+	// "-mkdir" ignores the error when the archive directory already exists
+	_, err := d.run("-mkdir "+sftpQuote(dir), "rename "+sftpQuote(path.Join(d.dir(), name))+" "+sftpQuote(path.Join(dir, name)))
+	return err
+}
+
+func (d *sftpDrop) Close() error { return nil }
+
+// ftpDrop is a minimal passive-mode FTP client: login, NLST, RETR and RNFR/RNTO.
+type ftpDrop struct {
+	ctx  context.Context
+	conn *textproto.Conn
+	dir  string
+	stop func() bool // stops closing the connection when ctx ends
+}
+
+// dialFTP connects and logs in; the control connection is closed if ctx ends first.
+func dialFTP(ctx context.Context, u *url.URL, password string) (*ftpDrop, error) {
+	addr := u.Host
+	if u.Port() == "" { addr = net.JoinHostPort(u.Hostname(), "21") }
+	nc, err := (&net.Dialer{Timeout: 30 * time.Second}).DialContext(ctx, "tcp", addr)
+	if err != nil { return nil, fmt.Errorf("ftp: %w", err) }
+	d := &ftpDrop{ctx: ctx, conn: textproto.NewConn(nc), dir: nz(u.Path, "."), stop: context.AfterFunc(ctx, func() { nc.Close() })}
+	if _, _, err := d.conn.ReadResponse(220); err != nil { d.Close(); return nil, fmt.Errorf("ftp: %w", err) }
+	user := "anonymous"
+	if u.User != nil { user = u.User.Username() }
+	code, _, err := d.cmd(0, "USER %s", user)
+	if err == nil && code == 331 { _, _, err = d.cmd(230, "PASS %s", password) }
+	if err == nil { _, _, err = d.cmd(200, "TYPE I") }
+	if err != nil { d.Close(); return nil, fmt.Errorf("ftp: %w", err) }
+	return d, nil
+}
+
+// cmd sends a command and reads its reply; expect 0 accepts any 1xx-3xx code.
+func (d *ftpDrop) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	if _, err := d.conn.Cmd(format, args...); err != nil { return 0, "", err }
+	code, msg, err := d.conn.ReadResponse(expect)
+	if err == nil && expect == 0 && code >= 400 { err = &textproto.Error{Code: code, Msg: msg} }
+	return code, msg, err
+}
+
+// transfer opens a passive data connection, issues the command and reads the data.
+func (d *ftpDrop) transfer(format string, args ...interface{}) ([]byte, error) {
+	_, msg, err := d.cmd(227, "PASV")
+	if err != nil { return nil, err }
+	open, end := strings.Index(msg, "("), strings.Index(msg, ")")
+	if open < 0 || end < open { return nil, fmt.Errorf("bad PASV reply %q", msg) }
+	var h [6]int
+	for i, p := range strings.Split(msg[open+1:end], ",") {
+		if i < 6 { h[i], _ = strconv.Atoi(strings.TrimSpace(p)) }
+	}
+	dc, err := (&net.Dialer{Timeout: 30 * time.Second}).DialContext(d.ctx, "tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h[0], h[1], h[2], h[3], h[4]<<8|h[5]))
+	if err != nil { return nil, err }
+	defer context.AfterFunc(d.ctx, func() { dc.Close() })()
+	if _, _, err := d.cmd(0, format, args...); err != nil { dc.Close(); return nil, err }
+	b, err := io.ReadAll(dc)
+	dc.Close()
+	if err != nil { return nil, err }
+	if _, _, err := d.conn.ReadResponse(226); err != nil { return nil, err }
+	return b, nil
+}
+
+func (d *ftpDrop) List() ([]string, error) {
+	b, err := d.transfer("NLST %s", d.dir)
+	if err != nil { return nil, err }
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" { names = append(names, path.Base(line)) }
+	}
+	return names, nil
+}
+
+func (d *ftpDrop) Get(name string) ([]byte, error) { return d.transfer("RETR %s", path.Join(d.dir, name)) }
+
+func (d *ftpDrop) Move(name, dir string) error {
+	if !path.IsAbs(dir) { dir = path.Join(d.dir, dir) }
+	d.cmd(0, "MKD %s", dir) // already exists on later runs
+	if _, _, err := d.cmd(350, "RNFR %s", path.Join(d.dir, name)); err != nil { return err }
+	_, _, err := d.cmd(250, "RNTO %s", path.Join(dir, name))
+	return err
+}
+
+func (d *ftpDrop) Close() error {
+	d.stop()
+	d.conn.Cmd("QUIT")
+	return d.conn.Close()
+}
+
+// -------- Stripe --------
+
+// Sales can come straight from the Stripe API instead of a CSV export: a source of
+// "stripe:charges" or "stripe:invoices", optionally followed by ?from=YYYY-MM-DD&to=YYYY-MM-DD,
+// works anywhere a file or URL does (-file, -schedule). The key is read from STRIPE_API_KEY;
+// a restricted key with read access to charges and invoices is enough. In server mode
+// stripe.every re-syncs on a cadence and POST /api/v1/stripe syncs now.
+type StripeConfig struct {
+	Object  string `json:"object"`  // charges (default) or invoices
+	Days    int    `json:"days"`    // history pulled when no from date is given (default 365)
+	Every   string `json:"every"`   // server mode sync cadence; empty syncs only on request
+	Mode    string `json:"mode"`    // replace (default, so later payments update statuses) or merge
+	Dataset string `json:"dataset"` // workspace synced into (default: the shared analysis)
+	URL     string `json:"url"`     // API base (default https://api.stripe.com)
+}
+
+const stripePageSize = 100 // the API's maximum
+
+// stripeZeroDecimal lists the currencies whose Stripe amounts are whole units, not cents.
+var stripeZeroDecimal = map[string]bool{"BIF": true, "CLP": true, "DJF": true, "GNF": true, "JPY": true, "KMF": true, "KRW": true,
+	"MGA": true, "PYG": true, "RWF": true, "UGX": true, "VND": true, "VUV": true, "XAF": true, "XOF": true, "XPF": true}
+
+// stripeObject holds the fields of a charge or an invoice that map to a sale.
+type stripeObject struct {
+	ID          string            `json:"id"`
+	Created     int64             `json:"created"`
+	Currency    string            `json:"currency"`
+	Status      string            `json:"status"`
+	Customer    string            `json:"customer"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+	// charges
+	Amount         int64  `json:"amount"`
+	AmountRefunded int64  `json:"amount_refunded"`
+	ReceiptEmail   string `json:"receipt_email"`
+	BillingDetails struct {
+		Name    string        `json:"name"`
+		Email   string        `json:"email"`
+		Address stripeAddress `json:"address"`
+	} `json:"billing_details"`
+	// invoices
+	Number            string `json:"number"`
+	Total             int64  `json:"total"`
+	CustomerName      string `json:"customer_name"`
+	CustomerEmail     string `json:"customer_email"`
+	CustomerAddress   *stripeAddress `json:"customer_address"`
+	DueDate           int64  `json:"due_date"`
+	Tax               int64  `json:"tax"`
+	Discounts         []struct {
+		Amount int64 `json:"amount"`
+	} `json:"total_discount_amounts"`
+	StatusTransitions struct {
+		FinalizedAt int64 `json:"finalized_at"`
+	} `json:"status_transitions"`
+	Lines struct {
+		Data []struct {
+			Description string `json:"description"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+type stripeAddress struct {
+	Country string `json:"country"` // ISO alpha-2
+}
+
+func isStripeSource(src string) bool { return strings.HasPrefix(src, "stripe:") }
+
+// parseStripeSource splits "stripe:invoices?from=2024-01-01" into the object and the
+// created-date range [from, to); to is zero for "up to now".
+func parseStripeSource(src string) (object string, from, to time.Time, err error) {
+	spec, query, _ := strings.Cut(strings.TrimPrefix(src, "stripe:"), "?")
+	object = strings.ToLower(nz(spec, nz(cfg.Stripe.Object, "charges")))
+	if object != "charges" && object != "invoices" {
+		return "", from, to, fmt.Errorf("stripe: object must be charges or invoices, got %q", object)
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil { return "", from, to, fmt.Errorf("stripe: %w", err) }
+	days := cfg.Stripe.Days
+	if days <= 0 { days = 365 }
+	from = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days)
+	if v := q.Get("from"); v != "" {
+		if from = parseDateFlexible(v); from.IsZero() { return "", from, to, fmt.Errorf("stripe: bad from date %q", v) }
+	}
+	if v := q.Get("to"); v != "" {
+		if to = parseDateFlexible(v); to.IsZero() { return "", from, to, fmt.Errorf("stripe: bad to date %q", v) }
+		to = to.AddDate(0, 0, 1) // inclusive
+	}
+	return object, from, to, nil
+}
+
+// readStripeSource pulls every charge or invoice created in the source's range, page by
+// page, and maps them to sales.
+func readStripeSource(ctx context.Context, src string) ([]Sale, error) {
+	object, from, to, err := parseStripeSource(src)
+	if err != nil { return nil, err }
+	key := os.Getenv("STRIPE_API_KEY")
+	if key == "" { return nil, fmt.Errorf("stripe: STRIPE_API_KEY is not set") }
+	q := url.Values{"limit": {strconv.Itoa(stripePageSize)}, "created[gte]": {strconv.FormatInt(from.Unix(), 10)}}
+	if !to.IsZero() { q.Set("created[lt]", strconv.FormatInt(to.Unix(), 10)) }
+	var out []Sale
+	for {
+		var page struct {
+			Data    []stripeObject `json:"data"`
+			HasMore bool           `json:"has_more"`
+		}
+		if err := stripeGet(ctx, key, "/v1/"+object+"?"+q.Encode(), &page); err != nil { return nil, err }
+		for _, o := range page.Data {
+			if s, ok := o.sale(object); ok { out = append(out, s) }
+		}
+		if !page.HasMore || len(page.Data) == 0 { break }
+		q.Set("starting_after", page.Data[len(page.Data)-1].ID)
+	}
+	if err := convertCurrencies(out); err != nil { return nil, err }
+	return out, nil
+}
+
+// stripeGet fetches one API path into v, backing off and retrying when rate limited.
+func stripeGet(ctx context.Context, key, path string, v interface{}) error {
+	base := strings.TrimRight(nz(cfg.Stripe.URL, "https://api.stripe.com"), "/")
+	client := &http.Client{Timeout: time.Minute}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+		if err != nil { return fmt.Errorf("stripe: %w", err) }
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := client.Do(req)
+		if err != nil { return withKind(ErrUpstream, fmt.Errorf("stripe: %w", err)) }
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < 3 {
+			resp.Body.Close()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt+1) * time.Second):
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var e struct {
+				Error struct{ Message string `json:"message"` } `json:"error"`
+			}
+			json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+			return withKind(ErrUpstream, fmt.Errorf("stripe: %s: %s", resp.Status, nz(e.Error.Message, "request failed")))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil { return withKind(ErrUpstream, fmt.Errorf("stripe: %w", err)) }
+		return nil
+	}
+}
+
+// sale maps a charge or invoice to a sale; false for ones that never became revenue
+// (failed charges, draft and void invoices). Charges are net of refunds. Open invoices
+// are unpaid, or overdue once past their due date; uncollectible ones count as overdue.
+func (o stripeObject) sale(object string) (Sale, bool) {
+	created := o.Created
+	var amount, tax, discount int64
+	var status, customer, product, invoice, email, country string
+	var due time.Time
+	switch object {
+	case "charges":
+		switch o.Status {
+		case "succeeded":
+			status = "paid"
+		case "pending":
+			status = "unpaid"
+		default:
+			return Sale{}, false
+		}
+		amount = o.Amount - o.AmountRefunded
+		if amount <= 0 { return Sale{}, false }
+		customer = nz(o.BillingDetails.Name, nz(o.BillingDetails.Email, nz(o.ReceiptEmail, o.Customer)))
+		email, country = nz(o.BillingDetails.Email, o.ReceiptEmail), o.BillingDetails.Address.Country
+		product = nz(o.Description, "Stripe charge")
+		invoice = o.ID
+	case "invoices":
+		switch o.Status {
+		case "paid":
+			status = "paid"
+		case "open":
+			status = "unpaid"
+			if o.DueDate > 0 && time.Unix(o.DueDate, 0).Before(time.Now()) { status = "overdue" }
+		case "uncollectible":
+			status = "overdue"
+		default:
+			return Sale{}, false
+		}
+		if o.StatusTransitions.FinalizedAt > 0 { created = o.StatusTransitions.FinalizedAt }
+		if o.DueDate > 0 { due = time.Unix(o.DueDate, 0).UTC().Truncate(24 * time.Hour) }
+		amount, tax = o.Total, o.Tax
+		for _, d := range o.Discounts { discount += d.Amount }
+		customer = nz(o.CustomerName, nz(o.CustomerEmail, o.Customer))
+		email = o.CustomerEmail
+		if o.CustomerAddress != nil { country = o.CustomerAddress.Country }
+		product = o.Description
+		if len(o.Lines.Data) > 0 { product = nz(product, o.Lines.Data[0].Description) }
+		product = nz(product, "Stripe invoice")
+		invoice = nz(o.Number, o.ID)
+	}
+	cur := strings.ToUpper(o.Currency)
+	amt, taxAmt, discAmt := float64(amount), float64(tax), float64(discount)
+	if !stripeZeroDecimal[cur] { amt, taxAmt, discAmt = amt/100, taxAmt/100, discAmt/100 }
+	customer = nz(customer, "Unknown")
+	return Sale{
+		Date:        time.Unix(created, 0).UTC().Truncate(24 * time.Hour),
+		Customer:    canonicalCustomer(customer),
+		RawCustomer: customer,
+		Product:     product,
+		Amount:      amt,
+		Status:      status,
+		Rep:         o.Metadata["rep"],
+		Region:      o.Metadata["region"],
+		Campaign:    o.Metadata["campaign"],
+		Invoice:     invoice,
+		Currency:    cur,
+		OrigAmount:  amt,
+		Due:         due,
+		Tax:         taxAmt,
+		Discount:    discAmt,
+		Email:       email,
+		Country:     normalizeCountry(country),
+	}, true
+}
+
+// syncStripe pulls the configured object into the configured dataset.
+func syncStripe(ctx context.Context) (IngestResult, error) {
+	res := IngestResult{Mode: nz(cfg.Stripe.Mode, "replace")}
+	a, err := workspace(cfg.Stripe.Dataset, true)
+	if err != nil { return res, fmt.Errorf("stripe: %w", err) }
+	sales, err := readStripeSource(ctx, "stripe:")
+	if err != nil { return res, err }
+	res.Received = len(sales)
+	if len(sales) == 0 { return res, nil }
+	if err := ingestInto(ctx, a, sales, &res, false); err != nil { return res, fmt.Errorf("stripe: %w", err) }
+	return res, nil
+}
+
+func monitorStripe(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		if res, err := syncStripe(ctx); err != nil {
+			log.Printf("%v", err)
+		} else {
+			log.Printf("stripe: synced %d %s (%d added, %d skipped)", res.Received, nz(cfg.Stripe.Object, "charges"), res.Added, res.Skipped)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleStripe syncs from Stripe now (POST /api/v1/stripe).
+func handleStripe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	res, err := syncStripe(r.Context())
+	if err != nil {
+		httpError(w, "", err, http.StatusBadGateway); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// -------- Shopify --------
+
+// ShopifyConfig syncs orders from the Shopify Admin API (server mode), authenticating with
+// SHOPIFY_TOKEN, an Admin API access token with read_orders. The first sync loads Days of
+// history; later ones fetch only orders updated since the last one, using the highest
+// updated_at seen as a cursor kept in the -shopify-state file. Each order becomes one row
+// per line item, invoiced as the order name, and replaces the rows from its previous
+// version, so payments, edits and cancellations made after a sync are picked up.
+type ShopifyConfig struct {
+	Shop       string `json:"shop"`       // acme or acme.myshopify.com; empty disables the sync
+	APIVersion string `json:"apiVersion"` // default 2024-07
+	Every      string `json:"every"`      // sync cadence (default 1h)
+	Days       int    `json:"days"`       // history loaded by the first sync (default 365)
+	Dataset    string `json:"dataset"`    // workspace synced into (default: the shared analysis)
+	URL        string `json:"url"`        // API base (default https://<shop>.myshopify.com)
+}
+
+const shopifyPageSize = 250 // the API's maximum
+
+type shopifyAddress struct {
+	Company     string `json:"company"`
+	Province    string `json:"province"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+}
+
+// shopifyOrder holds the fields of an order that map to sales.
+type shopifyOrder struct {
+	Name            string          `json:"name"` // "#1001"
+	CreatedAt       string          `json:"created_at"`
+	ProcessedAt     string          `json:"processed_at"`
+	UpdatedAt       string          `json:"updated_at"`
+	CancelledAt     string          `json:"cancelled_at"`
+	FinancialStatus string          `json:"financial_status"`
+	Currency        string          `json:"currency"`
+	TaxesIncluded   bool            `json:"taxes_included"`
+	Email           string          `json:"email"`
+	SourceName      string          `json:"source_name"`
+	BillingAddress  *shopifyAddress `json:"billing_address"`
+	ShippingAddress *shopifyAddress `json:"shipping_address"`
+	Customer        *struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+	} `json:"customer"`
+	LineItems []struct {
+		Title         string `json:"title"`
+		Quantity      int    `json:"quantity"`
+		Price         string `json:"price"`
+		TotalDiscount string `json:"total_discount"`
+		TaxLines      []struct {
+			Price string `json:"price"`
+		} `json:"tax_lines"`
+	} `json:"line_items"`
+}
+
+var (
+	shopifyMu        sync.Mutex
+	shopifyStatePath string
+	shopifyCursors   = map[string]string{} // shop -> highest updated_at synced
+)
+
+func loadShopifyState(path string) error {
+	shopifyStatePath = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	if err != nil { return err }
+	if err := json.Unmarshal(b, &shopifyCursors); err != nil { return fmt.Errorf("shopify state %s: %w", path, err) }
+	return nil
+}
+
+func saveShopifyState() error {
+	if shopifyStatePath == "" { return nil }
+	b, _ := json.MarshalIndent(shopifyCursors, "", "  ")
+	return os.WriteFile(shopifyStatePath, b, 0644)
+}
+
+func shopifyDomain(shop string) string {
+	if strings.Contains(shop, ".") { return shop }
+	return shop + ".myshopify.com"
+}
+
+// sales maps an order to one sale per line item, at line price less line discounts.
+// Refunded, voided and cancelled orders have none. Tax is recorded only when the shop's
+// prices include it, since otherwise the amount doesn't.
+func (o shopifyOrder) sales() []Sale {
+	var status string
+	switch o.FinancialStatus {
+	case "paid", "partially_refunded":
+		status = "paid"
+	case "pending", "authorized", "partially_paid":
+		status = "unpaid"
+	default:
+		return nil
+	}
+	if o.CancelledAt != "" { return nil }
+	placed, err := time.Parse(time.RFC3339, nz(o.ProcessedAt, o.CreatedAt))
+	if err != nil { return nil }
+	day := time.Date(placed.Year(), placed.Month(), placed.Day(), 0, 0, 0, 0, time.UTC) // the shop's local date
+	var customer, region, country string
+	if a := o.BillingAddress; a != nil { customer, region, country = a.Company, a.Province, nz(a.CountryCode, a.Country) }
+	email := o.Email
+	if c := o.Customer; c != nil {
+		customer = nz(customer, nz(strings.TrimSpace(c.FirstName+" "+c.LastName), c.Email))
+		email = nz(email, c.Email)
+	}
+	customer = nz(customer, nz(o.Email, "Unknown"))
+	if a := o.ShippingAddress; a != nil {
+		region = nz(a.Province, nz(region, a.Country))
+		country = nz(a.CountryCode, nz(a.Country, country))
+	}
+	cur := strings.ToUpper(o.Currency)
+	var out []Sale
+	for _, li := range o.LineItems {
+		price, _ := strconv.ParseFloat(li.Price, 64)
+		discount, _ := strconv.ParseFloat(li.TotalDiscount, 64)
+		amt := price*float64(li.Quantity) - discount
+		var tax float64
+		if o.TaxesIncluded {
+			for _, t := range li.TaxLines { tax += parseNumber(t.Price) }
+		}
+		out = append(out, Sale{Date: day, Customer: canonicalCustomer(customer), RawCustomer: customer, Product: nz(li.Title, "Unknown"),
+			Amount: amt, Status: status, Region: region, Campaign: o.SourceName, Invoice: o.Name, Currency: cur, OrigAmount: amt,
+			Tax: tax, Discount: discount, Quantity: float64(li.Quantity), Email: email, Country: normalizeCountry(country)})
+	}
+	return out
+}
+
+// fetchShopifyOrders pages through the orders updated since since, returning their sales,
+// the invoice of every order seen (including ones with no rows left) and the new cursor.
+func fetchShopifyOrders(ctx context.Context, sc ShopifyConfig, since string) ([]Sale, map[string]bool, string, error) {
+	token := os.Getenv("SHOPIFY_TOKEN")
+	if token == "" { return nil, nil, "", fmt.Errorf("shopify: SHOPIFY_TOKEN is not set") }
+	base := strings.TrimRight(nz(sc.URL, "https://"+shopifyDomain(sc.Shop)), "/")
+	q := url.Values{"status": {"any"}, "limit": {strconv.Itoa(shopifyPageSize)}, "updated_at_min": {since}}
+	next := base + "/admin/api/" + nz(sc.APIVersion, "2024-07") + "/orders.json?" + q.Encode()
+	client := &http.Client{Timeout: time.Minute}
+	var sales []Sale
+	invoices := map[string]bool{}
+	cursor := since
+	for attempt := 0; next != ""; {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil { return nil, nil, "", fmt.Errorf("shopify: %w", err) }
+		req.Header.Set("X-Shopify-Access-Token", token)
+		resp, err := client.Do(req)
+		if err != nil { return nil, nil, "", withKind(ErrUpstream, fmt.Errorf("shopify: %w", err)) }
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < 3 {
+			resp.Body.Close()
+			attempt++
+			wait := time.Duration(attempt) * time.Second
+			if s, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && s > 0 { wait = time.Duration(s * float64(time.Second)) }
+			select {
+			case <-ctx.Done():
+				return nil, nil, "", ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		var page struct {
+			Orders []shopifyOrder `json:"orders"`
+		}
+		if resp.StatusCode == http.StatusOK { err = json.NewDecoder(resp.Body).Decode(&page) } else { err = fmt.Errorf("%s", resp.Status) }
+		resp.Body.Close()
+		if err != nil { return nil, nil, "", withKind(ErrUpstream, fmt.Errorf("shopify: orders: %w", err)) }
+		for _, o := range page.Orders {
+			invoices[o.Name] = true
+			sales = append(sales, o.sales()...)
+			if laterTimestamp(o.UpdatedAt, cursor) { cursor = o.UpdatedAt }
+		}
+		next, attempt = linkNext(resp.Header.Get("Link")), 0
+	}
+	if err := convertCurrencies(sales); err != nil { return nil, nil, "", err }
+	return sales, invoices, cursor, nil
+}
+
+// laterTimestamp reports whether RFC 3339 timestamp a is after b (true when b is unset).
+func laterTimestamp(a, b string) bool {
+	ta, err := time.Parse(time.RFC3339, a)
+	if err != nil { return false }
+	tb, err := time.Parse(time.RFC3339, b)
+	return err != nil || ta.After(tb)
+}
+
+// linkNext returns the rel="next" URL of a Link header, or "".
+func linkNext(header string) string {
+	for _, part := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(part, ";")
+		if ok && strings.Contains(params, `rel="next"`) { return strings.Trim(strings.TrimSpace(target), "<>") }
+	}
+	return ""
+}
+
+// upsertInto replaces a's rows for the given invoices with sales, those orders' current
+// rows, keeps everything else, and republishes a.
+func upsertInto(ctx context.Context, a *Analysis, sales []Sale, invoices map[string]bool, res *IngestResult) error {
+	a.ingest.Lock()
+	defer a.ingest.Unlock()
+	cur := a.view()
+	all := make([]Sale, 0, len(cur.Sales)+len(sales))
+	for _, s := range cur.Sales {
+		if s.Invoice != "" && invoices[s.Invoice] { res.Replaced++; continue }
+		all = append(all, s)
+	}
+	all = append(all, sales...)
+	res.Added = len(sales)
+	if _, err := publishAnalysis(ctx, a, all, cur.Leads, cur.Spend, false, storeErr(func() error { return a.storage().Replace(all) })); err != nil { return err }
+	res.Snapshot = a.view().Snapshot
+	return nil
+}
+
+// syncShopify pulls the orders updated since the last sync (or all of the first sync's
+// window when full is set) into the configured dataset.
+func syncShopify(ctx context.Context, full bool) (IngestResult, error) {
+	shopifyMu.Lock()
+	defer shopifyMu.Unlock()
+	sc := cfg.Shopify
+	res := IngestResult{Mode: "upsert"}
+	a, err := workspace(sc.Dataset, true)
+	if err != nil { return res, fmt.Errorf("shopify: %w", err) }
+	since := shopifyCursors[sc.Shop]
+	if since == "" || full {
+		days := sc.Days
+		if days <= 0 { days = 365 }
+		since = time.Now().UTC().AddDate(0, 0, -days).Format(time.RFC3339)
+	}
+	sales, invoices, cursor, err := fetchShopifyOrders(ctx, sc, since)
+	if err != nil { return res, err }
+	res.Received = len(invoices)
+	if len(invoices) == 0 { return res, nil }
+	if err := upsertInto(ctx, a, sales, invoices, &res); err != nil { return res, fmt.Errorf("shopify: %w", err) }
+	shopifyCursors[sc.Shop] = cursor
+	return res, saveShopifyState()
+}
+
+func monitorShopify(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		if res, err := syncShopify(ctx, false); err != nil {
+			log.Printf("%v", err)
+		} else if res.Received > 0 {
+			log.Printf("shopify: %d orders updated — %d rows added, %d replaced", res.Received, res.Added, res.Replaced)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// handleShopify syncs from Shopify now (POST /api/v1/shopify; full=1 reloads the whole window).
+func handleShopify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if cfg.Shopify.Shop == "" {
+		http.Error(w, "shopify is not configured", 404); return
+	}
+	res, err := syncShopify(r.Context(), r.FormValue("full") != "")
+	if err != nil {
+		httpError(w, "", err, http.StatusBadGateway); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// -------- Scheduler --------
+
+// -schedule takes a five-field cron expression (minute hour day-of-month month day-of-week,
+// local time), e.g. "0 8 * * MON". Fields accept *, lists, ranges, /steps and three-letter
+// month and weekday names; 0 and 7 are both Sunday. As in cron, when both day fields are
+// restricted a day matching either one fires.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	anyDom, anyDow                bool
+}
+
+var (
+	cronMonths   = map[string]int{"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6, "JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12}
+	cronWeekdays = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+)
+
+func parseCron(expr string) (*cronSchedule, error) {
+	f := strings.Fields(expr)
+	if len(f) != 5 { return nil, fmt.Errorf("schedule %q: want 5 fields (minute hour day month weekday)", expr) }
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59, nil); err != nil { return nil, fmt.Errorf("schedule %q: minute: %w", expr, err) }
+	if c.hour, err = parseCronField(f[1], 0, 23, nil); err != nil { return nil, fmt.Errorf("schedule %q: hour: %w", expr, err) }
+	if c.dom, err = parseCronField(f[2], 1, 31, nil); err != nil { return nil, fmt.Errorf("schedule %q: day of month: %w", expr, err) }
+	if c.month, err = parseCronField(f[3], 1, 12, cronMonths); err != nil { return nil, fmt.Errorf("schedule %q: month: %w", expr, err) }
+	if c.dow, err = parseCronField(f[4], 0, 7, cronWeekdays); err != nil { return nil, fmt.Errorf("schedule %q: weekday: %w", expr, err) }
+	if c.dow[7] { c.dow[0] = true }
+	c.anyDom, c.anyDow = strings.HasPrefix(f[2], "*"), strings.HasPrefix(f[4], "*")
+	return &c, nil
+}
+
+func parseCronField(s string, lo, hi int, names map[string]int) (map[int]bool, error) {
+	val := func(v string) (int, error) {
+		if n, ok := names[strings.ToUpper(v)]; ok { return n, nil }
+		n, err := strconv.Atoi(v)
+		if err != nil || n < lo || n > hi { return 0, fmt.Errorf("invalid value %q", v) }
+		return n, nil
+	}
+	out := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 { return nil, fmt.Errorf("invalid step in %q", part) }
+			rng, step = part[:i], n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = val(a); err != nil { return nil, err }
+			to = from
+			if isRange {
+				if to, err = val(b); err != nil { return nil, err }
+			} else if step > 1 {
+				to = hi
+			}
+			if to < from { return nil, fmt.Errorf("invalid range %q", rng) }
+		}
+		for v := from; v <= to; v += step { out[v] = true }
+	}
+	return out, nil
+}
+
+// next returns the first matching minute strictly after t, or the zero time if none
+// falls within five years (e.g. "0 0 30 FEB *").
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// runScheduled calls run at every time the schedule matches until ctx is done.
+func runScheduled(ctx context.Context, c *cronSchedule, run func() error) {
+	for {
+		at := c.next(time.Now())
+		if at.IsZero() { log.Printf("schedule: no upcoming run"); return }
+		log.Printf("schedule: next run at %s", at.Format("2006-01-02 15:04 MST"))
+		t := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if err := run(); err != nil { log.Printf("scheduled run: %v", err) }
+	}
+}
+
+// scheduledIngest re-reads the -file/-url sources into the shared analysis, which sends
+// alerts as an upload would, then rewrites report.md.
+func scheduledIngest(ctx context.Context, sources, sheet, granularity string) error {
+	sales, quality, err := loadSources(ctx, sources, sheet)
+	if err != nil { return err }
+	res := IngestResult{Mode: "replace", Received: len(sales)}
+	if err := ingestInto(ctx, shared, sales, &res, true); err != nil { return err }
+	shared.update(func(a *Analysis) { a.Quality = quality })
+	k := *shared.view().KPIs
+	k.Quality = quality
+	if err := os.WriteFile("report.md", []byte(renderMarkdown(k, granularity)), 0644); err != nil { return err }
+	log.Printf("schedule: analyzed %d rows (snapshot %s); wrote report.md", len(sales), res.Snapshot)
+	return nil
+}
+
+// -------- Demo mode --------
+
+// -demo serves a generated dataset for public demos: nothing can be uploaded or changed
+// (only GET and HEAD are allowed), nothing is sent out (Slack, OpenAI and email are
+// recorded in the outbound audit as blocked), nothing is written to disk, and the
+// dashboard carries a DEMO watermark.
+var demoMode bool
+
+const demoDays = 120
+
+var (
+	demoCustomers = []string{"Acme Corp", "Globex", "Initech", "Umbrella", "Hooli", "Stark Industries", "Wayne Enterprises", "Wonka",
+		"Cyberdyne", "Soylent", "Tyrell", "Vandelay Industries", "Pied Piper", "Dunder Mifflin", "Oscorp", "Monarch",
+		"Nakatomi", "Aperture", "Massive Dynamic", "Bluth Company", "Sterling Cooper", "Prestige Worldwide"}
+	demoProducts = []KVf{{"Analytics Suite", 1200}, {"Onboarding", 1500}, {"Training", 800}, {"Support Plan", 450}, {"Data Connector", 300}, {"API Add-on", 200}}
+	demoReps     = [][2]string{{"Alice", "North"}, {"Bob", "South"}, {"Chen", "East"}, {"Dana", "West"}}
+	demoSources  = []string{"", "", "Referral", "Paid Search", "Webinar"}
+	demoChannels = []string{"Online", "Direct", "Partner"}
+)
+
+// demoSales generates demoDays of sales ending on end. The seed is fixed, so every boot
+// tells the same story: steady growth with quieter weekends, a dip three weeks ago, a
+// webinar-driven spike, overdue invoices, and Globex going quiet over the last ten days.
+func demoSales(end time.Time) []Sale {
+	rng := rand.New(rand.NewSource(42))
+	start := end.AddDate(0, 0, -(demoDays - 1))
+	var out []Sale
+	inv := 1000
+	for i := 0; i < demoDays; i++ {
+		day := start.AddDate(0, 0, i)
+		n := 4 + rng.Intn(5) + i/30
+		if wd := day.Weekday(); wd == time.Saturday || wd == time.Sunday { n /= 3 }
+		if i == demoDays-21 { n = 1 }
+		if i == demoDays-45 { n *= 3 }
+		for j := 0; j < n; j++ {
+			c := demoCustomers[int(rng.ExpFloat64()*5)%len(demoCustomers)]
+			if c == "Globex" && i >= demoDays-10 { c = demoCustomers[len(demoCustomers)-1-rng.Intn(8)] }
+			p := demoProducts[rng.Intn(len(demoProducts))]
+			rep := demoReps[rng.Intn(len(demoReps))]
+			amt := math.Round(p.Value*(0.8+0.4*rng.Float64())*(1+0.002*float64(i))*100) / 100
+			status := "paid"
+			if r := rng.Float64(); r < 0.06 {
+				status = "unpaid"
+				if i < demoDays-30 { status = "overdue" }
+			}
+			src := demoSources[rng.Intn(len(demoSources))]
+			if i >= demoDays-47 && i <= demoDays-45 { src = "Webinar" }
+			inv++
+			out = append(out, Sale{Date: day, Customer: c, RawCustomer: c, Product: p.Key, Amount: amt, OrigAmount: amt, Status: status,
+				Rep: rep[0], Region: rep[1], Campaign: src, Invoice: fmt.Sprintf("INV-%05d", inv), Channel: demoChannels[len(c)%len(demoChannels)]})
+		}
+	}
+	return out
+}
+
+// demoGuard rejects everything but reads. It goes by method alone, which holds because
+// every handler that changes data refuses GET (BizOps_test.go checks each write route).
+func demoGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !readPosts[r.URL.Path] {
+			http.Error(w, "read-only demo: uploads and changes are disabled", http.StatusForbidden); return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// -------- Upload wizard --------
+
+// The wizard stages an upload in steps: file → detected schema and validation feedback →
+// options → analyze. Each step is an API call, so the same flow is scriptable:
+//
+//   POST /api/v1/uploads                 (multipart file[, sheet]) → StagedUpload
+//   GET  /api/v1/uploads/{id}            → StagedUpload
+//   POST /api/v1/uploads/{id}/options    {"From","To","ExcludeCustomers","ExcludeProducts","AI"}
+//   POST /api/v1/uploads/{id}/analyze    → KPIs
+//
+// The /wizard page drives the same functions.
+
+// UploadOptions are applied when a staged upload is analyzed.
+type UploadOptions struct {
+	From             string // YYYY-MM-DD, inclusive; empty = no bound
+	To               string
+	ExcludeCustomers []string
+	ExcludeProducts  []string
+	AI               bool // request the AI summary (when OPENAI_API_KEY is set)
+	Columns          map[string]string // field -> header pins for this file
+}
+
+// StagedUpload is a parsed file awaiting analysis.
+type StagedUpload struct {
+	ID       string
+	Name     string
+	Created  time.Time
+	Columns  map[string]string // field -> bound header ("" when missing)
+	Headers  []string          // the file's header row, for remapping
+	Rows     int               // data rows in the file
+	Valid    int               // rows that parse into sales
+	Selected int               // valid rows remaining after options
+	Errors   []string          // first validation problems, with row numbers
+	Quality  *DataQuality      // the parse under the current mapping; nil when it doesn't bind
+	Sample   []Sale
+	Options  UploadOptions
+	sales    []Sale
+	records  [][]string
+}
+
+const (
+	stagedUploadTTL   = time.Hour
+	stagedErrorsLimit = 20
+)
+
+var (
+	stagedMu      sync.Mutex
+	stagedUploads = map[string]*StagedUpload{}
+)
+
+// validateRecords lists rows that parseRecords would drop or misread.
+func validateRecords(records [][]string, mapping map[string]string) (errs []string, valid int) {
+	if len(records) < 2 { return []string{"file has no data rows"}, 0 }
+	get := saleGetter(records[0], mapping)
+	for _, f := range saleFields {
+		if pin := pinnedColumn(f, mapping); pin != "" && exactHeader(records[0], pin) < 0 {
+			errs = append(errs, fmt.Sprintf("column %q mapped to %s not found", pin, f))
+		}
+	}
+	if columnFor(records[0], "date", mapping) < 0 { errs = append(errs, "no date column found") }
+	if columnFor(records[0], "amount", mapping) < 0 { errs = append(errs, "no amount column found") }
+	for i, row := range records[1:] {
+		line := i + 2 // 1-based, after the header
+		var problem string
+		ds := get(row, "date")
+		amt := strings.ReplaceAll(get(row, "amount"), ",", "")
+		switch {
+		case ds == "":
+			problem = "empty date"
+		case parseDateFlexible(ds).IsZero():
+			problem = fmt.Sprintf("unparseable date %q", ds)
+		}
+		if problem == "" {
+			valid++
+			if _, err := strconv.ParseFloat(amt, 64); amt != "" && err != nil {
+				problem = fmt.Sprintf("amount %q is not numeric (read as 0)", amt)
+			}
+		}
+		if problem != "" && len(errs) < stagedErrorsLimit {
+			errs = append(errs, fmt.Sprintf("row %d: %s", line, problem))
+		}
+	}
+	return errs, valid
+}
+
+func stageUpload(name string, records [][]string) (*StagedUpload, error) {
+	if len(records) < 2 { return nil, withKind(ErrNoData, fmt.Errorf("file has no data rows")) }
+	buf := make([]byte, 8)
+	if _, err := cryptorand.Read(buf); err != nil { return nil, err }
+	su := &StagedUpload{ID: hex.EncodeToString(buf), Name: name, Created: time.Now(), Headers: records[0],
+		Rows: len(records) - 1, Options: UploadOptions{AI: true}, records: records}
+	su.remap()
+	su.refresh()
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	for id, old := range stagedUploads {
+		if time.Since(old.Created) > stagedUploadTTL { delete(stagedUploads, id) }
+	}
+	stagedUploads[su.ID] = su
+	return su, nil
+}
+
+// remap re-binds columns with the current Options.Columns and re-parses the rows.
+// A mapping that doesn't bind leaves no sales; the reason is listed in Errors.
+func (su *StagedUpload) remap() {
+	su.Columns = headerBinding(su.records[0], su.Options.Columns)
+	su.Errors, su.Valid = validateRecords(su.records, su.Options.Columns)
+	var err error
+	if su.sales, su.Quality, err = parseRecords(su.records, su.Options.Columns); err != nil && !strings.Contains(strings.Join(su.Errors, "\n"), err.Error()) {
+		su.Errors = append(su.Errors, err.Error())
+	}
+	if su.Quality != nil { su.Quality.File = su.Name }
+}
+
+// refresh recomputes the selection count and sample after options change.
+func (su *StagedUpload) refresh() {
+	sel := su.selected()
+	su.Selected = len(sel)
+	if len(sel) > 5 { sel = sel[:5] }
+	su.Sample = sel
+}
+
+func (su *StagedUpload) selected() []Sale {
+	o := su.Options
+	from, to := parseDateFlexible(o.From), parseDateFlexible(o.To)
+	skip := map[string]bool{}
+	for _, c := range o.ExcludeCustomers { skip["c:"+strings.ToLower(strings.TrimSpace(c))] = true }
+	for _, p := range o.ExcludeProducts { skip["p:"+strings.ToLower(strings.TrimSpace(p))] = true }
+	var out []Sale
+	for _, s := range su.sales {
+		if !from.IsZero() && s.Date.Before(from) { continue }
+		if !to.IsZero() && s.Date.After(to) { continue }
+		if skip["c:"+strings.ToLower(s.Customer)] || skip["p:"+strings.ToLower(s.Product)] { continue }
+		out = append(out, s)
+	}
+	return out
+}
+
+func getStaged(id string) *StagedUpload {
+	stagedMu.Lock()
+	defer stagedMu.Unlock()
+	return stagedUploads[id]
+}
+
+// analyzeStaged runs the full pipeline on a staged upload and drops it from staging.
+func analyzeStaged(ctx context.Context, a *Analysis, su *StagedUpload) (KPIs, error) {
+	sales := su.selected()
+	if len(sales) == 0 { return KPIs{}, withKind(ErrNoData, fmt.Errorf("no rows left after options")) }
+	a.ingest.Lock()
+	defer a.ingest.Unlock()
+	var save func() error
+	if a.Dataset != "" { save = storeErr(func() error { return a.storage().Replace(sales) }) }
+	k, err := publishAnalysis(ctx, a, sales, nil, nil, su.Options.AI, save)
+	if err != nil { return KPIs{}, err }
+	a.update(func(a *Analysis) { a.Columns, a.Quality = su.Columns, []*DataQuality{su.Quality} })
+	stagedMu.Lock()
+	delete(stagedUploads, su.ID)
+	stagedMu.Unlock()
+	return k, nil
+}
+
+// handleUploadsAPI serves /api/v1/uploads and /api/v1/uploads/{id}[/options|/analyze].
+func handleUploadsAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/uploads"), "/")
+	parts := strings.Split(rest, "/")
+	writeJSON := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+		}
+		if err := r.ParseMultipartForm(50 << 20); err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		f, fh, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file is required", 400); return
+		}
+		defer f.Close()
+		records, err := readRecords(f, fh.Filename, r.FormValue("sheet"))
+		if err != nil {
+			httpError(w, "parse: ", err, 400); return
+		}
+		su, err := stageUpload(fh.Filename, records)
+		if err != nil {
+			httpError(w, "parse: ", err, 400); return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(su)
+		return
+	}
+	su := getStaged(parts[0])
+	if su == nil {
+		http.Error(w, "upload not found or expired", 404); return
+	}
+	action := ""
+	if len(parts) > 1 { action = parts[1] }
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(su)
+	case action == "options" && r.Method == http.MethodPost:
+		var o UploadOptions
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&o); err != nil {
+			http.Error(w, "invalid JSON body", 400); return
+		}
+		for f := range o.Columns {
+			if !isSaleField(f) {
+				http.Error(w, "unknown column field "+f, 400); return
+			}
+		}
+		stagedMu.Lock()
+		su.Options = o
+		su.remap()
+		su.refresh()
+		stagedMu.Unlock()
+		writeJSON(su)
+	case action == "analyze" && r.Method == http.MethodPost:
+		a, err := uploadTarget(w, r, false)
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		k, err := analyzeStaged(r.Context(), a, su)
+		if err != nil {
+			httpError(w, "", err, 400); return
+		}
+		writeJSON(k)
+	default:
+		http.Error(w, "not found", 404)
+	}
+}
+
+var wizardTpl = template.Must(template.New("wizard").Parse(`
+<!doctype html><html><head><meta charset="utf-8"><title>BizPulse · Upload wizard</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
+.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
+table{width:100%;border-collapse:collapse} th,td{border-bottom:1px solid #22305f;padding:6px;text-align:left}
+.muted{color:#9aa7cf} .err{color:#ff9a9a} a{color:#7aa2ff}
+button{background:#7aa2ff;color:#04102a;border:none;padding:8px 12px;border-radius:10px;cursor:pointer}</style>
+</head><body>
+<h1>Upload wizard</h1><p><a href="/">← Dashboard</a></p>
+{{if not .}}
+<div class="card"><h3>1. Choose file</h3>
+  <form method="POST" action="/wizard" enctype="multipart/form-data">
+    <input type="file" name="file" accept=".csv,.xlsx" required> <input name="sheet" placeholder="Sheet (xlsx)" size="14">
+    <button type="submit">Next</button>
+  </form></div>
+{{else}}
+<div class="card"><h3>2. Detected schema — {{.Name}}</h3>
+  <form method="POST" action="/wizard/columns">
+  <input type="hidden" name="id" value="{{.ID}}">
+  <table><thead><tr><th>Field</th><th>Bound column</th><th>Pin to</th></tr></thead><tbody>
+  {{$su := .}}{{range $f, $c := .Columns}}<tr><td>{{$f}}</td><td>{{if $c}}{{$c}}{{else}}<span class="muted">not found</span>{{end}}</td>
+  <td><select name="col_{{$f}}"><option value="">auto</option>{{$pin := index $su.Options.Columns $f}}{{range $su.Headers}}<option{{if eq . $pin}} selected{{end}}>{{.}}</option>{{end}}</select></td></tr>{{end}}
+  </tbody></table>
+  <button type="submit">Apply mapping</button></form>
+  <p>{{.Valid}} of {{.Rows}} rows valid · {{.Selected}} selected</p>
+  {{if .Errors}}<ul>{{range .Errors}}<li class="err">{{.}}</li>{{end}}</ul>{{end}}
+  <table><thead><tr><th>Date</th><th>Customer</th><th>Product</th><th>Amount</th><th>Status</th></tr></thead><tbody>
+  {{range .Sample}}<tr><td>{{.Date.Format "2006-01-02"}}</td><td>{{.Customer}}</td><td>{{.Product}}</td><td>{{printf "%.2f" .Amount}}</td><td>{{.Status}}</td></tr>{{end}}
+  </tbody></table></div>
+<div class="card"><h3>3. Options</h3>
+  <form method="POST" action="/wizard/analyze">
+    <input type="hidden" name="id" value="{{.ID}}">
+    From <input type="date" name="from" value="{{.Options.From}}"> To <input type="date" name="to" value="{{.Options.To}}"><br><br>
+    Exclude customers <input name="exclude_customers" placeholder="comma separated" size="30">
+    Exclude products <input name="exclude_products" placeholder="comma separated" size="30"><br><br>
+    <label><input type="checkbox" name="ai" value="1" {{if .Options.AI}}checked{{end}}> AI summary</label><br><br>
+    <button type="submit">4. Analyze</button>
+  </form></div>
+{{end}}
+</body></html>`))
+
+// handleWizardColumns applies the pinned columns chosen in step 2 and re-renders it.
+func handleWizardColumns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	su := getStaged(r.FormValue("id"))
+	if su == nil {
+		http.Error(w, "upload not found or expired", 404); return
+	}
+	cols := map[string]string{}
+	for _, f := range saleFields {
+		if v := r.FormValue("col_" + f); v != "" { cols[f] = v }
+	}
+	stagedMu.Lock()
+	su.Options.Columns = cols
+	su.remap()
+	su.refresh()
+	stagedMu.Unlock()
+	_ = wizardTpl.Execute(w, su)
+}
+
+// handleWizard renders step 1, or stages a posted file and renders steps 2–3.
+func handleWizard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		_ = wizardTpl.Execute(w, nil); return
+	}
+	if err := r.ParseMultipartForm(50 << 20); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", 400); return
+	}
+	defer f.Close()
+	records, err := readRecords(f, fh.Filename, r.FormValue("sheet"))
+	if err != nil {
+		httpError(w, "parse: ", err, 400); return
+	}
+	su, err := stageUpload(fh.Filename, records)
+	if err != nil {
+		httpError(w, "parse: ", err, 400); return
+	}
+	_ = wizardTpl.Execute(w, su)
+}
+
+func handleWizardAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	su := getStaged(r.FormValue("id"))
+	if su == nil {
+		http.Error(w, "upload not found or expired", 404); return
+	}
+	split := func(v string) []string {
+		var out []string
+		for _, x := range strings.Split(v, ",") {
+			if x = strings.TrimSpace(x); x != "" { out = append(out, x) }
+		}
+		return out
+	}
+	stagedMu.Lock()
+	su.Options = UploadOptions{From: r.FormValue("from"), To: r.FormValue("to"),
+		ExcludeCustomers: split(r.FormValue("exclude_customers")), ExcludeProducts: split(r.FormValue("exclude_products")),
+		AI: r.FormValue("ai") != "", Columns: su.Options.Columns}
+	stagedMu.Unlock()
+	a, err := uploadTarget(w, r, true)
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	if _, err := analyzeStaged(r.Context(), a, su); err != nil {
+		httpError(w, "", err, 400); return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// -------- Search --------
+
+const searchLimit = 20
+
+// SearchResult is one hit from /api/v1/search; URL opens its drill-down view.
+type SearchResult struct {
+	Kind   string // customer, product, date or anomaly
+	Label  string
+	Detail string
+	URL    string
+	rank   int // 0 exact, 1 prefix, 2 substring
+}
+
+// searchRank scores how name matches the lowercased query q, or -1 when it doesn't.
+func searchRank(name, q string) int {
+	n := strings.ToLower(name)
+	switch {
+	case n == q:
+		return 0
+	case strings.HasPrefix(n, q):
+		return 1
+	case strings.Contains(n, q):
+		return 2
+	}
+	return -1
+}
+
+// search finds customers, products, days and anomalies in a matching q. Dates match by
+// prefix ("2025-07" finds every July day) or by any format parseDateFlexible accepts.
+func search(a *Analysis, q string) []SearchResult {
+	q = strings.ToLower(strings.TrimSpace(q))
+	var out []SearchResult
+	for _, c := range customerRows(a.Sales) {
+		if rk := searchRank(c.Customer, q); rk >= 0 {
+			out = append(out, SearchResult{Kind: "customer", Label: c.Customer, rank: rk,
+				Detail: fmt.Sprintf("%s · %d orders", money(c.Revenue), c.Orders), URL: "/view?customer=" + url.QueryEscape(c.Customer)})
+		}
+	}
+	for _, p := range productRows(a.Sales) {
+		if rk := searchRank(p.Product, q); rk >= 0 {
+			out = append(out, SearchResult{Kind: "product", Label: p.Product, rank: rk,
+				Detail: fmt.Sprintf("%s · %d orders", money(p.Revenue), p.Orders), URL: "/view?product=" + url.QueryEscape(p.Product)})
+		}
+	}
+	day := ""
+	if d := parseDateFlexible(q); !d.IsZero() { day = d.Format("2006-01-02") }
+	dayRank := func(ds string) int {
+		if ds == day { return 0 }
+		if strings.HasPrefix(ds, q) { return 1 }
+		return -1
+	}
+	for _, d := range a.KPIs.DailyRevenue {
+		ds := d.Day.Format("2006-01-02")
+		if rk := dayRank(ds); rk >= 0 {
+			out = append(out, SearchResult{Kind: "date", Label: ds, rank: rk,
+				Detail: fmt.Sprintf("%s revenue", money(d.Value)), URL: "/view?date=" + ds})
+		}
+	}
+	for _, an := range a.KPIs.Anomalies {
+		ds := an.Day.Format("2006-01-02")
+		rk := dayRank(ds)
+		if rk < 0 && strings.HasPrefix("anomalies", q) { rk = 1 }
+		for _, c := range an.Campaigns {
+			if rk < 0 && strings.Contains(strings.ToLower(c), q) { rk = 2 }
+		}
+		if rk >= 0 {
+			out = append(out, SearchResult{Kind: "anomaly", Label: "Anomaly " + ds, rank: rk,
+				Detail: fmt.Sprintf("%s (z=%.2f)", money(an.Value), an.Z), URL: "/view?date=" + ds})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].rank < out[j].rank })
+	return out
+}
+
+// handleSearch serves GET /api/v1/search?q=&limit= over the caller's active dataset.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no data yet", 404); return
+	}
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "missing q", 400); return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 { limit = searchLimit }
+	res := search(a, q)
+	if len(res) > limit { res = res[:limit] }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+var drillTpl = template.Must(template.New("drill").Funcs(template.FuncMap{"money": money}).Parse(`
+<!doctype html><html><head><meta charset="utf-8"><title>BizPulse · {{.Title}}</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
+.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
+table{width:100%;border-collapse:collapse} th,td{border-bottom:1px solid #22305f;padding:6px;text-align:left}
+.muted{color:#9aa7cf} a{color:#7aa2ff}</style>
+</head><body>
+<h1>{{.Title}}</h1><p><a href="/">← Dashboard</a></p>
+{{with .Anomaly}}<div class="card"><b>⚠️ Anomaly</b> <span class="muted">— revenue {{money .Value}}, z={{printf "%.2f" .Z}}{{if .Campaigns}}, campaigns: {{range $i, $c := .Campaigns}}{{if $i}}, {{end}}{{$c}}{{end}}{{end}}</span></div>{{end}}
+<div class="card">
+  <b>{{money .Total}}</b> <span class="muted">across {{len .Rows}} orders</span>
+  <table><thead><tr><th>Date</th><th>Customer</th><th>Product</th><th>Amount</th><th>Status</th></tr></thead><tbody>
+  {{range .Rows}}<tr><td><a href="/view?date={{.Date.Format "2006-01-02"}}">{{.Date.Format "2006-01-02"}}</a></td>
+  <td><a href="/view?customer={{.Customer}}">{{.Customer}}</a></td><td><a href="/view?product={{.Product}}">{{.Product}}</a></td>
+  <td>{{money .Amount}}</td><td class="muted">{{.Status}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+</body></html>`))
+
+// handleDrill renders the rows behind one customer, product or day (/view?customer=|product=|date=).
+func handleDrill(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther); return
+	}
+	var data struct {
+		Title   string
+		Total   float64
+		Rows    []Sale
+		Anomaly *Anomaly
+	}
+	q := r.URL.Query()
+	var match func(s Sale) bool
+	switch {
+	case q.Get("customer") != "":
+		data.Title = "Customer: " + q.Get("customer")
+		match = func(s Sale) bool { return s.Customer == q.Get("customer") }
+	case q.Get("product") != "":
+		data.Title = "Product: " + q.Get("product")
+		match = func(s Sale) bool { return s.Product == q.Get("product") }
+	case q.Get("date") != "":
+		day := parseDateFlexible(q.Get("date"))
+		if day.IsZero() {
+			http.Error(w, "bad date", 400); return
+		}
+		ds := day.Format("2006-01-02")
+		data.Title = "Day: " + ds
+		match = func(s Sale) bool { return s.Date.Format("2006-01-02") == ds }
+		for i := range a.KPIs.Anomalies {
+			if a.KPIs.Anomalies[i].Day.Format("2006-01-02") == ds { data.Anomaly = &a.KPIs.Anomalies[i] }
+		}
+	case q.Get("category") != "":
+		data.Title = "Category: " + q.Get("category")
+		match = func(s Sale) bool { return nz(categoryOf(s), "Uncategorized") == q.Get("category") }
+	case q.Get("refunds") != "":
+		data.Title = "Refunds"
+		match = func(s Sale) bool { return s.Amount < 0 }
+	default:
+		http.Error(w, "pass customer, product, category, date or refunds", 400); return
+	}
+	for _, s := range a.Sales {
+		if match(s) {
+			data.Rows = append(data.Rows, s)
+			data.Total += s.Amount
+		}
+	}
+	sort.SliceStable(data.Rows, func(i, j int) bool { return data.Rows[i].Date.Before(data.Rows[j].Date) })
+	_ = drillTpl.Execute(w, data)
+}
+
+// -------- Snapshots --------
+
+// Snapshot is one published analysis of the shared dataset. Its artifacts are rendered
+// from the KPIs as they were at the time, so the URLs keep returning the exact report
+// for that run after newer uploads replace the dashboard. IDs are content hashes
+// (snapshotID), the same value served as the ETag of the API responses.
+//
+// Snapshot links are temporary: only the last snapshotHistory are kept, in memory, so
+// older ones and every one from before a restart answer 410 Gone.
+type Snapshot struct {
+	ID        string
+	Created   time.Time
+	From, To  time.Time
+	Artifacts []Artifact
+	kpis      KPIs
+}
+
+// Artifact is a file generated for a snapshot.
+type Artifact struct {
+	Name        string
+	ContentType string
+	URL         string
+}
+
+const snapshotHistory = 50 // snapshots kept in memory, oldest dropped first
+
+var snapshotIDRe = regexp.MustCompile(`^[0-9a-f]{16}$`) // the shape of a snapshotID
+
+var (
+	snapshotsMu sync.Mutex
+	snapshots   []*Snapshot // oldest first
+)
+
+// recordSnapshot keeps the shared analysis k under id; re-publishing identical
+// results keeps the original entry.
+func recordSnapshot(id string, k KPIs) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	for _, s := range snapshots {
+		if s.ID == id { return }
+	}
+	snapshots = append(snapshots, &Snapshot{ID: id, Created: time.Now(), From: k.From, To: k.To, Artifacts: snapshotArtifacts(id, k), kpis: k})
+	if len(snapshots) > snapshotHistory { snapshots = snapshots[len(snapshots)-snapshotHistory:] }
+}
+
+func getSnapshot(id string) *Snapshot {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	for _, s := range snapshots {
+		if s.ID == id { return s }
+	}
+	return nil
+}
+
+// snapshotArtifacts lists what renderArtifact can produce for k: the markdown report,
+// the revenue chart, the forecast-vs-actual chart and one PNG per anomaly.
+func snapshotArtifacts(id string, k KPIs) []Artifact {
+	base := "/api/v1/snapshots/" + id + "/artifacts/"
+	arts := []Artifact{
+		{Name: "report.md", ContentType: "text/markdown; charset=utf-8"},
+		{Name: "revenue.svg", ContentType: "image/svg+xml"},
+	}
+	if k.Forecast != nil {
+		arts = append(arts, Artifact{Name: "projection.svg", ContentType: "image/svg+xml"})
+	}
+	if t := k.ForecastTracking; t != nil && len(t.Days) > 0 {
+		arts = append(arts, Artifact{Name: "forecast.svg", ContentType: "image/svg+xml"})
+	}
+	for _, an := range k.Anomalies {
+		arts = append(arts, Artifact{Name: "anomaly-" + an.Day.Format("2006-01-02") + ".png", ContentType: "image/png"})
+	}
+	for i := range arts { arts[i].URL = base + arts[i].Name }
+	return arts
+}
+
+func renderArtifact(k KPIs, name string) []byte {
+	standalone := func(svg template.HTML) []byte {
+		return []byte(strings.Replace(string(svg), "<svg ", `<svg xmlns="http://www.w3.org/2000/svg" `, 1))
+	}
+	switch {
+	case name == "report.md":
+		return []byte(renderMarkdown(k, "day"))
+	case name == "revenue.svg":
+		l := ChartLayers{Events: k.Events, Anomalies: k.Anomalies}
+		if k.Forecast != nil { l.Forecast = k.Forecast.Days }
+		return standalone(revenueChart(k.DailyRevenue, l))
+	case name == "projection.svg" && k.Forecast != nil:
+		return standalone(k.Forecast.Chart)
+	case name == "forecast.svg" && k.ForecastTracking != nil:
+		return standalone(forecastChart(k.ForecastTracking.Days))
+	case strings.HasPrefix(name, "anomaly-") && strings.HasSuffix(name, ".png"):
+		day, err := time.Parse("2006-01-02", strings.TrimSuffix(strings.TrimPrefix(name, "anomaly-"), ".png"))
+		if err != nil { return nil }
+		for _, an := range k.Anomalies {
+			if an.Day.Equal(day) { return anomalyChart(k.DailyRevenue, day) }
+		}
+	}
+	return nil
+}
+
+// handleSnapshots serves /api/v1/snapshots, /api/v1/snapshots/{id},
+// /api/v1/snapshots/{id}/artifacts and /api/v1/snapshots/{id}/artifacts/{name}.
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/snapshots"), "/")
+	parts := strings.SplitN(rest, "/", 3)
+	writeJSON := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	if rest == "" {
+		snapshotsMu.Lock()
+		list := make([]Snapshot, 0, len(snapshots))
+		for i := len(snapshots) - 1; i >= 0; i-- { list = append(list, *snapshots[i]) }
+		snapshotsMu.Unlock()
+		writeJSON(list)
+		return
+	}
+	s := getSnapshot(parts[0])
+	if s == nil && snapshotIDRe.MatchString(parts[0]) {
+		http.Error(w, fmt.Sprintf("snapshot expired: only the last %d are kept, until the server restarts", snapshotHistory), http.StatusGone); return
+	}
+	if s == nil {
+		http.Error(w, "snapshot not found", 404); return
+	}
+	// Snapshots never change, so clients and proxies may cache them indefinitely.
+	immutable := func() { w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") }
+	switch {
+	case len(parts) == 1:
+		immutable()
+		writeJSON(s.kpis)
+	case parts[1] == "artifacts" && len(parts) == 2:
+		immutable()
+		writeJSON(s.Artifacts)
+	case parts[1] == "artifacts":
+		for _, a := range s.Artifacts {
+			if a.Name != parts[2] { continue }
+			immutable()
+			w.Header().Set("Content-Type", a.ContentType)
+			w.Write(renderArtifact(s.kpis, a.Name))
+			return
+		}
+		http.Error(w, "artifact not found", 404)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// -------- Close package --------
+
+// ClosePackage gathers what finance reviews at period end into one document: monthly
+// revenue, receivables aging, restatements, the biggest movements against the prior
+// period and data-quality issues still present in the period's rows.
+type ClosePackage struct {
+	Period       string // 2025-Q2 or 2025-06
+	From, To     time.Time
+	PrevFrom     time.Time // prior period of the same length, ending the day before From
+	AsOf         time.Time // last day with data; before To while the period is open
+	Revenue      float64
+	PrevRevenue  float64
+	Months       []KVt
+	Aging        []AgingBucket  // open (overdue/unpaid) invoices dated up to To
+	Restatements []Restatement  // restated days inside the period
+	Movements    []Movement     // accounts and products, largest absolute change first
+	Issues       []DataIssue
+}
+
+type AgingBucket struct {
+	Label  string
+	Count  int
+	Amount float64
+}
+
+type Movement struct {
+	Segment string // account or product
+	Key     string
+	Current float64
+	Prior   float64
+	Change  float64
+}
+
+type DataIssue struct {
+	Issue   string
+	Rows    int
+	Example string // first affected row
+}
+
+const closeMovementRows = 10 // movements listed in the close package
+
+var agingBuckets = []struct {
+	Label   string
+	MaxDays float64
+}{{"0-30 days", 30}, {"31-60 days", 60}, {"61-90 days", 90}, {"90+ days", math.Inf(1)}}
+
+// closePeriod resolves "quarter" or "" (the quarter holding asOf), "month", "2025-Q2" or
+// "2025-06" to its first and last day.
+func closePeriod(spec string, asOf time.Time) (label string, from, to time.Time, err error) {
+	y, m := asOf.Year(), asOf.Month()
+	quarter := func(y, q int) (string, time.Time, time.Time, error) {
+		from := time.Date(y, time.Month(q*3-2), 1, 0, 0, 0, 0, time.UTC)
+		return fmt.Sprintf("%d-Q%d", y, q), from, from.AddDate(0, 3, -1), nil
+	}
+	month := func(y int, m time.Month) (string, time.Time, time.Time, error) {
+		from := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		return from.Format("2006-01"), from, from.AddDate(0, 1, -1), nil
+	}
+	up := strings.ToUpper(strings.TrimSpace(spec))
+	switch up {
+	case "", "QUARTER":
+		return quarter(y, (int(m)+2)/3)
+	case "MONTH":
+		return month(y, m)
+	}
+	var q int
+	if n, _ := fmt.Sscanf(up, "%d-Q%d", &y, &q); n == 2 && q >= 1 && q <= 4 { return quarter(y, q) }
+	if t, err := time.Parse("2006-01", up); err == nil { return month(t.Year(), t.Month()) }
+	return "", time.Time{}, time.Time{}, fmt.Errorf("invalid close period %q (want quarter, month, 2025-Q2 or 2025-06)", spec)
+}
+
+func closePackage(sales []Sale, restated []Restatement, spec string) (*ClosePackage, error) {
+	if len(sales) == 0 { return nil, fmt.Errorf("no sales loaded") }
+	asOf := sales[0].Date
+	for _, s := range sales {
+		if s.Date.After(asOf) { asOf = s.Date }
+	}
+	label, from, to, err := closePeriod(spec, asOf)
+	if err != nil { return nil, err }
+	cp := &ClosePackage{Period: label, From: from, To: to, PrevFrom: from.AddDate(0, -int(monthsBetween(from, to)), 0), AsOf: asOf}
+	if asOf.After(to) { cp.AsOf = to }
+	in := func(d, a, b time.Time) bool { return !d.Before(a) && !d.After(b) }
+	prevTo := from.AddDate(0, 0, -1)
+	cur, prev := map[[2]string]float64{}, map[[2]string]float64{}
+	months := map[time.Time]float64{}
+	invoices := map[string]int{}
+	issues := map[string]*DataIssue{}
+	var issueOrder []string
+	note := func(issue string, s Sale) {
+		if issues[issue] == nil {
+			issues[issue] = &DataIssue{Issue: issue, Example: fmt.Sprintf("%s %s / %s %s", s.Date.Format("2006-01-02"), nz(s.RawCustomer, s.Customer), s.Product, money(s.Amount))}
+			issueOrder = append(issueOrder, issue)
+		}
+		issues[issue].Rows++
+	}
+	cp.Aging = make([]AgingBucket, len(agingBuckets))
+	for i, b := range agingBuckets { cp.Aging[i].Label = b.Label }
+	for _, s := range sales {
+		if isOverdue(s.Status) && !s.Date.After(to) {
+			b := &cp.Aging[agingBucket(math.Max(0, receivableAge(s, cp.AsOf)))]
+			b.Count++; b.Amount += s.Amount
+		}
+		switch {
+		case in(s.Date, cp.PrevFrom, prevTo):
+			cp.PrevRevenue += s.Amount
+			prev[[2]string{"account", accountOf(s.Customer)}] += s.Amount
+			prev[[2]string{"product", s.Product}] += s.Amount
+		case in(s.Date, from, to):
+			cp.Revenue += s.Amount
+			months[periodStart(s.Date, "month")] += s.Amount
+			cur[[2]string{"account", accountOf(s.Customer)}] += s.Amount
+			cur[[2]string{"product", s.Product}] += s.Amount
+			if s.Customer == "Unknown" { note("Missing customer", s) }
+			if s.Product == "Unknown" { note("Missing product", s) }
+			if s.Amount == 0 { note("Zero or unparseable amount", s) }
+			if s.Amount < 0 { note("Negative amount (credit or refund to confirm)", s) }
+			if s.Invoice != "" {
+				invoices[s.Invoice]++
+				if invoices[s.Invoice] == 2 { note("Duplicate invoice number", s) }
+			}
+		}
+	}
+	for d := from; !d.After(cp.AsOf); d = d.AddDate(0, 1, 0) {
+		cp.Months = append(cp.Months, KVt{Day: d, Value: months[d]})
+	}
+	for _, r := range restated {
+		if in(r.Day, from, to) { cp.Restatements = append(cp.Restatements, r) }
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok { cur[k] = 0 }
+	}
+	for k, v := range cur {
+		if v == prev[k] { continue }
+		cp.Movements = append(cp.Movements, Movement{Segment: k[0], Key: k[1], Current: v, Prior: prev[k], Change: v - prev[k]})
+	}
+	sort.Slice(cp.Movements, func(i, j int) bool {
+		a, b := math.Abs(cp.Movements[i].Change), math.Abs(cp.Movements[j].Change)
+		if a != b { return a > b }
+		return cp.Movements[i].Key < cp.Movements[j].Key
+	})
+	if len(cp.Movements) > closeMovementRows { cp.Movements = cp.Movements[:closeMovementRows] }
+	for _, name := range issueOrder { cp.Issues = append(cp.Issues, *issues[name]) }
+	return cp, nil
+}
+
+func monthsBetween(from, to time.Time) int {
+	return (to.Year()-from.Year())*12 + int(to.Month()-from.Month()) + 1
+}
+
+func renderClosePackage(cp *ClosePackage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# BizPulse Close Package — %s\n\n", cp.Period)
+	fmt.Fprintf(&b, "Period: %s → %s. Prior period: %s → %s.\n\n", cp.From.Format("2006-01-02"), cp.To.Format("2006-01-02"), cp.PrevFrom.Format("2006-01-02"), cp.From.AddDate(0, 0, -1).Format("2006-01-02"))
+	check := func(done bool, text string) {
+		box := "[ ]"
+		if done { box = "[x]" }
+		fmt.Fprintf(&b, "- %s %s\n", box, text)
+	}
+	over90 := cp.Aging[len(cp.Aging)-1].Amount
+	fmt.Fprintf(&b, "## Checklist\n")
+	check(!cp.AsOf.Before(cp.To), fmt.Sprintf("Data covers the full period (last day with data: %s)", cp.AsOf.Format("2006-01-02")))
+	check(len(cp.Restatements) == 0, fmt.Sprintf("Restated days reviewed (%d in period)", len(cp.Restatements)))
+	check(over90 == 0, fmt.Sprintf("Receivables over 90 days followed up (%s)", money(over90)))
+	check(len(cp.Issues) == 0, fmt.Sprintf("Data-quality issues resolved (%d open)", len(cp.Issues)))
+	fmt.Fprintln(&b)
+
+	fmt.Fprintf(&b, "## Revenue by Month\n")
+	for _, m := range cp.Months {
+		fmt.Fprintf(&b, "- %s: %s\n", m.Day.Format("2006-01"), money(m.Value))
+	}
+	fmt.Fprintf(&b, "- **Total:** %s", money(cp.Revenue))
+	if cp.PrevRevenue > 0 { fmt.Fprintf(&b, " (%+.1f%% vs prior %s)", (cp.Revenue/cp.PrevRevenue-1)*100, money(cp.PrevRevenue)) }
+	fmt.Fprintf(&b, "\n\n")
+
+	fmt.Fprintf(&b, "## AR Aging (as of %s)\n", cp.AsOf.Format("2006-01-02"))
+	fmt.Fprintf(&b, "| Age | Invoices | Amount |\n|---|---:|---:|\n")
+	for _, a := range cp.Aging {
+		fmt.Fprintf(&b, "| %s | %d | %s |\n", a.Label, a.Count, money(a.Amount))
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintf(&b, "## Restatements\n")
+	if len(cp.Restatements) == 0 { fmt.Fprintf(&b, "None recorded for days in this period.\n") }
+	for _, r := range cp.Restatements {
+		fmt.Fprintf(&b, "- %s: %s → %s (%+.2f), changed %s\n", r.Day.Format("2006-01-02"), money(r.Old), money(r.New), r.Delta, r.ChangedAt.Format("2006-01-02 15:04"))
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintf(&b, "## Top Movements vs Prior Period\n")
+	if len(cp.Movements) == 0 { fmt.Fprintf(&b, "No changes.\n") }
+	for _, m := range cp.Movements {
+		fmt.Fprintf(&b, "- %s %s: %s → %s (%s%s)\n", m.Segment, m.Key, money(m.Prior), money(m.Current), map[bool]string{true: "+", false: "-"}[m.Change >= 0], money(math.Abs(m.Change)))
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintf(&b, "## Data-Quality Issues\n")
+	if len(cp.Issues) == 0 { fmt.Fprintf(&b, "None found in the period's rows.\n") }
+	for _, i := range cp.Issues {
+		fmt.Fprintf(&b, "- %s: %d row(s), e.g. %s\n", i.Issue, i.Rows, i.Example)
+	}
+	return b.String()
+}
+
+// handleClose returns the close package for ?period= (default: the latest quarter) as
+// JSON, or as a Markdown download with ?format=md.
+func handleClose(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	var restated []Restatement
+	if a.Dataset == defaultDataset { restated = restatements() }
+	cp, err := closePackage(a.Sales, restated, r.URL.Query().Get("period"))
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	if r.URL.Query().Get("format") == "md" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=close-%s.md", cp.Period))
+		io.WriteString(w, renderClosePackage(cp))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cp)
+}
+
+// runClose writes close-<period>.md for the CLI's -close flag.
+func runClose(ctx context.Context, paths, sheet, spec string) error {
+	sales, _, err := loadSources(ctx, paths, sheet)
+	if err != nil { return err }
+	cp, err := closePackage(sales, nil, spec)
+	if err != nil { return err }
+	name := "close-" + cp.Period + ".md"
+	if err := os.WriteFile(name, []byte(renderClosePackage(cp)), 0644); err != nil { return err }
+	fmt.Println("Wrote " + name)
+	return nil
+}
+
+// -------- Split reports --------
+
+// -split-by=product|customer|region writes one report per value of that column
+// (report-<value>.md), each analyzed from that segment's rows alone, so a product manager
+// can be sent just their product. With -split-combined the segments are chapters of a
+// single report.md instead. Rows with no value are grouped under "(none)".
+var splitFields = []string{"product", "customer", "region"}
+
+// splitSales groups sales by field, returning the values by revenue, highest first.
+func splitSales(sales []Sale, field string) ([]string, map[string][]Sale) {
+	groups := map[string][]Sale{}
+	revenue := map[string]float64{}
+	for _, s := range sales {
+		v := strings.TrimSpace(fmt.Sprint(saleColumn(s, field)))
+		if v == "" { v = "(none)" }
+		groups[v] = append(groups[v], s)
+		revenue[v] += s.Amount
+	}
+	values := make([]string, 0, len(groups))
+	for v := range groups { values = append(values, v) }
+	sort.Slice(values, func(i, j int) bool {
+		if revenue[values[i]] != revenue[values[j]] { return revenue[values[i]] > revenue[values[j]] }
+		return values[i] < values[j]
+	})
+	return values, groups
+}
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slugify turns a segment value into a file name part: "Acme Corp." -> "acme-corp".
+func slugify(v string) string { return nz(strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(v), "-"), "-"), "none") }
+
+// chapter rewrites a report as a chapter titled title: the report heading is replaced
+// and every other heading moves down a level.
+func chapter(md, title string) string {
+	lines := strings.Split(md, "\n")
+	lines[0] = "## " + title
+	for i := 1; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "#") { lines[i] = "#" + lines[i] }
+	}
+	return strings.Join(lines, "\n")
+}
+
+func runSplit(ctx context.Context, paths, sheet, field string, combined bool, granularity string) error {
+	ok := false
+	for _, f := range splitFields { ok = ok || f == field }
+	if !ok { return fmt.Errorf("-split-by must be one of %s", strings.Join(splitFields, ", ")) }
+	if _, err := seriesFor(&KPIs{}, granularity); err != nil { return err }
+	sales, _, err := loadSources(ctx, paths, sheet)
+	if err != nil { return err }
+	if len(sales) == 0 { return fmt.Errorf("%w in %s", errNoDatedRows, paths) }
+	values, groups := splitSales(sales, field)
+	total, err := analyze(ctx, defaultDataset, sales, nil, nil)
+	if err != nil { return err }
+	var all strings.Builder
+	fmt.Fprintf(&all, "# BizPulse Report by %s (%s → %s)\n\n", field, total.From.Format("2006-01-02"), total.To.Format("2006-01-02"))
+	reports := make([]KPIs, len(values))
+	for i, v := range values {
+		if reports[i], err = analyze(ctx, defaultDataset, groups[v], nil, nil); err != nil { return err }
+		share := 0.0
+		if total.TotalRevenue != 0 { share = reports[i].TotalRevenue / total.TotalRevenue }
+		fmt.Fprintf(&all, "- %s: %s (%.0f%%), %d orders\n", v, money(reports[i].TotalRevenue), share*100, reports[i].Orders)
+	}
+	fmt.Fprintln(&all)
+	used := map[string]bool{}
+	for i, v := range values {
+		if ctx.Err() != nil { return ctx.Err() }
+		md, title := renderMarkdown(reports[i], granularity), strings.ToUpper(field[:1])+field[1:]+": "+v
+		if combined {
+			fmt.Fprintf(&all, "%s\n", chapter(md, title))
+			continue
+		}
+		md = strings.Replace(md, "# BizPulse Report (", "# BizPulse Report — "+title+" (", 1)
+		slug := slugify(v)
+		for n := 2; used[slug]; n++ { slug = fmt.Sprintf("%s-%d", slugify(v), n) }
+		used[slug] = true
+		name := "report-" + slug + ".md"
+		if err := os.WriteFile(name, []byte(md), 0644); err != nil { return err }
+		fmt.Println("Wrote " + name)
+	}
+	if !combined { return nil }
+	if err := os.WriteFile("report.md", []byte(all.String()), 0644); err != nil { return err }
+	fmt.Printf("Wrote report.md (%d %s chapters)\n", len(values), field)
+	return nil
+}
+
+// -------- HTML + API + CLI --------
+
+// templateFuncs are callable from the dashboard and its partials. They are bound before
+// parsing, so a template naming an unknown func fails at startup, not mid-request.
+var templateFuncs = template.FuncMap{
+	"svgSpark": svgSpark,
+	"revenueChart": func(d []KVt, k *KPIs, overlays []SeriesOverlay) template.HTML {
+		l := ChartLayers{Events: k.Events, Overlays: overlays, Anomalies: k.Anomalies}
+		if k.Forecast != nil { l.Forecast = k.Forecast.Days }
+		return revenueChart(d, l)
+	},
+	"mul100": mul100,
+	"inc": inc,
+	"paramList": paramList,
+	"money": money,
+	"demo": func() bool { return demoMode },
+	"contact": contactFor,
+	"svgWaterfall": svgWaterfall,
+}
+
+// Partials the dashboard includes, empty by default: "head" (inside <head>, e.g. brand
+// CSS or a favicon), "header" (above the title) and "footer". Branding overrides them
+// with {{define}} blocks in *.tmpl files under the config's templates directory.
+const defaultPartials = `{{define "head"}}{{end}}{{define "header"}}{{end}}{{define "footer"}}{{end}}`
+
+var tpl *template.Template // built in main, after funcs are registered and the config is read
+
+// RegisterTemplateFunc makes fn callable as name from the dashboard and partials. Call it
+// from an init func (main builds the template after); names already taken are rejected so
+// a built-in can't be replaced by accident.
+func RegisterTemplateFunc(name string, fn interface{}) error {
+	if _, ok := templateFuncs[name]; ok { return fmt.Errorf("template func %q already registered", name) }
+	templateFuncs[name] = fn
+	return nil
+}
+
+// dashboardTemplate parses the dashboard with the registered funcs, then the default
+// partials, then any *.tmpl overrides in dir.
+func dashboardTemplate(dir string) (*template.Template, error) {
+	t, err := template.New("page").Funcs(templateFuncs).Parse(dashboardHTML)
+	if err != nil { return nil, err }
+	if _, err := t.Parse(defaultPartials); err != nil { return nil, err }
+	if dir == "" { return t, nil }
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil { return nil, err }
+	if len(files) == 0 { return nil, fmt.Errorf("templates: no *.tmpl files in %s", dir) }
+	if _, err := t.ParseFiles(files...); err != nil { return nil, fmt.Errorf("templates: %w", err) }
+	return t, nil
+}
+
+const dashboardHTML = `
+<!doctype html><html><head>
+<meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1">
+<title>BizPulse</title>
+<style>
+body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
+.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
+h1{margin:0 0 10px 0} .muted{color:#9aa7cf} table{width:100%;border-collapse:collapse}
+th,td{border-bottom:1px solid #22305f;padding:8px;vertical-align:top}
+.badge{display:inline-block;background:#1b2a59;padding:4px 8px;border-radius:8px;margin-right:6px}
+svg{max-width:100%}
+button{background:#7aa2ff;color:#04102a;border:none;padding:8px 12px;border-radius:10px;cursor:pointer}
+input[type=file]{margin-top:8px}
+</style>
+{{if demo}}<style>body::after{content:"DEMO";position:fixed;right:24px;bottom:12px;font-size:72px;font-weight:800;color:#7aa2ff;opacity:.12;pointer-events:none}</style>{{end}}
+{{if .Export}}<base href="{{.ExportBase}}">{{end}}
+{{template "head" .}}
+</head><body>
+{{template "header" .}}
+<h1>BizPulse</h1>
+{{if demo}}<div class="card"><b>Demo</b> <span class="muted">— generated sample data. Uploads, changes and outbound alerts are disabled.</span></div>{{end}}
+{{if .Export}}<div class="card"><b>Snapshot</b> <span class="muted">— dataset {{.Dataset}}{{if .RangeQuery}}, {{.From}} → {{.To}}{{end}}, exported {{.ExportedAt.Format "2006-01-02 15:04 MST"}}. Links open <a href="{{.ExportBase}}" style="color:#7aa2ff">{{.ExportBase}}</a>.</span></div>
+{{else}}<p class="muted"><a href="/wizard" style="color:#7aa2ff">Upload wizard</a> · <a href="/aliases" style="color:#7aa2ff">Manage customer aliases</a> · <a href="/outbound" style="color:#7aa2ff">Outbound audit</a> · <a href="/alert-rules" style="color:#7aa2ff">Alert rules</a> · <a href="/api/docs" style="color:#7aa2ff">API</a>{{if .KPIs}} · <a href="/export/xlsx" style="color:#7aa2ff">Download Excel</a> · Clean data <a href="/export/clean?format=csv{{with .From}}&from={{.}}{{end}}{{with .To}}&to={{.}}{{end}}" style="color:#7aa2ff">CSV</a> / <a href="/export/clean?format=parquet{{with .From}}&from={{.}}{{end}}{{with .To}}&to={{.}}{{end}}" style="color:#7aa2ff">Parquet</a> · <a href="/export/html?granularity={{.Granularity}}{{with .From}}&from={{.}}{{end}}{{with .To}}&to={{.}}{{end}}" style="color:#7aa2ff">Download HTML snapshot</a>{{end}}</p>{{end}}
+{{if and .KPIs (not .Export)}}
+<div class="card" style="position:relative">
+  <input id="search" placeholder="Search customers, products, dates, anomalies…  ( / )" autocomplete="off"
+    style="width:100%;padding:8px;border-radius:10px;border:1px solid #203063;background:#0b1020;color:#e8ecff">
+  <div id="hits"></div>
+</div>
+<script>
+(function(){
+  var box = document.getElementById('search'), hits = document.getElementById('hits'), items = [], sel = -1, timer;
+  function render(){
+    hits.innerHTML = '';
+    items.forEach(function(h, i){
+      var a = document.createElement('a');
+      a.href = h.URL; a.style.display = 'block'; a.style.padding = '6px'; a.style.color = '#e8ecff';
+      a.style.background = i === sel ? '#1b2a59' : 'transparent';
+      a.textContent = h.Kind + ' · ' + h.Label + ' — ' + h.Detail;
+      hits.appendChild(a);
+    });
+  }
+  box.addEventListener('input', function(){
+    clearTimeout(timer);
+    timer = setTimeout(function(){
+      if (!box.value.trim()) { items = []; render(); return; }
+      fetch('/api/v1/search?q=' + encodeURIComponent(box.value)).then(function(r){ return r.ok ? r.json() : []; })
+        .then(function(res){ items = res || []; sel = items.length ? 0 : -1; render(); });
+    }, 150);
+  });
+  box.addEventListener('keydown', function(e){
+    if (e.key === 'ArrowDown') { sel = Math.min(sel + 1, items.length - 1); render(); e.preventDefault(); }
+    else if (e.key === 'ArrowUp') { sel = Math.max(sel - 1, 0); render(); e.preventDefault(); }
+    else if (e.key === 'Enter' && items[sel]) { location.href = items[sel].URL; }
+    else if (e.key === 'Escape') { box.value = ''; items = []; render(); box.blur(); }
+  });
+  document.addEventListener('keydown', function(e){
+    if (e.key === '/' && document.activeElement !== box && !/INPUT|TEXTAREA/.test(document.activeElement.tagName)) { box.focus(); e.preventDefault(); }
+  });
+})();
+</script>
+{{end}}
+{{if and .Session (not .Export)}}
+<div class="card"><b>🔒 Viewing your private session upload</b> <span class="muted">— other users still see the shared data.</span>
+  <form method="POST" action="/session/reset" style="display:inline"><button type="submit">Back to shared data</button></form></div>
+{{end}}
+{{if and (gt (len .Workspaces) 1) (not .Export)}}
+<div class="card"><form method="GET" action="/" style="display:inline"><b>Workspace</b>
+  <select name="dataset" onchange="this.form.submit()">{{range .Workspaces}}<option value="{{.}}"{{if eq . $.Dataset}} selected{{end}}>{{.}}</option>{{end}}</select>
+  <noscript><button type="submit">Switch</button></noscript></form>
+  <span class="muted">— each workspace keeps its own data; uploads go to the one selected</span></div>
+{{end}}
+{{range .Freshness}}{{if .Stale}}
+<div class="card"><b>⚠️ Dataset "{{.Dataset}}" is stale</b>
+  <span class="muted">— last ingest {{if .LastIngest.IsZero}}never{{else}}{{.LastIngest.Format "2006-01-02 15:04"}}{{end}}, expected every {{.ExpectedEvery}}</span></div>
+{{end}}{{end}}
+{{if and (not demo) (ne .Role "viewer") (not .Export)}}
+<div class="card">
+  <h3>Upload CSV / Excel</h3>
+  <form id="upload" method="POST" action="/upload" enctype="multipart/form-data">
+    <input type="file" name="file" accept=".csv,.xlsx" multiple required>
+    <input name="sheet" placeholder="Sheet (xlsx, optional)" size="18">
+    <label class="muted">Workspace <input name="dataset" value="{{.Dataset}}" list="workspaces" size="12" title="A new name creates a workspace"></label>
+    <datalist id="workspaces">{{range .Workspaces}}<option value="{{.}}">{{end}}</datalist>
+    <label class="muted">Business type <select name="preset" title="Tunes suggestions and KPIs for the workspace">
+      <option value="">{{.Preset.Label}}</option>{{range .Presets}}{{if ne .Name $.Preset.Name}}<option value="{{.Name}}">{{.Label}}</option>{{end}}{{end}}</select></label>
+    <label class="muted">Leads (optional) <input type="file" name="leads"></label>
+    <label class="muted">Campaign spend (optional) <input type="file" name="spend"></label>
+    <label class="muted">Contacts (optional) <input type="file" name="contacts"></label>
+    <label class="muted">Events (optional) <input type="file" name="events"></label>
+    <label class="muted"><input type="checkbox" name="append" value="1"> Append to current data</label>
+    <label class="muted"><input type="checkbox" name="merge" value="1"> Merge &amp; skip duplicates</label>
+    <button type="submit">Analyze</button>
+    <span id="upload-status" class="muted"></span> <progress id="upload-bar" max="100" hidden></progress>
+  </form>
+  <script>
+  (function(){
+    var form = document.getElementById('upload'), status = document.getElementById('upload-status'), bar = document.getElementById('upload-bar');
+    function show(text, pct){
+      status.textContent = text;
+      bar.hidden = false;
+      if (pct == null) bar.removeAttribute('value'); else bar.value = pct;
+    }
+    function poll(id){
+      fetch('/api/jobs/' + id).then(function(r){ return r.json(); }).then(function(j){
+        var p = j.Progress;
+        if (j.Status === 'done') { location.reload(); return; }
+        if (j.Status === 'failed') { bar.hidden = true; status.textContent = 'Failed: ' + j.Error; return; }
+        if (j.Status === 'analyzing') show('Analyzing ' + p.Rows.toLocaleString() + ' rows…', null);
+        else show('Parsing ' + (p.File || j.Files.join(', ')) + ': ' + p.Rows.toLocaleString() + ' rows', p.Total ? Math.round(p.Bytes / p.Total * 100) : null);
+        setTimeout(function(){ poll(id); }, 700);
+      });
+    }
+    form.addEventListener('submit', function(e){
+      e.preventDefault();
+      var xhr = new XMLHttpRequest();
+      xhr.open('POST', form.action);
+      xhr.setRequestHeader('Accept', 'application/json');
+      xhr.upload.onprogress = function(ev){ if (ev.lengthComputable) show('Uploading…', Math.round(ev.loaded / ev.total * 100)); };
+      xhr.onload = function(){
+        if (xhr.status >= 300) { bar.hidden = true; status.textContent = xhr.responseText; return; }
+        poll(JSON.parse(xhr.responseText).ID);
+      };
+      xhr.onerror = function(){ bar.hidden = true; status.textContent = 'Upload failed'; };
+      xhr.send(new FormData(form));
+    });
+  })();
+  </script>
+  {{with .Columns}}<p class="muted">Columns bound: {{.}}</p>{{end}}
+  {{range .Quality}}<details class="muted"><summary>Data quality — {{.File}}: {{.Summary}}</summary>
+    {{range .Examples}}<div>Row {{.Row}}: {{.Reason}}{{with .Value}} ({{.}}){{end}}</div>{{end}}
+    {{with .Gaps}}<div>No rows:{{range .}} <span class="badge">{{.From.Format "2006-01-02"}} → {{.To.Format "2006-01-02"}} ({{.Days}}d)</span>{{end}}</div>{{end}}
+    {{with .Unbound}}<div>No column for: {{range $i, $f := .}}{{if $i}}, {{end}}{{$f}}{{end}}</div>{{end}}
+    {{with .Unused}}<div>Columns not used: {{range $i, $h := .}}{{if $i}}, {{end}}{{$h}}{{end}}</div>{{end}}
+    {{with .DateOrder}}<div>Dates read: {{.}}</div>{{end}}
+  </details>{{end}}
+  {{with .Merge}}<p class="muted">Last merge {{.When.Format "2006-01-02 15:04"}}: {{.Files}} file(s), <b>{{.Added}}</b> rows added, <b>{{.Skipped}}</b> duplicates skipped</p>{{end}}
+  <p class="muted">Columns: date, customer, product, amount, status, optional invoice (flexible order)</p>
+</div>
+{{end}}
+
+{{if .KPIs}}
+{{with .KPIs.Forecast}}
+<div class="card">
+  <h3>Forecast (next {{len .Days}} days)</h3>
+  <p class="muted">{{if eq .Method "holt-winters"}}Holt-Winters, weekly seasonality (α={{printf "%.2f" .Alpha}}, β={{printf "%.2f" .Beta}}, γ={{printf "%.2f" .Gamma}}){{else}}Trailing average (under two weeks of history){{end}} · solid: actual · dashed: forecast · shaded: ~95% band</p>
+  {{with .Capped}}{{if .Days}}<p class="muted">Inputs winsorized at the {{printf "%.0f" (mul100 .Percentile)}}th percentile: {{len .Days}} day(s) held to {{money .Low}} – {{money .High}} ({{money .Adjustment}}){{range .Days}} <span class="badge">{{.Day.Format "2006-01-02"}} {{money .Value}}</span>{{end}}</p>{{end}}{{end}}
+  {{with .Holidays}}<p class="muted">Holidays &amp; promotions:{{range .}} <span class="badge">{{.Title}} ×{{printf "%.2f" .Factor}} {{if .Occurrences}}({{.Occurrences}} past){{else}}({{.Kind}} average){{end}}{{range .Days}} · {{.Format "Jan 2"}}{{end}}</span>{{end}}</p>{{end}}
+  {{.Chart}}
+  <table><thead><tr><th>Day</th><th>Forecast</th><th>Low</th><th>High</th></tr></thead><tbody>
+  {{range .Days}}<tr><td>{{.Day.Format "Mon 2006-01-02"}}</td><td>{{money .Value}}</td><td class="muted">{{money .Low}}</td><td class="muted">{{money .High}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{with .KPIs.ForecastTracking}}
+<div class="card">
+  <h3>Forecast vs Actual</h3>
+  <p class="muted">Dashed: forecast · solid: actual · band ±{{printf "%.0f" (mul100 .Band)}}% · MAPE {{printf "%.0f" (mul100 .MAPE)}}%</p>
+  {{.Chart}}
+  <table><thead><tr><th>Week of</th><th>Forecast</th><th>Actual</th><th>Error</th></tr></thead><tbody>
+  {{range .Weeks}}<tr><td>{{.Day.Format "2006-01-02"}}</td><td>{{money .Forecast}}</td><td>{{money .Actual}}</td><td>{{if .Breach}}⚠️ {{end}}{{printf "%+.0f" (mul100 .Error)}}%</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+{{with .KPIs.Health}}
+<div class="card">
+  <h3>Business Health</h3>
+  <div style="font-size:48px;font-weight:700">{{printf "%.0f" .Score}}<span class="muted" style="font-size:18px"> / 100 · {{.Grade}}</span></div>
+  <details><summary class="muted">Breakdown</summary>
+  <table><thead><tr><th>Component</th><th>Score</th><th>Weight</th><th></th></tr></thead><tbody>
+  {{range .Components}}<tr><td>{{.Name}}</td><td>{{printf "%.0f" .Score}}</td><td>{{printf "%.0f" (mul100 .Weight)}}%</td><td class="muted">{{.Detail}}</td></tr>{{end}}
+  </tbody></table></details>
+</div>
+{{end}}
+
+{{if .KPIs.Insufficient}}
+<div class="card">
+  <h3>Insufficient data</h3>
+  {{if .KPIs.Orders}}<p class="muted">{{.KPIs.Days}} day(s) with sales loaded. Totals and top lists are complete; these sections are left out until there is more history:</p>
+  <ul>{{range $section, $why := .KPIs.Insufficient}}<li>{{$section}} — <span class="muted">{{$why}}</span></li>{{end}}</ul>
+  {{else}}<p class="muted">No rows with a usable date were loaded. Check the date column and upload again.</p>{{end}}
+</div>
+{{end}}
+<div class="card">
+  <h3>KPIs{{if .KPIs.Orders}} ({{.KPIs.From.Format "2006-01-02"}} → {{.KPIs.To.Format "2006-01-02"}}){{end}}</h3>
+  {{if not .Export}}<form method="get" action="/" class="muted">Date range: <input type="date" name="from" value="{{.From}}"> → <input type="date" name="to" value="{{.To}}">
+  <input type="hidden" name="granularity" value="{{.Granularity}}"> <button type="submit">Apply</button>{{if .RangeQuery}} <a href="/" style="color:#7aa2ff">All dates</a>{{end}}
+  {{with .RangeError}}<span style="color:#ff8080">{{.}}</span>{{end}}</form>{{end}}
+  <div class="badge">Revenue: {{money .KPIs.TotalRevenue}}</div>
+  <div class="badge">Orders: {{.KPIs.Orders}}</div>
+  {{if .Preset.Shows "aov"}}<div class="badge">AOV: {{money .KPIs.AvgOrderValue}}</div>{{end}}
+  {{if .Preset.Shows "customers"}}<div class="badge">Unique Customers: {{.KPIs.UniqueCustomers}}</div>{{end}}
+  {{if .Preset.Shows "retention"}}<div class="badge">Retention: {{if index .KPIs.Insufficient "retention"}}n/a{{else}}{{printf "%.1f" (mul100 .KPIs.RetentionRate)}}%{{end}}</div>{{end}}
+  {{if .Preset.Shows "forecast"}}<div class="badge">Forecast 7d: {{if index .KPIs.Insufficient "forecast"}}n/a{{else}}{{money .KPIs.ForecastNext7DaysTotal}}{{end}}</div>{{end}}
+  {{range .KPIs.Comparisons}}
+  <div class="badge" title="{{.From.Format "2006-01-02"}} → {{.To.Format "2006-01-02"}} vs {{.PrevFrom.Format "2006-01-02"}} → {{.PrevTo.Format "2006-01-02"}}: {{money .Revenue}} vs {{money .PrevRevenue}}; {{.Method}}{{if .Excluded}}, {{.Excluded}} holiday day(s) left out{{end}}">{{.Label}}: {{if .PrevRevenue}}<span style="color:{{if lt .Change 0.0}}#ff8080">▼{{else}}#7bd88f">▲{{end}} {{printf "%+.1f" (mul100 .Change)}}%</span>{{if ne .Method "same dates"}} <span class="muted" style="font-size:12px">{{.Method}}</span>{{end}}{{else}}<span class="muted">no prior revenue</span>{{end}}</div>
+  {{end}}
+  {{with .KPIs.Momentum}}
+  <div class="badge">Momentum: {{.Label}} · 7d/28d {{printf "%.2f" .RunRateRatio}}×</div>
+  {{if .Velocity}}<div class="badge">Run rate Δ7d: {{printf "%+.2f" .Velocity}} · accel {{printf "%+.2f" .Acceleration}}</div>{{end}}
+  {{if .GrowthStreak}}<div class="badge">Growth streak: {{.GrowthStreak}}d (best {{.LongestGrowthStreak}}d)</div>{{end}}
+  {{end}}
+</div>
+
+<div class="card">
+  <h3>{{.SeriesTitle}} Revenue {{if not .Export}}<span class="muted" style="font-size:14px">· <a href="/?granularity=day{{with $.From}}&from={{.}}{{end}}{{with $.To}}&to={{.}}{{end}}" style="color:#7aa2ff">day</a> · <a href="/?granularity=week{{with $.From}}&from={{.}}{{end}}{{with $.To}}&to={{.}}{{end}}" style="color:#7aa2ff">week</a> · <a href="/?granularity=month{{with $.From}}&from={{.}}{{end}}{{with $.To}}&to={{.}}{{end}}" style="color:#7aa2ff">month</a></span>{{end}}</h3>
+  <div id="rev-chart" style="position:relative">{{ revenueChart .Series .KPIs .Overlays }}</div>
+  <p class="muted" style="font-size:12px">Hover for values{{if not .Export}}; drag across the chart to zoom to those dates{{end}}.</p>
+  {{with .Overlays}}<p class="muted">Compared with: {{range $i, $o := .}}{{if $i}} · {{end}}<span style="color:{{$o.Color}}">- - {{$o.Label}}</span>{{end}}</p>{{end}}
+  {{if .KPIs.Events}}<p class="muted">Events: {{range $i, $e := .KPIs.Events}}{{if $i}} · {{end}}<span style="color:#ffb86b">{{$e.Date}}</span> {{$e.Label}}{{end}}</p>{{end}}
+  {{ if .KPIs.Anomalies }}
+  <p class="muted">Anomalies ({{.KPIs.AnomalyMethod.Algorithm}}): {{len .KPIs.Anomalies}}
+  {{range .KPIs.Anomalies}}<span class="badge">{{.Day.Format "2006-01-02"}}{{if .Restated}} · restated{{else if .Reviewed}} · reviewed{{end}}{{range .Events}} · {{.}}{{end}}</span>{{end}}</p>
+  {{end}}
+  {{$editExclusions := and (not demo) (ne .Role "viewer") (not .Export)}}
+  {{if or .KPIs.AnomalyExclusions $editExclusions}}<div id="exclusions">
+  {{with .KPIs.AnomalyExclusions}}<p class="muted">Left out of anomaly detection: {{range .}}<span class="badge">{{.Span}}{{with .Reason}} · {{.}}{{end}}
+    {{if and .ID $editExclusions}}<form method="POST" action="/api/v1/anomaly-exclusions" style="display:inline"><input type="hidden" name="redirect" value="1"><input type="hidden" name="action" value="delete"><input type="hidden" name="id" value="{{.ID}}"><button type="submit" style="padding:0 6px">×</button></form>{{end}}</span>{{end}}</p>{{end}}
+  {{if $editExclusions}}<form method="POST" action="/api/v1/anomaly-exclusions">
+    <input type="hidden" name="redirect" value="1">
+    <input type="date" name="from" required> to <input type="date" name="to">
+    <input name="reason" placeholder="Reason (billing migration)" size="22">
+    <button type="submit">Exclude from anomalies</button>
+  </form>{{end}}
+  </div>{{end}}
+</div>
+<script>
+(function(){
+  var box = document.getElementById('rev-chart'), svg = box && box.querySelector('svg.chart');
+  if (!svg) return;
+  var pts = JSON.parse(svg.getAttribute('data-points')), names = JSON.parse(svg.getAttribute('data-overlays'));
+  var plot = svg.getAttribute('data-plot').split(',').map(Number), W = svg.viewBox.baseVal.width;
+  var actual = pts.filter(function(p){ return !p.f; }).length, zoom = {{not $.Export}};
+  function add(tag, attrs){
+    var e = document.createElementNS('http://www.w3.org/2000/svg', tag);
+    for (var k in attrs) e.setAttribute(k, attrs[k]);
+    svg.appendChild(e);
+    return e;
+  }
+  var cross = add('line', {y1: plot[1], y2: plot[1] + plot[3], stroke: '#e8ecff', 'stroke-opacity': 0});
+  var sel = add('rect', {y: plot[1], height: plot[3], width: 0, fill: '#7aa2ff', opacity: 0});
+  var tip = document.createElement('div');
+  tip.style.cssText = 'position:absolute;top:0;display:none;pointer-events:none;background:#1b2a59;border:1px solid #203063;border-radius:8px;padding:6px 8px;font-size:12px;white-space:nowrap';
+  box.appendChild(tip);
+  function xOf(i){ return pts.length < 2 ? plot[0] + plot[2] / 2 : plot[0] + i * plot[2] / (pts.length - 1); }
+  function at(ev){
+    var r = svg.getBoundingClientRect(), x = (ev.clientX - r.left) / r.width * W;
+    if (pts.length < 2) return 0;
+    return Math.max(0, Math.min(pts.length - 1, Math.round((x - plot[0]) / plot[2] * (pts.length - 1))));
+  }
+  function usd(v){ return '$' + v.toFixed(2); }
+  var start = -1;
+  svg.addEventListener('mousemove', function(ev){
+    var i = at(ev), p = pts[i], lines = [p.d, p.f ? 'forecast ' + usd(p.v) + ' (' + usd(p.lo) + ' – ' + usd(p.hi) + ')' : usd(p.v)];
+    (p.o || []).forEach(function(v, j){ if (v !== null) lines.push(names[j] + ': ' + usd(v)); });
+    if (p.a) lines.push(p.a);
+    tip.innerHTML = '';
+    lines.forEach(function(t, j){ var d = document.createElement('div'); d.textContent = t; if (j === 0) d.style.fontWeight = 'bold'; tip.appendChild(d); });
+    tip.style.display = 'block';
+    var r = box.getBoundingClientRect(), left = ev.clientX - r.left + 12;
+    if (left + tip.offsetWidth > r.width) left = ev.clientX - r.left - tip.offsetWidth - 12;
+    tip.style.left = Math.max(0, left) + 'px';
+    cross.setAttribute('x1', xOf(i)); cross.setAttribute('x2', xOf(i)); cross.setAttribute('stroke-opacity', 0.4);
+    if (start >= 0) {
+      var a = Math.min(start, Math.min(i, actual - 1)), b = Math.max(start, Math.min(i, actual - 1));
+      sel.setAttribute('x', xOf(a)); sel.setAttribute('width', xOf(b) - xOf(a)); sel.setAttribute('opacity', 0.2);
+    }
+  });
+  svg.addEventListener('mouseleave', function(){ tip.style.display = 'none'; cross.setAttribute('stroke-opacity', 0); start = -1; sel.setAttribute('opacity', 0); });
+  svg.addEventListener('mousedown', function(ev){ if (!zoom) return; ev.preventDefault(); start = Math.min(at(ev), actual - 1); });
+  svg.addEventListener('mouseup', function(ev){
+    var i = Math.min(at(ev), actual - 1), a = Math.min(start, i), b = Math.max(start, i);
+    start = -1; sel.setAttribute('opacity', 0);
+    if (!zoom || a < 0 || a === b) return;
+    // a point covers the days up to the next one, so the window ends the day before it
+    var u = new URL(location.href);
+    u.hash = '';
+    u.searchParams.set('from', pts[a].d);
+    if (b + 1 < actual) u.searchParams.set('to', new Date(Date.parse(pts[b + 1].d) - 864e5).toISOString().slice(0, 10));
+    else u.searchParams.delete('to');
+    location.href = u.toString();
+  });
+})();
+</script>
+
+<div class="card">
+  <h3>Top Customers</h3>
+  <table><thead><tr><th>Customer</th><th>Revenue</th><th>Overdue</th></tr></thead><tbody>
+  {{range .KPIs.AccountRollups}}<tr><td>{{.Account}}</td><td>{{money .Revenue}}</td><td>{{money .Overdue}}</td></tr>
+  {{if gt (len .Children) 1}}{{range .Children}}<tr class="muted"><td>&nbsp;&nbsp;↳ {{.Key}}</td><td>{{money .Value}}</td><td></td></tr>{{end}}{{end}}{{end}}
+  </tbody></table>
+  <p class="muted">Top 5 accounts: {{printf "%.1f" (mul100 .KPIs.Concentration)}}% of revenue</p>
+</div>
+
+{{with .KPIs.Categories}}
+<div class="card">
+  <h3>Categories</h3>
+  <table><thead><tr><th>Category</th><th>Revenue</th><th>Share</th><th>Last 30d vs prior</th></tr></thead><tbody>
+  {{range .}}<tr><td><details><summary><a href="/view?category={{.Category}}" style="color:#e8ecff">{{.Category}}</a> <span class="muted">({{len .Products}})</span></summary>
+  {{range .Products}}<div class="muted">&nbsp;&nbsp;↳ <a href="/view?product={{.Key}}" style="color:#9aa7cf">{{.Key}}</a> {{money .Value}}</div>{{end}}</details></td>
+  <td>{{money .Revenue}}</td><td>{{printf "%.1f" (mul100 .Share)}}%</td><td>{{if .Prior}}<span style="color:{{if lt .Change 0.0}}#ff8080{{else}}#7bd88f{{end}}">{{printf "%+.0f" (mul100 .Change)}}%</span>{{else}}<span class="muted">–</span>{{end}}</td></tr>
+  {{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{with .KPIs.Countries}}
+<div class="card">
+  <h3>Revenue by Country</h3>
+  <table><thead><tr><th>Country</th><th>Revenue</th><th>Share</th><th>Orders</th><th>Customers</th><th>Last 30d vs prior</th></tr></thead><tbody>
+  {{range .}}<tr><td><details><summary>{{.Name}}{{if ne .Country "Unknown"}} <span class="muted">{{.Country}}</span>{{end}}</summary>
+  {{range .Companies}}<div class="muted">&nbsp;&nbsp;↳ {{.Key}} {{money .Value}}</div>{{end}}</details></td>
+  <td>{{money .Revenue}}</td><td>{{printf "%.1f" (mul100 .Share)}}%</td><td>{{.Orders}}</td><td>{{.Customers}}</td><td>{{if .Prior}}<span style="color:{{if lt .Change 0.0}}#ff8080{{else}}#7bd88f{{end}}">{{printf "%+.0f" (mul100 .Change)}}%</span>{{else}}<span class="muted">–</span>{{end}}</td></tr>
+  {{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{if not .Export}}{{with .SegmentFields}}
+<div class="card">
+  <h3>Segments <select id="seg-by">{{range .}}<option>{{.}}</option>{{end}}</select></h3>
+  <table><thead><tr><th>Segment</th><th>Revenue</th><th>Share</th><th>Orders</th><th>AOV</th><th>Last 30d vs prior</th><th>Anomalies</th></tr></thead><tbody id="seg-rows"></tbody></table>
+  <p id="seg-info" class="muted"></p>
+</div>
+<script>
+(function(){
+  var by = document.getElementById('seg-by'), body = document.getElementById('seg-rows'), info = document.getElementById('seg-info');
+  ['region', 'channel', 'rep'].some(function(f){ for (var i = 0; i < by.options.length; i++) if (by.options[i].value === f) { by.selectedIndex = i; return true; } });
+  function load(){
+    fetch('/api/kpis?groupby=' + encodeURIComponent(by.value) + {{$.RangeQuery}})
+      .then(function(r){ return r.ok ? r.json() : r.text().then(function(t){ throw new Error(t); }); })
+      .then(function(g){
+        body.innerHTML = '';
+        g.Segments.forEach(function(s){
+          var tr = document.createElement('tr');
+          var change = s.Prior > 0 ? (s.Change >= 0 ? '+' : '') + (s.Change * 100).toFixed(0) + '%' : '–';
+          [s.Segment, '$' + s.Revenue.toFixed(2), (s.Share * 100).toFixed(1) + '%', s.Orders, '$' + s.AvgOrderValue.toFixed(2), change,
+           (s.Anomalies || []).map(function(a){ return a.Day.slice(0, 10); }).join(' ')].forEach(function(v, i){
+            var td = document.createElement('td');
+            td.textContent = v;
+            if (i === 5 && s.Prior > 0) td.style.color = s.Change < 0 ? '#ff8080' : '#7bd88f';
+            tr.appendChild(td);
+          });
+          body.appendChild(tr);
+        });
+        info.textContent = g.Omitted ? g.Omitted + ' smaller segments not shown' : '';
+      })
+      .catch(function(e){ body.innerHTML = ''; info.textContent = e.message; });
+  }
+  by.addEventListener('change', load);
+  load();
+})();
+</script>
+{{end}}{{end}}
+
+{{with .KPIs.Pricing}}
+<div class="card">
+  <h3>Tax, Discounts &amp; Units</h3>
+  {{if .HasTax}}<p>Revenue excluding tax {{money .NetExTax}} <span class="muted">· tax {{money .Tax}}</span></p>{{end}}
+  {{if .HasDiscount}}<p>Discounts {{money .Discount}} <span class="muted">· average discount rate {{printf "%.1f" (mul100 .DiscountRate)}}%</span></p>{{end}}
+  {{if .HasQuantity}}<p>Units sold {{.Units}}{{with .Unit}} {{.}}{{end}} <span class="muted">· {{money .UnitPrice}} per {{or .Unit "unit"}}</span></p>{{end}}
+</div>
+{{end}}
+
+{{with .KPIs.Refunds}}
+<div class="card">
+  <h3><a href="/view?refunds=1" style="color:#e8ecff">Refunds</a> <span class="muted" style="font-size:13px">{{printf "%.1f" (mul100 .Rate)}}% of gross · last 7 days {{printf "%.1f" (mul100 .Rate7)}}%</span></h3>
+  <p>Gross {{money .Gross}} − refunds {{money .Total}} ({{.Count}} rows) = net {{money .Net}}</p>
+  <p class="muted">Most refunded products: {{range .TopProducts}}<span class="badge">{{.Key}} {{money .Value}}</span>{{end}}</p>
+  <p class="muted">Most refunded customers: {{range .TopCustomers}}<span class="badge">{{.Key}} {{money .Value}}</span>{{end}}</p>
+</div>
+{{end}}
+
+{{with .KPIs.Receivables}}
+<div class="card" id="aging">
+  <h3>Receivables Aging <span class="muted" style="font-size:13px">as of {{.AsOf.Format "2006-01-02"}} · by {{.Basis}}</span></h3>
+  <table><thead><tr><th>Age</th><th>Invoices</th><th>Amount</th></tr></thead><tbody>
+  {{if .Current.Count}}<tr><td>{{.Current.Label}}</td><td>{{.Current.Count}}</td><td>{{money .Current.Amount}}</td></tr>{{end}}
+  {{range .Buckets}}<tr><td>{{.Label}}</td><td>{{.Count}}</td><td>{{money .Amount}}</td></tr>{{end}}
+  </tbody></table>
+  <p class="muted">Open: {{money .Open}} · DSO {{printf "%.0f" .DSO}} days · average {{printf "%.0f" .AvgAge}} days past due</p>
+  {{with .Drift}}<p {{if .Alert}}style="color:#ff8080"{{else}}class="muted"{{end}}>Average age {{printf "%+.0f" .Change}} days over the last {{.Snapshots}} analyses (since {{.Since.Format "2006-01-02"}}){{if .Alert}}: collections are slipping{{end}}</p>{{end}}
+</div>
+{{end}}
+
+<div class="card">
+  <h3>Top Products</h3>
+  <table><thead><tr><th>Product</th><th>Revenue</th></tr></thead><tbody>
+  {{range .KPIs.TopProducts}}<tr><td>{{.Key}}</td><td>{{money .Value}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+
+{{if not .Export}}
+<div class="card">
+  <details id="raw"><summary><b>Raw data</b> <span class="muted">· {{.KPIs.Orders}} rows</span></summary>
+  <p><input id="raw-filter" placeholder="Filter: text, or a condition like amount > 500 AND status = 'overdue'" size="60" autocomplete="off">
+  <button id="raw-prev" type="button">‹ Prev</button> <button id="raw-next" type="button">Next ›</button> <span id="raw-info" class="muted"></span></p>
+  <table><thead><tr><th>#</th><th>Date</th><th>Customer</th><th>Product</th><th>Amount</th><th>Status</th><th>Rep</th><th>Region</th><th>Invoice</th></tr></thead><tbody id="raw-rows"></tbody></table>
+  </details>
+</div>
+<script>
+(function(){
+  var raw = document.getElementById('raw'), box = document.getElementById('raw-filter'), body = document.getElementById('raw-rows'),
+      info = document.getElementById('raw-info'), size = 25, offset = 0, total = 0, timer;
+  var cols = ['Row', 'Date', 'Customer', 'Product', 'Amount', 'Status', 'Rep', 'Region', 'Invoice'];
+  function load(){
+    fetch('/api/v1/rows?limit=' + size + '&offset=' + offset + '&filter=' + encodeURIComponent(box.value))
+      .then(function(r){ return r.ok ? r.json() : r.text().then(function(t){ throw new Error(t); }); })
+      .then(function(page){
+        total = page.Total;
+        body.innerHTML = '';
+        page.Items.forEach(function(row){
+          var tr = document.createElement('tr');
+          cols.forEach(function(c){
+            var td = document.createElement('td');
+            td.textContent = c === 'Amount' ? row[c].toFixed(2) : row[c];
+            if (c === 'Customer' && row.RawCustomer && row.RawCustomer !== row.Customer) td.title = 'as uploaded: ' + row.RawCustomer;
+            tr.appendChild(td);
+          });
+          body.appendChild(tr);
+        });
+        info.textContent = total ? (offset + 1) + '–' + (offset + page.Items.length) + ' of ' + total : 'no matching rows';
+      })
+      .catch(function(e){ body.innerHTML = ''; info.textContent = e.message; });
+  }
+  raw.addEventListener('toggle', function(){ if (raw.open) load(); });
+  box.addEventListener('input', function(){ clearTimeout(timer); timer = setTimeout(function(){ offset = 0; load(); }, 250); });
+  document.getElementById('raw-prev').addEventListener('click', function(){ if (offset > 0) { offset = Math.max(0, offset - size); load(); } });
+  document.getElementById('raw-next').addEventListener('click', function(){ if (offset + size < total) { offset += size; load(); } });
+})();
+</script>
+{{end}}
+
+{{if .Customers}}
+<div class="card">
+  <h3>Customer Lifetime Value</h3>
+  <table class="sortable"><thead><tr><th>Customer</th><th>Revenue</th><th>Orders</th><th>AOV</th><th>Orders / month</th><th>Avg gap</th><th>Last order</th><th>Projected LTV</th></tr></thead><tbody>
+  {{range .Customers}}<tr><td><a href="/view?customer={{.Customer}}" style="color:#e8ecff">{{.Customer}}</a></td><td data-v="{{.Revenue}}">{{money .Revenue}}</td><td data-v="{{.Orders}}">{{.Orders}}</td><td data-v="{{.AvgOrderValue}}">{{money .AvgOrderValue}}</td>
+  <td data-v="{{.OrdersPerMonth}}">{{if .AvgGapDays}}{{printf "%.1f" .OrdersPerMonth}}{{else}}—{{end}}</td><td data-v="{{.AvgGapDays}}">{{if .AvgGapDays}}{{printf "%.0f" .AvgGapDays}}d{{else}}—{{end}}</td><td>{{.LastOrder.Format "2006-01-02"}}</td><td data-v="{{.ProjectedLTV}}">{{money .ProjectedLTV}}</td></tr>{{end}}
+  </tbody></table>
+  <p class="muted">Click a column to sort.{{if gt .CustomerCount (len .Customers)}} Showing the top {{len .Customers}} of {{.CustomerCount}} customers by projected LTV.{{end}}</p>
+</div>
+<script>
+document.querySelectorAll('table.sortable').forEach(function(t){
+  t.querySelectorAll('th').forEach(function(th, col){
+    th.style.cursor = 'pointer';
+    th.addEventListener('click', function(){
+      var body = t.tBodies[0], rows = Array.prototype.slice.call(body.rows), asc = th.dataset.dir !== 'asc';
+      t.querySelectorAll('th').forEach(function(h){ delete h.dataset.dir; });
+      th.dataset.dir = asc ? 'asc' : 'desc';
+      function key(r){ var c = r.cells[col]; return c.dataset.v !== undefined ? parseFloat(c.dataset.v) : c.textContent; }
+      rows.sort(function(a, b){ var x = key(a), y = key(b), d = typeof x === 'number' ? x - y : x.localeCompare(y); return asc ? d : -d; });
+      rows.forEach(function(r){ body.appendChild(r); });
+    });
+  });
+});
+</script>
+{{end}}
+
+{{if .KPIs.Restatements}}
+<div class="card">
+  <h3>Restatements</h3>
+  <table><thead><tr><th>Day</th><th>Old</th><th>New</th><th>Delta</th><th>Changed</th></tr></thead><tbody>
+  {{range .KPIs.Restatements}}<tr><td>{{.Day.Format "2006-01-02"}}</td><td>{{money .Old}}</td><td>{{money .New}}</td><td>{{printf "%+.2f" .Delta}}</td><td class="muted">{{.ChangedAt.Format "2006-01-02 15:04"}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{if .KPIs.Campaigns}}
+<div class="card">
+  <h3>Campaigns</h3>
+  <table><thead><tr><th>Campaign</th><th>Start</th><th>Revenue</th><th>Orders</th><th>AOV</th><th>New customers</th><th>Spend</th><th>ROI</th></tr></thead><tbody>
+  {{range .KPIs.Campaigns}}<tr><td>{{.Name}}</td><td>{{if not .Start.IsZero}}{{.Start.Format "2006-01-02"}}{{end}}</td><td>{{money .Revenue}}</td><td>{{.Orders}}</td><td>{{money .AOV}}</td><td>{{printf "%.0f" (mul100 .NewCustomerShare)}}%</td><td>{{if .Spend}}{{money .Spend}}{{end}}</td><td>{{if .Spend}}{{printf "%.0f" (mul100 .ROI)}}%{{end}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{if .KPIs.Currencies}}
+<div class="card">
+  <h3>Currencies</h3>
+  {{if .KPIs.BaseCurrency}}<p class="muted">Totals are converted to {{.KPIs.BaseCurrency}}.</p>{{else if gt (len .KPIs.Currencies) 1}}<p><b>⚠️ Totals blend several currencies.</b> <span class="muted">Configure a base currency to convert.</span></p>{{end}}
+  <table><thead><tr><th>Currency</th><th>Orders</th><th>Revenue</th>{{if .KPIs.BaseCurrency}}<th>In {{.KPIs.BaseCurrency}}</th>{{end}}</tr></thead><tbody>
+  {{range .KPIs.Currencies}}<tr><td>{{.Currency}}</td><td>{{.Orders}}</td><td>{{printf "%.2f" .Amount}}</td>{{if $.KPIs.BaseCurrency}}<td>{{printf "%.2f" .Converted}}</td>{{end}}</tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{with .KPIs.Funnel}}
+<div class="card">
+  <h3>Lead Funnel</h3>
+  <div class="badge">Leads: {{.Leads}}</div>
+  <div class="badge">Converted: {{.Converted}} ({{printf "%.1f" (mul100 .ConversionRate)}}%)</div>
+  <div class="badge">Median time to first purchase: {{printf "%.0f" .MedianDaysToFirstPurchase}}d</div>
+  <table><thead><tr><th>Cohort</th><th>Leads</th><th>≤7d</th><th>≤14d</th><th>≤30d</th><th>≤60d</th><th>≤90d</th></tr></thead><tbody>
+  {{range .Cohorts}}<tr><td>{{.Month.Format "2006-01"}}</td><td>{{.Leads}}</td>{{range .ConvertedWithin}}<td>{{printf "%.0f" (mul100 .)}}%</td>{{end}}</tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{if .KPIs.SegmentAnomalies}}
+<div class="card">
+  <h3>Segment Anomalies</h3>
+  <table><thead><tr><th>Segment</th><th>Day</th><th>Last 7 days</th><th>Usual</th><th>z</th></tr></thead><tbody>
+  {{range .KPIs.SegmentAnomalies}}<tr><td>{{.Key}} <span class="muted">({{.Segment}})</span></td><td>{{.Day.Format "2006-01-02"}}{{if .Ongoing}} <span class="badge">ongoing</span>{{end}}</td><td>{{money .Value}}</td><td>{{money .Baseline}}</td><td>{{printf "%.2f" .Z}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{if .KPIs.AtRisk}}
+<div class="card">
+  <h3>At-Risk Customers <a href="/export/outreach.csv?list=churn" class="muted" style="font-size:13px">outreach CSV</a></h3>
+  <table><thead><tr><th>Customer</th><th>Last order</th><th>Days since</th><th>Usual gap</th><th>Revenue</th><th>Owner</th></tr></thead><tbody>
+  {{range .KPIs.AtRisk}}<tr><td><a href="/view?customer={{.Customer}}" style="color:#e8ecff">{{.Customer}}</a></td><td>{{.LastOrder.Format "2006-01-02"}}</td><td>{{printf "%.0f" .DaysSince}}d <span class="muted">({{printf "%.1f" .Overdue}}×)</span></td><td>{{printf "%.0f" .MedianGapDays}}d</td><td>{{money .Revenue}}</td><td>{{with contact .Customer}}{{if .Email}}<a href="mailto:{{.Email}}" style="color:#7aa2ff">{{if .Owner}}{{.Owner}}{{else}}{{.Email}}{{end}}</a>{{else}}{{.Owner}}{{end}}{{end}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{if .KPIs.KeyAccounts}}
+<div class="card">
+  <h3>Key Accounts</h3>
+  <table><thead><tr><th>Account</th><th>Last order</th><th>Usual gap</th><th>Next order</th><th>Order value</th><th>Forecast</th></tr></thead><tbody>
+  {{range .KPIs.KeyAccounts}}<tr><td><a href="/view?customer={{.Account}}" style="color:#e8ecff">{{.Account}}</a></td><td>{{if .Orders}}{{.LastOrder.Format "2006-01-02"}}{{else}}<span class="muted">no orders</span>{{end}}</td><td>{{if .MedianGapDays}}{{printf "%.0f" .MedianGapDays}}d{{else}}<span class="muted">n/a</span>{{end}}</td><td>{{if .MedianGapDays}}{{.NextOrder.Format "2006-01-02"}}{{if .Overdue}} <span class="badge">{{printf "%.0f" .DaysLate}}d overdue</span>{{end}}{{end}}</td><td>{{money .OrderValue}}</td><td>{{money .Forecast}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{with .KPIs.Bridge}}
+<div class="card">
+  <h3>Revenue Bridge <span class="muted" style="font-size:13px">{{.From.Format "2006-01-02"}} → {{.To.Format "2006-01-02"}} vs {{.PrevFrom.Format "2006-01-02"}} → {{.PrevTo.Format "2006-01-02"}}</span></h3>
+  {{svgWaterfall .}}
+  <div class="badge">New customers: {{.NewCustomers}}</div>
+  <div class="badge">Churned: {{.ChurnedCustomers}}</div>
+  <div class="badge">Retained: volume {{money .Volume}} · price {{money .Price}}</div>
+  {{if .Movers}}<table><thead><tr><th>Customer</th><th>Component</th><th>Prior</th><th>Current</th></tr></thead><tbody>
+  {{range .Movers}}<tr><td>{{.Customer}}</td><td class="muted">{{.Component}}</td><td>{{money .Prior}}</td><td>{{money .Current}}</td></tr>{{end}}
+  </tbody></table>{{end}}
+</div>
+{{end}}
+
+{{with .KPIs.Tiers}}
+<div class="card">
+  <h3>Customer Tiers ({{.Period}})</h3>
+  {{range $t, $n := .Counts}}<span class="badge">{{$t}}: {{$n}}</span>{{end}}
+  {{if .Migrations}}
+  <table><thead><tr><th>Customer</th><th>Change</th><th></th></tr></thead><tbody>
+  {{range .Migrations}}<tr><td>{{.Customer}}</td><td>{{.From}} → {{if .To}}{{.To}}{{else}}—{{end}}</td><td class="muted">{{.Direction}}</td></tr>{{end}}
+  </tbody></table>
+  {{else if .PrevPeriod}}<p class="muted">No tier changes since {{.PrevPeriod}}.</p>{{end}}
+</div>
+{{end}}
+
+{{if .KPIs.Territories}}
+<div class="card">
+  <h3>Quota Attainment</h3>
+  <table><thead><tr><th>#</th><th>Territory</th><th>Revenue</th><th>Quota</th><th>Attainment</th><th>Pace</th><th>Projected</th></tr></thead><tbody>
+  {{range $i, $t := .KPIs.Territories}}<tr><td>{{inc $i}}</td><td>{{$t.Name}}{{if $t.Behind}} <span class="badge">behind</span>{{end}}</td><td>{{money $t.Revenue}}</td><td>{{money $t.Quota}}</td><td>{{printf "%.1f" (mul100 $t.Attainment)}}%</td><td>{{printf "%.0f" (mul100 $t.Pace)}}%</td><td>{{money $t.Projected}}</td></tr>{{end}}
+  </tbody></table>
+</div>
+{{end}}
+
+{{$editTargets := and (not demo) (ne .Role "viewer") (not .Export)}}
+{{if or .KPIs.Targets $editTargets}}
+<div class="card" id="targets">
+  <h3>Revenue Targets</h3>
+  {{if .KPIs.Targets}}
+  <table><thead><tr><th>Target</th><th>Period</th><th>Revenue</th><th>Target</th><th>To target</th><th>Pace</th><th>Projected</th><th></th></tr></thead><tbody>
+  {{range .KPIs.Targets}}<tr><td>{{.Name}}{{if .Behind}} <span class="badge">behind</span>{{end}}</td><td class="muted">{{.Period}} of {{.PeriodStart.Format "Jan 2"}}, {{printf "%.0f" (mul100 .Elapsed)}}% gone</td>
+    <td>{{money .Revenue}}</td><td>{{money .Target}}</td><td>{{printf "%.1f" (mul100 .Attainment)}}%</td><td>{{printf "%.0f" (mul100 .Pace)}}%</td>
+    <td>{{money .Projected}} ({{printf "%.0f" (mul100 .ProjectedAttainment)}}%){{if .Basis}} <span class="muted">by {{.Basis}}</span>{{end}}</td>
+    <td>{{if and .Saved $editTargets}}<form method="POST" action="/api/v1/targets"><input type="hidden" name="redirect" value="1"><input type="hidden" name="action" value="delete"><input type="hidden" name="name" value="{{.Name}}"><button type="submit" style="padding:2px 8px">Remove</button></form>{{end}}</td></tr>{{end}}
+  </tbody></table>
+  {{end}}
+  {{if $editTargets}}<form method="POST" action="/api/v1/targets">
+    <input type="hidden" name="redirect" value="1">
+    <input name="name" placeholder="Name (Monthly)" size="14">
+    <select name="period"><option value="month">Monthly</option><option value="week">Weekly</option></select>
+    <input name="amount" placeholder="Revenue target" size="12" required>
+    <button type="submit">Save target</button>
+    <span class="muted">— saving a name that exists replaces it</span>
+  </form>{{end}}
+</div>
+{{end}}
+
+<div class="card">
+  <h3>Risks & Actions</h3>
+  <ul>{{range .KPIs.Suggestions}}<li>{{.Text}}{{if .Impact}} <span class="badge" title="{{.Basis}}">~{{money .Impact}}</span>{{end}}
+    {{if not (or demo $.Export)}}<form method="POST" action="/api/v1/suggestions" style="display:inline"><input type="hidden" name="redirect" value="1"><input type="hidden" name="key" value="{{.Key}}">
+    <button name="status" value="done" style="padding:2px 8px">Done</button> <button name="status" value="dismissed" style="padding:2px 8px">Dismiss</button></form>{{end}}</li>{{end}}</ul>
+  {{if .KPIs.ExecSummary}}
+  <h4>Executive Summary (AI)</h4>
+  <p class="muted">{{.KPIs.ExecSummary}}</p>
+  {{end}}
+</div>
+
+<div class="card">
+  <details><summary><b>Glossary</b> <span class="muted">— how each metric is computed</span></summary>
+  <table><tbody>
+  {{range .Glossary}}<tr><td><b>{{.Name}}</b></td><td>{{.Definition}}{{if .Params}}<br><span class="muted">{{paramList .Params}}</span>{{end}}</td></tr>{{end}}
+  </tbody></table>
+  </details>
+</div>
+{{end}}
+
+{{template "footer" .}}
+</body></html>
+`
+
+// template funcs
+func mul100(f float64) float64 { return f*100 }
+
+// money formats an amount per cfg.Money; every dashboard, report and alert
+// figure goes through it so one setting covers all outputs.
+func money(v float64) string {
+	sign := ""
+	if v < 0 { sign, v = "-", -v }
+	switch cfg.Money {
+	case "whole":
+		return fmt.Sprintf("%s$%.0f", sign, v)
+	case "short":
+		return sign + shortMoney(v)
+	}
+	return fmt.Sprintf("%s$%.2f", sign, v)
+}
+
+// shortMoney is money's "short" style, also used for chart axis labels.
+func shortMoney(v float64) string {
+	sign := ""
+	if v < 0 { sign, v = "-", -v }
+	switch {
+	case v >= 1e9: return fmt.Sprintf("%s$%.1fB", sign, v/1e9)
+	case v >= 1e6: return fmt.Sprintf("%s$%.1fM", sign, v/1e6)
+	case v >= 1e3: return fmt.Sprintf("%s$%.1fk", sign, v/1e3)
+	}
+	return fmt.Sprintf("%s$%.0f", sign, v)
+}
+func inc(i int) int { return i+1 }
+
+// ChartLayers are drawn over a revenue chart's series. Forecast days continue a daily
+// series past its last point and are skipped on other series.
+type ChartLayers struct {
+	Events    []Event
+	Overlays  []SeriesOverlay
+	Anomalies []Anomaly
+	Forecast  []ForecastDay
+}
+
+// chartPoint is one x position of a chart as the dashboard's hover script reads it:
+// the day, the value, the overlays' values (nil where they have none) and, for
+// forecast points, the band.
+type chartPoint struct {
+	D  string     `json:"d"`
+	V  float64    `json:"v"`
+	O  []*float64 `json:"o,omitempty"`
+	F  bool       `json:"f,omitempty"`
+	Lo float64    `json:"lo,omitempty"`
+	Hi float64    `json:"hi,omitempty"`
+	A  string     `json:"a,omitempty"` // anomaly note
+}
+
+// Chart geometry, in viewBox units; the dashboard script reads the plot area from data attributes.
+const (
+	chartW, chartH        = 640.0, 200.0
+	chartLeft, chartRight = 58.0, 10.0
+	chartTop, chartBottom = 10.0, 24.0
+)
+
+// svgSpark draws the revenue chart with events only; kept for partials that call it.
+func svgSpark(d []KVt, events []Event, overlays ...SeriesOverlay) template.HTML {
+	return revenueChart(d, ChartLayers{Events: events, Overlays: overlays})
+}
+
+// revenueChart draws the series as a line over a money axis and date labels, with
+// overlays as dashed comparison lines in their own colors, events as dashed orange
+// markers and anomalies as red dots at the point covering their day (hover either for
+// its title), and the forecast as a dashed line in its band. The points are also written
+// to data-points for the dashboard's hover values and drag-to-zoom; without the script
+// the chart reads the same.
+func revenueChart(d []KVt, l ChartLayers) template.HTML {
+	if len(d) == 0 { return template.HTML("<p class='muted'>No data.</p>") }
+	var fc []ForecastDay
+	if len(l.Forecast) > 0 && len(d) > 1 && d[len(d)-1].Day.Sub(d[len(d)-2].Day) == 24*time.Hour && l.Forecast[0].Day.Equal(d[len(d)-1].Day.AddDate(0, 0, 1)) {
+		fc = l.Forecast
+	}
+	lo, hi := math.Min(0, d[0].Value), d[0].Value
+	for _, x := range d { lo, hi = math.Min(lo, x.Value), math.Max(hi, x.Value) }
+	for _, o := range l.Overlays {
+		for i, v := range o.Values {
+			if o.Have[i] { lo, hi = math.Min(lo, v), math.Max(hi, v) }
+		}
+	}
+	for _, f := range fc { hi = math.Max(hi, f.High) }
+	step := niceStep((hi - lo) / 4)
+	lo, hi = math.Floor(lo/step)*step, math.Ceil(hi/step)*step
+	if hi == lo { hi = lo + step }
+	n := len(d) + len(fc)
+	plotW, plotH := chartW-chartLeft-chartRight, chartH-chartTop-chartBottom
+	px := func(i int) float64 {
+		if n == 1 { return chartLeft + plotW/2 }
+		return chartLeft + float64(i)*plotW/float64(n-1)
+	}
+	py := func(v float64) float64 { return chartTop + plotH - (v-lo)/(hi-lo)*plotH }
+	var sb strings.Builder
+	// axes: gridlines with money labels, and dates under evenly spaced points
+	for v := lo; v <= hi+step/2; v += step {
+		fmt.Fprintf(&sb, `<line x1="%.0f" y1="%.1f" x2="%.0f" y2="%.1f" stroke="#22305f"/><text x="%.0f" y="%.1f" text-anchor="end" font-size="11" fill="#9aa7cf">%s</text>`,
+			chartLeft, py(v), chartW-chartRight, py(v), chartLeft-6, py(v)+4, shortMoney(v))
+	}
+	layout := "Jan 2"
+	if d[len(d)-1].Day.Sub(d[0].Day) > 180*24*time.Hour { layout = "Jan 2006" }
+	ticks := min(n, 6)
+	for t := 0; t < ticks; t++ {
+		i := 0
+		if ticks > 1 { i = t * (n - 1) / (ticks - 1) }
+		day := d[min(i, len(d)-1)].Day
+		if i >= len(d) { day = fc[i-len(d)].Day }
+		anchor := "middle"
+		if t == 0 && ticks > 1 { anchor = "start" } else if t == ticks-1 && ticks > 1 { anchor = "end" }
+		fmt.Fprintf(&sb, `<text x="%.1f" y="%.0f" text-anchor="%s" font-size="11" fill="#9aa7cf">%s</text>`, px(i), chartH-6, anchor, day.Format(layout))
+	}
+	if len(fc) > 0 {
+		var band, line []string
+		last := len(d) - 1
+		line = append(line, fmt.Sprintf("%.1f,%.1f", px(last), py(d[last].Value)))
+		for i, f := range fc {
+			band = append(band, fmt.Sprintf("%.1f,%.1f", px(len(d)+i), py(f.High)))
+			line = append(line, fmt.Sprintf("%.1f,%.1f", px(len(d)+i), py(f.Value)))
+		}
+		for i := len(fc) - 1; i >= 0; i-- { band = append(band, fmt.Sprintf("%.1f,%.1f", px(len(d)+i), py(fc[i].Low))) }
+		fmt.Fprintf(&sb, `<path d="M %s Z" fill="#22305f" opacity="0.7"><title>forecast band</title></path><path d="M %s" fill="none" stroke="#9aa7cf" stroke-width="2" stroke-dasharray="6,4"><title>forecast</title></path>`,
+			strings.Join(band, " L "), strings.Join(line, " L "))
+	}
+	for _, o := range l.Overlays {
+		var op strings.Builder
+		for i, v := range o.Values {
+			if !o.Have[i] { continue }
+			cmd := "L"
+			if i == 0 || !o.Have[i-1] { cmd = "M" }
+			fmt.Fprintf(&op, "%s %.1f,%.1f ", cmd, px(i), py(v))
+		}
+		fmt.Fprintf(&sb, `<path d="%s" fill="none" stroke="%s" stroke-width="1.5" stroke-dasharray="4,3" opacity="0.8"><title>%s</title></path>`, strings.TrimSpace(op.String()), o.Color, o.Label)
+	}
+	pts := make([]string, len(d))
+	for i, x := range d { pts[i] = fmt.Sprintf("%.1f,%.1f", px(i), py(x.Value)) }
+	fmt.Fprintf(&sb, `<path d="M %s" fill="none" stroke="#7aa2ff" stroke-width="2"/>`, strings.Join(pts, " L "))
+	at := func(day time.Time) int { return sort.Search(len(d), func(i int) bool { return d[i].Day.After(day) }) - 1 }
+	for _, e := range l.Events {
+		day, _ := e.days()
+		i := at(day)
+		if i < 0 { continue }
+		fmt.Fprintf(&sb, `<line x1="%.1f" y1="%.0f" x2="%.1f" y2="%.0f" stroke="#ffb86b" stroke-width="1.5" stroke-dasharray="3,3"><title>%s %s</title></line>`,
+			px(i), chartTop, px(i), chartTop+plotH, e.Date, template.HTMLEscapeString(e.Label()))
+	}
+	notes := map[int]string{}
+	for _, an := range l.Anomalies {
+		i := at(an.Day)
+		if i < 0 { continue }
+		note := fmt.Sprintf("anomaly %s: %s (z %.1f)", an.Day.Format("2006-01-02"), money(an.Value), an.Z)
+		if notes[i] != "" { note = notes[i] + "; " + note }
+		notes[i] = note
+	}
+	for i := range d {
+		if notes[i] == "" { continue }
+		fmt.Fprintf(&sb, `<circle cx="%.1f" cy="%.1f" r="4" fill="#ff8080" stroke="#0b1020"><title>%s</title></circle>`, px(i), py(d[i].Value), template.HTMLEscapeString(notes[i]))
+	}
+	points := make([]chartPoint, 0, n)
+	for i, x := range d {
+		p := chartPoint{D: x.Day.Format("2006-01-02"), V: math.Round(x.Value*100) / 100, A: notes[i]}
+		for _, o := range l.Overlays {
+			var v *float64
+			if o.Have[i] { r := math.Round(o.Values[i]*100) / 100; v = &r }
+			p.O = append(p.O, v)
+		}
+		points = append(points, p)
+	}
+	for _, f := range fc {
+		points = append(points, chartPoint{D: f.Day.Format("2006-01-02"), V: math.Round(f.Value*100) / 100, F: true, Lo: math.Round(f.Low*100) / 100, Hi: math.Round(f.High*100) / 100})
+	}
+	labels := []string{}
+	for _, o := range l.Overlays { labels = append(labels, o.Label) }
+	pj, _ := json.Marshal(points)
+	lj, _ := json.Marshal(labels)
+	return template.HTML(fmt.Sprintf(`<svg class="chart" viewBox="0 0 %.0f %.0f" data-points="%s" data-overlays="%s" data-plot="%.0f,%.0f,%.0f,%.0f">%s</svg>`,
+		chartW, chartH, template.HTMLEscapeString(string(pj)), template.HTMLEscapeString(string(lj)), chartLeft, chartTop, plotW, plotH, sb.String()))
+}
+
+// niceStep rounds a raw axis step up to 1, 2, 2.5 or 5 times a power of ten.
+func niceStep(raw float64) float64 {
+	if raw <= 0 { return 1 }
+	p := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 2.5, 5} {
+		if raw <= m*p { return m * p }
+	}
+	return 10 * p
+}
+
+func scale(v, min, max, a, b float64) float64 {
+	if max == min { return (a+b)/2 }
+	return a + (v-min)*(b-a)/(max-min)
+}
+func max(a,b int) int { if a>b {return a}; return b }
+func min(a,b int) int { if a<b {return a}; return b }
+
+// server state
+// Analysis is a loaded dataset and the KPIs computed from it. Handlers read a copy taken
+// with view; publishes replace the fields under mu, and ingest serializes the
+// read-modify-write of appends and merges so concurrent uploads can't drop rows.
+type Analysis struct {
+	Dataset  string            // workspace name; empty for session analyses
+	KPIs     *KPIs
+	Sales    []Sale
+	Leads    []Lead
+	Spend    []CampaignSpend
+	Snapshot string            // content hash of KPIs, used for ETags
+	Merge    *MergeResult      // summary of the last merge-mode upload
+	Columns  map[string]string // field -> header bound in the last uploaded file
+	Quality  []*DataQuality    // per file of the last upload or ingest
+	store    Store             // a workspace's own store; nil uses the default one
+	cube     *Cube             // pre-aggregated KPIs for slices, rebuilt on publish
+	mu       sync.RWMutex
+	ingest   sync.Mutex
+}
+
+// shared is the server-wide analysis; with -sessions, browser uploads go to per-session ones.
+var shared = &Analysis{Dataset: defaultDataset}
+
+// storage is where a's uploads are persisted.
+func (a *Analysis) storage() Store {
+	if a.store != nil { return a.store }
+	return store
+}
+
+// view returns a consistent copy of a's current state. Published KPIs and rows are never
+// modified in place, so the copy can be read without holding any lock.
+func (a *Analysis) view() *Analysis {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return &Analysis{Dataset: a.Dataset, KPIs: a.KPIs, Sales: a.Sales, Leads: a.Leads, Spend: a.Spend,
+		Snapshot: a.Snapshot, Merge: a.Merge, Columns: a.Columns, Quality: a.Quality, store: a.store, cube: a.cube}
+}
+
+// update runs f with a locked for writing.
+func (a *Analysis) update(f func(a *Analysis)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f(a)
+}
+
+func (a *Analysis) rows() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.Sales)
+}
+
+func (a *Analysis) set(k KPIs, sales []Sale, leads []Lead, spend []CampaignSpend) {
+	snap := snapshotID(k)
+	cube := buildCube(sales)
+	a.update(func(a *Analysis) {
+		a.KPIs = &k
+		a.Sales = sales
+		a.cube = cube
+		a.Leads = leads
+		a.Spend = spend
+		a.Snapshot = snap
+	})
+	if a == shared { recordSnapshot(snap, k) }
+}
+
+// recomputeLatest re-analyzes every loaded dataset after a retroactive change (e.g. aliases).
+// The AI summary is dropped since it described the previous numbers.
+func recomputeLatest() {
+	for _, a := range allAnalyses() {
+		a.ingest.Lock()
+		if v := a.view(); v.KPIs != nil {
+			sales := append([]Sale(nil), v.Sales...) // readers may still hold the old rows
+			applyAliases(sales)
+			if k, err := analyze(context.Background(), a.Dataset, sales, v.Leads, v.Spend); err == nil {
+				if a == shared {
+					k.ForecastTracking = trackForecasts(k.DailyRevenue, k.To, false)
+					if k.Receivables != nil { k.Receivables.Drift = agingDrift(k.Receivables) }
+				}
+				a.set(k, sales, v.Leads, v.Spend)
+			}
+		}
+		a.ingest.Unlock()
+	}
+}
+
+// -------- Jobs --------
+
+// Dashboard uploads run as jobs so a large file doesn't hold the request open: POST /upload
+// saves the files and answers 202 with the job (browsers are sent back to the dashboard;
+// wait=1 answers once it's finished), then parses and analyzes in the background.
+// GET /api/jobs/{id} reports its status, parse progress and any error, and the upload form
+// polls it for a progress bar. Finished jobs are kept for jobTTL.
+//
+// A job that's still running after jobTimeout (-job-timeout; 0 for no limit) is cancelled,
+// as is one whose wait=1 caller hangs up: parsing and analysis stop where they are and
+// nothing is stored.
+const jobTTL = time.Hour
+
+var jobTimeout = 30 * time.Minute
+
+// Job is one background upload.
+type Job struct {
+	ID       string
+	Status   string // parsing, analyzing, done or failed
+	Dataset  string `json:",omitempty"`
+	Files    []string
+	Progress ParseProgress
+	Quality  []*DataQuality `json:",omitempty"` // per file, as each is parsed
+	Error    string     `json:",omitempty"`
+	Kind     string     `json:",omitempty"` // the error's kind (bad_schema, no_data, parse_row, upstream, too_large), if it has one
+	Snapshot string     `json:",omitempty"` // the published analysis, once done
+	Created  time.Time
+	Finished *time.Time `json:",omitempty"`
+	done     chan struct{}
+	target   *Analysis // where the upload goes; only callers looking at it see the job
+}
+
+// jobContext is the context an upload job runs under, ending after jobTimeout.
+func jobContext() (context.Context, context.CancelFunc) {
+	if jobTimeout <= 0 { return context.WithCancel(context.Background()) }
+	return context.WithTimeout(context.Background(), jobTimeout)
+}
+
+// jobError words a job's error for its status: a timeout says how long it had.
+func jobError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("timed out after %s", jobTimeout)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("cancelled: the caller waiting for it went away")
+	}
+	return err
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*Job{}
+)
+
+func newJob(target *Analysis, files []string) *Job {
+	buf := make([]byte, 8)
+	cryptorand.Read(buf)
+	j := &Job{ID: hex.EncodeToString(buf), Status: "parsing", Dataset: target.Dataset, Files: files, Created: time.Now(), done: make(chan struct{}), target: target}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, old := range jobs {
+		if old.Finished != nil && time.Since(*old.Finished) > jobTTL { delete(jobs, id) }
+	}
+	jobs[j.ID] = j
+	return j
+}
+
+func (j *Job) update(f func(j *Job)) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	f(j)
+}
+
+// finish records the job's outcome: done, or failed with err.
+func (j *Job) finish(err error, snapshot string) {
+	j.update(func(j *Job) {
+		now := time.Now()
+		j.Status, j.Snapshot, j.Finished = "done", snapshot, &now
+		if err != nil { j.Status, j.Error, j.Kind = "failed", err.Error(), errorKind(err) }
+	})
+	if err != nil { log.Printf("job %s: %v", j.ID, err) }
+	close(j.done)
+}
+
+func jobView(id string) (Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	if !ok { return Job{}, false }
+	return *j, true
+}
+
+// jobScope is the analysis whose jobs r may see: the selected workspace's, the caller's
+// session's, or the shared one. Unlike uploadTarget it never creates one; nil matches nothing.
+func jobScope(r *http.Request) *Analysis {
+	if name := datasetFor(r); name != defaultDataset {
+		a, _ := workspace(name, false)
+		return a
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		if s := sessions[c.Value]; s != nil { return &s.Analysis }
+	}
+	return shared
+}
+
+// handleJobs lists recent jobs, newest first (GET /api/jobs), or reports one (GET /api/jobs/{id}).
+// Either way a caller only sees the jobs of the dataset or session they're looking at.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	scope := jobScope(r)
+	if id == "" {
+		jobsMu.Lock()
+		out := []Job{}
+		for _, j := range jobs {
+			if scope != nil && j.target == scope { out = append(out, *j) }
+		}
+		jobsMu.Unlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	j, ok := jobView(id)
+	if !ok || scope == nil || j.target != scope {
+		http.Error(w, "no job with that id", 404); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// savedFile is an uploaded file copied out of the request for its job.
+type savedFile struct {
+	name, path string
+	size       int64
+}
+
+func saveUpload(fh *multipart.FileHeader) (savedFile, error) {
+	src, err := fh.Open()
+	if err != nil { return savedFile{}, err }
+	defer src.Close()
+	dst, err := os.CreateTemp("", "bizpulse-upload-*")
+	if err != nil { return savedFile{}, err }
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil { err = cerr }
+	if err != nil {
+		os.Remove(dst.Name())
+		return savedFile{}, err
+	}
+	return savedFile{name: fh.Filename, path: dst.Name(), size: n}, nil
+}
+
+// uploadRequest is what a dashboard upload asked for, kept for its job.
+type uploadRequest struct {
+	target, cur        *Analysis // where the upload goes; what the caller was looking at
+	files              []savedFile
+	sheet              string
+	merging, appending bool
+	leads              []Lead
+	spend              []CampaignSpend
+}
+
+func (u *uploadRequest) cleanup() {
+	for _, f := range u.files { os.Remove(f.path) }
+}
+
+// run parses u's files and publishes the result, appending to or merging with the data
+// the caller had loaded when asked. It gives up if ctx ends.
+func (u *uploadRequest) run(ctx context.Context, j *Job) {
+	defer u.cleanup()
+	u.target.ingest.Lock()
+	defer u.target.ingest.Unlock()
+	cur := u.cur.view()
+	appending := u.appending && cur.KPIs != nil
+	var base []Sale
+	if appending { base = cur.Sales }
+	sales := base
+	res := MergeResult{Files: len(u.files), When: time.Now()}
+	var columns map[string]string
+	var quality []*DataQuality
+	for _, sf := range u.files {
+		f, err := os.Open(sf.path)
+		if err != nil { j.finish(err, ""); return }
+		batch, q, err := parseSalesStream(ctx, f, sf.name, u.sheet, sf.size, func(p ParseProgress) {
+			p.File = sf.name
+			j.update(func(j *Job) { j.Progress = p })
+		})
+		f.Close()
+		if ctx.Err() != nil { j.finish(jobError(ctx.Err()), ""); return }
+		if err != nil { j.finish(fmt.Errorf("parse %s: %w", sf.name, err), ""); return }
+		columns, quality = q.Columns, append(quality, q)
+		j.update(func(j *Job) { j.Quality = quality })
+		if u.merging {
+			var added []Sale
+			var skipped int
+			sales, added, skipped = mergeSales(sales, batch)
+			res.Added += len(added)
+			res.Skipped += skipped
+		} else {
+			sales = append(append([]Sale(nil), sales...), batch...)
+		}
+	}
+	if len(sales) == 0 { j.finish(errNoDatedRows, ""); return }
+	var save func() error
+	switch {
+	case u.target.Dataset == "": // session uploads are scratch work and aren't persisted
+	case appending && cur.Dataset == u.target.Dataset:
+		save = func() error { return u.target.storage().Append(sales[len(base):]) }
+	default:
+		save = func() error { return u.target.storage().Replace(sales) }
+	}
+	if save != nil { save = storeErr(save) }
+	leads, spend := u.leads, u.spend
+	if appending && leads == nil { leads = cur.Leads }
+	if appending && spend == nil { spend = cur.Spend }
+	j.update(func(j *Job) { j.Status = "analyzing" })
+	if _, err := publishAnalysis(ctx, u.target, sales, leads, spend, true, save); err != nil { j.finish(jobError(err), ""); return }
+	u.target.update(func(a *Analysis) {
+		a.Columns, a.Quality = columns, quality
+		if u.merging { a.Merge = &res }
+	})
+	if u.merging {
+		log.Printf("merge: %d file(s), %d rows added, %d duplicates skipped", res.Files, res.Added, res.Skipped)
+	}
+	j.finish(nil, u.target.view().Snapshot)
+}
+
+// -------- Shutdown --------
+
+// On SIGINT or SIGTERM the server stops accepting connections and gives in-flight requests
+// (an upload mid-analysis included) up to shutdownGrace to finish. The background monitors
+// see their context cancelled; shutdown waits for any ingest one is running, then closes
+// the stores.
+const shutdownGrace = 30 * time.Second
+
+// background tracks the goroutines -serve starts, so shutdown can wait for them.
+var background sync.WaitGroup
+
+func goBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// serveUntil serves h on addr until ctx is done, then shuts down gracefully.
+func serveUntil(ctx context.Context, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("shutting down: waiting up to %s for in-flight requests", shutdownGrace)
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	err := srv.Shutdown(sctx)
+	done := make(chan struct{})
+	go func() { background.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-sctx.Done():
+		log.Printf("shutdown: background work still running after %s", shutdownGrace)
+	}
+	workspacesMu.Lock()
+	for _, a := range workspaces {
+		if a.store != nil { a.store.Close() }
+	}
+	workspacesMu.Unlock()
+	return err
+}
+
+// -------- Diagnostics --------
+
+// -pprof serves runtime profiles on their own listener (keep it on localhost or a private
+// interface), never on the main port: /debug/pprof/ lists them, /debug/pprof/<name> serves
+// one (heap, goroutine, allocs, block, mutex, threadcreate; ?debug=1 for text), and
+// /debug/pprof/profile?seconds=30 records CPU. They work with `go tool pprof`. With
+// BIZPULSE_PPROF_TOKEN set, requests need "Authorization: Bearer <token>".
+// -memstats logs RuntimeStats on an interval; /debug/stats returns them as JSON.
+
+// RuntimeStats is a snapshot of memory, goroutines and the data the server holds.
+type RuntimeStats struct {
+	Time          time.Time
+	Uptime        string
+	HeapAllocMB   float64
+	HeapInuseMB   float64
+	SysMB         float64
+	NumGC         uint32
+	Goroutines    int
+	SharedRows    int
+	Workspaces    int
+	WorkspaceRows int
+	Sessions      int
+	SessionRows   int
+	Snapshots     int
+	OutboundLog   int
+}
+
+var startTime = time.Now()
+
+func runtimeStats() RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mb := func(b uint64) float64 { return math.Round(float64(b)/(1<<20)*10) / 10 }
+	st := RuntimeStats{Time: time.Now(), Uptime: time.Since(startTime).Round(time.Second).String(),
+		HeapAllocMB: mb(ms.HeapAlloc), HeapInuseMB: mb(ms.HeapInuse), SysMB: mb(ms.Sys), NumGC: ms.NumGC,
+		Goroutines: runtime.NumGoroutine(), SharedRows: shared.rows()}
+	workspacesMu.Lock()
+	st.Workspaces = len(workspaces)
+	for _, a := range workspaces { st.WorkspaceRows += a.rows() }
+	workspacesMu.Unlock()
+	sessionsMu.Lock()
+	st.Sessions = len(sessions)
+	for _, se := range sessions { st.SessionRows += se.rows() }
+	sessionsMu.Unlock()
+	snapshotsMu.Lock()
+	st.Snapshots = len(snapshots)
+	snapshotsMu.Unlock()
+	outboundMu.Lock()
+	st.OutboundLog = len(outboundLog)
+	outboundMu.Unlock()
+	return st
+}
+
+func logRuntimeStats(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			st := runtimeStats()
+			log.Printf("stats: heap %.1fMB (inuse %.1fMB, sys %.1fMB), %d GCs, %d goroutines; %d shared rows, %d workspaces (%d rows), %d sessions (%d rows), %d snapshots, %d outbound records",
+				st.HeapAllocMB, st.HeapInuseMB, st.SysMB, st.NumGC, st.Goroutines, st.SharedRows, st.Workspaces, st.WorkspaceRows, st.Sessions, st.SessionRows, st.Snapshots, st.OutboundLog)
+		}
+	}
+}
+
+// pprofListenAddr is where -pprof listens: a bare ":port" binds to localhost, and a
+// non-loopback host is refused unless BIZPULSE_PPROF_TOKEN guards the profiles.
+func pprofListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil { return "", fmt.Errorf("-pprof %q: %w", addr, err) }
+	if host == "" { return net.JoinHostPort("localhost", port), nil }
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() { return addr, nil }
+	if os.Getenv("BIZPULSE_PPROF_TOKEN") == "" {
+		return "", fmt.Errorf("-pprof %s is reachable beyond localhost; set BIZPULSE_PPROF_TOKEN or listen on localhost", addr)
+	}
+	return addr, nil
+}
+
+// pprofHandler serves profiles and stats for -pprof.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/stats", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runtimeStats())
+	})
+	mux.HandleFunc("/debug/pprof/profile", func(w http.ResponseWriter, r *http.Request) {
+		secs, _ := strconv.Atoi(r.URL.Query().Get("seconds"))
+		if secs <= 0 || secs > 300 { secs = 30 }
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="cpu.pprof"`)
+		if err := pprof.StartCPUProfile(w); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Duration(secs) * time.Second):
+		}
+		pprof.StopCPUProfile()
+	})
+	mux.HandleFunc("/debug/pprof/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+		if name == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "profiles (?debug=1 for text):")
+			for _, p := range pprof.Profiles() { fmt.Fprintf(w, "  /debug/pprof/%s (%d)\n", p.Name(), p.Count()) }
+			fmt.Fprintln(w, "  /debug/pprof/profile?seconds=30 (CPU)\n  /debug/stats (memory, goroutines, rows held)")
+			return
+		}
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, "unknown profile", 404); return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pprof"`, name))
+		}
+		if name == "heap" && r.URL.Query().Get("gc") != "" { runtime.GC() }
+		p.WriteTo(w, debug)
+	})
+	token := os.Getenv("BIZPULSE_PPROF_TOKEN")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized); return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// -------- Authentication --------
+
+// Once any credential is configured, every request needs one. API keys come from
+// BIZPULSE_API_KEYS ("key:role,key:role") or the -users JSON file and are sent as
+// "Authorization: Bearer <key>", X-API-Key, or a basic-auth password; users in the file
+// log in to the dashboard with basic auth. Roles:
+//
+//   viewer   dashboards and read-only API calls (the default; "read" is accepted too)
+//   analyst  also uploads, ingests, deletes data and curates aliases ("upload" too)
+//   admin    also manages alert rules and integrations (adminPaths)
+//
+// A signature on an integration endpoint is checked on top of the key, not instead of
+// it: only a GET or HEAD to a signed endpoint outside adminPaths may present a v1
+// signature (bound to its method, path and expiry) in place of a key.
+
+// Credential is an API key or dashboard login from BIZPULSE_API_KEYS or the -users file:
+// [{"name": "ops-bot", "key": "...", "role": "analyst"}, {"name": "alice", "password": "sha256:<hex>", "role": "admin"}]
+type Credential struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Password string `json:"password"` // plain, or "sha256:" + hex digest
+	Role     string `json:"role"`     // viewer (default), analyst or admin
+}
+
+var roleRank = map[string]int{"viewer": 1, "analyst": 2, "admin": 3}
+
+var (
+	credentials []Credential
+	signedPaths = map[string]bool{} // integration endpoints behind requireSignature
+	// adminPaths change alerting or talk to other systems; other writes need an analyst
+	adminPaths = map[string]bool{"/api/v1/alert-rules": true, "/api/v1/alert-state": true, "/api/v1/crm": true,
+		"/api/v1/pull": true, "/api/v1/stripe": true, "/api/v1/shopify": true, "/api/v1/digest/send": true, "/api/v1/insights/send": true, "/api/v1/outbound/decision": true}
+	// readPosts take POST for the request body but only read, so viewers may use them
+	readPosts = map[string]bool{"/graphql": true}
+)
+
+// loadCredentials reads BIZPULSE_API_KEYS and, when path is set, the users file.
+func loadCredentials(path string) error {
+	credentials = nil
+	for i, entry := range strings.Split(os.Getenv("BIZPULSE_API_KEYS"), ",") {
+		key, role, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if key == "" { continue }
+		credentials = append(credentials, Credential{Name: fmt.Sprintf("BIZPULSE_API_KEYS #%d", i+1), Key: key, Role: role})
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil { return err }
+		var users []Credential
+		if err := json.Unmarshal(b, &users); err != nil { return fmt.Errorf("users %s: %w", path, err) }
+		credentials = append(credentials, users...)
+	}
+	for i, c := range credentials {
+		switch {
+		case c.Key == "" && c.Password == "":
+			return fmt.Errorf("credential %q: needs a key or a password", c.Name)
+		case c.Password != "" && c.Name == "":
+			return fmt.Errorf("credential with a password needs a name to log in with")
+		}
+		role := nz(strings.ToLower(c.Role), "viewer")
+		role = nz(map[string]string{"read": "viewer", "upload": "analyst"}[role], role)
+		if roleRank[role] == 0 {
+			return fmt.Errorf("credential %q: role must be viewer, analyst or admin, not %q", c.Name, c.Role)
+		}
+		credentials[i].Role = role
+	}
+	return nil
+}
+
+func secretEqual(a, b string) bool {
+	x, y := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return hmac.Equal(x[:], y[:])
+}
+
+func passwordMatches(stored, given string) bool {
+	if strings.HasPrefix(stored, "sha256:") {
+		sum := sha256.Sum256([]byte(given))
+		return secretEqual(hex.EncodeToString(sum[:]), strings.ToLower(strings.TrimPrefix(stored, "sha256:")))
+	}
+	return secretEqual(stored, given)
+}
+
+// authenticate returns the credential a request presents, or nil.
+func authenticate(r *http.Request) *Credential {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") { key = strings.TrimPrefix(auth, "Bearer ") }
+	user, pass, basic := r.BasicAuth()
+	for i := range credentials {
+		c := &credentials[i]
+		switch {
+		case c.Key != "" && key != "" && secretEqual(c.Key, key):
+			return c
+		case c.Key != "" && basic && pass != "" && secretEqual(c.Key, pass):
+			return c
+		case c.Password != "" && basic && user == c.Name && passwordMatches(c.Password, pass):
+			return c
+		}
+	}
+	return nil
+}
+
+// requiredRole is the least role that may make request r.
+func requiredRole(r *http.Request) string { return roleNeeded(r.Method, r.URL.Path) }
+
+func roleNeeded(method, path string) string {
+	switch {
+	case method == http.MethodGet || method == http.MethodHead || readPosts[path]:
+		return "viewer"
+	case adminPaths[path]:
+		return "admin"
+	}
+	return "analyst"
+}
+
+// roleFor is the caller's role; without configured credentials everyone is an admin.
+func roleFor(r *http.Request) string {
+	if len(credentials) == 0 { return "admin" }
+	if c := authenticate(r); c != nil { return c.Role }
+	return ""
+}
+
+// requireAuth enforces credentials and roles on every route; main installs it once any
+// credential is configured.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signedRead(r) { next.ServeHTTP(w, r); return }
+		c := authenticate(r)
+		if c == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="BizPulse", charset="UTF-8"`)
+			http.Error(w, "unauthorized: send an API key or log in", http.StatusUnauthorized); return
+		}
+		if need := requiredRole(r); roleRank[c.Role] < roleRank[need] {
+			http.Error(w, fmt.Sprintf("forbidden: %s is a %s; this needs %s", c.Name, c.Role, need), http.StatusForbidden); return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signedRead reports whether r is a read that a valid v1 signature lets through without a
+// key. Writes and admin endpoints need a key with the right role, signed or not.
+func signedRead(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || !signedPaths[r.URL.Path] || adminPaths[r.URL.Path] { return false }
+	if os.Getenv("BIZPULSE_SIGNING_SECRET") == "" || r.Header.Get("X-BizPulse-Signature") == "" { return false }
+	return verifySignature(r, nil, time.Now()) == nil
+}
+
+// handleMe reports who the caller is authenticated as.
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	me := struct{ Name, Role string }{"anonymous", roleFor(r)}
+	if c := authenticate(r); c != nil { me.Name = c.Name }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(me)
+}
+
+// handleSigned registers an inbound integration endpoint behind requireSignature.
+func handleSigned(mux *http.ServeMux, path string, h http.HandlerFunc) {
+	signedPaths[path] = true
+	mux.HandleFunc(path, requireSignature(h))
+}
+
+// -------- GraphQL --------
+
+// /graphql answers GraphQL queries over the data the REST API serves, for clients that
+// would rather pick fields and nest in one request:
+//
+//   { datasets { name rows kpis { totalRevenue orders } }
+//     customers(limit: 5, sort: "-revenue") { customer revenue products { product revenue } } }
+//
+// POST takes {"query", "variables", "operationName"} (or an application/graphql body);
+// GET takes the same as query parameters. Only queries are supported, with variables,
+// named and inline fragments and @include/@skip; introspection is limited to __typename.
+// Plain fields are the JSON fields of the REST responses matched ignoring case, so
+// totalRevenue and TotalRevenue both work. The fields in gqlSchema are computed and are
+// where arguments go; the Query fields that read a dataset also take dataset:.
+
+const (
+	gqlMaxBody  = 64 << 10 // largest request body
+	gqlMaxDepth = 12       // deepest nesting of selections
+)
+
+// gqlSel is a field, fragment spread (Spread) or inline fragment (Inline) in a selection
+// set. Args and Directives may still hold variables.
+type gqlSel struct {
+	Alias, Name string
+	Args        map[string]interface{}
+	Directives  map[string]map[string]interface{}
+	Sel         []gqlSel
+	Spread      string
+	Inline      bool
+}
+
+type gqlVar string
+
+type gqlVarDef struct {
+	Name       string
+	Required   bool
+	Default    interface{}
+	HasDefault bool
+}
+
+type gqlOp struct {
+	Kind, Name string
+	Vars       []gqlVarDef
+	Sel        []gqlSel
+}
+
+type gqlDoc struct {
+	Ops   []gqlOp
+	Frags map[string][]gqlSel
+}
+
+// gqlError is an entry of the response's errors; Path is set for errors while resolving.
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlObject is a result object that keeps its fields in selection order.
+type gqlObject struct {
+	keys []string
+	vals []interface{}
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 { b.WriteByte(',') }
+		kb, _ := json.Marshal(k)
+		vb, err := json.Marshal(o.vals[i])
+		if err != nil { return nil, err }
+		b.Write(kb); b.WriteByte(':'); b.Write(vb)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlTokens splits a query into names, numbers, punctuators and strings; a string token
+// is its unescaped value behind the opening quote. Commas and comments are skipped.
+func gqlTokens(q string) ([]string, error) {
+	var toks []string
+	isName := func(c byte) bool { return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' }
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(q) && q[i] != '\n' { i++ }
+		case strings.HasPrefix(q[i:], "..."):
+			toks = append(toks, "...")
+			i += 3
+		case c == '"':
+			j := i + 1
+			for ; j < len(q) && q[j] != '"'; j++ {
+				if q[j] == '\\' { j++ }
+			}
+			if j >= len(q) { return nil, fmt.Errorf("unterminated string") }
+			var s string
+			if err := json.Unmarshal([]byte(q[i:j+1]), &s); err != nil { return nil, fmt.Errorf("invalid string %s", q[i:j+1]) }
+			toks = append(toks, `"`+s)
+			i = j + 1
+		case strings.ContainsRune("{}()[]:=!$@", rune(c)):
+			toks = append(toks, string(c))
+			i++
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(q) && strings.ContainsRune("0123456789.eE+-", rune(q[j])) { j++ }
+			toks = append(toks, q[i:j])
+			i = j
+		case isName(c):
+			j := i + 1
+			for j < len(q) && isName(q[j]) { j++ }
+			toks = append(toks, q[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+type gqlParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *gqlParser) peek() string {
+	if p.pos < len(p.toks) { return p.toks[p.pos] }
+	return ""
+}
+
+func (p *gqlParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *gqlParser) expect(t string) error {
+	if got := p.peek(); got != t {
+		if got == "" { got = "end of query" }
+		return fmt.Errorf("expected %q, found %q", t, strings.TrimPrefix(got, `"`))
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t == "" || !(t[0] == '_' || t[0] >= 'a' && t[0] <= 'z' || t[0] >= 'A' && t[0] <= 'Z') {
+		if t == "" { t = "end of query" }
+		return "", fmt.Errorf("expected a name, found %q", strings.TrimPrefix(t, `"`))
+	}
+	return t, nil
+}
+
+func parseGraphQL(q string) (*gqlDoc, error) {
+	toks, err := gqlTokens(q)
+	if err != nil { return nil, err }
+	p := &gqlParser{toks: toks}
+	doc := &gqlDoc{Frags: map[string][]gqlSel{}}
+	for p.pos < len(p.toks) {
+		switch t := p.peek(); t {
+		case "{":
+			sel, err := p.selectionSet()
+			if err != nil { return nil, err }
+			doc.Ops = append(doc.Ops, gqlOp{Kind: "query", Sel: sel})
+		case "query", "mutation", "subscription":
+			op, err := p.operation()
+			if err != nil { return nil, err }
+			doc.Ops = append(doc.Ops, op)
+		case "fragment":
+			p.next()
+			name, err := p.name()
+			if err != nil { return nil, err }
+			if err := p.expect("on"); err != nil { return nil, err }
+			if _, err := p.name(); err != nil { return nil, err }
+			if _, err := p.directives(); err != nil { return nil, err }
+			sel, err := p.selectionSet()
+			if err != nil { return nil, err }
+			if _, dup := doc.Frags[name]; dup { return nil, fmt.Errorf("fragment %s is defined twice", name) }
+			doc.Frags[name] = sel
+		default:
+			return nil, fmt.Errorf("unexpected %q: expected a query or fragment", strings.TrimPrefix(t, `"`))
+		}
+	}
+	if len(doc.Ops) == 0 { return nil, fmt.Errorf("no operation in the query") }
+	return doc, nil
+}
+
+func (p *gqlParser) operation() (gqlOp, error) {
+	op := gqlOp{Kind: p.next()}
+	var err error
+	if t := p.peek(); t != "(" && t != "{" && t != "@" {
+		if op.Name, err = p.name(); err != nil { return op, err }
+	}
+	if p.peek() == "(" {
+		p.next()
+		for p.peek() != ")" {
+			if err := p.expect("$"); err != nil { return op, err }
+			var v gqlVarDef
+			if v.Name, err = p.name(); err != nil { return op, err }
+			if err := p.expect(":"); err != nil { return op, err }
+			if v.Required, err = p.varType(); err != nil { return op, err }
+			if p.peek() == "=" {
+				p.next()
+				if v.Default, err = p.value(true); err != nil { return op, err }
+				v.HasDefault = true
+			}
+			op.Vars = append(op.Vars, v)
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil { return op, err }
+	op.Sel, err = p.selectionSet()
+	return op, err
+}
+
+// varType skips a variable's type, reporting whether it is non-null.
+func (p *gqlParser) varType() (bool, error) {
+	if p.peek() == "[" {
+		p.next()
+		if _, err := p.varType(); err != nil { return false, err }
+		if err := p.expect("]"); err != nil { return false, err }
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.peek() == "!" { p.next(); return true, nil }
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSel, error) {
+	if err := p.expect("{"); err != nil { return nil, err }
+	var out []gqlSel
+	for p.peek() != "}" {
+		if p.peek() == "" { return nil, fmt.Errorf("unclosed selection set") }
+		s, err := p.selection()
+		if err != nil { return nil, err }
+		out = append(out, s)
+	}
+	p.next()
+	if len(out) == 0 { return nil, fmt.Errorf("empty selection set") }
+	return out, nil
+}
+
+func (p *gqlParser) selection() (gqlSel, error) {
+	var s gqlSel
+	var err error
+	if p.peek() == "..." {
+		p.next()
+		switch t := p.peek(); {
+		case t == "on":
+			p.next()
+			if _, err := p.name(); err != nil { return s, err }
+			s.Inline = true
+		case t == "{" || t == "@":
+			s.Inline = true
+		default:
+			if s.Spread, err = p.name(); err != nil { return s, err }
+		}
+		if s.Directives, err = p.directives(); err != nil { return s, err }
+		if s.Inline { s.Sel, err = p.selectionSet() }
+		return s, err
+	}
+	if s.Name, err = p.name(); err != nil { return s, err }
+	if p.peek() == ":" {
+		p.next()
+		s.Alias = s.Name
+		if s.Name, err = p.name(); err != nil { return s, err }
+	}
+	if p.peek() == "(" {
+		if s.Args, err = p.arguments(); err != nil { return s, err }
+	}
+	if s.Directives, err = p.directives(); err != nil { return s, err }
+	if p.peek() == "{" { s.Sel, err = p.selectionSet() }
+	return s, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	p.next()
+	args := map[string]interface{}{}
+	for p.peek() != ")" {
+		name, err := p.name()
+		if err != nil { return nil, err }
+		if err := p.expect(":"); err != nil { return nil, err }
+		if args[name], err = p.value(false); err != nil { return nil, err }
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives() (map[string]map[string]interface{}, error) {
+	var out map[string]map[string]interface{}
+	for p.peek() == "@" {
+		p.next()
+		name, err := p.name()
+		if err != nil { return nil, err }
+		args := map[string]interface{}{}
+		if p.peek() == "(" {
+			if args, err = p.arguments(); err != nil { return nil, err }
+		}
+		if out == nil { out = map[string]map[string]interface{}{} }
+		out[name] = args
+	}
+	return out, nil
+}
+
+// value reads an argument value; constant ones (variable defaults) can't use variables.
+// Numbers are float64 and enum values strings, as in JSON variables.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	switch t := p.next(); {
+	case t == "$":
+		if constant { return nil, fmt.Errorf("variables aren't allowed in default values") }
+		name, err := p.name()
+		return gqlVar(name), err
+	case t == "[":
+		list := []interface{}{}
+		for p.peek() != "]" {
+			if p.peek() == "" { return nil, fmt.Errorf("unclosed list") }
+			v, err := p.value(constant)
+			if err != nil { return nil, err }
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case t == "{":
+		obj := map[string]interface{}{}
+		for p.peek() != "}" {
+			name, err := p.name()
+			if err != nil { return nil, err }
+			if err := p.expect(":"); err != nil { return nil, err }
+			if obj[name], err = p.value(constant); err != nil { return nil, err }
+		}
+		p.next()
+		return obj, nil
+	case strings.HasPrefix(t, `"`):
+		return t[1:], nil
+	case t == "true" || t == "false":
+		return t == "true", nil
+	case t == "null":
+		return nil, nil
+	case t != "" && (t[0] == '-' || t[0] >= '0' && t[0] <= '9'):
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil { return nil, fmt.Errorf("invalid number %q", t) }
+		return f, nil
+	case t != "" && !strings.ContainsRune("{}()[]:=!$@.", rune(t[0])):
+		return t, nil
+	default:
+		if t == "" { t = "end of query" }
+		return nil, fmt.Errorf("expected a value, found %q", t)
+	}
+}
+
+// gqlResolver computes a field of parent from its arguments.
+type gqlResolver func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error)
+
+// gqlFieldDef is a computed field: its result (or its items) are objects of Type.
+type gqlFieldDef struct {
+	Type    string
+	Args    []string
+	Resolve gqlResolver
+}
+
+// gqlDataset, gqlCustomer and gqlProduct carry what their computed fields need next to
+// the row the plain fields come from. A customer under a product (or the other way
+// round) is limited to that product's rows.
+type gqlDataset struct {
+	WorkspaceInfo
+	a *Analysis
+}
+
+type gqlCustomer struct {
+	CustomerRow
+	sales   []Sale
+	product string
+}
+
+type gqlProduct struct {
+	ProductRow
+	sales    []Sale
+	customer string
+}
+
+var gqlSchema = map[string]map[string]gqlFieldDef{
+	"Query": {
+		"datasets": {"Dataset", nil, func(ex *gqlExec, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			var out []interface{}
+			for _, name := range workspaceNames() {
+				if d, err := ex.dataset(name); err == nil { out = append(out, d) }
+			}
+			return out, nil
+		}},
+		"dataset": {"Dataset", []string{"name"}, func(ex *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlString(args, "name")
+			if err != nil { return nil, err }
+			return ex.dataset(name)
+		}},
+		"snapshots": {"Snapshot", []string{"limit", "offset"}, func(ex *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			snapshotsMu.Lock()
+			var list []interface{}
+			for i := len(snapshots) - 1; i >= 0; i-- { list = append(list, *snapshots[i]) }
+			snapshotsMu.Unlock()
+			return gqlPage(list, args, "")
+		}},
+		"snapshot": {"Snapshot", []string{"id"}, func(ex *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+			id, err := gqlString(args, "id")
+			if err != nil { return nil, err }
+			if s := getSnapshot(id); s != nil { return *s, nil }
+			return nil, nil
+		}},
+	},
+	"Dataset": {
+		"kpis": {"KPIs", nil, func(ex *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			if k := parent.(gqlDataset).a.KPIs; k != nil { return *k, nil }
+			return nil, nil
+		}},
+		"series": {"Point", []string{"granularity"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			g, err := gqlString(args, "granularity")
+			if err != nil { return nil, err }
+			k := parent.(gqlDataset).a.KPIs
+			if k == nil { return []interface{}{}, nil }
+			series, err := seriesFor(k, g)
+			if err != nil { return nil, err }
+			out := []interface{}{}
+			for _, p := range series { out = append(out, p) }
+			return out, nil
+		}},
+		"segments": {"Segments", []string{"groupBy", "granularity"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			field, err := gqlString(args, "groupBy")
+			if err != nil { return nil, err }
+			g, err := gqlString(args, "granularity")
+			if err != nil { return nil, err }
+			ok := false
+			for _, f := range groupByFields { ok = ok || f == field }
+			if !ok { return nil, fmt.Errorf("groupBy must be one of %s", strings.Join(groupByFields, ", ")) }
+			if g = nz(g, "week"); g != "day" && g != "week" && g != "month" { return nil, fmt.Errorf("granularity must be day, week or month") }
+			ds := parent.(gqlDataset).a
+			return segmentKPIs(ex.r.Context(), ds.Dataset, ds.Sales, field, g)
+		}},
+		"customers": {"Customer", []string{"limit", "offset", "sort"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return gqlPage(gqlCustomers(parent.(gqlDataset).a.Sales, ""), args, "-Revenue")
+		}},
+		"customer": {"Customer", []string{"name"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return gqlFind(gqlCustomers(parent.(gqlDataset).a.Sales, ""), args, func(v interface{}) string { return v.(gqlCustomer).Customer })
+		}},
+		"products": {"Product", []string{"limit", "offset", "sort"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return gqlPage(gqlProducts(parent.(gqlDataset).a.Sales, ""), args, "-Revenue")
+		}},
+		"product": {"Product", []string{"name"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return gqlFind(gqlProducts(parent.(gqlDataset).a.Sales, ""), args, func(v interface{}) string { return v.(gqlProduct).Product })
+		}},
+	},
+	"Customer": {
+		"products": {"Product", []string{"limit", "offset", "sort"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			c := parent.(gqlCustomer)
+			return gqlPage(gqlProducts(c.sales, c.Customer), args, "-Revenue")
+		}},
+		"rows": {"Row", []string{"limit", "offset", "sort"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			c := parent.(gqlCustomer)
+			return gqlPage(gqlRows(c.sales, func(s Sale) bool { return s.Customer == c.Customer && (c.product == "" || s.Product == c.product) }), args, "")
+		}},
+	},
+	"Product": {
+		"buyers": {"Customer", []string{"limit", "offset", "sort"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			p := parent.(gqlProduct)
+			return gqlPage(gqlCustomers(p.sales, p.Product), args, "-Revenue")
+		}},
+		"rows": {"Row", []string{"limit", "offset", "sort"}, func(ex *gqlExec, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			p := parent.(gqlProduct)
+			return gqlPage(gqlRows(p.sales, func(s Sale) bool { return s.Product == p.Product && (p.customer == "" || s.Customer == p.customer) }), args, "")
+		}},
+	},
+	"Snapshot": {
+		"kpis": {"KPIs", nil, func(ex *gqlExec, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return parent.(Snapshot).kpis, nil
+		}},
+	},
+}
+
+// gqlLookup finds a computed field, ignoring case. The dataset fields are also Query
+// fields, reading the dataset: argument or else the request's dataset.
+func gqlLookup(typ, name string) (gqlFieldDef, bool) {
+	for n, d := range gqlSchema[typ] {
+		if strings.EqualFold(n, name) { return d, true }
+	}
+	if typ != "Query" { return gqlFieldDef{}, false }
+	def, ok := gqlLookup("Dataset", name)
+	if !ok { return def, false }
+	return gqlFieldDef{def.Type, append([]string{"dataset"}, def.Args...), func(ex *gqlExec, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		name, err := gqlString(args, "dataset")
+		if err != nil { return nil, err }
+		d, err := ex.dataset(name)
+		if err != nil { return nil, err }
+		delete(args, "dataset")
+		return def.Resolve(ex, d, args)
+	}}, true
+}
+
+// gqlCustomers lists the customers of sales, limited to product's rows when it's set.
+func gqlCustomers(sales []Sale, product string) []interface{} {
+	sub := sales
+	if product != "" {
+		sub = nil
+		for _, s := range sales {
+			if s.Product == product { sub = append(sub, s) }
+		}
+	}
+	out := []interface{}{}
+	for _, c := range customerRows(sub) { out = append(out, gqlCustomer{c, sales, product}) }
+	return out
+}
+
+// gqlProducts lists the products of sales, limited to customer's rows when it's set.
+func gqlProducts(sales []Sale, customer string) []interface{} {
+	sub := sales
+	if customer != "" {
+		sub = nil
+		for _, s := range sales {
+			if s.Customer == customer { sub = append(sub, s) }
+		}
+	}
+	out := []interface{}{}
+	for _, p := range productRows(sub) { out = append(out, gqlProduct{p, sales, customer}) }
+	return out
+}
+
+// gqlRows lists the rows matching keep, numbered like /api/v1/rows.
+func gqlRows(sales []Sale, keep func(Sale) bool) []interface{} {
+	out := []interface{}{}
+	for i, s := range sales {
+		if keep(s) { out = append(out, rawRow(i, s)) }
+	}
+	return out
+}
+
+// gqlFind returns the item whose key equals the name argument, ignoring case.
+func gqlFind(items []interface{}, args map[string]interface{}, key func(interface{}) string) (interface{}, error) {
+	name, err := gqlString(args, "name")
+	if err != nil { return nil, err }
+	if name == "" { return nil, fmt.Errorf("name is required") }
+	for _, it := range items {
+		if strings.EqualFold(key(it), name) { return it, nil }
+	}
+	return nil, nil
+}
+
+// gqlPage applies sort (a field, - prefix for descending), offset and limit (default 50,
+// max 500) as the REST listings do.
+func gqlPage(items []interface{}, args map[string]interface{}, defaultSort string) ([]interface{}, error) {
+	limit, err := gqlInt(args, "limit", 50)
+	if err != nil { return nil, err }
+	offset, err := gqlInt(args, "offset", 0)
+	if err != nil { return nil, err }
+	if limit < 1 || offset < 0 { return nil, fmt.Errorf("limit must be positive and offset not negative") }
+	if limit > 500 { limit = 500 }
+	key, err := gqlString(args, "sort")
+	if err != nil { return nil, err }
+	if key = nz(key, defaultSort); key != "" && len(items) > 1 {
+		desc := strings.HasPrefix(key, "-")
+		key = strings.TrimPrefix(key, "-")
+		rows := make([]map[string]interface{}, len(items))
+		for i, it := range items { rows[i] = gqlGeneric(it) }
+		if key = matchField(rows[0], key); key == "" { return nil, fmt.Errorf("unknown sort field") }
+		idx := make([]int, len(items))
+		for i := range idx { idx[i] = i }
+		sort.SliceStable(idx, func(i, j int) bool {
+			if desc { return lessValue(rows[idx[j]][key], rows[idx[i]][key]) }
+			return lessValue(rows[idx[i]][key], rows[idx[j]][key])
+		})
+		sorted := make([]interface{}, len(items))
+		for i, k := range idx { sorted[i] = items[k] }
+		items = sorted
+	}
+	if offset >= len(items) { return []interface{}{}, nil }
+	if end := offset + limit; end < len(items) { return items[offset:end], nil }
+	return items[offset:], nil
+}
+
+func gqlString(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("%s must be a string", name)
+}
+
+func gqlInt(args map[string]interface{}, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case float64:
+		if v == math.Trunc(v) { return int(v), nil }
+	}
+	return 0, fmt.Errorf("%s must be an integer", name)
+}
+
+// gqlGeneric is v's JSON form as an object, for its plain fields.
+func gqlGeneric(v interface{}) map[string]interface{} {
+	var m map[string]interface{}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// gqlExec runs one operation for a request.
+type gqlExec struct {
+	r     *http.Request
+	vars  map[string]interface{}
+	frags map[string][]gqlSel
+	errs  []gqlError
+}
+
+// dataset looks up a dataset by name; empty is the one the request addresses.
+func (ex *gqlExec) dataset(name string) (gqlDataset, error) {
+	var a *Analysis
+	if name == "" {
+		a, name = analysisFor(ex.r), datasetFor(ex.r)
+	} else {
+		w, err := workspace(name, false)
+		if err != nil { return gqlDataset{}, err }
+		a = w.view()
+	}
+	return gqlDataset{workspaceInfo(name, a), a}, nil
+}
+
+func (ex *gqlExec) fail(path []interface{}, err error) {
+	ex.errs = append(ex.errs, gqlError{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+// arg replaces the variables in v by their values.
+func (ex *gqlExec) arg(v interface{}) interface{} {
+	switch x := v.(type) {
+	case gqlVar:
+		return ex.vars[string(x)]
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x { out[i] = ex.arg(e) }
+		return out
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range x { out[k] = ex.arg(e) }
+		return out
+	}
+	return v
+}
+
+// included applies @skip and @include.
+func (ex *gqlExec) included(s gqlSel) bool {
+	if d, ok := s.Directives["skip"]; ok && ex.arg(d["if"]) == true { return false }
+	if d, ok := s.Directives["include"]; ok && ex.arg(d["if"]) != true { return false }
+	return true
+}
+
+// fields expands fragments in a selection set and merges fields with the same response
+// key, whose selections are combined.
+func (ex *gqlExec) fields(sel []gqlSel, seen map[string]bool) ([]gqlSel, error) {
+	var out []gqlSel
+	at := map[string]int{}
+	add := func(f gqlSel) error {
+		key := nz(f.Alias, f.Name)
+		i, dup := at[key]
+		if !dup {
+			at[key] = len(out)
+			out = append(out, f)
+			return nil
+		}
+		if out[i].Name != f.Name { return fmt.Errorf("%s selects both %s and %s", key, out[i].Name, f.Name) }
+		out[i].Sel = append(append([]gqlSel(nil), out[i].Sel...), f.Sel...)
+		return nil
+	}
+	for _, s := range sel {
+		if !ex.included(s) { continue }
+		if s.Name != "" {
+			if err := add(s); err != nil { return nil, err }
+			continue
+		}
+		sub, inner := s.Sel, seen
+		if s.Spread != "" {
+			if seen[s.Spread] { return nil, fmt.Errorf("fragment %s spreads itself", s.Spread) }
+			var ok bool
+			if sub, ok = ex.frags[s.Spread]; !ok { return nil, fmt.Errorf("unknown fragment %s", s.Spread) }
+			inner = map[string]bool{s.Spread: true}
+			for k := range seen { inner[k] = true }
+		}
+		fs, err := ex.fields(sub, inner)
+		if err != nil { return nil, err }
+		for _, f := range fs {
+			if err := add(f); err != nil { return nil, err }
+		}
+	}
+	return out, nil
+}
+
+// object resolves sel on v, of type typ ("" for a plain JSON object).
+func (ex *gqlExec) object(typ string, v interface{}, sel []gqlSel, path []interface{}) interface{} {
+	if len(path) > gqlMaxDepth {
+		ex.fail(path, fmt.Errorf("query nests deeper than %d levels", gqlMaxDepth)); return nil
+	}
+	fields, err := ex.fields(sel, nil)
+	if err != nil {
+		ex.fail(path, err); return nil
+	}
+	out := &gqlObject{}
+	var plain map[string]interface{}
+	for _, f := range fields {
+		key := nz(f.Alias, f.Name)
+		fpath := append(append([]interface{}(nil), path...), key)
+		out.keys = append(out.keys, key)
+		out.vals = append(out.vals, nil)
+		if f.Name == "__typename" {
+			out.vals[len(out.vals)-1] = nz(typ, "Object")
+			continue
+		}
+		args := map[string]interface{}{}
+		for k, a := range f.Args { args[k] = ex.arg(a) }
+		def, computed := gqlLookup(typ, f.Name)
+		var val interface{}
+		ftyp := ""
+		if computed {
+			for k := range args {
+				known := false
+				for _, a := range def.Args { known = known || a == k }
+				if !known { err = fmt.Errorf("unknown argument %s on %s", k, f.Name) }
+			}
+			if err == nil { val, err = def.Resolve(ex, v, args) }
+			ftyp = def.Type
+		} else {
+			if plain == nil { plain = gqlGeneric(v) }
+			k := matchField(plain, f.Name)
+			switch {
+			case k == "":
+				err = fmt.Errorf("cannot query field %s on %s", f.Name, nz(typ, "this object"))
+			case len(args) > 0:
+				err = fmt.Errorf("%s takes no arguments", f.Name)
+			}
+			val = plain[k]
+		}
+		if err != nil {
+			ex.fail(fpath, err); err = nil
+			continue
+		}
+		out.vals[len(out.vals)-1] = ex.value(ftyp, val, f, fpath)
+	}
+	return out
+}
+
+// value completes a field's value: lists item by item, objects by their selection.
+func (ex *gqlExec) value(typ string, v interface{}, f gqlSel, path []interface{}) interface{} {
+	if typ != "" && len(f.Sel) == 0 {
+		ex.fail(path, fmt.Errorf("%s is an object: select its fields", f.Name)); return nil
+	}
+	if list, ok := v.([]interface{}); ok {
+		out := make([]interface{}, len(list))
+		for i, it := range list { out[i] = ex.value(typ, it, f, append(append([]interface{}(nil), path...), i)) }
+		return out
+	}
+	if v == nil { return nil }
+	_, isObj := v.(map[string]interface{})
+	isObj = isObj || typ != ""
+	switch {
+	case isObj && len(f.Sel) == 0:
+		ex.fail(path, fmt.Errorf("%s is an object: select its fields", f.Name)); return nil
+	case !isObj && len(f.Sel) > 0:
+		ex.fail(path, fmt.Errorf("%s has no fields to select", f.Name)); return nil
+	case !isObj:
+		return v
+	}
+	return ex.object(typ, v, f.Sel, path)
+}
+
+// runGraphQL executes a query; errors before execution leave data nil.
+func runGraphQL(r *http.Request, query, opName string, vars map[string]interface{}) (interface{}, []gqlError) {
+	doc, err := parseGraphQL(query)
+	if err != nil { return nil, []gqlError{{Message: "syntax: " + err.Error()}} }
+	if opName == "" && len(doc.Ops) > 1 { return nil, []gqlError{{Message: "operationName is required with several operations"}} }
+	var op *gqlOp
+	for i := range doc.Ops {
+		if opName == "" || doc.Ops[i].Name == opName { op = &doc.Ops[i] }
+	}
+	if op == nil { return nil, []gqlError{{Message: fmt.Sprintf("no operation named %q", opName)}} }
+	if op.Kind != "query" { return nil, []gqlError{{Message: op.Kind + " isn't supported: the GraphQL API is read-only"}} }
+	ex := &gqlExec{r: r, vars: map[string]interface{}{}, frags: doc.Frags}
+	for _, v := range op.Vars {
+		val, ok := vars[v.Name]
+		if !ok && v.HasDefault { val, ok = v.Default, true }
+		if v.Required && val == nil { return nil, []gqlError{{Message: "variable $" + v.Name + " is required"}} }
+		ex.vars[v.Name] = val
+	}
+	data := ex.object("Query", nil, op.Sel, nil)
+	return data, ex.errs
+}
+
+// handleGraphQL serves /graphql.
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "variables: "+err.Error(), 400); return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, gqlMaxBody+1))
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		if len(body) > gqlMaxBody {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge); return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "body: "+err.Error(), 400); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		http.Error(w, "query is required", 400); return
+	}
+	data, errs := runGraphQL(r, req.Query, req.OperationName, req.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	if data == nil { w.WriteHeader(400) }
+	json.NewEncoder(w).Encode(struct {
+		Data   interface{} `json:"data"`
+		Errors []gqlError  `json:"errors,omitempty"`
+	}{data, errs})
+}
+
+// -------- API docs --------
+
+// /api/openapi.json is an OpenAPI 3 description of the JSON API generated from apiOps,
+// listing only the operations the caller's role may use; /api/docs renders it with
+// Swagger UI, whose "Try it out" calls the API with the caller's own login or key.
+
+// apiOp documents one API operation. Params are "name:description" query parameters;
+// Body, when set, is an example JSON request body.
+type apiOp struct {
+	Method, Path, Tag, Summary string
+	Params                     []string
+	Body                       string
+}
+
+// readParams apply to every endpoint that reads the loaded dataset.
+var readParams = []string{"dataset:workspace to read (default: the default dataset)"}
+
+var pageParams = []string{"limit:page size (default 50, max 500)", "cursor:NextCursor from the previous page", "offset:rows to skip instead of a cursor",
+	"sort:field to sort by, - prefix for descending", "fields:comma-separated fields to return"}
+
+var fxParams = []string{"currency:convert money to this ISO currency at query time", "rateDate:convert at that day's rates (needs currency.historyUrl) instead of the current ones"}
+
+var apiOps = []apiOp{
+	{"GET", "/api/kpis", "analysis", "KPIs for the loaded dataset, or per segment with groupby", []string{"from:first day to include (recomputes the KPIs)", "to:last day to include", "granularity:keep only the day, week or month revenue series (with groupby, the segment trends; default week)",
+		"groupby:region, country, channel, rep, campaign, category, product, account, company, customer, currency or status", fxParams[0], fxParams[1]}, ""},
+	{"GET", "/api/series", "analysis", "Revenue series", append([]string{"granularity:day (default), week or month"}, fxParams...), ""},
+	{"GET", "/api/accounts", "analysis", "Top parent accounts with child drill-down", []string{"account:one account"}, ""},
+	{"GET", "/api/v1/categories", "analysis", "Revenue by product category with product drill-down", []string{"category:one category"}, ""},
+	{"GET", "/api/v1/countries", "analysis", "Revenue by country with company drill-down", []string{"country:one country, by name or ISO code"}, ""},
+	{"GET", "/api/customers", "listings", "Customers, paginated", pageParams, ""},
+	{"GET", "/api/products", "listings", "Products, paginated", pageParams, ""},
+	{"GET", "/api/anomalies", "listings", "Anomaly days, paginated", pageParams, ""},
+	{"GET", "/api/v1/rows", "listings", "Loaded rows, normalized and filtered", append([]string{"filter:text, or a WHERE condition like amount > 500"}, pageParams...), ""},
+	{"GET", "/api/v1/slice", "analysis", "KPIs for a date range, product, customer tier or customer", []string{"from:first day", "to:last day", "product:one product", "tier:Platinum, Gold, Silver or Bronze",
+		"customer:customer or parent account (scans the rows)", "filter:row filter as in /api/v1/rows (scans the rows)", "granularity:day (default), week or month"}, ""},
+	{"GET", "/api/v1/query", "analysis", "Restricted SQL-like query over the sales table (no joins, subqueries or functions beyond COUNT/SUM/AVG/MIN/MAX)", []string{"q:SELECT ... FROM sales ...", "limit:most rows returned"}, ""},
+	{"GET", "/api/v1/search", "analysis", "Search customers, products, dates and anomalies", []string{"q:search text"}, ""},
+	{"GET", "/api/v1/insights", "analysis", "The week's most notable changes against the 4 weeks before it", []string{"week:any day of the week to report (default: the last full week)"}, ""},
+	{"GET", "/api/v1/bridge", "analysis", "Revenue bridge between two periods", []string{"period:month, quarter, 2025-Q2 or 2025-06"}, ""},
+	{"GET", "/api/v1/close", "analysis", "Close package for a period", []string{"period:month, quarter, 2025-Q2 or 2025-06", "format:md for Markdown"}, ""},
+	{"GET", "/api/v1/explain", "analysis", "How a metric was computed", []string{"metric:metric name"}, ""},
+	{"GET", "/api/v1/schema", "analysis", "Data dictionary: normalized fields, dimensions and metrics of the dataset", nil, ""},
+	{"GET", "/api/v1/suggestions", "analysis", "Suggested actions and their status", nil, ""},
+	{"POST", "/api/v1/suggestions", "analysis", "Mark a suggestion done or dismissed", nil, `{"key": "dunning", "status": "done"}`},
+	{"GET", "/api/v1/forecasts", "analysis", "Forecast vs actual tracking", nil, ""},
+	{"GET", "/api/v1/targets", "analysis", "Revenue targets with percent-to-target, pace and projected attainment", nil, ""},
+	{"POST", "/api/v1/targets", "analysis", "Add or replace a weekly or monthly revenue target", nil, `{"name": "Monthly", "period": "month", "amount": 120000}`},
+	{"DELETE", "/api/v1/targets", "analysis", "Remove a target added here", []string{"name:target name"}, ""},
+	{"GET", "/api/v1/anomaly-exclusions", "analysis", "Date windows left out of anomaly detection", nil, ""},
+	{"POST", "/api/v1/anomaly-exclusions", "analysis", "Leave a date window out of anomaly detection", nil, `{"from": "2025-03-03", "to": "2025-03-09", "reason": "Billing migration"}`},
+	{"DELETE", "/api/v1/anomaly-exclusions", "analysis", "Remove a window added here", []string{"id:exclusion id"}, ""},
+	{"GET", "/api/v1/restatements", "analysis", "Revisions to previously reported days", nil, ""},
+	{"GET", "/api/v1/events", "events", "Events log", []string{"from:first day", "to:last day"}, ""},
+	{"POST", "/api/v1/events", "events", "Log events (JSON, form, or CSV with date, kind, title, end)", nil, `{"date": "2025-07-01", "kind": "deploy", "title": "Checkout v2"}`},
+	{"DELETE", "/api/v1/events", "events", "Remove an event", []string{"id:event id"}, ""},
+	{"GET", "/api/v1/freshness", "analysis", "Dataset freshness against expected cadence", nil, ""},
+	{"GET", "/api/v1/snapshots", "analysis", "Recent published analyses", nil, ""},
+	{"GET", "/api/v1/workspaces", "data", "Datasets with preset, currency, unit, rows, range and last ingest", nil, ""},
+	{"POST", "/api/v1/workspaces", "data", "Create an empty workspace, or change a dataset's business-type preset, currency or unit", nil, `{"name": "emea", "preset": "services", "currency": "EUR", "unit": "seats"}`},
+	{"GET", "/api/v1/presets", "data", "Business-type presets: thresholds, KPIs shown and suggestion wording", nil, ""},
+	{"GET", "/api/jobs", "data", "Recent upload jobs, newest first", nil, ""},
+	{"GET", "/api/jobs/{id}", "data", "An upload job's status, parse progress and error", nil, ""},
+	{"POST", "/api/ingest", "data", "Push sale records as JSON", []string{"mode:replace (default), append or merge", "dataset:workspace to ingest into", "ai:1 for an AI summary"},
+		`[{"date": "2025-07-01", "customer": "Acme", "product": "Widget", "amount": 120, "status": "paid"}]`},
+	{"POST", "/api/v1/ingest", "data", "Fetch a CSV or xlsx by URL and ingest it", nil, `{"url": "https://portal.example.com/export.csv", "mode": "merge", "dataset": ""}`},
+	{"POST", "/api/v1/uploads", "data", "Stage a file upload (multipart)", nil, ""},
+	{"GET", "/api/v1/contacts", "data", "Customer contacts", nil, ""},
+	{"GET", "/api/v1/aliases", "data", "Customer aliases", nil, ""},
+	{"POST", "/api/v1/aliases", "data", "Merge or rename a customer", nil, `{"from": "ACME Inc", "to": "Acme"}`},
+	{"DELETE", "/api/v1/aliases", "data", "Remove an alias", []string{"from:aliased name"}, ""},
+	{"GET", "/api/v1/alert-rules", "alerts", "Alert rules and whether they fire now", nil, ""},
+	{"POST", "/api/v1/alert-rules", "alerts", "Add or replace an alert rule", nil, `{"name": "weekly dip", "when": "revenue_wow < -20%", "severity": "warning"}`},
+	{"DELETE", "/api/v1/alert-rules", "alerts", "Delete a saved alert rule", []string{"name:rule name"}, ""},
+	{"GET", "/api/v1/alert-state", "alerts", "Alert conditions inside the cooldown", nil, ""},
+	{"DELETE", "/api/v1/alert-state", "alerts", "Clear the alert cooldown", nil, ""},
+	{"GET", "/api/v1/slack/preview", "alerts", "Preview the Slack alert payload", nil, ""},
+	{"GET", "/api/v1/outbound", "integrations", "Outbound payload audit", nil, ""},
+	{"POST", "/api/v1/outbound/decision", "integrations", "Approve or reject a held payload", []string{"id:payload id", "action:approve or reject"}, ""},
+	{"GET", "/api/v1/crm", "integrations", "Customer insights the CRM sync would push", nil, ""},
+	{"POST", "/api/v1/crm", "integrations", "Push customer insights to the CRM now", []string{"force:1 to push unchanged customers too"}, ""},
+	{"POST", "/api/v1/pull", "integrations", "Poll the FTP/SFTP drops now", nil, ""},
+	{"POST", "/api/v1/stripe", "integrations", "Sync charges or invoices from Stripe now", nil, ""},
+	{"POST", "/api/v1/shopify", "integrations", "Sync orders updated in Shopify since the last sync now", []string{"full:1 to reload the whole history window"}, ""},
+	{"POST", "/api/v1/digest/send", "integrations", "Send the anomaly digest now", nil, ""},
+	{"POST", "/api/v1/insights/send", "integrations", "Send the weekly insights now", []string{"week:any day of the week to report"}, ""},
+	{"GET", "/api/v1/me", "auth", "The caller's name and role", nil, ""},
+	{"POST", "/graphql", "analysis", "GraphQL queries over datasets, KPIs, series, segments, customers, products and snapshots", nil,
+		`{"query": "query($n: Int) { kpis { totalRevenue orders } customers(limit: $n) { customer revenue products { product revenue } } }", "variables": {"n": 5}}`},
+}
+
+// openAPISpec builds the spec for the operations role may use.
+func openAPISpec(role string) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, op := range apiOps {
+		need := roleNeeded(op.Method, op.Path)
+		if roleRank[role] < roleRank[need] { continue }
+		params := op.Params
+		if op.Method == http.MethodGet && op.Tag != "auth" && op.Tag != "alerts" && op.Tag != "integrations" { params = append(append([]string(nil), params...), readParams...) }
+		var ps []interface{}
+		for _, p := range params {
+			name, desc, _ := strings.Cut(p, ":")
+			ps = append(ps, map[string]interface{}{"name": name, "in": "query", "description": desc, "schema": map[string]string{"type": "string"}})
+		}
+		desc := "Requires the " + need + " role."
+		if signedPaths[op.Path] { desc += " Needs a BizPulse or Slack signature as well as a key while a signing secret is set." }
+		o := map[string]interface{}{"tags": []string{op.Tag}, "summary": op.Summary, "description": desc,
+			"responses": map[string]interface{}{"200": map[string]string{"description": "OK"}, "401": map[string]string{"description": "no or unknown credential"}, "403": map[string]string{"description": "role too low"}}}
+		if len(ps) > 0 { o["parameters"] = ps }
+		if op.Body != "" {
+			var example interface{}
+			json.Unmarshal([]byte(op.Body), &example)
+			o["requestBody"] = map[string]interface{}{"content": map[string]interface{}{"application/json": map[string]interface{}{"example": example}}}
+		}
+		item, _ := paths[op.Path].(map[string]interface{})
+		if item == nil { item = map[string]interface{}{}; paths[op.Path] = item }
+		item[strings.ToLower(op.Method)] = o
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "BizPulse API", "version": "1", "description": "Operations available to the " + role + " role."},
+		"paths":   paths,
+		"components": map[string]interface{}{"securitySchemes": map[string]interface{}{
+			"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			"basic":  map[string]string{"type": "http", "scheme": "basic"},
+		}},
+		"security": []interface{}{map[string][]string{"bearer": {}}, map[string][]string{"apiKey": {}}, map[string][]string{"basic": {}}},
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec(roleFor(r)))
+}
+
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	apiDocsTpl.Execute(w, strings.TrimSuffix(nz(cfg.SwaggerUI, "https://unpkg.com/swagger-ui-dist@5"), "/"))
+}
+
+var apiDocsTpl = template.Must(template.New("apiDocs").Parse(`<!doctype html><html><head><meta charset="utf-8"><title>BizPulse · API</title>
+<link rel="stylesheet" href="{{.}}/swagger-ui.css"></head><body>
+<div id="ui"><p style="font-family:system-ui;padding:20px">Loading Swagger UI… The spec is also at <a href="/api/openapi.json">/api/openapi.json</a>.</p></div>
+<script src="{{.}}/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: '/api/openapi.json', dom_id: '#ui', tryItOutEnabled: true, persistAuthorization: true});</script>
+</body></html>`))
+
+// -------- Sessions --------
+
+// With -sessions, dashboard uploads land in an analysis private to the browser's session
+// cookie instead of replacing the shared one, so analysts on one server don't overwrite
+// each other. Requests without a session analysis see the shared data.
+const (
+	sessionCookie = "bizpulse_session"
+	sessionTTL    = 24 * time.Hour // idle sessions are dropped after this
+)
+
+var sessionUploads bool
+
+// maxSessions caps the live session analyses (-max-sessions), each of which holds a whole
+// dataset; a new session past it evicts the one idle longest.
+var maxSessions = 100
+
+type session struct {
+	Analysis
+	seen time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*session{}
+)
+
+// analysisFor returns a view of the caller's session analysis if it has loaded data, else
+// of the shared one.
+func analysisFor(r *http.Request) *Analysis { return currentAnalysis(r).view() }
+
+// currentAnalysis is the live analysis analysisFor views.
+func currentAnalysis(r *http.Request) *Analysis {
+	if name := datasetFor(r); name != defaultDataset {
+		if a, err := workspace(name, false); err == nil { return a }
+		return &Analysis{Dataset: name} // unknown workspace: nothing loaded
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil { return shared }
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s := sessions[c.Value]; s != nil && s.view().KPIs != nil {
+		s.seen = time.Now()
+		return &s.Analysis
+	}
+	return shared
+}
+
+// uploadTarget returns the analysis an upload should write to: the shared one unless
+// -sessions is on, in which case the caller's session (created with a cookie when create
+// is set; API callers without a cookie keep writing to the shared analysis). A selected
+// workspace takes precedence over both.
+func uploadTarget(w http.ResponseWriter, r *http.Request, create bool) (*Analysis, error) {
+	if name := datasetFor(r); name != defaultDataset { return workspace(name, create) }
+	if !sessionUploads { return shared, nil }
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	now := time.Now()
+	for id, s := range sessions {
+		if now.Sub(s.seen) > sessionTTL { delete(sessions, id) }
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if s := sessions[c.Value]; s != nil {
+			s.seen = now
+			return &s.Analysis, nil
+		}
+	}
+	if !create { return shared, nil }
+	buf := make([]byte, 16)
+	if _, err := cryptorand.Read(buf); err != nil { return shared, nil }
+	for maxSessions > 0 && len(sessions) >= maxSessions {
+		idle := ""
+		for id, s := range sessions {
+			if idle == "" || s.seen.Before(sessions[idle].seen) { idle = id }
+		}
+		delete(sessions, idle)
+	}
+	id := hex.EncodeToString(buf)
+	s := &session{seen: now}
+	sessions[id] = s
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, MaxAge: int(sessionTTL / time.Second)})
+	return &s.Analysis, nil
+}
+
+// allAnalyses lists the shared analysis, every workspace and every live session analysis.
+func allAnalyses() []*Analysis {
+	out := []*Analysis{shared}
+	workspacesMu.Lock()
+	for _, a := range workspaces { out = append(out, a) }
+	workspacesMu.Unlock()
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range sessions { out = append(out, &s.Analysis) }
+	return out
+}
+
+// handleSessionReset drops the caller's session analysis so the dashboard shows shared data again.
+func handleSessionReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sessionsMu.Lock()
+		delete(sessions, c.Value)
+		sessionsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// -------- Workspaces --------
+
+// Workspaces are named datasets (e.g. one per business unit) kept beside the default one.
+// Each has its own store derived from -store, with the name before the extension
+// (file:bizpulse.jsonl keeps "emea" in bizpulse.emea.jsonl), and is found again on restart
+// from those files. The API picks one with ?dataset=NAME; the dashboard's selector
+// remembers the choice in a cookie. Alerts, restatements and forecast tracking cover
+// the default dataset only.
+const datasetCookie = "bizpulse_dataset"
+
+var (
+	workspacesMu   sync.Mutex
+	workspaces     = map[string]*Analysis{}
+	workspaceStore string // the -store spec workspace stores are derived from
+	datasetNameRe  = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+)
+
+// WorkspaceInfo summarizes a dataset for the workspace list.
+type WorkspaceInfo struct {
+	Name       string
+	Preset     string
+	Currency   string // what the amounts are in; "" when not known
+	Unit       string
+	Rows       int
+	From, To   time.Time
+	Revenue    float64
+	LastIngest time.Time
+}
+
+// datasetFor is the dataset a request addresses: ?dataset= (or a form field), else the
+// dashboard's selection cookie, else the default.
+func datasetFor(r *http.Request) string {
+	if name := r.FormValue("dataset"); name != "" { return name }
+	if c, err := r.Cookie(datasetCookie); err == nil && c.Value != "" { return c.Value }
+	return defaultDataset
+}
+
+// selectDataset remembers the dashboard's workspace; the default clears the cookie.
+func selectDataset(w http.ResponseWriter, name string) {
+	if name == defaultDataset {
+		http.SetCookie(w, &http.Cookie{Name: datasetCookie, Path: "/", MaxAge: -1}); return
+	}
+	http.SetCookie(w, &http.Cookie{Name: datasetCookie, Value: name, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// workspace returns the named dataset's analysis, opening its store when create is set
+// and it doesn't exist yet. An empty name or the default name is the shared analysis.
+func workspace(name string, create bool) (*Analysis, error) {
+	if name == "" || name == defaultDataset { return shared, nil }
+	if !datasetNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid dataset %q: use up to 32 lowercase letters, digits, - or _", name)
+	}
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+	if a := workspaces[name]; a != nil { return a, nil }
+	if !create { return nil, fmt.Errorf("unknown dataset %q", name) }
+	st, err := openStore(datasetStoreSpec(workspaceStore, name))
+	if err != nil { return nil, err }
+	a := &Analysis{Dataset: name, store: st}
+	workspaces[name] = a
+	return a, nil
+}
+
+// datasetStoreSpec derives a workspace's store from the default one; memory stays memory.
+func datasetStoreSpec(spec, name string) string {
+	kind, path, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "file":
+		path = nz(path, "bizpulse.jsonl")
+	case "sqlite":
+		path = nz(path, "bizpulse.db")
+	default:
+		return spec
+	}
+	ext := filepath.Ext(path)
+	return kind + ":" + strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// restoreWorkspaces reopens the workspaces whose store files exist next to the default
+// store.
+func restoreWorkspaces() error {
+	kind, path, _ := strings.Cut(workspaceStore, ":")
+	switch kind {
+	case "file":
+		path = nz(path, "bizpulse.jsonl")
+	case "sqlite":
+		path = nz(path, "bizpulse.db")
+	default:
+		return nil
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext) + "."
+	matches, err := filepath.Glob(base + "*" + ext)
+	if err != nil { return err }
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(m, base), ext)
+		if !datasetNameRe.MatchString(name) || name == defaultDataset { continue }
+		workspacesMu.Lock()
+		_, open := workspaces[name]
+		workspacesMu.Unlock()
+		if open { continue }
+		a, err := workspace(name, true)
+		if err != nil { return fmt.Errorf("workspace %s: %w", name, err) }
+		if err := restoreFromStore(a); err != nil { return fmt.Errorf("workspace %s: %w", name, err) }
+	}
+	return nil
+}
+
+// workspaceNames lists the default dataset first, then workspaces by name.
+func workspaceNames() []string {
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+	var names []string
+	for name := range workspaces { names = append(names, name) }
+	sort.Strings(names)
+	return append([]string{defaultDataset}, names...)
+}
+
+// handleWorkspaces lists datasets (GET) or creates an empty one (POST name=..., with an
+// optional preset=...). Posting an existing name with a preset changes its preset; the
+// default dataset's can only be changed that way.
+func handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name, preset := r.FormValue("name"), r.FormValue("preset")
+		meta := DatasetMeta{Currency: r.FormValue("currency"), Unit: r.FormValue("unit")}
+		if name == "" {
+			var body struct{ Name, Preset, Currency, Unit string }
+			json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body)
+			name, preset, meta = body.Name, body.Preset, DatasetMeta{Currency: body.Currency, Unit: body.Unit}
+		}
+		if name == "" || name == defaultDataset && preset == "" && meta == (DatasetMeta{}) {
+			http.Error(w, "name is required and can't be "+defaultDataset, 400); return
+		}
+		if preset != "" {
+			if err := checkPreset(preset); err != nil { http.Error(w, err.Error(), 400); return }
+		}
+		meta.Currency = strings.ToUpper(strings.TrimSpace(meta.Currency))
+		if err := meta.check(); err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		a, err := workspace(name, true)
+		if err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+		changed := false
+		if preset != "" && preset != presetFor(name).Name {
+			if err := setPreset(name, preset); err != nil { http.Error(w, err.Error(), 500); return }
+			changed = true
+		}
+		if meta != (DatasetMeta{}) {
+			if err := setDatasetMeta(name, meta); err != nil { http.Error(w, err.Error(), 500); return }
+			changed = true
+		}
+		if changed && a.rows() > 0 { recomputeLatest() }
+		if r.FormValue("redirect") != "" {
+			selectDataset(w, name)
+			http.Redirect(w, r, "/", http.StatusSeeOther); return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	var out []WorkspaceInfo
+	for _, name := range workspaceNames() {
+		a, err := workspace(name, false)
+		if err != nil { continue }
+		out = append(out, workspaceInfo(name, a.view()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// workspaceInfo summarizes the named dataset's analysis a.
+func workspaceInfo(name string, a *Analysis) WorkspaceInfo {
+	freshnessMu.Lock()
+	info := WorkspaceInfo{Name: name, Preset: presetFor(name).Name, Rows: len(a.Sales), LastIngest: lastIngest[name]}
+	freshnessMu.Unlock()
+	meta := datasetMeta(name)
+	info.Currency, info.Unit = meta.Currency, meta.Unit
+	if k := a.KPIs; k != nil { info.From, info.To, info.Revenue = k.From, k.To, k.TotalRevenue }
+	return info
+}
+
+// routes is the server's handler for every route; main wraps it in the demo guard and
+// authentication.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleIndex)
+	mux.HandleFunc("/session/reset", handleSessionReset)
+	mux.HandleFunc("/api/v1/workspaces", handleWorkspaces)
+	mux.HandleFunc("/api/v1/presets", handlePresets)
+	mux.HandleFunc("/api/v1/me", handleMe)
+	mux.HandleFunc("/api/openapi.json", handleOpenAPI)
+	mux.HandleFunc("/api/docs", handleAPIDocs)
+	mux.HandleFunc("/upload", handleUpload)
+	mux.HandleFunc("/api/jobs", handleJobs)
+	mux.HandleFunc("/api/jobs/", handleJobs)
+	handleSigned(mux, "/api/ingest", handleIngest)
+	handleSigned(mux, "/api/v1/ingest", handleURLIngest)
+	handleSigned(mux, "/api/v1/pull", handlePull)
+	handleSigned(mux, "/api/v1/stripe", handleStripe)
+	handleSigned(mux, "/api/v1/shopify", handleShopify)
+	mux.HandleFunc("/api/kpis", handleKPIs)
+	mux.HandleFunc("/api/series", handleSeries)
+	mux.HandleFunc("/api/accounts", handleAccounts)
+	mux.HandleFunc("/api/v1/categories", handleCategories)
+	mux.HandleFunc("/api/v1/countries", handleCountries)
+	mux.HandleFunc("/api/customers", handleCustomers)
+	mux.HandleFunc("/api/products", handleProducts)
+	mux.HandleFunc("/api/anomalies", handleAnomalies)
+	mux.HandleFunc("/api/v1/rows", handleRows)
+	mux.HandleFunc("/api/v1/query", handleQuery)
+	mux.HandleFunc("/graphql", handleGraphQL)
+	mux.HandleFunc("/api/v1/slice", handleSlice)
+	mux.HandleFunc("/api/v1/restatements", handleRestatements)
+	mux.HandleFunc("/api/v1/events", handleEvents)
+	mux.HandleFunc("/api/v1/freshness", handleFreshness)
+	mux.HandleFunc("/api/v1/uploads", handleUploadsAPI)
+	mux.HandleFunc("/api/v1/uploads/", handleUploadsAPI)
+	mux.HandleFunc("/wizard", handleWizard)
+	mux.HandleFunc("/wizard/analyze", handleWizardAnalyze)
+	mux.HandleFunc("/wizard/columns", handleWizardColumns)
+	mux.HandleFunc("/api/v1/explain", handleExplain)
+	mux.HandleFunc("/api/v1/schema", handleSchema)
+	mux.HandleFunc("/api/v1/forecasts", handleForecasts)
+	mux.HandleFunc("/api/v1/snapshots", handleSnapshots)
+	mux.HandleFunc("/api/v1/snapshots/", handleSnapshots)
+	mux.HandleFunc("/api/v1/search", handleSearch)
+	mux.HandleFunc("/api/v1/suggestions", handleSuggestions)
+	mux.HandleFunc("/api/v1/targets", handleTargets)
+	mux.HandleFunc("/api/v1/anomaly-exclusions", handleAnomalyExclusions)
+	mux.HandleFunc("/api/v1/close", handleClose)
+	mux.HandleFunc("/api/v1/bridge", handleBridge)
+	mux.HandleFunc("/export/xlsx", handleExportXLSX)
+	mux.HandleFunc("/export/html", handleExportHTML)
+	mux.HandleFunc("/export/clean", handleExportClean)
+	mux.HandleFunc("/export/outreach.csv", handleOutreachExport)
+	mux.HandleFunc("/api/v1/contacts", handleContacts)
+	mux.HandleFunc("/view", handleDrill)
+	mux.HandleFunc("/api/v1/aliases", handleAliases)
+	mux.HandleFunc("/api/v1/aliases/undo", handleAliasUndo)
+	mux.HandleFunc("/aliases", handleAliasPage)
+	mux.HandleFunc("/api/v1/outbound", handleOutbound)
+	mux.HandleFunc("/api/v1/outbound/decision", handleOutboundDecision)
+	mux.HandleFunc("/outbound", handleOutboundPage)
+	mux.HandleFunc("/digest/preview", handleDigestPreview)
+	mux.HandleFunc("/insights/preview", handleInsightsPreview)
+	mux.HandleFunc("/api/v1/insights", handleInsights)
+	mux.HandleFunc("/api/v1/slack/preview", handleSlackPreview)
+	mux.HandleFunc("/api/v1/alert-rules", handleAlertRules)
+	mux.HandleFunc("/alert-rules", handleAlertRulesPage)
+	mux.HandleFunc("/api/v1/alert-state", handleAlertState)
+	handleSigned(mux, "/api/v1/crm", handleCRM)
+	handleSigned(mux, "/api/v1/digest/send", handleDigestSend)
+	handleSigned(mux, "/api/v1/insights/send", handleInsightsSend)
+	return mux
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runQueryCLI(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var (
+		file  = flag.String("file", "", "CSV or .xlsx file to analyze, or stripe:charges / stripe:invoices to pull from Stripe (CLI mode; comma-separate several to merge)")
+		fetchURL = flag.String("url", "", "HTTPS URL of a CSV or .xlsx file to fetch and analyze (CLI mode; headers from the config's fetch section)")
+		sheet = flag.String("sheet", "", "Worksheet name or 1-based index for .xlsx input (default: first sheet)")
+		serve = flag.Bool("serve", false, "Start HTTP server")
+		port  = flag.Int("port", 8080, "HTTP port")
+		config  = flag.String("config", "", "JSON config file (optional)")
+		parents = flag.String("parents", "", "CSV of child,parent customer mappings for account rollup (optional)")
+		leads   = flag.String("leads", "", "Leads/signups CSV for funnel analysis (CLI mode, optional)")
+		spend   = flag.String("spend", "", "Campaign spend CSV (campaign,spend,start) for ROI (CLI mode, optional)")
+		aliases = flag.String("aliases", "aliases.json", "Customer merge/rename mappings file")
+		granularity = flag.String("granularity", "day", "Revenue breakdown in report.md: day, week or month (CLI mode)")
+		forecasts = flag.String("forecasts", "forecasts.jsonl", "File where each forecast is kept for forecast-vs-actual tracking")
+		agingHist = flag.String("aging-history", "aging.jsonl", "File where each analysis's receivables age is kept for the aging drift alert")
+		outLog  = flag.String("outbound-log", "", "Append audited outbound payloads (Slack, OpenAI) to this JSONL file")
+		approve = flag.Bool("approve-outbound", false, "Hold outbound payloads until approved at /outbound (server mode)")
+		perSession = flag.Bool("sessions", false, "Keep dashboard uploads private to each browser session (server mode)")
+		sessionCap = flag.Int("max-sessions", maxSessions, "With -sessions, the most session analyses kept; a new one past it drops the one idle longest")
+		strict  = flag.Bool("strict", false, "Fail an ingest on any row it can't fully read, listing the rows, instead of leaving them out (as \"strict\": true in the config)")
+		dateFmt = flag.String("date-format", "", "Read numeric dates like 03/04/2025 as dmy, mdy or a Go layout such as 02.01.2006, instead of inferring it per file; overrides the config")
+		columns = flag.String("columns", "", "Pin sale fields to exact headers, e.g. amount=Net Amount,date=Order Date")
+		moneyFmt = flag.String("money", "", "Amount display: cents, whole or short ($12.3k); overrides the config")
+		pullState = flag.String("pull-state", "pulled.json", "Files already ingested from FTP/SFTP drops without an archive directory")
+		shopifyState = flag.String("shopify-state", "shopify.json", "Cursor of the incremental Shopify order sync")
+		sugState = flag.String("suggestions", "suggestions.json", "File where suggestions marked done or dismissed are kept")
+		targetsFile = flag.String("targets", "targets.json", "Revenue targets added from the dashboard")
+		exclusionsFile = flag.String("anomaly-exclusions", "anomaly-exclusions.json", "Date windows left out of anomaly detection, added from the dashboard")
+		presetsFile = flag.String("presets", "presets.json", "Business-type presets picked for workspaces")
+		metaFile = flag.String("dataset-meta", "dataset-meta.json", "Currency and unit metadata set on workspaces")
+		splitBy   = flag.String("split-by", "", "Write one report per product, customer or region (report-<value>.md) instead of report.md (CLI mode)")
+		splitCombined = flag.Bool("split-combined", false, "With -split-by, write a single report.md with a chapter per segment")
+		closeSpec = flag.String("close", "", "Write a close package (close-<period>.md) for quarter, month, 2025-Q2 or 2025-06 instead of report.md (CLI mode)")
+		schedule = flag.String("schedule", "", "Cron expression (minute hour day month weekday) to re-run the -file/-url analysis, e.g. \"0 8 * * MON\"")
+		contactsFile = flag.String("contacts", "contacts.csv", "Customer contacts CSV (customer, email, owner, optional name/phone) joined into outreach exports")
+		rulesFile    = flag.String("alert-rules", "alert-rules.json", "Alert rules added from the alert rules page")
+		alertState   = flag.String("alert-state", "alert-state.json", "Recently sent alert conditions, for the alert cooldown")
+		eventsFile   = flag.String("events", "events.json", "Events log (deploys, campaigns, price changes, outages, holidays) matched against anomalies and used as the forecast's holiday calendar")
+		demo = flag.Bool("demo", false, "Serve generated sample data read-only: no uploads or changes, no outbound alerts, watermarked UI")
+		storeSpec = flag.String("store", "file:bizpulse.jsonl", "Server data store: file:path, sqlite:path (needs a SQLite driver in the build) or memory")
+		pprofAddr = flag.String("pprof", "", "Serve runtime profiles and stats on this address, e.g. localhost:6060; :6060 means localhost, other hosts need BIZPULSE_PPROF_TOKEN (server mode)")
+		memStats  = flag.Duration("memstats", 0, "Log memory, goroutine and dataset-size stats at this interval, e.g. 10m (server mode)")
+		rowLimit  = flag.Int("max-rows", maxRows, "Fail an ingest that keeps more than this many rows (HTTP 413), before it runs the server out of memory; 0 for no limit")
+		jobLimit  = flag.Duration("job-timeout", jobTimeout, "Cancel a dashboard upload still parsing or analyzing after this long; 0 for no limit (server mode)")
+		usersFile = flag.String("users", "", "JSON file of API keys and dashboard logins with read or upload roles (server mode; adds to BIZPULSE_API_KEYS)")
+	)
+	flag.Parse()
+	outboundLogPath = *outLog
+	outboundApproval = *approve && *serve
+	maxRows = *rowLimit
+
+	demoMode = *demo
+	if !demoMode {
+		if err := loadAliases(*aliases); err != nil { log.Fatal(err) }
+		if err := loadForecasts(*forecasts); err != nil { log.Fatal(err) }
+		if err := loadAgingHistory(*agingHist); err != nil { log.Fatal(err) }
+		if err := loadSuggestionState(*sugState); err != nil { log.Fatal(err) }
+		if err := loadTargets(*targetsFile); err != nil { log.Fatal(err) }
+		if err := loadExclusions(*exclusionsFile); err != nil { log.Fatal(err) }
+		if err := loadPresets(*presetsFile); err != nil { log.Fatal(err) }
+		if err := loadDatasetMeta(*metaFile); err != nil { log.Fatal(err) }
+		if err := loadContacts(*contactsFile); err != nil { log.Fatal(err) }
+		if err := loadAlertRules(*rulesFile); err != nil { log.Fatal(err) }
+		if err := loadAlertState(*alertState); err != nil { log.Fatal(err) }
+		if err := loadEvents(*eventsFile); err != nil { log.Fatal(err) }
+	}
+
+	if *config != "" {
+		if err := loadConfig(*config); err != nil { log.Fatal(err) }
+	}
+	if *parents != "" {
+		if err := loadParentAccounts(*parents); err != nil { log.Fatal(err) }
+	}
+	if *columns != "" {
+		if err := parseColumnFlag(*columns); err != nil { log.Fatal(err) }
+	}
+	if *strict { cfg.Strict = true }
+	if *dateFmt != "" {
+		if err := checkDateFormat(*dateFmt); err != nil { log.Fatal(err) }
+		cfg.DateFormat = *dateFmt
+	}
+	if *moneyFmt != "" {
+		if err := checkMoneyFormat(*moneyFmt); err != nil { log.Fatal(err) }
+		cfg.Money = *moneyFmt
+	}
+	sources := *file
+	if *fetchURL != "" { sources = strings.Trim(sources+","+*fetchURL, ",") }
+	var sched *cronSchedule
+	if *schedule != "" {
+		var err error
+		if sched, err = parseCron(*schedule); err != nil { log.Fatal(err) }
+		if sources == "" { log.Fatal("-schedule needs -file or -url to re-read") }
+	}
+
+	t, err := dashboardTemplate(cfg.Templates)
+	if err != nil { log.Fatal(err) }
+	tpl = t
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *serve || demoMode {
+		if demoMode {
+			publishAnalysis(context.Background(), shared, demoSales(time.Now().UTC().Truncate(24*time.Hour)), nil, nil, false, nil)
+		} else {
+			st, err := openStore(*storeSpec)
+			if err != nil { log.Fatal(err) }
+			log.Printf("store: %s", *storeSpec)
+			defer st.Close()
+			store = st
+			if err := restoreFromStore(shared); err != nil { log.Fatal(err) }
+			workspaceStore = *storeSpec
+			if err := restoreWorkspaces(); err != nil { log.Fatal(err) }
+		}
+		sessionUploads = *perSession
+		maxSessions = *sessionCap
+		jobTimeout = *jobLimit
+		for ds, cad := range cfg.ExpectedCadence {
+			if _, err := parseCadence(cad); err != nil { log.Fatalf("expectedCadence %s: %v", ds, err) }
+		}
+		// background ingest and alerting; a demo has neither
+		if !demoMode {
+			if len(cfg.ExpectedCadence) > 0 {
+				goBackground(func() { monitorFreshness(ctx, time.Minute) })
+			}
+			if err := loadPullState(*pullState); err != nil { log.Fatal(err) }
+			for _, pc := range cfg.Pull {
+				every, err := parseCadence(nz(pc.Every, "1h"))
+				if err != nil || every <= 0 { log.Fatalf("pull.every: invalid %q", pc.Every) }
+				pc := pc
+				goBackground(func() { monitorPull(ctx, pc, every) })
+			}
+			if len(cfg.Digest.To) > 0 {
+				every, err := parseCadence(nz(cfg.Digest.Every, "24h"))
+				if err != nil || every <= 0 { log.Fatalf("digest.every: invalid %q", cfg.Digest.Every) }
+				goBackground(func() { monitorDigest(ctx, every) })
+			}
+			if cfg.Insights.enabled() {
+				sc, err := parseCron(nz(cfg.Insights.Schedule, "0 8 * * MON"))
+				if err != nil { log.Fatalf("insights.schedule: %v", err) }
+				goBackground(func() { runScheduled(ctx, sc, func() error { return runInsights(ctx) }) })
+			}
+			if cfg.CRM.Provider != "" {
+				every, err := parseCadence(nz(cfg.CRM.Every, "24h"))
+				if err != nil || every <= 0 { log.Fatalf("crm.every: invalid %q", cfg.CRM.Every) }
+				goBackground(func() { monitorCRM(ctx, every) })
+			}
+			if cfg.Shopify.Shop != "" {
+				if err := loadShopifyState(*shopifyState); err != nil { log.Fatal(err) }
+				every, err := parseCadence(nz(cfg.Shopify.Every, "1h"))
+				if err != nil || every <= 0 { log.Fatalf("shopify.every: invalid %q", cfg.Shopify.Every) }
+				goBackground(func() { monitorShopify(ctx, every) })
+			}
+			if cfg.Stripe.Every != "" {
+				every, err := parseCadence(cfg.Stripe.Every)
+				if err != nil || every <= 0 { log.Fatalf("stripe.every: invalid %q", cfg.Stripe.Every) }
+				goBackground(func() { monitorStripe(ctx, every) })
+			}
+			if sched != nil {
+				goBackground(func() { runScheduled(ctx, sched, func() error { return scheduledIngest(ctx, sources, *sheet, *granularity) }) })
+			}
+		}
+		if *pprofAddr != "" {
+			addr, err := pprofListenAddr(*pprofAddr)
+			if err != nil { log.Fatal(err) }
+			go func() {
+				log.Printf("profiles on %s/debug/pprof/", addr)
+				log.Printf("pprof: %v", http.ListenAndServe(addr, pprofHandler()))
+			}()
+		}
+		if *memStats > 0 { go logRuntimeStats(ctx, *memStats) }
+		var h http.Handler = routes()
+		if demoMode { h = demoGuard(h) }
+		if err := loadCredentials(*usersFile); err != nil { log.Fatal(err) }
+		if len(credentials) > 0 {
+			h = requireAuth(h)
+			log.Printf("auth: %d credential(s); requests need an API key or login", len(credentials))
+		} else {
+			log.Printf("auth: no credentials configured; anyone who can reach the server can read and upload (set BIZPULSE_API_KEYS or -users)")
+		}
+		addr := fmt.Sprintf(":%d", *port)
+		log.Printf("BizPulse server on %s", addr)
+		if err := serveUntil(ctx, addr, h); err != nil && !errors.Is(err, http.ErrServerClosed) { log.Fatal(err) }
+		log.Printf("BizPulse server stopped")
+		return
+	}
+
+	if *closeSpec != "" {
+		if sources == "" { log.Fatal("-close needs -file or -url") }
+		if err := runClose(ctx, sources, *sheet, *closeSpec); err != nil { log.Fatal(err) }
+		return
+	}
+	if *splitBy != "" {
+		if sources == "" { log.Fatal("-split-by needs -file or -url") }
+		if err := runSplit(ctx, sources, *sheet, *splitBy, *splitCombined, *granularity); err != nil { log.Fatal(err) }
+		return
+	}
+	if sched != nil {
+		runScheduled(ctx, sched, func() error { return runCLI(ctx, sources, *sheet, *leads, *spend, *granularity) })
+		return
+	}
+	if sources != "" {
+		if err := runCLI(ctx, sources, *sheet, *leads, *spend, *granularity); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fmt.Println("Usage:")
+	fmt.Println("  go run main.go -file=data.csv           # CLI: outputs report.md")
+	fmt.Println("  go run main.go -serve -port=8080        # Web: upload & dashboard")
+	fmt.Println("  go run main.go -file=data.csv -schedule=\"0 8 * * MON\"  # re-run weekly")
+	fmt.Println(`  go run main.go query -file=data.csv "SELECT product, SUM(amount) FROM sales GROUP BY product"`)
+}
+
+// dashboardView is what the dashboard template renders.
+type dashboardView struct{ KPIs *KPIs; Glossary []MetricDef; Freshness []Freshness; Merge *MergeResult; Session bool; Columns string; Quality []*DataQuality; Series []KVt; SeriesTitle string; Customers []CustomerLTV; CustomerCount int; Dataset string; Workspaces []string; Role string; SegmentFields []string; Overlays []SeriesOverlay
+		Preset *Preset; Presets []*Preset
+		Granularity, From, To, RangeError, RangeQuery string
+		Export bool; ExportedAt time.Time; ExportBase string } // Export leaves out what needs the server; see handleExportHTML
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if data := dashboardData(w, r); data != nil { _ = tpl.Execute(w, data) }
+}
+
+// dashboardData collects the dashboard for r: the selected dataset, narrowed to ?from=&to=,
+// with the chart at ?granularity=. It returns nil once it has answered r itself.
+func dashboardData(w http.ResponseWriter, r *http.Request) *dashboardView {
+	var data dashboardView
+	if name := r.URL.Query().Get("dataset"); name != "" {
+		if _, err := workspace(name, false); err != nil {
+			http.Error(w, err.Error(), 404); return nil
+		}
+		selectDataset(w, name)
+	}
+	a := analysisFor(r)
+	data.Columns = bindingSummary(a.Columns)
+	data.Quality = a.Quality
+	data.KPIs = a.KPIs
+	if a.KPIs != nil {
+		sales := a.Sales
+		// ?from=&to= narrows the whole dashboard to a window
+		if from, to, err := dateRange(r.URL.Query()); err != nil {
+			data.RangeError = err.Error()
+		} else if !from.IsZero() || !to.IsZero() {
+			if k, err := rangeKPIs(r.Context(), a, from, to, nil); err != nil {
+				if r.Context().Err() != nil { return nil }
+				data.RangeError = err.Error()
+			} else {
+				data.KPIs, sales = k, salesBetween(a.Sales, from, to)
+				data.From, data.To = r.URL.Query().Get("from"), r.URL.Query().Get("to")
+				if !from.IsZero() { data.From = from.Format("2006-01-02") }
+				if !to.IsZero() { data.To = to.Format("2006-01-02") }
+				data.RangeQuery = "&from=" + data.From + "&to=" + data.To
+			}
+		}
+		g := r.URL.Query().Get("granularity")
+		series, err := seriesFor(data.KPIs, g)
+		if err != nil { g, series = "day", data.KPIs.DailyRevenue }
+		data.Granularity = nz(g, "day")
+		data.Series = series
+		data.SeriesTitle = map[string]string{"week": "Weekly", "month": "Monthly"}[g]
+		if data.SeriesTitle == "" { data.SeriesTitle = "Daily" }
+		data.Overlays = comparisonOverlays(series, g)
+		data.Customers = customerLTV(sales)
+		data.CustomerCount = len(data.Customers)
+		if len(data.Customers) > ltvTableRows { data.Customers = data.Customers[:ltvTableRows] }
+		data.SegmentFields = segmentFields(sales)
+	}
+	data.Merge = a.Merge
+	data.Session = a.Dataset == ""
+	data.Dataset = nz(a.Dataset, datasetFor(r))
+	data.Preset = presetFor(data.Dataset)
+	for _, name := range presetNames { data.Presets = append(data.Presets, presets[name]) }
+	data.Workspaces = workspaceNames()
+	data.Role = roleFor(r)
+	data.Glossary = metricDefs(data.Dataset)
+	data.Freshness = freshnessStatus(time.Now())
+	return &data
+}
+
+// handleExportHTML downloads the dashboard as it's shown (same dataset, ?from=&to= and
+// ?granularity=) as one self-contained HTML file to attach or archive: styles and charts
+// are inline, and what needs the server (search, uploads, forms, the segment and raw-data
+// tables, chart zoom) is left out. Links to drill-downs open on the server the file came
+// from (the Slack dashboardURL when set). GET /export/html.
+func handleExportHTML(w http.ResponseWriter, r *http.Request) {
+	data := dashboardData(w, r)
+	if data == nil { return }
+	if data.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	data.Export, data.ExportedAt = true, time.Now()
+	data.ExportBase = strings.TrimRight(cfg.Slack.DashboardURL, "/") + "/"
+	if data.ExportBase == "/" {
+		scheme := "http"
+		if r.TLS != nil { scheme = "https" }
+		data.ExportBase = scheme + "://" + r.Host + "/"
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	name := "bizpulse-" + data.KPIs.To.Format("2006-01-02")
+	if data.Dataset != defaultDataset { name = "bizpulse-" + data.Dataset + "-" + data.KPIs.To.Format("2006-01-02") }
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+".html")
+	w.Write(buf.Bytes())
+}
+
+// handleUpload takes a dashboard upload (sales files plus optional leads, spend, contacts
+// and events) and starts a job for the sales files; see Jobs. The side files are small
+// and are checked before answering.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if err := r.ParseMultipartForm(50<<20); err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		http.Error(w, "file is required", 400); return
+	}
+	target, err := uploadTarget(w, r, true)
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	if p := r.FormValue("preset"); p != "" && target.Dataset != "" {
+		if err := setPreset(target.Dataset, p); err != nil {
+			http.Error(w, err.Error(), 400); return
+		}
+	}
+	u := &uploadRequest{target: target, cur: currentAnalysis(r), sheet: r.FormValue("sheet"), merging: r.FormValue("merge") != ""}
+	u.appending = u.merging || r.FormValue("append") != ""
+	if lf, _, err := r.FormFile("leads"); err == nil {
+		defer lf.Close()
+		if u.leads, err = parseLeads(lf); err != nil {
+			http.Error(w, "leads: "+err.Error(), 400); return
+		}
+	}
+	if sf, _, err := r.FormFile("spend"); err == nil {
+		defer sf.Close()
+		if u.spend, err = parseSpend(sf); err != nil {
+			http.Error(w, "spend: "+err.Error(), 400); return
+		}
+	}
+	if cf, _, err := r.FormFile("contacts"); err == nil {
+		b, err := io.ReadAll(io.LimitReader(cf, 10<<20))
+		cf.Close()
+		if err == nil { _, err = setContacts(b) }
+		if err != nil {
+			http.Error(w, "contacts: "+err.Error(), 400); return
+		}
+	}
+	if ef, _, err := r.FormFile("events"); err == nil {
+		evs, err := parseEvents(ef)
+		ef.Close()
+		if err == nil { err = addEvents(evs) }
+		if err != nil {
+			http.Error(w, "events: "+err.Error(), 400); return
+		}
+	}
+	// the request's temporary files are removed when it ends, so the job gets copies
+	var names []string
+	for _, fh := range files {
+		sf, err := saveUpload(fh)
+		if err != nil {
+			u.cleanup()
+			http.Error(w, "save "+fh.Filename+": "+err.Error(), 500); return
+		}
+		u.files = append(u.files, sf)
+		names = append(names, fh.Filename)
+	}
+	j := newJob(target, names)
+	ctx, cancel := jobContext()
+	goBackground(func() {
+		defer cancel()
+		u.run(ctx, j)
+	})
+	if target.Dataset != "" { selectDataset(w, target.Dataset) }
+	if r.FormValue("wait") != "" {
+		select {
+		case <-j.done:
+		case <-r.Context().Done(): // nobody is left to wait for the result
+			cancel()
+			<-j.done
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/", http.StatusSeeOther); return
+	}
+	v, _ := jobView(j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+j.ID)
+	switch {
+	case v.Finished == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case v.Status == "failed":
+		w.WriteHeader(400)
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// publishAnalysis analyzes an ingest and makes it a's dataset. For the shared analysis it
+// also records restatements and ingest freshness and sends alerts; session analyses don't.
+// save (if set) stores the rows once the analysis is done, so an ingest whose ctx ends
+// mid-analysis leaves both the store and the dashboard as they were.
+func publishAnalysis(ctx context.Context, a *Analysis, sales []Sale, leads []Lead, spend []CampaignSpend, ai bool, save func() error) (KPIs, error) {
+	k, err := analyze(ctx, a.Dataset, sales, leads, spend)
+	if err != nil { return KPIs{}, err }
+	if save != nil {
+		if err := save(); err != nil { return KPIs{}, err }
+	}
+	markReviewedAnomalies(a.Dataset, &k, sales, a == shared)
+	k.RankChanges = rankChanges(a.view().KPIs, k, time.Now())
+	if a == shared {
+		logRankChanges(k.RankChanges)
+		recordRestatements(shared.view().KPIs, k, time.Now())
+		k.Restatements = restatements()
+		k.ForecastTracking = trackForecasts(k.DailyRevenue, k.To, true)
+		if err := recordForecast(k); err != nil { log.Printf("forecasts: %v", err) }
+		if k.Receivables != nil { k.Receivables.Drift = agingDrift(k.Receivables) }
+		if err := recordAging(k); err != nil { log.Printf("aging history: %v", err) }
+	}
+	// AI exec summary (optional)
+	if ai && os.Getenv("OPENAI_API_KEY") != "" {
+		ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+		defer cancel()
+		k.ExecSummary = openAISummary(ctx, k)
+	}
+	a.set(k, sales, leads, spend)
+	if a.Dataset != "" { markIngested(a.Dataset, time.Now()) }
+	if a != shared { return k, nil }
+	// push alerts if anomalies, overdue or territories behind pace
+	dispatchAlerts(k, sales)
+	return k, nil
+}
+
+// ?from=&to= on /api/kpis and the dashboard recompute the KPIs from the rows in that
+// window, either end open when left out. Results are kept per published analysis, so
+// flipping between a few ranges doesn't re-run the analysis each time.
+const rangeCacheSize = 16
+
+var (
+	rangeMu    sync.Mutex
+	rangeCache = map[string]*KPIs{}
+)
+
+// dateRange reads ?from= and ?to=; a bound that's left out is zero.
+func dateRange(q url.Values) (from, to time.Time, err error) {
+	for _, d := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(d.name); v != "" {
+			if *d.t = parseDateFlexible(v); d.t.IsZero() { return from, to, fmt.Errorf("%s: expected a date like 2025-07-01", d.name) }
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) { return from, to, fmt.Errorf("to is before from") }
+	return from, to, nil
+}
+
+// salesBetween returns the sales from..to, inclusive; zero bounds are open.
+func salesBetween(sales []Sale, from, to time.Time) []Sale {
+	var out []Sale
+	for _, s := range sales {
+		if (from.IsZero() || !s.Date.Before(from)) && (to.IsZero() || !s.Date.After(to)) { out = append(out, s) }
+	}
+	return out
+}
+
+// rangeKPIs analyzes a's rows from..to, converted by fx when it's set; an error when none
+// fall in the window or ctx ends first (nothing is cached then).
+func rangeKPIs(ctx context.Context, a *Analysis, from, to time.Time, fx *FXConversion) (*KPIs, error) {
+	key := a.Dataset + "|" + a.Snapshot + "|" + from.Format("2006-01-02") + "|" + to.Format("2006-01-02")
+	if fx != nil { key += "|" + fx.To + "|" + strconv.FormatFloat(fx.Rate, 'g', -1, 64) }
+	rangeMu.Lock()
+	k := rangeCache[key]
+	rangeMu.Unlock()
+	if k != nil { return k, nil }
+	sales, spend := salesBetween(a.Sales, from, to), a.Spend
+	if len(sales) == 0 { return nil, withKind(ErrNoData, fmt.Errorf("no rows in the selected range")) }
+	if fx != nil { sales, spend = fx.apply(sales, spend) }
+	kp, err := analyze(ctx, a.Dataset, sales, a.Leads, spend)
+	if err != nil { return nil, err }
+	if fx != nil { kp.Currency, kp.Conversion = fx.To, fx }
+	rangeMu.Lock()
+	if len(rangeCache) >= rangeCacheSize { rangeCache = map[string]*KPIs{} }
+	rangeCache[key] = &kp
+	rangeMu.Unlock()
+	return &kp, nil
+}
+
+func handleKPIs(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	q := r.URL.Query()
+	from, to, err := dateRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	field, g := q.Get("groupby"), q.Get("granularity")
+	if field != "" {
+		ok := false
+		for _, f := range groupByFields { ok = ok || f == field }
+		if !ok {
+			http.Error(w, "groupby must be one of "+strings.Join(groupByFields, ", "), 400); return
+		}
+		g = nz(g, "week")
+	}
+	if g != "" && g != "day" && g != "week" && g != "month" {
+		http.Error(w, "granularity must be day, week or month", 400); return
+	}
+	// the snapshot and the query fix the answer, so a match skips the recompute below;
+	// a currency conversion doesn't, as current rates move under the same query
+	if q.Get("currency") == "" && q.Get("rateDate") == "" && notModified(w, r, a.Snapshot) { return }
+	fx, err := queryConversion(r, a.KPIs)
+	if err != nil {
+		httpError(w, "", err, 400); return
+	}
+	sales, k := a.Sales, *a.KPIs
+	ranged := !from.IsZero() || !to.IsZero()
+	if ranged { sales = salesBetween(a.Sales, from, to) }
+	if fx != nil {
+		sales, _ = fx.apply(sales, nil)
+		fxHeaders(w, fx)
+	}
+	if field != "" {
+		seg, err := segmentKPIs(r.Context(), a.Dataset, sales, field, g)
+		if err != nil {
+			httpError(w, "", err, 500); return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(seg)
+		return
+	}
+	if ranged || fx != nil {
+		rk, err := rangeKPIs(r.Context(), a, from, to, fx)
+		if err != nil {
+			httpError(w, "", err, 404); return
+		}
+		k = *rk
+	}
+	// ?granularity= keeps only that revenue series
+	if g != "" {
+		series, _ := seriesFor(&k, g)
+		k.DailyRevenue, k.WeeklyRevenue, k.MonthlyRevenue = nil, nil, nil
+		switch g {
+		case "week":
+			k.WeeklyRevenue = series
+		case "month":
+			k.MonthlyRevenue = series
+		default:
+			k.DailyRevenue = series
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k)
+}
+
+// handleSeries returns the revenue series, daily unless ?granularity=week|month, in
+// ?currency= when it's set (the rate is in the X-FX-* headers).
+func handleSeries(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	fx, err := queryConversion(r, a.KPIs)
+	if err != nil {
+		httpError(w, "", err, 400); return
+	}
+	k := a.KPIs
+	if fx != nil {
+		if k, err = rangeKPIs(r.Context(), a, time.Time{}, time.Time{}, fx); err != nil {
+			httpError(w, "", err, 500); return
+		}
+		fxHeaders(w, fx)
+	}
+	series, err := seriesFor(k, r.URL.Query().Get("granularity"))
+	if err != nil {
+		http.Error(w, err.Error(), 400); return
+	}
+	if fx == nil && notModified(w, r, a.Snapshot) { return }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// snapshotID is a content hash of an analysis; identical results share an ID.
+func snapshotID(k KPIs) string {
+	b, _ := json.Marshal(k)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// notModified sets an ETag derived from snapshot (the analysis being answered from) and
+// the normalized query, and answers 304 when the client's If-None-Match already has it.
+// Call it before the expensive work, once the query is known to be valid.
+func notModified(w http.ResponseWriter, r *http.Request, snapshot string) bool {
+	etag := snapshot
+	if q := r.URL.Query().Encode(); q != "" { // sorted by key, so parameter order doesn't matter
+		sum := sha256.Sum256([]byte(q))
+		etag += "-" + hex.EncodeToString(sum[:4])
+	}
+	etag = `"` + etag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// handleAccounts returns the top account rollups, or one account's children with ?account=.
+func handleAccounts(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	w.Header().Set("Content-Type", "application/json")
+	if name := r.URL.Query().Get("account"); name != "" {
+		for _, acct := range a.KPIs.AccountRollups {
+			if strings.EqualFold(acct.Account, name) {
+				json.NewEncoder(w).Encode(acct)
+				return
+			}
+		}
+		http.Error(w, "account not found", 404); return
+	}
+	json.NewEncoder(w).Encode(a.KPIs.AccountRollups)
+}
+
+// CustomerRow and ProductRow are the per-entity rows served by the listing endpoints.
+type CustomerRow struct {
+	Customer   string
+	Account    string
+	Revenue    float64
+	Orders     int
+	AOV        float64
+	Overdue    float64
+	FirstOrder time.Time
+	LastOrder  time.Time
+}
+
+type ProductRow struct {
+	Product   string
+	Revenue   float64
+	Orders    int
+	Customers int
+	AOV       float64
+}
+
+func customerRows(sales []Sale) []CustomerRow {
+	idx := map[string]int{}
+	var out []CustomerRow
+	for _, s := range sales {
+		i, ok := idx[s.Customer]
+		if !ok {
+			i = len(out)
+			idx[s.Customer] = i
+			out = append(out, CustomerRow{Customer: s.Customer, Account: accountOf(s.Customer), FirstOrder: s.Date})
+		}
+		c := &out[i]
+		c.Revenue += s.Amount
+		if !isRefund(s) { c.Orders++ }
+		if s.Date.Before(c.FirstOrder) { c.FirstOrder = s.Date }
+		if s.Date.After(c.LastOrder) { c.LastOrder = s.Date }
+		if isOverdue(s.Status) {
+			c.Overdue += s.Amount
+		}
+	}
+	for i := range out {
+		if out[i].Orders > 0 { out[i].AOV = out[i].Revenue / float64(out[i].Orders) } // refunds only: no orders to average over
+	}
+	return out
+}
+
+func productRows(sales []Sale) []ProductRow {
+	idx := map[string]int{}
+	buyers := map[string]map[string]bool{}
+	var out []ProductRow
+	for _, s := range sales {
+		i, ok := idx[s.Product]
+		if !ok {
+			i = len(out)
+			idx[s.Product] = i
+			out = append(out, ProductRow{Product: s.Product})
+			buyers[s.Product] = map[string]bool{}
+		}
+		out[i].Revenue += s.Amount
+		if !isRefund(s) { out[i].Orders++ }
+		buyers[s.Product][s.Customer] = true
+	}
+	for i := range out {
+		if out[i].Orders > 0 { out[i].AOV = out[i].Revenue / float64(out[i].Orders) }
+		out[i].Customers = len(buyers[out[i].Product])
+	}
+	return out
+}
+
+// Page is the standard envelope for listing endpoints.
+type Page struct {
+	Items      []interface{}
+	NextCursor string
+	Total      int
+}
+
+// pageCursor is where a page ended, sent base64-encoded as NextCursor: the snapshot paged
+// through, a hash of the query (sort and filter), and the count and key of the rows before
+// the next page. The key is a hash of the last row, so a cursor only resumes on the exact
+// listing it came from.
+type pageCursor struct {
+	Snapshot string
+	Query    string
+	Offset   int
+	Key      string
+}
+
+// pageQuery hashes q without the parameters that only pick a page out of the listing.
+func pageQuery(q url.Values) string {
+	rest := url.Values{}
+	for k, v := range q {
+		switch k {
+		case "cursor", "offset", "limit", "fields":
+		default:
+			rest[k] = v
+		}
+	}
+	sum := sha256.Sum256([]byte(rest.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// rowKey hashes a row's JSON.
+func rowKey(row reflect.Value) (string, error) {
+	b, err := json.Marshal(row.Interface())
+	if err != nil { return "", err }
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// writePage applies ?sort=[-]field, ?cursor= (or ?offset=), ?limit= and ?fields=a,b to items,
+// a slice of structs from the published snapshot, and writes the page; only the page's rows
+// are encoded. Field names match case-insensitively; defaultSort is used when ?sort= is
+// absent. A cursor from an earlier snapshot answers 410, and one that doesn't fit this
+// listing (another query, or its last row moved) 400: the client starts over.
+func writePage(w http.ResponseWriter, r *http.Request, snapshot string, items interface{}, defaultSort string) {
+	q := r.URL.Query()
+	rows := reflect.ValueOf(items)
+	elem := rows.Type().Elem()
+	order := make([]int, rows.Len())
+	for i := range order { order[i] = i }
+
+	sortKey := nz(q.Get("sort"), defaultSort)
+	desc := strings.HasPrefix(sortKey, "-")
+	if name := strings.TrimPrefix(sortKey, "-"); name != "" {
+		f := structField(elem, name)
+		if f < 0 {
+			http.Error(w, "unknown sort field", 400); return
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			a, b := rows.Index(order[i]).Field(f), rows.Index(order[j]).Field(f)
+			if desc { return lessField(b, a) }
+			return lessField(a, b)
+		})
+	}
+
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", 400); return
+		}
+		limit = n
+	}
+	if limit > 500 { limit = 500 }
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", 400); return
+		}
+		offset = n
+	}
+	if c := q.Get("cursor"); c != "" {
+		var pc pageCursor
+		raw, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil { err = json.Unmarshal(raw, &pc) }
+		if err != nil || pc.Offset < 1 {
+			http.Error(w, "invalid cursor", 400); return
+		}
+		if pc.Snapshot != snapshot {
+			http.Error(w, "stale cursor: the data has been republished since; start again without ?cursor=", http.StatusGone); return
+		}
+		if pc.Query != pageQuery(q) || pc.Offset > len(order) {
+			http.Error(w, "cursor is for a different listing", 400); return
+		}
+		if key, err := rowKey(rows.Index(order[pc.Offset-1])); err != nil || key != pc.Key {
+			http.Error(w, "cursor is for a different listing", 400); return
+		}
+		offset = pc.Offset
+	}
+
+	page := Page{Items: []interface{}{}, Total: len(order)}
+	end := offset
+	if offset < len(order) {
+		end = offset + limit
+		if end > len(order) { end = len(order) }
+	}
+	var fields []int
+	if f := q.Get("fields"); f != "" {
+		for _, name := range strings.Split(f, ",") {
+			if i := structField(elem, strings.TrimSpace(name)); i >= 0 { fields = append(fields, i) }
+		}
+	}
+	for _, i := range order[offset:end] {
+		row := rows.Index(i)
+		if q.Get("fields") == "" {
+			page.Items = append(page.Items, row.Interface())
+			continue
+		}
+		sparse := map[string]interface{}{}
+		for _, f := range fields { sparse[elem.Field(f).Name] = row.Field(f).Interface() }
+		page.Items = append(page.Items, sparse)
+	}
+	if end < len(order) {
+		key, err := rowKey(rows.Index(order[end-1]))
+		if err != nil {
+			http.Error(w, "encoding rows: "+err.Error(), 500); return
+		}
+		c, _ := json.Marshal(pageCursor{Snapshot: snapshot, Query: pageQuery(q), Offset: end, Key: key})
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(c)
+	}
+	b, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "encoding rows: "+err.Error(), 500); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// structField is the index of t's field called name, matched case-insensitively, or -1.
+func structField(t reflect.Type, name string) int {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, name) { return i }
+	}
+	return -1
+}
+
+// lessField orders two values of a row field: numbers numerically, times chronologically,
+// everything else by its printed form.
+func lessField(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.String:
+		return a.String() < b.String()
+	}
+	if ta, ok := a.Interface().(time.Time); ok { return ta.Before(b.Interface().(time.Time)) }
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+func matchField(row map[string]interface{}, name string) string {
+	for k := range row {
+		if strings.EqualFold(k, name) { return k }
+	}
+	return ""
+}
+
+// lessValue orders decoded JSON scalars: numbers numerically, everything else as strings.
+func lessValue(a, b interface{}) bool {
+	fa, okA := a.(float64)
+	fb, okB := b.(float64)
+	if okA && okB { return fa < fb }
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+func handleCustomers(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	writePage(w, r, a.Snapshot, customerRows(a.Sales), "-Revenue")
+}
+
+func handleProducts(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	writePage(w, r, a.Snapshot, productRows(a.Sales), "-Revenue")
+}
+
+// RawRow is one loaded sale as normalized, for the raw-data explorer. Row is its 1-based
+// position in the dataset (sorted by date).
+type RawRow struct {
+	Row         int
+	Date        string
+	Customer    string
+	RawCustomer string // as written in the file, before aliases
+	Account     string
+	Product     string
+	Amount      float64
+	Currency    string
+	OrigAmount  float64 // in Currency, before conversion
+	Status      string
+	Rep         string
+	Region      string
+	Campaign    string
+	Invoice     string
+	Tax         float64
+	Discount    float64
+	Quantity    float64
+	Category    string
+	Channel     string
+	Email       string
+	Country     string // enriched; see Geography
+	Company     string // from the email domain
+}
+
+// handleRows pages through the loaded rows: /api/v1/rows?limit=&offset=&filter=, where
+// filter is a WHERE condition or plain text (see parseFilter). Sort and fields work as
+// on the other listings.
+func handleRows(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	cond, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, "filter: "+err.Error(), 400); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	rows := []RawRow{}
+	for i, s := range a.Sales {
+		if cond != nil && !cond.eval(s) { continue }
+		rows = append(rows, rawRow(i, s))
+	}
+	writePage(w, r, a.Snapshot, rows, "")
+}
+
+// rawRow is s, the i-th (0-based) loaded sale, as a RawRow.
+func rawRow(i int, s Sale) RawRow {
+	return RawRow{Row: i + 1, Date: s.Date.Format("2006-01-02"), Customer: s.Customer, RawCustomer: s.RawCustomer,
+		Account: accountOf(s.Customer), Product: s.Product, Amount: s.Amount, Currency: s.Currency, OrigAmount: s.OrigAmount,
+		Status: s.Status, Rep: s.Rep, Region: s.Region, Campaign: s.Campaign, Invoice: s.Invoice,
+		Tax: s.inBase(s.Tax), Discount: s.inBase(s.Discount), Quantity: s.Quantity, Category: categoryOf(s), Channel: s.Channel,
+		Email: s.Email, Country: countryOf(s), Company: companyOf(s)}
+}
+
+func handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	a := analysisFor(r)
+	if a.KPIs == nil {
+		http.Error(w, "no KPIs yet", 404); return
+	}
+	if notModified(w, r, a.Snapshot) { return }
+	writePage(w, r, a.Snapshot, a.KPIs.Anomalies, "Day")
+}
+
+// handleAliases lists (GET), adds (POST {"from","to"}) or removes (DELETE ?from=) customer aliases.
+func handleAliases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		from, to := r.FormValue("from"), r.FormValue("to")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body struct{ From, To string }
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil {
+				http.Error(w, "invalid JSON body", 400); return
+			}
+			from, to = body.From, body.To
+		}
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if from == "" || to == "" || strings.EqualFold(from, to) {
+			http.Error(w, "from and to are required and must differ", 400); return
+		}
+		err := changeAliases(func(next map[string]string) error {
+			next[strings.ToLower(from)] = to
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		recomputeLatest()
+	case http.MethodDelete:
+		from := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("from")))
+		err := changeAliases(func(next map[string]string) error {
+			if _, ok := next[from]; !ok { return errNoAlias }
+			delete(next, from)
+			return nil
+		})
+		if errors.Is(err, errNoAlias) {
+			http.Error(w, err.Error(), 404); return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		recomputeLatest()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	if r.Method == http.MethodPost && r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/aliases", http.StatusSeeOther); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases())
+}
+
+// handleAliasUndo restores the mapping in effect before the last change.
+func handleAliasUndo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return
+	}
+	err := undoAliases()
+	if errors.Is(err, errNothingToUndo) {
+		http.Error(w, err.Error(), 409); return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	recomputeLatest()
+	if r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/aliases", http.StatusSeeOther); return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases())
+}
+
+var aliasTpl = template.Must(template.New("aliases").Parse(`
+<!doctype html><html><head><meta charset="utf-8"><title>BizPulse · Customer aliases</title>
+<style>body{font-family:system-ui,Segoe UI,Roboto,Inter,Arial;background:#0b1020;color:#e8ecff;margin:0;padding:20px}
+.card{background:#111837;border:1px solid #203063;border-radius:14px;padding:16px;margin:12px 0}
+table{width:100%;border-collapse:collapse} th,td{border-bottom:1px solid #22305f;padding:8px}
+a{color:#7aa2ff} button{background:#7aa2ff;color:#04102a;border:none;padding:6px 10px;border-radius:8px;cursor:pointer}</style>
+</head><body>
+<h1>Customer aliases</h1><p><a href="/">← Dashboard</a></p>
+<div class="card">
+  <form method="POST" action="/api/v1/aliases">
+    <input type="hidden" name="redirect" value="1">
+    Merge <input name="from" placeholder="Acme Ltd" required> into <input name="to" placeholder="Acme" required>
+    <button type="submit">Save</button>
+  </form>
+  <form method="POST" action="/api/v1/aliases/undo" style="margin-top:8px">
+    <input type="hidden" name="redirect" value="1"><button type="submit">Undo last change</button>
+  </form>
+</div>
+<div class="card"><table><thead><tr><th>From</th><th>To</th></tr></thead><tbody>
+{{range $from, $to := .}}<tr><td>{{$from}}</td><td>{{$to}}</td></tr>{{else}}<tr><td colspan="2">No aliases yet.</td></tr>{{end}}
+</tbody></table></div>
+</body></html>`))
+
+func handleAliasPage(w http.ResponseWriter, _ *http.Request) {
+	_ = aliasTpl.Execute(w, aliases())
+}
+
+// loadSources reads comma-separated files or URLs, merging later ones into the first and
+// skipping rows already seen. It returns each file's quality report (none for Stripe).
+func loadSources(ctx context.Context, paths, sheet string) ([]Sale, []*DataQuality, error) {
+	var sales []Sale
+	var quality []*DataQuality
+	for i, path := range strings.Split(paths, ",") {
+		batch, q, err := readSalesSource(ctx, strings.TrimSpace(path), sheet)
+		if err != nil { return nil, nil, err }
+		if q != nil {
+			fmt.Printf("Columns in %s: %s\n", path, bindingSummary(q.Columns))
+			fmt.Printf("Quality of %s: %s\n", path, q.Summary())
+			quality = append(quality, q)
+		}
+		if i == 0 { sales = batch; continue }
+		var added []Sale
+		var skipped int
+		sales, added, skipped = mergeSales(sales, batch)
+		fmt.Printf("Merged %s: %d rows added, %d duplicates skipped\n", path, len(added), skipped)
+	}
+	return sales, quality, nil
+}
+
+func runCLI(ctx context.Context, paths, sheet, leadsPath, spendPath, granularity string) error {
+	if _, err := seriesFor(&KPIs{}, granularity); err != nil { return err }
+	sales, quality, err := loadSources(ctx, paths, sheet)
+	if err != nil { return err }
+	if len(sales) == 0 { return fmt.Errorf("%w in %s", errNoDatedRows, paths) }
+	var leads []Lead
+	if leadsPath != "" {
+		lf, err := os.Open(leadsPath)
+		if err != nil { return err }
+		defer lf.Close()
+		if leads, err = parseLeads(lf); err != nil { return err }
+	}
+	var spend []CampaignSpend
+	if spendPath != "" {
+		sf, err := os.Open(spendPath)
+		if err != nil { return err }
+		defer sf.Close()
+		if spend, err = parseSpend(sf); err != nil { return err }
+	}
+	k, err := analyze(ctx, defaultDataset, sales, leads, spend)
+	if err != nil { return err }
+	k.Quality = quality
+	k.ForecastTracking = trackForecasts(k.DailyRevenue, k.To, true)
+	if err := recordForecast(k); err != nil { return err }
+	if k.Receivables != nil { k.Receivables.Drift = agingDrift(k.Receivables) }
+	if err := recordAging(k); err != nil { return err }
+	// AI exec summary
+	if os.Getenv("OPENAI_API_KEY") != "" {
+		ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+		defer cancel()
+		k.ExecSummary = openAISummary(ctx, k)
+	}
+	md := renderMarkdown(k, granularity)
+	if err := os.WriteFile("report.md", []byte(md), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Wrote report.md")
+	if len(contacts) > 0 {
+		var b bytes.Buffer
+		if err := writeOutreachCSV(&b, outreachRows(k, sales, "")); err != nil { return err }
+		if err := os.WriteFile("outreach.csv", b.Bytes(), 0644); err != nil { return err }
+		fmt.Println("Wrote outreach.csv")
+	}
+	// Slack alert if needed
+	dispatchAlerts(k, sales)
+	return nil
+}
+
+func renderMarkdown(k KPIs, granularity string) string {
+	var b strings.Builder
+	if k.Orders == 0 { return "# BizPulse Report\n\nNo rows with a usable date were loaded.\n" }
+	fmt.Fprintf(&b, "# BizPulse Report (%s → %s)\n\n", k.From.Format("2006-01-02"), k.To.Format("2006-01-02"))
+	if len(k.Insufficient) > 0 {
+		fmt.Fprintf(&b, "> **Insufficient data:** %d day(s) with sales. These sections are left out until there is more history:\n", k.Days)
+		var sections []string
+		for section := range k.Insufficient { sections = append(sections, section) }
+		sort.Strings(sections)
+		for _, section := range sections { fmt.Fprintf(&b, "> - %s: %s\n", section, k.Insufficient[section]) }
+		fmt.Fprintln(&b)
+	}
+	if h := k.Health; h != nil {
+		fmt.Fprintf(&b, "**Health score: %.0f / 100 (%s)**\n\n", h.Score, h.Grade)
+		for _, c := range h.Components {
+			fmt.Fprintf(&b, "- %s: %.0f (weight %.0f%%) — %s\n", c.Name, c.Score, c.Weight*100, c.Detail)
+		}
+		fmt.Fprintln(&b)
+	}
+	retention := fmt.Sprintf("%.1f%%", k.RetentionRate*100)
+	if k.Insufficient["retention"] != "" { retention = "n/a (too little history)" }
+	fmt.Fprintf(&b, "- **Revenue:** %s\n- **Orders:** %d\n", money(k.TotalRevenue), k.Orders)
+	p := presetNamed(k.Preset)
+	if p.Shows("aov") { fmt.Fprintf(&b, "- **AOV:** %s\n", money(k.AvgOrderValue)) }
+	if p.Shows("customers") { fmt.Fprintf(&b, "- **Unique Customers:** %d\n", k.UniqueCustomers) }
+	if p.Shows("retention") { fmt.Fprintf(&b, "- **Retention:** %s\n", retention) }
+	if p.Shows("forecast") { fmt.Fprintf(&b, "- **Forecast (7d):** %s\n", forecastFigure(k)) }
+	fmt.Fprintln(&b)
+	if s := momentumSentence(k.Momentum); s != "" {
+		fmt.Fprintf(&b, "%s\n\n", s)
+	}
+	if len(k.Comparisons) > 0 {
+		fmt.Fprintf(&b, "## Period Comparison\n")
+		for _, c := range k.Comparisons {
+			fmt.Fprintf(&b, "- %s: %s vs %s", c.Label, money(c.Revenue), money(c.PrevRevenue))
+			if c.PrevRevenue > 0 { fmt.Fprintf(&b, " (%+.1f%%)", c.Change*100) }
+			fmt.Fprintf(&b, ", %d vs %d orders (%s → %s vs %s → %s", c.Orders, c.PrevOrders, c.From.Format("2006-01-02"), c.To.Format("2006-01-02"), c.PrevFrom.Format("2006-01-02"), c.PrevTo.Format("2006-01-02"))
+			if c.Excluded > 0 { fmt.Fprintf(&b, "; %d holiday day(s) left out", c.Excluded) }
+			fmt.Fprintln(&b, ")")
+		}
+		fmt.Fprintf(&b, "\nChanges compare %s.\n\n", k.Comparisons[0].Method)
+	}
+	if len(k.RankChanges) > 0 {
+		fmt.Fprintf(&b, "## Highlights\n")
+		for _, c := range k.RankChanges { fmt.Fprintf(&b, "- %s\n", c.Text()) }
+		fmt.Fprintln(&b)
+	}
+	if len(k.Currencies) > 0 {
+		fmt.Fprintf(&b, "## Currencies\n")
+		if k.BaseCurrency != "" {
+			fmt.Fprintf(&b, "Totals are converted to %s.\n\n", k.BaseCurrency)
+		}
+		for _, c := range k.Currencies {
+			fmt.Fprintf(&b, "- %s: %.2f over %d orders", c.Currency, c.Amount, c.Orders)
+			if k.BaseCurrency != "" && c.Currency != k.BaseCurrency { fmt.Fprintf(&b, " (%.2f %s)", c.Converted, k.BaseCurrency) }
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.AccountRollups) > 0 {
+		fmt.Fprintf(&b, "## Top Customers\n")
+		for _, r := range k.AccountRollups {
+			fmt.Fprintf(&b, "- %s: %s\n", r.Account, money(r.Revenue))
+			if len(r.Children) > 1 {
+				for _, c := range r.Children {
+					fmt.Fprintf(&b, "  - %s: %s\n", c.Key, money(c.Value))
+				}
+			}
+		}
+		fmt.Fprintf(&b, "\nTop 5 accounts drive %.1f%% of revenue.\n\n", k.Concentration*100)
+	}
+	if len(k.Categories) > 0 {
+		fmt.Fprintf(&b, "## Categories\n")
+		for _, c := range k.Categories {
+			fmt.Fprintf(&b, "- %s: %s (%.1f%%)", c.Category, money(c.Revenue), c.Share*100)
+			if c.Prior > 0 { fmt.Fprintf(&b, ", last %d days %+.0f%%", bridgeDays, c.Change*100) }
+			fmt.Fprintln(&b)
+			for _, p := range c.Products {
+				fmt.Fprintf(&b, "  - %s: %s\n", p.Key, money(p.Value))
+			}
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Countries) > 0 {
+		fmt.Fprintf(&b, "## Revenue by Country\n")
+		for _, c := range k.Countries {
+			fmt.Fprintf(&b, "- %s: %s (%.1f%%; orders %d, customers %d)", c.Name, money(c.Revenue), c.Share*100, c.Orders, c.Customers)
+			if c.Prior > 0 { fmt.Fprintf(&b, ", last %d days %+.0f%%", bridgeDays, c.Change*100) }
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.TopProducts) > 0 {
+		fmt.Fprintf(&b, "## Top Products\n")
+		for _, kv := range k.TopProducts {
+			fmt.Fprintf(&b, "- %s: %s\n", kv.Key, money(kv.Value))
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.TopByLTV) > 0 {
+		fmt.Fprintf(&b, "## Top Customers by LTV\n")
+		for _, c := range k.TopByLTV {
+			fmt.Fprintf(&b, "- %s: projected %s (%s over %d orders", c.Customer, money(c.ProjectedLTV), money(c.Revenue), c.Orders)
+			if c.AvgGapDays > 0 { fmt.Fprintf(&b, ", every %.0f days", c.AvgGapDays) }
+			fmt.Fprintln(&b, ")")
+		}
+		fmt.Fprintln(&b)
+	}
+	if series, _ := seriesFor(&k, granularity); granularity == "week" || granularity == "month" {
+		fmt.Fprintf(&b, "## Revenue by %s\n", granularity)
+		layout := "2006-01"
+		if granularity == "week" { layout = "week of 2006-01-02" }
+		for _, p := range series {
+			fmt.Fprintf(&b, "- %s: %s\n", p.Day.Format(layout), money(p.Value))
+		}
+		fmt.Fprintln(&b)
+	}
+	if f := k.Forecast; f != nil {
+		fmt.Fprintf(&b, "## Forecast (next %d days)\n", len(f.Days))
+		if f.Method == "holt-winters" {
+			fmt.Fprintf(&b, "Holt-Winters with weekly seasonality (α=%.2f, β=%.2f, γ=%.2f); ranges are ~95%% bands.\n\n", f.Alpha, f.Beta, f.Gamma)
+		} else {
+			fmt.Fprintf(&b, "Trailing %d-day average (under two weeks of history); ranges are ~95%% bands.\n\n", forecastWindow)
+		}
+		if c := f.Capped; c != nil && len(c.Days) > 0 {
+			var days []string
+			for _, d := range c.Days { days = append(days, d.Day.Format("2006-01-02")+" "+money(d.Value)) }
+			fmt.Fprintf(&b, "Inputs winsorized at the %.0fth percentile (%s – %s); adjusted %s on %s.\n\n", c.Percentile*100, money(c.Low), money(c.High), money(c.Adjustment), strings.Join(days, ", "))
+		}
+		if len(f.Holidays) > 0 {
+			var effs []string
+			for _, e := range f.Holidays {
+				t := fmt.Sprintf("%s ×%.2f", e.Title, e.Factor)
+				if e.Occurrences > 0 { t += fmt.Sprintf(" from %d past occurrence(s)", e.Occurrences) } else { t += " (" + e.Kind + " average)" }
+				var days []string
+				for _, d := range e.Days { days = append(days, d.Format("2006-01-02")) }
+				if len(days) > 0 { t += ", applied to " + strings.Join(days, ", ") }
+				effs = append(effs, t)
+			}
+			fmt.Fprintf(&b, "Holidays & promotions: %s.\n\n", strings.Join(effs, "; "))
+		}
+		for _, d := range f.Days {
+			fmt.Fprintf(&b, "- %s: %s (%s – %s)\n", d.Day.Format("Mon 2006-01-02"), money(d.Value), money(d.Low), money(d.High))
+		}
+		fmt.Fprintln(&b)
+	}
+	if t := k.ForecastTracking; t != nil {
+		fmt.Fprintf(&b, "## Forecast vs Actual\n")
+		fmt.Fprintf(&b, "MAPE %.0f%%; band ±%.0f%%.\n\n", t.MAPE*100, t.Band*100)
+		for _, w := range t.Weeks {
+			fmt.Fprintf(&b, "- Week of %s: forecast %s, actual %s (%+.0f%%)", w.Day.Format("2006-01-02"), money(w.Forecast), money(w.Actual), w.Error*100)
+			if w.Breach { fmt.Fprintf(&b, " ⚠️") }
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Anomalies) > 0 {
+		fmt.Fprintf(&b, "## Anomalies\n")
+		fmt.Fprintf(&b, "Detector: %s (%s).\n\n", k.AnomalyMethod.Algorithm, paramList(k.AnomalyMethod.Params))
+		for _, a := range k.Anomalies {
+			fmt.Fprintf(&b, "- %s: %s (z=%.2f)", a.Day.Format("2006-01-02"), money(a.Value), a.Z)
+			if len(a.Campaigns) > 0 {
+				fmt.Fprintf(&b, " — campaign start: %s", strings.Join(a.Campaigns, ", "))
+			}
+			if len(a.Events) > 0 {
+				fmt.Fprintf(&b, " — coincides with %s", strings.Join(a.Events, "; "))
+			}
+			if a.Restated {
+				fmt.Fprintf(&b, " _(restated since last alert)_")
+			}
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Events) > 0 {
+		fmt.Fprintf(&b, "## Events\n")
+		for _, e := range k.Events {
+			fmt.Fprintf(&b, "- %s", e.Date)
+			if e.End != "" { fmt.Fprintf(&b, " → %s", e.End) }
+			fmt.Fprintf(&b, ": %s\n", e.Label())
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.SegmentAnomalies) > 0 {
+		fmt.Fprintf(&b, "## Segment Anomalies\n")
+		fmt.Fprintf(&b, "Trailing %d-day revenue per top account and product.\n\n", segmentWindow)
+		for _, a := range k.SegmentAnomalies {
+			fmt.Fprintf(&b, "- %s %s, %s: %s vs %s usual (z=%.2f)", a.Segment, a.Key, a.Day.Format("2006-01-02"), money(a.Value), money(a.Baseline), a.Z)
+			if a.Ongoing { fmt.Fprintf(&b, " — ongoing") }
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.AtRisk) > 0 {
+		fmt.Fprintf(&b, "## At-Risk Customers\n")
+		for _, c := range k.AtRisk {
+			fmt.Fprintf(&b, "- %s: last order %s, %.0f days ago (usually every %.0f days); %s lifetime\n", c.Customer, c.LastOrder.Format("2006-01-02"), c.DaysSince, c.MedianGapDays, money(c.Revenue))
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.KeyAccounts) > 0 {
+		fmt.Fprintf(&b, "## Key Accounts\n")
+		fmt.Fprintf(&b, "Next order at the account's usual cadence; forecast over the next %d days.\n\n", forecastHorizonDays())
+		for _, ka := range k.KeyAccounts {
+			switch {
+			case ka.Orders == 0:
+				fmt.Fprintf(&b, "- %s: no orders in the data\n", ka.Account)
+			case ka.MedianGapDays == 0:
+				fmt.Fprintf(&b, "- %s: %d orders, last %s; too few for a cadence\n", ka.Account, ka.Orders, ka.LastOrder.Format("2006-01-02"))
+			default:
+				fmt.Fprintf(&b, "- %s: next order expected %s (every %.0f days, ~%s); forecast %s", ka.Account, ka.NextOrder.Format("2006-01-02"), ka.MedianGapDays, money(ka.OrderValue), money(ka.Forecast))
+				if ka.Overdue { fmt.Fprintf(&b, " — **overdue %.0f days**", ka.DaysLate) }
+				fmt.Fprintln(&b)
+			}
+		}
+		fmt.Fprintln(&b)
+	}
+	if k.Bridge != nil {
+		fmt.Fprintf(&b, "## Revenue Bridge\n%s\n", bridgeMarkdown(k.Bridge))
+	}
+	if t := k.Tiers; t != nil {
+		fmt.Fprintf(&b, "## Customer Tiers (%s)\n", t.Period)
+		for _, c := range tierCutoffs {
+			fmt.Fprintf(&b, "- %s: %d\n", c.Name, t.Counts[c.Name])
+		}
+		if len(t.Migrations) > 0 {
+			fmt.Fprintf(&b, "\nChanges since %s:\n", t.PrevPeriod)
+			for _, m := range t.Migrations {
+				fmt.Fprintf(&b, "- %s: %s → %s (%s)\n", m.Customer, m.From, nz(m.To, "—"), m.Direction)
+			}
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Territories) > 0 {
+		fmt.Fprintf(&b, "## Quota Attainment\n| # | Territory | Revenue | Quota | Attainment | Pace |\n|---|---|---|---|---|---|\n")
+		for i, t := range k.Territories {
+			flag := ""
+			if t.Behind { flag = " ⚠️" }
+			fmt.Fprintf(&b, "| %d | %s%s | %s | %s | %.1f%% | %.0f%% |\n", i+1, t.Name, flag, money(t.Revenue), money(t.Quota), t.Attainment*100, t.Pace*100)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Targets) > 0 {
+		fmt.Fprintf(&b, "## Targets\n| Target | Period | Revenue | Target | To target | Pace | Projected | Projected %% |\n|---|---|---|---|---|---|---|---|\n")
+		for _, t := range k.Targets {
+			flag := ""
+			if t.Behind { flag = " ⚠️" }
+			fmt.Fprintf(&b, "| %s%s | %s → %s | %s | %s | %.1f%% | %.0f%% | %s | %.0f%% |\n", t.Name, flag, t.PeriodStart.Format("2006-01-02"), t.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02"),
+				money(t.Revenue), money(t.Target), t.Attainment*100, t.Pace*100, money(t.Projected), t.ProjectedAttainment*100)
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Restatements) > 0 {
+		fmt.Fprintf(&b, "## Restatements\n| Day | Old | New | Delta | Changed |\n|---|---|---|---|---|\n")
+		for _, r := range k.Restatements {
+			fmt.Fprintf(&b, "| %s | %s | %s | %+.2f | %s |\n", r.Day.Format("2006-01-02"), money(r.Old), money(r.New), r.Delta, r.ChangedAt.Format("2006-01-02 15:04"))
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Campaigns) > 0 {
+		fmt.Fprintf(&b, "## Campaigns\n| Campaign | Revenue | Orders | AOV | New customers | Spend | ROI |\n|---|---|---|---|---|---|---|\n")
+		for _, c := range k.Campaigns {
+			roi := "—"
+			if c.Spend > 0 { roi = fmt.Sprintf("%.0f%%", c.ROI*100) }
+			fmt.Fprintf(&b, "| %s | %s | %d | %s | %.0f%% | %s | %s |\n", c.Name, money(c.Revenue), c.Orders, money(c.AOV), c.NewCustomerShare*100, money(c.Spend), roi)
+		}
+		fmt.Fprintln(&b)
+	}
+	if f := k.Funnel; f != nil {
+		fmt.Fprintf(&b, "## Lead Funnel\n- Leads: %d\n- Converted: %d (%.1f%%)\n- Median time to first purchase: %.0f days\n\n",
+			f.Leads, f.Converted, f.ConversionRate*100, f.MedianDaysToFirstPurchase)
+		fmt.Fprintf(&b, "| Cohort | Leads | ≤7d | ≤14d | ≤30d | ≤60d | ≤90d |\n|---|---|---|---|---|---|---|\n")
+		for _, c := range f.Cohorts {
+			fmt.Fprintf(&b, "| %s | %d |", c.Month.Format("2006-01"), c.Leads)
+			for _, v := range c.ConvertedWithin {
+				fmt.Fprintf(&b, " %.0f%% |", v*100)
+			}
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if k.OverdueCount > 0 {
+		fmt.Fprintf(&b, "## Overdue / Unpaid\n- Count: %d\n- Total: %s\n", k.OverdueCount, money(k.OverdueTotal))
+		for _, kv := range k.OverdueByAccount {
+			fmt.Fprintf(&b, "- %s: %s\n", kv.Key, money(kv.Value))
+		}
+		fmt.Fprintln(&b)
+	}
+	if r := k.Refunds; r != nil {
+		fmt.Fprintf(&b, "## Refunds\n")
+		fmt.Fprintf(&b, "- Gross revenue: %s\n- Refunds: %s over %d rows (%.1f%% of gross)\n- Net revenue: %s\n- Last 7 days: %s (%.1f%% of gross)\n",
+			money(r.Gross), money(r.Total), r.Count, r.Rate*100, money(r.Net), money(r.Last7), r.Rate7*100)
+		for _, list := range []struct {
+			Title string
+			Items []KVf
+		}{{"products", r.TopProducts}, {"customers", r.TopCustomers}} {
+			var parts []string
+			for _, kv := range list.Items { parts = append(parts, kv.Key+" "+money(kv.Value)) }
+			fmt.Fprintf(&b, "- Most refunded %s: %s\n", list.Title, strings.Join(parts, ", "))
+		}
+		fmt.Fprintln(&b)
+	}
+	if p := k.Pricing; p != nil {
+		fmt.Fprintf(&b, "## Tax, Discounts & Units\n")
+		if p.HasTax { fmt.Fprintf(&b, "- Tax: %s; revenue excluding tax %s\n", money(p.Tax), money(p.NetExTax)) }
+		if p.HasDiscount { fmt.Fprintf(&b, "- Discounts: %s (%.1f%% average discount rate)\n", money(p.Discount), p.DiscountRate*100) }
+		if p.HasQuantity { fmt.Fprintf(&b, "- Units sold: %s%s at %s per %s\n", strconv.FormatFloat(p.Units, 'f', -1, 64), strings.TrimRight(" "+p.Unit, " "), money(p.UnitPrice), nz(p.Unit, "unit")) }
+		fmt.Fprintln(&b)
+	}
+	if r := k.Receivables; r != nil {
+		fmt.Fprintf(&b, "## AR Aging (as of %s)\n", r.AsOf.Format("2006-01-02"))
+		fmt.Fprintf(&b, "Aged by %s. DSO: %.0f days. Average age: %.0f days past due.\n\n", r.Basis, r.DSO, r.AvgAge)
+		if d := r.Drift; d != nil {
+			fmt.Fprintf(&b, "Average age %+.0f days over the last %d analyses (%.0f on %s → %.0f)", d.Change, d.Snapshots, d.From, d.Since.Format("2006-01-02"), d.To)
+			if d.Alert { fmt.Fprintf(&b, " ⚠️ collections are slipping") }
+			fmt.Fprintf(&b, ".\n\n")
+		}
+		fmt.Fprintf(&b, "| Age | Invoices | Amount |\n|---|---:|---:|\n")
+		for _, a := range append([]AgingBucket{r.Current}, r.Buckets...) {
+			if a.Count == 0 && a.Label == r.Current.Label { continue }
+			fmt.Fprintf(&b, "| %s | %d | %s |\n", a.Label, a.Count, money(a.Amount))
+		}
+		fmt.Fprintln(&b)
+	}
+	if len(k.Suggestions) > 0 {
+		fmt.Fprintf(&b, "## Recommendations\n")
+		for _, s := range k.Suggestions {
+			fmt.Fprintf(&b, "- %s", s.Text)
+			if s.Impact > 0 { fmt.Fprintf(&b, " _(~%s: %s)_", money(s.Impact), s.Basis) }
+			fmt.Fprintln(&b)
+		}
+		fmt.Fprintln(&b)
+	}
+	if k.ExecSummary != "" {
+		fmt.Fprintf(&b, "## Executive Summary (AI)\n%s\n\n", k.ExecSummary)
+	}
+	if len(k.Quality) > 0 {
+		fmt.Fprintf(&b, "## Data Quality\n")
+		for _, q := range k.Quality {
+			fmt.Fprintf(&b, "- %s: %s\n", q.File, q.Summary())
+			for _, x := range q.Examples {
+				fmt.Fprintf(&b, "  - row %d: %s", x.Row, x.Reason)
+				if x.Value != "" { fmt.Fprintf(&b, " (%q)", x.Value) }
+				fmt.Fprintln(&b)
+			}
+			for _, g := range q.Gaps { fmt.Fprintf(&b, "  - no rows %s → %s (%d days)\n", g.From.Format("2006-01-02"), g.To.Format("2006-01-02"), g.Days) }
+			if len(q.Unused) > 0 { fmt.Fprintf(&b, "  - columns not used: %s\n", strings.Join(q.Unused, ", ")) }
+			if q.DateOrder != "" { fmt.Fprintf(&b, "  - dates read: %s\n", q.DateOrder) }
+		}
+		fmt.Fprintln(&b)
+	}
+	fmt.Fprintf(&b, "## Glossary\n")
+	for _, d := range metricDefs(defaultDataset) { // reports cover the default dataset
+		fmt.Fprintf(&b, "- **%s:** %s", d.Name, d.Definition)
+		if len(d.Params) > 0 {
+			fmt.Fprintf(&b, " _(%s)_", paramList(d.Params))
+		}
+		fmt.Fprintln(&b)
+	}
+	return b.String()
+}
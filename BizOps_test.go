@@ -0,0 +1,892 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multipartRequest is a multipart upload of a one-row CSV, sent with method to path.
+func multipartRequest(method, path string) *http.Request {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, _ := mw.CreateFormFile("file", "x.csv")
+	io.WriteString(fw, "date,customer,product,amount\n2025-01-01,Mallory,Widget,1000000\n")
+	mw.WriteField("wait", "1")
+	mw.WriteField("id", "x")
+	mw.Close()
+	r := httptest.NewRequest(method, path, &b)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// demoServer publishes the demo data and returns the demo's handler.
+func demoServer(t *testing.T) http.Handler {
+	t.Helper()
+	demoMode = true
+	t.Cleanup(func() { demoMode = false })
+	if _, err := publishAnalysis(context.Background(), shared, demoSales(time.Now().UTC().Truncate(24*time.Hour)), nil, nil, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return demoGuard(routes())
+}
+
+// writePaths are the documented write endpoints plus the dashboard's form targets.
+func writePaths() []string {
+	paths := []string{"/upload", "/wizard", "/wizard/columns", "/wizard/analyze", "/session/reset"}
+	for _, op := range apiOps {
+		if op.Method == http.MethodGet || readPosts[op.Path] { continue }
+		paths = append(paths, strings.NewReplacer("{id}", "x", "{name}", "x").Replace(op.Path))
+	}
+	return paths
+}
+
+func TestDemoRejectsWrites(t *testing.T) {
+	h := demoServer(t)
+	for _, path := range writePaths() {
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, multipartRequest(method, path))
+			if w.Code != http.StatusForbidden { t.Errorf("%s %s: got %d, want 403", method, path, w.Code) }
+		}
+	}
+}
+
+func TestDemoGetWithBodyChangesNothing(t *testing.T) {
+	h := demoServer(t)
+	before := shared.view().Snapshot
+	for _, path := range writePaths() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, multipartRequest(http.MethodGet, path))
+		if w.Code == http.StatusAccepted || w.Code == http.StatusCreated { t.Errorf("GET %s: got %d", path, w.Code) }
+		if after := shared.view().Snapshot; after != before { t.Fatalf("GET %s replaced the demo data", path) }
+	}
+}
+
+// TestAliasesConcurrent runs alias changes from the API alongside ingest lookups; run it
+// with -race.
+func TestAliasesConcurrent(t *testing.T) {
+	aliasPath = ""
+	t.Cleanup(func() { aliasPath, aliasMap, aliasHistory = "aliases.json", map[string]string{}, nil })
+	h := routes()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ { canonicalCustomer("Acme Ltd") }
+		done <- true
+	}()
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/aliases?from=Acme+Ltd&to=Acme", nil))
+		if w.Code != http.StatusOK { t.Fatalf("add alias: %d %s", w.Code, w.Body) }
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/aliases/undo", nil))
+	}
+	<-done
+	if got := canonicalCustomer("Acme Ltd"); got != "Acme Ltd" { t.Errorf("after undoing every change: got %q", got) }
+}
+
+// signed returns r with a valid v1 signature over body.
+func signed(r *http.Request, body string) *http.Request {
+	signRequest(r, []byte(body), time.Now())
+	return r
+}
+
+func TestSignatureDoesNotReplaceKey(t *testing.T) {
+	t.Setenv("BIZPULSE_SIGNING_SECRET", "s3cret")
+	t.Setenv("BIZPULSE_API_KEYS", "view:viewer")
+	if err := loadCredentials(""); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { credentials = nil })
+	h := requireAuth(routes())
+	body := "date,customer,product,amount\n2025-01-01,Mallory,Widget,1\n"
+	cases := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"signed ingest, no key", signed(httptest.NewRequest(http.MethodPost, "/api/ingest", strings.NewReader(body)), body), http.StatusUnauthorized},
+		{"signed admin read, no key", signed(httptest.NewRequest(http.MethodGet, "/api/v1/crm", nil), ""), http.StatusUnauthorized},
+		{"signed ingest, viewer key", signed(httptest.NewRequest(http.MethodPost, "/api/ingest", strings.NewReader(body)), body), http.StatusForbidden},
+	}
+	cases[2].r.Header.Set("X-API-Key", "view")
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, c.r)
+		if w.Code != c.want { t.Errorf("%s: got %d, want %d", c.name, w.Code, c.want) }
+	}
+}
+
+func TestSignatureBindsMethodAndPath(t *testing.T) {
+	t.Setenv("BIZPULSE_SIGNING_SECRET", "s3cret")
+	r := signed(httptest.NewRequest(http.MethodPost, "/api/v1/pull", nil), "{}")
+	if err := verifySignature(r, []byte("{}"), time.Now()); err != nil { t.Fatalf("own request: %v", err) }
+	moved := httptest.NewRequest(http.MethodPost, "/api/v1/crm", nil)
+	moved.Header = r.Header
+	if verifySignature(moved, []byte("{}"), time.Now()) == nil { t.Error("signature accepted on another path") }
+	if verifySignature(r, []byte("{}"), time.Now().Add(signatureMaxAge+time.Second)) == nil { t.Error("expired signature accepted") }
+}
+
+func TestPprofListenAddr(t *testing.T) {
+	cases := []struct{ addr, token, want string }{
+		{":6060", "", "localhost:6060"},
+		{"localhost:6060", "", "localhost:6060"},
+		{"127.0.0.1:6060", "", "127.0.0.1:6060"},
+		{"0.0.0.0:6060", "", ""},
+		{"10.0.0.5:6060", "", ""},
+		{"0.0.0.0:6060", "tok", "0.0.0.0:6060"},
+	}
+	for _, c := range cases {
+		t.Setenv("BIZPULSE_PPROF_TOKEN", c.token)
+		got, err := pprofListenAddr(c.addr)
+		if c.want == "" && err == nil { t.Errorf("%s without a token: got %s, want an error", c.addr, got) }
+		if c.want != "" && got != c.want { t.Errorf("%s: got %q (%v), want %q", c.addr, got, err, c.want) }
+	}
+}
+
+func TestExpiredSnapshotIsGone(t *testing.T) {
+	h := routes()
+	for path, want := range map[string]int{
+		"/api/v1/snapshots/0123456789abcdef":           http.StatusGone,
+		"/api/v1/snapshots/0123456789abcdef/artifacts": http.StatusGone,
+		"/api/v1/snapshots/not-an-id":                  http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want { t.Errorf("%s: got %d, want %d", path, w.Code, want) }
+	}
+}
+
+func TestRawDataSheetMatchesCleanExport(t *testing.T) {
+	day := time.Date(2025, 3, 4, 0, 0, 0, 0, time.UTC)
+	sales := []Sale{
+		{Date: day, Customer: "Acme", RawCustomer: "ACME Ltd", Product: "Widget", Amount: 120, Region: "EMEA", Currency: "EUR", OrigAmount: 110, Tax: 20, Quantity: 3, Channel: "online"},
+		{Date: day.AddDate(0, 0, 1), Customer: "Acme", RawCustomer: "Acme", Product: "Widget", Amount: -40, Region: "EMEA"},
+	}
+	sheets := exportWorkbook(KPIs{}, sales)
+	raw := sheets[len(sheets)-1]
+	if raw.Name != "Raw Data" { t.Fatalf("last sheet is %q", raw.Name) }
+	for i, c := range cleanColumns {
+		if raw.Rows[0][i] != c.Name { t.Errorf("column %d: got %v, want %s", i, raw.Rows[0][i], c.Name) }
+	}
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, sheets); err != nil { t.Fatal(err) }
+	got, _, err := parseSalesFile(context.Background(), &buf, "x.xlsx", "Raw Data")
+	if err != nil { t.Fatal(err) }
+	if len(got) != 2 { t.Fatalf("re-read %d rows, want 2", len(got)) }
+	if g := got[0]; g.Region != "EMEA" || g.Currency != "EUR" || g.Quantity != 3 || g.Channel != "online" || !g.Date.Equal(day) {
+		t.Errorf("re-read row: %+v", g)
+	}
+	if got[1].Amount != -40 { t.Errorf("refund row amount: got %v", got[1].Amount) }
+}
+
+// querySales are the rows the SQL tests run against.
+var querySales = []Sale{
+	{Date: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Customer: "Acme", Product: "Widget", Amount: 100, Status: "paid", Region: "EMEA"},
+	{Date: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), Customer: "Acme", Product: "Gadget", Amount: 250, Status: "overdue", Region: "EMEA"},
+	{Date: time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), Customer: "Bolt", Product: "Widget", Amount: 50, Status: "paid", Region: "AMER"},
+	{Date: time.Date(2025, 1, 4, 0, 0, 0, 0, time.UTC), Customer: "Core", Product: "Widget", Amount: -20, Status: "paid", Region: "AMER"},
+}
+
+func TestRunQuery(t *testing.T) {
+	cases := []struct {
+		q, cols, rows, err string
+	}{
+		{q: "SELECT COUNT(*) FROM sales", cols: "[count(*)]", rows: "[[4]]"},
+		{q: "select customer, sum(amount) as total from sales group by customer order by total desc", cols: "[customer total]", rows: "[[Acme 350] [Bolt 50] [Core -20]]"},
+		{q: "SELECT customer FROM sales WHERE amount > 60 AND status = 'overdue'", cols: "[customer]", rows: "[[Acme]]"},
+		{q: "SELECT product FROM sales WHERE NOT (region = 'EMEA' OR amount < 0)", cols: "[product]", rows: "[[Widget]]"},
+		{q: "SELECT customer FROM sales WHERE customer LIKE 'b%'", cols: "[customer]", rows: "[[Bolt]]"},
+		{q: "SELECT date FROM sales WHERE date >= '2025-01-03' ORDER BY date LIMIT 1", cols: "[date]", rows: "[[2025-01-03]]"},
+		{q: "SELECT region, AVG(amount), MIN(amount), MAX(amount) FROM sales GROUP BY region ORDER BY region", cols: "[region avg(amount) min(amount) max(amount)]", rows: "[[AMER 15 -20 50] [EMEA 175 100 250]]"},
+		{q: "SELECT customer, SUM(amount) FROM sales", err: "GROUP BY"},
+		{q: "SELECT nope FROM sales", err: "nope"},
+		{q: "DELETE FROM sales", err: "SELECT"},
+		{q: "SELECT customer FROM sales WHERE amount >", err: ""},
+		// unquoted values that happen to be keywords are values
+		{q: "SELECT customer FROM sales WHERE region = in", cols: "[customer]", rows: "[]"},
+		// SQL the language leaves out is rejected by name
+		{q: "SELECT s.customer FROM sales s JOIN refunds r ON s.invoice = r.invoice", err: "JOIN"},
+		{q: "SELECT customer FROM sales, refunds", err: "only the sales table"},
+		{q: "SELECT customer FROM refunds", err: `unknown table "refunds"`},
+		{q: "SELECT customer FROM sales WHERE amount > (SELECT AVG(amount) FROM sales)", err: "subqueries"},
+		{q: "SELECT customer, SUM(amount) FROM sales GROUP BY customer HAVING SUM(amount) > 100", err: "HAVING"},
+		{q: "SELECT DISTINCT customer FROM sales", err: "DISTINCT"},
+		{q: "SELECT UPPER(customer) FROM sales", err: "function UPPER()"},
+		{q: "SELECT customer FROM sales WHERE region IN ('EMEA', 'AMER')", err: "IN"},
+		{q: "SELECT customer FROM sales WHERE amount BETWEEN 10 AND 60", err: "BETWEEN"},
+		{q: "SELECT customer FROM sales WHERE rep IS NULL", err: "IS [NOT] NULL"},
+		{q: "SELECT customer FROM sales UNION SELECT product FROM sales", err: "UNION"},
+		{q: "SELECT customer FROM sales LIMIT 1 OFFSET 1", err: "OFFSET"},
+		{q: "SELECT customer FROM sales; DROP TABLE sales", err: "one statement"},
+	}
+	for _, c := range cases {
+		res, err := runQuery(context.Background(), querySales, c.q, 0)
+		if c.cols == "" {
+			if err == nil { t.Errorf("%s: want an error, got %v", c.q, res.Rows) } else if !strings.Contains(err.Error(), c.err) { t.Errorf("%s: error %q doesn't mention %q", c.q, err, c.err) }
+			continue
+		}
+		if err != nil { t.Errorf("%s: %v", c.q, err); continue }
+		if got := fmt.Sprint(res.Columns); got != c.cols { t.Errorf("%s: columns %s, want %s", c.q, got, c.cols) }
+		if got := fmt.Sprint(res.Rows); got != c.rows { t.Errorf("%s: rows %s, want %s", c.q, got, c.rows) }
+	}
+}
+
+func TestParseFilterRejectsUnsupportedSQL(t *testing.T) {
+	if _, err := parseFilter("region IN ('EMEA')"); err == nil || !strings.Contains(err.Error(), "IN") { t.Errorf("IN filter: %v", err) }
+	if _, err := parseFilter("amount > 5 AND lower(customer) = 'acme'"); err == nil || !strings.Contains(err.Error(), "LOWER()") { t.Errorf("function in a filter: %v", err) }
+	if e, err := parseFilter("join the club"); err != nil || e == nil { t.Errorf("plain text with a keyword: %v, %v", e, err) }
+}
+
+// gqlShape prints selections as name(args){children}, aliases as alias:name.
+func gqlShape(sels []gqlSel) string {
+	var parts []string
+	for _, s := range sels {
+		p := s.Name
+		if s.Spread != "" { p = "..." + s.Spread }
+		if s.Alias != "" && s.Alias != s.Name { p = s.Alias + ":" + p }
+		if len(s.Args) > 0 {
+			var keys []string
+			for k, v := range s.Args {
+				if name, ok := v.(gqlVar); ok { v = "$" + string(name) }
+				keys = append(keys, fmt.Sprintf("%s=%v", k, v))
+			}
+			sort.Strings(keys)
+			p += "(" + strings.Join(keys, ",") + ")"
+		}
+		if len(s.Sel) > 0 { p += "{" + gqlShape(s.Sel) + "}" }
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseGraphQL(t *testing.T) {
+	cases := []struct {
+		q, shape, err string
+	}{
+		{q: "{ kpis { totalRevenue orders } }", shape: "query: kpis{totalRevenue orders}"},
+		{q: `query Top($n: Int = 5) { customers(limit: $n, sort: "-revenue") { name } }`, shape: "query Top: customers(limit=$n,sort=-revenue){name}"},
+		{q: "{ a: dataset(name: \"emea\") { kpis { orders } } # comment\n}", shape: "query: a:dataset(name=emea){kpis{orders}}"},
+		{q: "query { ...F } fragment F on Query { snapshots { ID } }", shape: "query: ...F"},
+		{q: "mutation { reset }", shape: "mutation: reset"},
+		{q: "{ kpis { orders }", err: "unclosed selection set"},
+		{q: `{ customer(name: "open) { name } }`, err: "unterminated string"},
+		{q: "fragment F on Q { a } fragment F on Q { b } { a }", err: "defined twice"},
+		{q: "", err: "no operation"},
+		{q: "{ kpis % }", err: "unexpected character"},
+	}
+	for _, c := range cases {
+		doc, err := parseGraphQL(c.q)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) { t.Errorf("%q: got error %v, want one mentioning %q", c.q, err, c.err) }
+			continue
+		}
+		if err != nil { t.Errorf("%q: %v", c.q, err); continue }
+		op := doc.Ops[0]
+		got := strings.TrimSpace(op.Kind+" "+op.Name) + ": " + gqlShape(op.Sel)
+		if got != c.shape { t.Errorf("%q: got %s, want %s", c.q, got, c.shape) }
+	}
+}
+
+// testWorkbook is a two-sheet xlsx with shared strings (one in rich-text runs), a
+// built-in and a custom date format, and a number format that isn't a date.
+func testWorkbook(t *testing.T) []byte {
+	t.Helper()
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Notes" sheetId="1" r:id="rId1"/><sheet name="Sales" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Target="worksheets/notes.xml"/><Relationship Id="rId2" Target="/xl/worksheets/data.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>date</t></si><si><r><t>cus</t></r><r><t>tomer</t></r></si><si><t>Acme &amp; Co</t></si></sst>`,
+		"xl/styles.xml": `<styleSheet><numFmts><numFmt numFmtId="164" formatCode="dd/mm/yyyy"/></numFmts>
+<cellXfs><xf numFmtId="0"/><xf numFmtId="14"/><xf numFmtId="164"/><xf numFmtId="4"/></cellXfs></styleSheet>`,
+		"xl/worksheets/notes.xml": `<worksheet><sheetData><row r="1"><c r="A1" t="inlineStr"><is><t>read me</t></is></c></row></sheetData></worksheet>`,
+		"xl/worksheets/data.xml": `<worksheet><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="inlineStr"><is><t>amount</t></is></c></row>
+<row r="2"><c r="A2" s="1"><v>45000</v></c><c r="B2" t="s"><v>2</v></c><c r="C2" s="3"><v>1234.5</v></c></row>
+<row r="3"><c r="A3" s="2"><v>45001.75</v></c><c r="C3"><v>7</v></c></row>
+<row r="4"><c r="A4" t="inlineStr"><is><t></t></is></c></row>
+</sheetData></worksheet>`,
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range parts {
+		f, err := zw.Create(name)
+		if err != nil { t.Fatal(err) }
+		io.WriteString(f, body)
+	}
+	if err := zw.Close(); err != nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func TestReadXLSX(t *testing.T) {
+	b := testWorkbook(t)
+	cases := []struct {
+		sheet, rows, err string
+	}{
+		{sheet: "Sales", rows: "[[date customer amount] [2023-03-15 Acme & Co 1234.5] [2023-03-16  7]]"},
+		{sheet: "sales", rows: "[[date customer amount] [2023-03-15 Acme & Co 1234.5] [2023-03-16  7]]"},
+		{sheet: "2", rows: "[[date customer amount] [2023-03-15 Acme & Co 1234.5] [2023-03-16  7]]"},
+		{sheet: "", rows: "[[read me]]"},
+		{sheet: "3", err: `sheet "3" not found (have Notes, Sales)`},
+	}
+	for _, c := range cases {
+		rows, err := readXLSX(b, c.sheet)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) { t.Errorf("sheet %q: got error %v, want %q", c.sheet, err, c.err) }
+			continue
+		}
+		if err != nil { t.Errorf("sheet %q: %v", c.sheet, err); continue }
+		if got := fmt.Sprint(rows); got != c.rows { t.Errorf("sheet %q:\n got %s\nwant %s", c.sheet, got, c.rows) }
+	}
+}
+
+// TestExcelSerialDate covers serials from 61 (1900-03-01) on; Excel counts a 29 February
+// 1900 that never was, so earlier serials are a day off and don't occur in sales data.
+func TestExcelSerialDate(t *testing.T) {
+	for serial, want := range map[float64]string{
+		61:       "1900-03-01",
+		45000:    "2023-03-15",
+		45000.99: "2023-03-15",
+		45658:    "2025-01-01",
+	} {
+		if got := excelSerialDate(serial).Format("2006-01-02"); got != want { t.Errorf("%v: got %s, want %s", serial, got, want) }
+	}
+}
+
+func TestDateOrderInference(t *testing.T) {
+	cases := []struct {
+		name, format string
+		dates        []string
+		order        string
+		ambiguous    int
+		read         string
+	}{
+		{"all ambiguous", "", []string{"03/04/2025", "05/06/2025"}, "day first", 2, "[2025-04-03 2025-06-05]"},
+		{"settled month first", "", []string{"03/04/2025", "12/25/2025"}, "month first", 0, "[2025-03-04 2025-12-25]"},
+		{"settled day first", "", []string{"03/04/2025", "25/12/2025"}, "day first", 0, "[2025-04-03 2025-12-25]"},
+		{"mixed", "", []string{"25/12/2025", "12/26/2025", "03/04/2025"}, "mixed", 1, "[2025-12-25 2025-12-26 2025-04-03]"},
+		{"same either way", "", []string{"05/05/2025", "2025-05-06"}, "", 0, "[2025-05-05 2025-05-06]"},
+		{"iso", "", []string{"2025-03-04", "4 Mar 2025"}, "", 0, "[2025-03-04 2025-03-04]"},
+		{"mdy hint", "mdy", []string{"03/04/2025", "05/06/2025"}, "month first", 0, "[2025-03-04 2025-05-06]"},
+		{"dmy hint", "dmy", []string{"03/04/2025", "12/25/2025"}, "day first", 0, "[2025-04-03]"},
+		{"two-digit year", "", []string{"13/01/25", "31/12/68", "01/01/69"}, "day first", 0, "[2025-01-13 2068-12-31 1969-01-01]"},
+	}
+	t.Cleanup(func() { cfg.DateFormat = "" })
+	for _, c := range cases {
+		cfg.DateFormat = c.format
+		csv := "date,customer,product,amount\n"
+		for _, d := range c.dates { csv += d + ",Acme,Widget,10\n" }
+		sales, q, err := parseSalesFile(context.Background(), strings.NewReader(csv), "x.csv", "")
+		if err != nil { t.Errorf("%s: %v", c.name, err); continue }
+		var read []string
+		for _, s := range sales { read = append(read, s.Date.Format("2006-01-02")) }
+		if got := fmt.Sprint(read); got != c.read { t.Errorf("%s: read %s, want %s", c.name, got, c.read) }
+		if q.DateOrder != c.order || q.Ambiguous != c.ambiguous {
+			t.Errorf("%s: order %q with %d ambiguous, want %q with %d", c.name, q.DateOrder, q.Ambiguous, c.order, c.ambiguous)
+		}
+	}
+}
+
+// TestViewerCannotUpload is the regression test for viewers replacing data with a GET
+// carrying an upload body, which roleNeeded lets through as a read.
+func TestViewerCannotUpload(t *testing.T) {
+	t.Setenv("BIZPULSE_API_KEYS", "view:viewer")
+	if err := loadCredentials(""); err != nil { t.Fatal(err) }
+	t.Cleanup(func() { credentials = nil })
+	if _, err := publishAnalysis(context.Background(), shared, demoSales(time.Now().UTC().Truncate(24*time.Hour)), nil, nil, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	h := requireAuth(routes())
+	before := shared.view().Snapshot
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		r := multipartRequest(method, "/upload")
+		r.Header.Set("X-API-Key", "view")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusAccepted || w.Code < 400 { t.Errorf("%s /upload as a viewer: got %d", method, w.Code) }
+		if after := shared.view().Snapshot; after != before { t.Fatalf("%s /upload as a viewer replaced the data", method) }
+	}
+}
+
+// TestConcurrentPublish ingests into the shared dataset and a workspace at once, twice
+// each; run it with -race. The workspace's anomalies mustn't take the shared alert state.
+func TestConcurrentPublish(t *testing.T) {
+	ws, err := workspace("racews", true)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() {
+		workspacesMu.Lock()
+		delete(workspaces, "racews")
+		workspacesMu.Unlock()
+	})
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	done := make(chan error)
+	for _, a := range []*Analysis{shared, ws, shared, ws} {
+		go func(a *Analysis) {
+			_, err := publishAnalysis(context.Background(), a, demoSales(today), nil, nil, false, nil)
+			done <- err
+		}(a)
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-done; err != nil { t.Fatal(err) }
+	}
+	alertedMu.Lock()
+	_, wsAlerted := alertedDays["racews"]
+	alertedMu.Unlock()
+	if wsAlerted { t.Error("a workspace publish recorded alerted days") }
+	if k := ws.view().KPIs; k != nil {
+		for _, an := range k.Anomalies {
+			if an.Reviewed || an.Restated { t.Errorf("workspace anomaly %s marked from the shared dataset's alerts", an.Day.Format("2006-01-02")) }
+		}
+	}
+}
+
+func TestRestatementLogIsCappedAndCopied(t *testing.T) {
+	t.Cleanup(func() { restatementLog = nil })
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := &KPIs{From: day, To: day, DailyRevenue: []KVt{{Day: day, Value: 1}}}
+	for i := 0; i < restatementHistory+10; i++ {
+		recordRestatements(prev, KPIs{DailyRevenue: []KVt{{Day: day, Value: float64(i + 2)}}}, day)
+	}
+	got := restatements()
+	if len(got) != restatementHistory { t.Fatalf("kept %d restatements, want %d", len(got), restatementHistory) }
+	if got[len(got)-1].New != float64(restatementHistory+11) { t.Errorf("newest is %v", got[len(got)-1].New) }
+	got[0].New = -1
+	if restatements()[0].New == -1 { t.Error("restatements() handed out the log itself") }
+}
+
+// TestConcurrentUploads posts uploads to the shared dataset and a workspace at once, with
+// rows that change between posts so the shared restatement log is written too; run it with -race.
+func TestConcurrentUploads(t *testing.T) {
+	t.Cleanup(func() {
+		workspacesMu.Lock()
+		delete(workspaces, "raceup")
+		workspacesMu.Unlock()
+		restatementMu.Lock()
+		restatementLog = nil
+		restatementMu.Unlock()
+	})
+	h := routes()
+	upload := func(path string, amount int) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("file", "x.csv")
+		fmt.Fprintf(fw, "date,customer,product,amount\n2025-01-01,Ann,Widget,%d\n2025-01-02,Bob,Gadget,50\n", amount)
+		mw.WriteField("wait", "1")
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, path, &b)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	for i := 0; i < 6; i++ {
+		path := "/upload"
+		if i%2 == 1 { path = "/upload?dataset=raceup" }
+		go func(path string, amount int) { done <- upload(path, amount) }(path, 100+i)
+	}
+	for i := 0; i < 6; i++ {
+		if w := <-done; w.Code >= 400 { t.Fatalf("upload: %d %s", w.Code, w.Body) }
+	}
+	ws, err := workspace("raceup", false)
+	if err != nil { t.Fatal(err) }
+	if k := ws.view().KPIs; k == nil || len(k.DailyRevenue) != 2 {
+		t.Fatalf("workspace KPIs after concurrent uploads: %+v", k)
+	}
+	if len(restatements()) == 0 { t.Error("shared re-uploads with changed rows recorded no restatements") }
+}
+
+func TestMaxRows(t *testing.T) {
+	defer func(n int) { maxRows = n }(maxRows)
+	maxRows = 2
+	csv := "date,customer,amount\n2025-01-01,Ann,10\n2025-01-02,Bob,20\n2025-01-03,Cy,30\n"
+	if _, _, err := parseCSV(context.Background(), strings.NewReader(csv), 0, nil); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("parseCSV over the limit: %v", err)
+	} else if errorStatus(err, 500) != http.StatusRequestEntityTooLarge || errorKind(err) != "too_large" {
+		t.Errorf("status %d, kind %q", errorStatus(err, 500), errorKind(err))
+	}
+	if _, _, err := parseRecords([][]string{{"date", "amount"}, {"2025-01-01", "1"}, {"2025-01-02", "2"}, {"2025-01-03", "3"}}, nil); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("parseRecords over the limit: %v", err)
+	}
+	// rows left out for want of a date don't count
+	maxRows = 3
+	if sales, _, err := parseCSV(context.Background(), strings.NewReader(csv+",Dee,40\n"), 0, nil); err != nil || len(sales) != 3 {
+		t.Errorf("3 dated rows under a limit of 3: %d sales, %v", len(sales), err)
+	}
+}
+
+func TestRefundOnlyRows(t *testing.T) {
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	sales := []Sale{
+		{Date: day, Customer: "Ann", Product: "Widget", Amount: 100},
+		{Date: day, Customer: "Bob", Product: "Gadget", Amount: -40},
+	}
+	for _, c := range customerRows(sales) {
+		if c.Customer == "Bob" && (c.Orders != 0 || c.AOV != 0) { t.Errorf("refund-only customer: %+v", c) }
+	}
+	for _, p := range productRows(sales) {
+		if p.Product == "Gadget" && (p.Orders != 0 || p.AOV != 0) { t.Errorf("refund-only product: %+v", p) }
+	}
+	for _, rows := range []interface{}{customerRows(sales), productRows(sales)} {
+		w := httptest.NewRecorder()
+		writePage(w, httptest.NewRequest("GET", "/api/customers", nil), "s1", rows, "-Revenue")
+		if w.Code != 200 || !strings.Contains(w.Body.String(), `"AOV":0`) { t.Errorf("%T: %d %s", rows, w.Code, w.Body) }
+	}
+	// rows that can't be encoded fail the request rather than coming back empty
+	w := httptest.NewRecorder()
+	writePage(w, httptest.NewRequest("GET", "/api/products", nil), "s1", []ProductRow{{Product: "Bad", AOV: math.Inf(-1)}}, "")
+	if w.Code != 500 { t.Errorf("unencodable rows: %d %s", w.Code, w.Body) }
+}
+
+func TestWritePage(t *testing.T) {
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := []CustomerRow{}
+	for i, name := range []string{"Ann", "Bob", "Cy", "Dee", "Eve"} {
+		rows = append(rows, CustomerRow{Customer: name, Revenue: float64(10 * (i%3 + 1)), Orders: 1, FirstOrder: day.AddDate(0, 0, -i)})
+	}
+	get := func(snapshot, query string) (*httptest.ResponseRecorder, Page, []string) {
+		w := httptest.NewRecorder()
+		writePage(w, httptest.NewRequest("GET", "/api/customers?"+query, nil), snapshot, rows, "-Revenue")
+		var page struct {
+			Items      []map[string]interface{}
+			NextCursor string
+			Total      int
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		var names []string
+		for _, it := range page.Items { names = append(names, fmt.Sprint(it["Customer"])) }
+		return w, Page{NextCursor: page.NextCursor, Total: page.Total}, names
+	}
+
+	// following NextCursor visits every row once, in sort order (ties keep their order)
+	var seen []string
+	query := "sort=-revenue&limit=2"
+	for pages := 0; ; pages++ {
+		w, page, names := get("s1", query)
+		if w.Code != 200 || page.Total != 5 || pages > 3 { t.Fatalf("%s: %d %s", query, w.Code, w.Body) }
+		seen = append(seen, names...)
+		if page.NextCursor == "" { break }
+		query = "sort=-revenue&limit=2&cursor=" + page.NextCursor
+	}
+	if got := strings.Join(seen, ","); got != "Cy,Bob,Eve,Ann,Dee" { t.Errorf("pages visited %s", got) }
+	if rows[0].Customer != "Ann" { t.Error("sorting reordered the caller's rows") }
+
+	_, first, _ := get("s1", "sort=-revenue&limit=2")
+	for _, c := range []struct {
+		name, snapshot, query string
+		code                  int
+	}{
+		{"republished", "s2", "sort=-revenue&limit=2&cursor=" + first.NextCursor, http.StatusGone},
+		{"other sort", "s1", "sort=customer&limit=2&cursor=" + first.NextCursor, 400},
+		{"other limit", "s1", "sort=-revenue&limit=3&cursor=" + first.NextCursor, 200},
+		{"garbage", "s1", "cursor=bm90LWpzb24", 400},
+		{"offset cursor", "s1", "cursor=" + base64.RawURLEncoding.EncodeToString([]byte("o:2")), 400},
+		{"unknown sort", "s1", "sort=nope", 400},
+		{"bad limit", "s1", "limit=0", 400},
+	} {
+		if w, _, _ := get(c.snapshot, c.query); w.Code != c.code { t.Errorf("%s: %d, want %d (%s)", c.name, w.Code, c.code, w.Body) }
+	}
+
+	// a row that changed under the same snapshot ID no longer matches the cursor's key
+	rows[1].Revenue, rows[2].Revenue = rows[2].Revenue, rows[1].Revenue
+	if w, _, _ := get("s1", "sort=-revenue&limit=2&cursor="+first.NextCursor); w.Code != 400 { t.Errorf("moved row: %d %s", w.Code, w.Body) }
+
+	w := httptest.NewRecorder()
+	writePage(w, httptest.NewRequest("GET", "/api/customers?fields=customer,REVENUE,nope&limit=1", nil), "s1", rows, "-Revenue")
+	if body := strings.TrimSpace(w.Body.String()); !strings.HasPrefix(body, `{"Items":[{"Customer":"Bob","Revenue":30}],"NextCursor":`) {
+		t.Errorf("sparse fields: %s", body)
+	}
+}
+
+func TestKPIsETag(t *testing.T) {
+	h := demoServer(t)
+	get := func(path, inm string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if inm != "" { r.Header.Set("If-None-Match", inm) }
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	from := time.Now().UTC().AddDate(0, 0, -20).Format("2006-01-02")
+	first := get("/api/kpis?from="+from+"&groupby=product", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != 200 || etag == "" { t.Fatalf("first: %d, ETag %q", first.Code, etag) }
+	if w := get("/api/kpis?groupby=product&from="+from, etag); w.Code != http.StatusNotModified {
+		t.Errorf("same query, other order: %d", w.Code)
+	}
+	if w := get("/api/kpis?from="+from, etag); w.Code != 200 { t.Errorf("other query: %d", w.Code) }
+	if w := get("/api/kpis?groupby=nope", "*"); w.Code != 400 { t.Errorf("invalid query answered %d before validating", w.Code) }
+	if w := get("/api/kpis?rateDate=2025-01-01", "*"); w.Code != 400 { t.Errorf("rateDate without currency: %d", w.Code) }
+	if _, err := publishAnalysis(context.Background(), shared, demoSales(time.Now().UTC().Truncate(24*time.Hour)), nil, nil, false, nil); err != nil { t.Fatal(err) }
+	if w := get("/api/kpis?from="+from+"&groupby=product", etag); w.Code != 200 { t.Errorf("after a republish: %d", w.Code) }
+}
+
+// TestJobsAreScoped checks that /api/jobs only shows a caller the jobs of the workspace or
+// session they're looking at.
+func TestJobsAreScoped(t *testing.T) {
+	defer func(on bool) { sessionUploads = on }(sessionUploads)
+	sessionUploads = true
+	t.Cleanup(func() {
+		workspacesMu.Lock()
+		delete(workspaces, "jobsws")
+		workspacesMu.Unlock()
+	})
+	h := routes()
+	serve := func(r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies { r.AddCookie(c) }
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	jobOf := func(w *httptest.ResponseRecorder) string {
+		var j Job
+		if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil || j.ID == "" { t.Fatalf("upload: %d %s", w.Code, w.Body) }
+		return j.ID
+	}
+	wsJob := jobOf(serve(multipartRequest("POST", "/upload?dataset=jobsws")))
+	up := serve(multipartRequest("POST", "/upload"))
+	sessJob := jobOf(up)
+	var session *http.Cookie
+	for _, c := range up.Result().Cookies() {
+		if c.Name == sessionCookie { session = c }
+	}
+	if session == nil { t.Fatal("a session upload set no session cookie") }
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		delete(sessions, session.Value)
+		sessionsMu.Unlock()
+	})
+
+	for _, c := range []struct {
+		name, path string
+		cookies    []*http.Cookie
+		see, hide  string
+	}{
+		{"workspace", "?dataset=jobsws", nil, wsJob, sessJob},
+		{"session", "", []*http.Cookie{session}, sessJob, wsJob},
+		{"shared", "", nil, "", wsJob + sessJob},
+	} {
+		list := serve(httptest.NewRequest("GET", "/api/jobs"+c.path, nil), c.cookies...).Body.String()
+		if c.see != "" && !strings.Contains(list, c.see) { t.Errorf("%s: list misses its job: %s", c.name, list) }
+		for _, id := range []string{wsJob, sessJob} {
+			want := 404
+			if id == c.see { want = 200 }
+			if strings.Contains(c.hide, id) && strings.Contains(list, id) { t.Errorf("%s: list shows job %s", c.name, id) }
+			if w := serve(httptest.NewRequest("GET", "/api/jobs/"+id+c.path, nil), c.cookies...); w.Code != want {
+				t.Errorf("%s: job %s answered %d, want %d", c.name, id, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	defer func(on bool, n int) { sessionUploads, maxSessions = on, n }(sessionUploads, maxSessions)
+	sessionUploads, maxSessions = true, 3
+	sessionsMu.Lock()
+	saved := sessions
+	sessions = map[string]*session{}
+	sessionsMu.Unlock()
+	t.Cleanup(func() {
+		sessionsMu.Lock()
+		sessions = saved
+		sessionsMu.Unlock()
+	})
+	var ids []string
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		if _, err := uploadTarget(w, httptest.NewRequest("POST", "/upload", nil), true); err != nil { t.Fatal(err) }
+		ids = append(ids, w.Result().Cookies()[0].Value)
+		time.Sleep(time.Millisecond) // the first session stays in use
+		r := httptest.NewRequest("POST", "/upload", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: ids[0]})
+		uploadTarget(httptest.NewRecorder(), r, true)
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if len(sessions) != 3 { t.Fatalf("%d sessions kept, want 3", len(sessions)) }
+	for i, id := range ids {
+		_, kept := sessions[id]
+		if want := i == 0 || i >= 3; kept != want { t.Errorf("session %d kept: %v, want %v", i, kept, want) }
+	}
+}
+
+func TestSFTPQuote(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{`/drop/sales.csv`, `"/drop/sales.csv"`},
+		{`my sales.csv`, `"my sales.csv"`},
+		{`say "hi".csv`, `"say \"hi\".csv"`},
+		{`C:\exports\jan.csv`, `"C:\\exports\\jan.csv"`},
+		{`trailing\`, `"trailing\\"`}, // would otherwise escape the closing quote
+		{`both\".csv`, `"both\\\".csv"`}, // a backslash before a quote stays a backslash
+		{`\\server`, `"\\\\server"`},
+	} {
+		if got := sftpQuote(c.in); got != c.want { t.Errorf("sftpQuote(%q) = %s, want %s", c.in, got, c.want) }
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	m := map[string]float64{"revenue": 1500, "orders": 2, "revenue_wow": -0.2, "new_customers_wow": -0.3,
+		"revenue_7d": 70, "refunds_7d": -10, "revenue_prev_7d": 100, "refunds": 0, "health": 40, "overdue_count": 1}
+	cases := []struct {
+		src   string
+		fired bool
+		refs  string
+		err   string
+	}{
+		{src: "revenue_wow < -15% AND new_customers_wow < -20%", fired: true, refs: "[revenue_wow new_customers_wow]"},
+		{src: "revenue_wow < -15% and new_customers_wow < -40%", fired: false, refs: "[revenue_wow new_customers_wow]"},
+		{src: "revenue_wow < -25% OR health < 50", fired: true, refs: "[revenue_wow health]"},
+		{src: "(revenue_7d + refunds_7d) / revenue_prev_7d < 0.8", fired: true, refs: "[revenue_7d refunds_7d revenue_prev_7d]"},
+		{src: "(revenue_wow < -15%) && !(overdue_count > 3)", fired: true, refs: "[revenue_wow overdue_count]"},
+		{src: "revenue > $1,000 || orders >= 3", fired: true, refs: "[revenue orders]"},
+		{src: "revenue / orders == 750", fired: true, refs: "[revenue orders]"},
+		{src: "NOT revenue <> 1500", fired: true, refs: "[revenue]"},
+		{src: "REVENUE - -500 = 2000", fired: true, refs: "[revenue]"},
+		// a ratio over zero is no value, so neither side of a comparison with it fires
+		{src: "revenue / refunds > 0", fired: false, refs: "[revenue refunds]"},
+		{src: "revenue / refunds <= 0", fired: false, refs: "[revenue refunds]"},
+		{src: "", err: "empty condition"},
+		{src: "revenue >", err: "ends early"},
+		{src: "revenue > 5 and", err: "ends early"},
+		{src: "bogus > 1", err: `unknown metric "bogus"`},
+		{src: "revenue 5", err: "expected a comparison"},
+		{src: "revenue > 5 )", err: `unexpected ")"`},
+		{src: "(revenue > 5", err: `expected ")"`},
+	}
+	for _, c := range cases {
+		cond, refs, err := parseRule(c.src)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) { t.Errorf("%q: error %v, want one mentioning %q", c.src, err, c.err) }
+			continue
+		}
+		if err != nil { t.Errorf("%q: %v", c.src, err); continue }
+		if got := cond.eval(m); got != c.fired { t.Errorf("%q: fired %v, want %v", c.src, got, c.fired) }
+		if got := fmt.Sprint(refs); got != c.refs { t.Errorf("%q: reads %s, want %s", c.src, got, c.refs) }
+	}
+}
+
+func TestCompileAlertRules(t *testing.T) {
+	rules := []AlertRule{
+		{When: "revenue_wow < -15% AND revenue_wow > -90%"},
+		{Name: "Refunds", When: "refund_rate > 5%", Severity: "CRITICAL"},
+	}
+	if err := compileAlertRules(rules); err != nil { t.Fatal(err) }
+	if r := rules[0]; r.Name != r.When || r.Severity != "warning" || fmt.Sprint(r.refs) != "[revenue_wow]" {
+		t.Errorf("defaults: name %q, severity %q, refs %v", r.Name, r.Severity, r.refs)
+	}
+	if rules[1].Severity != "critical" { t.Errorf("severity %q not normalized", rules[1].Severity) }
+	for _, c := range []struct {
+		rule AlertRule
+		err  string
+	}{
+		{AlertRule{Name: "Loud", When: "revenue > 1", Severity: "page-me"}, `alertRules[1] "Loud": severity must be`},
+		{AlertRule{When: "revenue >> 1"}, `alertRules[1] "revenue >> 1":`},
+	} {
+		err := compileAlertRules([]AlertRule{{When: "revenue > 1"}, c.rule})
+		if err == nil || !strings.Contains(err.Error(), c.err) { t.Errorf("%+v: error %v, want one starting %q", c.rule, err, c.err) }
+	}
+}
+
+// graphQL runs query against querySales in a workspace and returns the response body.
+func graphQL(t *testing.T, h http.Handler, query, vars string) (int, string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": json.RawMessage(nz(vars, "{}"))})
+	r := httptest.NewRequest(http.MethodPost, "/graphql?dataset=gqltest", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func TestGraphQLExecution(t *testing.T) {
+	ws, err := workspace("gqltest", true)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() {
+		workspacesMu.Lock()
+		delete(workspaces, "gqltest")
+		workspacesMu.Unlock()
+	})
+	if _, err := publishAnalysis(context.Background(), ws, querySales, nil, nil, false, nil); err != nil { t.Fatal(err) }
+	h := routes()
+	cases := []struct {
+		name, query, vars string
+		code              int
+		want              string
+	}{
+		{"listing", `{ customers(limit: 2) { customer revenue } }`, "", 200,
+			`{"data":{"customers":[{"customer":"Acme","revenue":350},{"customer":"Bolt","revenue":50}]}}`},
+		{"variables and sort", `query P($n: Int!) { products(limit: $n, sort: "product") { product } }`, `{"n":1}`, 200,
+			`{"data":{"products":[{"product":"Gadget"}]}}`},
+		{"alias, fragment and typename", `{ top: customers(limit: 1) { ...C __typename } } fragment C on Customer { customer orders }`, "", 200,
+			`{"data":{"top":[{"customer":"Acme","orders":2,"__typename":"Customer"}]}}`},
+		{"directives", `query($x: Boolean = false) { customer(name: "bolt") { customer @include(if: $x) revenue @skip(if: $x) } }`, "", 200,
+			`{"data":{"customer":{"revenue":50}}}`},
+		{"nesting", `{ product(name: "Widget") { buyers(sort: "customer") { customer rows { Amount } } } }`, "", 200,
+			`{"data":{"product":{"buyers":[{"customer":"Acme","rows":[{"Amount":100}]},{"customer":"Bolt","rows":[{"Amount":50}]},{"customer":"Core","rows":[{"Amount":-20}]}]}}}`},
+		{"missing find", `{ customer(name: "Nobody") { customer } }`, "", 200, `{"data":{"customer":null}}`},
+		{"field errors keep the rest", `{ customers(limit: 1) { customer nope } kpis }`, "", 200,
+			`{"data":{"customers":[{"customer":"Acme","nope":null}],"kpis":null},"errors":[{"message":"cannot query field nope on Customer","path":["customers",0,"nope"]},{"message":"kpis is an object: select its fields","path":["kpis"]}]}`},
+		{"bad arguments", `{ customers(limit: 0) { customer } products(color: "red") { product } }`, "", 200,
+			`{"data":{"customers":null,"products":null},"errors":[{"message":"limit must be positive and offset not negative","path":["customers"]},{"message":"unknown argument color on products","path":["products"]}]}`},
+		{"required variable", `query($n: Int!) { customers(limit: $n) { customer } }`, "", 400, `{"data":null,"errors":[{"message":"variable $n is required"}]}`},
+		{"mutation", `mutation { reset }`, "", 400, `{"data":null,"errors":[{"message":"mutation isn't supported: the GraphQL API is read-only"}]}`},
+		{"syntax", `{ customers {`, "", 400, `{"data":null,"errors":[{"message":"syntax: unclosed selection set"}]}`},
+	}
+	for _, c := range cases {
+		code, body := graphQL(t, h, c.query, c.vars)
+		if code != c.code || body != c.want { t.Errorf("%s: %d %s\nwant %d %s", c.name, code, body, c.code, c.want) }
+	}
+}
+
+func TestRoleNeeded(t *testing.T) {
+	for _, c := range []struct{ method, path, want string }{
+		{"GET", "/api/kpis", "viewer"},
+		{"HEAD", "/api/kpis", "viewer"},
+		{"GET", "/api/v1/alert-rules", "viewer"}, // reading an admin endpoint is a read
+		{"POST", "/graphql", "viewer"},           // takes POST, only reads
+		{"POST", "/upload", "analyst"},
+		{"POST", "/api/ingest", "analyst"},
+		{"DELETE", "/api/aliases", "analyst"},
+		{"POST", "/api/v1/alert-rules", "admin"},
+		{"DELETE", "/api/v1/alert-rules", "admin"},
+		{"POST", "/api/v1/crm", "admin"},
+		{"PUT", "/api/v1/outbound/decision", "admin"},
+	} {
+		if got := roleNeeded(c.method, c.path); got != c.want { t.Errorf("%s %s needs %s, want %s", c.method, c.path, got, c.want) }
+	}
+}
+
+func TestSignedRead(t *testing.T) {
+	routes() // registers the signed paths
+	t.Setenv("BIZPULSE_SIGNING_SECRET", "s3cret")
+	moved := httptest.NewRequest(http.MethodGet, "/api/v1/ingest", nil)
+	moved.Header = signed(httptest.NewRequest(http.MethodGet, "/api/ingest", nil), "").Header
+	for _, c := range []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"signed read of a signed path", signed(httptest.NewRequest(http.MethodGet, "/api/ingest", nil), ""), true},
+		{"unsigned", httptest.NewRequest(http.MethodGet, "/api/ingest", nil), false},
+		{"signed write", signed(httptest.NewRequest(http.MethodPost, "/api/ingest", nil), ""), false},
+		{"signed read of an admin path", signed(httptest.NewRequest(http.MethodGet, "/api/v1/crm", nil), ""), false},
+		{"signed read of an unsigned path", signed(httptest.NewRequest(http.MethodGet, "/api/kpis", nil), ""), false},
+		{"signature for another path", moved, false},
+	} {
+		if got := signedRead(c.r); got != c.want { t.Errorf("%s: %v, want %v", c.name, got, c.want) }
+	}
+	r := signed(httptest.NewRequest(http.MethodGet, "/api/ingest", nil), "")
+	t.Setenv("BIZPULSE_SIGNING_SECRET", "")
+	if signedRead(r) { t.Error("a signature counted with no signing secret set") }
+}